@@ -13,7 +13,7 @@ import (
 
 // Send daily anonymized ping to measure a rough user count.
 // Drawbridge will send a different ping value each day.
-func DAUPing(db *persistence.SQLiteRepository) error {
+func DAUPing(db persistence.ConfigRepository) error {
 	client := &http.Client{
 		Timeout: time.Second * 10,
 		Transport: &http.Transport{
@@ -1,23 +1,40 @@
 package ui
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"html"
 	"imdawon/drawbridge/cmd/analytics"
+	"imdawon/drawbridge/cmd/dashboard/ui/qrcode"
 	"imdawon/drawbridge/cmd/dashboard/ui/templates"
 	"imdawon/drawbridge/cmd/drawbridge"
+	"imdawon/drawbridge/cmd/drawbridge/anomaly"
+	"imdawon/drawbridge/cmd/drawbridge/backup"
+	"imdawon/drawbridge/cmd/drawbridge/declarative"
+	"imdawon/drawbridge/cmd/drawbridge/emissary"
+	"imdawon/drawbridge/cmd/drawbridge/emissary/authorization"
+	"imdawon/drawbridge/cmd/drawbridge/network"
 	"imdawon/drawbridge/cmd/drawbridge/persistence"
+	"imdawon/drawbridge/cmd/drawbridge/replication"
 	"imdawon/drawbridge/cmd/drawbridge/services"
+	"imdawon/drawbridge/cmd/drawbridge/sinks"
 	flagger "imdawon/drawbridge/cmd/flags"
+	certificates "imdawon/drawbridge/cmd/reverse_proxy/ca"
+	"io"
 	"log"
 	"log/slog"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
 	"runtime"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -34,7 +51,9 @@ var decoder = schema.NewDecoder()
 type Controller struct {
 	DrawbridgeAPI     *drawbridge.Drawbridge
 	ProtectedServices []services.ProtectedService
-	DB                *persistence.SQLiteRepository
+	DB                persistence.Repository
+	// Set when Drawbridge runs with an authoritative configuration file.
+	ConfigDrift *declarative.DriftDetector
 }
 
 func (f *Controller) SetUp(hostAndPort string) error {
@@ -55,6 +74,8 @@ func (f *Controller) SetUp(hostAndPort string) error {
 	r.Use(middleware.Logger)
 	// Use gzip
 	r.Use(middleware.Compress(5, "gzip"))
+	r.Use(f.rejectEditsOnStandby)
+	r.Use(f.checkConfigDriftAfterEdits)
 
 	r.Get("/admin/get/emissary/bundle", func(w http.ResponseWriter, r *http.Request) {
 		r.ParseForm()
@@ -105,7 +126,8 @@ func (f *Controller) SetUp(hostAndPort string) error {
 	// The two most likely options that come to mind are going all in on sqlite for all data persistence,
 	// or writing to a file with some format like JSON.
 	r.Post("/admin/post/config", func(w http.ResponseWriter, r *http.Request) {
-		r.ParseForm()
+		// The form is multipart when the Drawbridge admin uploads their own certificate authority.
+		r.ParseMultipartForm(maxCertificateAuthorityUploadSize)
 		newSettings := drawbridge.Settings{}
 		decoder.Decode(&newSettings, r.Form)
 
@@ -116,13 +138,45 @@ func (f *Controller) SetUp(hostAndPort string) error {
 			newSettings.ListenerAddress = "127.0.0.1"
 		}
 
+		importedCA, err := parseCertificateAuthorityUpload(r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "<span class=\"error-response\">Unable to import certificate authority: %s. Please try again.<span>", err)
+			return
+		}
+
+		if newSettings.CertificateAuthorityKeyAlgorithm != "" {
+			_, err = certificates.ParseKeyAlgorithm(newSettings.CertificateAuthorityKeyAlgorithm)
+			if err == nil {
+				err = f.DB.CreateNewDrawbridgeConfigSettings("key_algorithm_ca", newSettings.CertificateAuthorityKeyAlgorithm)
+			}
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, "<span class=\"error-response\">Error saving certificate authority key algorithm: %s. Please try again.<span>", err)
+				return
+			}
+		}
+
 		newListeningAddress := strings.TrimSpace(newSettings.ListenerAddress)
-		err := f.DB.CreateNewDrawbridgeConfigSettings("listening_address", newListeningAddress)
+		err = f.DB.CreateNewDrawbridgeConfigSettings("listening_address", newListeningAddress)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			fmt.Fprintf(w, "<span class=\"error-response\">Error saving listening address. Please try again.<span>")
 		}
 
+		// The server certificate needs the listening address, so we import the certificate authority once it's saved.
+		if importedCA != nil {
+			err = f.DrawbridgeAPI.ImportCertificateAuthority(importedCA)
+			if err != nil {
+				slog.Error("error importing certificate authority", slog.Any("error", err))
+				// Undo the listening address so the Drawbridge admin goes through onboarding again.
+				f.DB.DeleteDrawbridgeConfigSetting("listening_address")
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprintf(w, "<span class=\"error-response\">Unable to import certificate authority: %s. Please reload and try again.<span>", err)
+				return
+			}
+		}
+
 		f.DrawbridgeAPI.ListeningAddress = newListeningAddress
 
 		err = f.DB.CreateNewDrawbridgeConfigSettings("dau_ping_enabled", strconv.FormatBool(newSettings.EnableDAUPing))
@@ -139,6 +193,10 @@ func (f *Controller) SetUp(hostAndPort string) error {
 		// Now that have a listening address we can generate our certificate authority and start our other
 		// services that require the CA to operate, like the mTLS reverse proxy.
 		go f.DrawbridgeAPI.SetUpCAAndDependentServices(f.ProtectedServices)
+		f.DrawbridgeAPI.RecordAdminAction(sinks.TypeSettingsUpdated, adminActor(r), map[string]string{
+			"listening_address": newListeningAddress,
+			"dau_ping_enabled":  strconv.FormatBool(newSettings.EnableDAUPing),
+		})
 		w.WriteHeader(http.StatusOK)
 		fmt.Fprintf(w, "%s:%d", newSettings.ListenerAddress, f.DrawbridgeAPI.ListeningPort)
 	})
@@ -169,6 +227,23 @@ func (f *Controller) SetUp(hostAndPort string) error {
 			return
 		}
 
+		retention := drawbridge.EventRetention{}
+		decoder.Decode(&retention, r.Form)
+		err = f.DrawbridgeAPI.SaveEventRetention(retention)
+		if err != nil {
+			slog.Error("Event Retention", slog.Any("Error saving event retention", err))
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "<span class=\"error-response\">Error saving event retention: %s<span>", err)
+			return
+		}
+		f.DrawbridgeAPI.RecordAdminAction(sinks.TypeSettingsUpdated, adminActor(r), map[string]string{
+			"listening_address":            f.DrawbridgeAPI.ListeningAddress,
+			"dau_ping_enabled":             strconv.FormatBool(newSettings.EnableDAUPing),
+			"event_retention_days":         strconv.Itoa(retention.EventDays),
+			"hourly_rollup_retention_days": strconv.Itoa(retention.HourlyRollupDays),
+			"daily_rollup_retention_days":  strconv.Itoa(retention.DailyRollupDays),
+		})
+
 		w.WriteHeader(http.StatusOK)
 		fmt.Fprintf(w, "%s:%d", newSettings.ListenerAddress, f.DrawbridgeAPI.ListeningPort)
 	})
@@ -195,7 +270,7 @@ func (f *Controller) SetUp(hostAndPort string) error {
 				w.WriteHeader(http.StatusInternalServerError)
 				fmt.Fprintf(w, "<span class=\"error-response\">Error parsing required data to configure Drawbridge settings. Please try again.<span>")
 			}
-			templates.GetOnboardingModalConfigure(f.DrawbridgeAPI.ListeningAddress, dauPingEnabledValue).Render(r.Context(), w)
+			templates.GetOnboardingModalConfigure(f.DrawbridgeAPI.ListeningAddress, dauPingEnabledValue, f.DrawbridgeAPI.EventRetention()).Render(r.Context(), w)
 		}
 	})
 
@@ -208,14 +283,22 @@ func (f *Controller) SetUp(hostAndPort string) error {
 		if strings.TrimSpace(newService.Host) == "localhost" {
 			newService.Host = "127.0.0.1"
 		}
+		rules, err := f.parseServiceNetworkRules(r.Form)
+		if err != nil {
+			f.renderServices(w, r, fmt.Sprintf("Error adding service: %s", err))
+			return
+		}
+		newService.NetworkRules = rules
 		newServiceWithId, err := f.DB.CreateNewService(newService)
 		if err != nil {
-			slog.Error("error creating new protected service: %w", err)
+			slog.Error("error creating new protected service", slog.Any("error", err))
+		} else {
+			f.DrawbridgeAPI.RecordAdminAction(sinks.TypeServiceCreated, adminActor(r), serviceDetails(*newServiceWithId))
 		}
 
 		services, err := f.DB.GetAllServices()
 		if err != nil {
-			slog.Error("Could not get all protected services: %s", err)
+			slog.Error("Could not get all protected services", slog.Any("error", err))
 		}
 		templates.GetServices(services).Render(r.Context(), w)
 
@@ -238,14 +321,22 @@ func (f *Controller) SetUp(hostAndPort string) error {
 		}
 		id, err := strconv.Atoi(idString)
 		if err != nil {
-			slog.Error("Error converting idString %s to int %d: %s", idString, id, err)
+			slog.Error("Error converting service id to int", slog.String("id", idString), slog.Any("error", err))
 		}
 
 		service, err := f.DB.GetServiceById(int64(id))
 		if err != nil {
-			slog.Error("Could not get service: %s", err)
+			slog.Error("Could not get service", slog.Any("error", err))
+		}
+		policies, err := f.DB.GetAllPolicies()
+		if err != nil {
+			slog.Error("Could not get all policies", slog.Any("error", err))
+		}
+		schedules, err := f.DB.GetAllSchedules()
+		if err != nil {
+			slog.Error("Could not get all schedules", slog.Any("error", err))
 		}
-		templates.EditService(service).Render(r.Context(), w)
+		templates.EditService(service, policies, schedules).Render(r.Context(), w)
 	})
 
 	r.Patch("/service/{id}/edit", f.handleEditService)
@@ -253,170 +344,1729 @@ func (f *Controller) SetUp(hostAndPort string) error {
 	r.Get("/services", func(w http.ResponseWriter, r *http.Request) {
 		services, err := f.DB.GetAllServices()
 		if err != nil {
-			slog.Error("Could not get all services: %s", err)
+			slog.Error("Could not get all services", slog.Any("error", err))
 		}
 		templates.GetServices(services).Render(r.Context(), w)
 	})
 
-	r.Get("/emissary/get/clients", func(w http.ResponseWriter, r *http.Request) {
-		clients, err := f.DB.GetAllEmissaryClients()
+	r.Get("/admin/get/policies", func(w http.ResponseWriter, r *http.Request) {
+		f.renderPolicies(w, r, "")
+	})
+
+	r.Get("/admin/get/policies/options", func(w http.ResponseWriter, r *http.Request) {
+		policies, err := f.DB.GetAllPolicies()
 		if err != nil {
-			slog.Error("error getting all emissary clients: %w", err)
+			slog.Error("Could not get all policies", slog.Any("error", err))
 		}
+		templates.PolicyOptions(policies, 0).Render(r.Context(), w)
+	})
 
-		var deviceIDs []any
-		for _, client := range clients {
-			deviceIDs = append(deviceIDs, client.ID)
+	r.Post("/admin/post/policies", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		policy, err := parsePolicyForm(r.Form)
+		if err == nil {
+			policy, err = f.DrawbridgeAPI.SavePolicy(*policy)
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			f.renderPolicies(w, r, fmt.Sprintf("Error adding policy: %s", err))
+			return
+		}
+		f.DrawbridgeAPI.RecordAdminAction(sinks.TypePolicyCreated, adminActor(r), policyDetails(policy))
+		f.renderPolicies(w, r, "")
+	})
+
+	r.Get("/admin/get/policies/{id}/edit", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "Unable to get policy with an invalid id")
+			return
+		}
+		policy, err := f.DB.GetPolicyById(id)
+		if err != nil {
+			slog.Error("Could not get policy", slog.Any("error", err))
+		}
+		schedules, err := f.DB.GetAllSchedules()
+		if err != nil {
+			slog.Error("Could not get all schedules", slog.Any("error", err))
 		}
+		templates.EditPolicy(policy, schedules).Render(r.Context(), w)
+	})
 
-		latestClientEvents, err := f.DB.GetLatestEventForEachDeviceId(deviceIDs)
+	r.Patch("/admin/patch/policies/{id}", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "Unable to edit policy with an invalid id")
+			return
+		}
+		policy, err := parsePolicyForm(r.Form)
+		if err == nil {
+			policy.ID = id
+			policy, err = f.DrawbridgeAPI.SavePolicy(*policy)
+		}
 		if err != nil {
-			slog.Error("error getting latest client events: %w", err)
+			w.WriteHeader(http.StatusBadRequest)
+			f.renderPolicies(w, r, fmt.Sprintf("Error updating policy: %s", err))
+			return
 		}
-		templates.GetAllEmissaryClients(clients, latestClientEvents).Render(r.Context(), w)
+		f.DrawbridgeAPI.RecordAdminAction(sinks.TypePolicyUpdated, adminActor(r), policyDetails(policy))
+		f.renderPolicies(w, r, "")
 	})
 
-	r.Post("/emissary/post/client/{id}/revoke_certificate", func(w http.ResponseWriter, r *http.Request) {
+	r.Delete("/admin/delete/policies/{id}", func(w http.ResponseWriter, r *http.Request) {
 		idString := chi.URLParam(r, "id")
-		if idString == "" {
+		id, err := strconv.ParseInt(idString, 10, 64)
+		if err == nil {
+			err = f.DB.DeletePolicy(id)
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			f.renderPolicies(w, r, fmt.Sprintf("Error deleting policy: %s", err))
+			return
+		}
+		f.DrawbridgeAPI.RecordAdminAction(sinks.TypePolicyDeleted, adminActor(r), map[string]string{"policy_id": idString})
+		f.renderPolicies(w, r, "")
+	})
+
+	r.Get("/admin/get/schedules", func(w http.ResponseWriter, r *http.Request) {
+		f.renderSchedules(w, r, "")
+	})
+
+	r.Get("/admin/get/schedules/options", func(w http.ResponseWriter, r *http.Request) {
+		schedules, err := f.DB.GetAllSchedules()
+		if err != nil {
+			slog.Error("Could not get all schedules", slog.Any("error", err))
+		}
+		templates.ScheduleOptions(schedules, 0).Render(r.Context(), w)
+	})
+
+	r.Post("/admin/post/schedules", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		schedule, err := parseScheduleForm(r.Form)
+		if err == nil {
+			schedule, err = f.DrawbridgeAPI.SaveSchedule(*schedule)
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			f.renderSchedules(w, r, fmt.Sprintf("Error adding schedule: %s", err))
+			return
+		}
+		f.DrawbridgeAPI.RecordAdminAction(sinks.TypeScheduleCreated, adminActor(r), scheduleDetails(schedule))
+		f.renderSchedules(w, r, "")
+	})
+
+	r.Get("/admin/get/schedules/{id}/edit", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+		if err != nil {
 			w.WriteHeader(http.StatusNotFound)
-			fmt.Fprintf(w, "Unable to revoke device with a blank id")
+			fmt.Fprintf(w, "Unable to get schedule with an invalid id")
+			return
 		}
-		client, event, err := f.DB.RevokeEmissaryClient(idString)
+		schedule, err := f.DB.GetScheduleById(id)
 		if err != nil {
-			slog.Error("error revoking emissary client: %w", err)
-			fmt.Fprintf(w, "error revoking device")
+			slog.Error("Could not get schedule", slog.Any("error", err))
 		}
-		// Add cert to CRL
-		hash := sha256.Sum256([]byte(client.DrawbridgeCertificate))
-		hexHash := hex.EncodeToString(hash[:])
-		f.DrawbridgeAPI.CA.RevokeCertInCertificateRevocationList(hexHash)
+		templates.EditSchedule(schedule).Render(r.Context(), w)
+	})
 
-		templates.GetEmissaryClient(client, event).Render(r.Context(), w)
+	r.Patch("/admin/patch/schedules/{id}", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "Unable to edit schedule with an invalid id")
+			return
+		}
+		schedule, err := parseScheduleForm(r.Form)
+		if err == nil {
+			schedule.ID = id
+			schedule, err = f.DrawbridgeAPI.SaveSchedule(*schedule)
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			f.renderSchedules(w, r, fmt.Sprintf("Error updating schedule: %s", err))
+			return
+		}
+		f.DrawbridgeAPI.RecordAdminAction(sinks.TypeScheduleUpdated, adminActor(r), scheduleDetails(schedule))
+		f.renderSchedules(w, r, "")
 	})
 
-	r.Post("/emissary/post/client/{id}/unrevoke_certificate", func(w http.ResponseWriter, r *http.Request) {
+	r.Delete("/admin/delete/schedules/{id}", func(w http.ResponseWriter, r *http.Request) {
 		idString := chi.URLParam(r, "id")
-		if idString == "" {
-			w.WriteHeader(http.StatusNotFound)
-			fmt.Fprintf(w, "Unable to revoke device with a blank id")
+		id, err := strconv.ParseInt(idString, 10, 64)
+		if err == nil {
+			err = f.DB.DeleteSchedule(id)
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			f.renderSchedules(w, r, fmt.Sprintf("Error deleting schedule: %s", err))
+			return
+		}
+		f.DrawbridgeAPI.RecordAdminAction(sinks.TypeScheduleDeleted, adminActor(r), map[string]string{"schedule_id": idString})
+		f.renderSchedules(w, r, "")
+	})
+
+	r.Get("/admin/get/grants", func(w http.ResponseWriter, r *http.Request) {
+		f.renderGrants(w, r, "")
+	})
+
+	r.Post("/admin/post/grants", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		grant, err := parseGrantForm(r.Form)
+		if err == nil {
+			grant, err = f.DrawbridgeAPI.SaveGrant(*grant)
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			f.renderGrants(w, r, fmt.Sprintf("Error adding grant: %s", err))
+			return
 		}
+		f.DrawbridgeAPI.RecordAdminAction(sinks.TypeGrantCreated, adminActor(r), grantDetails(grant))
+		f.renderGrants(w, r, "")
+	})
 
-		client, event, err := f.DB.UnRevokeEmissaryClient(idString)
+	r.Delete("/admin/delete/grants/{id}", func(w http.ResponseWriter, r *http.Request) {
+		idString := chi.URLParam(r, "id")
+		id, err := strconv.ParseInt(idString, 10, 64)
+		if err == nil {
+			err = f.DB.DeleteGrant(id)
+		}
 		if err != nil {
-			slog.Error("error unrevoking emissary client: %w", err)
+			w.WriteHeader(http.StatusBadRequest)
+			f.renderGrants(w, r, fmt.Sprintf("Error removing grant: %s", err))
+			return
 		}
-		// Remove cert from CRL
-		hash := sha256.Sum256([]byte(client.DrawbridgeCertificate))
-		hexHash := hex.EncodeToString(hash[:])
-		f.DrawbridgeAPI.CA.UnRevokeCertInCertificateRevocationList(hexHash)
+		f.DrawbridgeAPI.RecordAdminAction(sinks.TypeGrantDeleted, adminActor(r), map[string]string{"grant_id": idString})
+		f.renderGrants(w, r, "")
+	})
 
-		templates.GetEmissaryClient(client, event).Render(r.Context(), w)
+	r.Get("/admin/get/ip_bans", func(w http.ResponseWriter, r *http.Request) {
+		f.renderIPBans(w, r, "")
 	})
 
-	// FOr testing, so we can access the html files we create
-	workDir, _ := os.Getwd()
-	if flagger.FLAGS.Env == "development" {
-		filesDir := http.Dir(filepath.Join(workDir, "./cmd/dashboard/ui/static"))
-		FileServer(r, "/", filesDir)
-	} else {
-		ex, err := os.Executable()
+	r.Delete("/admin/delete/ip_bans/{ip}", func(w http.ResponseWriter, r *http.Request) {
+		ip, err := url.PathUnescape(chi.URLParam(r, "ip"))
+		if err == nil {
+			err = f.DrawbridgeAPI.UnbanIP(ip)
+		}
 		if err != nil {
-			log.Fatal(err)
+			w.WriteHeader(http.StatusBadRequest)
+			f.renderIPBans(w, r, fmt.Sprintf("Error lifting the ban: %s", err))
+			return
 		}
-		dir := path.Dir(ex)
-		filesDir := http.Dir(fmt.Sprintf("%s/static", dir))
-		FileServer(r, "/", filesDir)
-	}
+		f.DrawbridgeAPI.RecordAdminAction(sinks.TypeIPUnbanned, adminActor(r), map[string]string{"ip": ip})
+		f.renderIPBans(w, r, "")
+	})
 
-	// Serve the ui / api.
-	srv := &http.Server{
-		Handler: r,
-		Addr:    hostAndPort,
-		// Good practice: enforce timeouts for servers you create!
-		WriteTimeout: 15 * time.Second,
-		ReadTimeout:  15 * time.Second,
-	}
+	r.Get("/admin/get/quarantine", func(w http.ResponseWriter, r *http.Request) {
+		f.renderQuarantine(w, r, "")
+	})
 
-	log.Fatal(srv.ListenAndServe())
-	return nil
-}
+	r.Post("/admin/post/quarantine/{id}/release", func(w http.ResponseWriter, r *http.Request) {
+		deviceID := chi.URLParam(r, "id")
+		err := f.DrawbridgeAPI.ReleaseDevice(deviceID)
+		if err != nil {
+			slog.Error("Quarantine", slog.Any("Error releasing device", err))
+			w.WriteHeader(http.StatusBadRequest)
+			f.renderQuarantine(w, r, fmt.Sprintf("Error releasing the device: %s", err))
+			return
+		}
+		f.DrawbridgeAPI.RecordAdminAction(sinks.TypeDeviceReleased, adminActor(r), map[string]string{"device_id": deviceID})
+		f.renderQuarantine(w, r, "")
+	})
 
-func (f *Controller) handleGetService(w http.ResponseWriter, r *http.Request) {
-	idString := chi.URLParam(r, "id")
-	if idString == "" {
-		w.WriteHeader(http.StatusNotFound)
-		fmt.Fprintf(w, "Unable to get service with a blank id")
-	}
-	id, err := strconv.Atoi(idString)
-	if err != nil {
-		slog.Error("Error converting idString %s to int %d: %s", idString, id, err)
-	}
+	// Revokes a quarantined device and takes it out of quarantine, since revocation already keeps it out.
+	r.Post("/admin/post/quarantine/{id}/revoke", func(w http.ResponseWriter, r *http.Request) {
+		deviceID := chi.URLParam(r, "id")
+		_, _, err := f.setDeviceRevoked(r, deviceID, true)
+		if err == nil {
+			err = f.DrawbridgeAPI.ReleaseDevice(deviceID)
+		}
+		if err != nil {
+			slog.Error("Quarantine", slog.Any("Error revoking device", err))
+			w.WriteHeader(http.StatusBadRequest)
+			f.renderQuarantine(w, r, fmt.Sprintf("Error revoking the device: %s", err))
+			return
+		}
+		f.renderQuarantine(w, r, "")
+	})
 
-	service, err := f.DB.GetServiceById(int64(id))
-	if err != nil {
-		slog.Error("Could not get service: %s", err)
-	}
-	templates.GetService(service).Render(r.Context(), w)
-}
+	r.Get("/admin/get/anomaly_settings", func(w http.ResponseWriter, r *http.Request) {
+		templates.GetAnomalySettings(f.DrawbridgeAPI.AnomalySettings(), "").Render(r.Context(), w)
+	})
 
-func (f *Controller) handleEditService(w http.ResponseWriter, r *http.Request) {
-	r.ParseForm()
-	idString := chi.URLParam(r, "id")
-	if idString == "" {
-		w.WriteHeader(http.StatusNotFound)
-		fmt.Fprintf(w, "Unable to edit service with a blank id")
-	}
-	id, err := strconv.Atoi(idString)
-	if err != nil {
-		slog.Error("Error converting idString %s to int %d: %s", idString, id, err)
-	}
+	r.Post("/admin/post/anomaly_settings", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		settings := anomaly.Settings{}
+		err := decoder.Decode(&settings, r.Form)
+		if err == nil {
+			err = f.DrawbridgeAPI.SaveAnomalySettings(settings)
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			templates.GetAnomalySettings(f.DrawbridgeAPI.AnomalySettings(), fmt.Sprintf("Error saving anomaly detection: %s", err)).Render(r.Context(), w)
+			return
+		}
+		f.DrawbridgeAPI.RecordAdminAction(sinks.TypeSettingsUpdated, adminActor(r), map[string]string{
+			"anomaly_detection":  strconv.FormatBool(settings.Enabled),
+			"anomaly_quarantine": strconv.FormatBool(settings.Quarantine),
+			"anomaly_threshold":  strconv.Itoa(settings.Threshold),
+		})
+		templates.GetAnomalySettings(settings, "").Render(r.Context(), w)
+	})
 
-	newService := services.ProtectedService{}
-	decoder.Decode(&newService, r.Form)
-	newService.ID = int64(id)
+	r.Get("/admin/get/lockdown", func(w http.ResponseWriter, r *http.Request) {
+		f.renderLockdown(w, r, "")
+	})
 
-	err = f.DB.UpdateService(&newService, int64(id))
-	if err != nil {
-		slog.Error("Could not update service: %s", err)
-	}
+	r.Get("/admin/get/standby_banner", func(w http.ResponseWriter, r *http.Request) {
+		role, err := replication.GetRole(f.DB)
+		if err != nil {
+			slog.Error("Replication", slog.Any("Error reading replication role", err))
+			return
+		}
+		templates.GetStandbyBanner(role).Render(r.Context(), w)
+	})
 
-	go f.DrawbridgeAPI.AddNewProtectedService(newService)
-	if err != nil {
-		slog.Error("Failed to start Protected Service after it was edited by a Drawbridge admin: %s", err)
-	}
-	services, err := f.DB.GetAllServices()
-	if err != nil {
-		slog.Error("Could not get all services: %s", err)
-	}
-	templates.GetServices(services).Render(r.Context(), w)
-}
+	r.Get("/admin/get/lockdown_banner", func(w http.ResponseWriter, r *http.Request) {
+		current, err := f.DB.GetLockdown()
+		if err != nil {
+			slog.Error("Lockdown", slog.Any("Error getting lockdown", err))
+			return
+		}
+		templates.GetLockdownBanner(current).Render(r.Context(), w)
+	})
 
-func (f *Controller) handleDeleteService(w http.ResponseWriter, r *http.Request) {
-	idString := chi.URLParam(r, "id")
-	if idString == "" {
-		w.WriteHeader(http.StatusNotFound)
-		fmt.Fprintf(w, "Unable to delete service with a blank id")
-	}
-	id, err := strconv.Atoi(idString)
-	if err != nil {
-		slog.Error("Error converting idString %s to int %d: %s", idString, id, err)
-	}
-	err = f.DB.DeleteService(id)
-	if err != nil {
-		slog.Error("Could not delete service from database: %s", err)
-		// TODO
-		// render error deleting service template here.
-	}
-	f.DrawbridgeAPI.StopRunningProtectedService(int64(id))
-	if err != nil {
-		slog.Error(err.Error())
-	}
-	services, err := f.DB.GetAllServices()
-	if err != nil {
-		slog.Error("Could not get all services: %s", err)
-	}
-	templates.GetServices(services).Render(r.Context(), w)
+	r.Post("/admin/post/lockdown/engage", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		err := f.DrawbridgeAPI.EngageLockdown(adminActor(r), strings.TrimSpace(r.Form.Get("lockdown-reason")))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			f.renderLockdown(w, r, fmt.Sprintf("Error engaging lockdown: %s", err))
+			return
+		}
+		f.renderLockdown(w, r, "")
+	})
+
+	r.Post("/admin/post/lockdown/lift", func(w http.ResponseWriter, r *http.Request) {
+		err := f.DrawbridgeAPI.LiftLockdown(adminActor(r))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			f.renderLockdown(w, r, fmt.Sprintf("Error lifting lockdown: %s", err))
+			return
+		}
+		f.renderLockdown(w, r, "")
+	})
+
+	r.Post("/admin/post/lockdown/break_glass", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		err := f.DrawbridgeAPI.SaveBreakGlassDevices(r.Form["break-glass"])
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			f.renderLockdown(w, r, fmt.Sprintf("Error saving the break-glass devices: %s", err))
+			return
+		}
+		f.DrawbridgeAPI.RecordAdminAction(sinks.TypeSettingsUpdated, adminActor(r), map[string]string{"lockdown_break_glass": strings.Join(f.DrawbridgeAPI.BreakGlassDevices(), ",")})
+		f.renderLockdown(w, r, "")
+	})
+
+	r.Get("/admin/get/jit_requests", func(w http.ResponseWriter, r *http.Request) {
+		f.renderJITRequests(w, r, "")
+	})
+
+	r.Post("/admin/post/jit_requests/{id}/approve", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+		if err == nil {
+			var minutes int
+			minutes, err = strconv.Atoi(r.Form.Get("jit-duration-minutes"))
+			if err != nil {
+				err = errors.New("pick how long to approve the request for")
+			} else {
+				_, err = f.DrawbridgeAPI.ApproveJITRequest(id, time.Duration(minutes)*time.Minute, adminActor(r))
+			}
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			f.renderJITRequests(w, r, fmt.Sprintf("Error approving request: %s", err))
+			return
+		}
+		f.renderJITRequests(w, r, "")
+	})
+
+	r.Post("/admin/post/jit_requests/{id}/deny", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+		if err == nil {
+			_, err = f.DrawbridgeAPI.DenyJITRequest(id, adminActor(r))
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			f.renderJITRequests(w, r, fmt.Sprintf("Error denying request: %s", err))
+			return
+		}
+		f.renderJITRequests(w, r, "")
+	})
+
+	r.Get("/admin/get/access_simulation", func(w http.ResponseWriter, r *http.Request) {
+		f.renderAccessSimulation(w, r, templates.AccessSimulationForm{}, nil, "")
+	})
+
+	// Decides whether a device would be let in to a Protected Service, without it connecting. Responds with the
+	// JSON encoded authorization.Decision when asked for JSON, e.g. by a script, and the simulator otherwise.
+	r.Post("/admin/post/access_simulation", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		form, request, err := parseAccessSimulationForm(r.Form)
+		wantsJSON := strings.Contains(r.Header.Get("Accept"), "application/json")
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			if wantsJSON {
+				fmt.Fprint(w, err)
+				return
+			}
+			f.renderAccessSimulation(w, r, form, nil, fmt.Sprintf("Error simulating access: %s", err))
+			return
+		}
+		decision := f.DrawbridgeAPI.SimulateAccess(request)
+		if wantsJSON {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(decision)
+			return
+		}
+		f.renderAccessSimulation(w, r, form, &decision, "")
+	})
+
+	r.Get("/admin/get/network_rules", func(w http.ResponseWriter, r *http.Request) {
+		f.renderNetworkRules(w, r, "")
+	})
+
+	r.Post("/admin/post/network_rules", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		rules, err := parseNetworkRules(r.Form.Get("network-rules"))
+		if err == nil {
+			err = f.DrawbridgeAPI.SaveNetworkRules(rules)
+		}
+		if err != nil {
+			f.renderNetworkRules(w, r, fmt.Sprintf("Error saving the network rules: %s", err))
+			return
+		}
+		f.DrawbridgeAPI.RecordAdminAction(sinks.TypeSettingsUpdated, adminActor(r), map[string]string{"network_rules": templates.NetworkRulesText(f.DrawbridgeAPI.NetworkRules())})
+		f.renderNetworkRules(w, r, "")
+	})
+
+	r.Post("/admin/post/geoip_databases", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		paths := strings.Fields(r.Form.Get("geoip-databases"))
+		err := f.DrawbridgeAPI.SaveGeoIPDatabases(paths)
+		if err != nil {
+			f.renderNetworkRules(w, r, fmt.Sprintf("Error saving the GeoIP databases: %s", err))
+			return
+		}
+		f.DrawbridgeAPI.RecordAdminAction(sinks.TypeSettingsUpdated, adminActor(r), map[string]string{drawbridge.GeoIPDatabasesSetting: strings.Join(paths, "\n")})
+		f.renderNetworkRules(w, r, "")
+	})
+
+	r.Get("/emissary/get/clients", func(w http.ResponseWriter, r *http.Request) {
+		f.renderFleet(w, r, parseFleetFilter(r.URL.Query()), "")
+	})
+
+	r.Get("/emissary/get/groups/options", func(w http.ResponseWriter, r *http.Request) {
+		groups, err := f.DrawbridgeAPI.DeviceGroups()
+		if err != nil {
+			slog.Error("error getting device groups", slog.Any("error", err))
+		}
+		templates.FleetGroupOptions(groups, r.URL.Query().Get("fleet-group")).Render(r.Context(), w)
+	})
+
+	r.Get("/emissary/get/client/{id}/groups", func(w http.ResponseWriter, r *http.Request) {
+		client, err := f.DB.GetEmissaryClientById(chi.URLParam(r, "id"))
+		if err != nil || client == nil || client.ID == "" {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "<span class=\"error-response\">Device not found.<span>")
+			return
+		}
+		templates.GetEmissaryClientGroups(client, false, "").Render(r.Context(), w)
+	})
+
+	r.Patch("/emissary/patch/client/{id}/groups", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		client, err := f.DB.GetEmissaryClientById(chi.URLParam(r, "id"))
+		if err != nil || client == nil || client.ID == "" {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "<span class=\"error-response\">Device not found.<span>")
+			return
+		}
+		updated, err := f.DrawbridgeAPI.SetDeviceGroupsAndTags(client.ID, strings.Split(r.Form.Get("device-groups"), ","), strings.Split(r.Form.Get("device-tags"), ","))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			templates.GetEmissaryClientGroups(client, false, fmt.Sprintf("Error saving the groups and tags: %s", err)).Render(r.Context(), w)
+			return
+		}
+		f.DrawbridgeAPI.RecordAdminAction(sinks.TypeDeviceUpdated, adminActor(r), deviceLabelDetails(updated))
+		templates.GetEmissaryClientGroups(updated, true, "").Render(r.Context(), w)
+	})
+
+	r.Get("/emissary/get/client/{id}/posture", func(w http.ResponseWriter, r *http.Request) {
+		client, err := f.DB.GetEmissaryClientById(chi.URLParam(r, "id"))
+		if err != nil || client == nil || client.ID == "" {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "<span class=\"error-response\">Device not found.<span>")
+			return
+		}
+		reports, err := f.DB.GetPostureHistory(client.ID, emissary.MaxPostureHistory)
+		if err != nil {
+			slog.Error("error getting device posture history", slog.Any("error", err))
+		}
+		templates.GetEmissaryClientPosture(client, reports, f.DrawbridgeAPI.PostureMaxAge()).Render(r.Context(), w)
+	})
+
+	r.Get("/admin/get/posture_settings", func(w http.ResponseWriter, r *http.Request) {
+		templates.GetPostureSettings(f.DrawbridgeAPI.PostureMaxAge(), "").Render(r.Context(), w)
+	})
+
+	r.Post("/admin/post/posture_settings", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		hours, err := strconv.Atoi(r.Form.Get("posture-max-age-hours"))
+		if err == nil {
+			err = f.DrawbridgeAPI.SavePostureMaxAge(time.Duration(hours) * time.Hour)
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			templates.GetPostureSettings(f.DrawbridgeAPI.PostureMaxAge(), fmt.Sprintf("Error saving the posture max age: %s", err)).Render(r.Context(), w)
+			return
+		}
+		maxAge := f.DrawbridgeAPI.PostureMaxAge()
+		f.DrawbridgeAPI.RecordAdminAction(sinks.TypeSettingsUpdated, adminActor(r), map[string]string{"posture_max_age": maxAge.String()})
+		templates.GetPostureSettings(maxAge, "").Render(r.Context(), w)
+	})
+
+	r.Get("/emissary/get/client/{id}/totp", func(w http.ResponseWriter, r *http.Request) {
+		client, err := f.DB.GetEmissaryClientById(chi.URLParam(r, "id"))
+		if err != nil || client == nil || client.ID == "" {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "<span class=\"error-response\">Device not found.<span>")
+			return
+		}
+		f.renderTOTP(w, r, client, "", "")
+	})
+
+	r.Post("/emissary/post/client/{id}/totp", func(w http.ResponseWriter, r *http.Request) {
+		client, err := f.DB.GetEmissaryClientById(chi.URLParam(r, "id"))
+		if err != nil || client == nil || client.ID == "" {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "<span class=\"error-response\">Device not found.<span>")
+			return
+		}
+		_, _, err = f.DrawbridgeAPI.EnrollTOTP(client.ID)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			f.renderTOTP(w, r, client, "", fmt.Sprintf("Error enrolling the device: %s", err))
+			return
+		}
+		f.renderTOTP(w, r, client, "Scan the QR code with the authenticator app, then enter a code from it.", "")
+	})
+
+	r.Post("/emissary/post/client/{id}/totp/confirm", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		client, err := f.DB.GetEmissaryClientById(chi.URLParam(r, "id"))
+		if err != nil || client == nil || client.ID == "" {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "<span class=\"error-response\">Device not found.<span>")
+			return
+		}
+		_, err = f.DrawbridgeAPI.ConfirmTOTP(client.ID, r.Form.Get("totp-code"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			f.renderTOTP(w, r, client, "", fmt.Sprintf("Error confirming the enrollment: %s", err))
+			return
+		}
+		f.DrawbridgeAPI.RecordAdminAction(sinks.TypeTOTPEnrolled, adminActor(r), map[string]string{"device_id": client.ID})
+		f.renderTOTP(w, r, client, "The device is enrolled in step-up authentication.", "")
+	})
+
+	r.Post("/emissary/post/client/{id}/totp/unlock", func(w http.ResponseWriter, r *http.Request) {
+		client, err := f.DB.GetEmissaryClientById(chi.URLParam(r, "id"))
+		if err != nil || client == nil || client.ID == "" {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "<span class=\"error-response\">Device not found.<span>")
+			return
+		}
+		err = f.DrawbridgeAPI.UnlockTOTP(client.ID)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			f.renderTOTP(w, r, client, "", fmt.Sprintf("Error unlocking the device: %s", err))
+			return
+		}
+		f.DrawbridgeAPI.RecordAdminAction(sinks.TypeTOTPUnlocked, adminActor(r), map[string]string{"device_id": client.ID})
+		f.renderTOTP(w, r, client, "The device can try step-up codes again.", "")
+	})
+
+	r.Delete("/emissary/delete/client/{id}/totp", func(w http.ResponseWriter, r *http.Request) {
+		client, err := f.DB.GetEmissaryClientById(chi.URLParam(r, "id"))
+		if err != nil || client == nil || client.ID == "" {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "<span class=\"error-response\">Device not found.<span>")
+			return
+		}
+		err = f.DrawbridgeAPI.RemoveTOTP(client.ID)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			f.renderTOTP(w, r, client, "", fmt.Sprintf("Error removing the enrollment: %s", err))
+			return
+		}
+		f.DrawbridgeAPI.RecordAdminAction(sinks.TypeTOTPRemoved, adminActor(r), map[string]string{"device_id": client.ID})
+		f.renderTOTP(w, r, client, "", "")
+	})
+
+	r.Get("/admin/get/step_up_settings", func(w http.ResponseWriter, r *http.Request) {
+		templates.GetStepUpSettings(f.DrawbridgeAPI.StepUpCache(), "").Render(r.Context(), w)
+	})
+
+	r.Post("/admin/post/step_up_settings", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		minutes, err := strconv.Atoi(r.Form.Get("step-up-cache-minutes"))
+		if err == nil {
+			err = f.DrawbridgeAPI.SaveStepUpCache(time.Duration(minutes) * time.Minute)
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			templates.GetStepUpSettings(f.DrawbridgeAPI.StepUpCache(), fmt.Sprintf("Error saving the step-up cache: %s", err)).Render(r.Context(), w)
+			return
+		}
+		cache := f.DrawbridgeAPI.StepUpCache()
+		f.DrawbridgeAPI.RecordAdminAction(sinks.TypeSettingsUpdated, adminActor(r), map[string]string{"step_up_cache": cache.String()})
+		templates.GetStepUpSettings(cache, "").Render(r.Context(), w)
+	})
+
+	r.Get("/emissary/get/client/{id}/usage", func(w http.ResponseWriter, r *http.Request) {
+		client, err := f.DB.GetEmissaryClientById(chi.URLParam(r, "id"))
+		if err != nil || client == nil {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "<span class=\"error-response\">Device not found.<span>")
+			return
+		}
+		rollups, err := f.DB.GetDailyUsageForDevice(client.ID, time.Now().AddDate(0, 0, -29))
+		if err != nil {
+			slog.Error("error getting device usage", slog.Any("error", err))
+		}
+		// Daily rollups are per Protected Service, so add them up into one bar per day.
+		var days []emissary.EventRollup
+		for _, rollup := range rollups {
+			if len(days) == 0 || !days[len(days)-1].Bucket.Equal(rollup.Bucket) {
+				days = append(days, emissary.EventRollup{DeviceID: rollup.DeviceID, Bucket: rollup.Bucket})
+			}
+			day := &days[len(days)-1]
+			day.Connections += rollup.Connections
+			day.BytesIn += rollup.BytesIn
+			day.BytesOut += rollup.BytesOut
+			// Unique IPs can't be added up across services, so show the busiest service's count.
+			day.UniqueIPs = max(day.UniqueIPs, rollup.UniqueIPs)
+		}
+		templates.GetEmissaryClientUsage(client, days).Render(r.Context(), w)
+	})
+
+	// The event log, with its filters taken from the query string.
+	r.Get("/emissary/get/events", func(w http.ResponseWriter, r *http.Request) {
+		f.handleGetEventLog(w, r, false)
+	})
+
+	// The rows for one page of the event log, after a filter changes or the Drawbridge admin loads more.
+	r.Get("/emissary/get/events/page", func(w http.ResponseWriter, r *http.Request) {
+		f.handleGetEventLog(w, r, true)
+	})
+
+	r.Get("/admin/get/config_drift", func(w http.ResponseWriter, r *http.Request) {
+		if f.ConfigDrift == nil {
+			return
+		}
+		templates.GetConfigDrift(f.ConfigDrift.Path, f.ConfigDrift.Drift()).Render(r.Context(), w)
+	})
+
+	r.Get("/admin/get/event_sinks", func(w http.ResponseWriter, r *http.Request) {
+		f.renderEventSinks(w, r, "")
+	})
+
+	r.Post("/admin/post/event_sinks", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		config, err := parseEventSinkForm(r.Form)
+		if err == nil {
+			err = f.updateEventSinks(r, func(configs []sinks.Config) []sinks.Config {
+				return append(configs, config)
+			})
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			f.renderEventSinks(w, r, fmt.Sprintf("Error adding event sink: %s", err))
+			return
+		}
+		f.renderEventSinks(w, r, "")
+	})
+
+	r.Post("/admin/post/event_sinks/{id}/{action:enable|disable}", func(w http.ResponseWriter, r *http.Request) {
+		id, disabled := chi.URLParam(r, "id"), chi.URLParam(r, "action") == "disable"
+		err := f.updateEventSinks(r, func(configs []sinks.Config) []sinks.Config {
+			for i := range configs {
+				if configs[i].ID == id {
+					configs[i].Disabled = disabled
+				}
+			}
+			return configs
+		})
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			f.renderEventSinks(w, r, fmt.Sprintf("Error updating event sink: %s", err))
+			return
+		}
+		f.renderEventSinks(w, r, "")
+	})
+
+	r.Delete("/admin/delete/event_sinks/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id := chi.URLParam(r, "id")
+		err := f.updateEventSinks(r, func(configs []sinks.Config) []sinks.Config {
+			return slices.DeleteFunc(configs, func(config sinks.Config) bool { return config.ID == id })
+		})
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			f.renderEventSinks(w, r, fmt.Sprintf("Error removing event sink: %s", err))
+			return
+		}
+		f.renderEventSinks(w, r, "")
+	})
+
+	r.Post("/emissary/post/client/{id}/revoke_certificate", func(w http.ResponseWriter, r *http.Request) {
+		f.handleSetDeviceRevoked(w, r, true)
+	})
+
+	r.Post("/emissary/post/client/{id}/unrevoke_certificate", func(w http.ResponseWriter, r *http.Request) {
+		f.handleSetDeviceRevoked(w, r, false)
+	})
+
+	// Runs one action on every device matching the Device Fleet filter, then shows the filtered fleet.
+	r.Post("/emissary/post/clients/bulk", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		filter := parseFleetFilter(r.Form)
+		clients, err := f.fleetDevices(filter)
+		if err == nil && filter.Group == "" && filter.Tag == "" {
+			err = errors.New("pick a group or tag to filter the fleet by first")
+		}
+		if err == nil {
+			err = f.runBulkAction(r, clients, r.Form.Get("bulk-action"), strings.TrimSpace(r.Form.Get("bulk-value")))
+		}
+		errorMessage := ""
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			errorMessage = fmt.Sprintf("Error running the bulk action: %s", err)
+		}
+		f.renderFleet(w, r, filter, errorMessage)
+	})
+
+	r.Get("/admin/get/ca", f.handleGetCertificateAuthority)
+
+	// Start rotating the certificate authority. The current certificate authority stays trusted for the
+	// number of days the Drawbridge admin picks, giving Emissary clients time to pick up a new certificate.
+	r.Post("/admin/post/ca/rotate", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		overlapDays, err := strconv.Atoi(r.FormValue("overlap-days"))
+		if err != nil || overlapDays < 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "<span class=\"error-response\">The overlap window must be at least 1 day. Please try again.<span>")
+			return
+		}
+		if f.DrawbridgeAPI.CA == nil {
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprintf(w, "<span class=\"error-response\">The certificate authority hasn't been set up yet.<span>")
+			return
+		}
+		err = f.DrawbridgeAPI.CA.StartRotation(time.Duration(overlapDays) * 24 * time.Hour)
+		if err != nil {
+			slog.Error("error rotating certificate authority", slog.Any("error", err))
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "<span class=\"error-response\">Error rotating certificate authority: %s<span>", err)
+			return
+		}
+		f.DrawbridgeAPI.RecordAdminAction(sinks.TypeCertificateAuthority, adminActor(r), map[string]string{"action": "rotate", "overlap_days": strconv.Itoa(overlapDays)})
+		f.handleGetCertificateAuthority(w, r)
+	})
+
+	// Replace the certificate authority with one the Drawbridge admin already runs.
+	r.Post("/admin/post/ca/import", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseMultipartForm(maxCertificateAuthorityUploadSize)
+		if f.DrawbridgeAPI.CA == nil {
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprintf(w, "<span class=\"error-response\">Finish setting up Drawbridge first, or import your certificate authority during setup.<span>")
+			return
+		}
+		importedCA, err := parseCertificateAuthorityUpload(r)
+		if err == nil && importedCA == nil {
+			err = fmt.Errorf("no certificate chain uploaded")
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "<span class=\"error-response\">Unable to import certificate authority: %s. Please try again.<span>", err)
+			return
+		}
+		err = f.DrawbridgeAPI.ImportCertificateAuthority(importedCA)
+		if err != nil {
+			slog.Error("error importing certificate authority", slog.Any("error", err))
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "<span class=\"error-response\">Unable to import certificate authority: %s<span>", err)
+			return
+		}
+		f.DrawbridgeAPI.RecordAdminAction(sinks.TypeCertificateAuthority, adminActor(r), map[string]string{"action": "import"})
+		f.handleGetCertificateAuthority(w, r)
+	})
+
+	// Download a backup of the database and certificate authority, encrypted if the Drawbridge admin sets a passphrase.
+	r.Post("/admin/post/backup", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		var passphrase []byte
+		if r.FormValue("backup-passphrase") != "" {
+			passphrase = []byte(r.FormValue("backup-passphrase"))
+		}
+		db, ok := f.DB.(backup.Database)
+		if !ok {
+			w.WriteHeader(http.StatusNotImplemented)
+			fmt.Fprintf(w, "<span class=\"error-response\">Backups are only available when Drawbridge stores its data in SQLite.<span>")
+			return
+		}
+		archive := new(bytes.Buffer)
+		_, err := backup.Create(db, archive, passphrase)
+		if err != nil {
+			slog.Error("error creating backup", slog.Any("error", err))
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "<span class=\"error-response\">Error creating backup: %s<span>", err)
+			return
+		}
+		filename := fmt.Sprintf("drawbridge-backup-%s.zip", time.Now().Format("2006-01-02"))
+		if passphrase != nil {
+			filename += ".enc"
+		}
+		f.DrawbridgeAPI.RecordAdminAction(sinks.TypeBackupCreated, adminActor(r), map[string]string{"encrypted": strconv.FormatBool(passphrase != nil)})
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+		w.Write(archive.Bytes())
+	})
+
+	// Pick the key algorithm for each certificate type, and the key algorithm and key encoding for each Emissary Bundle
+	// platform. Existing keys are left alone.
+	r.Post("/admin/post/ca/key_algorithms", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if f.DrawbridgeAPI.CA == nil {
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprintf(w, "<span class=\"error-response\">The certificate authority hasn't been set up yet.<span>")
+			return
+		}
+		settings := certificates.KeyAlgorithmSettings{
+			CertificateAuthority: certificates.KeyAlgorithm(r.FormValue("key-algorithm-ca")),
+			Server:               certificates.KeyAlgorithm(r.FormValue("key-algorithm-server")),
+			Device:               certificates.KeyAlgorithm(r.FormValue("key-algorithm-device")),
+			Platforms:            make(map[string]certificates.KeyAlgorithm),
+			Encodings:            make(map[string]certificates.KeyEncoding),
+		}
+		for _, platform := range certificates.EmissaryPlatforms {
+			algorithm := r.FormValue("key-algorithm-device-" + platform)
+			if algorithm != "" {
+				settings.Platforms[platform] = certificates.KeyAlgorithm(algorithm)
+			}
+			encoding := r.FormValue("key-encoding-device-" + platform)
+			if encoding != "" {
+				settings.Encodings[platform] = certificates.KeyEncoding(encoding)
+			}
+		}
+		err := f.DrawbridgeAPI.CA.SaveKeyAlgorithmSettings(settings)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "<span class=\"error-response\">Error saving key algorithms: %s<span>", err)
+			return
+		}
+		f.DrawbridgeAPI.RecordAdminAction(sinks.TypeCertificateAuthority, adminActor(r), map[string]string{
+			"action":               "key_algorithms",
+			"key_algorithm_ca":     string(settings.CertificateAuthority),
+			"key_algorithm_server": string(settings.Server),
+			"key_algorithm_device": string(settings.Device),
+		})
+		f.handleGetCertificateAuthority(w, r)
+	})
+
+	// Decrypt the certificate authority and server keys with the key passphrase and start accepting Emissary connections.
+	r.Post("/admin/post/ca/unlock", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		passphrase := r.FormValue("key-passphrase")
+		if passphrase == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "<span class=\"error-response\">The key passphrase is blank! Please try again.<span>")
+			return
+		}
+		err := f.DrawbridgeAPI.UnlockCertificateAuthority([]byte(passphrase))
+		if errors.Is(err, certificates.ErrIncorrectKeyPassphrase) {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprintf(w, "<span class=\"error-response\">Incorrect key passphrase. Please try again.<span>")
+			return
+		}
+		if err != nil {
+			slog.Error("error unlocking certificate authority", slog.Any("error", err))
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "<span class=\"error-response\">Error unlocking certificate authority: %s<span>", err)
+			return
+		}
+		f.DrawbridgeAPI.RecordAdminAction(sinks.TypeCertificateAuthority, adminActor(r), map[string]string{"action": "unlock"})
+		f.handleGetCertificateAuthority(w, r)
+	})
+
+	// FOr testing, so we can access the html files we create
+	workDir, _ := os.Getwd()
+	if flagger.FLAGS.Env == "development" {
+		filesDir := http.Dir(filepath.Join(workDir, "./cmd/dashboard/ui/static"))
+		FileServer(r, "/", filesDir)
+	} else {
+		ex, err := os.Executable()
+		if err != nil {
+			log.Fatal(err)
+		}
+		dir := path.Dir(ex)
+		filesDir := http.Dir(fmt.Sprintf("%s/static", dir))
+		FileServer(r, "/", filesDir)
+	}
+
+	// Serve the ui / api.
+	srv := &http.Server{
+		Handler: r,
+		Addr:    hostAndPort,
+		// Good practice: enforce timeouts for servers you create!
+		WriteTimeout: 15 * time.Second,
+		ReadTimeout:  15 * time.Second,
+	}
+
+	log.Fatal(srv.ListenAndServe())
+	return nil
+}
+
+func (f *Controller) handleGetService(w http.ResponseWriter, r *http.Request) {
+	idString := chi.URLParam(r, "id")
+	if idString == "" {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "Unable to get service with a blank id")
+	}
+	id, err := strconv.Atoi(idString)
+	if err != nil {
+		slog.Error("Error converting service id to int", slog.String("id", idString), slog.Any("error", err))
+	}
+
+	service, err := f.DB.GetServiceById(int64(id))
+	if err != nil {
+		slog.Error("Could not get service", slog.Any("error", err))
+	}
+	templates.GetService(service).Render(r.Context(), w)
+}
+
+func (f *Controller) handleEditService(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	idString := chi.URLParam(r, "id")
+	if idString == "" {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "Unable to edit service with a blank id")
+	}
+	id, err := strconv.Atoi(idString)
+	if err != nil {
+		slog.Error("Error converting service id to int", slog.String("id", idString), slog.Any("error", err))
+	}
+
+	newService := services.ProtectedService{}
+	decoder.Decode(&newService, r.Form)
+	newService.ID = int64(id)
+	newService.NetworkRules, err = f.parseServiceNetworkRules(r.Form)
+	if err != nil {
+		f.renderServices(w, r, fmt.Sprintf("Error updating service: %s", err))
+		return
+	}
+
+	err = f.DB.UpdateService(&newService, int64(id))
+	if err != nil {
+		slog.Error("Could not update service", slog.Any("error", err))
+	} else {
+		f.DrawbridgeAPI.RecordAdminAction(sinks.TypeServiceUpdated, adminActor(r), serviceDetails(newService))
+	}
+
+	go f.DrawbridgeAPI.AddNewProtectedService(newService)
+	if err != nil {
+		slog.Error("Failed to start Protected Service after it was edited by a Drawbridge admin", slog.Any("error", err))
+	}
+	services, err := f.DB.GetAllServices()
+	if err != nil {
+		slog.Error("Could not get all services", slog.Any("error", err))
+	}
+	templates.GetServices(services).Render(r.Context(), w)
+}
+
+func (f *Controller) handleDeleteService(w http.ResponseWriter, r *http.Request) {
+	idString := chi.URLParam(r, "id")
+	if idString == "" {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "Unable to delete service with a blank id")
+	}
+	id, err := strconv.Atoi(idString)
+	if err != nil {
+		slog.Error("Error converting service id to int", slog.String("id", idString), slog.Any("error", err))
+	}
+	err = f.DB.DeleteService(id)
+	if err != nil {
+		slog.Error("Could not delete service from database", slog.Any("error", err))
+		// TODO
+		// render error deleting service template here.
+	} else {
+		f.DrawbridgeAPI.RecordAdminAction(sinks.TypeServiceDeleted, adminActor(r), map[string]string{"service_id": idString})
+	}
+	f.DrawbridgeAPI.StopRunningProtectedService(int64(id))
+	if err != nil {
+		slog.Error(err.Error())
+	}
+	services, err := f.DB.GetAllServices()
+	if err != nil {
+		slog.Error("Could not get all services", slog.Any("error", err))
+	}
+	templates.GetServices(services).Render(r.Context(), w)
+}
+
+// Flags Dashboard edits to anything an authoritative configuration file manages.
+// Requests that only read, even though they are POSTs, and so are allowed on a standby.
+var standbyReadRequests = []string{"/admin/post/access_simulation", "/admin/post/backup"}
+
+// A standby's database is replicated from the primary, so the Drawbridge Dashboard can't change anything until
+// the standby is promoted.
+func (f *Controller) rejectEditsOnStandby(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || slices.Contains(standbyReadRequests, r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		err := f.DrawbridgeAPI.CheckWritable()
+		if err != nil {
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprintf(w, "<span class=\"error-response\">%s<span>", html.EscapeString(err.Error()))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (f *Controller) checkConfigDriftAfterEdits(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r)
+		if r.Method != http.MethodGet {
+			f.ConfigDrift.Check()
+		}
+	})
+}
+
+// Who to record as making an admin action from the Drawbridge Dashboard.
+func adminActor(r *http.Request) string {
+	return fmt.Sprintf("%s %s", drawbridge.DashboardActor, r.RemoteAddr)
+}
+
+func serviceDetails(service services.ProtectedService) map[string]string {
+	return map[string]string{
+		"service_id":       strconv.FormatInt(service.ID, 10),
+		"name":             service.Name,
+		"host":             service.Host,
+		"port":             strconv.Itoa(int(service.Port)),
+		"policy_id":        strconv.FormatInt(service.ClientPolicyID, 10),
+		"schedule_id":      strconv.FormatInt(service.ScheduleID, 10),
+		"network_rules":    templates.NetworkRulesText(service.NetworkRules),
+		"require_approval": strconv.FormatBool(service.RequireApproval),
+		"require_step_up":  strconv.FormatBool(service.RequireStepUp),
+	}
+}
+
+func (f *Controller) renderServices(w http.ResponseWriter, r *http.Request, errorMessage string) {
+	if errorMessage != "" {
+		fmt.Fprintf(w, "<li><span class=\"error-response\">%s</span></li>", html.EscapeString(errorMessage))
+	}
+	services, err := f.DB.GetAllServices()
+	if err != nil {
+		slog.Error("Could not get all services", slog.Any("error", err))
+	}
+	templates.GetServices(services).Render(r.Context(), w)
+}
+
+// Reads the source network rules a Protected Service form was sent with, as JSON. An empty field means no rules.
+func (f *Controller) parseServiceNetworkRules(form url.Values) (network.Rules, error) {
+	rules, err := parseNetworkRules(form.Get("service-network-rules"))
+	if err != nil {
+		return rules, err
+	}
+	return rules, f.DrawbridgeAPI.ValidateNetworkRules(&rules)
+}
+
+func parseNetworkRules(text string) (network.Rules, error) {
+	var rules network.Rules
+	if strings.TrimSpace(text) == "" {
+		return rules, nil
+	}
+	decoder := json.NewDecoder(strings.NewReader(text))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&rules)
+	if err != nil {
+		return rules, fmt.Errorf("invalid network rules: %w", err)
+	}
+	return rules, nil
+}
+
+func (f *Controller) renderNetworkRules(w http.ResponseWriter, r *http.Request, errorMessage string) {
+	templates.GetNetworkRules(f.DrawbridgeAPI.NetworkRules(), f.DrawbridgeAPI.GeoIPDatabases(), errorMessage).Render(r.Context(), w)
+}
+
+func policyDetails(policy *authorization.Policy) map[string]string {
+	return map[string]string{
+		"policy_id":   strconv.FormatInt(policy.ID, 10),
+		"name":        policy.Name,
+		"schedule_id": strconv.FormatInt(policy.ScheduleID, 10),
+	}
+}
+
+func scheduleDetails(schedule *authorization.Schedule) map[string]string {
+	return map[string]string{
+		"schedule_id":  strconv.FormatInt(schedule.ID, 10),
+		"name":         schedule.Name,
+		"timezone":     schedule.Timezone,
+		"end_sessions": strconv.FormatBool(schedule.EndSessions),
+	}
+}
+
+func (f *Controller) renderPolicies(w http.ResponseWriter, r *http.Request, errorMessage string) {
+	policies, err := f.DB.GetAllPolicies()
+	if err != nil {
+		slog.Error("Policy", slog.Any("Error getting policies", err))
+		errorMessage = fmt.Sprintf("Error getting policies: %s", err)
+	}
+	protectedServices, err := f.DB.GetAllServices()
+	if err != nil {
+		slog.Error("Policy", slog.Any("Error getting Protected Services", err))
+	}
+	schedules, err := f.DB.GetAllSchedules()
+	if err != nil {
+		slog.Error("Policy", slog.Any("Error getting schedules", err))
+	}
+	templates.GetPolicies(policies, protectedServices, schedules, errorMessage).Render(r.Context(), w)
+}
+
+func (f *Controller) renderSchedules(w http.ResponseWriter, r *http.Request, errorMessage string) {
+	schedules, err := f.DB.GetAllSchedules()
+	if err != nil {
+		slog.Error("Schedule", slog.Any("Error getting schedules", err))
+		errorMessage = fmt.Sprintf("Error getting schedules: %s", err)
+	}
+	protectedServices, err := f.DB.GetAllServices()
+	if err != nil {
+		slog.Error("Schedule", slog.Any("Error getting Protected Services", err))
+	}
+	policies, err := f.DB.GetAllPolicies()
+	if err != nil {
+		slog.Error("Schedule", slog.Any("Error getting policies", err))
+	}
+	templates.GetSchedules(schedules, protectedServices, policies, errorMessage).Render(r.Context(), w)
+}
+
+// Builds a schedule from the add and edit schedule forms. The windows and exceptions are JSON lists.
+func parseScheduleForm(form url.Values) (*authorization.Schedule, error) {
+	schedule := &authorization.Schedule{
+		Name:        strings.TrimSpace(form.Get("schedule-name")),
+		Timezone:    strings.TrimSpace(form.Get("schedule-timezone")),
+		EndSessions: form.Get("schedule-end-sessions") == "true",
+	}
+	for field, list := range map[string]any{"schedule-windows": &schedule.Windows, "schedule-exceptions": &schedule.Exceptions} {
+		value := strings.TrimSpace(form.Get(field))
+		if value == "" {
+			continue
+		}
+		decoder := json.NewDecoder(strings.NewReader(value))
+		decoder.DisallowUnknownFields()
+		err := decoder.Decode(list)
+		if err != nil {
+			return nil, fmt.Errorf("the %s aren't valid JSON: %w", strings.TrimPrefix(field, "schedule-"), err)
+		}
+	}
+	return schedule, nil
+}
+
+// Returns an empty report when the device hasn't sent one.
+func (f *Controller) latestPostureReport(deviceID string) emissary.PostureReport {
+	reports, err := f.DB.GetLatestPostureReports([]string{deviceID})
+	if err != nil {
+		slog.Error("error getting latest posture report", slog.Any("error", err))
+	}
+	return reports[deviceID]
+}
+
+// The group and tag the Device Fleet is filtered by. Empty ones match every device.
+type fleetFilter struct {
+	Group string
+	Tag   string
+}
+
+func parseFleetFilter(values url.Values) fleetFilter {
+	return fleetFilter{
+		Group: strings.TrimSpace(values.Get("fleet-group")),
+		Tag:   strings.TrimSpace(values.Get("fleet-tag")),
+	}
+}
+
+func (filter fleetFilter) matches(client *emissary.EmissaryClient) bool {
+	return (filter.Group == "" || slices.Contains(client.Groups, filter.Group)) &&
+		(filter.Tag == "" || slices.Contains(client.Tags, filter.Tag))
+}
+
+// Describes the filter for the Device Fleet, e.g. "group family and tag laptop".
+func (filter fleetFilter) String() string {
+	var parts []string
+	if filter.Group != "" {
+		parts = append(parts, "group "+filter.Group)
+	}
+	if filter.Tag != "" {
+		parts = append(parts, "tag "+filter.Tag)
+	}
+	return strings.Join(parts, " and ")
+}
+
+func (f *Controller) fleetDevices(filter fleetFilter) ([]*emissary.EmissaryClient, error) {
+	clients, err := f.DB.GetAllEmissaryClients()
+	if err != nil {
+		return nil, err
+	}
+	return slices.DeleteFunc(clients, func(client *emissary.EmissaryClient) bool { return !filter.matches(client) }), nil
+}
+
+func (f *Controller) renderFleet(w http.ResponseWriter, r *http.Request, filter fleetFilter, errorMessage string) {
+	clients, err := f.fleetDevices(filter)
+	if err != nil {
+		slog.Error("error getting all emissary clients", slog.Any("error", err))
+	}
+
+	var deviceIDs []any
+	var postureDeviceIDs []string
+	for _, client := range clients {
+		deviceIDs = append(deviceIDs, client.ID)
+		postureDeviceIDs = append(postureDeviceIDs, client.ID)
+	}
+
+	latestClientEvents, err := f.DB.GetLatestEventForEachDeviceId(deviceIDs)
+	if err != nil {
+		slog.Error("error getting latest client events", slog.Any("error", err))
+	}
+	// The latest events come from the usage rollups, which don't keep where their IPs are.
+	for deviceID, event := range latestClientEvents {
+		f.DrawbridgeAPI.LocateEvent(&event)
+		latestClientEvents[deviceID] = event
+	}
+	posture, err := f.DB.GetLatestPostureReports(postureDeviceIDs)
+	if err != nil {
+		slog.Error("error getting latest posture reports", slog.Any("error", err))
+	}
+	templates.GetAllEmissaryClients(clients, latestClientEvents, posture, f.DrawbridgeAPI.PostureMaxAge(), filter.String(), errorMessage).Render(r.Context(), w)
+}
+
+// Revokes or restores the device in the URL and shows it in the Device Fleet.
+func (f *Controller) handleSetDeviceRevoked(w http.ResponseWriter, r *http.Request, revoked bool) {
+	idString := chi.URLParam(r, "id")
+	if idString == "" {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "Unable to revoke device with a blank id")
+		return
+	}
+	client, event, err := f.setDeviceRevoked(r, idString, revoked)
+	if err != nil {
+		slog.Error("error revoking or restoring emissary client", slog.Any("error", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "error revoking device")
+		return
+	}
+	if event != nil {
+		f.DrawbridgeAPI.LocateEvent(event)
+	}
+	templates.GetEmissaryClient(client, event, f.latestPostureReport(client.ID), f.DrawbridgeAPI.PostureMaxAge()).Render(r.Context(), w)
+}
+
+// Revokes or restores a device, adding its certificate to or removing it from the Certificate Revocation List.
+func (f *Controller) setDeviceRevoked(r *http.Request, deviceID string, revoked bool) (*emissary.EmissaryClient, *emissary.Event, error) {
+	revoke, updateRevocationList, action := f.DB.RevokeEmissaryClient, f.DrawbridgeAPI.CA.RevokeCertInCertificateRevocationList, sinks.TypeDeviceRevoked
+	if !revoked {
+		revoke, updateRevocationList, action = f.DB.UnRevokeEmissaryClient, f.DrawbridgeAPI.CA.UnRevokeCertInCertificateRevocationList, sinks.TypeDeviceUnrevoked
+	}
+	client, event, err := revoke(deviceID)
+	if err != nil {
+		return nil, nil, err
+	}
+	hash := sha256.Sum256([]byte(client.DrawbridgeCertificate))
+	updateRevocationList(hex.EncodeToString(hash[:]))
+	f.DrawbridgeAPI.RecordAdminAction(action, adminActor(r), map[string]string{"device_id": client.ID, "name": client.Name})
+	return client, event, nil
+}
+
+// Runs a Device Fleet bulk action on clients. value is the group or tag to add or remove.
+func (f *Controller) runBulkAction(r *http.Request, clients []*emissary.EmissaryClient, action, value string) error {
+	var labels func(client *emissary.EmissaryClient) (groups, tags []string)
+	switch action {
+	case "revoke", "unrevoke":
+		for _, client := range clients {
+			if (client.Revoked == 1) == (action == "revoke") {
+				continue
+			}
+			_, _, err := f.setDeviceRevoked(r, client.ID, action == "revoke")
+			if err != nil {
+				return fmt.Errorf("%s: %w", client.Name, err)
+			}
+		}
+		return nil
+	case "add_group":
+		labels = func(client *emissary.EmissaryClient) ([]string, []string) {
+			return append(slices.Clone(client.Groups), value), client.Tags
+		}
+	case "remove_group":
+		labels = func(client *emissary.EmissaryClient) ([]string, []string) {
+			return slices.DeleteFunc(slices.Clone(client.Groups), func(group string) bool { return group == value }), client.Tags
+		}
+	case "add_tag":
+		labels = func(client *emissary.EmissaryClient) ([]string, []string) {
+			return client.Groups, append(slices.Clone(client.Tags), value)
+		}
+	case "remove_tag":
+		labels = func(client *emissary.EmissaryClient) ([]string, []string) {
+			return client.Groups, slices.DeleteFunc(slices.Clone(client.Tags), func(tag string) bool { return tag == value })
+		}
+	default:
+		return fmt.Errorf("unknown action %q", action)
+	}
+	if value == "" {
+		return errors.New("enter the group or tag to add or remove")
+	}
+	for _, client := range clients {
+		groups, tags := labels(client)
+		updated, err := f.DrawbridgeAPI.SetDeviceGroupsAndTags(client.ID, groups, tags)
+		if err != nil {
+			return fmt.Errorf("%s: %w", client.Name, err)
+		}
+		f.DrawbridgeAPI.RecordAdminAction(sinks.TypeDeviceUpdated, adminActor(r), deviceLabelDetails(updated))
+	}
+	return nil
+}
+
+func deviceLabelDetails(client *emissary.EmissaryClient) map[string]string {
+	return map[string]string{
+		"device_id": client.ID,
+		"name":      client.Name,
+		"groups":    strings.Join(client.Groups, ","),
+		"tags":      strings.Join(client.Tags, ","),
+	}
+}
+
+func (f *Controller) renderGrants(w http.ResponseWriter, r *http.Request, errorMessage string) {
+	grants, err := f.DB.GetAllGrants()
+	if err != nil {
+		slog.Error("Grant", slog.Any("Error getting grants", err))
+		errorMessage = fmt.Sprintf("Error getting grants: %s", err)
+	}
+	protectedServices, err := f.DB.GetAllServices()
+	if err != nil {
+		slog.Error("Grant", slog.Any("Error getting Protected Services", err))
+	}
+	policies, err := f.DB.GetAllPolicies()
+	if err != nil {
+		slog.Error("Grant", slog.Any("Error getting policies", err))
+	}
+	schedules, err := f.DB.GetAllSchedules()
+	if err != nil {
+		slog.Error("Grant", slog.Any("Error getting schedules", err))
+	}
+	templates.GetGrants(grants, protectedServices, policies, schedules, errorMessage).Render(r.Context(), w)
+}
+
+func (f *Controller) renderIPBans(w http.ResponseWriter, r *http.Request, errorMessage string) {
+	bans, err := f.DB.GetActiveIPBans(time.Now())
+	if err != nil {
+		slog.Error("IP Bans", slog.Any("Error getting bans", err))
+		errorMessage = fmt.Sprintf("Error getting bans: %s", err)
+	}
+	templates.GetIPBans(bans, errorMessage).Render(r.Context(), w)
+}
+
+func (f *Controller) renderLockdown(w http.ResponseWriter, r *http.Request, errorMessage string) {
+	transitions, err := f.DB.GetLockdownTransitions(drawbridge.RecentLockdownTransitions)
+	if err != nil {
+		slog.Error("Lockdown", slog.Any("Error getting lockdown", err))
+		errorMessage = fmt.Sprintf("Error getting lockdown: %s", err)
+	}
+	clients, err := f.DB.GetAllEmissaryClients()
+	if err != nil {
+		slog.Error("Lockdown", slog.Any("Error getting devices", err))
+	}
+	templates.GetLockdown(transitions, f.DrawbridgeAPI.BreakGlassDevices(), clients, errorMessage).Render(r.Context(), w)
+}
+
+func (f *Controller) renderQuarantine(w http.ResponseWriter, r *http.Request, errorMessage string) {
+	quarantines, err := f.DB.GetQuarantinedDevices()
+	if err != nil {
+		slog.Error("Quarantine", slog.Any("Error getting quarantined devices", err))
+		errorMessage = fmt.Sprintf("Error getting quarantined devices: %s", err)
+	}
+	clients, err := f.DB.GetAllEmissaryClients()
+	if err != nil {
+		slog.Error("Quarantine", slog.Any("Error getting devices", err))
+	}
+	templates.GetQuarantinedDevices(quarantines, clients, errorMessage).Render(r.Context(), w)
+}
+
+// How many decided just-in-time access requests the Drawbridge Dashboard lists.
+const recentJITRequests = 20
+
+func (f *Controller) renderJITRequests(w http.ResponseWriter, r *http.Request, errorMessage string) {
+	pending, err := f.DB.GetJITRequests([]authorization.JITStatus{authorization.JITPending}, 0)
+	if err != nil {
+		slog.Error("Just-in-time Access", slog.Any("Error getting pending requests", err))
+		errorMessage = fmt.Sprintf("Error getting requests: %s", err)
+	}
+	recent, err := f.DB.GetJITRequests([]authorization.JITStatus{authorization.JITApproved, authorization.JITDenied, authorization.JITExpired}, recentJITRequests)
+	if err != nil {
+		slog.Error("Just-in-time Access", slog.Any("Error getting recent requests", err))
+	}
+	clients, err := f.DB.GetAllEmissaryClients()
+	if err != nil {
+		slog.Error("Just-in-time Access", slog.Any("Error getting devices", err))
+	}
+	protectedServices, err := f.DB.GetAllServices()
+	if err != nil {
+		slog.Error("Just-in-time Access", slog.Any("Error getting Protected Services", err))
+	}
+	templates.GetJITRequests(pending, recent, clients, protectedServices, errorMessage).Render(r.Context(), w)
+}
+
+// Renders the device's step-up enrollment, with the QR code for its authenticator app until the enrollment is
+// confirmed.
+func (f *Controller) renderTOTP(w http.ResponseWriter, r *http.Request, client *emissary.EmissaryClient, message, errorMessage string) {
+	enrollment, err := f.DB.GetDeviceTOTP(client.ID)
+	if err != nil {
+		slog.Error("Step-up Authentication", slog.Any("Error getting TOTP enrollment", err))
+		errorMessage = fmt.Sprintf("Error getting the enrollment: %s", err)
+		enrollment = &emissary.TOTPEnrollment{}
+	}
+	var qrCode string
+	if enrollment.DeviceID != "" && !enrollment.Confirmed {
+		uri, err := f.DrawbridgeAPI.TOTPURI(enrollment)
+		if err == nil {
+			var code *qrcode.Code
+			code, err = qrcode.Encode([]byte(uri))
+			if err == nil {
+				qrCode = code.SVG(4)
+			}
+		}
+		if err != nil {
+			slog.Error("Step-up Authentication", slog.Any("Error drawing QR code", err))
+			errorMessage = fmt.Sprintf("Error drawing the QR code, enter the secret by hand: %s", err)
+		}
+	}
+	templates.GetEmissaryClientTOTP(client, enrollment, qrCode, message, errorMessage).Render(r.Context(), w)
+}
+
+func (f *Controller) renderAccessSimulation(w http.ResponseWriter, r *http.Request, form templates.AccessSimulationForm, decision *authorization.Decision, errorMessage string) {
+	clients, err := f.DB.GetAllEmissaryClients()
+	if err != nil {
+		slog.Error("Access Simulation", slog.Any("Error getting devices", err))
+	}
+	protectedServices, err := f.DB.GetAllServices()
+	if err != nil {
+		slog.Error("Access Simulation", slog.Any("Error getting Protected Services", err))
+	}
+	templates.GetAccessSimulation(form, clients, protectedServices, decision, errorMessage).Render(r.Context(), w)
+}
+
+// Builds an access request from the access simulator form. The time is in UTC, and is now when it is left empty.
+func parseAccessSimulationForm(form url.Values) (templates.AccessSimulationForm, drawbridge.AccessRequest, error) {
+	simulation := templates.AccessSimulationForm{
+		DeviceID:        form.Get("simulation-device-id"),
+		ConnectionIP:    strings.TrimSpace(form.Get("simulation-ip")),
+		Time:            form.Get("simulation-time"),
+		OverridePosture: form.Get("simulation-override-posture") == "true",
+		Posture: emissary.PostureReport{
+			OS:              strings.TrimSpace(form.Get("simulation-os")),
+			OSVersion:       strings.TrimSpace(form.Get("simulation-os-version")),
+			Hostname:        strings.TrimSpace(form.Get("simulation-hostname")),
+			DiskEncrypted:   form.Get("simulation-disk-encrypted") == "true",
+			FirewallEnabled: form.Get("simulation-firewall-enabled") == "true",
+		},
+	}
+	request := drawbridge.AccessRequest{DeviceID: simulation.DeviceID, ConnectionIP: simulation.ConnectionIP, Time: time.Now()}
+	var err error
+	simulation.ServiceID, err = strconv.ParseInt(form.Get("simulation-service-id"), 10, 64)
+	if err != nil {
+		return simulation, request, errors.New("pick a Protected Service")
+	}
+	request.ServiceID = simulation.ServiceID
+	if simulation.DeviceID == "" {
+		return simulation, request, errors.New("pick a device")
+	}
+	if _, err := network.ParseIP(simulation.ConnectionIP); err != nil {
+		return simulation, request, err
+	}
+	if simulation.Time != "" {
+		request.Time, err = time.Parse(templates.EventLogTimeFormat, simulation.Time)
+		if err != nil {
+			return simulation, request, fmt.Errorf("invalid time %q", simulation.Time)
+		}
+	}
+	if simulation.OverridePosture {
+		// Reported at the simulated time, so it is never too old.
+		report := simulation.Posture
+		report.DeviceID, report.ReportedAt = simulation.DeviceID, request.Time
+		request.Posture = &report
+	}
+	return simulation, request, nil
+}
+
+// Builds a grant from the add grant form.
+func parseGrantForm(form url.Values) (*authorization.Grant, error) {
+	grant := &authorization.Grant{Group: strings.TrimSpace(form.Get("grant-group"))}
+	var err error
+	grant.ServiceID, err = strconv.ParseInt(form.Get("grant-service-id"), 10, 64)
+	if err != nil {
+		return nil, errors.New("pick a Protected Service")
+	}
+	if value := form.Get("grant-policy-id"); value != "" {
+		grant.PolicyID, err = strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid policy id %q", value)
+		}
+	}
+	if value := form.Get("grant-schedule-id"); value != "" {
+		grant.ScheduleID, err = strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule id %q", value)
+		}
+	}
+	return grant, nil
+}
+
+func grantDetails(grant *authorization.Grant) map[string]string {
+	return map[string]string{
+		"grant_id":    strconv.FormatInt(grant.ID, 10),
+		"service_id":  strconv.FormatInt(grant.ServiceID, 10),
+		"group":       grant.Group,
+		"policy_id":   strconv.FormatInt(grant.PolicyID, 10),
+		"schedule_id": strconv.FormatInt(grant.ScheduleID, 10),
+	}
+}
+
+// Builds a policy from the add and edit policy forms. The rules are an expression or the JSON encoded authorization.Group.
+func parsePolicyForm(form url.Values) (*authorization.Policy, error) {
+	policy := &authorization.Policy{
+		Name:        strings.TrimSpace(form.Get("policy-name")),
+		Description: strings.TrimSpace(form.Get("policy-description")),
+	}
+	if scheduleID := form.Get("policy-schedule-id"); scheduleID != "" {
+		var err error
+		policy.ScheduleID, err = strconv.ParseInt(scheduleID, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule id %q", scheduleID)
+		}
+	}
+	rules := strings.TrimSpace(form.Get("policy-rules"))
+	// Rules that aren't a JSON group are a single expression.
+	if !strings.HasPrefix(rules, "{") {
+		policy.Rules = authorization.Group{Match: authorization.MatchAll, Conditions: []authorization.Condition{{Expression: rules}}}
+		return policy, nil
+	}
+	decoder := json.NewDecoder(strings.NewReader(rules))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&policy.Rules)
+	if err != nil {
+		return nil, fmt.Errorf("the rules aren't valid JSON: %w", err)
+	}
+	return policy, nil
+}
+
+func (f *Controller) renderEventSinks(w http.ResponseWriter, r *http.Request, errorMessage string) {
+	configs, err := f.DrawbridgeAPI.EventSinks()
+	if err != nil {
+		slog.Error("Event Sink", slog.Any("Error getting event sinks", err))
+		errorMessage = fmt.Sprintf("Error getting event sinks: %s", err)
+	}
+	templates.GetEventSinks(configs, errorMessage).Render(r.Context(), w)
+}
+
+// Saves the event sinks returned by update and records the change.
+func (f *Controller) updateEventSinks(r *http.Request, update func([]sinks.Config) []sinks.Config) error {
+	configs, err := f.DrawbridgeAPI.EventSinks()
+	if err != nil {
+		return err
+	}
+	configs = update(configs)
+	err = f.DrawbridgeAPI.SaveEventSinks(configs)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(configs))
+	for _, config := range configs {
+		if !config.Disabled {
+			names = append(names, config.Name)
+		}
+	}
+	f.DrawbridgeAPI.RecordAdminAction(sinks.TypeEventSinksUpdated, adminActor(r), map[string]string{"enabled_sinks": strings.Join(names, ", ")})
+	return nil
+}
+
+// Builds an event sink from the add event sink form. Only the fields for the chosen type are used.
+func parseEventSinkForm(form url.Values) (sinks.Config, error) {
+	config := sinks.Config{
+		Name: strings.TrimSpace(form.Get("sink-name")),
+		Type: form.Get("sink-type"),
+	}
+	for _, eventType := range strings.Split(form.Get("sink-event-types"), ",") {
+		if eventType = strings.TrimSpace(eventType); eventType != "" {
+			config.EventTypes = append(config.EventTypes, eventType)
+		}
+	}
+	numbers := map[string]int{}
+	for _, name := range []string{"jsonl-max-size-mb", "jsonl-max-backups", "webhook-max-retries", "webhook-queue-size"} {
+		if form.Get(name) == "" {
+			continue
+		}
+		number, err := strconv.Atoi(form.Get(name))
+		if err != nil {
+			return config, fmt.Errorf("%s must be a number", name)
+		}
+		numbers[name] = number
+	}
+	switch config.Type {
+	case sinks.TypeJSONL:
+		config.JSONL = &sinks.JSONLConfig{
+			Path:       strings.TrimSpace(form.Get("jsonl-path")),
+			MaxSizeMB:  numbers["jsonl-max-size-mb"],
+			MaxBackups: numbers["jsonl-max-backups"],
+		}
+	case sinks.TypeSyslog:
+		config.Syslog = &sinks.SyslogConfig{
+			Network:  form.Get("syslog-network"),
+			Address:  strings.TrimSpace(form.Get("syslog-address")),
+			Facility: strings.TrimSpace(form.Get("syslog-facility")),
+			CAFile:   strings.TrimSpace(form.Get("syslog-ca-file")),
+		}
+	case sinks.TypeWebhook:
+		config.Webhook = &sinks.WebhookConfig{
+			URL:        strings.TrimSpace(form.Get("webhook-url")),
+			Secret:     form.Get("webhook-secret"),
+			MaxRetries: numbers["webhook-max-retries"],
+			QueueSize:  numbers["webhook-queue-size"],
+		}
+	}
+	return config, nil
+}
+
+func (f *Controller) handleGetEventLog(w http.ResponseWriter, r *http.Request, rowsOnly bool) {
+	values := r.URL.Query()
+	query, err := parseEventQuery(values)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "<span class=\"error-response\">%s<span>", err)
+		return
+	}
+	page, err := f.DB.QueryEmissaryClientEvents(query)
+	if err != nil {
+		slog.Error("error querying emissary events", slog.Any("error", err))
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "<span class=\"error-response\">Error searching events: %s<span>", err)
+		return
+	}
+	clients, err := f.DB.GetAllEmissaryClients()
+	if err != nil {
+		slog.Error("error getting all emissary clients", slog.Any("error", err))
+	}
+
+	var nextPageURL string
+	if page.NextCursor != "" {
+		values.Set("cursor", page.NextCursor)
+		nextPageURL = "/emissary/get/events/page?" + values.Encode()
+	}
+	if rowsOnly {
+		templates.GetEventLogRows(page, clients, nextPageURL).Render(r.Context(), w)
+		return
+	}
+	templates.GetEventLog(query, clients, page, nextPageURL).Render(r.Context(), w)
+}
+
+// Reads event log filters from the query string. Times are in UTC, in the format of a datetime-local input.
+func parseEventQuery(values url.Values) (emissary.EventQuery, error) {
+	query := emissary.EventQuery{
+		DeviceID:      values.Get("device"),
+		TargetService: strings.TrimSpace(values.Get("service")),
+		Type:          values.Get("type"),
+		IP:            strings.TrimSpace(values.Get("ip")),
+		Sort:          emissary.EventSort(values.Get("sort")),
+		Descending:    values.Get("order") != "asc",
+		Cursor:        values.Get("cursor"),
+	}
+	if query.Sort == "" {
+		query.Sort = emissary.EventSortTimestamp
+	}
+	for name, t := range map[string]*time.Time{"since": &query.Since, "until": &query.Until} {
+		if values.Get(name) == "" {
+			continue
+		}
+		parsed, err := time.Parse(templates.EventLogTimeFormat, values.Get(name))
+		if err != nil {
+			return query, fmt.Errorf("invalid %s time %q", name, values.Get(name))
+		}
+		*t = parsed
+	}
+	return query, nil
+}
+
+func (f *Controller) handleGetCertificateAuthority(w http.ResponseWriter, r *http.Request) {
+	ca := f.DrawbridgeAPI.CA
+	if ca == nil {
+		templates.GetCertificateAuthority(nil, nil).Render(r.Context(), w)
+		return
+	}
+	clients, err := f.DB.GetAllEmissaryClients()
+	if err != nil {
+		slog.Error("error getting all emissary clients", slog.Any("error", err))
+	}
+	templates.GetCertificateAuthority(ca, ca.DevicesPendingMigration(clients)).Render(r.Context(), w)
+}
+
+// Certificate chains and keys are a few kilobytes. Anything larger isn't a certificate authority.
+const maxCertificateAuthorityUploadSize = 1 << 20
+
+// Reads and validates the certificate authority chain and key uploaded by the Drawbridge admin.
+// Returns nil if no certificate chain was uploaded.
+func parseCertificateAuthorityUpload(r *http.Request) (*certificates.ImportedCertificateAuthority, error) {
+	chainPEM, err := readUploadedFile(r, "ca-chain")
+	if err != nil || chainPEM == nil {
+		return nil, err
+	}
+	keyPEM, err := readUploadedFile(r, "ca-key")
+	if err != nil {
+		return nil, err
+	}
+	if keyPEM == nil {
+		return nil, fmt.Errorf("the certificate authority private key is missing")
+	}
+	return certificates.ParseImportedCertificateAuthority(chainPEM, keyPEM)
+}
+
+// Returns the contents of an uploaded file, or nil if the Drawbridge admin didn't pick one.
+func readUploadedFile(r *http.Request, name string) ([]byte, error) {
+	file, _, err := r.FormFile(name)
+	if errors.Is(err, http.ErrMissingFile) || errors.Is(err, http.ErrNotMultipart) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	contents, err := io.ReadAll(io.LimitReader(file, maxCertificateAuthorityUploadSize))
+	if err != nil || len(contents) == 0 {
+		return nil, err
+	}
+	return contents, nil
 }
 
 func FileServer(r chi.Router, path string, root http.FileSystem) {
@@ -0,0 +1,541 @@
+// Package qrcode draws QR codes (ISO/IEC 18004) as SVG, so the Drawbridge Dashboard can show otpauth URIs to
+// authenticator apps without loading anything from the internet. It only encodes bytes, in versions 1 to 10, which
+// fits up to 213 bytes at error correction level M and is plenty for those URIs.
+package qrcode
+
+import (
+	"fmt"
+	"strings"
+)
+
+// How much of the code is given to error correction, and so how much of it can be damaged and still scan: about 7%,
+// 15%, 25% and 30%.
+type Level int
+
+const (
+	LevelL Level = iota
+	LevelM
+	LevelQ
+	LevelH
+)
+
+func (l Level) String() string {
+	return [...]string{"L", "M", "Q", "H"}[l]
+}
+
+// The two bits the format information uses for the level.
+func (l Level) formatIndicator() int {
+	return [...]int{0b01, 0b00, 0b11, 0b10}[l]
+}
+
+// The error correction blocks of a version at a level: the error correction codewords per block, and how many
+// blocks there are of each length of data codewords.
+type versionBlocks struct {
+	ecc    int
+	groups [][2]int
+}
+
+var levelBlocks = [...][]versionBlocks{
+	LevelL: {
+		1:  {7, [][2]int{{1, 19}}},
+		2:  {10, [][2]int{{1, 34}}},
+		3:  {15, [][2]int{{1, 55}}},
+		4:  {20, [][2]int{{1, 80}}},
+		5:  {26, [][2]int{{1, 108}}},
+		6:  {18, [][2]int{{2, 68}}},
+		7:  {20, [][2]int{{2, 78}}},
+		8:  {24, [][2]int{{2, 97}}},
+		9:  {30, [][2]int{{2, 116}}},
+		10: {18, [][2]int{{2, 68}, {2, 69}}},
+	},
+	LevelM: {
+		1:  {10, [][2]int{{1, 16}}},
+		2:  {16, [][2]int{{1, 28}}},
+		3:  {26, [][2]int{{1, 44}}},
+		4:  {18, [][2]int{{2, 32}}},
+		5:  {24, [][2]int{{2, 43}}},
+		6:  {16, [][2]int{{4, 27}}},
+		7:  {18, [][2]int{{4, 31}}},
+		8:  {22, [][2]int{{2, 38}, {2, 39}}},
+		9:  {22, [][2]int{{3, 36}, {2, 37}}},
+		10: {26, [][2]int{{4, 43}, {1, 44}}},
+	},
+	LevelQ: {
+		1:  {13, [][2]int{{1, 13}}},
+		2:  {22, [][2]int{{1, 22}}},
+		3:  {18, [][2]int{{2, 17}}},
+		4:  {26, [][2]int{{2, 24}}},
+		5:  {18, [][2]int{{2, 15}, {2, 16}}},
+		6:  {24, [][2]int{{4, 19}}},
+		7:  {18, [][2]int{{2, 14}, {4, 15}}},
+		8:  {22, [][2]int{{4, 18}, {2, 19}}},
+		9:  {20, [][2]int{{4, 16}, {4, 17}}},
+		10: {24, [][2]int{{6, 19}, {2, 20}}},
+	},
+	LevelH: {
+		1:  {17, [][2]int{{1, 9}}},
+		2:  {28, [][2]int{{1, 16}}},
+		3:  {22, [][2]int{{2, 13}}},
+		4:  {16, [][2]int{{4, 9}}},
+		5:  {22, [][2]int{{2, 11}, {2, 12}}},
+		6:  {28, [][2]int{{4, 15}}},
+		7:  {26, [][2]int{{4, 13}, {1, 14}}},
+		8:  {26, [][2]int{{4, 14}, {2, 15}}},
+		9:  {24, [][2]int{{4, 12}, {4, 13}}},
+		10: {28, [][2]int{{6, 15}, {2, 16}}},
+	},
+}
+
+// The row and column centres of the alignment patterns of each version.
+var alignmentPositions = [][]int{
+	2:  {6, 18},
+	3:  {6, 22},
+	4:  {6, 26},
+	5:  {6, 30},
+	6:  {6, 34},
+	7:  {6, 22, 38},
+	8:  {6, 24, 42},
+	9:  {6, 26, 46},
+	10: {6, 28, 50},
+}
+
+const maxVersion = 10
+
+// The modules around a QR code that must be left light for scanners to find it.
+const quietZone = 4
+
+type Code struct {
+	Version int
+	Level   Level
+	// How many modules wide and high the code is, without the quiet zone.
+	Size     int
+	modules  [][]bool
+	function [][]bool
+}
+
+// Encodes data at error correction level M, which is what authenticator apps scanning a screen need.
+func Encode(data []byte) (*Code, error) {
+	return EncodeLevel(data, LevelM)
+}
+
+// Encodes data in the smallest version it fits in at the level, with the mask that makes it easiest to scan.
+func EncodeLevel(data []byte, level Level) (*Code, error) {
+	if level < LevelL || level > LevelH {
+		return nil, fmt.Errorf("unknown error correction level %d", level)
+	}
+	version := 0
+	for v := 1; v <= maxVersion; v++ {
+		if len(data) <= dataCapacity(v, level) {
+			version = v
+			break
+		}
+	}
+	if version == 0 {
+		return nil, fmt.Errorf("QR codes can hold at most %d bytes at level %s, got %d", dataCapacity(maxVersion, level), level, len(data))
+	}
+	codewords := addErrorCorrection(version, level, encodeData(version, level, data))
+
+	var best *Code
+	bestPenalty := 0
+	for mask := 0; mask < 8; mask++ {
+		code := newCode(version, level)
+		code.placeCodewords(codewords)
+		code.applyMask(mask)
+		code.drawFormatBits(mask)
+		penalty := code.penalty()
+		if best == nil || penalty < bestPenalty {
+			best, bestPenalty = code, penalty
+		}
+	}
+	return best, nil
+}
+
+// Reports whether the module in column x and row y is dark.
+func (c *Code) Dark(x, y int) bool {
+	return c.modules[y][x]
+}
+
+// Draws the code, with its quiet zone, as an SVG image moduleSize pixels per module.
+func (c *Code) SVG(moduleSize int) string {
+	size := c.Size + 2*quietZone
+	var path strings.Builder
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			if c.modules[y][x] {
+				fmt.Fprintf(&path, "M%d,%dh1v1h-1z", x+quietZone, y+quietZone)
+			}
+		}
+	}
+	return fmt.Sprintf(
+		`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" width="%d" height="%d" shape-rendering="crispEdges"><rect width="100%%" height="100%%" fill="#ffffff"/><path d="%s" fill="#000000"/></svg>`,
+		size, size, size*moduleSize, size*moduleSize, path.String(),
+	)
+}
+
+// How many data codewords the version has, less the mode and length header of byte mode.
+func dataCapacity(version int, level Level) int {
+	return dataCodewords(version, level) - (4+lengthBits(version)+7)/8
+}
+
+func dataCodewords(version int, level Level) int {
+	total := 0
+	for _, group := range levelBlocks[level][version].groups {
+		total += group[0] * group[1]
+	}
+	return total
+}
+
+func lengthBits(version int) int {
+	if version < 10 {
+		return 8
+	}
+	return 16
+}
+
+type bitBuffer struct {
+	bytes []byte
+	bits  int
+}
+
+func (b *bitBuffer) append(value, length int) {
+	for i := length - 1; i >= 0; i-- {
+		if b.bits%8 == 0 {
+			b.bytes = append(b.bytes, 0)
+		}
+		if value>>i&1 == 1 {
+			b.bytes[b.bits/8] |= 0x80 >> (b.bits % 8)
+		}
+		b.bits++
+	}
+}
+
+// Builds the data codewords: the byte mode header, the data, a terminator and padding.
+func encodeData(version int, level Level, data []byte) []byte {
+	capacity := dataCodewords(version, level)
+	var buffer bitBuffer
+	buffer.append(0b0100, 4)
+	buffer.append(len(data), lengthBits(version))
+	for _, b := range data {
+		buffer.append(int(b), 8)
+	}
+	buffer.append(0, min(4, capacity*8-buffer.bits))
+	buffer.append(0, (8-buffer.bits%8)%8)
+	for pad := 0; len(buffer.bytes) < capacity; pad++ {
+		buffer.append([]int{0xEC, 0x11}[pad%2], 8)
+	}
+	return buffer.bytes
+}
+
+// Splits the data codewords into blocks, adds each block's error correction codewords, and interleaves them.
+func addErrorCorrection(version int, level Level, data []byte) []byte {
+	blocks := levelBlocks[level][version]
+	divisor := reedSolomonDivisor(blocks.ecc)
+	var dataBlocks, eccBlocks [][]byte
+	for _, group := range blocks.groups {
+		for i := 0; i < group[0]; i++ {
+			block := data[:group[1]]
+			data = data[group[1]:]
+			dataBlocks = append(dataBlocks, block)
+			eccBlocks = append(eccBlocks, reedSolomonRemainder(block, divisor))
+		}
+	}
+	var result []byte
+	longest := len(dataBlocks[len(dataBlocks)-1])
+	for i := 0; i < longest; i++ {
+		for _, block := range dataBlocks {
+			if i < len(block) {
+				result = append(result, block[i])
+			}
+		}
+	}
+	for i := 0; i < blocks.ecc; i++ {
+		for _, block := range eccBlocks {
+			result = append(result, block[i])
+		}
+	}
+	return result
+}
+
+// Multiplies in GF(2^8) modulo x^8 + x^4 + x^3 + x^2 + 1.
+func gfMultiply(x, y byte) byte {
+	z := 0
+	for i := 7; i >= 0; i-- {
+		z = z<<1 ^ (z>>7)*0x11D
+		z ^= int(y>>i&1) * int(x)
+	}
+	return byte(z)
+}
+
+// The generator polynomial of the given degree, without its leading 1, highest power first.
+func reedSolomonDivisor(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range result {
+			result[j] = gfMultiply(result[j], root)
+			if j+1 < len(result) {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = gfMultiply(root, 0x02)
+	}
+	return result
+}
+
+func reedSolomonRemainder(data, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i, coefficient := range divisor {
+			result[i] ^= gfMultiply(coefficient, factor)
+		}
+	}
+	return result
+}
+
+// A code with its finder, timing and alignment patterns and version information drawn, and space reserved for the
+// format information.
+func newCode(version int, level Level) *Code {
+	size := version*4 + 17
+	c := &Code{Version: version, Level: level, Size: size, modules: make([][]bool, size), function: make([][]bool, size)}
+	for y := range c.modules {
+		c.modules[y] = make([]bool, size)
+		c.function[y] = make([]bool, size)
+	}
+	for i := 0; i < size; i++ {
+		c.setFunction(6, i, i%2 == 0)
+		c.setFunction(i, 6, i%2 == 0)
+	}
+	c.drawFinder(3, 3)
+	c.drawFinder(size-4, 3)
+	c.drawFinder(3, size-4)
+	positions := alignmentPositions[version]
+	last := len(positions) - 1
+	for i, x := range positions {
+		for j, y := range positions {
+			// The corners with finder patterns.
+			if i == 0 && j == 0 || i == 0 && j == last || i == last && j == 0 {
+				continue
+			}
+			c.drawAlignment(x, y)
+		}
+	}
+	c.drawFormatBits(0)
+	c.drawVersion()
+	return c
+}
+
+func (c *Code) setFunction(x, y int, dark bool) {
+	c.modules[y][x] = dark
+	c.function[y][x] = true
+}
+
+func (c *Code) drawFinder(x, y int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			xx, yy := x+dx, y+dy
+			if xx < 0 || xx >= c.Size || yy < 0 || yy >= c.Size {
+				continue
+			}
+			distance := max(abs(dx), abs(dy))
+			c.setFunction(xx, yy, distance != 2 && distance != 4)
+		}
+	}
+}
+
+func (c *Code) drawAlignment(x, y int) {
+	for dy := -2; dy <= 2; dy++ {
+		for dx := -2; dx <= 2; dx++ {
+			c.setFunction(x+dx, y+dy, max(abs(dx), abs(dy)) != 1)
+		}
+	}
+}
+
+// The 15 format bits for the level and the mask, with their BCH error correction.
+func formatBits(level Level, mask int) int {
+	data := level.formatIndicator()<<3 | mask
+	remainder := data
+	for i := 0; i < 10; i++ {
+		remainder = remainder<<1 ^ (remainder>>9)*0x537
+	}
+	return (data<<10 | remainder) ^ 0x5412
+}
+
+func (c *Code) drawFormatBits(mask int) {
+	bits := formatBits(c.Level, mask)
+	bit := func(i int) bool { return bits>>i&1 == 1 }
+	// Around the top left finder pattern.
+	for i := 0; i <= 5; i++ {
+		c.setFunction(8, i, bit(i))
+	}
+	c.setFunction(8, 7, bit(6))
+	c.setFunction(8, 8, bit(7))
+	c.setFunction(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		c.setFunction(14-i, 8, bit(i))
+	}
+	// Split between the other two finder patterns.
+	for i := 0; i < 8; i++ {
+		c.setFunction(c.Size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		c.setFunction(8, c.Size-15+i, bit(i))
+	}
+	c.setFunction(8, c.Size-8, true)
+}
+
+// The 18 version bits with their BCH error correction, for versions 7 and up.
+func versionBits(version int) int {
+	remainder := version
+	for i := 0; i < 12; i++ {
+		remainder = remainder<<1 ^ (remainder>>11)*0x1F25
+	}
+	return version<<12 | remainder
+}
+
+func (c *Code) drawVersion() {
+	if c.Version < 7 {
+		return
+	}
+	bits := versionBits(c.Version)
+	for i := 0; i < 18; i++ {
+		dark := bits>>i&1 == 1
+		a, b := c.Size-11+i%3, i/3
+		c.setFunction(a, b, dark)
+		c.setFunction(b, a, dark)
+	}
+}
+
+// Fills the modules that aren't part of a pattern with the codewords, in two module wide columns zigzagging up and
+// down from the bottom right. Modules left over are the remainder bits, which are light.
+func (c *Code) placeCodewords(codewords []byte) {
+	i := 0
+	for right := c.Size - 1; right >= 1; right -= 2 {
+		// Skip the vertical timing pattern.
+		if right == 6 {
+			right = 5
+		}
+		upward := (right+1)&2 == 0
+		for vertical := 0; vertical < c.Size; vertical++ {
+			y := vertical
+			if upward {
+				y = c.Size - 1 - vertical
+			}
+			for j := 0; j < 2; j++ {
+				x := right - j
+				if c.function[y][x] || i >= len(codewords)*8 {
+					continue
+				}
+				c.modules[y][x] = codewords[i/8]>>(7-i%8)&1 == 1
+				i++
+			}
+		}
+	}
+}
+
+func maskApplies(mask, x, y int) bool {
+	switch mask {
+	case 0:
+		return (x+y)%2 == 0
+	case 1:
+		return y%2 == 0
+	case 2:
+		return x%3 == 0
+	case 3:
+		return (x+y)%3 == 0
+	case 4:
+		return (x/3+y/2)%2 == 0
+	case 5:
+		return x*y%2+x*y%3 == 0
+	case 6:
+		return (x*y%2+x*y%3)%2 == 0
+	default:
+		return ((x+y)%2+x*y%3)%2 == 0
+	}
+}
+
+func (c *Code) applyMask(mask int) {
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			if !c.function[y][x] && maskApplies(mask, x, y) {
+				c.modules[y][x] = !c.modules[y][x]
+			}
+		}
+	}
+}
+
+// Scores how hard the code is to scan, by the rules the standard uses to pick a mask: long runs of one colour, 2x2
+// blocks of one colour, patterns that look like finder patterns, and an uneven balance of dark and light.
+func (c *Code) penalty() int {
+	penalty := 0
+	dark := 0
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			if c.modules[y][x] {
+				dark++
+			}
+			if x+1 < c.Size && y+1 < c.Size {
+				colour := c.modules[y][x]
+				if c.modules[y][x+1] == colour && c.modules[y+1][x] == colour && c.modules[y+1][x+1] == colour {
+					penalty += 3
+				}
+			}
+		}
+	}
+	for i := 0; i < c.Size; i++ {
+		row := make([]bool, c.Size)
+		column := make([]bool, c.Size)
+		for j := 0; j < c.Size; j++ {
+			row[j], column[j] = c.modules[i][j], c.modules[j][i]
+		}
+		penalty += linePenalty(row) + linePenalty(column)
+	}
+	total := c.Size * c.Size
+	penalty += abs(dark*100/total-50) / 5 * 10
+	return penalty
+}
+
+var finderLike = [][]bool{
+	{true, false, true, true, true, false, true, false, false, false, false},
+	{false, false, false, false, true, false, true, true, true, false, true},
+}
+
+func linePenalty(line []bool) int {
+	penalty := 0
+	run := 1
+	for i := 1; i <= len(line); i++ {
+		if i < len(line) && line[i] == line[i-1] {
+			run++
+			continue
+		}
+		if run >= 5 {
+			penalty += run - 2
+		}
+		run = 1
+	}
+	for i := 0; i+len(finderLike[0]) <= len(line); i++ {
+		for _, pattern := range finderLike {
+			matches := true
+			for j, dark := range pattern {
+				if line[i+j] != dark {
+					matches = false
+					break
+				}
+			}
+			if matches {
+				penalty += 40
+			}
+		}
+	}
+	return penalty
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
@@ -0,0 +1,541 @@
+package qrcode
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestReedSolomon(t *testing.T) {
+	// HELLO WORLD at 1-M, from the worked example in the standard's tutorials.
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	want := []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}
+	if got := reedSolomonRemainder(data, reedSolomonDivisor(10)); !bytes.Equal(got, want) {
+		t.Errorf("got error correction codewords %v, wanted %v", got, want)
+	}
+}
+
+func TestFormatAndVersionBits(t *testing.T) {
+	formats := []struct {
+		level Level
+		mask  int
+		want  string
+	}{
+		{LevelL, 0, "111011111000100"},
+		{LevelM, 0, "101010000010010"},
+		{LevelM, 4, "100010111111001"},
+		{LevelM, 5, "100000011001110"},
+		{LevelQ, 0, "011010101011111"},
+		{LevelH, 0, "001011010001001"},
+		{LevelH, 7, "000100000111011"},
+	}
+	for _, format := range formats {
+		if got := fmt.Sprintf("%015b", formatBits(format.level, format.mask)); got != format.want {
+			t.Errorf("level %s mask %d: got format bits %s, wanted %s", format.level, format.mask, got, format.want)
+		}
+	}
+	versions := map[int]string{7: "000111110010010100", 10: "001010010011010011"}
+	for version, want := range versions {
+		if got := fmt.Sprintf("%018b", versionBits(version)); got != want {
+			t.Errorf("version %d: got version bits %s, wanted %s", version, got, want)
+		}
+	}
+}
+
+func TestCapacity(t *testing.T) {
+	// The byte mode capacities from the standard's table.
+	capacities := map[Level][2]int{LevelL: {17, 271}, LevelM: {14, 213}, LevelQ: {11, 151}, LevelH: {7, 119}}
+	for level, want := range capacities {
+		if got := [2]int{dataCapacity(1, level), dataCapacity(maxVersion, level)}; got != want {
+			t.Errorf("level %s: got capacities %v for versions 1 and %d, wanted %v", level, got, maxVersion, want)
+		}
+	}
+}
+
+func TestEncode(t *testing.T) {
+	uri := "otpauth://totp/Drawbridge:Brave%20Otter?secret=JBSWY3DPEHPK3PXPJBSWY3DPEHPK3PXP&issuer=Drawbridge&algorithm=SHA1&digits=6&period=30"
+	code, err := Encode([]byte(uri))
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	if code.Version != 8 || code.Size != 49 || code.Level != LevelM {
+		t.Errorf("expected %d bytes to fit in version 8 at level M, got version %d at level %s", len(uri), code.Version, code.Level)
+	}
+	result, err := decode(code)
+	if err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if string(result.data) != uri {
+		t.Errorf("decoded %q, wanted %q", result.data, uri)
+	}
+	if !strings.Contains(code.SVG(4), `viewBox="0 0 57 57"`) {
+		t.Errorf("expected the SVG to include the quiet zone")
+	}
+
+	if _, err := Encode(make([]byte, 214)); err == nil {
+		t.Error("expected Encode to refuse more than 213 bytes")
+	}
+	if _, err := EncodeLevel(nil, LevelH+1); err == nil {
+		t.Error("expected EncodeLevel to refuse an unknown level")
+	}
+}
+
+// Every version at every level, filled to capacity so the code can't fit in a smaller version, reads back with each
+// mask, and still reads back with as many codewords damaged in each block as the level can correct.
+func TestRoundTrip(t *testing.T) {
+	for level := LevelL; level <= LevelH; level++ {
+		for version := 1; version <= maxVersion; version++ {
+			data := make([]byte, dataCapacity(version, level))
+			for i := range data {
+				data[i] = byte(i*37 + version*11 + int(level))
+			}
+			name := fmt.Sprintf("%d-%s", version, level)
+
+			code, err := EncodeLevel(data, level)
+			if err != nil {
+				t.Fatalf("%s: EncodeLevel failed: %v", name, err)
+			}
+			if code.Version != version || code.Level != level {
+				t.Fatalf("%s: expected %d bytes to encode as %s, got %d-%s", name, len(data), name, code.Version, code.Level)
+			}
+			result, err := decode(code)
+			if err != nil {
+				t.Fatalf("%s: decode failed: %v", name, err)
+			}
+			if !bytes.Equal(result.data, data) || result.corrected != 0 {
+				t.Errorf("%s: decoded %x with %d corrections, wanted %x", name, result.data, result.corrected, data)
+			}
+			if _, err := EncodeLevel(append(data, 0), level); err == nil && version == maxVersion {
+				t.Errorf("%s: expected EncodeLevel to refuse more than %d bytes", name, len(data))
+			}
+
+			codewords := addErrorCorrection(version, level, encodeData(version, level, data))
+			for mask := 0; mask < 8; mask++ {
+				code := newCode(version, level)
+				code.placeCodewords(codewords)
+				code.applyMask(mask)
+				code.drawFormatBits(mask)
+				result, err := decode(code)
+				if err != nil {
+					t.Fatalf("%s mask %d: decode failed: %v", name, mask, err)
+				}
+				if result.version != version || result.level != level || result.mask != mask || !bytes.Equal(result.data, data) {
+					t.Errorf("%s mask %d: decoded %d-%s mask %d %x, wanted %x", name, mask, result.version, result.level, result.mask, result.data, data)
+				}
+			}
+
+			// The first codewords are interleaved a block at a time, so damaging the first blocks*correctable of them
+			// damages each block as much as it can be.
+			blocks := levelBlocks[level][version]
+			count := 0
+			for _, group := range blocks.groups {
+				count += group[0]
+			}
+			damaged := count * (blocks.ecc / 2)
+			positions := dataModules(version)
+			for i := 0; i < damaged; i++ {
+				for _, bit := range []int{0, 3, 6} {
+					position := positions[i*8+bit]
+					code.modules[position[1]][position[0]] = !code.modules[position[1]][position[0]]
+				}
+			}
+			result, err = decode(code)
+			if err != nil {
+				t.Fatalf("%s: decode of %d damaged codewords failed: %v", name, damaged, err)
+			}
+			if !bytes.Equal(result.data, data) || result.corrected != damaged {
+				t.Errorf("%s: decoded %x with %d corrections, wanted %x with %d", name, result.data, result.corrected, data, damaged)
+			}
+		}
+	}
+}
+
+// What a scanner reads from a code.
+type decoded struct {
+	version   int
+	level     Level
+	mask      int
+	data      []byte
+	corrected int
+}
+
+// Reads a code the way a scanner does, going only by its modules and the standard: the format and version
+// information, the data modules in placement order with the mask undone, the blocks with their errors corrected, and
+// the byte mode segment. Only the block tables are shared with the encoder, and the reader checks they account for
+// every data module.
+func decode(code *Code) (*decoded, error) {
+	size := code.Size
+	version := (size - 17) / 4
+	if version < 1 || version > maxVersion || size != version*4+17 {
+		return nil, fmt.Errorf("a code %d modules wide isn't a version this package reads", size)
+	}
+	result := &decoded{version: version}
+
+	// The format information, next to the top left finder pattern and split between the other two.
+	var first, second int
+	for i := 0; i < 15; i++ {
+		var x, y int
+		switch {
+		case i <= 5:
+			x, y = 8, i
+		case i == 6:
+			x, y = 8, 7
+		case i == 7:
+			x, y = 8, 8
+		case i == 8:
+			x, y = 7, 8
+		default:
+			x, y = 14-i, 8
+		}
+		if code.Dark(x, y) {
+			first |= 1 << i
+		}
+		if i < 8 {
+			x, y = size-1-i, 8
+		} else {
+			x, y = 8, size-15+i
+		}
+		if code.Dark(x, y) {
+			second |= 1 << i
+		}
+	}
+	if first != second {
+		return nil, fmt.Errorf("the two copies of the format information differ: %015b and %015b", first, second)
+	}
+	found := false
+	for level := LevelL; level <= LevelH; level++ {
+		for mask := 0; mask < 8; mask++ {
+			if formatBits(level, mask) == first {
+				result.level, result.mask, found = level, mask, true
+			}
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("the format information %015b isn't valid", first)
+	}
+	if !code.Dark(8, size-8) {
+		return nil, errors.New("the dark module is light")
+	}
+
+	if version >= 7 {
+		var first, second int
+		for i := 0; i < 18; i++ {
+			if code.Dark(size-11+i%3, i/3) {
+				first |= 1 << i
+			}
+			if code.Dark(i/3, size-11+i%3) {
+				second |= 1 << i
+			}
+		}
+		if first != versionBits(version) || second != versionBits(version) {
+			return nil, fmt.Errorf("the version information %018b and %018b isn't version %d", first, second, version)
+		}
+	}
+
+	positions := dataModules(version)
+	blocks := levelBlocks[result.level][version]
+	var dataBlocks [][]byte
+	total := 0
+	for _, group := range blocks.groups {
+		for i := 0; i < group[0]; i++ {
+			dataBlocks = append(dataBlocks, make([]byte, 0, group[1]+blocks.ecc))
+			total += group[1] + blocks.ecc
+		}
+	}
+	if len(positions)/8 != total {
+		return nil, fmt.Errorf("version %d has %d data modules, but the blocks of level %s take %d codewords", version, len(positions), result.level, total)
+	}
+	codewords := make([]byte, total)
+	for i := range codewords {
+		for j := 0; j < 8; j++ {
+			x, y := positions[i*8+j][0], positions[i*8+j][1]
+			if code.Dark(x, y) != masked(result.mask, y, x) {
+				codewords[i] |= 0x80 >> j
+			}
+		}
+	}
+
+	// The data codewords are interleaved across the blocks, the shorter blocks first, then the error correction
+	// codewords.
+	lengths := make([]int, len(dataBlocks))
+	for i := range dataBlocks {
+		lengths[i] = cap(dataBlocks[i]) - blocks.ecc
+	}
+	next := 0
+	for i := 0; i < lengths[len(lengths)-1]; i++ {
+		for b := range dataBlocks {
+			if i < lengths[b] {
+				dataBlocks[b] = append(dataBlocks[b], codewords[next])
+				next++
+			}
+		}
+	}
+	for i := 0; i < blocks.ecc; i++ {
+		for b := range dataBlocks {
+			dataBlocks[b] = append(dataBlocks[b], codewords[next])
+			next++
+		}
+	}
+	var data []byte
+	for b, block := range dataBlocks {
+		corrected, err := correctErrors(block, blocks.ecc)
+		if err != nil {
+			return nil, fmt.Errorf("block %d: %w", b, err)
+		}
+		result.corrected += corrected
+		data = append(data, block[:lengths[b]]...)
+	}
+
+	segment, err := readSegment(version, data)
+	if err != nil {
+		return nil, err
+	}
+	result.data = segment
+	return result, nil
+}
+
+// The modules left for the codewords, in the order they're placed: two columns at a time from the right, zigzagging
+// up then down, skipping the vertical timing pattern.
+func dataModules(version int) [][2]int {
+	size := version*4 + 17
+	function := functionModules(version)
+	var positions [][2]int
+	y, direction := size-1, -1
+	for x := size - 1; x > 0; x -= 2 {
+		if x == 6 {
+			x--
+		}
+		for y >= 0 && y < size {
+			for _, column := range []int{x, x - 1} {
+				if !function[y][column] {
+					positions = append(positions, [2]int{column, y})
+				}
+			}
+			y += direction
+		}
+		direction = -direction
+		y += direction
+	}
+	return positions
+}
+
+// The finder patterns with their separators and format information, the timing patterns, the alignment patterns and
+// the version information.
+func functionModules(version int) [][]bool {
+	size := version*4 + 17
+	function := make([][]bool, size)
+	finder := func(x, y int) bool {
+		return x < 9 && y < 9 || x >= size-8 && y < 9 || x < 9 && y >= size-8
+	}
+	for y := range function {
+		function[y] = make([]bool, size)
+		for x := range function[y] {
+			function[y][x] = finder(x, y) || x == 6 || y == 6
+			if version >= 7 {
+				function[y][x] = function[y][x] || x >= size-11 && x < size-8 && y < 6 || y >= size-11 && y < size-8 && x < 6
+			}
+		}
+	}
+	// The alignment patterns are spread evenly between row and column 6 and the far edge, leaving out the ones that
+	// would overlap the finder patterns.
+	if version > 1 {
+		count := version/7 + 2
+		step := (version*4 + count*2 + 1) / (count*2 - 2) * 2
+		centres := []int{6}
+		for i := count - 1; i >= 1; i-- {
+			centres = append(centres, size-7-(i-1)*step)
+		}
+		for _, cx := range centres {
+			for _, cy := range centres {
+				if finder(cx, cy) {
+					continue
+				}
+				for y := cy - 2; y <= cy+2; y++ {
+					for x := cx - 2; x <= cx+2; x++ {
+						function[y][x] = true
+					}
+				}
+			}
+		}
+	}
+	return function
+}
+
+// The mask patterns as the standard writes them, by row i and column j.
+func masked(mask, i, j int) bool {
+	switch mask {
+	case 0b000:
+		return (i+j)%2 == 0
+	case 0b001:
+		return i%2 == 0
+	case 0b010:
+		return j%3 == 0
+	case 0b011:
+		return (i+j)%3 == 0
+	case 0b100:
+		return (i/2+j/3)%2 == 0
+	case 0b101:
+		return i*j%2+i*j%3 == 0
+	case 0b110:
+		return (i*j%2+i*j%3)%2 == 0
+	default:
+		return ((i+j)%2+i*j%3)%2 == 0
+	}
+}
+
+// Reads the byte mode segment, and checks the terminator and padding after it.
+func readSegment(version int, data []byte) ([]byte, error) {
+	position := 0
+	read := func(length int) int {
+		value := 0
+		for i := 0; i < length; i++ {
+			value <<= 1
+			if position < len(data)*8 && data[position/8]>>(7-position%8)&1 == 1 {
+				value |= 1
+			}
+			position++
+		}
+		return value
+	}
+	if mode := read(4); mode != 0b0100 {
+		return nil, fmt.Errorf("got mode %04b, wanted byte mode", mode)
+	}
+	lengthBits := 8
+	if version >= 10 {
+		lengthBits = 16
+	}
+	length := read(lengthBits)
+	if position+length*8 > len(data)*8 {
+		return nil, fmt.Errorf("the segment is %d bytes long, which doesn't fit", length)
+	}
+	segment := make([]byte, length)
+	for i := range segment {
+		segment[i] = byte(read(8))
+	}
+	if terminator := read(min(4, len(data)*8-position)); terminator != 0 {
+		return nil, fmt.Errorf("got terminator %b", terminator)
+	}
+	if padding := read((8 - position%8) % 8); padding != 0 {
+		return nil, fmt.Errorf("got padding bits %b", padding)
+	}
+	for pad := 0; position < len(data)*8; pad++ {
+		if got, want := read(8), []int{0xEC, 0x11}[pad%2]; got != want {
+			return nil, fmt.Errorf("got pad codeword %#x, wanted %#x", got, want)
+		}
+	}
+	return segment, nil
+}
+
+// Logarithms and exponents of 2 in GF(2^8) modulo x^8 + x^4 + x^3 + x^2 + 1, for the reader's own arithmetic.
+var gfExp, gfLog = func() ([510]byte, [256]int) {
+	var exp [510]byte
+	var log [256]int
+	value := 1
+	for i := 0; i < 255; i++ {
+		exp[i], exp[i+255] = byte(value), byte(value)
+		log[value] = i
+		value <<= 1
+		if value&0x100 != 0 {
+			value ^= 0x11D
+		}
+	}
+	return exp, log
+}()
+
+func gfMul(x, y byte) byte {
+	if x == 0 || y == 0 {
+		return 0
+	}
+	return gfExp[gfLog[x]+gfLog[y]]
+}
+
+func gfDiv(x, y byte) byte {
+	if x == 0 {
+		return 0
+	}
+	return gfExp[gfLog[x]+255-gfLog[y]]
+}
+
+// Evaluates a polynomial, lowest power first, at x.
+func gfEvaluate(polynomial []byte, x byte) byte {
+	result := byte(0)
+	for i := len(polynomial) - 1; i >= 0; i-- {
+		result = gfMul(result, x) ^ polynomial[i]
+	}
+	return result
+}
+
+// Corrects up to ecc/2 wrong codewords in a block, highest power first, with the Berlekamp-Massey algorithm, a Chien
+// search and the Forney algorithm. Returns how many codewords were corrected.
+func correctErrors(block []byte, ecc int) (int, error) {
+	n := len(block)
+	syndromes := make([]byte, ecc)
+	clean := true
+	for j := range syndromes {
+		for _, b := range block {
+			syndromes[j] = gfMul(syndromes[j], gfExp[j]) ^ b
+		}
+		clean = clean && syndromes[j] == 0
+	}
+	if clean {
+		return 0, nil
+	}
+
+	locator, previous := []byte{1}, []byte{1}
+	errorCount, shift, lastDiscrepancy := 0, 1, byte(1)
+	for i := 0; i < ecc; i++ {
+		discrepancy := syndromes[i]
+		for j := 1; j <= errorCount && j < len(locator); j++ {
+			discrepancy ^= gfMul(locator[j], syndromes[i-j])
+		}
+		if discrepancy == 0 {
+			shift++
+			continue
+		}
+		saved := append([]byte(nil), locator...)
+		factor := gfDiv(discrepancy, lastDiscrepancy)
+		for len(locator) < len(previous)+shift {
+			locator = append(locator, 0)
+		}
+		for j, coefficient := range previous {
+			locator[j+shift] ^= gfMul(factor, coefficient)
+		}
+		if 2*errorCount <= i {
+			errorCount, previous, lastDiscrepancy, shift = i+1-errorCount, saved, discrepancy, 1
+		} else {
+			shift++
+		}
+	}
+	if errorCount > ecc/2 {
+		return 0, fmt.Errorf("%d errors is more than %d error correction codewords can correct", errorCount, ecc)
+	}
+
+	// The evaluator is the syndromes times the locator, modulo x^ecc.
+	evaluator := make([]byte, ecc)
+	for i := range evaluator {
+		for j := 0; j <= i && j < len(locator); j++ {
+			evaluator[i] ^= gfMul(locator[j], syndromes[i-j])
+		}
+	}
+	// The formal derivative keeps the odd powers.
+	derivative := make([]byte, len(locator))
+	for i := 1; i < len(locator); i += 2 {
+		derivative[i-1] = locator[i]
+	}
+	var found []int
+	for power := 0; power < n; power++ {
+		inverse := gfExp[(255-power)%255]
+		if gfEvaluate(locator, inverse) != 0 {
+			continue
+		}
+		magnitude := gfMul(gfExp[power], gfDiv(gfEvaluate(evaluator, inverse), gfEvaluate(derivative, inverse)))
+		block[n-1-power] ^= magnitude
+		found = append(found, power)
+	}
+	if len(found) != errorCount {
+		return 0, fmt.Errorf("found %d of the %d errors", len(found), errorCount)
+	}
+	return len(found), nil
+}
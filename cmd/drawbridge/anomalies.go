@@ -0,0 +1,255 @@
+package drawbridge
+
+import (
+	"encoding/json"
+	"fmt"
+	"imdawon/drawbridge/cmd/drawbridge/anomaly"
+	"imdawon/drawbridge/cmd/drawbridge/emissary"
+	"imdawon/drawbridge/cmd/drawbridge/network"
+	"imdawon/drawbridge/cmd/drawbridge/sinks"
+	"imdawon/drawbridge/cmd/utils"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// The setting in the drawbridge_config table for the JSON encoded anomaly.Settings.
+	anomalySetting = "anomaly_detection"
+
+	quarantineCheck = "quarantine"
+)
+
+// What the anomaly detector remembers between events. Kept in memory only.
+type anomalyState struct {
+	mu sync.Mutex
+	// When the detector last alerted about each device it didn't quarantine, so it alerts once per window instead
+	// of for every connection.
+	alerted map[string]time.Time
+	// When the Drawbridge admin released each device, so the connections that got it quarantined don't count
+	// again.
+	released map[string]time.Time
+}
+
+func (d *Drawbridge) AnomalySettings() anomaly.Settings {
+	settings := anomaly.DefaultSettings
+	value, err := d.DB.GetDrawbridgeConfigValueByName(anomalySetting)
+	if err != nil {
+		slog.Error("Database", slog.Any("Error getting "+anomalySetting, err))
+		return settings
+	}
+	if value == nil || *value == "" {
+		return settings
+	}
+	err = json.Unmarshal([]byte(*value), &settings)
+	if err == nil {
+		err = settings.Validate()
+	}
+	if err != nil {
+		slog.Error("Anomaly Detection", slog.String("Invalid "+anomalySetting, *value))
+		return anomaly.DefaultSettings
+	}
+	return settings
+}
+
+func (d *Drawbridge) SaveAnomalySettings(settings anomaly.Settings) error {
+	err := settings.Validate()
+	if err != nil {
+		return err
+	}
+	encoded, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	return d.DB.CreateNewDrawbridgeConfigSettings(anomalySetting, string(encoded))
+}
+
+// Scores the device's connections within the window when one of its events is recorded, against where it connected
+// from and what it used before. A device whose score reaches the threshold is quarantined, or only alerted about if
+// quarantine is turned off.
+func (d *Drawbridge) detectAnomalies(event emissary.Event) {
+	settings := d.AnomalySettings()
+	if !settings.Enabled || event.DeviceID == "" || event.Type == EventTypeTerminated {
+		return
+	}
+	quarantine, err := d.DB.GetDeviceQuarantine(event.DeviceID)
+	if err != nil {
+		slog.Error("Anomaly Detection", slog.Any("Error getting quarantine", err))
+		return
+	}
+	if quarantine.DeviceID != "" {
+		return
+	}
+	windowStart := event.Timestamp.Add(-settings.Window())
+	d.anomalies.mu.Lock()
+	if released := d.anomalies.released[event.DeviceID]; released.After(windowStart) {
+		windowStart = released
+	}
+	d.anomalies.mu.Unlock()
+
+	activity, err := d.deviceActivity(event.DeviceID, windowStart)
+	if err != nil {
+		slog.Error("Anomaly Detection", slog.String("Device", event.DeviceID), slog.Any("Error", err))
+		return
+	}
+	result := settings.Evaluate(*activity)
+	if !result.Flagged(settings) {
+		return
+	}
+	if settings.Quarantine {
+		d.quarantineDevice(event, result)
+		return
+	}
+	d.anomalies.mu.Lock()
+	if alerted, ok := d.anomalies.alerted[event.DeviceID]; ok && alerted.After(event.Timestamp.Add(-settings.Window())) {
+		d.anomalies.mu.Unlock()
+		return
+	}
+	if d.anomalies.alerted == nil {
+		d.anomalies.alerted = make(map[string]time.Time)
+	}
+	d.anomalies.alerted[event.DeviceID] = event.Timestamp
+	d.anomalies.mu.Unlock()
+	slog.Warn("Anomaly Detection", slog.String("Device", event.DeviceID), slog.String("signals", result.String()))
+	d.recordAnomalyEvent(sinks.TypeAnomalyDetected, event, result)
+}
+
+// Adds the event to the device's baseline, which the detector compares the device's connections within the window
+// to. The baseline keeps the countries and Protected Services after the event is pruned.
+func (d *Drawbridge) recordDeviceBaseline(event emissary.Event) {
+	// Drawbridge records these itself, from the IP of the connection it ended.
+	if event.DeviceID == "" || event.Type == EventTypeTerminated {
+		return
+	}
+	err := d.DB.RecordDeviceBaseline(event.DeviceID, event.Country, anomalyService(event), event.Timestamp)
+	if err != nil {
+		slog.Error("Anomaly Detection", slog.String("Device", event.DeviceID), slog.Any("Error recording baseline", err))
+	}
+}
+
+// The Protected Service the event asked for, counted towards a burst of new services, or "". Only connections and
+// denied connections ask for one.
+func anomalyService(event emissary.Event) string {
+	if event.Type == "PS_CONN" || event.Type == EventTypeDenied {
+		return event.TargetService
+	}
+	return ""
+}
+
+// Gathers the device's events since windowStart, and its baseline from before.
+func (d *Drawbridge) deviceActivity(deviceID string, windowStart time.Time) (*anomaly.Activity, error) {
+	history, err := d.DB.GetDeviceHistory(deviceID, windowStart)
+	if err != nil {
+		return nil, err
+	}
+	recent, err := d.DB.QueryEmissaryClientEvents(emissary.EventQuery{DeviceID: deviceID, Since: windowStart, Descending: true, Limit: emissary.MaxEventQueryLimit})
+	if err != nil {
+		return nil, err
+	}
+	activity := anomaly.Activity{
+		HasHistory:     !history.FirstSeen.IsZero(),
+		KnownCountries: history.Countries,
+		KnownServices:  history.Services,
+	}
+	countries, ips, services := map[string]bool{}, map[string]bool{}, map[string]bool{}
+	for _, event := range recent.Events {
+		// Drawbridge records these itself, from the IP of the connection it ended.
+		if event.Type == EventTypeTerminated {
+			continue
+		}
+		if event.Country != "" && !countries[event.Country] {
+			countries[event.Country] = true
+			activity.Countries = append(activity.Countries, event.Country)
+		}
+		if addr, err := network.ParseIP(event.ConnectionIP); err == nil && !ips[addr.String()] {
+			ips[addr.String()] = true
+			activity.IPs = append(activity.IPs, addr.String())
+		}
+		if service := anomalyService(event); service != "" && !services[service] {
+			services[service] = true
+			activity.Services = append(activity.Services, service)
+		}
+	}
+	return &activity, nil
+}
+
+// Returns why quarantine turns the device away, or "" if it isn't quarantined. Anything that goes wrong looking up
+// the quarantine turns the device away.
+func (d *Drawbridge) checkQuarantine(deviceID string) string {
+	quarantine, err := d.DB.GetDeviceQuarantine(deviceID)
+	if err != nil {
+		slog.Error("Anomaly Detection", slog.Any("Error getting quarantine", err))
+		return "error getting the device's quarantine"
+	}
+	if quarantine.DeviceID == "" {
+		return ""
+	}
+	return fmt.Sprintf("the device is quarantined: %s", quarantine.Reason)
+}
+
+// Stops letting the device in to Protected Services, closes its Emissary Outbound Protected Services and ends its live
+// sessions. The device keeps its certificate.
+func (d *Drawbridge) quarantineDevice(event emissary.Event, result anomaly.Result) {
+	err := d.DB.QuarantineDevice(emissary.Quarantine{
+		DeviceID:      event.DeviceID,
+		Reason:        result.String(),
+		Score:         result.Score,
+		QuarantinedAt: time.Now().UTC(),
+	})
+	if err != nil {
+		// Another of the device's events got it quarantined first.
+		slog.Debug("Anomaly Detection", slog.String("Device", event.DeviceID), slog.Any("Error", err))
+		return
+	}
+	slog.Warn("Anomaly Detection", slog.String("Quarantined device", event.DeviceID), slog.String("signals", result.String()))
+	d.recordAnomalyEvent(sinks.TypeDeviceQuarantined, event, result)
+	reason := fmt.Sprintf("the device was quarantined: %s", result.String())
+	d.CloseOutboundServices(func(deviceID string) bool {
+		return deviceID == event.DeviceID
+	}, reason)
+	d.TerminateSessions(func(session Session) bool {
+		return session.DeviceID == event.DeviceID
+	}, reason)
+}
+
+// Lets a quarantined device connect to Protected Services again. Only its connections from now on count towards
+// quarantining it again.
+func (d *Drawbridge) ReleaseDevice(deviceID string) error {
+	err := d.DB.ReleaseDevice(deviceID)
+	if err != nil {
+		return err
+	}
+	d.anomalies.mu.Lock()
+	defer d.anomalies.mu.Unlock()
+	if d.anomalies.released == nil {
+		d.anomalies.released = make(map[string]time.Time)
+	}
+	d.anomalies.released[deviceID] = time.Now().UTC()
+	delete(d.anomalies.alerted, deviceID)
+	return nil
+}
+
+// Publishes an alert explaining why the detector flagged the device, with the connection that tipped it over.
+func (d *Drawbridge) recordAnomalyEvent(eventType string, event emissary.Event, result anomaly.Result) {
+	id, err := utils.NewUUID()
+	if err != nil {
+		slog.Error("Anomaly Detection", slog.Any("Error", err))
+	}
+	details := map[string]string{"score": strconv.Itoa(result.Score)}
+	for _, signal := range result.Signals {
+		details[signal.Name] = signal.Detail
+	}
+	d.EventSinkDispatcher.Publish(sinks.Event{
+		ID:            id,
+		Type:          eventType,
+		Timestamp:     time.Now().UTC(),
+		DeviceID:      event.DeviceID,
+		ConnectionIP:  event.ConnectionIP,
+		TargetService: event.TargetService,
+		Reason:        result.String(),
+		Country:       event.Country,
+		ASN:           event.ASN,
+		Details:       details,
+	})
+}
@@ -0,0 +1,177 @@
+package drawbridge
+
+import (
+	"fmt"
+	"imdawon/drawbridge/cmd/drawbridge/anomaly"
+	"imdawon/drawbridge/cmd/drawbridge/emissary"
+	"imdawon/drawbridge/cmd/drawbridge/persistence"
+	"imdawon/drawbridge/cmd/drawbridge/services"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAnomalyQuarantine(t *testing.T) {
+	db := persistence.NewMemoryRepository()
+	d := &Drawbridge{DB: db}
+	db.CreateNewEmissaryClient(emissary.EmissaryClient{ID: "laptop", Name: "Brave Otter", DrawbridgeCertificate: "cert-1"})
+	nas, _ := db.CreateNewService(services.ProtectedService{Name: "NAS"})
+
+	now := time.Now().UTC()
+	record := func(id, ip, country, eventType, service string, at time.Time) {
+		d.RecordEmissaryEvent(emissary.Event{ID: id, DeviceID: "laptop", ConnectionIP: ip, Country: country, Type: eventType, TargetService: service, Timestamp: at})
+	}
+	// A week of connecting to the NAS from home.
+	for day := 7; day > 0; day-- {
+		record(fmt.Sprintf("home-%d", day), "203.0.113.7:50000", "GB", "PS_CONN", "001", now.AddDate(0, 0, -day))
+	}
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	d.startSession(emissary.Event{ID: "home-session", DeviceID: "laptop", ConnectionIP: "203.0.113.7:50000"}, nas.ID, serverConn)
+	// The laptop also hosts an Emissary Outbound Protected Service.
+	d.OutboundServices = make(map[int64]*services.ProtectedService)
+	laptopOutbound, laptopClient := net.Pipe()
+	defer laptopClient.Close()
+	go io.ReadFull(laptopClient, make([]byte, len("ACK")))
+	d.handleEmissaryOutboundRegistration(laptopOutbound, "laptop", "Minecraft")
+
+	// The laptop shows up from France: unusual, but not enough on its own.
+	record("travel", "198.51.100.1:50000", "FR", "PS_LIST", "", now.Add(-2*time.Minute))
+	if quarantine, _ := db.GetDeviceQuarantine("laptop"); quarantine.DeviceID != "" {
+		t.Fatalf("expected one signal not to quarantine the device, got %+v", quarantine)
+	}
+	// Then from two more IPs within the window.
+	record("second-ip", "198.51.100.2:50000", "FR", "PS_LIST", "", now.Add(-time.Minute))
+	record("third-ip", "198.51.100.3:50000", "FR", "PS_CONN", "001", now)
+	quarantine, err := db.GetDeviceQuarantine("laptop")
+	if err != nil || quarantine.DeviceID != "laptop" || quarantine.Score != 80 {
+		t.Fatalf("expected the device to be quarantined with a score of 80, got %+v: %v", quarantine, err)
+	}
+	if !strings.Contains(quarantine.Reason, "first connection from FR") || !strings.Contains(quarantine.Reason, "3 IPs within 10 minutes") {
+		t.Errorf("expected the quarantine to explain why, got %q", quarantine.Reason)
+	}
+	if len(d.Sessions()) != 0 {
+		t.Error("expected quarantining the device to end its live sessions")
+	}
+	if len(d.OutboundServices) != 0 {
+		t.Errorf("expected quarantining the device to close its Emissary Outbound Protected Service, got %+v", d.OutboundServices)
+	}
+	if _, err := laptopClient.Read(make([]byte, 1)); err == nil {
+		t.Error("expected quarantining the device to close its Emissary Outbound connection")
+	}
+	// Connections let through before anomaly detection quarantined the device don't get in either.
+	lateConn, lateClient := net.Pipe()
+	defer lateClient.Close()
+	if err := d.startSession(emissary.Event{ID: "late-session", DeviceID: "laptop", ConnectionIP: "198.51.100.3:50000"}, nas.ID, lateConn); err == nil {
+		t.Error("expected a quarantined device not to start a session")
+	}
+	lateOutbound, lateOutboundClient := net.Pipe()
+	defer lateOutboundClient.Close()
+	d.handleEmissaryOutboundRegistration(lateOutbound, "laptop", "Minecraft")
+	if len(d.OutboundServices) != 0 {
+		t.Errorf("expected a quarantined device not to register an Emissary Outbound Protected Service, got %+v", d.OutboundServices)
+	}
+	decision := d.AuthorizeProtectedServiceConnection("laptop", "203.0.113.7:50000", nas.ID)
+	if decision.Allowed || !strings.HasPrefix(decision.Reason, "the device is quarantined: ") {
+		t.Errorf("expected a quarantined device to be denied, got %+v", decision)
+	}
+	if decision := d.AuthorizeOutboundRegistration("laptop"); decision.Allowed || !strings.HasPrefix(decision.Reason, "the device is quarantined: ") {
+		t.Errorf("expected a quarantined device to be denied registering an Emissary Outbound Protected Service, got %+v", decision)
+	}
+	if device, _ := db.GetEmissaryClientById("laptop"); device.Revoked != 0 {
+		t.Error("expected quarantine not to revoke the device")
+	}
+
+	// Releasing the device forgives the connections that got it quarantined.
+	if err := d.ReleaseDevice("laptop"); err != nil {
+		t.Fatalf("ReleaseDevice failed: %v", err)
+	}
+	record("after-release", "198.51.100.3:50001", "FR", "PS_CONN", "001", now.Add(time.Second))
+	if quarantine, _ := db.GetDeviceQuarantine("laptop"); quarantine.DeviceID != "" {
+		t.Errorf("expected a released device not to be quarantined again for the same connections, got %+v", quarantine)
+	}
+	if decision := d.AuthorizeProtectedServiceConnection("laptop", "198.51.100.3:50001", nas.ID); !decision.Allowed {
+		t.Errorf("expected a released device to be let in, got %+v", decision)
+	}
+	if err := d.startSession(emissary.Event{ID: "released-session", DeviceID: "laptop", ConnectionIP: "198.51.100.3:50001"}, nas.ID, lateConn); err != nil {
+		t.Errorf("expected a released device to start a session, got %v", err)
+	}
+	if err := d.ReleaseDevice("laptop"); err == nil {
+		t.Error("expected ReleaseDevice to fail for a device that isn't quarantined")
+	}
+}
+
+func TestAnomalyAlertOnly(t *testing.T) {
+	db := persistence.NewMemoryRepository()
+	d := &Drawbridge{DB: db}
+	db.CreateNewEmissaryClient(emissary.EmissaryClient{ID: "phone", Name: "Quiet Heron", DrawbridgeCertificate: "cert-1"})
+	settings := anomaly.DefaultSettings
+	settings.Quarantine = false
+	settings.Threshold = settings.ManyIPsScore
+	if err := d.SaveAnomalySettings(settings); err != nil {
+		t.Fatalf("SaveAnomalySettings failed: %v", err)
+	}
+	if saved := d.AnomalySettings(); saved != settings {
+		t.Errorf("expected the settings to be saved, got %+v", saved)
+	}
+	invalid := settings
+	invalid.Threshold = 0
+	if err := d.SaveAnomalySettings(invalid); err == nil {
+		t.Error("expected SaveAnomalySettings to refuse a threshold of 0")
+	}
+
+	now := time.Now().UTC()
+	for i := 0; i < 4; i++ {
+		d.RecordEmissaryEvent(emissary.Event{ID: fmt.Sprint(i), DeviceID: "phone", ConnectionIP: fmt.Sprintf("198.51.100.%d:50000", i), Type: "PS_LIST", Timestamp: now})
+	}
+	if quarantine, _ := db.GetDeviceQuarantine("phone"); quarantine.DeviceID != "" {
+		t.Errorf("expected the detector only to alert when quarantine is off, got %+v", quarantine)
+	}
+	if alerted, ok := d.anomalies.alerted["phone"]; !ok || !alerted.Equal(now) {
+		t.Errorf("expected the detector to alert once, for the connection that crossed the threshold, got %v", alerted)
+	}
+}
+
+func TestAnomalyBaseline(t *testing.T) {
+	db := persistence.NewMemoryRepository()
+	d := &Drawbridge{DB: db}
+	db.CreateNewEmissaryClient(emissary.EmissaryClient{ID: "laptop", Name: "Brave Otter", DrawbridgeCertificate: "cert-1"})
+	settings := anomaly.DefaultSettings
+	settings.Threshold = settings.NewServicesScore
+	if err := d.SaveAnomalySettings(settings); err != nil {
+		t.Fatalf("SaveAnomalySettings failed: %v", err)
+	}
+
+	now := time.Now().UTC()
+	record := func(id, country, eventType, service string, at time.Time) {
+		d.RecordEmissaryEvent(emissary.Event{ID: id, DeviceID: "laptop", ConnectionIP: "203.0.113.7:50000", Country: country, Type: eventType, TargetService: service, Timestamp: at})
+	}
+	// Two months ago the laptop used the NAS from home, and registered Emissary Outbound Protected Services.
+	record("nas", "GB", "PS_CONN", "001", now.AddDate(0, -2, 0))
+	for i, service := range []string{"002", "003", "004"} {
+		record(fmt.Sprint("outbound-", i), "GB", "OB_CR8T", service, now.AddDate(0, -2, 0))
+	}
+	if _, err := db.PruneEmissaryClientEvents(now.AddDate(0, 0, -30)); err != nil {
+		t.Fatalf("PruneEmissaryClientEvents failed: %v", err)
+	}
+
+	// Its events are gone, but the detector still knows the laptop connects from GB and uses the NAS.
+	record("home", "GB", "PS_CONN", "001", now.Add(-2*time.Minute))
+	if quarantine, _ := db.GetDeviceQuarantine("laptop"); quarantine.DeviceID != "" {
+		t.Fatalf("expected the baseline to outlive the events, got %+v", quarantine)
+	}
+	// Registering an Emissary Outbound Protected Service isn't connecting to it, so connecting to those counts as
+	// new services.
+	record("second", "GB", "PS_CONN", "002", now.Add(-time.Minute))
+	record("third", "GB", "PS_DENY", "003", now)
+	if quarantine, _ := db.GetDeviceQuarantine("laptop"); quarantine.DeviceID != "" {
+		t.Fatalf("expected 2 new services not to be a burst, got %+v", quarantine)
+	}
+	record("fourth", "GB", "PS_CONN", "004", now)
+	quarantine, _ := db.GetDeviceQuarantine("laptop")
+	if quarantine.Reason != "burst of new services: 3 Protected Services it never used within 10 minutes" {
+		t.Errorf("expected a burst of new services, got %+v", quarantine)
+	}
+}
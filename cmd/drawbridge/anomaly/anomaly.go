@@ -0,0 +1,156 @@
+// Package anomaly scores how unusual a device's recent connections are compared to its history, so Drawbridge can
+// notice a device certificate that was stolen and is being used from somewhere else.
+//
+// Each signal that fires adds its score. A device whose score reaches the threshold is reported, and quarantined if
+// the Drawbridge admin turned quarantine on.
+package anomaly
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// The signals the detector scores.
+const (
+	SignalNewCountry  = "new country"
+	SignalManyIPs     = "several IPs at once"
+	SignalNewServices = "burst of new services"
+)
+
+// How the detector scores connections. Scores are out of 100.
+type Settings struct {
+	Enabled bool `json:"enabled" schema:"anomaly-enabled"`
+	// Quarantine devices whose score reaches Threshold. Otherwise the detector only alerts.
+	Quarantine bool `json:"quarantine" schema:"anomaly-quarantine"`
+	Threshold  int  `json:"threshold" schema:"anomaly-threshold"`
+	// What each signal adds to the score. 0 turns the signal off.
+	NewCountryScore  int `json:"new_country_score" schema:"anomaly-new-country-score"`
+	ManyIPsScore     int `json:"many_ips_score" schema:"anomaly-many-ips-score"`
+	NewServicesScore int `json:"new_services_score" schema:"anomaly-new-services-score"`
+	// How far back the detector looks at a device's connections.
+	WindowMinutes int `json:"window_minutes" schema:"anomaly-window-minutes"`
+	// Distinct IPs within the window that count as several IPs at once.
+	MaxIPs int `json:"max_ips" schema:"anomaly-max-ips"`
+	// Protected Services the device never asked for before, asked for within the window, that count as a burst.
+	MaxNewServices int `json:"max_new_services" schema:"anomaly-max-new-services"`
+}
+
+// Any two signals quarantine a device. A device that travels sets off the new country signal on its own, and
+// a phone switching between Wi-Fi and mobile data uses two IPs, so neither is enough by itself.
+var DefaultSettings = Settings{
+	Enabled:          true,
+	Quarantine:       true,
+	Threshold:        60,
+	NewCountryScore:  40,
+	ManyIPsScore:     40,
+	NewServicesScore: 30,
+	WindowMinutes:    10,
+	MaxIPs:           3,
+	MaxNewServices:   3,
+}
+
+const (
+	MaxScore         = 100
+	MaxWindowMinutes = 24 * 60
+)
+
+func (s *Settings) Window() time.Duration {
+	return time.Duration(s.WindowMinutes) * time.Minute
+}
+
+func (s *Settings) Validate() error {
+	for _, score := range []int{s.Threshold, s.NewCountryScore, s.ManyIPsScore, s.NewServicesScore} {
+		if score < 0 || score > MaxScore {
+			return fmt.Errorf("scores and the threshold must be between 0 and %d", MaxScore)
+		}
+	}
+	if s.Threshold == 0 {
+		return errors.New("a threshold of 0 would flag every device")
+	}
+	if s.WindowMinutes < 1 || s.WindowMinutes > MaxWindowMinutes {
+		return fmt.Errorf("the window must be between 1 and %d minutes", MaxWindowMinutes)
+	}
+	if s.MaxIPs < 2 {
+		return errors.New("several IPs at once needs at least 2 IPs")
+	}
+	if s.MaxNewServices < 1 {
+		return errors.New("a burst of new services needs at least 1 service")
+	}
+	return nil
+}
+
+// What the detector knows about a device when one of its connections is recorded.
+type Activity struct {
+	// False for a device without connections before the window, which has nothing to compare to, so the new
+	// country and new service signals don't fire.
+	HasHistory bool
+	// Countries and padded Protected Service ids from before the window.
+	KnownCountries []string
+	KnownServices  []string
+	// Distinct countries, IPs and padded Protected Service ids within the window, including the connection being
+	// recorded.
+	Countries []string
+	IPs       []string
+	Services  []string
+}
+
+type Signal struct {
+	Name   string
+	Score  int
+	Detail string
+}
+
+type Result struct {
+	Score   int
+	Signals []Signal
+}
+
+func (r Result) Flagged(settings Settings) bool {
+	return r.Score >= settings.Threshold
+}
+
+// e.g. "new country: first connection from FR; several IPs at once: 4 IPs within 10 minutes"
+func (r Result) String() string {
+	var signals []string
+	for _, signal := range r.Signals {
+		signals = append(signals, fmt.Sprintf("%s: %s", signal.Name, signal.Detail))
+	}
+	return strings.Join(signals, "; ")
+}
+
+func (s *Settings) Evaluate(activity Activity) Result {
+	var result Result
+	add := func(name string, score int, detail string) {
+		if score > 0 {
+			result.Score += score
+			result.Signals = append(result.Signals, Signal{Name: name, Score: score, Detail: detail})
+		}
+	}
+	if activity.HasHistory {
+		if countries := unknown(activity.Countries, activity.KnownCountries); len(countries) > 0 {
+			add(SignalNewCountry, s.NewCountryScore, "first connection from "+strings.Join(countries, ", "))
+		}
+		if services := unknown(activity.Services, activity.KnownServices); len(services) >= s.MaxNewServices {
+			add(SignalNewServices, s.NewServicesScore, fmt.Sprintf("%d Protected Services it never used within %d minutes", len(services), s.WindowMinutes))
+		}
+	}
+	if len(activity.IPs) >= s.MaxIPs {
+		add(SignalManyIPs, s.ManyIPsScore, fmt.Sprintf("%d IPs within %d minutes", len(activity.IPs), s.WindowMinutes))
+	}
+	return result
+}
+
+// Returns the values that aren't known, sorted.
+func unknown(values, known []string) []string {
+	var unknown []string
+	for _, value := range values {
+		if !slices.Contains(known, value) {
+			unknown = append(unknown, value)
+		}
+	}
+	slices.Sort(unknown)
+	return slices.Compact(unknown)
+}
@@ -0,0 +1,74 @@
+package anomaly
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEvaluate(t *testing.T) {
+	settings := DefaultSettings
+	usual := Activity{
+		HasHistory:     true,
+		KnownCountries: []string{"GB"},
+		KnownServices:  []string{"001", "002"},
+		Countries:      []string{"GB"},
+		IPs:            []string{"203.0.113.7"},
+		Services:       []string{"001"},
+	}
+	if result := settings.Evaluate(usual); result.Score != 0 || result.Flagged(settings) {
+		t.Errorf("expected usual activity not to score, got %+v", result)
+	}
+
+	travelling := usual
+	travelling.Countries = []string{"FR"}
+	result := settings.Evaluate(travelling)
+	if result.Score != settings.NewCountryScore || result.Flagged(settings) {
+		t.Errorf("expected a new country alone not to be flagged, got %+v", result)
+	}
+	if result.String() != "new country: first connection from FR" {
+		t.Errorf("unexpected explanation %q", result.String())
+	}
+
+	stolen := travelling
+	stolen.IPs = []string{"198.51.100.1", "198.51.100.2", "203.0.113.7"}
+	stolen.Services = []string{"001", "003", "004", "005"}
+	result = settings.Evaluate(stolen)
+	if result.Score != 110 || !result.Flagged(settings) || len(result.Signals) != 3 {
+		t.Errorf("expected every signal to fire, got %+v", result)
+	}
+	if !strings.Contains(result.String(), "several IPs at once: 3 IPs within 10 minutes") || !strings.Contains(result.String(), "burst of new services: 3 Protected Services") {
+		t.Errorf("expected the explanation to include every signal, got %q", result.String())
+	}
+
+	// A new device has nothing to compare its countries and services to.
+	stolen.HasHistory = false
+	if result := settings.Evaluate(stolen); result.Score != settings.ManyIPsScore {
+		t.Errorf("expected only several IPs at once to fire for a device without history, got %+v", result)
+	}
+
+	settings.ManyIPsScore = 0
+	if result := settings.Evaluate(stolen); len(result.Signals) != 0 {
+		t.Errorf("expected a signal scoring 0 to be turned off, got %+v", result)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := DefaultSettings.Validate(); err != nil {
+		t.Errorf("expected the default settings to be valid, got %v", err)
+	}
+	for name, change := range map[string]func(s *Settings){
+		"zero threshold":    func(s *Settings) { s.Threshold = 0 },
+		"score over 100":    func(s *Settings) { s.NewCountryScore = 101 },
+		"negative score":    func(s *Settings) { s.ManyIPsScore = -1 },
+		"no window":         func(s *Settings) { s.WindowMinutes = 0 },
+		"one IP":            func(s *Settings) { s.MaxIPs = 1 },
+		"no new services":   func(s *Settings) { s.MaxNewServices = 0 },
+		"window over a day": func(s *Settings) { s.WindowMinutes = MaxWindowMinutes + 1 },
+	} {
+		settings := DefaultSettings
+		change(&settings)
+		if err := settings.Validate(); err == nil {
+			t.Errorf("%s: expected Validate to fail", name)
+		}
+	}
+}
@@ -2,19 +2,18 @@ package drawbridge
 
 import (
 	"bytes"
-	"crypto/ecdsa"
-	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
-	"crypto/x509/pkix"
 	"encoding/json"
-	"encoding/pem"
 	"errors"
 	"fmt"
 	"imdawon/drawbridge/cmd/drawbridge/emissary"
+	"imdawon/drawbridge/cmd/drawbridge/emissary/authorization"
+	"imdawon/drawbridge/cmd/drawbridge/network"
 	"imdawon/drawbridge/cmd/drawbridge/persistence"
 	"imdawon/drawbridge/cmd/drawbridge/services"
+	"imdawon/drawbridge/cmd/drawbridge/sinks"
 	flagger "imdawon/drawbridge/cmd/flags"
 	certificates "imdawon/drawbridge/cmd/reverse_proxy/ca"
 	"imdawon/drawbridge/cmd/utils"
@@ -29,6 +28,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ProtonMail/gopenpgp/v3/crypto"
@@ -37,6 +37,8 @@ import (
 type Settings struct {
 	ListenerAddress string `schema:"listener-address"`
 	EnableDAUPing   bool   `schema:"enable-ping"`
+	// The key algorithm for the certificate authority Drawbridge creates during onboarding.
+	CertificateAuthorityKeyAlgorithm string `schema:"ca-key-algorithm"`
 }
 
 // Used by the frontend controller to execute Drawbridge functions.
@@ -46,16 +48,34 @@ type Drawbridge struct {
 	CA                *certificates.CA
 	ProtectedServices map[int64]services.RunningProtectedService
 	Settings          *Settings
-	DB                *persistence.SQLiteRepository
+	DB                persistence.Repository
 	ListeningAddress  string
 	ListeningPort     uint
 	// Contains persistent connections to Emissary Outbound proxy clients, which can expose a service available to it as a Protected Service in Drawbridge.
 	OutboundServices map[int64]*services.ProtectedService
 	OutboundMutex    sync.RWMutex
+	// Decrypts the certificate authority and server private keys on disk, if they are encrypted.
+	KeyPassphrase []byte
+	// Ships Emissary events and admin actions to the configured event sinks.
+	EventSinkDispatcher *sinks.Dispatcher
+	// Connections currently proxied to Protected Services, so they can be ended early.
+	sessions sessionRegistry
+	// When each device last stepped up with a TOTP code.
+	stepUps stepUpCache
+	// Recent failed connections to the Emissary listener, counted towards banning their source IPs.
+	connectionFailures failureTracker
+	// What the anomaly detector remembers about devices between their events.
+	anomalies anomalyState
+	lockdown  lockdownState
+	// Nil until the Drawbridge admin sets up GeoIP databases.
+	geoIP atomic.Pointer[network.GeoIP]
 }
 
 type EmissaryConfig struct {
 	Platform string `schema:"emissary-platform"`
+	// Comma separated groups and tags for the new device, e.g. family,friends.
+	Groups string `schema:"emissary-groups"`
+	Tags   string `schema:"emissary-tags"`
 }
 
 // Commented out until we decide to develop device attestation requirements.
@@ -91,14 +111,56 @@ type EmissaryConfig struct {
 // }
 // }
 
-func (d *Drawbridge) handleEmissaryOutboundRegistration(conn net.Conn, serviceName string) {
+func (d *Drawbridge) handleEmissaryOutboundRegistration(conn net.Conn, deviceID, serviceName string) {
 	d.OutboundMutex.Lock()
+	// Anomaly detection runs after the registration is let through, so the device may have been quarantined since.
+	// Checked while holding the lock so quarantineDevice either closes the registration or it is refused here.
+	if reason := d.checkQuarantine(deviceID); reason != "" {
+		d.OutboundMutex.Unlock()
+		slog.Warn("OB_CR8T Handler", slog.String("Denied device", deviceID), slog.String("reason", reason))
+		conn.Close()
+		return
+	}
 	// TODO - don't pin a set ID, integrate it alongside the other Protected Services.
-	d.OutboundServices[999] = &services.ProtectedService{ID: 999, Name: serviceName, Conn: conn}
+	d.OutboundServices[999] = &services.ProtectedService{ID: 999, Name: serviceName, Conn: conn, OutboundDeviceID: deviceID}
 	d.OutboundMutex.Unlock()
 
 	conn.Write([]byte("ACK"))
-	slog.Info("Registered outbound service", slog.String("service", serviceName))
+	slog.Info("Registered outbound service", slog.String("service", serviceName), slog.String("device", deviceID))
+}
+
+// Closes and forgets the Emissary Outbound Protected Services registered by the devices match returns true for, and
+// records a PS_TERM event with the reason for each. Returns how many were closed.
+func (d *Drawbridge) CloseOutboundServices(match func(deviceID string) bool, reason string) int {
+	d.OutboundMutex.Lock()
+	var closed []*services.ProtectedService
+	for id, service := range d.OutboundServices {
+		if match(service.OutboundDeviceID) {
+			closed = append(closed, service)
+			delete(d.OutboundServices, id)
+		}
+	}
+	d.OutboundMutex.Unlock()
+
+	for _, service := range closed {
+		// Closing the Emissary Outbound client's connection also ends the sessions proxied over it.
+		service.Conn.Close()
+		id, err := utils.NewUUID()
+		if err != nil {
+			slog.Error("Emissary Event", slog.Any("Error", err))
+		}
+		slog.Info("Closed outbound service", slog.String("service", service.Name), slog.String("device", service.OutboundDeviceID), slog.String("reason", reason))
+		d.RecordEmissaryEvent(emissary.Event{
+			ID:            id,
+			DeviceID:      service.OutboundDeviceID,
+			ConnectionIP:  service.Conn.RemoteAddr().String(),
+			Type:          EventTypeTerminated,
+			TargetService: utils.PadWithZeros(int(service.ID)),
+			Timestamp:     time.Now().UTC(),
+			Reason:        reason,
+		})
+	}
+	return len(closed)
 }
 
 // If a Protected Service is being tunneled by an Emissary Outbound client, we have to handle the connection differently than a normal Drawbridge -> Protected Service connection.
@@ -107,7 +169,8 @@ func (d *Drawbridge) handleEmissaryOutboundRegistration(conn net.Conn, serviceNa
 // d.OutboundServices map.
 // When a regular Emissary client requests to access an Emissary Outbound Protected Service, Drawbridge will get the connection from the OutboundServices map
 // mentioned earlier and write all the data the Emissary client sends to the Emissary Outbound Protected service, and vice versa.
-func (d *Drawbridge) handleEmissaryOutboundProtectedServiceConnection(emissaryClient net.Conn, serviceName string) {
+// Returns the bytes proxied from and to the Emissary client.
+func (d *Drawbridge) handleEmissaryOutboundProtectedServiceConnection(emissaryClient net.Conn, serviceName string) (bytesIn, bytesOut int64) {
 	defer emissaryClient.Close()
 
 	d.OutboundMutex.RLock()
@@ -115,13 +178,12 @@ func (d *Drawbridge) handleEmissaryOutboundProtectedServiceConnection(emissaryCl
 	d.OutboundMutex.RUnlock()
 	if !exists {
 		slog.Error("Requested service not found", "serviceName", serviceName)
-		return
+		return 0, 0
 	} else {
 		slog.Debug("Proxying emissary outbound traffic...\n")
 	}
 
-	proxyData(outboundService.Conn, emissaryClient)
-
+	return proxyData(outboundService.Conn, emissaryClient)
 }
 
 // Set up an mTLS-protected API to serve Emissary client requests.
@@ -144,19 +206,59 @@ func (d *Drawbridge) SetUpEmissaryAPI(hostAndPort string) {
 
 func (d *Drawbridge) SetUpCAAndDependentServices(protectedServices []services.ProtectedService) {
 	certificates.CertificateAuthority = &certificates.CA{DB: d.DB}
+	certificates.CertificateAuthority.UseKeyPassphrase(d.KeyPassphrase)
 	err := certificates.CertificateAuthority.SetupCertificates()
-	if err != nil {
-		slog.Error("Error setting up root CA: %s", err)
-	}
 	// Set certificate authority for Drawbridge. We access the CA from Drawbridge from this point on.
 	d.CA = certificates.CertificateAuthority
+	if errors.Is(err, certificates.ErrCertificateAuthorityLocked) {
+		// We can't accept Emissary connections without the server key.
+		// The dependent services start once the Drawbridge admin unlocks the certificate authority.
+		return
+	}
+	if err != nil {
+		slog.Error("Error setting up root CA", slog.Any("error", err))
+	}
+	d.startDependentServices(protectedServices)
+}
 
+// Decrypts the certificate authority and server private keys with passphrase, then starts the services
+// that were waiting on the certificate authority.
+func (d *Drawbridge) UnlockCertificateAuthority(passphrase []byte) error {
+	if d.CA == nil {
+		return fmt.Errorf("the certificate authority has not been set up yet")
+	}
+	err := d.CA.Unlock(passphrase)
+	if err != nil {
+		return err
+	}
+	protectedServices, err := d.DB.GetAllServices()
+	if err != nil {
+		return err
+	}
+	go d.startDependentServices(protectedServices)
+	return nil
+}
+
+// Replaces the certificate authority with one the Drawbridge admin already runs.
+// During onboarding the certificate authority doesn't exist yet, so we only write the imported files to disk
+// and SetUpCAAndDependentServices loads them.
+func (d *Drawbridge) ImportCertificateAuthority(imported *certificates.ImportedCertificateAuthority) error {
+	if d.CA != nil {
+		return d.CA.ImportCertificateAuthority(imported)
+	}
+	ca := &certificates.CA{DB: d.DB}
+	ca.UseKeyPassphrase(d.KeyPassphrase)
+	return ca.ImportCertificateAuthority(imported)
+}
+
+func (d *Drawbridge) startDependentServices(protectedServices []services.ProtectedService) {
 	// Start TCP and UDP listeners for each Drawbridge Protected Service.
 	for _, service := range protectedServices {
 		d.AddNewProtectedService(service)
 	}
 
 	go d.SetUpProtectedServiceTunnel()
+	go d.startReplication()
 
 	d.SetUpEmissaryAPI(flagger.FLAGS.BackendAPIHostAndPort)
 }
@@ -181,82 +283,26 @@ func (d *Drawbridge) CreateEmissaryClientTCPMutualTLSKey(clientId, platform stri
 		slog.Error("Database", slog.Any("Could not get all services: %s", err))
 	}
 
-	clientCert := &x509.Certificate{
-		SerialNumber: big.NewInt(2019),
-		// TODO: Must be domain name or IP during user dash setup
-		Subject: pkix.Name{
-			Organization:  []string{"Drawbridge"},
-			Country:       []string{""},
-			Province:      []string{""},
-			Locality:      []string{""},
-			StreetAddress: []string{""},
-			PostalCode:    []string{""},
-			CommonName:    *listeningAddress,
-			SerialNumber:  clientId,
-		},
-		NotBefore:    time.Now(),
-		NotAfter:     time.Now().AddDate(10, 0, 0),
-		SubjectKeyId: []byte{1, 2, 3, 4, 6},
-		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
-		KeyUsage:     x509.KeyUsageDigitalSignature,
-	}
-
-	clientCertPrivKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	certPEMBytes, clientCertPrivKey, err := d.CA.IssueEmissaryCertificate(clientId, *listeningAddress, d.CA.DeviceKeyAlgorithm(platform))
 	if err != nil {
 		return nil, err
 	}
-
-	// Create the client certificate and sign it with our CA private key.
-	clientCertBytes, err := x509.CreateCertificate(
-		rand.Reader,
-		clientCert,
-		d.CA.CertificateAuthority,
-		&clientCertPrivKey.PublicKey,
-		d.CA.PrivateKey,
-	)
-	if err != nil {
-		slog.Error(fmt.Sprintf("%s", err))
-	}
-
-	certPEM := new(bytes.Buffer)
-	pem.Encode(certPEM, &pem.Block{
-		Type:  "CERTIFICATE",
-		Bytes: clientCertBytes,
-	})
+	certPEM := bytes.NewBuffer(certPEMBytes)
+	// The Emissary client presents the certificate followed by the intermediate certificate authority,
+	// so it can be verified against the root certificate authority in the bundle.
+	certChainPEM := append(certPEM.Bytes(), d.CA.CertificateChainPEM()...)
 	// Save the file to disk for use by an Emissary client. This should be later used and saved in the db for downloading later.
-	err = utils.SaveFile("emissary-mtls-tcp.crt", certPEM.String(), directoryToSave)
+	err = utils.SaveFile("emissary-mtls-tcp.crt", string(certChainPEM), directoryToSave)
 	if err != nil {
 		return nil, err
 	}
 
-	// Android is a special little platform. The Kotlin/Java stdlib seems to only have support for the
-	// PKCS8 format. We generate a key in this format for Android to avoid complicated conversion code
-	// on the Android client.
-	var certPrivKeyPEMBytes []byte
-	var certPrivKeyPEM *bytes.Buffer
-	if platform == "android" {
-		certPrivKeyPEMBytes, err = x509.MarshalPKCS8PrivateKey(clientCertPrivKey)
-		if err != nil {
-			return nil, err
-		}
-		certPrivKeyPEM = new(bytes.Buffer)
-		pem.Encode(certPrivKeyPEM, &pem.Block{
-			Type:  "PRIVATE KEY",
-			Bytes: certPrivKeyPEMBytes,
-		})
-		// For non-Android platforms, use the EC Private Key format.
-	} else {
-		certPrivKeyPEMBytes, err = x509.MarshalECPrivateKey(clientCertPrivKey)
-		if err != nil {
-			return nil, err
-		}
-		certPrivKeyPEM = new(bytes.Buffer)
-		pem.Encode(certPrivKeyPEM, &pem.Block{
-			Type:  "EC PRIVATE KEY",
-			Bytes: certPrivKeyPEMBytes,
-		})
-
+	// The key encoding is a per-platform setting, since each platform's Emissary client reads different formats.
+	certPrivKeyPEMBytes, err := certificates.EncodePrivateKeyAs(clientCertPrivKey, d.CA.DeviceKeyEncoding(platform))
+	if err != nil {
+		return nil, err
 	}
+	certPrivKeyPEM := bytes.NewBuffer(certPrivKeyPEMBytes)
 
 	// Save the file to disk for use by an Emissary client. This should be later used and saved in the db for downloading later.
 	err = utils.SaveFile("emissary-mtls-tcp.key", certPrivKeyPEM.String(), directoryToSave)
@@ -264,7 +310,7 @@ func (d *Drawbridge) CreateEmissaryClientTCPMutualTLSKey(clientId, platform stri
 		slog.Error(fmt.Sprintf("Error saving x509 keypair for Emissary client to disk: %s", err))
 	}
 
-	emissaryCert, err := tls.X509KeyPair(certPEM.Bytes(), certPrivKeyPEM.Bytes())
+	emissaryCert, err := tls.X509KeyPair(certChainPEM, certPrivKeyPEM.Bytes())
 	if err != nil {
 		return nil, err
 	}
@@ -317,7 +363,9 @@ func (d *Drawbridge) VerifyPeerCertificateWithRevocationCheck(cert string) error
 	return nil
 }
 
-func proxyData(dst net.Conn, src net.Conn) {
+// Copies data between dst and src until either side closes.
+// Returns the bytes copied from src to dst and from dst to src.
+func proxyData(dst net.Conn, src net.Conn) (srcToDst, dstToSrc int64) {
 	defer dst.Close()
 	defer src.Close()
 
@@ -326,7 +374,8 @@ func proxyData(dst net.Conn, src net.Conn) {
 
 	go func() {
 		defer wg.Done()
-		_, err := io.Copy(dst, src)
+		var err error
+		srcToDst, err = io.Copy(dst, src)
 		if err != nil {
 			slog.Error("Failed to copy src to dst", "error", err)
 		}
@@ -335,7 +384,8 @@ func proxyData(dst net.Conn, src net.Conn) {
 	}()
 	go func() {
 		defer wg.Done()
-		_, err := io.Copy(src, dst)
+		var err error
+		dstToSrc, err = io.Copy(src, dst)
 		if err != nil {
 			slog.Error("Failed to copy dst to src", "error", err)
 		}
@@ -343,6 +393,7 @@ func proxyData(dst net.Conn, src net.Conn) {
 	}()
 
 	wg.Wait()
+	return srcToDst, dstToSrc
 }
 
 // This is the service the Emissary client connects to when it wants to access a Protected Service.
@@ -359,34 +410,79 @@ func (d *Drawbridge) SetUpProtectedServiceTunnel() error {
 	l, err := tls.Listen("tcp", fmt.Sprintf("0.0.0.0:%d", d.ListeningPort), d.CA.ServerTLSConfig)
 	if err != nil {
 		slog.Error(fmt.Sprintf("Reverse proxy TCP Listen failed: %s", err))
+		return err
 	}
 
 	defer l.Close()
 
+	const minAcceptDelay = 5 * time.Millisecond
+	const maxAcceptDelay = time.Second
+	var acceptDelay time.Duration
 	for {
-		// Wait and accept connections that present a valid mTLS certificate.
-		conn, _ := l.Accept()
+		// Wait and accept connections. Their mTLS certificate is checked during the handshake below.
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			// e.g. Drawbridge ran out of file descriptors. Back off instead of spinning until connections close.
+			acceptDelay = min(max(2*acceptDelay, minAcceptDelay), maxAcceptDelay)
+			slog.Error("Reverse proxy TCP Accept failed", slog.Any("error", err), slog.Duration("retrying in", acceptDelay))
+			time.Sleep(acceptDelay)
+			continue
+		}
+		acceptDelay = 0
 
 		// Handle new connection in a new go routine.
 		// The loop then returns to accepting, so that
 		// multiple connections may be served concurrently.
 		go func(emissaryConn net.Conn) {
+			connectionIP := emissaryConn.RemoteAddr().String()
+			// Checked before the TLS handshake and the preamble, so connections from banned IPs and refused networks cost as little as possible.
+			if ban := d.activeBan(connectionIP, time.Now()); ban != nil {
+				slog.Debug("IP Bans", slog.String("Refused connection from", ban.IP))
+				emissaryConn.Close()
+				return
+			}
+			if reason := d.CheckNetworkRules(connectionIP); reason != "" {
+				slog.Warn("Network Rules", slog.String("Refused connection", reason))
+				emissaryConn.Close()
+				return
+			}
+			// The deadline keeps connections that never finish the handshake or send a request from piling up.
+			tlsConn := emissaryConn.(*tls.Conn)
+			tlsConn.SetDeadline(time.Now().Add(handshakeTimeout))
+			failure, err := handshake(tlsConn)
+			if err != nil {
+				slog.Warn("Emissary Connection", slog.String("Failed handshake from", connectionIP), slog.Any("error", err))
+				d.RecordConnectionFailure(connectionIP, failure, time.Now())
+				emissaryConn.Close()
+				return
+			}
 			// Read incoming data
 			buf := make([]byte, 256)
 			n, err := conn.Read(buf)
 			if err != nil {
 				slog.Error("Protected Service", slog.Any("Connection Read Error: %w", err))
+				emissaryConn.Close()
 				return
 			}
+			tlsConn.SetDeadline(time.Time{})
 			// Trim unused buffer null terminating characters.
 			buf = bytes.Trim(buf, "\x00")
 			// Print the incoming data - for debugging
 			slog.Info("Emissary Connection", slog.Any("Message Received", buf))
 
 			emissaryRequestPayload := string(buf[:n])
+			if err := checkPreamble(emissaryRequestPayload); err != nil {
+				slog.Warn("Emissary Connection", slog.String("Malformed request from", connectionIP), slog.Any("error", err))
+				d.RecordConnectionFailure(connectionIP, network.FailureMalformedRequest, time.Now())
+				emissaryConn.Close()
+				return
+			}
 			emissaryRequestType := emissaryRequestPayload[:7]
 			emissaryRequestedServiceId := ""
-			if emissaryRequestType != "PS_LIST" {
+			if emissaryRequestType != "PS_LIST" && emissaryRequestType != "CA_ROTN" && emissaryRequestType != "DV_PSTR" {
 				emissaryRequestedServiceId = emissaryRequestPayload[8:11]
 			}
 
@@ -405,33 +501,73 @@ func (d *Drawbridge) SetUpProtectedServiceTunnel() error {
 				Type:           emissaryRequestType,
 				TargetService:  emissaryRequestedServiceId,
 				ConnectionType: "",
-				Timestamp:      time.Now().Format(time.RFC3339),
+				Timestamp:      time.Now().UTC(),
 			}
-			go func() {
-				slog.Debug("Inserting Emissary Event...")
-				err = d.DB.InsertEmissaryClientEvent(event)
-			}()
-			if err != nil {
-				slog.Error("Emissary Event", slog.Any("DB Error", err))
+			emissaryRequestedServiceIdNum := 0
+			var decision authorization.Decision
+			if emissaryRequestType == "PS_CONN" {
+				emissaryRequestedServiceIdNum, err = strconv.Atoi(emissaryRequestedServiceId)
+				if err != nil {
+					slog.Error("PS_CONN Handler", slog.Any("Error converting first byte of emissary request service id to int", err))
+				}
+				// Checked before the event is recorded, so a denied connection is recorded as one.
+				decision = d.AuthorizeConnection(AccessRequest{
+					DeviceID:     deviceUUID,
+					ServiceID:    int64(emissaryRequestedServiceIdNum),
+					ConnectionIP: event.ConnectionIP,
+					Time:         time.Now(),
+					StepUpCode:   stepUpCode(emissaryRequestPayload),
+				})
+				if !decision.Allowed {
+					event.Type = EventTypeDenied
+					event.Reason = decision.Reason
+					event.Trace = decision.Trace
+				}
+			} else if emissaryRequestType == "OB_CR8T" {
+				decision = d.AuthorizeOutboundRegistration(deviceUUID)
+				if !decision.Allowed {
+					event.Type = EventTypeDenied
+					event.Reason = decision.Reason
+					event.Trace = decision.Trace
+				}
 			}
+			go d.RecordEmissaryEvent(event)
 
 			switch emissaryRequestType {
 			case "OB_CR8T":
+				if !decision.Allowed {
+					slog.Warn("OB_CR8T Handler", slog.String("Denied device", deviceUUID), slog.String("reason", decision.Reason))
+					emissaryConn.Close()
+					break
+				}
 				slog.Debug("Create Outbound Protected Service Request - handling...")
-				d.handleEmissaryOutboundRegistration(conn, emissaryRequestPayload[18:])
+				d.handleEmissaryOutboundRegistration(conn, deviceUUID, emissaryRequestPayload[18:])
 			case "PS_CONN":
+				if !decision.Allowed {
+					slog.Warn("PS_CONN Handler", slog.String("Denied device", deviceUUID), slog.String("service", emissaryRequestedServiceId), slog.String("reason", decision.Reason))
+					// Tells the Emissary client to ask for a TOTP code and connect again.
+					if decision.NeedsStepUp {
+						fmt.Fprintf(emissaryConn, "PS_CONN: STEP_UP %s\n", decision.Reason)
+					}
+					emissaryConn.Close()
+					break
+				}
 				// May be used later after we standardize how and when to read the tcp connection into the buf above.
 				// d.getRequestProtectedServiceName(clientConn)
-				emissaryRequestedServiceIdNum, err := strconv.Atoi(emissaryRequestedServiceId)
-				if err != nil {
-					slog.Error("PS_CONN Handler", slog.Any("Error converting first byte of emissary request service id to int", err))
-				}
 				requestedServiceAddress, tunnelType := d.getProtectedServiceAddressById(emissaryRequestedServiceIdNum)
 				// For Emissary OB (Outbound) connects, Drawbridge will actually connect to an Emissary client which is exposing a
 				// locally accessible network service.
 				if tunnelType == "OB" {
 					slog.Debug("Outbound Protected Service Detected - handling connection...")
-					d.handleEmissaryOutboundProtectedServiceConnection(emissaryConn, requestedServiceAddress)
+					err := d.startSession(event, int64(emissaryRequestedServiceIdNum), emissaryConn)
+					if err != nil {
+						slog.Warn("PS_CONN Handler", slog.String("Denied device", deviceUUID), slog.String("service", emissaryRequestedServiceId), slog.String("reason", err.Error()))
+						emissaryConn.Close()
+						break
+					}
+					bytesIn, bytesOut := d.handleEmissaryOutboundProtectedServiceConnection(emissaryConn, requestedServiceAddress)
+					d.endSession(event.ID)
+					d.recordEventBytes(event.ID, bytesIn, bytesOut)
 					break
 				}
 
@@ -480,12 +616,21 @@ func (d *Drawbridge) SetUpProtectedServiceTunnel() error {
 				// This can happen if the Drawbridge admin deletes a Protected Service while it is running.
 				// The net.Listener will be closed and any remaining Accept operations are blocked and return errors.
 				if err != nil {
-					slog.Error("Failed to tcp dial to actual target service", err)
+					slog.Error("Failed to tcp dial to actual target service", slog.Any("error", err))
 				}
 
 				slog.Debug(fmt.Sprintf("TCP Accept from Emissary client: %s", emissaryConn.RemoteAddr()))
 				// Copy data back and from client and server.
-				proxyData(protectedServiceConn, emissaryConn)
+				err = d.startSession(event, int64(emissaryRequestedServiceIdNum), emissaryConn)
+				if err != nil {
+					slog.Warn("PS_CONN Handler", slog.String("Denied device", deviceUUID), slog.String("service", emissaryRequestedServiceId), slog.String("reason", err.Error()))
+					protectedServiceConn.Close()
+					emissaryConn.Close()
+					break
+				}
+				bytesIn, bytesOut := proxyData(protectedServiceConn, emissaryConn)
+				d.endSession(event.ID)
+				d.recordEventBytes(event.ID, bytesIn, bytesOut)
 				// Shut down the connection.
 				emissaryConn.Close()
 			case "PS_LIST":
@@ -505,6 +650,14 @@ func (d *Drawbridge) SetUpProtectedServiceTunnel() error {
 				serviceConnectCommand := fmt.Sprintf("PS_LIST: %s\n", serviceList)
 				slog.Debug(fmt.Sprintf("PS_LIST values: %s\n", serviceConnectCommand))
 				emissaryConn.Write([]byte(serviceConnectCommand))
+				// Emissary clients list Protected Services when they connect.
+				d.pushCertificateAuthorityRotation(emissaryConn, deviceUUID, clientCert)
+			case "CA_ROTN":
+				d.handleCertificateAuthorityRotation(emissaryConn, deviceUUID, clientCert)
+			case "DV_PSTR":
+				d.handlePostureReport(emissaryConn, deviceUUID, emissaryRequestPayload)
+			case "PS_RQST":
+				d.handleJITRequest(emissaryConn, deviceUUID, emissaryRequestPayload)
 			default:
 			}
 		}(conn)
@@ -574,10 +727,22 @@ func (d *Drawbridge) GenerateEmissaryBundle(config EmissaryConfig) (*BundleFile,
 	if config.Platform != "macos" && config.Platform != "linux" && config.Platform != "windows" && config.Platform != "android" {
 		return nil, fmt.Errorf("platform %s is not supported", config.Platform)
 	}
+	// Fail before downloading Emissary if we can't issue the device certificate.
+	if d.CA != nil && d.CA.Locked() {
+		return nil, certificates.ErrCertificateAuthorityLocked
+	}
+	groups, err := emissary.ParseLabels(config.Groups)
+	if err != nil {
+		return nil, fmt.Errorf("invalid group: %w", err)
+	}
+	tags, err := emissary.ParseLabels(config.Tags)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tag: %w", err)
+	}
 
 	if config.Platform == "android" || config.Platform == "ios" {
 		slog.Debug("Making mobile platform Emissary Bundle")
-		return d.generateMobileEmissaryBundle(config.Platform)
+		return d.generateMobileEmissaryBundle(config.Platform, groups, tags)
 	}
 
 	// Get assets url
@@ -737,7 +902,7 @@ func (d *Drawbridge) GenerateEmissaryBundle(config EmissaryConfig) (*BundleFile,
 	if len(*listeningAddress) > 0 {
 		// TODO
 		// Change the port hardcoding and write the listening port in the lsiteningAddress config file instead.
-		utils.SaveFile("drawbridge.txt", fmt.Sprintf("%s:%d", *listeningAddress, d.ListeningPort), "./bundle_tmp/bundle")
+		utils.SaveFile("drawbridge.txt", d.emissaryEndpoints(*listeningAddress), "./bundle_tmp/bundle")
 	} else {
 		slog.Error("Emissary Bundle Creation", slog.String("Error", "Unable to get Drawbridge listening address. Unable to finish creating bundle."))
 		return nil, fmt.Errorf("error getting Drawbridge listening address")
@@ -761,7 +926,7 @@ func (d *Drawbridge) GenerateEmissaryBundle(config EmissaryConfig) (*BundleFile,
 		Name:     bundledFilename,
 	}
 
-	err = d.createEmissaryDevice(clientId, *emissaryCert)
+	err = d.createEmissaryDevice(clientId, *emissaryCert, groups, tags)
 	if err != nil {
 		return nil, err
 	}
@@ -769,7 +934,7 @@ func (d *Drawbridge) GenerateEmissaryBundle(config EmissaryConfig) (*BundleFile,
 	return &bundleFile, nil
 }
 
-func (d *Drawbridge) createEmissaryDevice(id, certificate string) error {
+func (d *Drawbridge) createEmissaryDevice(id, certificate string, groups, tags []string) error {
 	adjectivesIndex := utils.RandInt(0, len(Adjectives))
 	animalsIndex := utils.RandInt(0, len(Animals))
 	deviceName := fmt.Sprintf("%s %s", Adjectives[adjectivesIndex], Animals[animalsIndex])
@@ -779,17 +944,20 @@ func (d *Drawbridge) createEmissaryDevice(id, certificate string) error {
 		Name:                  deviceName,
 		DrawbridgeCertificate: certificate,
 		Revoked:               0,
+		Groups:                groups,
+		Tags:                  tags,
 	}
 	_, err := d.DB.CreateNewEmissaryClient(client)
 	if err != nil {
 		return fmt.Errorf("error creating emissary client: %w", err)
 	}
+	d.RecordAdminAction(sinks.TypeDeviceCreated, DashboardActor, map[string]string{"device_id": id, "name": deviceName, "groups": strings.Join(groups, ","), "tags": strings.Join(tags, ",")})
 	return nil
 }
 
 // Generate an Emissary Bundle for a mobile device.
 // We can't fling .apk or .ipa files at mobile users, so we instead just ship the bundle with our certs, keypair, and drawbridge address.
-func (d *Drawbridge) generateMobileEmissaryBundle(platform string) (*BundleFile, error) {
+func (d *Drawbridge) generateMobileEmissaryBundle(platform string, groups, tags []string) (*BundleFile, error) {
 	bundleTmpFolderPath := "./bundle_tmp"
 	// Create temporary directory used for placing Emissary files to zip up for use as the downloadable Emissary Bundle.
 	os.Mkdir(utils.CreateDrawbridgeFilePath(bundleTmpFolderPath), os.ModePerm)
@@ -818,7 +986,7 @@ func (d *Drawbridge) generateMobileEmissaryBundle(platform string) (*BundleFile,
 	if len(*listeningAddress) > 0 {
 		// TODO
 		// Change the port hardcoding and write the listening port in the lsiteningAddress config file instead.
-		utils.SaveFile("drawbridge.txt", fmt.Sprintf("%s:%d", *listeningAddress, d.ListeningPort), "./bundle_tmp/bundle")
+		utils.SaveFile("drawbridge.txt", d.emissaryEndpoints(*listeningAddress), "./bundle_tmp/bundle")
 	} else {
 		slog.Error("Emissary Bundle Creation", slog.String("Error", "Unable to get Drawbridge listening address. Unable to finish creating bundle."))
 		return nil, fmt.Errorf("error getting Drawbridge listening address")
@@ -842,7 +1010,7 @@ func (d *Drawbridge) generateMobileEmissaryBundle(platform string) (*BundleFile,
 		Name:     bundledFilename,
 	}
 
-	err = d.createEmissaryDevice(clientId, *emissaryCert)
+	err = d.createEmissaryDevice(clientId, *emissaryCert, groups, tags)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,363 @@
+// Package backup creates and restores archives of the whole Drawbridge state: the SQLite database, including the
+// drawbridge_config settings, and the certificate authority files in the ca folder.
+//
+// A backup is a zip archive holding a manifest.json, a drawbridge.db snapshot made with VACUUM INTO, and the ca folder.
+// The manifest lists the SHA-256 of every other file in the archive so a restore can detect a damaged archive.
+// Backups contain the certificate authority private keys, so they can be encrypted with a passphrase. Encrypted backups
+// are the zip archive sealed in a DRAWBRIDGE ENCRYPTED BACKUP PEM block, the same way private keys are encrypted at rest.
+package backup
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"imdawon/drawbridge/cmd/drawbridge/persistence"
+	"imdawon/drawbridge/cmd/drawbridge/persistence/migrations"
+	certificates "imdawon/drawbridge/cmd/reverse_proxy/ca"
+	"imdawon/drawbridge/cmd/utils"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	manifestName             = "manifest.json"
+	databaseName             = "drawbridge.db"
+	caDirectory              = "ca"
+	encryptedBackupBlockType = "DRAWBRIDGE ENCRYPTED BACKUP"
+	// Bumped whenever the archive layout changes in a way older Drawbridge versions can't restore.
+	formatVersion = 1
+	// Refuse to read archives larger than this. Drawbridge databases are a few megabytes.
+	maxArchiveSize = 1 << 30
+)
+
+// Returned when restoring an encrypted backup without a passphrase.
+var ErrBackupEncrypted = errors.New("the backup is encrypted, provide its passphrase")
+
+type Manifest struct {
+	FormatVersion int       `json:"format_version"`
+	CreatedAt     time.Time `json:"created_at"`
+	// The schema version of the database snapshot, see persistence.Migrate.
+	SchemaVersion int            `json:"schema_version"`
+	Files         []ManifestFile `json:"files"`
+}
+
+type ManifestFile struct {
+	// Slash-separated path inside the archive, e.g. ca/ca.crt.
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// The database a backup is made from. Only SQLiteRepository can be backed up.
+type Database interface {
+	SnapshotTo(path string) error
+	SchemaVersion() (int, error)
+}
+
+// Writes a backup of the database and the certificate authority files to w.
+// The backup is encrypted when passphrase is set.
+func Create(db Database, w io.Writer, passphrase []byte) (*Manifest, error) {
+	snapshotDirectory, err := os.MkdirTemp("", "drawbridge-backup")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(snapshotDirectory)
+	snapshotPath := filepath.Join(snapshotDirectory, databaseName)
+	err = db.SnapshotTo(snapshotPath)
+	if err != nil {
+		return nil, err
+	}
+	schemaVersion, err := db.SchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	files := make(map[string][]byte)
+	files[databaseName], err = os.ReadFile(snapshotPath)
+	if err != nil {
+		return nil, err
+	}
+	caPath := utils.CreateDrawbridgeFilePath(caDirectory)
+	err = filepath.WalkDir(caPath, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		relativePath, err := filepath.Rel(caPath, filePath)
+		if err != nil {
+			return err
+		}
+		files[path.Join(caDirectory, filepath.ToSlash(relativePath))], err = os.ReadFile(filePath)
+		return err
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("error reading the certificate authority files: %w", err)
+	}
+
+	manifest := &Manifest{
+		FormatVersion: formatVersion,
+		CreatedAt:     time.Now().UTC(),
+		SchemaVersion: schemaVersion,
+	}
+	for name, contents := range files {
+		checksum := sha256.Sum256(contents)
+		manifest.Files = append(manifest.Files, ManifestFile{
+			Path:   name,
+			Size:   int64(len(contents)),
+			SHA256: hex.EncodeToString(checksum[:]),
+		})
+	}
+	manifestJSON, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	archive := new(bytes.Buffer)
+	zipWriter := zip.NewWriter(archive)
+	err = writeZipFile(zipWriter, manifestName, manifestJSON)
+	for _, file := range manifest.Files {
+		if err != nil {
+			break
+		}
+		err = writeZipFile(zipWriter, file.Path, files[file.Path])
+	}
+	if err == nil {
+		err = zipWriter.Close()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error writing backup archive: %w", err)
+	}
+
+	contents := archive.Bytes()
+	if passphrase != nil {
+		contents, err = certificates.SealWithPassphrase(encryptedBackupBlockType, contents, passphrase)
+		if err != nil {
+			return nil, err
+		}
+	}
+	_, err = w.Write(contents)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("Backup", slog.Int("Created backup with files", len(manifest.Files)))
+	return manifest, nil
+}
+
+func writeZipFile(zipWriter *zip.Writer, name string, contents []byte) error {
+	writer, err := zipWriter.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(contents)
+	return err
+}
+
+// A backup that has been decrypted and validated against its manifest.
+type archive struct {
+	manifest *Manifest
+	files    map[string][]byte
+}
+
+// Reports whether the backup is encrypted with a passphrase.
+func Encrypted(backup []byte) bool {
+	block, _ := pem.Decode(backup)
+	return block != nil && block.Type == encryptedBackupBlockType
+}
+
+// Decrypts the backup if needed and checks every file against the manifest.
+func Validate(backup []byte, passphrase []byte) (*Manifest, error) {
+	archive, err := open(backup, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return archive.manifest, nil
+}
+
+func open(backup []byte, passphrase []byte) (*archive, error) {
+	if Encrypted(backup) {
+		if passphrase == nil {
+			return nil, ErrBackupEncrypted
+		}
+		block, _ := pem.Decode(backup)
+		var err error
+		backup, err = certificates.OpenWithPassphrase(block, passphrase)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	zipReader, err := zip.NewReader(bytes.NewReader(backup), int64(len(backup)))
+	if err != nil {
+		return nil, fmt.Errorf("not a Drawbridge backup: %w", err)
+	}
+	files := make(map[string][]byte)
+	for _, file := range zipReader.File {
+		if file.UncompressedSize64 > maxArchiveSize {
+			return nil, fmt.Errorf("%s is too large for a Drawbridge backup", file.Name)
+		}
+		reader, err := file.Open()
+		if err != nil {
+			return nil, err
+		}
+		contents, err := io.ReadAll(io.LimitReader(reader, maxArchiveSize))
+		reader.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s from the backup: %w", file.Name, err)
+		}
+		files[file.Name] = contents
+	}
+
+	manifestJSON, ok := files[manifestName]
+	if !ok {
+		return nil, fmt.Errorf("not a Drawbridge backup: %s is missing", manifestName)
+	}
+	delete(files, manifestName)
+	manifest := &Manifest{}
+	err = json.Unmarshal(manifestJSON, manifest)
+	if err != nil {
+		return nil, fmt.Errorf("invalid backup manifest: %w", err)
+	}
+	if manifest.FormatVersion != formatVersion {
+		return nil, fmt.Errorf("the backup uses format version %d, this Drawbridge restores version %d", manifest.FormatVersion, formatVersion)
+	}
+
+	if len(manifest.Files) != len(files) {
+		return nil, fmt.Errorf("the backup holds %d files but its manifest lists %d", len(files), len(manifest.Files))
+	}
+	for _, file := range manifest.Files {
+		if !validArchivePath(file.Path) {
+			return nil, fmt.Errorf("the backup contains an unexpected file %s", file.Path)
+		}
+		contents, ok := files[file.Path]
+		if !ok {
+			return nil, fmt.Errorf("the backup is missing %s", file.Path)
+		}
+		checksum := sha256.Sum256(contents)
+		if int64(len(contents)) != file.Size || hex.EncodeToString(checksum[:]) != file.SHA256 {
+			return nil, fmt.Errorf("%s in the backup is damaged, its checksum does not match the manifest", file.Path)
+		}
+	}
+	if _, ok := files[databaseName]; !ok {
+		return nil, fmt.Errorf("the backup is missing %s", databaseName)
+	}
+
+	known, err := migrations.All()
+	if err != nil {
+		return nil, err
+	}
+	if manifest.SchemaVersion > len(known) {
+		return nil, fmt.Errorf("the backup was made by a newer Drawbridge at schema version %d, upgrade Drawbridge to restore it", manifest.SchemaVersion)
+	}
+	return &archive{manifest: manifest, files: files}, nil
+}
+
+// Only the database and files in the ca folder are restored, so a crafted archive can't write anywhere else.
+func validArchivePath(name string) bool {
+	if name == databaseName {
+		return true
+	}
+	cleaned := path.Clean(name)
+	return cleaned == name && strings.HasPrefix(name, caDirectory+"/") && !strings.Contains(name, "..")
+}
+
+// Restores a backup onto a fresh install: databasePath must not hold a set up Drawbridge, and the ca folder must be empty.
+// Drawbridge must not be running. The restored database is migrated to the current schema the next time Drawbridge starts.
+func Restore(backup []byte, passphrase []byte, databasePath string) (*Manifest, error) {
+	archive, err := open(backup, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	err = checkFreshInstall(databasePath)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check the database snapshot opens before touching anything.
+	restoredDatabasePath := databasePath + ".restore"
+	err = os.WriteFile(restoredDatabasePath, archive.files[databaseName], 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(restoredDatabasePath)
+	restored := persistence.NewSQLiteRepository(persistence.OpenDatabaseFile(restoredDatabasePath))
+	err = restored.IntegrityCheck()
+	if closeErr := restored.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("the database in the backup is damaged: %w", err)
+	}
+
+	for _, file := range archive.manifest.Files {
+		if file.Path == databaseName {
+			continue
+		}
+		var perm os.FileMode = 0644
+		if strings.HasSuffix(file.Path, ".key") {
+			perm = 0600
+		}
+		err = utils.ReplaceFile(path.Base(file.Path), archive.files[file.Path], path.Dir(file.Path), perm)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// Emissary Bundles are built with the copy of the root certificate in this folder.
+	if rootCertificate, ok := archive.files[path.Join(caDirectory, "ca.crt")]; ok {
+		err = utils.ReplaceFile("ca.crt", rootCertificate, "./emissary_certs_and_key_here", 0644)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = os.Rename(restoredDatabasePath, databasePath)
+	if err != nil {
+		return nil, err
+	}
+
+	slog.Info("Backup", slog.String("Restored backup created at", archive.manifest.CreatedAt.Format(time.RFC1123)))
+	return archive.manifest, nil
+}
+
+// Refuses to restore over a Drawbridge that has been set up, so a restore can never silently replace a live certificate authority.
+func checkFreshInstall(databasePath string) error {
+	if utils.FileExists(path.Join(caDirectory, "ca.crt")) {
+		return fmt.Errorf("the ca folder already holds a certificate authority, move it aside to restore onto a fresh install")
+	}
+	if _, err := os.Stat(databasePath); errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	existing := persistence.NewSQLiteRepository(persistence.OpenDatabaseFile(databasePath))
+	defer existing.Close()
+	_, err := existing.Migrate()
+	if err != nil {
+		return err
+	}
+	listeningAddress, err := existing.GetDrawbridgeConfigValueByName("listening_address")
+	if err != nil {
+		return err
+	}
+	if listeningAddress != nil && *listeningAddress != "" {
+		return fmt.Errorf("%s belongs to a Drawbridge that has already been set up, move it aside to restore onto a fresh install", databasePath)
+	}
+	clients, err := existing.GetAllEmissaryClients()
+	if err != nil {
+		return err
+	}
+	if len(clients) > 0 {
+		return fmt.Errorf("%s already has Emissary clients, move it aside to restore onto a fresh install", databasePath)
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package backup
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"imdawon/drawbridge/cmd/drawbridge/persistence"
+	certificates "imdawon/drawbridge/cmd/reverse_proxy/ca"
+	"imdawon/drawbridge/cmd/utils"
+	"path/filepath"
+	"testing"
+)
+
+func TestBackupAndRestore(t *testing.T) {
+	databasePath := filepath.Join(t.TempDir(), "drawbridge.db")
+	db := persistence.NewSQLiteRepository(persistence.OpenDatabaseFile(databasePath))
+	if _, err := db.Migrate(); err != nil {
+		t.Fatalf("migration failed: %v", err)
+	}
+	if err := db.CreateNewDrawbridgeConfigSettings("listening_address", "127.0.0.1"); err != nil {
+		t.Fatalf("failed to save listening address: %v", err)
+	}
+	t.Cleanup(func() {
+		utils.DeleteDirectory("ca")
+		utils.DeleteDirectory("emissary_certs_and_key_here")
+	})
+	ca := &certificates.CA{DB: db}
+	if err := ca.SetupCertificates(); err != nil {
+		t.Fatalf("SetupCertificates failed: %v", err)
+	}
+	rootCertificate := *utils.ReadFile("ca/ca.crt")
+
+	plain := new(bytes.Buffer)
+	manifest, err := Create(db, plain, nil)
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if Encrypted(plain.Bytes()) {
+		t.Errorf("backups without a passphrase should not be encrypted")
+	}
+	paths := make(map[string]bool)
+	for _, file := range manifest.Files {
+		paths[file.Path] = true
+	}
+	for _, expected := range []string{databaseName, "ca/ca.crt", "ca/ca.key", "ca/intermediate.key", "ca/server-key.key"} {
+		if !paths[expected] {
+			t.Errorf("backup should contain %s", expected)
+		}
+	}
+
+	passphrase := []byte("correct horse battery staple")
+	encrypted := new(bytes.Buffer)
+	if _, err := Create(db, encrypted, passphrase); err != nil {
+		t.Fatalf("Create with passphrase failed: %v", err)
+	}
+	if !Encrypted(encrypted.Bytes()) {
+		t.Errorf("backups with a passphrase should be encrypted")
+	}
+	if _, err := Validate(encrypted.Bytes(), nil); !errors.Is(err, ErrBackupEncrypted) {
+		t.Errorf("validating an encrypted backup without a passphrase should return ErrBackupEncrypted, got %v", err)
+	}
+	if _, err := Validate(encrypted.Bytes(), []byte("wrong")); !errors.Is(err, certificates.ErrIncorrectKeyPassphrase) {
+		t.Errorf("validating with the wrong passphrase should return ErrIncorrectKeyPassphrase, got %v", err)
+	}
+	if _, err := Validate(encrypted.Bytes(), passphrase); err != nil {
+		t.Errorf("Validate failed: %v", err)
+	}
+
+	// Restoring onto a Drawbridge that has been set up is refused.
+	if _, err := Restore(encrypted.Bytes(), passphrase, databasePath); err == nil {
+		t.Errorf("restoring over a set up Drawbridge should fail")
+	}
+
+	// Restore onto a fresh install.
+	utils.DeleteDirectory("ca")
+	freshDatabasePath := filepath.Join(t.TempDir(), "drawbridge.db")
+	if _, err := Restore(encrypted.Bytes(), passphrase, freshDatabasePath); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	if !bytes.Equal(*utils.ReadFile("ca/ca.crt"), rootCertificate) {
+		t.Errorf("the certificate authority should be restored")
+	}
+	restored := persistence.NewSQLiteRepository(persistence.OpenDatabaseFile(freshDatabasePath))
+	defer restored.Close()
+	listeningAddress, err := restored.GetDrawbridgeConfigValueByName("listening_address")
+	if err != nil || listeningAddress == nil || *listeningAddress != "127.0.0.1" {
+		t.Errorf("the database should be restored, listening address = %v: %v", listeningAddress, err)
+	}
+	restoredCA := &certificates.CA{DB: restored}
+	if err := restoredCA.SetupCertificates(); err != nil {
+		t.Errorf("the restored certificate authority should load: %v", err)
+	}
+
+	// A damaged archive is rejected. Damage the database snapshot itself, as zip headers hold fields nothing reads.
+	damaged := bytes.Clone(plain.Bytes())
+	zipReader, err := zip.NewReader(bytes.NewReader(damaged), int64(len(damaged)))
+	if err != nil {
+		t.Fatalf("the backup should be a zip archive: %v", err)
+	}
+	for _, file := range zipReader.File {
+		if file.Name == databaseName {
+			offset, err := file.DataOffset()
+			if err != nil {
+				t.Fatalf("DataOffset failed: %v", err)
+			}
+			// A single byte can land in a part of the deflate stream that doesn't change the output, so damage a run.
+			middle := offset + int64(file.CompressedSize64)/2
+			for i := middle; i < middle+64; i++ {
+				damaged[i] ^= 0xff
+			}
+		}
+	}
+	if _, err := Validate(damaged, nil); err == nil {
+		t.Errorf("a damaged backup should be rejected")
+	}
+}
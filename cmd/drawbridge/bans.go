@@ -0,0 +1,160 @@
+package drawbridge
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"imdawon/drawbridge/cmd/drawbridge/network"
+	"imdawon/drawbridge/cmd/drawbridge/sinks"
+	certificates "imdawon/drawbridge/cmd/reverse_proxy/ca"
+	"imdawon/drawbridge/cmd/utils"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// How long a connection to the Emissary listener has to finish its TLS handshake and send its request.
+	handshakeTimeout = 10 * time.Second
+	// Source IPs whose failures are tracked at once. Past this, IPs without a failure in the last
+	// network.FailureWindow are forgotten.
+	maxTrackedIPs = 10000
+)
+
+// Recent failed connections to the Emissary listener, keyed by source IP. Kept in memory only: the bans they lead
+// to are stored, so a restart only forgets failures that haven't led to a ban yet.
+type failureTracker struct {
+	mu       sync.Mutex
+	failures map[string][]time.Time
+}
+
+// Returns the ban on the source IP of connectionIP if it is active at now, or nil. The Emissary listener closes
+// connections from banned IPs before the TLS handshake.
+func (d *Drawbridge) activeBan(connectionIP string, now time.Time) *network.Ban {
+	addr, err := network.ParseIP(connectionIP)
+	if err != nil {
+		return nil
+	}
+	ban, err := d.DB.GetIPBan(addr.String())
+	if err != nil {
+		slog.Error("IP Bans", slog.Any("Error getting ban", err))
+		return nil
+	}
+	if !ban.Active(now) {
+		return nil
+	}
+	return ban
+}
+
+// Counts a failed connection from connectionIP for reason, one of the network.Failure reasons. Once the IP has failed
+// network.MaxFailures times within network.FailureWindow it is banned, for longer each time it comes back. Returns the
+// new ban, or nil.
+func (d *Drawbridge) RecordConnectionFailure(connectionIP, reason string, now time.Time) *network.Ban {
+	addr, err := network.ParseIP(connectionIP)
+	if err != nil {
+		slog.Error("IP Bans", slog.Any("Error", err))
+		return nil
+	}
+	ip := addr.String()
+	d.connectionFailures.mu.Lock()
+	defer d.connectionFailures.mu.Unlock()
+	if d.connectionFailures.failures == nil {
+		d.connectionFailures.failures = make(map[string][]time.Time)
+	}
+	windowStart := now.Add(-network.FailureWindow)
+	if len(d.connectionFailures.failures) >= maxTrackedIPs {
+		for trackedIP, failures := range d.connectionFailures.failures {
+			if failures[len(failures)-1].Before(windowStart) {
+				delete(d.connectionFailures.failures, trackedIP)
+			}
+		}
+	}
+	failures := d.connectionFailures.failures[ip]
+	for len(failures) > 0 && failures[0].Before(windowStart) {
+		failures = failures[1:]
+	}
+	failures = append(failures, now)
+	if len(failures) < network.MaxFailures {
+		d.connectionFailures.failures[ip] = failures
+		return nil
+	}
+	delete(d.connectionFailures.failures, ip)
+	ban, err := d.banIP(ip, fmt.Sprintf("%d connection failures within %d minutes, the last: %s", len(failures), int(network.FailureWindow.Minutes()), reason), now)
+	if err != nil {
+		slog.Error("IP Bans", slog.String("IP", ip), slog.Any("Error saving ban", err))
+		return nil
+	}
+	return ban
+}
+
+func (d *Drawbridge) banIP(ip, reason string, now time.Time) (*network.Ban, error) {
+	previous, err := d.DB.GetIPBan(ip)
+	if err != nil {
+		return nil, err
+	}
+	ban := network.NextBan(*previous, ip, reason, now)
+	err = d.DB.SaveIPBan(ban)
+	if err != nil {
+		return nil, err
+	}
+	// Bans that ended long enough ago don't make the next one longer, so there is no need to keep them.
+	_, err = d.DB.PruneIPBans(now.Add(-network.BanMemory))
+	if err != nil {
+		slog.Error("IP Bans", slog.Any("Error pruning bans", err))
+	}
+	slog.Warn("IP Bans", slog.String("Banned", ip), slog.String("until", ban.ExpiresAt.UTC().Format(time.RFC3339)), slog.String("reason", reason))
+	d.recordBanEvent(&ban)
+	return &ban, nil
+}
+
+// Lifts the ban on ip and forgets its failures, so its next ban is the shortest one again.
+func (d *Drawbridge) UnbanIP(ip string) error {
+	err := d.DB.DeleteIPBan(ip)
+	if err != nil {
+		return err
+	}
+	d.connectionFailures.mu.Lock()
+	defer d.connectionFailures.mu.Unlock()
+	delete(d.connectionFailures.failures, ip)
+	return nil
+}
+
+func (d *Drawbridge) recordBanEvent(ban *network.Ban) {
+	id, err := utils.NewUUID()
+	if err != nil {
+		slog.Error("IP Bans", slog.Any("Error", err))
+	}
+	event := sinks.Event{
+		ID:           id,
+		Type:         sinks.TypeIPBanned,
+		Timestamp:    time.Now().UTC(),
+		ConnectionIP: ban.IP,
+		Reason:       ban.Reason,
+		Details: map[string]string{
+			"offenses":   strconv.Itoa(ban.Offenses),
+			"expires_at": ban.ExpiresAt.UTC().Format(time.RFC3339),
+		},
+	}
+	if addr, err := network.ParseIP(ban.IP); err == nil {
+		location := d.geoIP.Load().Lookup(addr)
+		event.Country, event.ASN = location.Country, location.ASN
+	}
+	d.EventSinkDispatcher.Publish(event)
+}
+
+// Finishes the TLS handshake of a connection to the Emissary listener. Returns the network.Failure reason it failed
+// for, or an empty string.
+func handshake(conn *tls.Conn) (string, error) {
+	err := conn.Handshake()
+	switch {
+	case err == nil:
+		return "", nil
+	case errors.Is(err, certificates.ErrRevokedCertificate):
+		return network.FailureRevokedCertificate, err
+	case errors.Is(err, certificates.ErrUnknownCertificate):
+		return network.FailureUnknownCertificate, err
+	default:
+		return network.FailureHandshake, err
+	}
+}
@@ -0,0 +1,102 @@
+package drawbridge
+
+import (
+	"imdawon/drawbridge/cmd/drawbridge/network"
+	"imdawon/drawbridge/cmd/drawbridge/persistence"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConnectionFailureBans(t *testing.T) {
+	db := persistence.NewMemoryRepository()
+	d := &Drawbridge{DB: db}
+	now := time.Date(2024, 12, 2, 21, 0, 0, 0, time.UTC)
+
+	fail := func(connectionIP string, times int, at time.Time) *network.Ban {
+		var ban *network.Ban
+		for i := 0; i < times; i++ {
+			ban = d.RecordConnectionFailure(connectionIP, network.FailureHandshake, at)
+		}
+		return ban
+	}
+	if ban := fail("203.0.113.7:50000", network.MaxFailures-1, now); ban != nil {
+		t.Fatalf("expected fewer than %d failures not to ban the IP, got %+v", network.MaxFailures, ban)
+	}
+	// Failures that fell out of the window don't count.
+	if ban := fail("203.0.113.7:50001", 1, now.Add(network.FailureWindow+time.Second)); ban != nil {
+		t.Fatalf("expected failures outside the window not to count, got %+v", ban)
+	}
+	later := now.Add(network.FailureWindow + time.Minute)
+	ban := fail("203.0.113.7:50002", network.MaxFailures-1, later)
+	if ban == nil || ban.IP != "203.0.113.7" || ban.Offenses != 1 || !ban.ExpiresAt.Equal(later.Add(network.BanDurations[0])) {
+		t.Fatalf("expected the IP to be banned for %s, got %+v", network.BanDurations[0], ban)
+	}
+	if !strings.Contains(ban.Reason, network.FailureHandshake) {
+		t.Errorf("expected the ban reason to say what failed, got %q", ban.Reason)
+	}
+	if d.activeBan("203.0.113.7:60000", later) == nil {
+		t.Error("expected connections from any port of the banned IP to be refused")
+	}
+	if d.activeBan("203.0.113.8:60000", later) != nil {
+		t.Error("expected other IPs not to be banned")
+	}
+	if d.activeBan("203.0.113.7:60000", ban.ExpiresAt) != nil {
+		t.Error("expected the ban to end when it expires")
+	}
+
+	// Coming back after a ban gets a longer one.
+	again := fail("203.0.113.7:50003", network.MaxFailures, ban.ExpiresAt)
+	if again == nil || again.Offenses != 2 || !again.ExpiresAt.Equal(ban.ExpiresAt.Add(network.BanDurations[1])) {
+		t.Fatalf("expected the second ban to last %s, got %+v", network.BanDurations[1], again)
+	}
+	bans, err := db.GetActiveIPBans(ban.ExpiresAt)
+	if err != nil || len(bans) != 1 || bans[0] != *again {
+		t.Errorf("expected the ban to be stored, got %+v: %v", bans, err)
+	}
+
+	if err := d.UnbanIP("203.0.113.7"); err != nil {
+		t.Fatalf("UnbanIP failed: %v", err)
+	}
+	if d.activeBan("203.0.113.7:60000", ban.ExpiresAt) != nil {
+		t.Error("expected an unbanned IP to be let through")
+	}
+	// Lifting a ban forgives the IP, so its next ban is the shortest one again.
+	if next := fail("203.0.113.7:50004", network.MaxFailures, ban.ExpiresAt); next == nil || next.Offenses != 1 {
+		t.Errorf("expected the IP's next ban to be its first, got %+v", next)
+	}
+	if err := d.UnbanIP("198.51.100.1"); err == nil {
+		t.Error("expected UnbanIP to fail for an IP that isn't banned")
+	}
+}
+
+func TestBanDuration(t *testing.T) {
+	if network.BanDuration(0) != network.BanDurations[0] || network.BanDuration(1) != network.BanDurations[0] {
+		t.Error("expected the first ban to be the shortest")
+	}
+	if last := network.BanDurations[len(network.BanDurations)-1]; network.BanDuration(100) != last {
+		t.Errorf("expected bans past the last duration to last %s", last)
+	}
+	now := time.Date(2024, 12, 2, 21, 0, 0, 0, time.UTC)
+	previous := network.Ban{IP: "203.0.113.7", Offenses: 3, ExpiresAt: now.Add(-network.BanMemory - time.Minute)}
+	if ban := network.NextBan(previous, previous.IP, network.FailureMalformedRequest, now); ban.Offenses != 1 {
+		t.Errorf("expected a ban that ended over %s ago to be forgotten, got %+v", network.BanMemory, ban)
+	}
+}
+
+func TestCheckPreamble(t *testing.T) {
+	for payload, valid := range map[string]bool{
+		"PS_LIST":            true,
+		"PS_CONN 004":        true,
+		"PS_CONN 004 1234":   true,
+		"PS_CONN":            false,
+		"PS_RQST 004 Fix":    true,
+		"GET / HTTP/1.1\r\n": false,
+		"":                   false,
+		"\x16\x03\x01":       false,
+	} {
+		if err := checkPreamble(payload); (err == nil) != valid {
+			t.Errorf("checkPreamble(%q) returned %v, expected valid to be %t", payload, err, valid)
+		}
+	}
+}
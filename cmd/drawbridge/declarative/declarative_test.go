@@ -0,0 +1,478 @@
+package declarative
+
+import (
+	"imdawon/drawbridge/cmd/drawbridge"
+	"imdawon/drawbridge/cmd/drawbridge/emissary"
+	"imdawon/drawbridge/cmd/drawbridge/emissary/authorization"
+	"imdawon/drawbridge/cmd/drawbridge/persistence"
+	"imdawon/drawbridge/cmd/drawbridge/services"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testYAML = `
+authoritative: true
+settings:
+  listening_address: 10.0.0.1
+  dau_ping_enabled: false
+  event_retention:
+    event_days: 7
+  event_sinks:
+    - name: audit
+      type: jsonl
+      event_types: ["ADMIN_*"]
+      jsonl:
+        path: events/audit.jsonl
+policies:
+  - name: Home network
+    description: LAN only
+    rules:
+      match: all
+      conditions:
+        - attribute: connection.ip
+          operator: in_cidr
+          values: ["10.0.0.0/8"]
+services:
+  - name: SSH
+    description: Home server
+    host: 10.0.0.2
+    port: 22
+    policy: Home network
+  - name: Gitea
+    host: localhost
+    port: 3000
+devices:
+  - id: device-1
+    name: Work Laptop
+    revoked: true
+`
+
+const testTOML = `
+authoritative = true
+
+[settings]
+listening_address = "10.0.0.1"
+dau_ping_enabled = false
+
+[settings.event_retention]
+event_days = 7
+
+[[settings.event_sinks]]
+name = "audit"
+type = "jsonl"
+event_types = ["ADMIN_*"]
+jsonl = { path = "events/audit.jsonl" }
+
+[[policies]]
+name = "Home network"
+description = "LAN only"
+
+[policies.rules]
+match = "all"
+
+[[policies.rules.conditions]]
+attribute = "connection.ip"
+operator = "in_cidr"
+values = ["10.0.0.0/8"]
+
+[[services]]
+name = "SSH"
+description = "Home server"
+host = "10.0.0.2"
+port = 22
+policy = "Home network"
+
+[[services]]
+name = "Gitea"
+host = "localhost"
+port = 3000
+
+[[devices]]
+id = "device-1"
+name = "Work Laptop"
+revoked = true
+`
+
+func writeConfigFile(t *testing.T, name, contents string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatalf("writing %s failed: %v", name, err)
+	}
+	return path
+}
+
+func newTestDrawbridge(t *testing.T) *drawbridge.Drawbridge {
+	db := persistence.NewMemoryRepository()
+	if _, err := db.CreateNewService(services.ProtectedService{Name: "SSH", Host: "10.0.0.2", Port: 2222}); err != nil {
+		t.Fatalf("CreateNewService failed: %v", err)
+	}
+	if _, err := db.CreateNewService(services.ProtectedService{Name: "Minecraft", Host: "10.0.0.3", Port: 25565}); err != nil {
+		t.Fatalf("CreateNewService failed: %v", err)
+	}
+	if _, err := db.CreateNewEmissaryClient(emissary.EmissaryClient{ID: "device-1", Name: "Brave Otter", DrawbridgeCertificate: "cert-1"}); err != nil {
+		t.Fatalf("CreateNewEmissaryClient failed: %v", err)
+	}
+	return &drawbridge.Drawbridge{DB: db}
+}
+
+func TestLoadYAMLAndTOMLAgree(t *testing.T) {
+	fromYAML, err := Load(writeConfigFile(t, "drawbridge.yaml", testYAML))
+	if err != nil {
+		t.Fatalf("loading YAML failed: %v", err)
+	}
+	fromTOML, err := Load(writeConfigFile(t, "drawbridge.toml", testTOML))
+	if err != nil {
+		t.Fatalf("loading TOML failed: %v", err)
+	}
+	yamlPlan, err := NewPlan(newTestDrawbridge(t), fromYAML)
+	if err != nil {
+		t.Fatalf("NewPlan failed: %v", err)
+	}
+	tomlPlan, err := NewPlan(newTestDrawbridge(t), fromTOML)
+	if err != nil {
+		t.Fatalf("NewPlan failed: %v", err)
+	}
+	if yamlPlan.String() != tomlPlan.String() {
+		t.Errorf("YAML and TOML plans differ:\n%s\n%s", yamlPlan, tomlPlan)
+	}
+}
+
+func TestLoadRejectsBadFiles(t *testing.T) {
+	for name, contents := range map[string]string{
+		"typo.yaml":              "servces: []\n",
+		"typo.toml":              "authoritatve = true\n",
+		"duplicate.yaml":         "services:\n  - {name: SSH, host: a, port: 22}\n  - {name: SSH, host: b, port: 22}\n",
+		"no-port.yaml":           "services:\n  - {name: SSH, host: a}\n",
+		"bad-sink.yaml":          "settings:\n  event_sinks:\n    - {name: x, type: carrier-pigeon}\n",
+		"bad-posture.yaml":       "settings:\n  posture_max_age: 5s\n",
+		"bad-policy.yaml":        "policies:\n  - {name: x, rules: {match: all, conditions: [{attribute: connection.ip, operator: in_cidr, values: [nope]}]}}\n",
+		"unlisted-policy.yaml":   "authoritative: true\nservices:\n  - {name: SSH, host: a, port: 22, policy: Elsewhere}\n",
+		"unlisted-schedule.yaml": "authoritative: true\nservices:\n  - {name: SSH, host: a, port: 22, schedule: Elsewhere}\n",
+		"bad-schedule.yaml":      "schedules:\n  - {name: x, timezone: Mars/Olympus, windows: [{days: [monday], start: \"09:00\", end: \"17:00\"}]}\n",
+		"bad-network.yaml":       "services:\n  - {name: SSH, host: a, port: 22, network_rules: {allow_cidrs: [nope]}}\n",
+		"unlisted-grant.yaml":    "authoritative: true\ngrants:\n  - {service: SSH, group: admins}\n",
+		"bad-grant.yaml":         "grants:\n  - {service: SSH, group: \"a,b\"}\n",
+		"bad-device-tag.yaml":    "devices:\n  - {id: device-1, tags: [\"a,b\"]}\n",
+		"drawbridge.ini":         "",
+	} {
+		if _, err := Load(writeConfigFile(t, name, contents)); err == nil {
+			t.Errorf("expected loading %s to fail", name)
+		}
+	}
+}
+
+func TestPlanAndApply(t *testing.T) {
+	file, err := Load(writeConfigFile(t, "drawbridge.yaml", testYAML))
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	d := newTestDrawbridge(t)
+	// Made in the Drawbridge Dashboard, and missing from the authoritative file.
+	if _, err := d.DB.CreateNewPolicy(authorization.Policy{Name: "Old", Rules: authorization.Group{Match: authorization.MatchAny, Conditions: []authorization.Condition{{Attribute: authorization.AttributeDeviceID, Operator: authorization.OperatorEquals, Value: "device-1"}}}}); err != nil {
+		t.Fatalf("CreateNewPolicy failed: %v", err)
+	}
+	plan, err := NewPlan(d, file)
+	if err != nil {
+		t.Fatalf("NewPlan failed: %v", err)
+	}
+	for _, want := range []string{
+		`+ policy "Home network"`,
+		`rules: {"match":"all","conditions":[{"attribute":"connection.ip","operator":"in_cidr","values":["10.0.0.0/8"]}]}`,
+		`policy: "" -> "Home network"`,
+		`- policy "Old"`,
+		`~ setting "listening_address"`,
+		`~ setting "dau_ping_enabled"`,
+		`~ setting "event_retention"`,
+		"event_days: 30 -> 7",
+		`~ setting "event_sinks"`,
+		`~ service "SSH"`,
+		"port: 2222 -> 22",
+		`+ service "Gitea"`,
+		`host: "127.0.0.1"`,
+		`- service "Minecraft"`,
+		`~ device "device-1"`,
+		`name: "Brave Otter" -> "Work Laptop"`,
+		"revoked: false -> true",
+		"Plan: 2 to create, 6 to update, 2 to delete.",
+	} {
+		if !strings.Contains(plan.String(), want) {
+			t.Errorf("plan is missing %q:\n%s", want, plan)
+		}
+	}
+
+	if err := plan.Apply(d, "test"); err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+	all, _ := d.DB.GetAllServices()
+	if len(all) != 2 || all[0].Name != "SSH" || all[0].Port != 22 || all[1].Name != "Gitea" || all[1].Host != "127.0.0.1" {
+		t.Errorf("unexpected services after apply: %+v", all)
+	}
+	policies, _ := d.DB.GetAllPolicies()
+	if len(policies) != 1 || policies[0].Name != "Home network" || all[0].ClientPolicyID != policies[0].ID {
+		t.Errorf("expected SSH to use the only policy after apply, got %+v and %+v", policies, all)
+	}
+	device, _ := d.DB.GetEmissaryClientById("device-1")
+	if device.Name != "Work Laptop" || device.Revoked != 1 {
+		t.Errorf("unexpected device after apply: %+v", device)
+	}
+	if retention := d.EventRetention(); retention.EventDays != 7 || retention.HourlyRollupDays != drawbridge.DefaultEventRetention.HourlyRollupDays {
+		t.Errorf("unexpected event retention after apply: %+v", retention)
+	}
+	sinks, _ := d.EventSinks()
+	if len(sinks) != 1 || sinks[0].ID == "" || sinks[0].JSONL.Path != "events/audit.jsonl" {
+		t.Errorf("unexpected event sinks after apply: %+v", sinks)
+	}
+
+	again, err := NewPlan(d, file)
+	if err != nil {
+		t.Fatalf("NewPlan failed: %v", err)
+	}
+	if !again.Empty() {
+		t.Errorf("expected no changes after applying, got:\n%s", again)
+	}
+}
+
+func TestNonAuthoritativeFilesLeaveOtherServicesAlone(t *testing.T) {
+	file := &File{Services: []Service{{Name: "SSH", Host: "10.0.0.2", Port: 2222}}}
+	plan, err := NewPlan(newTestDrawbridge(t), file)
+	if err != nil {
+		t.Fatalf("NewPlan failed: %v", err)
+	}
+	if !plan.Empty() {
+		t.Errorf("expected no changes, got:\n%s", plan)
+	}
+}
+
+func TestPlanRejectsUnknownDevices(t *testing.T) {
+	file := &File{Devices: []Device{{ID: "no-such-device", Revoked: true}}}
+	if _, err := NewPlan(newTestDrawbridge(t), file); err == nil {
+		t.Error("expected a device missing from the Device Fleet to fail the plan")
+	}
+}
+
+func TestDriftDetector(t *testing.T) {
+	d := newTestDrawbridge(t)
+	file := &File{Authoritative: true, Services: []Service{{Name: "SSH", Host: "10.0.0.2", Port: 2222}, {Name: "Minecraft", Host: "10.0.0.3", Port: 25565}}}
+	detector := NewDriftDetector(d, "drawbridge.yaml", file)
+	detector.Check()
+	if drift := detector.Drift(); len(drift) != 0 {
+		t.Fatalf("expected no drift, got %+v", drift)
+	}
+
+	// An edit in the Drawbridge Dashboard.
+	ssh, _ := d.DB.GetServiceById(1)
+	ssh.Port = 22
+	if err := d.DB.UpdateService(ssh, ssh.ID); err != nil {
+		t.Fatalf("UpdateService failed: %v", err)
+	}
+	detector.Check()
+	drift := detector.Drift()
+	if len(drift) != 1 || drift[0].Name != "SSH" || drift[0].Fields[0].From != "22" || drift[0].Fields[0].To != "2222" {
+		t.Errorf("expected the SSH port change to be flagged, got %+v", drift)
+	}
+
+	var nilDetector *DriftDetector
+	nilDetector.Check()
+	if nilDetector.Drift() != nil {
+		t.Error("a nil DriftDetector should never find drift")
+	}
+}
+
+func TestPlanSchedulesAndServiceSettings(t *testing.T) {
+	file, err := Load(writeConfigFile(t, "drawbridge.yaml", `
+authoritative: true
+schedules:
+  - name: Office hours
+    timezone: Europe/London
+    windows:
+      - {days: [monday, tuesday, wednesday, thursday, friday], start: "09:00", end: "17:00"}
+    exceptions:
+      - {date: "2024-12-25", open: false}
+    end_sessions: true
+policies:
+  - name: Anyone
+    rules: {match: any, conditions: [{attribute: device.id, operator: eq, value: device-1}]}
+    schedule: Office hours
+services:
+  - name: SSH
+    host: 10.0.0.2
+    port: 2222
+    schedule: Office hours
+    network_rules:
+      allow_cidrs: [10.0.0.0/8]
+    require_approval: true
+    require_step_up: true
+  - name: Minecraft
+    host: 10.0.0.3
+    port: 25565
+`))
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	d := newTestDrawbridge(t)
+	// Made in the Drawbridge Dashboard, and missing from the authoritative file.
+	if _, err := d.SaveSchedule(authorization.Schedule{Name: "Old", Timezone: "UTC", Windows: []authorization.Window{{Days: []string{"monday"}, Start: "00:00", End: "24:00"}}}); err != nil {
+		t.Fatalf("SaveSchedule failed: %v", err)
+	}
+	plan, err := NewPlan(d, file)
+	if err != nil {
+		t.Fatalf("NewPlan failed: %v", err)
+	}
+	for _, want := range []string{
+		`+ schedule "Office hours"`,
+		`timezone: "Europe/London"`,
+		`exceptions: [{"date":"2024-12-25","open":false}]`,
+		`- schedule "Old"`,
+		`~ service "SSH"`,
+		`schedule: "" -> "Office hours"`,
+		`network_rules: {} -> {"allow_cidrs":["10.0.0.0/8"]}`,
+		"require_approval: false -> true",
+		"require_step_up: false -> true",
+	} {
+		if !strings.Contains(plan.String(), want) {
+			t.Errorf("plan is missing %q:\n%s", want, plan)
+		}
+	}
+
+	if err := plan.Apply(d, "test"); err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+	schedules, _ := d.DB.GetAllSchedules()
+	if len(schedules) != 1 || schedules[0].Name != "Office hours" || !schedules[0].EndSessions {
+		t.Fatalf("unexpected schedules after apply: %+v", schedules)
+	}
+	ssh, _ := d.DB.GetServiceById(1)
+	if ssh.ScheduleID != schedules[0].ID || !ssh.RequireApproval || !ssh.RequireStepUp || len(ssh.NetworkRules.AllowCIDRs) != 1 {
+		t.Errorf("unexpected SSH service after apply: %+v", ssh)
+	}
+	policies, _ := d.DB.GetAllPolicies()
+	if len(policies) != 1 || policies[0].ScheduleID != schedules[0].ID {
+		t.Errorf("expected the policy to use the schedule after apply, got %+v", policies)
+	}
+	again, err := NewPlan(d, file)
+	if err != nil {
+		t.Fatalf("NewPlan failed: %v", err)
+	}
+	if !again.Empty() {
+		t.Errorf("expected no changes after applying, got:\n%s", again)
+	}
+
+	// Edits in the Drawbridge Dashboard.
+	ssh.RequireStepUp = false
+	if err := d.DB.UpdateService(ssh, ssh.ID); err != nil {
+		t.Fatalf("UpdateService failed: %v", err)
+	}
+	officeHours := schedules[0]
+	officeHours.Windows[0].End = "18:00"
+	if _, err := d.SaveSchedule(officeHours); err != nil {
+		t.Fatalf("SaveSchedule failed: %v", err)
+	}
+	detector := NewDriftDetector(d, "drawbridge.yaml", file)
+	detector.Check()
+	drift := (&Plan{Changes: detector.Drift()}).String()
+	for _, want := range []string{`~ schedule "Office hours"`, `"end":"18:00"`, `~ service "SSH"`, "require_step_up: false -> true"} {
+		if !strings.Contains(drift, want) {
+			t.Errorf("drift is missing %q:\n%s", want, drift)
+		}
+	}
+}
+
+func TestPlanGrantsAndDeviceLabels(t *testing.T) {
+	file, err := Load(writeConfigFile(t, "drawbridge.toml", `
+authoritative = true
+
+[[schedules]]
+name = "Weekends"
+timezone = "UTC"
+windows = [{ days = ["saturday", "sunday"], start = "00:00", end = "24:00" }]
+
+[[services]]
+name = "SSH"
+host = "10.0.0.2"
+port = 2222
+
+[[services]]
+name = "Minecraft"
+host = "10.0.0.3"
+port = 25565
+
+[[grants]]
+service = "SSH"
+group = " admins "
+
+[[grants]]
+service = "Minecraft"
+group = "kids"
+schedule = "Weekends"
+
+[[devices]]
+id = "device-1"
+groups = ["kids", "admins", "admins"]
+tags = []
+`))
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	d := newTestDrawbridge(t)
+	if _, err := d.SaveGrant(authorization.Grant{ServiceID: 2, Group: "kids"}); err != nil {
+		t.Fatalf("SaveGrant failed: %v", err)
+	}
+	if _, err := d.SaveGrant(authorization.Grant{ServiceID: 1, Group: "contractors"}); err != nil {
+		t.Fatalf("SaveGrant failed: %v", err)
+	}
+	if _, err := d.SetDeviceGroupsAndTags("device-1", nil, []string{"laptop"}); err != nil {
+		t.Fatalf("SetDeviceGroupsAndTags failed: %v", err)
+	}
+	plan, err := NewPlan(d, file)
+	if err != nil {
+		t.Fatalf("NewPlan failed: %v", err)
+	}
+	for _, want := range []string{
+		`+ grant "SSH to admins"`,
+		`~ grant "Minecraft to kids"`,
+		`schedule: "" -> "Weekends"`,
+		`- grant "SSH to contractors"`,
+		`~ device "device-1"`,
+		`groups: [] -> ["admins","kids"]`,
+		`tags: ["laptop"] -> []`,
+	} {
+		if !strings.Contains(plan.String(), want) {
+			t.Errorf("plan is missing %q:\n%s", want, plan)
+		}
+	}
+
+	if err := plan.Apply(d, "test"); err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+	grants, _ := d.DB.GetAllGrants()
+	if len(grants) != 2 {
+		t.Fatalf("expected 2 grants after apply, got %+v", grants)
+	}
+	for _, grant := range grants {
+		if grant.Group == "kids" && (grant.ServiceID != 2 || grant.ScheduleID == 0) || grant.Group == "admins" && grant.ServiceID != 1 {
+			t.Errorf("unexpected grant after apply: %+v", grant)
+		}
+	}
+	device, _ := d.DB.GetEmissaryClientById("device-1")
+	if strings.Join(device.Groups, ",") != "admins,kids" || len(device.Tags) != 0 {
+		t.Errorf("unexpected device after apply: %+v", device)
+	}
+	again, err := NewPlan(d, file)
+	if err != nil {
+		t.Fatalf("NewPlan failed: %v", err)
+	}
+	if !again.Empty() {
+		t.Errorf("expected no changes after applying, got:\n%s", again)
+	}
+
+	// Leaving a device's groups and tags out leaves them alone.
+	file.Devices[0].Groups, file.Devices[0].Tags = nil, nil
+	if _, err := d.SetDeviceGroupsAndTags("device-1", []string{"guests"}, nil); err != nil {
+		t.Fatalf("SetDeviceGroupsAndTags failed: %v", err)
+	}
+	if plan, err := NewPlan(d, file); err != nil || !plan.Empty() {
+		t.Errorf("expected no changes, got %v:\n%s", err, plan)
+	}
+}
@@ -0,0 +1,62 @@
+package declarative
+
+import (
+	"fmt"
+	"imdawon/drawbridge/cmd/drawbridge"
+	"imdawon/drawbridge/cmd/drawbridge/sinks"
+	"log/slog"
+	"strconv"
+	"sync"
+)
+
+// Watches for the Drawbridge Dashboard changing something an authoritative configuration file manages.
+// A nil DriftDetector never finds drift, so callers don't need to check whether a configuration file is in use.
+type DriftDetector struct {
+	Path       string
+	file       *File
+	drawbridge *drawbridge.Drawbridge
+	mu         sync.Mutex
+	drift      []Change
+}
+
+func NewDriftDetector(d *drawbridge.Drawbridge, path string, file *File) *DriftDetector {
+	return &DriftDetector{Path: path, file: file, drawbridge: d}
+}
+
+// Diffs the configuration file against Drawbridge again. Drift is logged and published to the event sinks
+// when it first shows up or changes.
+func (dd *DriftDetector) Check() {
+	if dd == nil {
+		return
+	}
+	plan, err := NewPlan(dd.drawbridge, dd.file)
+	if err != nil {
+		slog.Error("Config Drift", slog.Any("Error diffing the configuration file", err))
+		return
+	}
+
+	dd.mu.Lock()
+	changed := plan.String() != (&Plan{Changes: dd.drift}).String()
+	dd.drift = plan.Changes
+	dd.mu.Unlock()
+	if !changed || plan.Empty() {
+		return
+	}
+	slog.Warn("Config Drift", slog.String("Drawbridge no longer matches the configuration file", dd.Path), slog.String("changes", plan.String()))
+	details := map[string]string{"config_file": dd.Path, "changes": strconv.Itoa(len(plan.Changes))}
+	for i, change := range plan.Changes {
+		details[fmt.Sprintf("change_%d", i+1)] = fmt.Sprintf("%s %s %s", change.Action, change.Resource, change.Name)
+	}
+	dd.drawbridge.RecordAdminAction(sinks.TypeConfigDrift, "", details)
+}
+
+// The changes `drawbridge apply` would make to bring Drawbridge back in line with the configuration file,
+// as of the last Check.
+func (dd *DriftDetector) Drift() []Change {
+	if dd == nil {
+		return nil
+	}
+	dd.mu.Lock()
+	defer dd.mu.Unlock()
+	return dd.drift
+}
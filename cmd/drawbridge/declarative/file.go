@@ -0,0 +1,280 @@
+// Package declarative manages Drawbridge from a YAML or TOML configuration file instead of the Drawbridge Dashboard,
+// so the setup can be reviewed and versioned.
+//
+// A Plan diffs the file against what Drawbridge has stored, and applying the plan reconciles the two. Only what the
+// file lists is managed: other services, policies, schedules, grants, devices and settings are left alone, unless the
+// file is authoritative, in which case services, policies, schedules and grants missing from it are deleted and
+// Dashboard edits to anything it manages are flagged as drift.
+package declarative
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"imdawon/drawbridge/cmd/drawbridge"
+	"imdawon/drawbridge/cmd/drawbridge/emissary"
+	"imdawon/drawbridge/cmd/drawbridge/emissary/authorization"
+	"imdawon/drawbridge/cmd/drawbridge/network"
+	"imdawon/drawbridge/cmd/drawbridge/sinks"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+type File struct {
+	// Makes the file the source of truth for Protected Services, policies, schedules and grants, and flags Dashboard
+	// edits to anything it manages.
+	Authoritative bool       `yaml:"authoritative" toml:"authoritative"`
+	Settings      *Settings  `yaml:"settings" toml:"settings"`
+	Schedules     []Schedule `yaml:"schedules" toml:"schedules"`
+	Policies      []Policy   `yaml:"policies" toml:"policies"`
+	Services      []Service  `yaml:"services" toml:"services"`
+	Grants        []Grant    `yaml:"grants" toml:"grants"`
+	Devices       []Device   `yaml:"devices" toml:"devices"`
+}
+
+// Settings left out of the file are not managed by it.
+type Settings struct {
+	ListeningAddress *string         `yaml:"listening_address" toml:"listening_address"`
+	DAUPingEnabled   *bool           `yaml:"dau_ping_enabled" toml:"dau_ping_enabled"`
+	EventRetention   *EventRetention `yaml:"event_retention" toml:"event_retention"`
+	// How old a device's latest posture report can be for policies that check posture, e.g. "12h".
+	PostureMaxAge *string `yaml:"posture_max_age" toml:"posture_max_age"`
+	// An empty list removes every event sink, leaving it out leaves them alone.
+	EventSinks *[]sinks.Config `yaml:"event_sinks" toml:"event_sinks"`
+}
+
+// Days left out use the Drawbridge defaults.
+type EventRetention struct {
+	EventDays        *int `yaml:"event_days" toml:"event_days"`
+	HourlyRollupDays *int `yaml:"hourly_rollup_days" toml:"hourly_rollup_days"`
+	DailyRollupDays  *int `yaml:"daily_rollup_days" toml:"daily_rollup_days"`
+}
+
+// A Protected Service, matched to the stored services by name.
+type Service struct {
+	Name        string `yaml:"name" toml:"name"`
+	Description string `yaml:"description" toml:"description"`
+	Host        string `yaml:"host" toml:"host"`
+	Port        uint16 `yaml:"port" toml:"port"`
+	// The name of the policy devices must pass to connect, from the file or the Drawbridge Dashboard. Empty for none.
+	Policy string `yaml:"policy" toml:"policy"`
+	// The name of the schedule devices may connect during, from the file or the Drawbridge Dashboard. Empty for any time.
+	Schedule string `yaml:"schedule" toml:"schedule"`
+	// The source networks devices may connect from, on top of the global network rules.
+	NetworkRules    network.Rules `yaml:"network_rules" toml:"network_rules"`
+	RequireApproval bool          `yaml:"require_approval" toml:"require_approval"`
+	RequireStepUp   bool          `yaml:"require_step_up" toml:"require_step_up"`
+}
+
+// An authorization policy, matched to the stored policies by name.
+type Policy struct {
+	Name        string              `yaml:"name" toml:"name"`
+	Description string              `yaml:"description" toml:"description"`
+	Rules       authorization.Group `yaml:"rules" toml:"rules"`
+	// The name of the schedule devices may connect during, from the file or the Drawbridge Dashboard. Empty for any time.
+	Schedule string `yaml:"schedule" toml:"schedule"`
+}
+
+// A schedule, matched to the stored schedules by name.
+type Schedule struct {
+	Name        string                    `yaml:"name" toml:"name"`
+	Timezone    string                    `yaml:"timezone" toml:"timezone"`
+	Windows     []authorization.Window    `yaml:"windows" toml:"windows"`
+	Exceptions  []authorization.Exception `yaml:"exceptions" toml:"exceptions"`
+	EndSessions bool                      `yaml:"end_sessions" toml:"end_sessions"`
+}
+
+func (s *Schedule) schedule() authorization.Schedule {
+	return authorization.Schedule{Name: s.Name, Timezone: s.Timezone, Windows: s.Windows, Exceptions: s.Exceptions, EndSessions: s.EndSessions}
+}
+
+// Gives the devices in a group access to a Protected Service, matched to the stored grants by service and group.
+// Changing a grant's policy or schedule replaces the grant.
+type Grant struct {
+	// The name of the Protected Service, from the file or the Drawbridge Dashboard.
+	Service string `yaml:"service" toml:"service"`
+	Group   string `yaml:"group" toml:"group"`
+	// The names of the policy and schedule the group's devices have to pass, on top of the service's. Empty for none.
+	Policy   string `yaml:"policy" toml:"policy"`
+	Schedule string `yaml:"schedule" toml:"schedule"`
+}
+
+// Identifies a grant in the plan, e.g. "SSH to admins".
+func (g *Grant) name() string {
+	return fmt.Sprintf("%s to %s", g.Service, g.Group)
+}
+
+// Devices are added to the Device Fleet by creating an Emissary Bundle, so the file can only manage existing ones.
+type Device struct {
+	ID string `yaml:"id" toml:"id"`
+	// Empty leaves the name Drawbridge picked alone.
+	Name    string `yaml:"name" toml:"name"`
+	Revoked bool   `yaml:"revoked" toml:"revoked"`
+	// Left out, the device's groups and tags are left alone. An empty list removes them all.
+	Groups *[]string `yaml:"groups" toml:"groups"`
+	Tags   *[]string `yaml:"tags" toml:"tags"`
+}
+
+// Reads a .yaml, .yml or .toml configuration file. Unknown keys are errors, so typos don't go unnoticed.
+func Load(path string) (*File, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file File
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(contents))
+		decoder.KnownFields(true)
+		err = decoder.Decode(&file)
+		// An empty file is an empty configuration.
+		if errors.Is(err, io.EOF) {
+			err = nil
+		}
+	case ".toml":
+		var metadata toml.MetaData
+		metadata, err = toml.Decode(string(contents), &file)
+		if err == nil && len(metadata.Undecoded()) > 0 {
+			err = fmt.Errorf("unknown keys %v", metadata.Undecoded())
+		}
+	default:
+		return nil, fmt.Errorf("%s: configuration files must be .yaml, .yml or .toml", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", path, err)
+	}
+	err = file.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &file, nil
+}
+
+func (f *File) Validate() error {
+	scheduleNames := make(map[string]bool)
+	for _, schedule := range f.Schedules {
+		if scheduleNames[schedule.Name] {
+			return fmt.Errorf("schedule %q is listed more than once", schedule.Name)
+		}
+		scheduleNames[schedule.Name] = true
+		validated := schedule.schedule()
+		err := validated.Validate()
+		if err != nil {
+			return fmt.Errorf("schedule %q: %w", schedule.Name, err)
+		}
+	}
+	policyNames := make(map[string]bool)
+	for _, policy := range f.Policies {
+		if policyNames[policy.Name] {
+			return fmt.Errorf("policy %q is listed more than once", policy.Name)
+		}
+		policyNames[policy.Name] = true
+		err := (&authorization.Policy{Name: policy.Name, Rules: policy.Rules}).Validate()
+		if err != nil {
+			return fmt.Errorf("policy %q: %w", policy.Name, err)
+		}
+		// Schedules missing from an authoritative file are deleted, so its policies and services can't use them.
+		if f.Authoritative && policy.Schedule != "" && !scheduleNames[policy.Schedule] {
+			return fmt.Errorf("policy %q uses schedule %q, which isn't listed in the file", policy.Name, policy.Schedule)
+		}
+	}
+	serviceNames := make(map[string]bool)
+	for i, service := range f.Services {
+		// Validating uppercases the country codes, so they compare equal to the stored ones.
+		if err := f.Services[i].NetworkRules.Validate(); err != nil {
+			return fmt.Errorf("service %q: %w", service.Name, err)
+		}
+		switch {
+		case strings.TrimSpace(service.Name) == "":
+			return errors.New("every service needs a name")
+		case serviceNames[service.Name]:
+			return fmt.Errorf("service %q is listed more than once", service.Name)
+		case strings.TrimSpace(service.Host) == "":
+			return fmt.Errorf("service %q needs a host", service.Name)
+		case service.Port == 0:
+			return fmt.Errorf("service %q needs a port", service.Name)
+		// Policies missing from an authoritative file are deleted, so its services can't use them.
+		case f.Authoritative && service.Policy != "" && !policyNames[service.Policy]:
+			return fmt.Errorf("service %q uses policy %q, which isn't listed in the file", service.Name, service.Policy)
+		case f.Authoritative && service.Schedule != "" && !scheduleNames[service.Schedule]:
+			return fmt.Errorf("service %q uses schedule %q, which isn't listed in the file", service.Name, service.Schedule)
+		}
+		serviceNames[service.Name] = true
+	}
+	grantNames := make(map[string]bool)
+	for i, grant := range f.Grants {
+		// Groups are trimmed the way the Drawbridge Dashboard trims them.
+		group, err := emissary.NormalizeLabels([]string{grant.Group})
+		if err != nil {
+			return fmt.Errorf("grant for %q: invalid group: %w", grant.Service, err)
+		}
+		if len(group) == 0 {
+			return fmt.Errorf("the grant for %q needs a group", grant.Service)
+		}
+		f.Grants[i].Group = group[0]
+		grant = f.Grants[i]
+		switch {
+		case grant.Service == "":
+			return fmt.Errorf("the grant to %q needs a service", grant.Group)
+		case grantNames[grant.name()]:
+			return fmt.Errorf("grant %q is listed more than once", grant.name())
+		// Services, policies and schedules missing from an authoritative file are deleted, so its grants can't use them.
+		case f.Authoritative && !serviceNames[grant.Service]:
+			return fmt.Errorf("grant %q is for a service that isn't listed in the file", grant.name())
+		case f.Authoritative && grant.Policy != "" && !policyNames[grant.Policy]:
+			return fmt.Errorf("grant %q uses policy %q, which isn't listed in the file", grant.name(), grant.Policy)
+		case f.Authoritative && grant.Schedule != "" && !scheduleNames[grant.Schedule]:
+			return fmt.Errorf("grant %q uses schedule %q, which isn't listed in the file", grant.name(), grant.Schedule)
+		}
+		grantNames[grant.name()] = true
+	}
+	deviceIDs, deviceNames := make(map[string]bool), make(map[string]bool)
+	for _, device := range f.Devices {
+		switch {
+		case device.ID == "":
+			return errors.New("every device needs an id")
+		case deviceIDs[device.ID]:
+			return fmt.Errorf("device %q is listed more than once", device.ID)
+		case device.Name != "" && deviceNames[device.Name]:
+			return fmt.Errorf("more than one device is named %q", device.Name)
+		}
+		deviceIDs[device.ID], deviceNames[device.Name] = true, device.Name != ""
+		// Normalized, so they compare equal to the stored groups and tags.
+		for _, labels := range []*[]string{device.Groups, device.Tags} {
+			if labels == nil {
+				continue
+			}
+			normalized, err := emissary.NormalizeLabels(*labels)
+			if err != nil {
+				return fmt.Errorf("device %q: %w", device.ID, err)
+			}
+			*labels = normalized
+		}
+	}
+	if f.Settings != nil && f.Settings.PostureMaxAge != nil {
+		maxAge, err := time.ParseDuration(*f.Settings.PostureMaxAge)
+		if err != nil || maxAge < drawbridge.MinPostureMaxAge {
+			return fmt.Errorf("posture_max_age must be a duration of at least %s, e.g. 12h", drawbridge.MinPostureMaxAge)
+		}
+	}
+	if f.Settings != nil && f.Settings.EventSinks != nil {
+		sinkNames := make(map[string]bool)
+		for _, config := range *f.Settings.EventSinks {
+			if sinkNames[config.Name] {
+				return fmt.Errorf("event sink %q is listed more than once", config.Name)
+			}
+			sinkNames[config.Name] = true
+			err := config.Validate()
+			if err != nil {
+				return fmt.Errorf("event sink %q: %w", config.Name, err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,1042 @@
+package declarative
+
+import (
+	"encoding/json"
+	"fmt"
+	"imdawon/drawbridge/cmd/drawbridge"
+	"imdawon/drawbridge/cmd/drawbridge/emissary/authorization"
+	"imdawon/drawbridge/cmd/drawbridge/network"
+	"imdawon/drawbridge/cmd/drawbridge/services"
+	"imdawon/drawbridge/cmd/drawbridge/sinks"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Action string
+
+const (
+	ActionCreate Action = "create"
+	ActionUpdate Action = "update"
+	ActionDelete Action = "delete"
+)
+
+// Kinds of things a configuration file manages.
+const (
+	ResourceSetting  = "setting"
+	ResourceSchedule = "schedule"
+	ResourcePolicy   = "policy"
+	ResourceService  = "service"
+	ResourceGrant    = "grant"
+	ResourceDevice   = "device"
+)
+
+// One difference between the configuration file and what Drawbridge has stored.
+type Change struct {
+	Action   Action
+	Resource string
+	Name     string
+	Fields   []FieldChange
+	apply    func(d *drawbridge.Drawbridge, actor string) error
+}
+
+type FieldChange struct {
+	Field string
+	From  string
+	To    string
+}
+
+// The changes that bring Drawbridge in line with a configuration file, in the order they are applied.
+type Plan struct {
+	Changes []Change
+}
+
+func (p *Plan) Empty() bool {
+	return len(p.Changes) == 0
+}
+
+// Lists the changes like `drawbridge plan` prints them.
+func (p *Plan) String() string {
+	if p.Empty() {
+		return "No changes. Drawbridge matches the configuration file.\n"
+	}
+	var out strings.Builder
+	counts := make(map[Action]int)
+	for _, change := range p.Changes {
+		counts[change.Action]++
+		symbol := map[Action]string{ActionCreate: "+", ActionUpdate: "~", ActionDelete: "-"}[change.Action]
+		fmt.Fprintf(&out, "  %s %s %q\n", symbol, change.Resource, change.Name)
+		for _, field := range change.Fields {
+			switch change.Action {
+			case ActionCreate:
+				fmt.Fprintf(&out, "      %s: %s\n", field.Field, field.To)
+			case ActionUpdate:
+				fmt.Fprintf(&out, "      %s: %s -> %s\n", field.Field, field.From, field.To)
+			}
+		}
+	}
+	fmt.Fprintf(&out, "Plan: %d to create, %d to update, %d to delete.\n", counts[ActionCreate], counts[ActionUpdate], counts[ActionDelete])
+	return out.String()
+}
+
+// Applies the changes in order, stopping at the first that fails. Each change is recorded as an admin action by actor.
+func (p *Plan) Apply(d *drawbridge.Drawbridge, actor string) error {
+	for i, change := range p.Changes {
+		err := change.apply(d, actor)
+		if err != nil {
+			return fmt.Errorf("error applying change %d of %d (%s %s %q): %w", i+1, len(p.Changes), change.Action, change.Resource, change.Name, err)
+		}
+	}
+	return nil
+}
+
+// Diffs the configuration file against what Drawbridge has stored.
+func NewPlan(d *drawbridge.Drawbridge, file *File) (*Plan, error) {
+	plan := &Plan{}
+	for _, diff := range []func(*drawbridge.Drawbridge, *File) ([]Change, error){planSettings, planSchedules, planPolicies, planServices, planGrants, planDevices, planPolicyDeletions, planScheduleDeletions} {
+		changes, err := diff(d, file)
+		if err != nil {
+			return nil, err
+		}
+		plan.Changes = append(plan.Changes, changes...)
+	}
+	return plan, nil
+}
+
+func planSettings(d *drawbridge.Drawbridge, file *File) ([]Change, error) {
+	if file.Settings == nil {
+		return nil, nil
+	}
+	var changes []Change
+	for _, managed := range []struct {
+		setting string
+		desired *string
+	}{
+		{"listening_address", file.Settings.ListeningAddress},
+		{"dau_ping_enabled", boolSetting(file.Settings.DAUPingEnabled)},
+		{"posture_max_age", durationSetting(file.Settings.PostureMaxAge)},
+	} {
+		setting, desired := managed.setting, managed.desired
+		if desired == nil {
+			continue
+		}
+		current, err := d.DB.GetDrawbridgeConfigValueByName(setting)
+		if err != nil {
+			return nil, err
+		}
+		if current != nil && *current == *desired {
+			continue
+		}
+		value := *desired
+		changes = append(changes, Change{
+			Action:   ActionUpdate,
+			Resource: ResourceSetting,
+			Name:     setting,
+			Fields:   []FieldChange{{Field: "value", From: strconv.Quote(*current), To: strconv.Quote(value)}},
+			apply: func(d *drawbridge.Drawbridge, actor string) error {
+				err := d.DB.CreateNewDrawbridgeConfigSettings(setting, value)
+				if err != nil {
+					return err
+				}
+				d.RecordAdminAction(sinks.TypeSettingsUpdated, actor, map[string]string{setting: value})
+				return nil
+			},
+		})
+	}
+
+	if file.Settings.EventRetention != nil {
+		change := planEventRetention(d, file.Settings.EventRetention)
+		if change != nil {
+			changes = append(changes, *change)
+		}
+	}
+	if file.Settings.EventSinks != nil {
+		change, err := planEventSinks(d, *file.Settings.EventSinks)
+		if err != nil {
+			return nil, err
+		}
+		if change != nil {
+			changes = append(changes, *change)
+		}
+	}
+	return changes, nil
+}
+
+func boolSetting(value *bool) *string {
+	if value == nil {
+		return nil
+	}
+	formatted := strconv.FormatBool(*value)
+	return &formatted
+}
+
+// Durations are stored the way time.Duration prints them, so 12h in the file matches a stored 12h0m0s.
+func durationSetting(value *string) *string {
+	if value == nil {
+		return nil
+	}
+	duration, err := time.ParseDuration(*value)
+	if err != nil {
+		return value
+	}
+	formatted := duration.String()
+	return &formatted
+}
+
+func planEventRetention(d *drawbridge.Drawbridge, desired *EventRetention) *Change {
+	current := d.EventRetention()
+	retention := drawbridge.DefaultEventRetention
+	var fields []FieldChange
+	for _, days := range []struct {
+		field   string
+		desired *int
+		current int
+		target  *int
+	}{
+		{"event_days", desired.EventDays, current.EventDays, &retention.EventDays},
+		{"hourly_rollup_days", desired.HourlyRollupDays, current.HourlyRollupDays, &retention.HourlyRollupDays},
+		{"daily_rollup_days", desired.DailyRollupDays, current.DailyRollupDays, &retention.DailyRollupDays},
+	} {
+		if days.desired != nil {
+			*days.target = *days.desired
+		}
+		if *days.target != days.current {
+			fields = append(fields, FieldChange{Field: days.field, From: strconv.Itoa(days.current), To: strconv.Itoa(*days.target)})
+		}
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	return &Change{
+		Action:   ActionUpdate,
+		Resource: ResourceSetting,
+		Name:     "event_retention",
+		Fields:   fields,
+		apply: func(d *drawbridge.Drawbridge, actor string) error {
+			err := d.SaveEventRetention(retention)
+			if err != nil {
+				return err
+			}
+			d.RecordAdminAction(sinks.TypeSettingsUpdated, actor, map[string]string{
+				"event_retention_days":         strconv.Itoa(retention.EventDays),
+				"hourly_rollup_retention_days": strconv.Itoa(retention.HourlyRollupDays),
+				"daily_rollup_retention_days":  strconv.Itoa(retention.DailyRollupDays),
+			})
+			return nil
+		},
+	}
+}
+
+// Event sinks are matched by name. Sinks keep their id, so webhooks keep their queue of undelivered events.
+func planEventSinks(d *drawbridge.Drawbridge, desired []sinks.Config) (*Change, error) {
+	current, err := d.EventSinks()
+	if err != nil {
+		return nil, err
+	}
+	currentByName := make(map[string]sinks.Config)
+	for _, config := range current {
+		currentByName[config.Name] = config
+	}
+	desired = append([]sinks.Config(nil), desired...)
+	desiredNames := make(map[string]bool)
+	var fields []FieldChange
+	for i, config := range desired {
+		desiredNames[config.Name] = true
+		existing, ok := currentByName[config.Name]
+		if !ok {
+			fields = append(fields, FieldChange{Field: config.Name, From: "(none)", To: config.Type})
+			continue
+		}
+		if config.ID == "" {
+			desired[i].ID = existing.ID
+		}
+		if !sameEventSink(existing, desired[i]) {
+			// Webhook secrets are never printed.
+			fields = append(fields, FieldChange{Field: config.Name, From: existing.Type, To: config.Type + " (changed)"})
+		}
+	}
+	for _, config := range current {
+		if !desiredNames[config.Name] {
+			fields = append(fields, FieldChange{Field: config.Name, From: config.Type, To: "(none)"})
+		}
+	}
+	// Reordering sinks changes nothing.
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	return &Change{
+		Action:   ActionUpdate,
+		Resource: ResourceSetting,
+		Name:     "event_sinks",
+		Fields:   fields,
+		apply: func(d *drawbridge.Drawbridge, actor string) error {
+			err := d.SaveEventSinks(desired)
+			if err != nil {
+				return err
+			}
+			d.RecordAdminAction(sinks.TypeEventSinksUpdated, actor, nil)
+			return nil
+		},
+	}, nil
+}
+
+func sameEventSink(a, b sinks.Config) bool {
+	encodedA, _ := json.Marshal(a)
+	encodedB, _ := json.Marshal(b)
+	return string(encodedA) == string(encodedB)
+}
+
+func planServices(d *drawbridge.Drawbridge, file *File) ([]Change, error) {
+	stored, err := d.DB.GetAllServices()
+	if err != nil {
+		return nil, err
+	}
+	storedPolicies, err := d.DB.GetAllPolicies()
+	if err != nil {
+		return nil, err
+	}
+	policyNames := make(map[int64]string)
+	knownPolicies := make(map[string]bool)
+	for _, policy := range storedPolicies {
+		policyNames[policy.ID], knownPolicies[policy.Name] = policy.Name, true
+	}
+	for _, policy := range file.Policies {
+		knownPolicies[policy.Name] = true
+	}
+	scheduleNames, knownSchedules, err := fileScheduleNames(d, file)
+	if err != nil {
+		return nil, err
+	}
+	storedByName := make(map[string]services.ProtectedService)
+	for _, service := range stored {
+		if _, ok := storedByName[service.Name]; ok {
+			return nil, fmt.Errorf("more than one Protected Service is named %q, rename one in the Drawbridge Dashboard so the configuration file can tell them apart", service.Name)
+		}
+		storedByName[service.Name] = service
+	}
+
+	var changes []Change
+	desiredNames := make(map[string]bool)
+	for _, desired := range file.Services {
+		desiredNames[desired.Name] = true
+		host := strings.TrimSpace(desired.Host)
+		// The same rewrite the Drawbridge Dashboard makes, so the service can be parsed as an IP.
+		if host == "localhost" {
+			host = "127.0.0.1"
+		}
+		if desired.Policy != "" && !knownPolicies[desired.Policy] {
+			return nil, fmt.Errorf("service %q uses policy %q, which doesn't exist", desired.Name, desired.Policy)
+		}
+		if desired.Schedule != "" && !knownSchedules[desired.Schedule] {
+			return nil, fmt.Errorf("service %q uses schedule %q, which doesn't exist", desired.Name, desired.Schedule)
+		}
+		rules := desired.NetworkRules
+		// Country and ASN rules need a GeoIP database on this Drawbridge.
+		err := d.ValidateNetworkRules(&rules)
+		if err != nil {
+			return nil, fmt.Errorf("service %q: %w", desired.Name, err)
+		}
+		policyName, scheduleName := desired.Policy, desired.Schedule
+		existing, ok := storedByName[desired.Name]
+		if !ok {
+			service := services.ProtectedService{
+				Name:            desired.Name,
+				Description:     desired.Description,
+				Host:            host,
+				Port:            desired.Port,
+				NetworkRules:    rules,
+				RequireApproval: desired.RequireApproval,
+				RequireStepUp:   desired.RequireStepUp,
+			}
+			fields := []FieldChange{
+				{Field: "description", To: strconv.Quote(service.Description)},
+				{Field: "host", To: strconv.Quote(service.Host)},
+				{Field: "port", To: strconv.Itoa(int(service.Port))},
+			}
+			if policyName != "" {
+				fields = append(fields, FieldChange{Field: "policy", To: strconv.Quote(policyName)})
+			}
+			if scheduleName != "" {
+				fields = append(fields, FieldChange{Field: "schedule", To: strconv.Quote(scheduleName)})
+			}
+			if !rules.Empty() {
+				fields = append(fields, FieldChange{Field: "network_rules", To: networkRules(rules)})
+			}
+			if service.RequireApproval {
+				fields = append(fields, FieldChange{Field: "require_approval", To: "true"})
+			}
+			if service.RequireStepUp {
+				fields = append(fields, FieldChange{Field: "require_step_up", To: "true"})
+			}
+			changes = append(changes, Change{
+				Action:   ActionCreate,
+				Resource: ResourceService,
+				Name:     desired.Name,
+				Fields:   fields,
+				apply: func(d *drawbridge.Drawbridge, actor string) error {
+					// The policy may have been created earlier in the same plan.
+					policy, err := policyID(d, policyName)
+					if err != nil {
+						return err
+					}
+					service.ClientPolicyID = policy
+					service.ScheduleID, err = scheduleID(d, scheduleName)
+					if err != nil {
+						return err
+					}
+					created, err := d.DB.CreateNewService(service)
+					if err != nil {
+						return err
+					}
+					d.RecordAdminAction(sinks.TypeServiceCreated, actor, map[string]string{"service_id": strconv.FormatInt(created.ID, 10), "name": created.Name})
+					return nil
+				},
+			})
+			continue
+		}
+
+		var fields []FieldChange
+		if existing.Description != desired.Description {
+			fields = append(fields, FieldChange{Field: "description", From: strconv.Quote(existing.Description), To: strconv.Quote(desired.Description)})
+		}
+		if existing.Host != host {
+			fields = append(fields, FieldChange{Field: "host", From: strconv.Quote(existing.Host), To: strconv.Quote(host)})
+		}
+		if existing.Port != desired.Port {
+			fields = append(fields, FieldChange{Field: "port", From: strconv.Itoa(int(existing.Port)), To: strconv.Itoa(int(desired.Port))})
+		}
+		existingPolicy := policyNames[existing.ClientPolicyID]
+		if existing.ClientPolicyID != 0 && existingPolicy == "" {
+			existingPolicy = fmt.Sprintf("(missing policy id %d)", existing.ClientPolicyID)
+		}
+		if existingPolicy != policyName {
+			fields = append(fields, FieldChange{Field: "policy", From: strconv.Quote(existingPolicy), To: strconv.Quote(policyName)})
+		}
+		if existingSchedule := storedScheduleName(scheduleNames, existing.ScheduleID); existingSchedule != scheduleName {
+			fields = append(fields, FieldChange{Field: "schedule", From: strconv.Quote(existingSchedule), To: strconv.Quote(scheduleName)})
+		}
+		if networkRules(existing.NetworkRules) != networkRules(rules) {
+			fields = append(fields, FieldChange{Field: "network_rules", From: networkRules(existing.NetworkRules), To: networkRules(rules)})
+		}
+		if existing.RequireApproval != desired.RequireApproval {
+			fields = append(fields, FieldChange{Field: "require_approval", From: strconv.FormatBool(existing.RequireApproval), To: strconv.FormatBool(desired.RequireApproval)})
+		}
+		if existing.RequireStepUp != desired.RequireStepUp {
+			fields = append(fields, FieldChange{Field: "require_step_up", From: strconv.FormatBool(existing.RequireStepUp), To: strconv.FormatBool(desired.RequireStepUp)})
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		updated := existing
+		updated.Description, updated.Host, updated.Port = desired.Description, host, desired.Port
+		updated.NetworkRules, updated.RequireApproval, updated.RequireStepUp = rules, desired.RequireApproval, desired.RequireStepUp
+		changes = append(changes, Change{
+			Action:   ActionUpdate,
+			Resource: ResourceService,
+			Name:     desired.Name,
+			Fields:   fields,
+			apply: func(d *drawbridge.Drawbridge, actor string) error {
+				var err error
+				updated.ClientPolicyID, err = policyID(d, policyName)
+				if err != nil {
+					return err
+				}
+				updated.ScheduleID, err = scheduleID(d, scheduleName)
+				if err != nil {
+					return err
+				}
+				err = d.DB.UpdateService(&updated, updated.ID)
+				if err != nil {
+					return err
+				}
+				d.RecordAdminAction(sinks.TypeServiceUpdated, actor, map[string]string{"service_id": strconv.FormatInt(updated.ID, 10), "name": updated.Name})
+				return nil
+			},
+		})
+	}
+
+	if !file.Authoritative {
+		return changes, nil
+	}
+	for _, service := range stored {
+		if desiredNames[service.Name] {
+			continue
+		}
+		id := service.ID
+		changes = append(changes, Change{
+			Action:   ActionDelete,
+			Resource: ResourceService,
+			Name:     service.Name,
+			apply: func(d *drawbridge.Drawbridge, actor string) error {
+				err := d.DB.DeleteService(int(id))
+				if err != nil {
+					return err
+				}
+				d.RecordAdminAction(sinks.TypeServiceDeleted, actor, map[string]string{"service_id": strconv.FormatInt(id, 10)})
+				return nil
+			},
+		})
+	}
+	return changes, nil
+}
+
+// Returns the id of the policy with the name, or 0 for no policy.
+func policyID(d *drawbridge.Drawbridge, name string) (int64, error) {
+	if name == "" {
+		return 0, nil
+	}
+	policies, err := d.DB.GetAllPolicies()
+	if err != nil {
+		return 0, err
+	}
+	for _, policy := range policies {
+		if policy.Name == name {
+			return policy.ID, nil
+		}
+	}
+	return 0, fmt.Errorf("policy %q doesn't exist", name)
+}
+
+// Policies are matched by name. They are created and updated before the services that use them are,
+// and deleted by planPolicyDeletions once the services no longer use them.
+func planPolicies(d *drawbridge.Drawbridge, file *File) ([]Change, error) {
+	stored, err := d.DB.GetAllPolicies()
+	if err != nil {
+		return nil, err
+	}
+	storedByName := make(map[string]authorization.Policy)
+	for _, policy := range stored {
+		storedByName[policy.Name] = policy
+	}
+	scheduleNames, knownSchedules, err := fileScheduleNames(d, file)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []Change
+	for _, desired := range file.Policies {
+		if desired.Schedule != "" && !knownSchedules[desired.Schedule] {
+			return nil, fmt.Errorf("policy %q uses schedule %q, which doesn't exist", desired.Name, desired.Schedule)
+		}
+		scheduleName := desired.Schedule
+		existing, ok := storedByName[desired.Name]
+		if !ok {
+			policy := authorization.Policy{Name: desired.Name, Description: desired.Description, Rules: desired.Rules}
+			fields := []FieldChange{
+				{Field: "description", To: strconv.Quote(policy.Description)},
+				{Field: "rules", To: policyRules(policy.Rules)},
+			}
+			if scheduleName != "" {
+				fields = append(fields, FieldChange{Field: "schedule", To: strconv.Quote(scheduleName)})
+			}
+			changes = append(changes, Change{
+				Action:   ActionCreate,
+				Resource: ResourcePolicy,
+				Name:     desired.Name,
+				Fields:   fields,
+				apply: func(d *drawbridge.Drawbridge, actor string) error {
+					// The schedule may have been created earlier in the same plan.
+					var err error
+					policy.ScheduleID, err = scheduleID(d, scheduleName)
+					if err != nil {
+						return err
+					}
+					created, err := d.SavePolicy(policy)
+					if err != nil {
+						return err
+					}
+					d.RecordAdminAction(sinks.TypePolicyCreated, actor, map[string]string{"policy_id": strconv.FormatInt(created.ID, 10), "name": created.Name})
+					return nil
+				},
+			})
+			continue
+		}
+
+		var fields []FieldChange
+		if existing.Description != desired.Description {
+			fields = append(fields, FieldChange{Field: "description", From: strconv.Quote(existing.Description), To: strconv.Quote(desired.Description)})
+		}
+		if policyRules(existing.Rules) != policyRules(desired.Rules) {
+			fields = append(fields, FieldChange{Field: "rules", From: policyRules(existing.Rules), To: policyRules(desired.Rules)})
+		}
+		if existingSchedule := storedScheduleName(scheduleNames, existing.ScheduleID); existingSchedule != scheduleName {
+			fields = append(fields, FieldChange{Field: "schedule", From: strconv.Quote(existingSchedule), To: strconv.Quote(scheduleName)})
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		updated := existing
+		updated.Description, updated.Rules = desired.Description, desired.Rules
+		changes = append(changes, Change{
+			Action:   ActionUpdate,
+			Resource: ResourcePolicy,
+			Name:     desired.Name,
+			Fields:   fields,
+			apply: func(d *drawbridge.Drawbridge, actor string) error {
+				var err error
+				updated.ScheduleID, err = scheduleID(d, scheduleName)
+				if err != nil {
+					return err
+				}
+				_, err = d.SavePolicy(updated)
+				if err != nil {
+					return err
+				}
+				d.RecordAdminAction(sinks.TypePolicyUpdated, actor, map[string]string{"policy_id": strconv.FormatInt(updated.ID, 10), "name": updated.Name})
+				return nil
+			},
+		})
+	}
+	return changes, nil
+}
+
+// Rules are compared and printed as JSON, the way they are stored.
+func policyRules(rules authorization.Group) string {
+	encoded, _ := json.Marshal(rules)
+	return string(encoded)
+}
+
+// Network rules are compared and printed as JSON too. No rules print as {}.
+func networkRules(rules network.Rules) string {
+	encoded, _ := json.Marshal(rules)
+	return string(encoded)
+}
+
+func planPolicyDeletions(d *drawbridge.Drawbridge, file *File) ([]Change, error) {
+	if !file.Authoritative {
+		return nil, nil
+	}
+	stored, err := d.DB.GetAllPolicies()
+	if err != nil {
+		return nil, err
+	}
+	desiredNames := make(map[string]bool)
+	for _, policy := range file.Policies {
+		desiredNames[policy.Name] = true
+	}
+	var changes []Change
+	for _, policy := range stored {
+		if desiredNames[policy.Name] {
+			continue
+		}
+		id := policy.ID
+		changes = append(changes, Change{
+			Action:   ActionDelete,
+			Resource: ResourcePolicy,
+			Name:     policy.Name,
+			apply: func(d *drawbridge.Drawbridge, actor string) error {
+				err := d.DB.DeletePolicy(id)
+				if err != nil {
+					return err
+				}
+				d.RecordAdminAction(sinks.TypePolicyDeleted, actor, map[string]string{"policy_id": strconv.FormatInt(id, 10)})
+				return nil
+			},
+		})
+	}
+	return changes, nil
+}
+
+func planDevices(d *drawbridge.Drawbridge, file *File) ([]Change, error) {
+	var changes []Change
+	for _, desired := range file.Devices {
+		existing, err := d.DB.GetEmissaryClientById(desired.ID)
+		if err != nil {
+			return nil, err
+		}
+		if existing.ID == "" {
+			return nil, fmt.Errorf("device %q isn't in the Device Fleet. Devices are added by creating an Emissary Bundle", desired.ID)
+		}
+		var fields []FieldChange
+		if desired.Name != "" && desired.Name != existing.Name {
+			fields = append(fields, FieldChange{Field: "name", From: strconv.Quote(existing.Name), To: strconv.Quote(desired.Name)})
+		}
+		revoked := existing.Revoked == 1
+		if desired.Revoked != revoked {
+			fields = append(fields, FieldChange{Field: "revoked", From: strconv.FormatBool(revoked), To: strconv.FormatBool(desired.Revoked)})
+		}
+		groups, tags := existing.Groups, existing.Tags
+		if desired.Groups != nil && jsonList(*desired.Groups) != jsonList(groups) {
+			fields = append(fields, FieldChange{Field: "groups", From: jsonList(groups), To: jsonList(*desired.Groups)})
+			groups = *desired.Groups
+		}
+		if desired.Tags != nil && jsonList(*desired.Tags) != jsonList(tags) {
+			fields = append(fields, FieldChange{Field: "tags", From: jsonList(tags), To: jsonList(*desired.Tags)})
+			tags = *desired.Tags
+		}
+		relabel := jsonList(groups) != jsonList(existing.Groups) || jsonList(tags) != jsonList(existing.Tags)
+		if len(fields) == 0 {
+			continue
+		}
+		device, name := desired, existing.Name
+		changes = append(changes, Change{
+			Action:   ActionUpdate,
+			Resource: ResourceDevice,
+			Name:     desired.ID,
+			Fields:   fields,
+			apply: func(d *drawbridge.Drawbridge, actor string) error {
+				if device.Name != "" && device.Name != name {
+					err := d.DB.RenameEmissaryClient(device.ID, device.Name)
+					if err != nil {
+						return err
+					}
+					name = device.Name
+				}
+				if relabel {
+					updated, err := d.SetDeviceGroupsAndTags(device.ID, groups, tags)
+					if err != nil {
+						return err
+					}
+					d.RecordAdminAction(sinks.TypeDeviceUpdated, actor, map[string]string{
+						"device_id": updated.ID,
+						"name":      updated.Name,
+						"groups":    strings.Join(updated.Groups, ","),
+						"tags":      strings.Join(updated.Tags, ","),
+					})
+				}
+				if device.Revoked == revoked {
+					return nil
+				}
+				eventType := sinks.TypeDeviceUnrevoked
+				revoke := d.DB.UnRevokeEmissaryClient
+				if device.Revoked {
+					eventType, revoke = sinks.TypeDeviceRevoked, d.DB.RevokeEmissaryClient
+				}
+				_, _, err := revoke(device.ID)
+				if err != nil {
+					return err
+				}
+				d.RecordAdminAction(eventType, actor, map[string]string{"device_id": device.ID, "name": name})
+				return nil
+			},
+		})
+	}
+	return changes, nil
+}
+
+// Schedules are matched by name. They are created and updated before the policies and services that use them are,
+// and deleted by planScheduleDeletions once nothing uses them.
+func planSchedules(d *drawbridge.Drawbridge, file *File) ([]Change, error) {
+	stored, err := d.DB.GetAllSchedules()
+	if err != nil {
+		return nil, err
+	}
+	storedByName := make(map[string]authorization.Schedule)
+	for _, schedule := range stored {
+		storedByName[schedule.Name] = schedule
+	}
+
+	var changes []Change
+	for _, desired := range file.Schedules {
+		schedule := desired.schedule()
+		existing, ok := storedByName[desired.Name]
+		if !ok {
+			changes = append(changes, Change{
+				Action:   ActionCreate,
+				Resource: ResourceSchedule,
+				Name:     desired.Name,
+				Fields: []FieldChange{
+					{Field: "timezone", To: strconv.Quote(schedule.Timezone)},
+					{Field: "windows", To: jsonList(schedule.Windows)},
+					{Field: "exceptions", To: jsonList(schedule.Exceptions)},
+					{Field: "end_sessions", To: strconv.FormatBool(schedule.EndSessions)},
+				},
+				apply: func(d *drawbridge.Drawbridge, actor string) error {
+					created, err := d.SaveSchedule(schedule)
+					if err != nil {
+						return err
+					}
+					d.RecordAdminAction(sinks.TypeScheduleCreated, actor, map[string]string{"schedule_id": strconv.FormatInt(created.ID, 10), "name": created.Name})
+					return nil
+				},
+			})
+			continue
+		}
+
+		var fields []FieldChange
+		if existing.Timezone != schedule.Timezone {
+			fields = append(fields, FieldChange{Field: "timezone", From: strconv.Quote(existing.Timezone), To: strconv.Quote(schedule.Timezone)})
+		}
+		if jsonList(existing.Windows) != jsonList(schedule.Windows) {
+			fields = append(fields, FieldChange{Field: "windows", From: jsonList(existing.Windows), To: jsonList(schedule.Windows)})
+		}
+		if jsonList(existing.Exceptions) != jsonList(schedule.Exceptions) {
+			fields = append(fields, FieldChange{Field: "exceptions", From: jsonList(existing.Exceptions), To: jsonList(schedule.Exceptions)})
+		}
+		if existing.EndSessions != schedule.EndSessions {
+			fields = append(fields, FieldChange{Field: "end_sessions", From: strconv.FormatBool(existing.EndSessions), To: strconv.FormatBool(schedule.EndSessions)})
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		schedule.ID = existing.ID
+		changes = append(changes, Change{
+			Action:   ActionUpdate,
+			Resource: ResourceSchedule,
+			Name:     desired.Name,
+			Fields:   fields,
+			apply: func(d *drawbridge.Drawbridge, actor string) error {
+				_, err := d.SaveSchedule(schedule)
+				if err != nil {
+					return err
+				}
+				d.RecordAdminAction(sinks.TypeScheduleUpdated, actor, map[string]string{"schedule_id": strconv.FormatInt(schedule.ID, 10), "name": schedule.Name})
+				return nil
+			},
+		})
+	}
+	return changes, nil
+}
+
+// Lists are compared and printed as JSON, with no list printed as [].
+func jsonList[T any](list []T) string {
+	if len(list) == 0 {
+		return "[]"
+	}
+	encoded, _ := json.Marshal(list)
+	return string(encoded)
+}
+
+func planScheduleDeletions(d *drawbridge.Drawbridge, file *File) ([]Change, error) {
+	if !file.Authoritative {
+		return nil, nil
+	}
+	stored, err := d.DB.GetAllSchedules()
+	if err != nil {
+		return nil, err
+	}
+	desiredNames := make(map[string]bool)
+	for _, schedule := range file.Schedules {
+		desiredNames[schedule.Name] = true
+	}
+	var changes []Change
+	for _, schedule := range stored {
+		if desiredNames[schedule.Name] {
+			continue
+		}
+		id := schedule.ID
+		changes = append(changes, Change{
+			Action:   ActionDelete,
+			Resource: ResourceSchedule,
+			Name:     schedule.Name,
+			apply: func(d *drawbridge.Drawbridge, actor string) error {
+				err := d.DB.DeleteSchedule(id)
+				if err != nil {
+					return err
+				}
+				d.RecordAdminAction(sinks.TypeScheduleDeleted, actor, map[string]string{"schedule_id": strconv.FormatInt(id, 10)})
+				return nil
+			},
+		})
+	}
+	return changes, nil
+}
+
+// Returns the names of the stored schedules by id, and the schedule names policies and services in the file can use.
+func fileScheduleNames(d *drawbridge.Drawbridge, file *File) (map[int64]string, map[string]bool, error) {
+	stored, err := d.DB.GetAllSchedules()
+	if err != nil {
+		return nil, nil, err
+	}
+	names := make(map[int64]string)
+	known := make(map[string]bool)
+	for _, schedule := range stored {
+		names[schedule.ID], known[schedule.Name] = schedule.Name, true
+	}
+	for _, schedule := range file.Schedules {
+		known[schedule.Name] = true
+	}
+	return names, known, nil
+}
+
+// Returns the name of the stored schedule with the id, or "" for none.
+func storedScheduleName(names map[int64]string, id int64) string {
+	if id != 0 && names[id] == "" {
+		return fmt.Sprintf("(missing schedule id %d)", id)
+	}
+	return names[id]
+}
+
+// Returns the id of the schedule with the name, or 0 for any time.
+func scheduleID(d *drawbridge.Drawbridge, name string) (int64, error) {
+	if name == "" {
+		return 0, nil
+	}
+	schedules, err := d.DB.GetAllSchedules()
+	if err != nil {
+		return 0, err
+	}
+	for _, schedule := range schedules {
+		if schedule.Name == name {
+			return schedule.ID, nil
+		}
+	}
+	return 0, fmt.Errorf("schedule %q doesn't exist", name)
+}
+
+// Grants are matched by service and group. They are created once the services, policies and schedules they use
+// are, and a grant whose policy or schedule changed is replaced. Grants of services the plan deletes go with them.
+func planGrants(d *drawbridge.Drawbridge, file *File) ([]Change, error) {
+	stored, err := d.DB.GetAllGrants()
+	if err != nil {
+		return nil, err
+	}
+	storedServices, err := d.DB.GetAllServices()
+	if err != nil {
+		return nil, err
+	}
+	storedPolicies, err := d.DB.GetAllPolicies()
+	if err != nil {
+		return nil, err
+	}
+	scheduleNames, knownSchedules, err := fileScheduleNames(d, file)
+	if err != nil {
+		return nil, err
+	}
+	serviceNames, policyNames := make(map[int64]string), make(map[int64]string)
+	knownServices, knownPolicies := make(map[string]bool), make(map[string]bool)
+	for _, service := range storedServices {
+		serviceNames[service.ID], knownServices[service.Name] = service.Name, true
+	}
+	for _, policy := range storedPolicies {
+		policyNames[policy.ID], knownPolicies[policy.Name] = policy.Name, true
+	}
+	desiredServices := make(map[string]bool)
+	for _, service := range file.Services {
+		desiredServices[service.Name], knownServices[service.Name] = true, true
+	}
+	for _, policy := range file.Policies {
+		knownPolicies[policy.Name] = true
+	}
+
+	// The stored grants by name, with their policy and schedule by name too.
+	storedByName := make(map[string][]Grant)
+	storedIDs := make(map[string][]int64)
+	for _, grant := range stored {
+		existing := Grant{
+			Service:  serviceNames[grant.ServiceID],
+			Group:    grant.Group,
+			Policy:   policyNames[grant.PolicyID],
+			Schedule: storedScheduleName(scheduleNames, grant.ScheduleID),
+		}
+		if existing.Service == "" {
+			continue
+		}
+		if grant.PolicyID != 0 && existing.Policy == "" {
+			existing.Policy = fmt.Sprintf("(missing policy id %d)", grant.PolicyID)
+		}
+		storedByName[existing.name()] = append(storedByName[existing.name()], existing)
+		storedIDs[existing.name()] = append(storedIDs[existing.name()], grant.ID)
+	}
+
+	var changes []Change
+	desiredNames := make(map[string]bool)
+	for _, desired := range file.Grants {
+		name := desired.name()
+		desiredNames[name] = true
+		switch {
+		case !knownServices[desired.Service]:
+			return nil, fmt.Errorf("grant %q is for service %q, which doesn't exist", name, desired.Service)
+		case desired.Policy != "" && !knownPolicies[desired.Policy]:
+			return nil, fmt.Errorf("grant %q uses policy %q, which doesn't exist", name, desired.Policy)
+		case desired.Schedule != "" && !knownSchedules[desired.Schedule]:
+			return nil, fmt.Errorf("grant %q uses schedule %q, which doesn't exist", name, desired.Schedule)
+		}
+		existing := storedByName[name]
+		if len(existing) == 1 && existing[0] == desired {
+			continue
+		}
+		grant, replaced := desired, storedIDs[name]
+		change := Change{
+			Action:   ActionCreate,
+			Resource: ResourceGrant,
+			Name:     name,
+			apply: func(d *drawbridge.Drawbridge, actor string) error {
+				for _, id := range replaced {
+					err := d.DB.DeleteGrant(id)
+					if err != nil {
+						return err
+					}
+					d.RecordAdminAction(sinks.TypeGrantDeleted, actor, map[string]string{"grant_id": strconv.FormatInt(id, 10)})
+				}
+				// The service, policy and schedule may have been created earlier in the same plan.
+				service, err := serviceID(d, grant.Service)
+				if err != nil {
+					return err
+				}
+				policy, err := policyID(d, grant.Policy)
+				if err != nil {
+					return err
+				}
+				schedule, err := scheduleID(d, grant.Schedule)
+				if err != nil {
+					return err
+				}
+				created, err := d.SaveGrant(authorization.Grant{ServiceID: service, Group: grant.Group, PolicyID: policy, ScheduleID: schedule})
+				if err != nil {
+					return err
+				}
+				d.RecordAdminAction(sinks.TypeGrantCreated, actor, map[string]string{"grant_id": strconv.FormatInt(created.ID, 10), "service_id": strconv.FormatInt(service, 10), "group": created.Group})
+				return nil
+			},
+		}
+		if len(existing) == 0 {
+			if desired.Policy != "" {
+				change.Fields = append(change.Fields, FieldChange{Field: "policy", To: strconv.Quote(desired.Policy)})
+			}
+			if desired.Schedule != "" {
+				change.Fields = append(change.Fields, FieldChange{Field: "schedule", To: strconv.Quote(desired.Schedule)})
+			}
+		} else {
+			// Repeated grants made in the Drawbridge Dashboard are replaced by the one in the file.
+			change.Action = ActionUpdate
+			if existing[0].Policy != desired.Policy || len(existing) > 1 {
+				change.Fields = append(change.Fields, FieldChange{Field: "policy", From: strconv.Quote(existing[0].Policy), To: strconv.Quote(desired.Policy)})
+			}
+			if existing[0].Schedule != desired.Schedule || len(existing) > 1 {
+				change.Fields = append(change.Fields, FieldChange{Field: "schedule", From: strconv.Quote(existing[0].Schedule), To: strconv.Quote(desired.Schedule)})
+			}
+		}
+		changes = append(changes, change)
+	}
+
+	if !file.Authoritative {
+		return changes, nil
+	}
+	for _, grant := range stored {
+		name := (&Grant{Service: serviceNames[grant.ServiceID], Group: grant.Group}).name()
+		// Deleting the service deletes its grants.
+		if desiredNames[name] || !desiredServices[serviceNames[grant.ServiceID]] {
+			continue
+		}
+		id := grant.ID
+		changes = append(changes, Change{
+			Action:   ActionDelete,
+			Resource: ResourceGrant,
+			Name:     name,
+			apply: func(d *drawbridge.Drawbridge, actor string) error {
+				err := d.DB.DeleteGrant(id)
+				if err != nil {
+					return err
+				}
+				d.RecordAdminAction(sinks.TypeGrantDeleted, actor, map[string]string{"grant_id": strconv.FormatInt(id, 10)})
+				return nil
+			},
+		})
+	}
+	return changes, nil
+}
+
+// Returns the id of the Protected Service with the name.
+func serviceID(d *drawbridge.Drawbridge, name string) (int64, error) {
+	protectedServices, err := d.DB.GetAllServices()
+	if err != nil {
+		return 0, err
+	}
+	for _, service := range protectedServices {
+		if service.Name == name {
+			return service.ID, nil
+		}
+	}
+	return 0, fmt.Errorf("Protected Service %q doesn't exist", name)
+}
@@ -1,5 +1,10 @@
 package emissary
 
+import (
+	"imdawon/drawbridge/cmd/drawbridge/emissary/authorization"
+	"time"
+)
+
 type Event struct {
 	ID             string
 	DeviceID       string
@@ -7,5 +12,86 @@ type Event struct {
 	Type           string
 	TargetService  string
 	ConnectionType string
-	Timestamp      string
+	// When the connection was made, in UTC. Zero for a device that hasn't connected yet.
+	Timestamp time.Time
+	// Why Drawbridge denied or ended the connection, e.g. a closed schedule. Empty for other events.
+	Reason string
+	// Every check Drawbridge made before denying the connection. Empty for other events.
+	Trace []authorization.TraceStep
+	// Where ConnectionIP was, from the GeoIP databases. Empty or 0 when unknown.
+	Country string
+	ASN     uint
+}
+
+// Events for one device and Protected Service aggregated over an hour or a day.
+type EventRollup struct {
+	DeviceID      string
+	TargetService string
+	// The start of the hour or day, in UTC.
+	Bucket      time.Time
+	Connections int64
+	// Bytes proxied from the Emissary client to the Protected Service.
+	BytesIn int64
+	// Bytes proxied from the Protected Service to the Emissary client.
+	BytesOut  int64
+	UniqueIPs int64
+	// The most recent event in the bucket.
+	LastSeen time.Time
+	LastIP   string
+	LastType string
+}
+
+// Where a device connected from and which Protected Services it asked for, from the anomaly detector's baseline of
+// it, which outlives its raw events.
+type DeviceHistory struct {
+	// When the device first connected, or zero if it hadn't.
+	FirstSeen time.Time
+	// ISO 3166-1 alpha-2 country codes, sorted. Connections GeoIP couldn't place are left out.
+	Countries []string
+	// The padded ids of the Protected Services, sorted, e.g. 004.
+	Services []string
+}
+
+// The columns events can be sorted by. Events with the same value are ordered by timestamp, then id.
+type EventSort string
+
+const (
+	EventSortTimestamp     EventSort = "timestamp"
+	EventSortDevice        EventSort = "device"
+	EventSortType          EventSort = "type"
+	EventSortTargetService EventSort = "service"
+	EventSortIP            EventSort = "ip"
+)
+
+var EventSorts = []EventSort{EventSortTimestamp, EventSortDevice, EventSortType, EventSortTargetService, EventSortIP}
+
+// Filters for searching raw events. Empty fields match every event.
+type EventQuery struct {
+	DeviceID      string
+	TargetService string
+	Type          string
+	// Matches the connection IP with or without its port.
+	IP string
+	// Events at or after Since and before Until.
+	Since time.Time
+	Until time.Time
+	// Defaults to EventSortTimestamp.
+	Sort       EventSort
+	Descending bool
+	// The NextCursor of the previous page, or empty for the first page.
+	Cursor string
+	// Defaults to DefaultEventQueryLimit and is capped at MaxEventQueryLimit.
+	Limit int
+}
+
+const (
+	DefaultEventQueryLimit = 50
+	MaxEventQueryLimit     = 500
+)
+
+// One page of events matching an EventQuery.
+type EventPage struct {
+	Events []Event
+	// Pass as EventQuery.Cursor to get the next page. Empty on the last page.
+	NextCursor string
 }
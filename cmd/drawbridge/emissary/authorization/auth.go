@@ -1,88 +1,507 @@
+// Package authorization decides whether an Emissary device may connect to a Protected Service.
+//
+// A Policy is a group of rules over attributes of the device and its connection, e.g. the IP it connects from.
+// Groups match when all or any of their conditions and nested groups match, so policies can combine AND and OR.
+// A condition is either an attribute compared to values with an operator, or an expression in the language of
+// the expression package, e.g. connection.ip in cidr("10.0.0.0/8") && now.hour >= 8.
+// An attribute Drawbridge doesn't know for a connection fails every condition on it, so policies fail closed.
 package authorization
 
 import (
-	"cmp"
+	"errors"
 	"fmt"
-	"log/slog"
-	"net"
-	"reflect"
+	"imdawon/drawbridge/cmd/drawbridge/emissary/authorization/expression"
+	"net/netip"
+	"regexp"
+	"slices"
+	"strings"
 )
 
-// The policy that Drawbridge will use to evaluate if it will allow access to an Emissary client.
+// The policy Drawbridge evaluates before letting an Emissary device connect to the Protected Services it is attached to.
 type Policy struct {
-	ID           int64
-	Name         string       `schema:"policy-name" json:"policy-name"`
-	Description  string       `schema:"policy-description" json:"policy-description"`
-	Requirements Requirements `schema:"policy-requirements" json:"policy-requirements"`
+	ID          int64  `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Rules       Group  `json:"rules"`
+	// The schedule devices may connect during, or 0 for any time.
+	ScheduleID int64 `json:"schedule_id,omitempty"`
 }
 
-// The actual required values of each field reported by the Emissary client.
-type Requirements struct {
-	WANIP        net.IP     `json:"wan-ip"`
-	OSType       string     `json:"os-type"`
-	SerialNumber string     `json:"serial-number"`
-	Operators    []Operator `json:"operators"`
+type Match string
+
+const (
+	MatchAll Match = "all"
+	MatchAny Match = "any"
+)
+
+// Matches when all, or any, of its conditions and groups match.
+type Group struct {
+	Match      Match       `json:"match" yaml:"match" toml:"match"`
+	Conditions []Condition `json:"conditions,omitempty" yaml:"conditions" toml:"conditions"`
+	Groups     []Group     `json:"groups,omitempty" yaml:"groups" toml:"groups"`
 }
 
-// An EmissaryRequest is all of the characteristics collected about a machine running the Emissary client.
-// If an EmissaryRequest passes the Requirements of an EmissaryRequest Policy, Drawbridge allow it to access protected resources.
-type EmissaryRequest struct {
-	WANIP        net.IP `json:"wan-ip"`
-	OSType       string `json:"os-type"`
-	SerialNumber string `json:"serial-number"`
+// Compares one attribute of the connection to the values set by the Drawbridge admin, e.g. connection.ip in_cidr 10.0.0.0/8,
+// or evaluates an expression.
+type Condition struct {
+	Attribute string   `json:"attribute,omitempty" yaml:"attribute" toml:"attribute"`
+	Operator  Operator `json:"operator,omitempty" yaml:"operator" toml:"operator"`
+	// Used by the operators that compare against one value.
+	Value string `json:"value,omitempty" yaml:"value" toml:"value"`
+	// Used by in, not_in, in_cidr and not_in_cidr. The condition matches when any of them does.
+	Values []string `json:"values,omitempty" yaml:"values" toml:"values"`
+	// Set instead of an attribute and operator, e.g. device.name.startsWith("Work ") && now.weekday != "sunday".
+	Expression string `json:"expression,omitempty" yaml:"expression" toml:"expression"`
 }
 
-var ValidateEmissaryRequest = EmissaryRequest{
-	WANIP:        net.IPv4(8, 8, 8, 8),
-	OSType:       "Windows",
-	SerialNumber: "00000",
+type Operator string
+
+const (
+	OperatorEquals     Operator = "eq"
+	OperatorNotEquals  Operator = "neq"
+	OperatorIn         Operator = "in"
+	OperatorNotIn      Operator = "not_in"
+	OperatorMatches    Operator = "matches"
+	OperatorNotMatches Operator = "not_matches"
+	OperatorInCIDR     Operator = "in_cidr"
+	OperatorNotInCIDR  Operator = "not_in_cidr"
+	OperatorSemverEq   Operator = "semver_eq"
+	OperatorSemverGt   Operator = "semver_gt"
+	OperatorSemverGte  Operator = "semver_gte"
+	OperatorSemverLt   Operator = "semver_lt"
+	OperatorSemverLte  Operator = "semver_lte"
+)
+
+var Operators = []Operator{
+	OperatorEquals, OperatorNotEquals, OperatorIn, OperatorNotIn, OperatorMatches, OperatorNotMatches,
+	OperatorInCIDR, OperatorNotInCIDR, OperatorSemverEq, OperatorSemverGt, OperatorSemverGte, OperatorSemverLt, OperatorSemverLte,
 }
 
-var TestPolicy = Policy{
-	Name:        "Allow Personal Machine",
-	Description: "Default policy stuff.",
-	Requirements: Requirements{
-		WANIP:        net.IPv4(8, 8, 8, 8),
-		OSType:       "Windows",
-		SerialNumber: "00000",
-		Operators:    []Operator{"=", "=", "="},
-	},
+// The attributes Drawbridge knows about an Emissary connection.
+const (
+	AttributeDeviceID     = "device.id"
+	AttributeDeviceName   = "device.name"
+	AttributeConnectionIP = "connection.ip"
+	AttributeServiceID    = "service.id"
+	AttributeServiceName  = "service.name"
+	// Comma separated, e.g. family,servers.
+	AttributeDeviceGroups = "device.groups"
+	AttributeDeviceTags   = "device.tags"
+	// From the device's latest posture report.
+	AttributeDeviceOS              = "device.os"
+	AttributeDeviceOSVersion       = "device.os_version"
+	AttributeDeviceHostname        = "device.hostname"
+	AttributeDeviceDiskEncrypted   = "device.disk_encrypted"
+	AttributeDeviceFirewallEnabled = "device.firewall_enabled"
+	// The time Drawbridge evaluated the policy, in its local time zone. The weekday is lowercase, e.g. monday.
+	AttributeNowHour    = "now.hour"
+	AttributeNowMinute  = "now.minute"
+	AttributeNowWeekday = "now.weekday"
+)
+
+// The attributes and their types in expressions.
+var Variables = []expression.Variable{
+	{Name: AttributeDeviceID, Type: expression.TypeString},
+	{Name: AttributeDeviceName, Type: expression.TypeString},
+	{Name: AttributeConnectionIP, Type: expression.TypeIP},
+	{Name: AttributeServiceID, Type: expression.TypeInt},
+	{Name: AttributeServiceName, Type: expression.TypeString},
+	{Name: AttributeDeviceGroups, Type: expression.ListOf(expression.TypeString)},
+	{Name: AttributeDeviceTags, Type: expression.ListOf(expression.TypeString)},
+	{Name: AttributeDeviceOS, Type: expression.TypeString},
+	{Name: AttributeDeviceOSVersion, Type: expression.TypeVersion},
+	{Name: AttributeDeviceHostname, Type: expression.TypeString},
+	{Name: AttributeDeviceDiskEncrypted, Type: expression.TypeBool},
+	{Name: AttributeDeviceFirewallEnabled, Type: expression.TypeBool},
+	{Name: AttributeNowHour, Type: expression.TypeInt},
+	{Name: AttributeNowMinute, Type: expression.TypeInt},
+	{Name: AttributeNowWeekday, Type: expression.TypeString},
 }
 
-// The Operator is used to evaluate if an Authorization Request field is greater than, is, is not, than an Authorization Requirement value.
-type Operator string
+// The attributes that come from a posture report. Policies using them deny devices without a recent report.
+var PostureAttributes = []string{AttributeDeviceOS, AttributeDeviceOSVersion, AttributeDeviceHostname, AttributeDeviceDiskEncrypted, AttributeDeviceFirewallEnabled}
+
+// Conditions may only use these attributes, so a typo in a policy is an error instead of a condition that never matches.
+var KnownAttributes = attributeNames()
+
+func attributeNames() []string {
+	names := make([]string, len(Variables))
+	for i, variable := range Variables {
+		names[i] = variable.Name
+	}
+	return names
+}
+
+// What Drawbridge knows about an Emissary connection, keyed by attribute name.
+type Attributes map[string]string
 
-func (arv Policy) ClientIsAuthorized(clientAuthorization EmissaryRequest) bool {
-	authorizationPolicyRequirementsValues := reflect.ValueOf(arv.Requirements)
-	clientAuthorizationValues := reflect.ValueOf(clientAuthorization)
-	comparisonOperatorValues := arv.Requirements.Operators
-	for i := 0; i < clientAuthorizationValues.NumField(); i++ {
-		policyValue := authorizationPolicyRequirementsValues.Field(i)
-		clientField := clientAuthorizationValues.Field(i)
-		comparisonOperator := comparisonOperatorValues[i]
-		if !clientAuthorizationFieldMatchesPolicy(clientField.String(), string(comparisonOperator), policyValue.String()) {
-			return false
-		}
-		slog.Debug(fmt.Sprintf("current eval: %s %s %s\n", clientField, comparisonOperator, policyValue))
-	}
-	return true
-}
-
-func clientAuthorizationFieldMatchesPolicy[T cmp.Ordered, V string](fieldValue T, operator V, policyValue T) bool {
-	switch operator {
-	case "=":
-		return fieldValue == policyValue
-	case "!=":
-		return fieldValue != policyValue
-	case ">":
-		return fieldValue > policyValue
-	case ">=":
-		return fieldValue >= policyValue
-	case "<":
-		return fieldValue < policyValue
-	case "<=":
-		return fieldValue <= policyValue
-	default:
-		return false
+// The outcome of evaluating a policy.
+type Decision struct {
+	Allowed bool `json:"allowed"`
+	// Why the policy denied the connection, e.g. `policy "Office": connection.ip in_cidr [10.0.0.0/8]: got 192.0.2.7:50000`.
+	Reason string `json:"reason,omitempty"`
+	// Every check made to reach the decision, in the order they were made, including the ones that passed.
+	Trace []TraceStep `json:"trace"`
+	// Set when the Protected Service requires step-up and a fresh TOTP code from the device would let it in.
+	NeedsStepUp bool `json:"needs_step_up,omitempty"`
+}
+
+// One check made while deciding whether to let a device connect, e.g. one condition of a policy.
+type TraceStep struct {
+	// What was checked, e.g. `schedule "Office hours"` or `device.os == "macos"`.
+	Check  string `json:"check"`
+	Passed bool   `json:"passed"`
+	// Why the check failed, or what it saw when it passed. Empty when there is nothing to add.
+	Detail string `json:"detail,omitempty"`
+	// How far the check is nested under the ones before it, e.g. the conditions of a policy are one deeper than the policy.
+	Depth int `json:"depth,omitempty"`
+}
+
+// Returns the steps nested depth levels deeper, to add them under another step.
+func Nest(steps []TraceStep, depth int) []TraceStep {
+	nested := make([]TraceStep, len(steps))
+	for i, step := range steps {
+		step.Depth += depth
+		nested[i] = step
+	}
+	return nested
+}
+
+// Checks the policy is complete and every condition can be evaluated.
+func (p *Policy) Validate() error {
+	if strings.TrimSpace(p.Name) == "" {
+		return errors.New("a policy needs a name")
+	}
+	if len(p.Rules.Conditions) == 0 && len(p.Rules.Groups) == 0 {
+		return errors.New("a policy needs at least one rule")
 	}
+	return p.Rules.Validate()
+}
+
+func (g *Group) Validate() error {
+	if g.Match != MatchAll && g.Match != MatchAny {
+		return fmt.Errorf("a group must match %q or %q, not %q", MatchAll, MatchAny, g.Match)
+	}
+	if len(g.Conditions) == 0 && len(g.Groups) == 0 {
+		return errors.New("a group needs at least one condition or group")
+	}
+	for _, condition := range g.Conditions {
+		err := condition.Validate()
+		if err != nil {
+			return err
+		}
+	}
+	for _, group := range g.Groups {
+		err := group.Validate()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Condition) Validate() error {
+	if c.Expression != "" {
+		if c.Attribute != "" || c.Operator != "" || c.Value != "" || len(c.Values) > 0 {
+			return errors.New("a condition with an expression can't also have an attribute, operator or values")
+		}
+		_, err := compileExpression(c.Expression)
+		if err != nil {
+			return fmt.Errorf("invalid expression at %w", err)
+		}
+		return nil
+	}
+	if !slices.Contains(KnownAttributes, c.Attribute) {
+		return fmt.Errorf("unknown attribute %q, expected one of %s", c.Attribute, strings.Join(KnownAttributes, ", "))
+	}
+	if !slices.Contains(Operators, c.Operator) {
+		return fmt.Errorf("unknown operator %q in the condition on %s", c.Operator, c.Attribute)
+	}
+	values := c.values()
+	if len(values) == 0 {
+		return fmt.Errorf("the %s condition on %s needs a value", c.Operator, c.Attribute)
+	}
+	if c.Operator.takesList() == (c.Value != "") {
+		if c.Operator.takesList() {
+			return fmt.Errorf("the %s condition on %s takes a list of values", c.Operator, c.Attribute)
+		}
+		return fmt.Errorf("the %s condition on %s takes a single value", c.Operator, c.Attribute)
+	}
+	for _, value := range values {
+		var err error
+		switch c.Operator {
+		case OperatorMatches, OperatorNotMatches:
+			_, err = compileRegexp(value)
+		case OperatorInCIDR, OperatorNotInCIDR:
+			_, err = netip.ParsePrefix(value)
+		case OperatorSemverEq, OperatorSemverGt, OperatorSemverGte, OperatorSemverLt, OperatorSemverLte:
+			_, err = expression.ParseVersion(value)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid value in the %s condition on %s: %w", c.Operator, c.Attribute, err)
+		}
+	}
+	return nil
+}
+
+func (o Operator) takesList() bool {
+	switch o {
+	case OperatorIn, OperatorNotIn, OperatorInCIDR, OperatorNotInCIDR:
+		return true
+	}
+	return false
+}
+
+func (c *Condition) values() []string {
+	if c.Operator.takesList() {
+		return c.Values
+	}
+	if c.Value == "" {
+		return nil
+	}
+	return []string{c.Value}
+}
+
+func (c *Condition) String() string {
+	if c.Expression != "" {
+		return c.Expression
+	}
+	if c.Operator.takesList() {
+		return fmt.Sprintf("%s %s [%s]", c.Attribute, c.Operator, strings.Join(c.Values, ", "))
+	}
+	return fmt.Sprintf("%s %s %s", c.Attribute, c.Operator, c.Value)
+}
+
+// Returns whether any condition in the policy refers to an attribute from a posture report.
+func (p *Policy) UsesPosture() bool {
+	return p.Rules.usesPosture()
+}
+
+func (g *Group) usesPosture() bool {
+	for _, condition := range g.Conditions {
+		attributes := []string{condition.Attribute}
+		if condition.Expression != "" {
+			program, err := compileExpression(condition.Expression)
+			if err != nil {
+				continue
+			}
+			attributes = program.Variables()
+		}
+		for _, attribute := range attributes {
+			if slices.Contains(PostureAttributes, attribute) {
+				return true
+			}
+		}
+	}
+	return slices.ContainsFunc(g.Groups, func(group Group) bool { return group.usesPosture() })
+}
+
+// Evaluates the policy against a connection. A policy that doesn't validate denies every connection.
+func (p *Policy) Evaluate(attributes Attributes) Decision {
+	err := p.Validate()
+	if err != nil {
+		return Decision{Reason: fmt.Sprintf("policy %q is invalid: %s", p.Name, err)}
+	}
+	var trace []TraceStep
+	matched, reason := p.Rules.evaluate(attributes, &trace, 0)
+	if !matched {
+		return Decision{Reason: fmt.Sprintf("policy %q: %s", p.Name, reason), Trace: trace}
+	}
+	return Decision{Allowed: true, Trace: trace}
+}
+
+// Returns whether the group matched and, when it didn't, why. Every condition and nested group is evaluated, even
+// once the outcome is known, so the trace shows all of them.
+func (g *Group) evaluate(attributes Attributes, trace *[]TraceStep, depth int) (bool, string) {
+	var reasons []string
+	matchedAny := false
+	for _, condition := range g.Conditions {
+		matched, reason := condition.evaluate(attributes)
+		*trace = append(*trace, TraceStep{Check: condition.String(), Passed: matched, Detail: strings.TrimPrefix(reason, condition.String()+": "), Depth: depth})
+		matchedAny = matchedAny || matched
+		if !matched {
+			reasons = append(reasons, reason)
+		}
+	}
+	for _, group := range g.Groups {
+		// The group's own step goes before its conditions, once it is known whether it matched.
+		step := len(*trace)
+		*trace = append(*trace, TraceStep{Check: fmt.Sprintf("%s of", group.Match), Depth: depth})
+		matched, reason := group.evaluate(attributes, trace, depth+1)
+		(*trace)[step].Passed = matched
+		matchedAny = matchedAny || matched
+		if !matched {
+			reasons = append(reasons, reason)
+		}
+	}
+	if g.Match == MatchAny {
+		if matchedAny {
+			return true, ""
+		}
+		return false, "none matched: " + strings.Join(reasons, "; ")
+	}
+	if len(reasons) > 0 {
+		return false, reasons[0]
+	}
+	return true, ""
+}
+
+func (c *Condition) evaluate(attributes Attributes) (bool, string) {
+	if c.Expression != "" {
+		return c.evaluateExpression(attributes)
+	}
+	if isListAttribute(c.Attribute) {
+		return c.evaluateList(attributes)
+	}
+	actual, known := attributes[c.Attribute]
+	if !known || actual == "" {
+		return false, fmt.Sprintf("%s: %s is unknown", c, c.Attribute)
+	}
+	matched, err := c.matches(actual)
+	if err != nil {
+		return false, fmt.Sprintf("%s: %s", c, err)
+	}
+	if !matched {
+		return false, fmt.Sprintf("%s: got %s", c, actual)
+	}
+	return true, ""
+}
+
+// A condition on a list attribute, e.g. device.groups in [family], matches when any of the list's elements does.
+// Negative operators, e.g. not_in, match when every element does, so they match an empty list.
+func (c *Condition) evaluateList(attributes Attributes) (bool, string) {
+	actual, known := attributes[c.Attribute]
+	if !known {
+		return false, fmt.Sprintf("%s: %s is unknown", c, c.Attribute)
+	}
+	var elements []string
+	for _, element := range strings.Split(actual, ",") {
+		if element = strings.TrimSpace(element); element != "" {
+			elements = append(elements, element)
+		}
+	}
+	negative := c.Operator.negative()
+	for _, element := range elements {
+		matched, err := c.matches(element)
+		if err != nil {
+			return false, fmt.Sprintf("%s: %s", c, err)
+		}
+		if matched != negative {
+			if negative {
+				return false, fmt.Sprintf("%s: got %s", c, actual)
+			}
+			return true, ""
+		}
+	}
+	if negative {
+		return true, ""
+	}
+	if len(elements) == 0 {
+		return false, fmt.Sprintf("%s: %s is empty", c, c.Attribute)
+	}
+	return false, fmt.Sprintf("%s: got %s", c, actual)
+}
+
+func (o Operator) negative() bool {
+	switch o {
+	case OperatorNotEquals, OperatorNotIn, OperatorNotMatches, OperatorNotInCIDR:
+		return true
+	}
+	return false
+}
+
+func isListAttribute(name string) bool {
+	return slices.ContainsFunc(Variables, func(variable expression.Variable) bool {
+		return variable.Name == name && strings.HasPrefix(string(variable.Type), "list<")
+	})
+}
+
+func (c *Condition) matches(actual string) (bool, error) {
+	switch c.Operator {
+	case OperatorEquals:
+		return actual == c.Value, nil
+	case OperatorNotEquals:
+		return actual != c.Value, nil
+	case OperatorIn:
+		return slices.Contains(c.Values, actual), nil
+	case OperatorNotIn:
+		return !slices.Contains(c.Values, actual), nil
+	case OperatorMatches, OperatorNotMatches:
+		expression, err := compileRegexp(c.Value)
+		if err != nil {
+			return false, err
+		}
+		return expression.MatchString(actual) == (c.Operator == OperatorMatches), nil
+	case OperatorInCIDR, OperatorNotInCIDR:
+		address, err := expression.ParseAddress(actual)
+		if err != nil {
+			return false, err
+		}
+		inside := false
+		for _, value := range c.Values {
+			prefix, err := netip.ParsePrefix(value)
+			if err != nil {
+				return false, err
+			}
+			inside = inside || prefix.Contains(address)
+		}
+		return inside == (c.Operator == OperatorInCIDR), nil
+	case OperatorSemverEq, OperatorSemverGt, OperatorSemverGte, OperatorSemverLt, OperatorSemverLte:
+		actualVersion, err := expression.ParseVersion(actual)
+		if err != nil {
+			return false, err
+		}
+		wantVersion, err := expression.ParseVersion(c.Value)
+		if err != nil {
+			return false, err
+		}
+		comparison := actualVersion.Compare(wantVersion)
+		switch c.Operator {
+		case OperatorSemverEq:
+			return comparison == 0, nil
+		case OperatorSemverGt:
+			return comparison > 0, nil
+		case OperatorSemverGte:
+			return comparison >= 0, nil
+		case OperatorSemverLt:
+			return comparison < 0, nil
+		default:
+			return comparison <= 0, nil
+		}
+	}
+	return false, fmt.Errorf("unknown operator %q", c.Operator)
+}
+
+func (c *Condition) evaluateExpression(attributes Attributes) (bool, string) {
+	program, err := compileExpression(c.Expression)
+	if err != nil {
+		return false, fmt.Sprintf("%s: %s", c, err)
+	}
+	matched, err := program.Eval(func(name string) (string, bool) {
+		value, ok := attributes[name]
+		return value, ok
+	})
+	if err != nil {
+		return false, fmt.Sprintf("%s: %s", c, err)
+	}
+	if !matched {
+		return false, fmt.Sprintf("%s: false", c)
+	}
+	return true, ""
+}
+
+// Expressions are compiled when a policy is saved and again on every connection, so each is only compiled once.
+var expressionCache = newLRUCache[*expression.Program](compiledCacheSize)
+
+func compileExpression(source string) (*expression.Program, error) {
+	return expressionCache.get(source, func(source string) (*expression.Program, error) {
+		return expression.Compile(source, Variables)
+	})
+}
+
+// Policies are evaluated on every connection, so each regular expression is only compiled once.
+var regexpCache = newLRUCache[*regexp.Regexp](compiledCacheSize)
+
+func compileRegexp(expression string) (*regexp.Regexp, error) {
+	return regexpCache.get(expression, regexp.Compile)
 }
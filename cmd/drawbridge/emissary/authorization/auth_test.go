@@ -1,82 +1,290 @@
 package authorization
 
 import (
-	"net"
+	"fmt"
+	"strings"
 	"testing"
 )
 
-func TestClientIsAuthorized(t *testing.T) {
-	arv := TestPolicy
-	testAuthorizationRequest := ValidateEmissaryRequest
-	got := arv.ClientIsAuthorized(testAuthorizationRequest)
-	if !got {
-		t.Errorf("client is authorized %t; wanted %t", got, true)
+var officeAttributes = Attributes{
+	AttributeDeviceID:     "device-1",
+	AttributeDeviceName:   "Brave Otter",
+	AttributeConnectionIP: "10.1.2.3:50000",
+	AttributeServiceName:  "SSH",
+}
+
+func TestConditionOperators(t *testing.T) {
+	tests := []struct {
+		condition Condition
+		want      bool
+	}{
+		{Condition{Attribute: AttributeDeviceName, Operator: OperatorEquals, Value: "Brave Otter"}, true},
+		{Condition{Attribute: AttributeDeviceName, Operator: OperatorNotEquals, Value: "Brave Otter"}, false},
+		{Condition{Attribute: AttributeDeviceID, Operator: OperatorIn, Values: []string{"device-2", "device-1"}}, true},
+		{Condition{Attribute: AttributeDeviceID, Operator: OperatorNotIn, Values: []string{"device-2", "device-1"}}, false},
+		{Condition{Attribute: AttributeDeviceName, Operator: OperatorMatches, Value: "^Brave "}, true},
+		{Condition{Attribute: AttributeDeviceName, Operator: OperatorNotMatches, Value: "Otter$"}, false},
+		{Condition{Attribute: AttributeConnectionIP, Operator: OperatorInCIDR, Values: []string{"192.168.0.0/16", "10.0.0.0/8"}}, true},
+		{Condition{Attribute: AttributeConnectionIP, Operator: OperatorInCIDR, Values: []string{"10.2.0.0/16"}}, false},
+		{Condition{Attribute: AttributeConnectionIP, Operator: OperatorNotInCIDR, Values: []string{"10.2.0.0/16"}}, true},
+	}
+	for _, test := range tests {
+		if got, _ := test.condition.evaluate(officeAttributes); got != test.want {
+			t.Errorf("%s: got %t, wanted %t", test.condition.String(), got, test.want)
+		}
 	}
 }
 
-// TestClientIsAuthorizedDenied tests authorization when request doesn't match policy
-func TestClientIsAuthorizedDenied(t *testing.T) {
-	// Test policy defined but not used in this test
-	
-	// Create a request that doesn't match policy requirements
-	mismatchedRequest := EmissaryRequest{
-		WANIP:        net.IPv4(1, 1, 1, 1), // Different IP
-		OSType:       "Windows",            // Same OS
-		SerialNumber: "00000",              // Same Serial
-	}
-	
-	// Create a policy with different IP requirement
-	customPolicy := Policy{
-		Name:        "Custom Policy",
-		Description: "Policy that should reject this request",
-		Requirements: Requirements{
-			WANIP:        net.IPv4(9, 9, 9, 9), // Different from request
-			OSType:       "Windows",
-			SerialNumber: "00000",
-			Operators:    []Operator{"!=", "=", "="},
-		},
+func TestListAttributes(t *testing.T) {
+	attributes := Attributes{AttributeDeviceGroups: "family,servers", AttributeDeviceTags: ""}
+	tests := []struct {
+		condition Condition
+		want      bool
+	}{
+		{Condition{Attribute: AttributeDeviceGroups, Operator: OperatorEquals, Value: "servers"}, true},
+		{Condition{Attribute: AttributeDeviceGroups, Operator: OperatorIn, Values: []string{"friends", "family"}}, true},
+		{Condition{Attribute: AttributeDeviceGroups, Operator: OperatorIn, Values: []string{"friends"}}, false},
+		{Condition{Attribute: AttributeDeviceGroups, Operator: OperatorNotIn, Values: []string{"friends"}}, true},
+		{Condition{Attribute: AttributeDeviceGroups, Operator: OperatorNotIn, Values: []string{"family"}}, false},
+		{Condition{Attribute: AttributeDeviceGroups, Operator: OperatorMatches, Value: "^serv"}, true},
+		// A device without tags is in none of them.
+		{Condition{Attribute: AttributeDeviceTags, Operator: OperatorIn, Values: []string{"laptop"}}, false},
+		{Condition{Attribute: AttributeDeviceTags, Operator: OperatorNotIn, Values: []string{"laptop"}}, true},
+		{Condition{Expression: `"servers" in device.groups && !("laptop" in device.tags)`}, true},
 	}
-	
-	// Should be denied
-	got := customPolicy.ClientIsAuthorized(mismatchedRequest)
-	if got {
-		t.Errorf("client authorization: got %t; wanted %t", got, false)
+	for _, test := range tests {
+		if got, reason := test.condition.evaluate(attributes); got != test.want {
+			t.Errorf("%s: got %t, wanted %t: %s", test.condition.String(), got, test.want, reason)
+		}
+	}
+	if got, _ := (&Condition{Attribute: AttributeDeviceGroups, Operator: OperatorNotIn, Values: []string{"family"}}).evaluate(Attributes{}); got {
+		t.Errorf("a condition on unknown groups should fail closed")
+	}
+}
+
+func TestIPv4MappedAddressesMatchIPv4Ranges(t *testing.T) {
+	condition := Condition{Attribute: AttributeConnectionIP, Operator: OperatorInCIDR, Values: []string{"10.0.0.0/8"}}
+	if matched, reason := condition.evaluate(Attributes{AttributeConnectionIP: "[::ffff:10.1.2.3]:50000"}); !matched {
+		t.Errorf("expected an IPv4-mapped address to be in an IPv4 range: %s", reason)
 	}
 }
 
-// TestOperatorComparisons tests the different operator comparisons
-func TestOperatorComparisons(t *testing.T) {
+func TestSemverComparisons(t *testing.T) {
 	tests := []struct {
-		name     string
-		operator string
-		a        string
-		b        string
-		expected bool
+		actual   string
+		operator Operator
+		value    string
+		want     bool
 	}{
-		{"Equal true", "=", "test", "test", true},
-		{"Equal false", "=", "test", "different", false},
-		{"Not equal true", "!=", "test", "different", true},
-		{"Not equal false", "!=", "test", "test", false},
-		{"Greater than true", ">", "b", "a", true},
-		{"Greater than false", ">", "a", "b", false},
-		{"Less than true", "<", "a", "b", true},
-		{"Less than false", "<", "b", "a", false},
-		{"Greater than or equal true (equal)", ">=", "a", "a", true},
-		{"Greater than or equal true (greater)", ">=", "b", "a", true},
-		{"Greater than or equal false", ">=", "a", "b", false},
-		{"Less than or equal true (equal)", "<=", "a", "a", true},
-		{"Less than or equal true (less)", "<=", "a", "b", true},
-		{"Less than or equal false", "<=", "b", "a", false},
-		{"Invalid operator", "invalid", "a", "b", false},
-	}
-	
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			result := clientAuthorizationFieldMatchesPolicy(tt.a, tt.operator, tt.b)
-			if result != tt.expected {
-				t.Errorf("clientAuthorizationFieldMatchesPolicy(%s, %s, %s) = %v; want %v", 
-					tt.a, tt.operator, tt.b, result, tt.expected)
-			}
-		})
+		{"1.2.3", OperatorSemverEq, "v1.2.3", true},
+		{"1.2.3+build.5", OperatorSemverEq, "1.2.3", true},
+		{"14.2", OperatorSemverGte, "14.2.0", true},
+		{"1.10.0", OperatorSemverGt, "1.9.0", true},
+		{"1.0.0-beta", OperatorSemverLt, "1.0.0", true},
+		{"1.0.0-alpha.2", OperatorSemverLt, "1.0.0-alpha.10", true},
+		{"1.0.0-alpha", OperatorSemverLt, "1.0.0-alpha.1", true},
+		{"1.0.0-1", OperatorSemverLt, "1.0.0-alpha", true},
+		{"2.0.0", OperatorSemverLte, "1.99.99", false},
+	}
+	for _, test := range tests {
+		condition := Condition{Attribute: AttributeDeviceName, Operator: test.operator, Value: test.value}
+		if got, reason := condition.evaluate(Attributes{AttributeDeviceName: test.actual}); got != test.want {
+			t.Errorf("%s %s %s: got %t, wanted %t (%s)", test.actual, test.operator, test.value, got, test.want, reason)
+		}
+	}
+}
+
+func TestPolicyGroups(t *testing.T) {
+	policy := Policy{
+		Name: "Office or named laptops",
+		Rules: Group{
+			Match: MatchAny,
+			Conditions: []Condition{
+				{Attribute: AttributeConnectionIP, Operator: OperatorInCIDR, Values: []string{"192.168.0.0/16"}},
+			},
+			Groups: []Group{{
+				Match: MatchAll,
+				Conditions: []Condition{
+					{Attribute: AttributeDeviceName, Operator: OperatorMatches, Value: "Otter"},
+					{Attribute: AttributeServiceName, Operator: OperatorEquals, Value: "SSH"},
+				},
+			}},
+		},
+	}
+	if err := policy.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+	if decision := policy.Evaluate(officeAttributes); !decision.Allowed {
+		t.Errorf("expected the nested group to allow the device: %s", decision.Reason)
+	}
+
+	elsewhere := Attributes{AttributeDeviceName: "Brave Otter", AttributeConnectionIP: "10.1.2.3:50000", AttributeServiceName: "Minecraft"}
+	decision := policy.Evaluate(elsewhere)
+	if decision.Allowed {
+		t.Fatal("expected a device matching neither branch to be denied")
+	}
+	if !strings.Contains(decision.Reason, "service.name eq SSH: got Minecraft") || !strings.Contains(decision.Reason, "in_cidr") {
+		t.Errorf("expected the reason to explain both branches, got %q", decision.Reason)
+	}
+}
+
+func TestPolicyTrace(t *testing.T) {
+	policy := Policy{
+		Name: "Office laptops",
+		Rules: Group{
+			Match: MatchAll,
+			Conditions: []Condition{
+				{Attribute: AttributeServiceName, Operator: OperatorEquals, Value: "Minecraft"},
+				{Expression: `device.name.startsWith("Brave")`},
+			},
+			Groups: []Group{{
+				Match: MatchAny,
+				Conditions: []Condition{
+					{Attribute: AttributeConnectionIP, Operator: OperatorInCIDR, Values: []string{"10.0.0.0/8"}},
+				},
+			}},
+		},
+	}
+	decision := policy.Evaluate(officeAttributes)
+	if decision.Allowed || !strings.Contains(decision.Reason, "service.name eq Minecraft: got SSH") {
+		t.Fatalf("expected the first failed condition to deny the device, got %+v", decision)
+	}
+	// The conditions after the failed one are still in the trace.
+	want := []TraceStep{
+		{Check: "service.name eq Minecraft", Detail: "got SSH"},
+		{Check: `device.name.startsWith("Brave")`, Passed: true},
+		{Check: "any of", Passed: true},
+		{Check: "connection.ip in_cidr [10.0.0.0/8]", Passed: true, Depth: 1},
+	}
+	if len(decision.Trace) != len(want) {
+		t.Fatalf("expected %d trace steps, got %+v", len(want), decision.Trace)
+	}
+	for i, step := range decision.Trace {
+		if step != want[i] {
+			t.Errorf("trace step %d: got %+v, wanted %+v", i, step, want[i])
+		}
+	}
+}
+
+func TestUnknownAttributesFailClosed(t *testing.T) {
+	policy := Policy{Name: "Not from the lab", Rules: Group{Match: MatchAll, Conditions: []Condition{
+		{Attribute: AttributeConnectionIP, Operator: OperatorNotInCIDR, Values: []string{"10.0.0.0/8"}},
+	}}}
+	decision := policy.Evaluate(Attributes{AttributeDeviceID: "device-1"})
+	if decision.Allowed {
+		t.Error("expected a negative condition on an unknown attribute to deny")
+	}
+	if !strings.Contains(decision.Reason, "connection.ip is unknown") {
+		t.Errorf("expected the reason to name the unknown attribute, got %q", decision.Reason)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := map[string]Policy{
+		"no name":           {Rules: Group{Match: MatchAll, Conditions: []Condition{{Attribute: AttributeDeviceID, Operator: OperatorEquals, Value: "a"}}}},
+		"no rules":          {Name: "Empty", Rules: Group{Match: MatchAll}},
+		"bad match":         {Name: "Bad", Rules: Group{Match: "most", Conditions: []Condition{{Attribute: AttributeDeviceID, Operator: OperatorEquals, Value: "a"}}}},
+		"unknown attribute": {Name: "Bad", Rules: Group{Match: MatchAll, Conditions: []Condition{{Attribute: "device.colour", Operator: OperatorEquals, Value: "a"}}}},
+		"unknown operator":  {Name: "Bad", Rules: Group{Match: MatchAll, Conditions: []Condition{{Attribute: AttributeDeviceID, Operator: ">=", Value: "a"}}}},
+		"missing value":     {Name: "Bad", Rules: Group{Match: MatchAll, Conditions: []Condition{{Attribute: AttributeDeviceID, Operator: OperatorEquals}}}},
+		"list for eq":       {Name: "Bad", Rules: Group{Match: MatchAll, Conditions: []Condition{{Attribute: AttributeDeviceID, Operator: OperatorEquals, Values: []string{"a"}}}}},
+		"value for in":      {Name: "Bad", Rules: Group{Match: MatchAll, Conditions: []Condition{{Attribute: AttributeDeviceID, Operator: OperatorIn, Value: "a", Values: []string{"a"}}}}},
+		"bad regexp":        {Name: "Bad", Rules: Group{Match: MatchAll, Conditions: []Condition{{Attribute: AttributeDeviceName, Operator: OperatorMatches, Value: "("}}}},
+		"bad cidr":          {Name: "Bad", Rules: Group{Match: MatchAll, Conditions: []Condition{{Attribute: AttributeConnectionIP, Operator: OperatorInCIDR, Values: []string{"10.0.0.0/33"}}}}},
+		"bad semver":        {Name: "Bad", Rules: Group{Match: MatchAll, Conditions: []Condition{{Attribute: AttributeDeviceName, Operator: OperatorSemverGte, Value: "one"}}}},
+		"empty nested":      {Name: "Bad", Rules: Group{Match: MatchAll, Groups: []Group{{Match: MatchAny}}}},
+	}
+	for name, policy := range tests {
+		if err := policy.Validate(); err == nil {
+			t.Errorf("%s: expected the policy to be invalid", name)
+		}
+		if decision := policy.Evaluate(officeAttributes); decision.Allowed {
+			t.Errorf("%s: expected an invalid policy to deny", name)
+		}
+	}
+}
+
+func TestExpressionConditions(t *testing.T) {
+	attributes := Attributes{
+		AttributeDeviceName:   "Brave Otter",
+		AttributeConnectionIP: "10.1.2.3:50000",
+		AttributeNowHour:      "9",
+		AttributeNowWeekday:   "monday",
+	}
+	policy := Policy{Name: "Office hours", Rules: Group{Match: MatchAll, Conditions: []Condition{
+		{Expression: `connection.ip in cidr("10.0.0.0/8") && now.hour >= 8 && now.weekday != "sunday"`},
+	}}}
+	if err := policy.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+	if decision := policy.Evaluate(attributes); !decision.Allowed {
+		t.Errorf("expected the expression to allow the device: %s", decision.Reason)
+	}
+
+	attributes[AttributeNowHour] = "7"
+	if decision := policy.Evaluate(attributes); decision.Allowed || !strings.Contains(decision.Reason, "now.hour >= 8") {
+		t.Errorf("expected the expression to deny before 8, got %+v", decision)
+	}
+	attributes[AttributeNowHour] = "9"
+	delete(attributes, AttributeConnectionIP)
+	if decision := policy.Evaluate(attributes); decision.Allowed || !strings.Contains(decision.Reason, "connection.ip is unknown") {
+		t.Errorf("expected an unknown attribute to deny, got %+v", decision)
+	}
+
+	invalid := Policy{Name: "Typo", Rules: Group{Match: MatchAll, Conditions: []Condition{{Expression: `device.name = "Brave Otter"`}}}}
+	if err := invalid.Validate(); err == nil || !strings.Contains(err.Error(), "1:13: unexpected '='") {
+		t.Errorf("expected the error to give the position of the mistake, got %v", err)
+	}
+	mixed := Policy{Name: "Mixed", Rules: Group{Match: MatchAll, Conditions: []Condition{{Expression: "true", Attribute: AttributeDeviceID}}}}
+	if err := mixed.Validate(); err == nil {
+		t.Error("expected a condition with an expression and an attribute to be invalid")
+	}
+}
+
+func TestUsesPosture(t *testing.T) {
+	tests := map[string]Group{
+		"":           {Match: MatchAll, Conditions: []Condition{{Attribute: AttributeDeviceName, Operator: OperatorEquals, Value: "Brave Otter"}}},
+		"attribute":  {Match: MatchAny, Groups: []Group{{Match: MatchAll, Conditions: []Condition{{Attribute: AttributeDeviceOS, Operator: OperatorEquals, Value: "linux"}}}}},
+		"expression": {Match: MatchAll, Conditions: []Condition{{Expression: `device.name == "Brave Otter" && device.disk_encrypted`}}},
+		"has":        {Match: MatchAll, Conditions: []Condition{{Expression: `!has(device.os_version)`}}},
+	}
+	for name, rules := range tests {
+		policy := Policy{Name: "Posture", Rules: rules}
+		if got := policy.UsesPosture(); got != (name != "") {
+			t.Errorf("%q: UsesPosture returned %t", name, got)
+		}
+	}
+}
+
+func TestCompiledCacheIsBounded(t *testing.T) {
+	cache := newLRUCache[string](2)
+	compiles := 0
+	compile := func(key string) (string, error) {
+		compiles++
+		return strings.ToUpper(key), nil
+	}
+	for _, key := range []string{"a", "b", "a", "c", "a", "b"} {
+		if value, _ := cache.get(key, compile); value != strings.ToUpper(key) {
+			t.Errorf("get(%q) = %q", key, value)
+		}
+	}
+	// b is evicted by c, as a was used more recently, and compiled again at the end.
+	if compiles != 4 {
+		t.Errorf("expected 4 compiles, got %d", compiles)
+	}
+	if cache.len() != 2 {
+		t.Errorf("expected the cache to hold 2 entries, got %d", cache.len())
+	}
+
+	condition := Condition{Expression: `device.name == "Brave Otter"`}
+	for i := 0; i < compiledCacheSize+10; i++ {
+		condition := Condition{Expression: fmt.Sprintf(`device.name == "Otter %d"`, i)}
+		condition.evaluate(officeAttributes)
+	}
+	if expressionCache.len() > compiledCacheSize {
+		t.Errorf("expected at most %d compiled expressions, got %d", compiledCacheSize, expressionCache.len())
+	}
+	if matched, reason := condition.evaluate(officeAttributes); !matched {
+		t.Errorf("expected an evicted expression to be compiled again, got %s", reason)
 	}
 }
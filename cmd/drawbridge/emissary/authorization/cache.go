@@ -0,0 +1,65 @@
+package authorization
+
+import (
+	"container/list"
+	"sync"
+)
+
+// How many compiled expressions and regular expressions are kept. Far more than the conditions in any real set of
+// policies, so only expressions from edited or deleted policies are evicted.
+const compiledCacheSize = 1024
+
+// Caches what conditions compile to, so policies evaluated on every connection compile each expression once.
+// Holds at most size entries, evicting the least recently used.
+type lruCache[V any] struct {
+	mu   sync.Mutex
+	size int
+	// Most recently used first.
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type lruEntry[V any] struct {
+	key   string
+	value V
+}
+
+func newLRUCache[V any](size int) *lruCache[V] {
+	return &lruCache[V]{size: size, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+// Returns the cached value for key, compiling and caching it if it isn't cached. Errors aren't cached.
+func (c *lruCache[V]) get(key string, compile func(string) (V, error)) (V, error) {
+	c.mu.Lock()
+	if element, ok := c.entries[key]; ok {
+		c.order.MoveToFront(element)
+		c.mu.Unlock()
+		return element.Value.(*lruEntry[V]).value, nil
+	}
+	c.mu.Unlock()
+
+	value, err := compile(key)
+	if err != nil {
+		return value, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Compiled by another connection in the meantime.
+	if element, ok := c.entries[key]; ok {
+		c.order.MoveToFront(element)
+		return element.Value.(*lruEntry[V]).value, nil
+	}
+	c.entries[key] = c.order.PushFront(&lruEntry[V]{key: key, value: value})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruEntry[V]).key)
+	}
+	return value, nil
+}
+
+func (c *lruCache[V]) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
@@ -0,0 +1,453 @@
+package expression
+
+import (
+	"fmt"
+	"net/netip"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+)
+
+type evaluator func(lookup Lookup) (any, error)
+
+// A type checked node. Literals, and functions of them like cidr("10.0.0.0/8"), are evaluated once when the
+// expression is compiled.
+type compiled struct {
+	typ        Type
+	constant   any
+	isConstant bool
+	eval       evaluator
+}
+
+func constant(t Type, value any) *compiled {
+	return &compiled{typ: t, constant: value, isConstant: true}
+}
+
+func (c *compiled) evaluator() evaluator {
+	if c.isConstant {
+		value := c.constant
+		return func(Lookup) (any, error) { return value, nil }
+	}
+	return c.eval
+}
+
+type compiler struct {
+	source    string
+	variables map[string]Type
+	// The attributes the expression refers to.
+	used map[string]bool
+}
+
+func (c *compiler) errorf(n node, format string, args ...any) error {
+	return &Error{Position: position(c.source, n.offset()), Message: fmt.Sprintf(format, args...)}
+}
+
+func (c *compiler) compile(n node) (*compiled, error) {
+	switch n := n.(type) {
+	case *literal:
+		return constant(n.typ, n.value), nil
+	case *identifier, *selection:
+		return c.compileAttribute(n)
+	case *list:
+		return c.compileList(n)
+	case *unary:
+		return c.compileUnary(n)
+	case *binary:
+		return c.compileBinary(n)
+	case *call:
+		return c.compileCall(n)
+	}
+	return nil, c.errorf(n, "unexpected expression")
+}
+
+// Returns the dotted name of an attribute, e.g. connection.ip, or false if the node isn't one.
+func attributeName(n node) (string, bool) {
+	switch n := n.(type) {
+	case *identifier:
+		return n.name, true
+	case *selection:
+		operand, ok := attributeName(n.operand)
+		return operand + "." + n.field, ok
+	}
+	return "", false
+}
+
+func (c *compiler) compileAttribute(n node) (*compiled, error) {
+	name, ok := attributeName(n)
+	if !ok {
+		return nil, c.errorf(n, "only attributes have fields")
+	}
+	t, known := c.variables[name]
+	if !known {
+		return nil, c.errorf(n, "unknown attribute %s", name)
+	}
+	c.used[name] = true
+	return &compiled{typ: t, eval: func(lookup Lookup) (any, error) {
+		value, ok := lookup(name)
+		// An empty list attribute is known, it just has no elements.
+		if !ok || (value == "" && t.elem() == "") {
+			return nil, fmt.Errorf("%s is unknown", name)
+		}
+		converted, err := convert(value, t)
+		if err != nil {
+			return nil, fmt.Errorf("%s is not a valid %s: %w", name, t, err)
+		}
+		return converted, nil
+	}}, nil
+}
+
+func (c *compiler) compileList(n *list) (*compiled, error) {
+	if len(n.elements) == 0 {
+		return nil, c.errorf(n, "an empty list never contains anything")
+	}
+	elements := make([]*compiled, len(n.elements))
+	allConstant := true
+	for i, element := range n.elements {
+		compiled, err := c.compile(element)
+		if err != nil {
+			return nil, err
+		}
+		if compiled.typ.elem() != "" {
+			return nil, c.errorf(element, "lists can't contain lists")
+		}
+		if i > 0 && compiled.typ != elements[0].typ {
+			return nil, c.errorf(element, "a list of %s can't contain a %s", elements[0].typ, compiled.typ)
+		}
+		elements[i] = compiled
+		allConstant = allConstant && compiled.isConstant
+	}
+	t := ListOf(elements[0].typ)
+	if allConstant {
+		values := make([]any, len(elements))
+		for i, element := range elements {
+			values[i] = element.constant
+		}
+		return constant(t, values), nil
+	}
+	return &compiled{typ: t, eval: func(lookup Lookup) (any, error) {
+		values := make([]any, len(elements))
+		for i, element := range elements {
+			value, err := element.evaluator()(lookup)
+			if err != nil {
+				return nil, err
+			}
+			values[i] = value
+		}
+		return values, nil
+	}}, nil
+}
+
+func (c *compiler) compileUnary(n *unary) (*compiled, error) {
+	operand, err := c.compile(n.operand)
+	if err != nil {
+		return nil, err
+	}
+	want := TypeBool
+	if n.operator == "-" {
+		want = TypeInt
+	}
+	if operand.typ != want {
+		return nil, c.errorf(n, "%s needs a %s, not a %s", n.operator, want, operand.typ)
+	}
+	return c.fold(want, []*compiled{operand}, func(values []any) (any, error) {
+		if n.operator == "-" {
+			return -values[0].(int64), nil
+		}
+		return !values[0].(bool), nil
+	})
+}
+
+func (c *compiler) compileBinary(n *binary) (*compiled, error) {
+	left, err := c.compile(n.left)
+	if err != nil {
+		return nil, err
+	}
+	right, err := c.compile(n.right)
+	if err != nil {
+		return nil, err
+	}
+	switch n.operator {
+	case "&&", "||":
+		if left.typ != TypeBool || right.typ != TypeBool {
+			return nil, c.errorf(n, "%s needs two bools, not %s and %s", n.operator, left.typ, right.typ)
+		}
+		return logical(n.operator == "||", left, right), nil
+	case "==", "!=":
+		if left.typ != right.typ || left.typ.elem() != "" {
+			return nil, c.errorf(n, "can't compare %s and %s with %s", left.typ, right.typ, n.operator)
+		}
+		return c.fold(TypeBool, []*compiled{left, right}, func(values []any) (any, error) {
+			return equal(values[0], values[1]) == (n.operator == "=="), nil
+		})
+	case "<", "<=", ">", ">=":
+		if left.typ != right.typ || !slices.Contains([]Type{TypeInt, TypeString, TypeVersion}, left.typ) {
+			return nil, c.errorf(n, "can't order %s and %s with %s, only ints, strings and versions", left.typ, right.typ, n.operator)
+		}
+		return c.fold(TypeBool, []*compiled{left, right}, func(values []any) (any, error) {
+			comparison := compare(values[0], values[1])
+			switch n.operator {
+			case "<":
+				return comparison < 0, nil
+			case "<=":
+				return comparison <= 0, nil
+			case ">":
+				return comparison > 0, nil
+			}
+			return comparison >= 0, nil
+		})
+	case "in":
+		switch {
+		case left.typ == TypeIP && (right.typ == TypeCIDR || right.typ == ListOf(TypeCIDR)):
+		case left.typ.elem() == "" && right.typ == ListOf(left.typ):
+		default:
+			return nil, c.errorf(n, "can't check whether a %s is in a %s", left.typ, right.typ)
+		}
+		return c.fold(TypeBool, []*compiled{left, right}, func(values []any) (any, error) {
+			return contains(values[1], values[0]), nil
+		})
+	}
+	return nil, c.errorf(n, "unknown operator %s", n.operator)
+}
+
+// && and || skip the right side when the left decides the result. An error on one side is ignored when the
+// other decides the result, so the order of the operands doesn't matter.
+func logical(or bool, left, right *compiled) *compiled {
+	leftEval, rightEval := left.evaluator(), right.evaluator()
+	return &compiled{typ: TypeBool, eval: func(lookup Lookup) (any, error) {
+		leftValue, leftErr := leftEval(lookup)
+		if leftErr == nil && leftValue.(bool) == or {
+			return or, nil
+		}
+		rightValue, rightErr := rightEval(lookup)
+		if rightErr == nil && rightValue.(bool) == or {
+			return or, nil
+		}
+		if leftErr != nil {
+			return nil, leftErr
+		}
+		if rightErr != nil {
+			return nil, rightErr
+		}
+		return !or, nil
+	}}
+}
+
+// Evaluates apply once the operands are evaluated, or straight away when they are all constant.
+func (c *compiler) fold(t Type, operands []*compiled, apply func([]any) (any, error)) (*compiled, error) {
+	constants := make([]any, len(operands))
+	allConstant := true
+	for i, operand := range operands {
+		constants[i] = operand.constant
+		allConstant = allConstant && operand.isConstant
+	}
+	if allConstant {
+		value, err := apply(constants)
+		if err != nil {
+			return nil, err
+		}
+		return constant(t, value), nil
+	}
+	evaluators := make([]evaluator, len(operands))
+	for i, operand := range operands {
+		evaluators[i] = operand.evaluator()
+	}
+	return &compiled{typ: t, eval: func(lookup Lookup) (any, error) {
+		values := make([]any, len(evaluators))
+		for i, eval := range evaluators {
+			value, err := eval(lookup)
+			if err != nil {
+				return nil, err
+			}
+			values[i] = value
+		}
+		return apply(values)
+	}}, nil
+}
+
+func equal(a, b any) bool {
+	if version, ok := a.(Version); ok {
+		return version.Compare(b.(Version)) == 0
+	}
+	return a == b
+}
+
+func compare(a, b any) int {
+	switch a := a.(type) {
+	case int64:
+		b := b.(int64)
+		switch {
+		case a < b:
+			return -1
+		case a > b:
+			return 1
+		}
+		return 0
+	case string:
+		return strings.Compare(a, b.(string))
+	case Version:
+		return a.Compare(b.(Version))
+	}
+	return 0
+}
+
+func contains(container, value any) bool {
+	switch container := container.(type) {
+	case netip.Prefix:
+		return container.Contains(value.(netip.Addr))
+	case []any:
+		for _, element := range container {
+			if prefix, ok := element.(netip.Prefix); ok {
+				if prefix.Contains(value.(netip.Addr)) {
+					return true
+				}
+			} else if equal(element, value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type function struct {
+	// The target's type for methods, "" for functions.
+	target Type
+	args   []Type
+	result Type
+	apply  func(values []any) (any, error)
+}
+
+var functions = map[string][]function{
+	"cidr": {{args: []Type{TypeString}, result: TypeCIDR, apply: func(values []any) (any, error) {
+		return netip.ParsePrefix(values[0].(string))
+	}}},
+	"ip": {{args: []Type{TypeString}, result: TypeIP, apply: func(values []any) (any, error) {
+		return ParseAddress(values[0].(string))
+	}}},
+	"version": {{args: []Type{TypeString}, result: TypeVersion, apply: func(values []any) (any, error) {
+		return ParseVersion(values[0].(string))
+	}}},
+	"size": {{args: []Type{TypeString}, result: TypeInt, apply: func(values []any) (any, error) {
+		return int64(len([]rune(values[0].(string)))), nil
+	}}},
+	"matches": {{target: TypeString, args: []Type{TypeString}, result: TypeBool, apply: func(values []any) (any, error) {
+		expression, err := compileRegexp(values[1].(string))
+		if err != nil {
+			return nil, err
+		}
+		return expression.MatchString(values[0].(string)), nil
+	}}},
+	"startsWith": {{target: TypeString, args: []Type{TypeString}, result: TypeBool, apply: func(values []any) (any, error) {
+		return strings.HasPrefix(values[0].(string), values[1].(string)), nil
+	}}},
+	"endsWith": {{target: TypeString, args: []Type{TypeString}, result: TypeBool, apply: func(values []any) (any, error) {
+		return strings.HasSuffix(values[0].(string), values[1].(string)), nil
+	}}},
+	"contains": {{target: TypeString, args: []Type{TypeString}, result: TypeBool, apply: func(values []any) (any, error) {
+		return strings.Contains(values[0].(string), values[1].(string)), nil
+	}}},
+}
+
+func (c *compiler) compileCall(n *call) (*compiled, error) {
+	if n.function == "has" && n.target == nil {
+		return c.compileHas(n)
+	}
+	var operands []*compiled
+	var types []Type
+	if n.target != nil {
+		target, err := c.compile(n.target)
+		if err != nil {
+			return nil, err
+		}
+		operands, types = append(operands, target), append(types, target.typ)
+	}
+	for _, arg := range n.args {
+		compiled, err := c.compile(arg)
+		if err != nil {
+			return nil, err
+		}
+		operands, types = append(operands, compiled), append(types, compiled.typ)
+	}
+
+	overloads, known := functions[n.function]
+	if n.function == "size" && n.target == nil && len(types) == 1 && types[0].elem() != "" {
+		return c.fold(TypeInt, operands, func(values []any) (any, error) {
+			return int64(len(values[0].([]any))), nil
+		})
+	}
+	for _, overload := range overloads {
+		want := overload.args
+		if overload.target != "" {
+			want = append([]Type{overload.target}, want...)
+		}
+		if (overload.target != "") != (n.target != nil) || !slices.Equal(want, types) {
+			continue
+		}
+		if n.function == "matches" && operands[1].isConstant {
+			if _, err := compileRegexp(operands[1].constant.(string)); err != nil {
+				return nil, c.errorf(n.args[0], "%s", err)
+			}
+		}
+		compiled, err := c.fold(overload.result, operands, overload.apply)
+		if err != nil {
+			// Only constant arguments are evaluated while compiling, e.g. cidr("10.0.0.0/33").
+			return nil, c.errorf(n.args[len(n.args)-1], "%s", err)
+		}
+		return compiled, nil
+	}
+	if !known {
+		return nil, c.errorf(n, "unknown function %s", n.function)
+	}
+	return nil, c.errorf(n, "%s %s", n.function, c.describeOverloads(overloads))
+}
+
+func (c *compiler) describeOverloads(overloads []function) string {
+	var usages []string
+	for _, overload := range overloads {
+		args := make([]string, len(overload.args))
+		for i, arg := range overload.args {
+			args[i] = string(arg)
+		}
+		usage := fmt.Sprintf("takes (%s)", strings.Join(args, ", "))
+		if overload.target != "" {
+			usage = fmt.Sprintf("is called on a %s and %s", overload.target, usage)
+		}
+		usages = append(usages, usage)
+	}
+	return strings.Join(usages, " or ")
+}
+
+// has(attribute) is true when Drawbridge knows the attribute for the connection, so an expression can check an
+// attribute only some devices report without failing for the others.
+func (c *compiler) compileHas(n *call) (*compiled, error) {
+	if len(n.args) != 1 {
+		return nil, c.errorf(n, "has takes one attribute")
+	}
+	name, ok := attributeName(n.args[0])
+	if !ok {
+		return nil, c.errorf(n.args[0], "has takes an attribute, e.g. has(device.name)")
+	}
+	if _, known := c.variables[name]; !known {
+		return nil, c.errorf(n.args[0], "unknown attribute %s", name)
+	}
+	c.used[name] = true
+	return &compiled{typ: TypeBool, eval: func(lookup Lookup) (any, error) {
+		value, ok := lookup(name)
+		return ok && value != "", nil
+	}}, nil
+}
+
+// Expressions are compiled for every policy that uses them, so each regular expression is only compiled once.
+var regexpCache sync.Map
+
+func compileRegexp(expression string) (*regexp.Regexp, error) {
+	if cached, ok := regexpCache.Load(expression); ok {
+		return cached.(*regexp.Regexp), nil
+	}
+	compiled, err := regexp.Compile(expression)
+	if err != nil {
+		return nil, err
+	}
+	regexpCache.Store(expression, compiled)
+	return compiled, nil
+}
@@ -0,0 +1,178 @@
+// Package expression is a small, CEL-like expression language for access rules, e.g.
+//
+//	device.name.startsWith("Work ") && connection.ip in cidr("10.0.0.0/8") && now.hour >= 8
+//
+// Expressions are type checked against the attributes Drawbridge knows about a connection when they are compiled,
+// so mistakes are reported with their line and column when a policy is saved rather than when a device connects.
+// They are sandboxed: there are no loops, assignments or side effects, and evaluating one takes time proportional
+// to its length.
+//
+// Types are bool, int, string, ip, cidr, version and lists of them. Operators are && || ! == != < <= > >= and in,
+// which checks list membership and whether an ip is inside a cidr or a list of cidrs. Functions are cidr(s), ip(s),
+// version(s), has(attribute), size(s or list) and the string methods matches(regexp), startsWith, endsWith and contains.
+package expression
+
+import (
+	"fmt"
+	"maps"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+type Type string
+
+const (
+	TypeBool    Type = "bool"
+	TypeInt     Type = "int"
+	TypeString  Type = "string"
+	TypeIP      Type = "ip"
+	TypeCIDR    Type = "cidr"
+	TypeVersion Type = "version"
+)
+
+func ListOf(t Type) Type {
+	return "list<" + t + ">"
+}
+
+// Returns the type of the elements of a list type, or "" for other types.
+func (t Type) elem() Type {
+	if strings.HasPrefix(string(t), "list<") && strings.HasSuffix(string(t), ">") {
+		return t[len("list<") : len(t)-1]
+	}
+	return ""
+}
+
+// An attribute expressions can refer to, e.g. connection.ip.
+type Variable struct {
+	Name string
+	Type Type
+}
+
+type Position struct {
+	Line   int
+	Column int
+}
+
+// A mistake in an expression, at the line and column it was found, both counted from 1.
+type Error struct {
+	Position Position
+	Message  string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%d:%d: %s", e.Position.Line, e.Position.Column, e.Message)
+}
+
+// Longer expressions, or more deeply nested ones, are refused so a policy can't exhaust the stack or slow down
+// every connection.
+const (
+	maxLength = 4096
+	maxDepth  = 64
+)
+
+// Returns the value of an attribute, and whether it is known. Values are converted to the attribute's type,
+// so an ip attribute may be 192.0.2.7 or 192.0.2.7:50000 and a list attribute is comma separated, or empty for
+// an empty list.
+type Lookup func(name string) (string, bool)
+
+// A compiled expression. Programs are safe to evaluate concurrently.
+type Program struct {
+	Source string
+	eval   evaluator
+	// The attributes the expression refers to, sorted.
+	variables []string
+}
+
+// Parses and type checks an expression, which must evaluate to a bool.
+func Compile(source string, variables []Variable) (*Program, error) {
+	if len(source) > maxLength {
+		return nil, &Error{Position: Position{1, 1}, Message: fmt.Sprintf("expressions can be at most %d characters", maxLength)}
+	}
+	tokens, err := lex(source)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{source: source, tokens: tokens}
+	tree, err := p.parse()
+	if err != nil {
+		return nil, err
+	}
+	c := &compiler{source: source, variables: make(map[string]Type, len(variables)), used: make(map[string]bool)}
+	for _, variable := range variables {
+		c.variables[variable.Name] = variable.Type
+	}
+	compiled, err := c.compile(tree)
+	if err != nil {
+		return nil, err
+	}
+	if compiled.typ != TypeBool {
+		return nil, c.errorf(tree, "the expression must be a bool, not %s", compiled.typ)
+	}
+	used := slices.Sorted(maps.Keys(c.used))
+	return &Program{Source: source, eval: compiled.evaluator(), variables: used}, nil
+}
+
+// Returns the attributes the expression refers to, including the ones it only checks with has.
+func (p *Program) Variables() []string {
+	return slices.Clone(p.variables)
+}
+
+// Evaluates the expression. An attribute that isn't known, or can't be converted to its type, is an error unless
+// the result doesn't depend on it, e.g. false && device.name == "x" is false.
+func (p *Program) Eval(lookup Lookup) (bool, error) {
+	value, err := p.eval(lookup)
+	if err != nil {
+		return false, err
+	}
+	return value.(bool), nil
+}
+
+// Converts an attribute value to its type.
+func convert(value string, t Type) (any, error) {
+	switch t {
+	case TypeString:
+		return value, nil
+	case TypeBool:
+		return strconv.ParseBool(value)
+	case TypeInt:
+		return strconv.ParseInt(value, 10, 64)
+	case TypeIP:
+		return ParseAddress(value)
+	case TypeCIDR:
+		return netip.ParsePrefix(value)
+	case TypeVersion:
+		return ParseVersion(value)
+	}
+	if elem := t.elem(); elem != "" {
+		var values []any
+		for _, part := range strings.Split(value, ",") {
+			if part = strings.TrimSpace(part); part == "" {
+				continue
+			}
+			converted, err := convert(part, elem)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, converted)
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("unknown type %s", t)
+}
+
+// Parses an IP with or without a port, as connection IPs are recorded with their port, e.g. 192.0.2.7:50000.
+// IPv4-mapped IPv6 addresses are returned as IPv4, so they match IPv4 ranges.
+func ParseAddress(value string) (netip.Addr, error) {
+	host, _, err := net.SplitHostPort(value)
+	if err != nil {
+		host = value
+	}
+	address, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	return address.Unmap(), nil
+}
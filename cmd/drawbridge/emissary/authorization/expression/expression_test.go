@@ -0,0 +1,159 @@
+package expression
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+var testVariables = []Variable{
+	{Name: "device.name", Type: TypeString},
+	{Name: "device.os", Type: TypeString},
+	{Name: "device.version", Type: TypeVersion},
+	{Name: "device.tags", Type: ListOf(TypeString)},
+	{Name: "service.id", Type: TypeInt},
+	{Name: "connection.ip", Type: TypeIP},
+	{Name: "now.hour", Type: TypeInt},
+}
+
+var testAttributes = map[string]string{
+	"device.name":    "Brave Otter",
+	"device.os":      "linux",
+	"device.version": "1.4.0",
+	"device.tags":    "laptop, work",
+	"service.id":     "3",
+	"connection.ip":  "[::ffff:10.1.2.3]:50000",
+	"now.hour":       "9",
+}
+
+func lookup(name string) (string, bool) {
+	value, ok := testAttributes[name]
+	return value, ok
+}
+
+func TestEval(t *testing.T) {
+	tests := map[string]bool{
+		`device.os == "linux" && connection.ip in cidr("10.0.0.0/8") && now.hour >= 8`:   true,
+		`device.os == 'linux' && now.hour < 8`:                                           false,
+		`connection.ip in [cidr("192.168.0.0/16"), cidr("10.1.0.0/16")]`:                 true,
+		`connection.ip == ip("10.1.2.3")`:                                                true,
+		`device.version >= version("v1.4.0-beta.1") && device.version < version("1.10")`: true,
+		`"work" in device.tags && !("admin" in device.tags)`:                             true,
+		`size(device.tags) == 2 && size(device.name) == 11`:                              true,
+		`device.name.startsWith("Brave") && device.name.endsWith("Otter")`:               true,
+		`device.name.contains("ve Ot") && device.name.matches("^B.*r$")`:                 true,
+		`service.id in [1, 2, 3] && -service.id < 0`:                                     true,
+		`has(device.name) && !has(device.serial)`:                                        true,
+		"now.hour >= 8 &&\n  now.hour < 17":                                              true,
+		`(device.os == "windows" || device.os == "linux") && true`:                       true,
+	}
+	variables := append(testVariables, Variable{Name: "device.serial", Type: TypeString})
+	for source, want := range tests {
+		program, err := Compile(source, variables)
+		if err != nil {
+			t.Errorf("%s: Compile failed: %v", source, err)
+			continue
+		}
+		got, err := program.Eval(lookup)
+		if err != nil {
+			t.Errorf("%s: Eval failed: %v", source, err)
+		} else if got != want {
+			t.Errorf("%s: got %t, wanted %t", source, got, want)
+		}
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	tests := []struct {
+		source   string
+		position Position
+		message  string
+	}{
+		{`device.os = "linux"`, Position{1, 11}, "did you mean ==?"},
+		{`device.colour == "red"`, Position{1, 1}, "unknown attribute device.colour"},
+		{`device.os == 1`, Position{1, 11}, "can't compare string and int"},
+		{`now.hour`, Position{1, 1}, "must be a bool, not int"},
+		{"now.hour >= 8 &&\n  connection.ip in cidr(\"10.0.0.0/33\")", Position{2, 25}, "netip.ParsePrefix"},
+		{`device.name.matches("(")`, Position{1, 21}, "missing closing )"},
+		{`device.name.shout()`, Position{1, 13}, "unknown function shout"},
+		{`device.name.startsWith(1)`, Position{1, 13}, "is called on a string and takes (string)"},
+		{`now.hour < 8 < 9`, Position{1, 14}, "expected &&, || or the end"},
+		{`device.os == "linux`, Position{1, 14}, "unterminated string"},
+		{`[1, "two"] == [1]`, Position{1, 5}, "a list of int can't contain a string"},
+		{`connection.ip in []`, Position{1, 18}, "empty list"},
+		{`(now.hour > 8`, Position{1, 14}, "expected ), found the end"},
+		{strings.Repeat("(", 100) + "true" + strings.Repeat(")", 100), Position{1, 66}, "nested too deeply"},
+		{strings.Repeat("!", 100) + "true", Position{1, 65}, "nested too deeply"},
+	}
+	for _, test := range tests {
+		_, err := Compile(test.source, testVariables)
+		var compileErr *Error
+		if !errors.As(err, &compileErr) {
+			t.Errorf("%s: expected an *Error, got %v", test.source, err)
+			continue
+		}
+		if compileErr.Position != test.position || !strings.Contains(compileErr.Message, test.message) {
+			t.Errorf("%s: got %v, wanted %d:%d: ...%s...", test.source, err, test.position.Line, test.position.Column, test.message)
+		}
+	}
+}
+
+// Attributes Drawbridge doesn't know for a connection are errors, unless the result doesn't depend on them.
+func TestUnknownAttributes(t *testing.T) {
+	unknown := func(name string) (string, bool) {
+		if name == "device.os" {
+			return "", false
+		}
+		return lookup(name)
+	}
+	tests := map[string]string{
+		`device.os == "linux"`:                     "device.os is unknown",
+		`device.os != "linux"`:                     "device.os is unknown",
+		`device.os == "linux" && now.hour > 8`:     "device.os is unknown",
+		`device.os == "linux" || now.hour > 8`:     "",
+		`now.hour > 12 && device.os == "linux"`:    "",
+		`has(device.os) && device.os == "linux"`:   "",
+		`!has(device.os) || device.os == "linux"`:  "",
+		`device.version > version("1.0") || false`: "",
+	}
+	for source, wantErr := range tests {
+		program, err := Compile(source, testVariables)
+		if err != nil {
+			t.Fatalf("%s: Compile failed: %v", source, err)
+		}
+		_, err = program.Eval(unknown)
+		switch {
+		case wantErr == "" && err != nil:
+			t.Errorf("%s: expected no error, got %v", source, err)
+		case wantErr != "" && (err == nil || !strings.Contains(err.Error(), wantErr)):
+			t.Errorf("%s: expected %q, got %v", source, wantErr, err)
+		}
+	}
+}
+
+func TestVersionOrdering(t *testing.T) {
+	ordered := []string{"1.0.0-1", "1.0.0-alpha", "1.0.0-alpha.1", "1.0.0-alpha.2", "1.0.0-alpha.10", "1.0.0-beta", "1.0.0", "v1.0.1+build.5", "1.10"}
+	for i := 1; i < len(ordered); i++ {
+		previous, err := ParseVersion(ordered[i-1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		next, err := ParseVersion(ordered[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if previous.Compare(next) >= 0 || next.Compare(previous) <= 0 {
+			t.Errorf("expected %s < %s", ordered[i-1], ordered[i])
+		}
+	}
+}
+
+func TestVariables(t *testing.T) {
+	program, err := Compile(`has(device.os) && connection.ip in cidr("10.0.0.0/8") || device.os == "linux" && now.hour > 8`, testVariables)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(program.Variables(), ","); got != "connection.ip,device.os,now.hour" {
+		t.Errorf("expected the attributes the expression refers to, got %s", got)
+	}
+}
@@ -0,0 +1,408 @@
+package expression
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenInt
+	tokenString
+	tokenOperator
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	// The unquoted string or the int.
+	value  any
+	offset int
+}
+
+// Longest first, so <= isn't read as < followed by =.
+var operators = []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "-", "(", ")", "[", "]", ",", "."}
+
+func lex(source string) ([]token, error) {
+	var tokens []token
+	for offset := 0; offset < len(source); {
+		r, size := utf8.DecodeRuneInString(source[offset:])
+		switch {
+		case unicode.IsSpace(r):
+			offset += size
+		case r == '_' || unicode.IsLetter(r):
+			end := offset
+			for end < len(source) {
+				r, size := utf8.DecodeRuneInString(source[end:])
+				if r != '_' && !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+					break
+				}
+				end += size
+			}
+			tokens = append(tokens, token{kind: tokenIdent, text: source[offset:end], offset: offset})
+			offset = end
+		case r >= '0' && r <= '9':
+			end := offset
+			for end < len(source) && source[end] >= '0' && source[end] <= '9' {
+				end++
+			}
+			value, err := strconv.ParseInt(source[offset:end], 10, 64)
+			if err != nil {
+				return nil, &Error{Position: position(source, offset), Message: fmt.Sprintf("%s is too large for an int", source[offset:end])}
+			}
+			tokens = append(tokens, token{kind: tokenInt, text: source[offset:end], value: value, offset: offset})
+			offset = end
+		case r == '"' || r == '\'':
+			end, value, err := lexString(source, offset)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, token{kind: tokenString, text: source[offset:end], value: value, offset: offset})
+			offset = end
+		default:
+			operator := ""
+			for _, candidate := range operators {
+				if strings.HasPrefix(source[offset:], candidate) {
+					operator = candidate
+					break
+				}
+			}
+			if operator == "" {
+				message := fmt.Sprintf("unexpected %q", r)
+				switch r {
+				case '=':
+					message += ", did you mean ==?"
+				case '&':
+					message += ", did you mean &&?"
+				case '|':
+					message += ", did you mean ||?"
+				}
+				return nil, &Error{Position: position(source, offset), Message: message}
+			}
+			tokens = append(tokens, token{kind: tokenOperator, text: operator, offset: offset})
+			offset += len(operator)
+		}
+	}
+	return append(tokens, token{kind: tokenEOF, offset: len(source)}), nil
+}
+
+// Reads a string quoted with " or ', with the escapes Go allows in strings.
+func lexString(source string, start int) (int, string, error) {
+	quote := source[start]
+	for end := start + 1; end < len(source); end++ {
+		switch source[end] {
+		case '\\':
+			end++
+		case '\n':
+			return 0, "", &Error{Position: position(source, start), Message: "strings can't span lines"}
+		case quote:
+			body := source[start+1 : end]
+			if quote == '\'' {
+				body = strings.ReplaceAll(strings.ReplaceAll(body, `\'`, `'`), `"`, `\"`)
+			}
+			value, err := strconv.Unquote(`"` + body + `"`)
+			if err != nil {
+				return 0, "", &Error{Position: position(source, start), Message: "invalid escape in string"}
+			}
+			return end + 1, value, nil
+		}
+	}
+	return 0, "", &Error{Position: position(source, start), Message: "unterminated string"}
+}
+
+// Converts a byte offset to a line and column, counting columns in characters.
+func position(source string, offset int) Position {
+	line, column := 1, 1
+	for _, r := range source[:min(offset, len(source))] {
+		if r == '\n' {
+			line, column = line+1, 1
+			continue
+		}
+		column++
+	}
+	return Position{Line: line, Column: column}
+}
+
+type node interface {
+	offset() int
+}
+
+type literal struct {
+	at    int
+	value any
+	typ   Type
+}
+
+type identifier struct {
+	at   int
+	name string
+}
+
+type selection struct {
+	at      int
+	operand node
+	field   string
+}
+
+// A function call, or a method call when target is set, e.g. device.name.startsWith("Work").
+type call struct {
+	at       int
+	target   node
+	function string
+	args     []node
+}
+
+type unary struct {
+	at       int
+	operator string
+	operand  node
+}
+
+type binary struct {
+	at          int
+	operator    string
+	left, right node
+}
+
+type list struct {
+	at       int
+	elements []node
+}
+
+func (n *literal) offset() int    { return n.at }
+func (n *identifier) offset() int { return n.at }
+func (n *selection) offset() int  { return n.at }
+func (n *call) offset() int       { return n.at }
+func (n *unary) offset() int      { return n.at }
+func (n *binary) offset() int     { return n.at }
+func (n *list) offset() int       { return n.at }
+
+// A recursive descent parser. From loosest to tightest, the operators bind: ||, &&, comparisons and in, ! and -.
+type parser struct {
+	source string
+	tokens []token
+	next   int
+	depth  int
+}
+
+func (p *parser) parse() (node, error) {
+	tree, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind != tokenEOF {
+		return nil, p.unexpected("&&, || or the end of the expression")
+	}
+	return tree, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.next]
+}
+
+func (p *parser) advance() token {
+	t := p.tokens[p.next]
+	if t.kind != tokenEOF {
+		p.next++
+	}
+	return t
+}
+
+func (p *parser) isOperator(operators ...string) bool {
+	t := p.peek()
+	if t.kind == tokenOperator {
+		for _, operator := range operators {
+			if t.text == operator {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (p *parser) expect(operator string) error {
+	if !p.isOperator(operator) {
+		return p.unexpected(operator)
+	}
+	p.advance()
+	return nil
+}
+
+func (p *parser) unexpected(expected string) error {
+	t := p.peek()
+	found := "the end of the expression"
+	if t.kind != tokenEOF {
+		found = strconv.Quote(t.text)
+	}
+	return &Error{Position: position(p.source, t.offset), Message: fmt.Sprintf("expected %s, found %s", expected, found)}
+}
+
+func (p *parser) parseOr() (node, error) {
+	return p.parseBinary(p.parseAnd, "||")
+}
+
+func (p *parser) parseAnd() (node, error) {
+	return p.parseBinary(p.parseRelation, "&&")
+}
+
+func (p *parser) parseBinary(operand func() (node, error), operator string) (node, error) {
+	left, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOperator(operator) {
+		at := p.advance().offset
+		right, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		left = &binary{at: at, operator: operator, left: left, right: right}
+	}
+	return left, nil
+}
+
+// Comparisons don't chain: a < b < c is an error rather than a comparison of a bool.
+func (p *parser) parseRelation() (node, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	t := p.peek()
+	isIn := t.kind == tokenIdent && t.text == "in"
+	if !isIn && !p.isOperator("==", "!=", "<", "<=", ">", ">=") {
+		return left, nil
+	}
+	p.advance()
+	right, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	return &binary{at: t.offset, operator: t.text, left: left, right: right}, nil
+}
+
+func (p *parser) parseUnary() (node, error) {
+	if !p.isOperator("!", "-") {
+		return p.parseMember()
+	}
+	t := p.advance()
+	p.depth++
+	defer func() { p.depth-- }()
+	if p.depth > maxDepth {
+		return nil, &Error{Position: position(p.source, t.offset), Message: "the expression is nested too deeply"}
+	}
+	operand, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	return &unary{at: t.offset, operator: t.text, operand: operand}, nil
+}
+
+func (p *parser) parseMember() (node, error) {
+	operand, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOperator(".") {
+		p.advance()
+		field := p.peek()
+		if field.kind != tokenIdent {
+			return nil, p.unexpected("an attribute or method name")
+		}
+		p.advance()
+		if !p.isOperator("(") {
+			operand = &selection{at: operand.offset(), operand: operand, field: field.text}
+			continue
+		}
+		args, err := p.parseArguments()
+		if err != nil {
+			return nil, err
+		}
+		operand = &call{at: field.offset, target: operand, function: field.text, args: args}
+	}
+	return operand, nil
+}
+
+func (p *parser) parsePrimary() (node, error) {
+	t := p.peek()
+	switch {
+	case t.kind == tokenInt:
+		p.advance()
+		return &literal{at: t.offset, value: t.value, typ: TypeInt}, nil
+	case t.kind == tokenString:
+		p.advance()
+		return &literal{at: t.offset, value: t.value, typ: TypeString}, nil
+	case t.kind == tokenIdent && (t.text == "true" || t.text == "false"):
+		p.advance()
+		return &literal{at: t.offset, value: t.text == "true", typ: TypeBool}, nil
+	case t.kind == tokenIdent && t.text == "in":
+		return nil, p.unexpected("a value")
+	case t.kind == tokenIdent:
+		p.advance()
+		if !p.isOperator("(") {
+			return &identifier{at: t.offset, name: t.text}, nil
+		}
+		args, err := p.parseArguments()
+		if err != nil {
+			return nil, err
+		}
+		return &call{at: t.offset, function: t.text, args: args}, nil
+	case p.isOperator("("):
+		p.advance()
+		inner, err := p.nested(p.parseOr)
+		if err != nil {
+			return nil, err
+		}
+		return inner, p.expect(")")
+	case p.isOperator("["):
+		p.advance()
+		elements, err := p.parseList("]")
+		if err != nil {
+			return nil, err
+		}
+		return &list{at: t.offset, elements: elements}, nil
+	}
+	return nil, p.unexpected("a value")
+}
+
+func (p *parser) parseArguments() ([]node, error) {
+	err := p.expect("(")
+	if err != nil {
+		return nil, err
+	}
+	return p.parseList(")")
+}
+
+// Parses comma separated expressions up to and including the closing operator.
+func (p *parser) parseList(closing string) ([]node, error) {
+	var elements []node
+	for !p.isOperator(closing) {
+		if len(elements) > 0 {
+			err := p.expect(",")
+			if err != nil {
+				return nil, p.unexpected(", or " + closing)
+			}
+		}
+		element, err := p.nested(p.parseOr)
+		if err != nil {
+			return nil, err
+		}
+		elements = append(elements, element)
+	}
+	p.advance()
+	return elements, nil
+}
+
+func (p *parser) nested(parse func() (node, error)) (node, error) {
+	p.depth++
+	defer func() { p.depth-- }()
+	if p.depth > maxDepth {
+		return nil, &Error{Position: position(p.source, p.peek().offset), Message: "the expression is nested too deeply"}
+	}
+	return parse()
+}
@@ -0,0 +1,91 @@
+package expression
+
+import (
+	"cmp"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A semantic version, e.g. an Emissary or OS version.
+type Version struct {
+	Major, Minor, Patch uint64
+	Prerelease          []string
+}
+
+// Parses versions like 1.2.3, v1.2.3-beta.1 or 14.2. OS versions often leave out the minor or patch number,
+// which count as 0. Build metadata after a + is ignored, as semver says.
+func ParseVersion(value string) (Version, error) {
+	version, _, _ := strings.Cut(strings.TrimPrefix(strings.TrimSpace(value), "v"), "+")
+	version, prerelease, hasPrerelease := strings.Cut(version, "-")
+	parts := strings.Split(version, ".")
+	if len(parts) > 3 {
+		return Version{}, fmt.Errorf("%q is not a semantic version", value)
+	}
+	var numbers [3]uint64
+	for i, part := range parts {
+		number, err := strconv.ParseUint(part, 10, 64)
+		if err != nil {
+			return Version{}, fmt.Errorf("%q is not a semantic version", value)
+		}
+		numbers[i] = number
+	}
+	parsed := Version{Major: numbers[0], Minor: numbers[1], Patch: numbers[2]}
+	if hasPrerelease {
+		if prerelease == "" {
+			return Version{}, fmt.Errorf("%q has an empty pre-release", value)
+		}
+		parsed.Prerelease = strings.Split(prerelease, ".")
+	}
+	return parsed, nil
+}
+
+// Orders versions by semver precedence: a pre-release comes before its release.
+func (v Version) Compare(other Version) int {
+	if c := cmp.Compare(v.Major, other.Major); c != 0 {
+		return c
+	}
+	if c := cmp.Compare(v.Minor, other.Minor); c != 0 {
+		return c
+	}
+	if c := cmp.Compare(v.Patch, other.Patch); c != 0 {
+		return c
+	}
+	switch {
+	case len(v.Prerelease) == 0 && len(other.Prerelease) == 0:
+		return 0
+	case len(v.Prerelease) == 0:
+		return 1
+	case len(other.Prerelease) == 0:
+		return -1
+	}
+	for i := 0; i < min(len(v.Prerelease), len(other.Prerelease)); i++ {
+		if c := comparePrereleaseIdentifiers(v.Prerelease[i], other.Prerelease[i]); c != 0 {
+			return c
+		}
+	}
+	return cmp.Compare(len(v.Prerelease), len(other.Prerelease))
+}
+
+func (v Version) String() string {
+	version := fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+	if len(v.Prerelease) > 0 {
+		version += "-" + strings.Join(v.Prerelease, ".")
+	}
+	return version
+}
+
+// Numeric identifiers compare as numbers and come before alphanumeric ones.
+func comparePrereleaseIdentifiers(a, b string) int {
+	aNumber, aErr := strconv.ParseUint(a, 10, 64)
+	bNumber, bErr := strconv.ParseUint(b, 10, 64)
+	switch {
+	case aErr == nil && bErr == nil:
+		return cmp.Compare(aNumber, bNumber)
+	case aErr == nil:
+		return -1
+	case bErr == nil:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
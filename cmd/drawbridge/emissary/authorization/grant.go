@@ -0,0 +1,32 @@
+package authorization
+
+import (
+	"errors"
+	"strings"
+)
+
+// Gives the devices in a group access to a Protected Service. Once a Protected Service has grants, only devices in
+// a granted group can connect to it. A grant can add its own policy and schedule, on top of the service's.
+type Grant struct {
+	ID        int64  `json:"id"`
+	ServiceID int64  `json:"service_id"`
+	Group     string `json:"group"`
+	// The policy the group's devices have to pass, or 0 for none.
+	PolicyID int64 `json:"policy_id,omitempty"`
+	// The schedule the group's devices may connect during, or 0 for any time.
+	ScheduleID int64 `json:"schedule_id,omitempty"`
+}
+
+func (g *Grant) Validate() error {
+	g.Group = strings.TrimSpace(g.Group)
+	if g.ServiceID == 0 {
+		return errors.New("a grant needs a Protected Service")
+	}
+	if g.Group == "" {
+		return errors.New("a grant needs a group")
+	}
+	if strings.Contains(g.Group, ",") {
+		return errors.New("group names can't contain a comma")
+	}
+	return nil
+}
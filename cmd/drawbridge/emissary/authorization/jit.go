@@ -0,0 +1,66 @@
+package authorization
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+type JITStatus string
+
+const (
+	JITPending  JITStatus = "pending"
+	JITApproved JITStatus = "approved"
+	JITDenied   JITStatus = "denied"
+	// An approved request whose time ran out.
+	JITExpired JITStatus = "expired"
+)
+
+// The longest reason a device can give for a just-in-time access request.
+const MaxJITReasonLength = 200
+
+// The shortest and longest a Drawbridge admin can approve a just-in-time access request for.
+const (
+	MinJITDuration = time.Minute
+	MaxJITDuration = 7 * 24 * time.Hour
+)
+
+// A device asking for temporary access to a Protected Service that requires approval. Once the Drawbridge admin
+// approves it, the device can connect until ExpiresAt.
+type JITRequest struct {
+	ID        int64     `json:"id"`
+	DeviceID  string    `json:"device_id"`
+	ServiceID int64     `json:"service_id"`
+	Reason    string    `json:"reason"`
+	Status    JITStatus `json:"status"`
+	// In UTC.
+	RequestedAt time.Time `json:"requested_at"`
+	// Who approved or denied the request, e.g. "dashboard 127.0.0.1:51234", and when. Empty while it is pending.
+	DecidedBy string    `json:"decided_by,omitempty"`
+	DecidedAt time.Time `json:"decided_at,omitempty"`
+	// When an approved request stops letting the device in. Zero until it is approved.
+	ExpiresAt time.Time `json:"expires_at,omitempty"`
+}
+
+func (r *JITRequest) Validate() error {
+	r.Reason = strings.TrimSpace(r.Reason)
+	if r.DeviceID == "" {
+		return errors.New("a just-in-time access request needs a device")
+	}
+	if r.ServiceID == 0 {
+		return errors.New("a just-in-time access request needs a Protected Service")
+	}
+	if r.Reason == "" {
+		return errors.New("a just-in-time access request needs a reason")
+	}
+	if len(r.Reason) > MaxJITReasonLength {
+		return fmt.Errorf("the reason can be at most %d characters", MaxJITReasonLength)
+	}
+	return nil
+}
+
+// Reports whether the request lets its device connect at now.
+func (r *JITRequest) Active(now time.Time) bool {
+	return r.Status == JITApproved && now.Before(r.ExpiresAt)
+}
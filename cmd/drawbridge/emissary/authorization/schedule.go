@@ -0,0 +1,209 @@
+package authorization
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	// Schedules name IANA time zones, which Windows doesn't ship.
+	_ "time/tzdata"
+)
+
+// When Emissary devices may connect, e.g. weekday evenings in Europe/London. A schedule can be attached to a
+// Protected Service or to a policy. Outside its windows Drawbridge refuses new connections and, if EndSessions is
+// set, ends the ones already open.
+type Schedule struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+	// An IANA time zone, e.g. America/New_York. Windows and exceptions are in local time there.
+	Timezone   string      `json:"timezone"`
+	Windows    []Window    `json:"windows"`
+	Exceptions []Exception `json:"exceptions,omitempty"`
+	// Ends live sessions when a window closes, instead of only refusing new connections.
+	EndSessions bool `json:"end_sessions"`
+	// Timezone, loaded by Validate.
+	location *time.Location
+}
+
+// Open from Start until End on each of Days, e.g. {"days": ["friday", "saturday"], "start": "18:00", "end": "23:30"}.
+// A window that ends at or before it starts runs past midnight into the next day.
+type Window struct {
+	// Lowercase weekdays, e.g. monday.
+	Days  []string `json:"days" yaml:"days" toml:"days"`
+	Start string   `json:"start" yaml:"start" toml:"start"`
+	End   string   `json:"end" yaml:"end" toml:"end"`
+}
+
+// Replaces the weekly windows for one date, e.g. a public holiday. An exception that isn't Open closes the whole
+// date. An Open one is open from Start until End, or all day when they are left out.
+type Exception struct {
+	// In the schedule's time zone, e.g. 2024-12-25.
+	Date  string `json:"date" yaml:"date" toml:"date"`
+	Open  bool   `json:"open" yaml:"open" toml:"open"`
+	Start string `json:"start,omitempty" yaml:"start" toml:"start"`
+	End   string `json:"end,omitempty" yaml:"end" toml:"end"`
+}
+
+var weekdays = []string{"sunday", "monday", "tuesday", "wednesday", "thursday", "friday", "saturday"}
+
+func (s *Schedule) Validate() error {
+	if strings.TrimSpace(s.Name) == "" {
+		return errors.New("a schedule needs a name")
+	}
+	location, err := loadLocation(s.Timezone)
+	if err != nil {
+		return fmt.Errorf("unknown time zone %q, expected an IANA time zone like Europe/London", s.Timezone)
+	}
+	s.location = location
+	if len(s.Windows) == 0 && !slices.ContainsFunc(s.Exceptions, func(e Exception) bool { return e.Open }) {
+		return errors.New("a schedule needs at least one window")
+	}
+	for _, window := range s.Windows {
+		if len(window.Days) == 0 {
+			return fmt.Errorf("the %s-%s window needs at least one day", window.Start, window.End)
+		}
+		for _, day := range window.Days {
+			if !slices.Contains(weekdays, day) {
+				return fmt.Errorf("unknown day %q, expected one of %s", day, strings.Join(weekdays, ", "))
+			}
+		}
+		if _, _, err := parseTimeRange(window.Start, window.End); err != nil {
+			return err
+		}
+	}
+	dates := make(map[string]bool)
+	for _, exception := range s.Exceptions {
+		if _, err := time.Parse(time.DateOnly, exception.Date); err != nil {
+			return fmt.Errorf("invalid exception date %q, expected YYYY-MM-DD", exception.Date)
+		}
+		if dates[exception.Date] {
+			return fmt.Errorf("%s has more than one exception", exception.Date)
+		}
+		dates[exception.Date] = true
+		if exception.Start == "" && exception.End == "" {
+			continue
+		}
+		if !exception.Open {
+			return fmt.Errorf("the exception on %s is closed all day, so it can't have a start or end", exception.Date)
+		}
+		start, end, err := parseTimeRange(exception.Start, exception.End)
+		if err != nil {
+			return fmt.Errorf("the exception on %s: %w", exception.Date, err)
+		}
+		if end <= start {
+			return fmt.Errorf("the exception on %s must end after it starts", exception.Date)
+		}
+	}
+	return nil
+}
+
+// Parses times like 09:00 into minutes since midnight. 24:00 is the end of the day.
+func parseClock(clock string) (int, error) {
+	var hour, minute int
+	_, err := fmt.Sscanf(clock, "%d:%d", &hour, &minute)
+	if err != nil || len(clock) != len("00:00") || hour < 0 || minute < 0 || minute > 59 || hour > 24 || (hour == 24 && minute > 0) {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", clock)
+	}
+	return hour*60 + minute, nil
+}
+
+func parseTimeRange(start, end string) (int, int, error) {
+	startMinute, err := parseClock(start)
+	if err != nil {
+		return 0, 0, err
+	}
+	endMinute, err := parseClock(end)
+	if err != nil {
+		return 0, 0, err
+	}
+	if startMinute == 24*60 {
+		return 0, 0, fmt.Errorf("a window can't start at %s", start)
+	}
+	return startMinute, endMinute, nil
+}
+
+// Time zones by name, so schedules read from the database don't load theirs on every connection. Only IANA time
+// zones are cached, so it can't grow past the time zone database.
+var locationCache sync.Map
+
+func loadLocation(name string) (*time.Location, error) {
+	if cached, ok := locationCache.Load(name); ok {
+		return cached.(*time.Location), nil
+	}
+	// LoadLocation returns UTC for an empty name.
+	if name == "" {
+		return nil, errors.New("no time zone")
+	}
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, err
+	}
+	locationCache.Store(name, location)
+	return location, nil
+}
+
+// Returns the time zone the schedule's windows and exceptions are in.
+func (s *Schedule) Location() (*time.Location, error) {
+	if s.location != nil {
+		return s.location, nil
+	}
+	return loadLocation(s.Timezone)
+}
+
+// Reports whether the schedule allows connections at t. Schedules are validated when they are saved, so they
+// aren't validated again here, but a time zone, window or exception that doesn't parse never opens the schedule.
+func (s *Schedule) Open(t time.Time) bool {
+	location, err := s.Location()
+	if err != nil {
+		return false
+	}
+	local := t.In(location)
+	minute := local.Hour()*60 + local.Minute()
+	if exception, found := s.exception(local); found {
+		if !exception.Open {
+			return false
+		}
+		if exception.Start == "" && exception.End == "" {
+			return true
+		}
+		// Unlike windows, an exception doesn't run past midnight, as the next date has its own windows.
+		start, end, err := parseTimeRange(exception.Start, exception.End)
+		return err == nil && minute >= start && minute < end
+	}
+	today, yesterday := weekdays[local.Weekday()], weekdays[(local.Weekday()+6)%7]
+	for _, window := range s.Windows {
+		start, end, err := parseTimeRange(window.Start, window.End)
+		if err != nil {
+			continue
+		}
+		if slices.Contains(window.Days, today) && (minute >= start && (end <= start || minute < end)) {
+			return true
+		}
+		// The part of yesterday's window that runs past midnight.
+		if slices.Contains(window.Days, yesterday) && end <= start && minute < end {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Schedule) exception(local time.Time) (Exception, bool) {
+	date := local.Format(time.DateOnly)
+	for _, exception := range s.Exceptions {
+		if exception.Date == date {
+			return exception, true
+		}
+	}
+	return Exception{}, false
+}
+
+// Explains a denial, e.g. `schedule "Evenings" is closed at Mon 14:03 Europe/London`.
+func (s *Schedule) ClosedReason(t time.Time) string {
+	location, err := s.Location()
+	if err != nil {
+		location = time.UTC
+	}
+	return fmt.Sprintf("schedule %q is closed at %s %s", s.Name, t.In(location).Format("Mon 15:04"), s.Timezone)
+}
@@ -0,0 +1,97 @@
+package authorization
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScheduleOpen(t *testing.T) {
+	schedule := Schedule{
+		Name:     "Evenings",
+		Timezone: "Europe/London",
+		Windows: []Window{
+			{Days: []string{"monday", "tuesday", "wednesday", "thursday"}, Start: "18:00", End: "21:00"},
+			// Runs past midnight into Saturday.
+			{Days: []string{"friday"}, Start: "18:00", End: "01:00"},
+		},
+		Exceptions: []Exception{
+			{Date: "2024-12-24", Open: false},
+			{Date: "2024-12-26", Open: true, Start: "10:00", End: "12:00"},
+		},
+	}
+	if err := schedule.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+	london, _ := time.LoadLocation("Europe/London")
+	tests := []struct {
+		at   string
+		open bool
+	}{
+		{"2024-12-02 18:00", true},  // Monday
+		{"2024-12-02 17:59", false}, // Monday
+		{"2024-12-02 21:00", false}, // Monday
+		{"2024-12-06 23:30", true},  // Friday
+		{"2024-12-07 00:30", true},  // Saturday, after Friday's window
+		{"2024-12-07 01:00", false}, // Saturday
+		{"2024-12-07 19:00", false}, // Saturday
+		{"2024-12-24 19:00", false}, // Tuesday, closed for Christmas Eve
+		{"2024-12-26 11:00", true},  // Thursday, opened in the morning
+		{"2024-12-26 19:00", false}, // Thursday, the exception replaces the evening window
+		{"2024-07-01 18:30", true},  // Monday in British Summer Time
+	}
+	for _, test := range tests {
+		at, _ := time.ParseInLocation("2006-01-02 15:04", test.at, london)
+		// Evaluated in UTC, to check the schedule converts to its own time zone.
+		if got := schedule.Open(at.UTC()); got != test.open {
+			t.Errorf("%s: got open %t, wanted %t", test.at, got, test.open)
+		}
+	}
+	monday, _ := time.ParseInLocation("2006-01-02 15:04", "2024-12-02 14:03", london)
+	if reason := schedule.ClosedReason(monday); reason != `schedule "Evenings" is closed at Mon 14:03 Europe/London` {
+		t.Errorf("unexpected reason %q", reason)
+	}
+}
+
+// Schedules read back from the database aren't validated again, so whatever doesn't parse must keep them closed.
+func TestUnvalidatedSchedulesFailClosed(t *testing.T) {
+	monday := time.Date(2024, 12, 2, 12, 0, 0, 0, time.UTC)
+	for name, schedule := range map[string]Schedule{
+		"no time zone":      {Name: "x", Windows: []Window{{Days: []string{"monday"}, Start: "00:00", End: "24:00"}}},
+		"unknown time zone": {Name: "x", Timezone: "Mars/Olympus", Windows: []Window{{Days: []string{"monday"}, Start: "00:00", End: "24:00"}}},
+		"bad window":        {Name: "x", Timezone: "UTC", Windows: []Window{{Days: []string{"monday"}, Start: "noon", End: "midnight"}}},
+		"bad exception":     {Name: "x", Timezone: "UTC", Exceptions: []Exception{{Date: "2024-12-02", Open: true, Start: "noon", End: "13:00"}}},
+	} {
+		if schedule.Open(monday) {
+			t.Errorf("%s: expected the schedule to be closed", name)
+		}
+	}
+}
+
+func TestScheduleValidate(t *testing.T) {
+	window := []Window{{Days: []string{"monday"}, Start: "09:00", End: "17:00"}}
+	tests := map[string]Schedule{
+		"no name":           {Timezone: "UTC", Windows: window},
+		"unknown time zone": {Name: "x", Timezone: "Mars/Olympus_Mons", Windows: window},
+		"no windows":        {Name: "x", Timezone: "UTC"},
+		"no days":           {Name: "x", Timezone: "UTC", Windows: []Window{{Start: "09:00", End: "17:00"}}},
+		"unknown day":       {Name: "x", Timezone: "UTC", Windows: []Window{{Days: []string{"Monday"}, Start: "09:00", End: "17:00"}}},
+		"bad time":          {Name: "x", Timezone: "UTC", Windows: []Window{{Days: []string{"monday"}, Start: "9am", End: "17:00"}}},
+		"bad date":          {Name: "x", Timezone: "UTC", Windows: window, Exceptions: []Exception{{Date: "25/12/2024"}}},
+		"duplicate date":    {Name: "x", Timezone: "UTC", Windows: window, Exceptions: []Exception{{Date: "2024-12-25"}, {Date: "2024-12-25"}}},
+		"closed with times": {Name: "x", Timezone: "UTC", Windows: window, Exceptions: []Exception{{Date: "2024-12-25", Start: "09:00", End: "10:00"}}},
+		"backwards":         {Name: "x", Timezone: "UTC", Windows: window, Exceptions: []Exception{{Date: "2024-12-25", Open: true, Start: "10:00", End: "09:00"}}},
+	}
+	for name, schedule := range tests {
+		err := schedule.Validate()
+		if err == nil {
+			t.Errorf("%s: expected the schedule to be invalid", name)
+		}
+		if schedule.Open(time.Now()) {
+			t.Errorf("%s: expected an invalid schedule to be closed", name)
+		}
+	}
+	if err := (&Schedule{Name: "x", Timezone: "UTC", Windows: []Window{{Days: []string{"monday"}, Start: "24:00", End: "01:00"}}}).Validate(); err == nil || !strings.Contains(err.Error(), "can't start at 24:00") {
+		t.Errorf("expected a window starting at 24:00 to be invalid, got %v", err)
+	}
+}
@@ -1,5 +1,11 @@
 package emissary
 
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
 // A device that can be allowed to access resources beyond Drawbridge.
 type EmissaryClient struct {
 	ID   string
@@ -7,9 +13,47 @@ type EmissaryClient struct {
 	// The mTLS certificate Emissary uses to connect to Drawbridge.
 	DrawbridgeCertificate string
 	Revoked               uint8
+	// The groups the device is in, e.g. family or servers. Protected Services can be granted to groups.
+	Groups []string
+	// Free-form labels the Drawbridge admin uses to find devices, e.g. laptop or alice.
+	Tags []string
+}
+
+// Reports whether the device is in any of the groups.
+func (c *EmissaryClient) InAnyGroup(groups ...string) bool {
+	return slices.ContainsFunc(groups, func(group string) bool { return slices.Contains(c.Groups, group) })
 }
 
 type DeviceCertificate struct {
 	Revoked  uint8
 	DeviceID string
 }
+
+// The longest group name or tag Drawbridge stores.
+const maxLabelLength = 64
+
+// Cleans up group names or tags typed in by the Drawbridge admin: trims them, drops empty and repeated ones,
+// and sorts them. Groups and tags are stored and handed to policies comma separated, so they can't contain commas.
+func NormalizeLabels(labels []string) ([]string, error) {
+	var normalized []string
+	for _, label := range labels {
+		label = strings.TrimSpace(label)
+		if label == "" {
+			continue
+		}
+		if strings.Contains(label, ",") {
+			return nil, fmt.Errorf("%q can't contain a comma", label)
+		}
+		if len(label) > maxLabelLength {
+			return nil, fmt.Errorf("%q is longer than %d characters", label, maxLabelLength)
+		}
+		normalized = append(normalized, label)
+	}
+	slices.Sort(normalized)
+	return slices.Compact(normalized), nil
+}
+
+// Splits comma separated group names or tags, e.g. from a form field, and normalizes them.
+func ParseLabels(labels string) ([]string, error) {
+	return NormalizeLabels(strings.Split(labels, ","))
+}
@@ -0,0 +1,39 @@
+package emissary
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// What an Emissary client reports about the machine it runs on with the DV_PSTR command.
+type PostureReport struct {
+	ID       int64  `json:"-"`
+	DeviceID string `json:"-"`
+	// The operating system, lowercase, e.g. linux, windows, macos, android or ios.
+	OS        string `json:"os"`
+	OSVersion string `json:"os_version"`
+	Hostname  string `json:"hostname"`
+	// Whether the disk Emissary runs from is encrypted, e.g. with FileVault, BitLocker or LUKS.
+	DiskEncrypted   bool `json:"disk_encrypted"`
+	FirewallEnabled bool `json:"firewall_enabled"`
+	// When Drawbridge received the report, in UTC.
+	ReportedAt time.Time `json:"-"`
+}
+
+// Drawbridge keeps this many posture reports for each device, dropping the oldest.
+const MaxPostureHistory = 100
+
+// Checks a report from an Emissary client before it is stored, and lowercases its OS so policies can compare it.
+func (p *PostureReport) Normalize() error {
+	p.OS = strings.ToLower(strings.TrimSpace(p.OS))
+	p.OSVersion = strings.TrimSpace(p.OSVersion)
+	p.Hostname = strings.TrimSpace(p.Hostname)
+	if p.OS == "" {
+		return errors.New("a posture report needs an os")
+	}
+	if len(p.OS) > 64 || len(p.OSVersion) > 64 || len(p.Hostname) > 253 {
+		return errors.New("the os, os_version or hostname in the posture report is too long")
+	}
+	return nil
+}
@@ -0,0 +1,14 @@
+package emissary
+
+import "time"
+
+// A device Drawbridge stopped letting in to Protected Services because its connections looked like its certificate
+// was stolen. Unlike revoking, the device keeps its certificate, and the Drawbridge admin can release it.
+type Quarantine struct {
+	DeviceID string
+	// What the anomaly detector noticed, e.g. "new country: first connection from FR".
+	Reason string
+	Score  int
+	// In UTC.
+	QuarantinedAt time.Time
+}
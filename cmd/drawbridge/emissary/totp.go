@@ -0,0 +1,27 @@
+package emissary
+
+import "time"
+
+// A device's TOTP secret for step-up authentication to Protected Services that require it, and the state that
+// protects it from replayed and guessed codes.
+type TOTPEnrollment struct {
+	DeviceID string
+	// Base32 encoded, as shown to the authenticator app.
+	Secret string
+	// False until the Drawbridge admin enters a code from the authenticator app, so a QR code that was never
+	// scanned doesn't lock the device out of the services that require step-up.
+	Confirmed bool
+	// In UTC.
+	EnrolledAt time.Time
+	// The counter of the last code accepted, so it can't be used again.
+	LastCounter uint64
+	// Wrong codes in a row, reset by a right one or once the device is locked out.
+	Failures int
+	// Codes aren't checked until then. Zero when the device isn't locked out.
+	LockedUntil time.Time
+}
+
+// Reports whether the device is locked out of step-up authentication at now.
+func (e *TOTPEnrollment) Locked(now time.Time) bool {
+	return now.Before(e.LockedUntil)
+}
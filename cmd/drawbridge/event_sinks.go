@@ -0,0 +1,130 @@
+package drawbridge
+
+import (
+	"encoding/json"
+	"fmt"
+	"imdawon/drawbridge/cmd/drawbridge/emissary"
+	"imdawon/drawbridge/cmd/drawbridge/sinks"
+	"imdawon/drawbridge/cmd/utils"
+	"log/slog"
+	"path/filepath"
+	"time"
+)
+
+// The drawbridge_config setting holding the configured event sinks as a JSON array of sinks.Config.
+const eventSinksSetting = "event_sinks"
+
+// Where webhook sinks queue undelivered events, one directory per sink.
+const eventSinkQueueDirectory = "event_sinks"
+
+// The actor recorded for admin actions made from the Drawbridge Dashboard.
+const DashboardActor = "dashboard"
+
+func (d *Drawbridge) EventSinks() ([]sinks.Config, error) {
+	value, err := d.DB.GetDrawbridgeConfigValueByName(eventSinksSetting)
+	if err != nil {
+		return nil, err
+	}
+	if value == nil || *value == "" {
+		return nil, nil
+	}
+	var configs []sinks.Config
+	err = json.Unmarshal([]byte(*value), &configs)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %s setting: %w", eventSinksSetting, err)
+	}
+	return configs, nil
+}
+
+// Saves the event sinks and restarts them if they are running. Sinks without an id are given one.
+func (d *Drawbridge) SaveEventSinks(configs []sinks.Config) error {
+	for i := range configs {
+		if configs[i].ID == "" {
+			id, err := utils.NewUUID()
+			if err != nil {
+				return err
+			}
+			configs[i].ID = id
+		}
+		err := resolveEventSinkPaths(&configs[i]).Validate()
+		if err != nil {
+			return fmt.Errorf("event sink %s: %w", configs[i].Name, err)
+		}
+	}
+	value, err := json.Marshal(configs)
+	if err != nil {
+		return err
+	}
+	err = d.DB.CreateNewDrawbridgeConfigSettings(eventSinksSetting, string(value))
+	if err != nil {
+		return err
+	}
+	// Admin commands save the event sinks without running them.
+	if d.EventSinkDispatcher == nil {
+		return nil
+	}
+	return d.StartEventSinks()
+}
+
+// Starts the saved event sinks, replacing any already running. Sinks that fail to start are logged and skipped.
+func (d *Drawbridge) StartEventSinks() error {
+	configs, err := d.EventSinks()
+	if err != nil {
+		return err
+	}
+	for i := range configs {
+		configs[i] = *resolveEventSinkPaths(&configs[i])
+	}
+	err = d.EventSinkDispatcher.Configure(configs)
+	if err != nil {
+		slog.Error("Event Sink", slog.Any("Error starting event sinks", err))
+	}
+	return err
+}
+
+// Relative JSONL paths are relative to the Drawbridge data directory, and webhook sinks without a queue directory
+// queue in event_sinks/<id> there. Returns a copy so the saved settings keep the paths as the admin wrote them.
+func resolveEventSinkPaths(config *sinks.Config) *sinks.Config {
+	resolved := *config
+	if config.JSONL != nil && config.JSONL.Path != "" && !filepath.IsAbs(config.JSONL.Path) {
+		jsonl := *config.JSONL
+		jsonl.Path = utils.CreateDrawbridgeFilePath(jsonl.Path)
+		resolved.JSONL = &jsonl
+	}
+	if config.Webhook != nil && config.Webhook.QueueDirectory == "" {
+		webhook := *config.Webhook
+		webhook.QueueDirectory = utils.CreateDrawbridgeFilePath(filepath.Join(eventSinkQueueDirectory, config.ID))
+		resolved.Webhook = &webhook
+	}
+	return &resolved
+}
+
+// Saves an Emissary event and publishes it to the event sinks.
+func (d *Drawbridge) RecordEmissaryEvent(event emissary.Event) {
+	slog.Debug("Inserting Emissary Event...")
+	d.LocateEvent(&event)
+	err := d.DB.InsertEmissaryClientEvent(event)
+	if err != nil {
+		slog.Error("Emissary Event", slog.Any("DB Error", err))
+	}
+	d.EventSinkDispatcher.Publish(sinks.FromEmissaryEvent(event))
+	d.detectAnomalies(event)
+	d.recordDeviceBaseline(event)
+}
+
+// Publishes a change the Drawbridge admin made to the event sinks. Admin actions aren't Emissary events,
+// so they only go to the sinks.
+func (d *Drawbridge) RecordAdminAction(eventType, actor string, details map[string]string) {
+	id, err := utils.NewUUID()
+	if err != nil {
+		slog.Error("Admin Action", slog.Any("Error", err))
+	}
+	d.EventSinkDispatcher.Publish(sinks.Event{
+		ID:        id,
+		Type:      eventType,
+		Timestamp: time.Now().UTC(),
+		DeviceID:  details["device_id"],
+		Actor:     actor,
+		Details:   details,
+	})
+}
@@ -0,0 +1,146 @@
+package drawbridge
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+)
+
+// Settings in the drawbridge_config table controlling how long Emissary events are kept.
+const (
+	eventRetentionSetting        = "event_retention_days"
+	hourlyRollupRetentionSetting = "hourly_rollup_retention_days"
+	dailyRollupRetentionSetting  = "daily_rollup_retention_days"
+	// Events before the start of the UTC day this falls in have been rolled up for good.
+	eventRollupWatermarkSetting = "event_rollup_watermark"
+
+	// How often raw events are rolled up and pruned. The Device Fleet "Last Seen" column reads the rollups,
+	// so this is how stale it can be.
+	eventRollupInterval = time.Minute
+)
+
+// How many days of Emissary events Drawbridge keeps. Raw events are rolled up into hourly and daily rollups
+// before they are pruned, so the history outlives them.
+type EventRetention struct {
+	EventDays        int `schema:"event-retention-days"`
+	HourlyRollupDays int `schema:"hourly-rollup-retention-days"`
+	// 0 keeps daily rollups forever.
+	DailyRollupDays int `schema:"daily-rollup-retention-days"`
+}
+
+var DefaultEventRetention = EventRetention{
+	EventDays:        30,
+	HourlyRollupDays: 90,
+	DailyRollupDays:  0,
+}
+
+func (d *Drawbridge) EventRetention() EventRetention {
+	retention := DefaultEventRetention
+	for setting, days := range map[string]*int{
+		eventRetentionSetting:        &retention.EventDays,
+		hourlyRollupRetentionSetting: &retention.HourlyRollupDays,
+		dailyRollupRetentionSetting:  &retention.DailyRollupDays,
+	} {
+		value, err := d.DB.GetDrawbridgeConfigValueByName(setting)
+		if err != nil {
+			slog.Error("Database", slog.Any("Error getting "+setting, err))
+			continue
+		}
+		if value == nil || *value == "" {
+			continue
+		}
+		parsed, err := strconv.Atoi(*value)
+		if err != nil {
+			slog.Error("Event Retention", slog.String("Invalid "+setting, *value))
+			continue
+		}
+		*days = parsed
+	}
+	return retention
+}
+
+func (d *Drawbridge) SaveEventRetention(retention EventRetention) error {
+	if retention.EventDays < 1 || retention.HourlyRollupDays < 1 || retention.DailyRollupDays < 0 {
+		return fmt.Errorf("events and hourly rollups must be kept for at least 1 day")
+	}
+	for setting, days := range map[string]int{
+		eventRetentionSetting:        retention.EventDays,
+		hourlyRollupRetentionSetting: retention.HourlyRollupDays,
+		dailyRollupRetentionSetting:  retention.DailyRollupDays,
+	} {
+		err := d.DB.CreateNewDrawbridgeConfigSettings(setting, strconv.Itoa(days))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rolls up and prunes Emissary events in the background every eventRollupInterval, starting right away.
+func (d *Drawbridge) StartEventRollups() {
+	go func() {
+		for {
+			err := d.RollupAndPruneEvents(time.Now())
+			if err != nil {
+				slog.Error("Event Rollup", slog.Any("Error", err))
+			}
+			time.Sleep(eventRollupInterval)
+		}
+	}()
+}
+
+// Aggregates the raw events since the last run into the rollup tables, then prunes raw events and rollups
+// past their retention.
+func (d *Drawbridge) RollupAndPruneEvents(now time.Time) error {
+	var since time.Time
+	watermark, err := d.DB.GetDrawbridgeConfigValueByName(eventRollupWatermarkSetting)
+	if err != nil {
+		return err
+	}
+	if watermark != nil && *watermark != "" {
+		since, err = time.Parse(time.RFC3339, *watermark)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", eventRollupWatermarkSetting, err)
+		}
+	}
+	err = d.DB.RollupEmissaryClientEvents(since)
+	if err != nil {
+		return err
+	}
+	// Leave a margin for events that were being inserted while we read, so the next run picks them up.
+	newWatermark := now.Add(-eventRollupInterval).UTC()
+	err = d.DB.CreateNewDrawbridgeConfigSettings(eventRollupWatermarkSetting, newWatermark.Format(time.RFC3339))
+	if err != nil {
+		return err
+	}
+
+	retention := d.EventRetention()
+	pruneBefore := now.AddDate(0, 0, -retention.EventDays)
+	// The next run recomputes the whole UTC day the watermark falls in from raw events, so keep all of them.
+	if rolledUp := newWatermark.Truncate(24 * time.Hour); pruneBefore.After(rolledUp) {
+		pruneBefore = rolledUp
+	}
+	pruned, err := d.DB.PruneEmissaryClientEvents(pruneBefore)
+	if err != nil {
+		return err
+	}
+	if pruned > 0 {
+		slog.Debug("Event Rollup", slog.Int64("Pruned raw events", pruned))
+	}
+
+	hourlyBefore := now.AddDate(0, 0, -retention.HourlyRollupDays)
+	var dailyBefore time.Time
+	if retention.DailyRollupDays > 0 {
+		dailyBefore = now.AddDate(0, 0, -retention.DailyRollupDays)
+	}
+	return d.DB.PruneEmissaryClientEventRollups(hourlyBefore, dailyBefore)
+}
+
+// Adds the bytes proxied for a PS_CONN connection to its event so they are counted in the rollups.
+func (d *Drawbridge) recordEventBytes(eventID string, bytesIn, bytesOut int64) {
+	err := d.DB.RecordEmissaryClientEventBytes(eventID, bytesIn, bytesOut)
+	if err != nil {
+		slog.Error("Emissary Event", slog.Any("DB Error", err))
+	}
+}
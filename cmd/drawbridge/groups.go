@@ -0,0 +1,81 @@
+package drawbridge
+
+import (
+	"fmt"
+	"imdawon/drawbridge/cmd/drawbridge/emissary"
+	"imdawon/drawbridge/cmd/drawbridge/emissary/authorization"
+	"slices"
+)
+
+// Validates a grant and stores it. The Protected Service, and the grant's policy and schedule if it has them,
+// have to exist.
+func (d *Drawbridge) SaveGrant(grant authorization.Grant) (*authorization.Grant, error) {
+	err := grant.Validate()
+	if err != nil {
+		return nil, err
+	}
+	service, err := d.DB.GetServiceById(grant.ServiceID)
+	if err != nil {
+		return nil, err
+	}
+	if service.ID == 0 {
+		return nil, fmt.Errorf("there is no Protected Service with id %d", grant.ServiceID)
+	}
+	if grant.PolicyID != 0 {
+		policy, err := d.DB.GetPolicyById(grant.PolicyID)
+		if err != nil {
+			return nil, err
+		}
+		if policy.ID == 0 {
+			return nil, fmt.Errorf("policy id %d doesn't exist", grant.PolicyID)
+		}
+	}
+	if grant.ScheduleID != 0 {
+		schedule, err := d.DB.GetScheduleById(grant.ScheduleID)
+		if err != nil {
+			return nil, err
+		}
+		if schedule.ID == 0 {
+			return nil, fmt.Errorf("schedule id %d doesn't exist", grant.ScheduleID)
+		}
+	}
+	return d.DB.CreateNewGrant(grant)
+}
+
+// Normalizes and stores the groups and tags of a device, and returns the updated device.
+func (d *Drawbridge) SetDeviceGroupsAndTags(deviceID string, groups, tags []string) (*emissary.EmissaryClient, error) {
+	groups, err := emissary.NormalizeLabels(groups)
+	if err != nil {
+		return nil, fmt.Errorf("invalid group: %w", err)
+	}
+	tags, err = emissary.NormalizeLabels(tags)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tag: %w", err)
+	}
+	err = d.DB.UpdateEmissaryClientGroupsAndTags(deviceID, groups, tags)
+	if err != nil {
+		return nil, err
+	}
+	return d.DB.GetEmissaryClientById(deviceID)
+}
+
+// Returns every group a device is in or a Protected Service is granted to, sorted.
+func (d *Drawbridge) DeviceGroups() ([]string, error) {
+	clients, err := d.DB.GetAllEmissaryClients()
+	if err != nil {
+		return nil, err
+	}
+	grants, err := d.DB.GetAllGrants()
+	if err != nil {
+		return nil, err
+	}
+	var groups []string
+	for _, client := range clients {
+		groups = append(groups, client.Groups...)
+	}
+	for _, grant := range grants {
+		groups = append(groups, grant.Group)
+	}
+	slices.Sort(groups)
+	return slices.Compact(groups), nil
+}
@@ -0,0 +1,124 @@
+package drawbridge
+
+import (
+	"imdawon/drawbridge/cmd/drawbridge/emissary"
+	"imdawon/drawbridge/cmd/drawbridge/emissary/authorization"
+	"imdawon/drawbridge/cmd/drawbridge/persistence"
+	"imdawon/drawbridge/cmd/drawbridge/services"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGrantedAccess(t *testing.T) {
+	db := persistence.NewMemoryRepository()
+	d := &Drawbridge{DB: db}
+	db.CreateNewEmissaryClient(emissary.EmissaryClient{ID: "family-laptop", Name: "Brave Otter", DrawbridgeCertificate: "cert-1", Groups: []string{"family"}, Tags: []string{"laptop"}})
+	db.CreateNewEmissaryClient(emissary.EmissaryClient{ID: "friend-phone", Name: "Calm Heron", DrawbridgeCertificate: "cert-2", Groups: []string{"friends"}})
+	db.CreateNewEmissaryClient(emissary.EmissaryClient{ID: "ungrouped", Name: "Quiet Fox", DrawbridgeCertificate: "cert-3"})
+
+	closed, _ := d.SaveSchedule(authorization.Schedule{Name: "Never", Timezone: "UTC", Exceptions: neverOpen})
+	laptops, _ := d.SavePolicy(authorization.Policy{Name: "Laptops", Rules: authorization.Group{Match: authorization.MatchAll, Conditions: []authorization.Condition{
+		{Expression: `"laptop" in device.tags`},
+	}}})
+	plex, _ := db.CreateNewService(services.ProtectedService{Name: "Plex"})
+	minecraft, _ := db.CreateNewService(services.ProtectedService{Name: "Minecraft"})
+	ssh, _ := db.CreateNewService(services.ProtectedService{Name: "SSH"})
+	open, _ := db.CreateNewService(services.ProtectedService{Name: "Wiki"})
+
+	for _, grant := range []authorization.Grant{
+		{ServiceID: plex.ID, Group: "family"},
+		{ServiceID: plex.ID, Group: "friends", ScheduleID: closed.ID},
+		{ServiceID: minecraft.ID, Group: "friends"},
+		{ServiceID: minecraft.ID, Group: "family", PolicyID: laptops.ID},
+		{ServiceID: ssh.ID, Group: "family", PolicyID: laptops.ID},
+	} {
+		if _, err := d.SaveGrant(grant); err != nil {
+			t.Fatalf("SaveGrant(%+v) failed: %v", grant, err)
+		}
+	}
+	if _, err := d.SaveGrant(authorization.Grant{ServiceID: 999, Group: "family"}); err == nil {
+		t.Error("expected SaveGrant to refuse a grant to a missing Protected Service")
+	}
+	if _, err := d.SaveGrant(authorization.Grant{ServiceID: plex.ID, Group: "family", PolicyID: 999}); err == nil {
+		t.Error("expected SaveGrant to refuse a grant with a missing policy")
+	}
+
+	tests := []struct {
+		name    string
+		device  string
+		service int64
+		allowed bool
+		reason  string
+	}{
+		{"granted group", "family-laptop", plex.ID, true, ""},
+		{"granted group with a closed schedule", "friend-phone", plex.ID, false, `grant to friends: schedule "Never" is closed at`},
+		{"no group", "ungrouped", plex.ID, false, "only granted to the groups family, friends"},
+		{"group with a passing policy", "family-laptop", minecraft.ID, true, ""},
+		{"other group", "friend-phone", ssh.ID, false, "only granted to the groups family"},
+		{"no grants", "ungrouped", open.ID, true, ""},
+	}
+	for _, test := range tests {
+		decision := d.AuthorizeProtectedServiceConnection(test.device, "192.168.1.20:50000", test.service)
+		if decision.Allowed != test.allowed || !strings.Contains(decision.Reason, test.reason) {
+			t.Errorf("%s: got %+v, wanted allowed %t with a reason containing %q", test.name, decision, test.allowed, test.reason)
+		}
+	}
+
+	// Dropping the laptop tag fails the grant's policy.
+	if _, err := d.SetDeviceGroupsAndTags("family-laptop", []string{" family "}, nil); err != nil {
+		t.Fatalf("SetDeviceGroupsAndTags failed: %v", err)
+	}
+	decision := d.AuthorizeProtectedServiceConnection("family-laptop", "192.168.1.20:50000", ssh.ID)
+	if decision.Allowed || !strings.Contains(decision.Reason, `grant to family: policy "Laptops"`) {
+		t.Errorf("expected the grant's policy to deny the device without the laptop tag, got %+v", decision)
+	}
+	if _, err := d.SetDeviceGroupsAndTags("family-laptop", []string{"family, friends"}, nil); err == nil {
+		t.Error("expected SetDeviceGroupsAndTags to refuse a group with a comma")
+	}
+
+	groups, err := d.DeviceGroups()
+	if err != nil || strings.Join(groups, ",") != "family,friends" {
+		t.Errorf("expected the groups family and friends, got %v (%v)", groups, err)
+	}
+}
+
+func TestEnforceGrantSchedules(t *testing.T) {
+	db := persistence.NewMemoryRepository()
+	d := &Drawbridge{DB: db}
+	db.CreateNewEmissaryClient(emissary.EmissaryClient{ID: "friend", Name: "Calm Heron", DrawbridgeCertificate: "cert-1", Groups: []string{"friends"}})
+	db.CreateNewEmissaryClient(emissary.EmissaryClient{ID: "both", Name: "Brave Otter", DrawbridgeCertificate: "cert-2", Groups: []string{"family", "friends"}})
+	evenings, _ := d.SaveSchedule(authorization.Schedule{
+		Name:        "Evenings",
+		Timezone:    "UTC",
+		Windows:     []authorization.Window{{Days: []string{"monday"}, Start: "18:00", End: "22:00"}},
+		EndSessions: true,
+	})
+	plex, _ := db.CreateNewService(services.ProtectedService{Name: "Plex"})
+	d.SaveGrant(authorization.Grant{ServiceID: plex.ID, Group: "friends", ScheduleID: evenings.ID})
+	d.SaveGrant(authorization.Grant{ServiceID: plex.ID, Group: "family"})
+
+	for i, device := range []string{"friend", "both"} {
+		emissaryConn, other := net.Pipe()
+		defer other.Close()
+		event := emissary.Event{ID: string(rune('a' + i)), DeviceID: device, ConnectionIP: "192.168.1.20:50000", Timestamp: time.Now()}
+		d.startSession(event, plex.ID, emissaryConn)
+	}
+
+	monday := time.Date(2024, 12, 2, 21, 0, 0, 0, time.UTC)
+	if ended := d.EnforceSchedules(monday); ended != 0 {
+		t.Errorf("expected no sessions to end while the schedule is open, ended %d", ended)
+	}
+	if ended := d.EnforceSchedules(monday.Add(time.Hour)); ended != 1 {
+		t.Errorf("expected only the session let in by the closed grant alone to end, ended %d", ended)
+	}
+	sessions := d.Sessions()
+	if len(sessions) != 1 || sessions[0].DeviceID != "both" {
+		t.Fatalf("expected the session of the device the family grant lets in to be left, got %+v", sessions)
+	}
+	events, _ := db.QueryEmissaryClientEvents(emissary.EventQuery{Type: EventTypeTerminated})
+	if len(events.Events) != 1 || !strings.Contains(events.Events[0].Reason, `grant to friends: schedule "Evenings" is closed`) {
+		t.Errorf("expected a PS_TERM event with the grant's reason, got %+v", events.Events)
+	}
+}
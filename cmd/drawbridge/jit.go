@@ -0,0 +1,216 @@
+package drawbridge
+
+import (
+	"fmt"
+	"imdawon/drawbridge/cmd/drawbridge/emissary/authorization"
+	"imdawon/drawbridge/cmd/drawbridge/replication"
+	"imdawon/drawbridge/cmd/drawbridge/sinks"
+	"imdawon/drawbridge/cmd/utils"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The actor recorded for just-in-time access requests that expire on their own.
+const jitExpiryActor = "drawbridge"
+
+// Stores a device's request for temporary access to a Protected Service that requires approval, and publishes it to
+// the event sinks so the Drawbridge admin hears about it. A device can only have one pending request per service.
+func (d *Drawbridge) RequestJITAccess(deviceID string, serviceID int64, reason string) (*authorization.JITRequest, error) {
+	request := authorization.JITRequest{
+		DeviceID:    deviceID,
+		ServiceID:   serviceID,
+		Reason:      reason,
+		Status:      authorization.JITPending,
+		RequestedAt: time.Now().UTC(),
+	}
+	err := request.Validate()
+	if err != nil {
+		return nil, err
+	}
+	service, err := d.DB.GetServiceById(serviceID)
+	if err != nil {
+		return nil, err
+	}
+	if service.ID == 0 {
+		return nil, fmt.Errorf("there is no Protected Service with id %d", serviceID)
+	}
+	if !service.RequireApproval {
+		return nil, fmt.Errorf("%s doesn't require approval", service.Name)
+	}
+	pending, err := d.DB.GetJITRequestsForDevice(deviceID, serviceID, authorization.JITPending)
+	if err != nil {
+		return nil, err
+	}
+	if len(pending) > 0 {
+		return nil, fmt.Errorf("request %d for %s is already waiting for approval", pending[0].ID, service.Name)
+	}
+	stored, err := d.DB.CreateNewJITRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("Just-in-time Access", slog.String("Requested by", deviceID), slog.String("service", service.Name), slog.String("reason", stored.Reason))
+	d.recordJITEvent(sinks.TypeJITRequested, deviceID, stored)
+	return stored, nil
+}
+
+// Lets the device of a pending request connect to its Protected Service for duration.
+func (d *Drawbridge) ApproveJITRequest(id int64, duration time.Duration, actor string) (*authorization.JITRequest, error) {
+	if duration < authorization.MinJITDuration || duration > authorization.MaxJITDuration {
+		return nil, fmt.Errorf("requests can be approved for between %s and %s", authorization.MinJITDuration, authorization.MaxJITDuration)
+	}
+	return d.decideJITRequest(id, authorization.JITApproved, duration, actor)
+}
+
+// Turns down a pending request. The device can ask again.
+func (d *Drawbridge) DenyJITRequest(id int64, actor string) (*authorization.JITRequest, error) {
+	return d.decideJITRequest(id, authorization.JITDenied, 0, actor)
+}
+
+func (d *Drawbridge) decideJITRequest(id int64, status authorization.JITStatus, duration time.Duration, actor string) (*authorization.JITRequest, error) {
+	request, err := d.DB.GetJITRequestById(id)
+	if err != nil {
+		return nil, err
+	}
+	if request.ID == 0 {
+		return nil, fmt.Errorf("there is no just-in-time access request with id %d", id)
+	}
+	if request.Status != authorization.JITPending {
+		return nil, fmt.Errorf("request %d was already %s", id, request.Status)
+	}
+	now := time.Now().UTC()
+	request.Status = status
+	request.DecidedBy = actor
+	request.DecidedAt = now
+	eventType := sinks.TypeJITDenied
+	if status == authorization.JITApproved {
+		request.ExpiresAt = now.Add(duration)
+		eventType = sinks.TypeJITApproved
+	}
+	// Another Drawbridge admin may decide the request at the same time. Only the first decision is stored.
+	err = d.DB.UpdateJITRequest(request, authorization.JITPending)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("Just-in-time Access", slog.Int64("Request", id), slog.String("status", string(status)), slog.String("by", actor))
+	d.recordJITEvent(eventType, actor, request)
+	return request, nil
+}
+
+// Marks the approved requests that have run out at now as expired, and ends the sessions they let in unless another
+// approved request still lets the device in. Returns how many sessions were ended.
+func (d *Drawbridge) ExpireJITRequests(now time.Time) int {
+	// The standby gets the primary's expired requests through replication, and has no sessions to end.
+	role, err := replication.GetRole(d.DB)
+	if err != nil {
+		slog.Error("Just-in-time Access", slog.Any("Error reading replication role", err))
+	}
+	if role == replication.RoleStandby {
+		return 0
+	}
+	approved, err := d.DB.GetJITRequests([]authorization.JITStatus{authorization.JITApproved}, 0)
+	if err != nil {
+		slog.Error("Just-in-time Access", slog.Any("Error getting approved requests", err))
+		return 0
+	}
+	ended := 0
+	for i := range approved {
+		request := &approved[i]
+		if request.Active(now) {
+			continue
+		}
+		request.Status = authorization.JITExpired
+		err := d.DB.UpdateJITRequest(request, authorization.JITApproved)
+		if err != nil {
+			slog.Error("Just-in-time Access", slog.Int64("Request", request.ID), slog.Any("Error expiring request", err))
+			continue
+		}
+		d.recordJITEvent(sinks.TypeJITExpired, jitExpiryActor, request)
+		if !d.requiresApproval(request.ServiceID) || d.jitStep(request.DeviceID, request.ServiceID, now).Passed {
+			continue
+		}
+		ended += d.TerminateSessions(func(session Session) bool {
+			return session.DeviceID == request.DeviceID && session.ServiceID == request.ServiceID
+		}, fmt.Sprintf("just-in-time access request %d expired", request.ID))
+	}
+	return ended
+}
+
+// Sessions to a Protected Service that stopped requiring approval, or can't be looked up, are left alone.
+func (d *Drawbridge) requiresApproval(serviceID int64) bool {
+	service, err := d.DB.GetServiceById(serviceID)
+	if err != nil {
+		slog.Error("Just-in-time Access", slog.Any("Error getting Protected Service", err))
+		return false
+	}
+	return service.RequireApproval
+}
+
+// Checks whether the device has an approved request for the Protected Service at now, for the trace of an
+// authorization decision.
+func (d *Drawbridge) jitStep(deviceID string, serviceID int64, now time.Time) authorization.TraceStep {
+	const check = "just-in-time access"
+	approved, err := d.DB.GetJITRequestsForDevice(deviceID, serviceID, authorization.JITApproved)
+	if err != nil {
+		slog.Error("Authorization", slog.Any("Error getting just-in-time access requests", err))
+		return authorization.TraceStep{Check: check, Detail: "error getting the just-in-time access requests"}
+	}
+	for _, request := range approved {
+		if request.Active(now) {
+			return authorization.TraceStep{Check: check, Passed: true, Detail: fmt.Sprintf("request %d approved by %s until %s", request.ID, request.DecidedBy, request.ExpiresAt.Format(time.RFC3339))}
+		}
+	}
+	return authorization.TraceStep{Check: check}
+}
+
+// Publishes a just-in-time access request, with its current status, to the event sinks.
+func (d *Drawbridge) recordJITEvent(eventType, actor string, request *authorization.JITRequest) {
+	id, err := utils.NewUUID()
+	if err != nil {
+		slog.Error("Just-in-time Access", slog.Any("Error", err))
+	}
+	details := map[string]string{
+		"request_id": strconv.FormatInt(request.ID, 10),
+		"service_id": strconv.FormatInt(request.ServiceID, 10),
+		"status":     string(request.Status),
+	}
+	if !request.ExpiresAt.IsZero() {
+		details["expires_at"] = request.ExpiresAt.Format(time.RFC3339)
+	}
+	d.EventSinkDispatcher.Publish(sinks.Event{
+		ID:            id,
+		Type:          eventType,
+		Timestamp:     time.Now().UTC(),
+		DeviceID:      request.DeviceID,
+		TargetService: utils.PadWithZeros(int(request.ServiceID)),
+		Reason:        request.Reason,
+		Actor:         actor,
+		Details:       details,
+	})
+}
+
+// Handles PS_RQST <3 digit Protected Service id> <reason>, answering with the id of the stored request.
+func (d *Drawbridge) handleJITRequest(conn net.Conn, deviceID, payload string) {
+	defer conn.Close()
+	request, err := d.readJITRequest(deviceID, payload)
+	if err != nil {
+		slog.Warn("PS_RQST Handler", slog.String("device", deviceID), slog.Any("Error", err))
+		fmt.Fprintf(conn, "PS_RQST: ERR %s\n", strings.ReplaceAll(err.Error(), "\n", " "))
+		return
+	}
+	fmt.Fprintf(conn, "PS_RQST: OK %d\n", request.ID)
+}
+
+func (d *Drawbridge) readJITRequest(deviceID, payload string) (*authorization.JITRequest, error) {
+	if len(payload) < 12 {
+		return nil, fmt.Errorf("expected PS_RQST followed by a Protected Service id and a reason")
+	}
+	serviceID, err := strconv.Atoi(payload[8:11])
+	if err != nil {
+		return nil, fmt.Errorf("%q isn't a Protected Service id", payload[8:11])
+	}
+	reason, _, _ := strings.Cut(payload[12:], "\n")
+	return d.RequestJITAccess(deviceID, int64(serviceID), reason)
+}
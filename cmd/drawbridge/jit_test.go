@@ -0,0 +1,174 @@
+package drawbridge
+
+import (
+	"imdawon/drawbridge/cmd/drawbridge/emissary"
+	"imdawon/drawbridge/cmd/drawbridge/emissary/authorization"
+	"imdawon/drawbridge/cmd/drawbridge/persistence"
+	"imdawon/drawbridge/cmd/drawbridge/replication"
+	"imdawon/drawbridge/cmd/drawbridge/services"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestJITAccess(t *testing.T) {
+	db := persistence.NewMemoryRepository()
+	d := &Drawbridge{DB: db}
+	db.CreateNewEmissaryClient(emissary.EmissaryClient{ID: "laptop", Name: "Brave Otter", DrawbridgeCertificate: "cert-1"})
+	nas, _ := db.CreateNewService(services.ProtectedService{Name: "NAS SSH", RequireApproval: true})
+	plex, _ := db.CreateNewService(services.ProtectedService{Name: "Plex"})
+
+	decision := d.AuthorizeProtectedServiceConnection("laptop", "192.168.1.20:50000", nas.ID)
+	if decision.Allowed || decision.Reason != "NAS SSH needs an approved just-in-time access request" {
+		t.Errorf("expected the device to be denied without an approved request, got %+v", decision)
+	}
+
+	if _, err := d.RequestJITAccess("laptop", plex.ID, "Watch a film"); err == nil {
+		t.Error("expected RequestJITAccess to refuse a service that doesn't require approval")
+	}
+	if _, err := d.RequestJITAccess("laptop", nas.ID, "  "); err == nil {
+		t.Error("expected RequestJITAccess to refuse a request without a reason")
+	}
+	request, err := d.RequestJITAccess("laptop", nas.ID, " Fix the backups ")
+	if err != nil {
+		t.Fatalf("RequestJITAccess failed: %v", err)
+	}
+	if request.Status != authorization.JITPending || request.Reason != "Fix the backups" {
+		t.Errorf("expected a pending request with a trimmed reason, got %+v", request)
+	}
+	if _, err := d.RequestJITAccess("laptop", nas.ID, "Fix the backups again"); err == nil {
+		t.Error("expected RequestJITAccess to refuse a second pending request for the same service")
+	}
+
+	if _, err := d.ApproveJITRequest(request.ID, 30*time.Second, "dashboard"); err == nil {
+		t.Error("expected ApproveJITRequest to refuse a duration under a minute")
+	}
+	approved, err := d.ApproveJITRequest(request.ID, time.Hour, "dashboard 127.0.0.1:51234")
+	if err != nil {
+		t.Fatalf("ApproveJITRequest failed: %v", err)
+	}
+	if approved.Status != authorization.JITApproved || approved.DecidedBy != "dashboard 127.0.0.1:51234" || approved.ExpiresAt.Sub(approved.DecidedAt) != time.Hour {
+		t.Errorf("expected the request to be approved for an hour, got %+v", approved)
+	}
+	if _, err := d.DenyJITRequest(request.ID, "dashboard"); err == nil {
+		t.Error("expected DenyJITRequest to refuse a request that was already approved")
+	}
+	decision = d.AuthorizeProtectedServiceConnection("laptop", "192.168.1.20:50000", nas.ID)
+	if !decision.Allowed || !strings.Contains(decision.Trace[0].Detail, "approved by dashboard 127.0.0.1:51234") {
+		t.Errorf("expected the approved request to let the device in, got %+v", decision)
+	}
+
+	emissaryConn, other := net.Pipe()
+	defer other.Close()
+	d.startSession(emissary.Event{ID: "session", DeviceID: "laptop", ConnectionIP: "192.168.1.20:50000", Timestamp: time.Now()}, nas.ID, emissaryConn)
+	if ended := d.ExpireJITRequests(time.Now()); ended != 0 {
+		t.Errorf("expected no sessions to end before the request expires, ended %d", ended)
+	}
+	if ended := d.ExpireJITRequests(time.Now().Add(2 * time.Hour)); ended != 1 {
+		t.Errorf("expected the session to end once the request expired, ended %d", ended)
+	}
+	expired, _ := db.GetJITRequestById(request.ID)
+	if expired.Status != authorization.JITExpired {
+		t.Errorf("expected the request to be expired, got %+v", expired)
+	}
+	events, _ := db.QueryEmissaryClientEvents(emissary.EventQuery{Type: EventTypeTerminated})
+	if len(events.Events) != 1 || events.Events[0].Reason != "just-in-time access request 1 expired" {
+		t.Errorf("expected a PS_TERM event for the expired request, got %+v", events.Events)
+	}
+
+	again, _ := d.RequestJITAccess("laptop", nas.ID, "Fix the backups")
+	denied, err := d.DenyJITRequest(again.ID, "dashboard")
+	if err != nil || denied.Status != authorization.JITDenied {
+		t.Errorf("expected the request to be denied, got %+v: %v", denied, err)
+	}
+	if decision := d.AuthorizeProtectedServiceConnection("laptop", "192.168.1.20:50000", nas.ID); decision.Allowed {
+		t.Errorf("expected the device to be denied once its request expired, got %+v", decision)
+	}
+}
+
+// Two Drawbridge admins deciding the same request at once: only the first decision counts.
+func TestJITConcurrentDecisions(t *testing.T) {
+	db := persistence.NewMemoryRepository()
+	d := &Drawbridge{DB: db}
+	nas, _ := db.CreateNewService(services.ProtectedService{Name: "NAS SSH", RequireApproval: true})
+
+	for i := 0; i < 20; i++ {
+		request, err := d.RequestJITAccess("laptop", nas.ID, "Fix the backups")
+		if err != nil {
+			t.Fatalf("RequestJITAccess failed: %v", err)
+		}
+		decided := make(chan *authorization.JITRequest, 2)
+		var decisions sync.WaitGroup
+		for _, decide := range []func() (*authorization.JITRequest, error){
+			func() (*authorization.JITRequest, error) { return d.ApproveJITRequest(request.ID, time.Hour, "admin") },
+			func() (*authorization.JITRequest, error) { return d.DenyJITRequest(request.ID, "other-admin") },
+		} {
+			decisions.Add(1)
+			go func() {
+				defer decisions.Done()
+				if request, err := decide(); err == nil {
+					decided <- request
+				}
+			}()
+		}
+		decisions.Wait()
+		close(decided)
+		if len(decided) != 1 {
+			t.Fatalf("expected exactly one decision to be accepted, got %d", len(decided))
+		}
+		winner := <-decided
+		if stored, _ := db.GetJITRequestById(request.ID); stored.Status != winner.Status || stored.DecidedBy != winner.DecidedBy {
+			t.Fatalf("expected the stored request to match the accepted decision %+v, got %+v", winner, stored)
+		}
+	}
+}
+
+func TestHandleJITRequest(t *testing.T) {
+	db := persistence.NewMemoryRepository()
+	d := &Drawbridge{DB: db}
+	nas, _ := db.CreateNewService(services.ProtectedService{Name: "NAS SSH", RequireApproval: true})
+
+	tests := []struct {
+		payload  string
+		response string
+	}{
+		{"PS_RQST 001 Fix the backups\n", "PS_RQST: OK 1\n"},
+		{"PS_RQST 001 Fix the backups\n", "PS_RQST: ERR request 1 for NAS SSH is already waiting for approval\n"},
+		{"PS_RQST 002 Fix the backups\n", "PS_RQST: ERR there is no Protected Service with id 2\n"},
+		{"PS_RQST 001\n", "PS_RQST: ERR a just-in-time access request needs a reason\n"},
+		{"PS_RQST 01", "PS_RQST: ERR expected PS_RQST followed by a Protected Service id and a reason\n"},
+	}
+	for _, test := range tests {
+		drawbridgeConn, emissaryConn := net.Pipe()
+		go d.handleJITRequest(drawbridgeConn, "laptop", test.payload)
+		buf := make([]byte, 256)
+		n, _ := emissaryConn.Read(buf)
+		emissaryConn.Close()
+		if got := string(buf[:n]); got != test.response {
+			t.Errorf("%q: got %q, wanted %q", test.payload, got, test.response)
+		}
+	}
+	pending, _ := db.GetJITRequestsForDevice("laptop", nas.ID, authorization.JITPending)
+	if len(pending) != 1 || pending[0].Reason != "Fix the backups" {
+		t.Errorf("expected one pending request, got %+v", pending)
+	}
+}
+
+func TestJITRequestsExpireOnThePrimary(t *testing.T) {
+	db := persistence.NewMemoryRepository()
+	d := &Drawbridge{DB: db}
+	db.CreateNewEmissaryClient(emissary.EmissaryClient{ID: "laptop", Name: "Brave Otter", DrawbridgeCertificate: "cert-1"})
+	nas, _ := db.CreateNewService(services.ProtectedService{Name: "NAS SSH", RequireApproval: true})
+	request, _ := d.RequestJITAccess("laptop", nas.ID, "Fix the backups")
+	if _, err := d.ApproveJITRequest(request.ID, time.Hour, "dashboard"); err != nil {
+		t.Fatalf("ApproveJITRequest failed: %v", err)
+	}
+
+	db.CreateNewDrawbridgeConfigSettings("replication_role", string(replication.RoleStandby))
+	d.ExpireJITRequests(time.Now().Add(2 * time.Hour))
+	if replicated, _ := db.GetJITRequestById(request.ID); replicated.Status != authorization.JITApproved {
+		t.Errorf("expected a standby to leave expiring the request to the primary, got %+v", replicated)
+	}
+}
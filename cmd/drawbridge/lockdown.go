@@ -0,0 +1,242 @@
+package drawbridge
+
+import (
+	"encoding/json"
+	"fmt"
+	"imdawon/drawbridge/cmd/drawbridge/emissary/authorization"
+	"imdawon/drawbridge/cmd/drawbridge/lockdown"
+	"imdawon/drawbridge/cmd/drawbridge/replication"
+	"imdawon/drawbridge/cmd/drawbridge/sinks"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// The setting in the drawbridge_config table for the JSON encoded ids of the devices still let in during lockdown.
+	breakGlassSetting = "lockdown_break_glass"
+
+	lockdownCheck = "emergency lockdown"
+
+	// How often a running Drawbridge checks for lockdown engaged or lifted with `drawbridge lockdown`, which runs in
+	// another process, and ends the sessions lockdown doesn't let in.
+	lockdownEnforcementInterval = 5 * time.Second
+
+	// How many transitions a running Drawbridge catches up on each interval, and the Drawbridge Dashboard lists.
+	RecentLockdownTransitions = 10
+)
+
+// Keeps transitions from being engaged twice or published twice when the Drawbridge Dashboard, a signal and
+// `drawbridge lockdown` race each other.
+type lockdownState struct {
+	mu sync.Mutex
+	// The latest transition published to the event sinks.
+	published int64
+}
+
+// Turns away every Emissary device except the break-glass devices, and ends the live sessions of the others. Lockdown
+// lasts until it is lifted, across restarts.
+func (d *Drawbridge) EngageLockdown(actor, reason string) error {
+	// The standby follows the primary's lockdown.
+	err := d.CheckWritable()
+	if err != nil {
+		return err
+	}
+	d.lockdown.mu.Lock()
+	current, err := d.DB.GetLockdown()
+	if err != nil {
+		d.lockdown.mu.Unlock()
+		return err
+	}
+	if current.Active {
+		d.lockdown.mu.Unlock()
+		return fmt.Errorf("Drawbridge has been in lockdown since %s", current.CreatedAt.Format(time.RFC1123))
+	}
+	transition, err := d.DB.CreateLockdownTransition(lockdown.Transition{Active: true, Actor: actor, Reason: reason, CreatedAt: time.Now().UTC()})
+	if err != nil {
+		d.lockdown.mu.Unlock()
+		return err
+	}
+	d.publishLockdownTransition(*transition)
+	d.lockdown.mu.Unlock()
+	d.enforceLockdown(transition)
+	return nil
+}
+
+func (d *Drawbridge) LiftLockdown(actor string) error {
+	err := d.CheckWritable()
+	if err != nil {
+		return err
+	}
+	d.lockdown.mu.Lock()
+	defer d.lockdown.mu.Unlock()
+	current, err := d.DB.GetLockdown()
+	if err != nil {
+		return err
+	}
+	if !current.Active {
+		return fmt.Errorf("Drawbridge isn't in lockdown")
+	}
+	transition, err := d.DB.CreateLockdownTransition(lockdown.Transition{Active: false, Actor: actor, CreatedAt: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+	d.publishLockdownTransition(*transition)
+	return nil
+}
+
+// Must be called with d.lockdown.mu held.
+func (d *Drawbridge) publishLockdownTransition(transition lockdown.Transition) {
+	if transition.ID <= d.lockdown.published {
+		return
+	}
+	d.lockdown.published = transition.ID
+	eventType := sinks.TypeLockdownLifted
+	if transition.Active {
+		eventType = sinks.TypeLockdownEngaged
+		slog.Warn("Lockdown", slog.String("Engaged by", transition.Actor), slog.String("reason", transition.Reason))
+	} else {
+		slog.Warn("Lockdown", slog.String("Lifted by", transition.Actor))
+	}
+	d.RecordAdminAction(eventType, transition.Actor, map[string]string{"reason": transition.Reason})
+}
+
+// Ends the live sessions of the devices that aren't break-glass devices, and closes the Emissary Outbound Protected
+// Services they registered. Returns how many sessions were ended.
+func (d *Drawbridge) enforceLockdown(transition *lockdown.Transition) int {
+	breakGlass := d.BreakGlassDevices()
+	d.CloseOutboundServices(func(deviceID string) bool {
+		return !slices.Contains(breakGlass, deviceID)
+	}, lockdownReason(transition))
+	return d.TerminateSessions(func(session Session) bool {
+		return !slices.Contains(breakGlass, session.DeviceID)
+	}, lockdownReason(transition))
+}
+
+// Checks every lockdownEnforcementInterval for lockdown engaged or lifted outside this Drawbridge, publishing the
+// transitions to the event sinks and ending sessions while Drawbridge is in lockdown.
+func (d *Drawbridge) StartLockdownEnforcement() {
+	// Transitions from before Drawbridge started were published when they were made, or can't be anymore.
+	current, err := d.DB.GetLockdown()
+	if err != nil {
+		slog.Error("Lockdown", slog.Any("Error getting lockdown", err))
+	} else {
+		d.lockdown.mu.Lock()
+		d.lockdown.published = current.ID
+		d.lockdown.mu.Unlock()
+	}
+	go func() {
+		for {
+			time.Sleep(lockdownEnforcementInterval)
+			d.EnforceLockdown()
+		}
+	}()
+}
+
+// Publishes the transitions made since the last one this Drawbridge published, and ends the sessions lockdown
+// doesn't let in. Returns how many sessions were ended.
+func (d *Drawbridge) EnforceLockdown() int {
+	d.lockdown.mu.Lock()
+	transitions, err := d.DB.GetLockdownTransitions(RecentLockdownTransitions)
+	if err != nil || len(transitions) == 0 {
+		d.lockdown.mu.Unlock()
+		if err != nil {
+			slog.Error("Lockdown", slog.Any("Error getting lockdown", err))
+		}
+		return 0
+	}
+	if transitions[0].ID > d.lockdown.published {
+		// The standby gets the primary's transitions through replication, and the primary already published them.
+		role, err := replication.GetRole(d.DB)
+		if err != nil {
+			slog.Error("Lockdown", slog.Any("Error reading replication role", err))
+		}
+		if role == replication.RoleStandby {
+			d.lockdown.published = transitions[0].ID
+		}
+		for i := len(transitions) - 1; i >= 0; i-- {
+			d.publishLockdownTransition(transitions[i])
+		}
+	}
+	d.lockdown.mu.Unlock()
+	if !transitions[0].Active {
+		return 0
+	}
+	return d.enforceLockdown(&transitions[0])
+}
+
+// e.g. "Drawbridge is in lockdown: leaked Emissary bundle"
+func lockdownReason(transition *lockdown.Transition) string {
+	if transition.Reason == "" {
+		return "Drawbridge is in lockdown"
+	}
+	return "Drawbridge is in lockdown: " + transition.Reason
+}
+
+// Returns why lockdown turns the device away, or "" if Drawbridge isn't in lockdown or the device is a break-glass
+// device. Anything that goes wrong looking up the lockdown turns the device away.
+func (d *Drawbridge) checkLockdown(deviceID string) string {
+	current, err := d.DB.GetLockdown()
+	if err != nil {
+		slog.Error("Lockdown", slog.Any("Error getting lockdown", err))
+		return "error getting the lockdown"
+	}
+	if !current.Active || slices.Contains(d.BreakGlassDevices(), deviceID) {
+		return ""
+	}
+	return lockdownReason(current)
+}
+
+// Decides whether a device may register an Emissary Outbound Protected Service with OB_CR8T. Only lockdown and
+// quarantine turn devices away.
+func (d *Drawbridge) AuthorizeOutboundRegistration(deviceID string) authorization.Decision {
+	if reason := d.checkLockdown(deviceID); reason != "" {
+		return denied(nil, lockdownCheck, reason)
+	}
+	if reason := d.checkQuarantine(deviceID); reason != "" {
+		return denied(nil, quarantineCheck, reason)
+	}
+	return authorization.Decision{Allowed: true}
+}
+
+// The ids of the devices lockdown lets in, sorted. Returns no devices if they can't be read, so lockdown lets
+// nobody in rather than everybody.
+func (d *Drawbridge) BreakGlassDevices() []string {
+	value, err := d.DB.GetDrawbridgeConfigValueByName(breakGlassSetting)
+	if err != nil {
+		slog.Error("Database", slog.Any("Error getting "+breakGlassSetting, err))
+		return nil
+	}
+	if value == nil || *value == "" {
+		return nil
+	}
+	var deviceIDs []string
+	err = json.Unmarshal([]byte(*value), &deviceIDs)
+	if err != nil {
+		slog.Error("Lockdown", slog.String("Invalid "+breakGlassSetting, *value))
+		return nil
+	}
+	return deviceIDs
+}
+
+func (d *Drawbridge) SaveBreakGlassDevices(deviceIDs []string) error {
+	deviceIDs = slices.Compact(slices.Sorted(slices.Values(deviceIDs)))
+	for _, deviceID := range deviceIDs {
+		device, err := d.DB.GetEmissaryClientById(deviceID)
+		if err != nil {
+			return err
+		}
+		if device.ID == "" {
+			return fmt.Errorf("there is no device with id %s", deviceID)
+		}
+	}
+	if deviceIDs == nil {
+		deviceIDs = []string{}
+	}
+	encoded, err := json.Marshal(deviceIDs)
+	if err != nil {
+		return err
+	}
+	return d.DB.CreateNewDrawbridgeConfigSettings(breakGlassSetting, string(encoded))
+}
@@ -0,0 +1,18 @@
+// Package lockdown describes Drawbridge's emergency lockdown: one switch that turns away every Emissary device
+// except a list of break-glass devices, and ends the live sessions of the others.
+package lockdown
+
+import "time"
+
+// Drawbridge going into or coming out of lockdown. The latest transition is the current state, and the earlier ones
+// are kept as a record of who locked Drawbridge down and why.
+type Transition struct {
+	ID int64
+	// True when the transition engaged lockdown, false when it lifted it.
+	Active bool
+	// The Drawbridge admin, "cli" for `drawbridge lockdown`, or "signal" for SIGUSR1.
+	Actor  string
+	Reason string
+	// In UTC.
+	CreatedAt time.Time
+}
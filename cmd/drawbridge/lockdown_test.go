@@ -0,0 +1,124 @@
+package drawbridge
+
+import (
+	"errors"
+	"imdawon/drawbridge/cmd/drawbridge/emissary"
+	"imdawon/drawbridge/cmd/drawbridge/lockdown"
+	"imdawon/drawbridge/cmd/drawbridge/persistence"
+	"imdawon/drawbridge/cmd/drawbridge/replication"
+	"imdawon/drawbridge/cmd/drawbridge/services"
+	"io"
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestLockdown(t *testing.T) {
+	db := persistence.NewMemoryRepository()
+	d := &Drawbridge{DB: db}
+	db.CreateNewEmissaryClient(emissary.EmissaryClient{ID: "laptop", Name: "Brave Otter", DrawbridgeCertificate: "cert-1"})
+	db.CreateNewEmissaryClient(emissary.EmissaryClient{ID: "admin-phone", Name: "Quiet Heron", DrawbridgeCertificate: "cert-2"})
+	nas, _ := db.CreateNewService(services.ProtectedService{Name: "NAS"})
+
+	if err := d.SaveBreakGlassDevices([]string{"admin-phone", "stolen"}); err == nil {
+		t.Error("expected SaveBreakGlassDevices to refuse a device that doesn't exist")
+	}
+	if err := d.SaveBreakGlassDevices([]string{"admin-phone", "admin-phone"}); err != nil {
+		t.Fatalf("SaveBreakGlassDevices failed: %v", err)
+	}
+	if breakGlass := d.BreakGlassDevices(); !slices.Equal(breakGlass, []string{"admin-phone"}) {
+		t.Errorf("expected the break-glass devices to be saved once each, got %v", breakGlass)
+	}
+
+	for _, device := range []string{"laptop", "admin-phone"} {
+		serverConn, clientConn := net.Pipe()
+		defer clientConn.Close()
+		d.startSession(emissary.Event{ID: device + "-session", DeviceID: device, ConnectionIP: "203.0.113.7:50000"}, nas.ID, serverConn)
+	}
+	// The laptop and the admin's phone both host an Emissary Outbound Protected Service.
+	d.OutboundServices = make(map[int64]*services.ProtectedService)
+	laptopOutbound, laptopClient := net.Pipe()
+	defer laptopClient.Close()
+	go io.ReadFull(laptopClient, make([]byte, len("ACK")))
+	d.handleEmissaryOutboundRegistration(laptopOutbound, "laptop", "Minecraft")
+	phoneOutbound, phoneClient := net.Pipe()
+	defer phoneClient.Close()
+	d.OutboundServices[998] = &services.ProtectedService{ID: 998, Name: "Camera", Conn: phoneOutbound, OutboundDeviceID: "admin-phone"}
+	if err := d.LiftLockdown("admin"); err == nil {
+		t.Error("expected LiftLockdown to fail when Drawbridge isn't in lockdown")
+	}
+	if err := d.EngageLockdown("admin", "leaked Emissary bundle"); err != nil {
+		t.Fatalf("EngageLockdown failed: %v", err)
+	}
+	if err := d.EngageLockdown("signal", "SIGUSR1"); err == nil {
+		t.Error("expected EngageLockdown to fail when Drawbridge is already in lockdown")
+	}
+	if sessions := d.Sessions(); len(sessions) != 1 || sessions[0].DeviceID != "admin-phone" {
+		t.Errorf("expected lockdown to end every session but the break-glass device's, got %+v", sessions)
+	}
+	if _, registered := d.OutboundServices[999]; registered || len(d.OutboundServices) != 1 || d.OutboundServices[998].OutboundDeviceID != "admin-phone" {
+		t.Errorf("expected lockdown to close every Emissary Outbound Protected Service but the break-glass device's, got %+v", d.OutboundServices)
+	}
+	if _, err := laptopClient.Read(make([]byte, 1)); err == nil {
+		t.Error("expected lockdown to close the laptop's Emissary Outbound connection")
+	}
+	terminated, _ := db.QueryEmissaryClientEvents(emissary.EventQuery{DeviceID: "laptop", Type: EventTypeTerminated})
+	if len(terminated.Events) != 2 {
+		t.Errorf("expected a PS_TERM event for the laptop's session and its Emissary Outbound Protected Service, got %+v", terminated.Events)
+	}
+	decision := d.AuthorizeProtectedServiceConnection("laptop", "203.0.113.7:50000", nas.ID)
+	if decision.Allowed || decision.Reason != "Drawbridge is in lockdown: leaked Emissary bundle" {
+		t.Errorf("expected lockdown to deny the laptop, got %+v", decision)
+	}
+	if decision := d.AuthorizeOutboundRegistration("laptop"); decision.Allowed {
+		t.Errorf("expected lockdown to deny registering an Emissary Outbound Protected Service, got %+v", decision)
+	}
+	if decision := d.AuthorizeProtectedServiceConnection("admin-phone", "203.0.113.7:50000", nas.ID); !decision.Allowed {
+		t.Errorf("expected lockdown to let the break-glass device in, got %+v", decision)
+	}
+
+	// `drawbridge lockdown` runs in another process. The running Drawbridge only sees what it stored.
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	d.startSession(emissary.Event{ID: "late-session", DeviceID: "laptop", ConnectionIP: "203.0.113.7:50000"}, nas.ID, serverConn)
+	if ended := d.EnforceLockdown(); ended != 1 {
+		t.Errorf("expected enforcing lockdown to end the session that got in, ended %d", ended)
+	}
+
+	if err := d.LiftLockdown("cli"); err != nil {
+		t.Fatalf("LiftLockdown failed: %v", err)
+	}
+	if decision := d.AuthorizeProtectedServiceConnection("laptop", "203.0.113.7:50000", nas.ID); !decision.Allowed {
+		t.Errorf("expected lifting lockdown to let the laptop in again, got %+v", decision)
+	}
+	transitions, err := db.GetLockdownTransitions(RecentLockdownTransitions)
+	if err != nil || len(transitions) != 2 || transitions[0].Active || transitions[0].Actor != "cli" || !transitions[1].Active || transitions[1].Actor != "admin" {
+		t.Errorf("expected both transitions to be recorded, got %+v: %v", transitions, err)
+	}
+}
+
+func TestLockdownPersists(t *testing.T) {
+	db := persistence.NewMemoryRepository()
+	db.CreateLockdownTransition(lockdown.Transition{Active: true, Actor: "cli", CreatedAt: time.Now()})
+	nas, _ := db.CreateNewService(services.ProtectedService{Name: "NAS"})
+
+	// A Drawbridge started after lockdown was engaged stays in lockdown.
+	d := &Drawbridge{DB: db}
+	decision := d.AuthorizeProtectedServiceConnection("laptop", "203.0.113.7:50000", nas.ID)
+	if decision.Allowed || decision.Reason != "Drawbridge is in lockdown" {
+		t.Errorf("expected lockdown to outlast a restart, got %+v", decision)
+	}
+}
+
+func TestLockdownOnStandby(t *testing.T) {
+	db := persistence.NewMemoryRepository()
+	db.CreateNewDrawbridgeConfigSettings("replication_role", string(replication.RoleStandby))
+	d := &Drawbridge{DB: db}
+	if err := d.EngageLockdown("signal", "SIGUSR1"); !errors.Is(err, ErrStandbyReadOnly) {
+		t.Errorf("expected a standby to refuse to engage lockdown, got %v", err)
+	}
+	if current, _ := db.GetLockdown(); current.Active {
+		t.Error("a standby should follow the primary's lockdown, not engage its own")
+	}
+}
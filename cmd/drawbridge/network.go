@@ -0,0 +1,149 @@
+package drawbridge
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"imdawon/drawbridge/cmd/drawbridge/emissary"
+	"imdawon/drawbridge/cmd/drawbridge/network"
+	"log/slog"
+	"strings"
+)
+
+// Settings in the drawbridge_config table for source network rules.
+const (
+	// The JSON encoded network.Rules every connection to Drawbridge has to pass.
+	networkRulesSetting = "network_rules"
+	// Paths to MaxMind-format GeoIP databases on this server, one per line.
+	GeoIPDatabasesSetting = "geoip_databases"
+)
+
+// The global network rules, checked for every connection before its preamble is read. Protected Services can add
+// their own on top.
+func (d *Drawbridge) NetworkRules() network.Rules {
+	var rules network.Rules
+	value, err := d.DB.GetDrawbridgeConfigValueByName(networkRulesSetting)
+	if err != nil {
+		slog.Error("Database", slog.Any("Error getting "+networkRulesSetting, err))
+		return rules
+	}
+	if value == nil || *value == "" {
+		return rules
+	}
+	err = json.Unmarshal([]byte(*value), &rules)
+	if err != nil {
+		slog.Error("Network Rules", slog.String("Invalid "+networkRulesSetting, *value))
+	}
+	return rules
+}
+
+func (d *Drawbridge) SaveNetworkRules(rules network.Rules) error {
+	err := d.ValidateNetworkRules(&rules)
+	if err != nil {
+		return err
+	}
+	encoded, err := json.Marshal(rules)
+	if err != nil {
+		return err
+	}
+	return d.DB.CreateNewDrawbridgeConfigSettings(networkRulesSetting, string(encoded))
+}
+
+// Validates global or Protected Service network rules. Country and ASN rules need a GeoIP database, or every
+// connection they allow would be refused.
+func (d *Drawbridge) ValidateNetworkRules(rules *network.Rules) error {
+	err := rules.Validate()
+	if err != nil {
+		return err
+	}
+	if rules.UsesGeoIP() && d.geoIP.Load() == nil {
+		return errors.New("country and ASN rules need a GeoIP database, set one up first")
+	}
+	return nil
+}
+
+// Returns why the global network rules refuse a connection from connectionIP, or an empty string if they don't.
+func (d *Drawbridge) CheckNetworkRules(connectionIP string) string {
+	rules := d.NetworkRules()
+	return d.checkNetworkRules(&rules, connectionIP)
+}
+
+func (d *Drawbridge) checkNetworkRules(rules *network.Rules, connectionIP string) string {
+	if rules.Empty() {
+		return ""
+	}
+	addr, err := network.ParseIP(connectionIP)
+	if err != nil {
+		return err.Error()
+	}
+	return rules.Check(addr, d.geoIP.Load().Lookup(addr))
+}
+
+func (d *Drawbridge) GeoIPDatabases() []string {
+	value, err := d.DB.GetDrawbridgeConfigValueByName(GeoIPDatabasesSetting)
+	if err != nil {
+		slog.Error("Database", slog.Any("Error getting "+GeoIPDatabasesSetting, err))
+		return nil
+	}
+	if value == nil {
+		return nil
+	}
+	return strings.Fields(*value)
+}
+
+// Opens the GeoIP databases and, once they all open, starts using them and saves their paths.
+// No paths stops using GeoIP, as long as no network rules need it.
+func (d *Drawbridge) SaveGeoIPDatabases(paths []string) error {
+	if len(paths) == 0 {
+		rules := d.NetworkRules()
+		if rules.UsesGeoIP() {
+			return errors.New("the network rules have country or ASN rules, remove them first")
+		}
+		d.geoIP.Store(nil)
+		return d.DB.DeleteDrawbridgeConfigSetting(GeoIPDatabasesSetting)
+	}
+	geoIP, err := network.OpenGeoIP(paths...)
+	if err != nil {
+		return err
+	}
+	err = d.DB.CreateNewDrawbridgeConfigSettings(GeoIPDatabasesSetting, strings.Join(paths, "\n"))
+	if err != nil {
+		return err
+	}
+	d.geoIP.Store(geoIP)
+	return nil
+}
+
+// Opens the GeoIP databases saved in the settings, if there are any. Drawbridge keeps running without them, and
+// country and ASN rules refuse the connections they would have allowed.
+func (d *Drawbridge) LoadGeoIP() {
+	paths := d.GeoIPDatabases()
+	if len(paths) == 0 {
+		return
+	}
+	geoIP, err := network.OpenGeoIP(paths...)
+	if err != nil {
+		slog.Error("GeoIP", slog.Any("Error opening the GeoIP databases", err))
+		return
+	}
+	slog.Info(fmt.Sprintf("Loaded GeoIP databases %s", strings.Join(paths, ", ")))
+	d.geoIP.Store(geoIP)
+}
+
+// Returns where connectionIP is, as far as the GeoIP databases know.
+func (d *Drawbridge) Locate(connectionIP string) network.Location {
+	addr, err := network.ParseIP(connectionIP)
+	if err != nil {
+		return network.Location{}
+	}
+	return d.geoIP.Load().Lookup(addr)
+}
+
+// Fills in the country and ASN of an event that doesn't have them yet.
+func (d *Drawbridge) LocateEvent(event *emissary.Event) {
+	if event.Country != "" || event.ASN != 0 || event.ConnectionIP == "" {
+		return
+	}
+	location := d.Locate(event.ConnectionIP)
+	event.Country, event.ASN = location.Country, location.ASN
+}
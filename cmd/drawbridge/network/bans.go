@@ -0,0 +1,54 @@
+package network
+
+import "time"
+
+// Why a connection to the Emissary listener counted against its source IP.
+const (
+	FailureHandshake          = "failed TLS handshake"
+	FailureUnknownCertificate = "unknown certificate"
+	FailureRevokedCertificate = "revoked certificate"
+	FailureMalformedRequest   = "malformed request"
+)
+
+const (
+	// Failures from one source IP within FailureWindow that get it banned.
+	MaxFailures   = 10
+	FailureWindow = 10 * time.Minute
+	// A ban that ended more than this long ago is forgotten, so the IP's next ban is the shortest one again.
+	BanMemory = 30 * 24 * time.Hour
+)
+
+// How long each ban of the same IP lasts, e.g. its third ban lasts 6 hours. Bans after the last one last as long.
+var BanDurations = []time.Duration{15 * time.Minute, time.Hour, 6 * time.Hour, 24 * time.Hour, 7 * 24 * time.Hour}
+
+// A source IP the Emissary listener refuses connections from, after too many failed handshakes or malformed
+// requests.
+type Ban struct {
+	IP     string `json:"ip"`
+	Reason string `json:"reason"`
+	// How many times the IP has been banned in a row, counting this ban.
+	Offenses  int       `json:"offenses"`
+	BannedAt  time.Time `json:"banned_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func (b *Ban) Active(now time.Time) bool {
+	return b.IP != "" && now.Before(b.ExpiresAt)
+}
+
+// Returns how long the nth ban of the same IP lasts, counting from 1.
+func BanDuration(offense int) time.Duration {
+	if offense < 1 {
+		offense = 1
+	}
+	return BanDurations[min(offense, len(BanDurations))-1]
+}
+
+// Returns the ban for reason starting at now, escalated from previous, the IP's last ban, unless it was forgotten.
+func NextBan(previous Ban, ip, reason string, now time.Time) Ban {
+	offenses := 1
+	if previous.IP != "" && now.Sub(previous.ExpiresAt) < BanMemory {
+		offenses = previous.Offenses + 1
+	}
+	return Ban{IP: ip, Reason: reason, Offenses: offenses, BannedAt: now, ExpiresAt: now.Add(BanDuration(offenses))}
+}
@@ -0,0 +1,127 @@
+// Package network decides which source networks may connect to Drawbridge, from CIDR lists and the country and
+// autonomous system of the connection IP.
+//
+// Countries and autonomous systems come from local MaxMind-format (.mmdb) databases, e.g. GeoLite2-Country and
+// GeoLite2-ASN, so Drawbridge never sends connection IPs anywhere to look them up.
+package network
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// Where an IP address is, as far as the GeoIP databases know. Unknown fields are left empty.
+type Location struct {
+	// The ISO 3166-1 alpha-2 country code, e.g. GB.
+	Country string
+	// The autonomous system number, e.g. 13335.
+	ASN uint
+	// The organization the autonomous system is registered to, e.g. CLOUDFLARENET.
+	Organization string
+}
+
+func (l Location) String() string {
+	var parts []string
+	if l.Country != "" {
+		parts = append(parts, l.Country)
+	}
+	if l.ASN != 0 {
+		parts = append(parts, fmt.Sprintf("AS%d", l.ASN))
+	}
+	if l.Organization != "" {
+		parts = append(parts, l.Organization)
+	}
+	return strings.Join(parts, " ")
+}
+
+// The fields of the MaxMind Country, City and ASN databases Drawbridge uses. Databases from other vendors in the
+// same format use the same names.
+type geoIPRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	// Used when the database doesn't know where the IP is, only where its network is registered.
+	RegisteredCountry struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+	ASN          uint   `maxminddb:"autonomous_system_number"`
+	Organization string `maxminddb:"autonomous_system_organization"`
+}
+
+// Looks up locations in one or more GeoIP databases, e.g. a country database and an ASN database.
+// A nil *GeoIP knows nothing, so every location is empty.
+type GeoIP struct {
+	paths   []string
+	readers []*maxminddb.Reader
+}
+
+// Reads each database into memory, so a GeoIP can be replaced while lookups are still using it.
+func OpenGeoIP(paths ...string) (*GeoIP, error) {
+	if len(paths) == 0 {
+		return nil, errors.New("no GeoIP databases given")
+	}
+	geoIP := &GeoIP{paths: paths}
+	for _, path := range paths {
+		contents, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading the GeoIP database %s: %w", path, err)
+		}
+		reader, err := maxminddb.FromBytes(contents)
+		if err != nil {
+			return nil, fmt.Errorf("%s isn't a MaxMind-format database: %w", path, err)
+		}
+		geoIP.readers = append(geoIP.readers, reader)
+	}
+	return geoIP, nil
+}
+
+func (g *GeoIP) Paths() []string {
+	if g == nil {
+		return nil
+	}
+	return g.paths
+}
+
+// Merges what each database knows about the address. The first database to know a field wins.
+func (g *GeoIP) Lookup(addr netip.Addr) Location {
+	var location Location
+	if g == nil || !addr.IsValid() {
+		return location
+	}
+	ip := net.IP(addr.Unmap().AsSlice())
+	for _, reader := range g.readers {
+		var record geoIPRecord
+		err := reader.Lookup(ip, &record)
+		if err != nil {
+			continue
+		}
+		if location.Country == "" {
+			location.Country = record.Country.ISOCode
+			if location.Country == "" {
+				location.Country = record.RegisteredCountry.ISOCode
+			}
+		}
+		if location.ASN == 0 {
+			location.ASN, location.Organization = record.ASN, record.Organization
+		}
+	}
+	return location
+}
+
+// Parses a connection IP as Drawbridge records it, with or without a port, e.g. [2001:db8::1]:50000.
+func ParseIP(connectionIP string) (netip.Addr, error) {
+	if addrPort, err := netip.ParseAddrPort(connectionIP); err == nil {
+		return addrPort.Addr().Unmap(), nil
+	}
+	addr, err := netip.ParseAddr(strings.Trim(connectionIP, "[]"))
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("invalid connection IP %q", connectionIP)
+	}
+	return addr.Unmap(), nil
+}
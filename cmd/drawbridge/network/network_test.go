@@ -0,0 +1,208 @@
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// Writes a small IPv4 MaxMind-format database mapping each prefix to its record, e.g.
+// {"country": map[string]any{"iso_code": "GB"}}. See https://maxmind.github.io/MaxMind-DB/.
+func writeTestDatabase(t *testing.T, records map[string]map[string]any) string {
+	t.Helper()
+	type node struct {
+		children [2]*node
+		// Offsets into the data section plus one, or 0 for no data.
+		data [2]int
+	}
+	var dataSection bytes.Buffer
+	root := &node{}
+	for cidr, record := range records {
+		prefix := netip.MustParsePrefix(cidr)
+		offset := dataSection.Len()
+		encodeTestValue(&dataSection, record)
+		ip := prefix.Addr().As4()
+		current := root
+		for bit := 0; bit < prefix.Bits(); bit++ {
+			side := (ip[bit/8] >> (7 - bit%8)) & 1
+			if bit == prefix.Bits()-1 {
+				current.data[side] = offset + 1
+				break
+			}
+			if current.children[side] == nil {
+				current.children[side] = &node{}
+			}
+			current = current.children[side]
+		}
+	}
+	// Nodes are numbered breadth first, the root being 0.
+	nodes := []*node{root}
+	for i := 0; i < len(nodes); i++ {
+		for _, child := range nodes[i].children {
+			if child != nil {
+				nodes = append(nodes, child)
+			}
+		}
+	}
+	index := make(map[*node]int, len(nodes))
+	for i, n := range nodes {
+		index[n] = i
+	}
+	var file bytes.Buffer
+	for _, n := range nodes {
+		for side := range 2 {
+			record := len(nodes)
+			switch {
+			case n.children[side] != nil:
+				record = index[n.children[side]]
+			case n.data[side] != 0:
+				record = len(nodes) + 16 + n.data[side] - 1
+			}
+			file.Write([]byte{byte(record >> 16), byte(record >> 8), byte(record)})
+		}
+	}
+	file.Write(make([]byte, 16))
+	file.Write(dataSection.Bytes())
+	file.WriteString("\xAB\xCD\xEFMaxMind.com")
+	encodeTestValue(&file, map[string]any{
+		"binary_format_major_version": uint(2),
+		"binary_format_minor_version": uint(0),
+		"build_epoch":                 uint(1700000000),
+		"database_type":               "Drawbridge-Test",
+		"ip_version":                  uint(4),
+		"node_count":                  uint(len(nodes)),
+		"record_size":                 uint(24),
+	})
+	path := filepath.Join(t.TempDir(), "test.mmdb")
+	if err := os.WriteFile(path, file.Bytes(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// Encodes strings, uints as uint32s, and maps, which is all the test databases need.
+func encodeTestValue(buf *bytes.Buffer, value any) {
+	switch value := value.(type) {
+	case string:
+		// Longer sizes are stored in the byte after the control byte.
+		if len(value) >= 29 {
+			buf.Write([]byte{2<<5 | 29, byte(len(value) - 29)})
+		} else {
+			buf.WriteByte(2<<5 | byte(len(value)))
+		}
+		buf.WriteString(value)
+	case uint:
+		encoded := binary.BigEndian.AppendUint32(nil, uint32(value))
+		encoded = bytes.TrimLeft(encoded, "\x00")
+		buf.WriteByte(6<<5 | byte(len(encoded)))
+		buf.Write(encoded)
+	case map[string]any:
+		buf.WriteByte(7<<5 | byte(len(value)))
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			encodeTestValue(buf, key)
+			encodeTestValue(buf, value[key])
+		}
+	}
+}
+
+func testGeoIP(t *testing.T) *GeoIP {
+	countries := writeTestDatabase(t, map[string]map[string]any{
+		"81.2.69.0/24":    {"country": map[string]any{"iso_code": "GB"}},
+		"175.16.199.0/24": {"country": map[string]any{"iso_code": "CN"}},
+		// Only the registered country is known.
+		"89.160.20.0/24": {"registered_country": map[string]any{"iso_code": "SE"}},
+	})
+	asns := writeTestDatabase(t, map[string]map[string]any{
+		"81.2.69.0/24": {"autonomous_system_number": uint(20712), "autonomous_system_organization": "Andrews & Arnold Ltd"},
+		"1.1.1.0/24":   {"autonomous_system_number": uint(13335), "autonomous_system_organization": "CLOUDFLARENET"},
+	})
+	geoIP, err := OpenGeoIP(countries, asns)
+	if err != nil {
+		t.Fatalf("OpenGeoIP failed: %v", err)
+	}
+	return geoIP
+}
+
+func TestGeoIPLookup(t *testing.T) {
+	geoIP := testGeoIP(t)
+	tests := map[string]Location{
+		"81.2.69.142:50000":    {Country: "GB", ASN: 20712, Organization: "Andrews & Arnold Ltd"},
+		"[::ffff:1.1.1.1]:443": {ASN: 13335, Organization: "CLOUDFLARENET"},
+		"89.160.20.112":        {Country: "SE"},
+		"10.0.0.1:50000":       {},
+		"[2001:db8::1]:50000":  {},
+	}
+	for connectionIP, want := range tests {
+		addr, err := ParseIP(connectionIP)
+		if err != nil {
+			t.Fatalf("ParseIP(%s) failed: %v", connectionIP, err)
+		}
+		if got := geoIP.Lookup(addr); got != want {
+			t.Errorf("%s: got %+v, wanted %+v", connectionIP, got, want)
+		}
+	}
+	if got := (*GeoIP)(nil).Lookup(netip.MustParseAddr("81.2.69.142")); got != (Location{}) {
+		t.Errorf("expected a nil GeoIP to know nothing, got %+v", got)
+	}
+	if got := geoIP.Lookup(netip.MustParseAddr("81.2.69.142")).String(); got != "GB AS20712 Andrews & Arnold Ltd" {
+		t.Errorf("unexpected location string %q", got)
+	}
+	if _, err := OpenGeoIP(filepath.Join(t.TempDir(), "missing.mmdb")); err == nil {
+		t.Error("expected OpenGeoIP to fail for a missing database")
+	}
+}
+
+func TestRules(t *testing.T) {
+	geoIP := testGeoIP(t)
+	tests := []struct {
+		name   string
+		rules  Rules
+		ip     string
+		reason string
+	}{
+		{"no rules", Rules{}, "81.2.69.142", ""},
+		{"allowed network", Rules{AllowCIDRs: []string{"10.0.0.0/8"}}, "10.1.2.3", ""},
+		{"outside allowed networks", Rules{AllowCIDRs: []string{"10.0.0.0/8"}}, "81.2.69.142", "isn't in an allowed network"},
+		{"deny wins", Rules{AllowCIDRs: []string{"10.0.0.0/8"}, DenyCIDRs: []string{"10.1.0.0/16"}}, "10.1.2.3", "denied network 10.1.0.0/16"},
+		{"allowed country", Rules{AllowCountries: []string{"gb"}}, "81.2.69.142", ""},
+		{"registered country", Rules{AllowCountries: []string{"SE"}}, "89.160.20.112", ""},
+		{"denied country", Rules{DenyCountries: []string{"CN"}}, "175.16.199.10", "denied country CN"},
+		{"allowed ASN", Rules{AllowCountries: []string{"GB"}, AllowASNs: []uint{13335}}, "1.1.1.1", ""},
+		{"denied ASN", Rules{DenyASNs: []uint{13335}}, "1.1.1.1", "denied autonomous system AS13335"},
+		{"unknown location", Rules{AllowCountries: []string{"GB"}}, "192.0.2.1", "are unknown"},
+		{"deny rules let unknown locations through", Rules{DenyCountries: []string{"CN"}}, "192.0.2.1", ""},
+		{"an allowed network doesn't need a location", Rules{AllowCIDRs: []string{"192.0.2.0/24"}, AllowCountries: []string{"GB"}}, "192.0.2.1", ""},
+		{"IPv6", Rules{AllowCIDRs: []string{"2001:db8::/32"}}, "2001:db8::1", ""},
+		{"IPv4-mapped", Rules{AllowCIDRs: []string{"10.0.0.0/8"}}, "::ffff:10.1.2.3", ""},
+	}
+	for _, test := range tests {
+		if err := test.rules.Validate(); err != nil {
+			t.Fatalf("%s: Validate failed: %v", test.name, err)
+		}
+		addr := netip.MustParseAddr(test.ip)
+		reason := test.rules.Check(addr, geoIP.Lookup(addr))
+		if (test.reason == "") != (reason == "") || !strings.Contains(reason, test.reason) {
+			t.Errorf("%s: got %q, wanted %q", test.name, reason, test.reason)
+		}
+	}
+
+	for name, rules := range map[string]Rules{
+		"bad CIDR":    {AllowCIDRs: []string{"10.0.0.0/33"}},
+		"bad country": {DenyCountries: []string{"GBR"}},
+		"ASN 0":       {AllowASNs: []uint{0}},
+	} {
+		if err := rules.Validate(); err == nil {
+			t.Errorf("%s: expected the rules to be invalid", name)
+		}
+	}
+}
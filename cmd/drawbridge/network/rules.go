@@ -0,0 +1,92 @@
+package network
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// Source network rules for connections to Drawbridge or to one Protected Service. A connection matching any deny
+// rule is refused. When there are allow rules, a connection has to match at least one of them. No rules lets every
+// connection through.
+type Rules struct {
+	AllowCIDRs []string `json:"allow_cidrs,omitempty" yaml:"allow_cidrs" toml:"allow_cidrs"`
+	DenyCIDRs  []string `json:"deny_cidrs,omitempty" yaml:"deny_cidrs" toml:"deny_cidrs"`
+	// ISO 3166-1 alpha-2 country codes, e.g. GB.
+	AllowCountries []string `json:"allow_countries,omitempty" yaml:"allow_countries" toml:"allow_countries"`
+	DenyCountries  []string `json:"deny_countries,omitempty" yaml:"deny_countries" toml:"deny_countries"`
+	// Autonomous system numbers, e.g. 13335.
+	AllowASNs []uint `json:"allow_asns,omitempty" yaml:"allow_asns" toml:"allow_asns"`
+	DenyASNs  []uint `json:"deny_asns,omitempty" yaml:"deny_asns" toml:"deny_asns"`
+}
+
+func (r *Rules) Empty() bool {
+	return !r.allows() && len(r.DenyCIDRs) == 0 && len(r.DenyCountries) == 0 && len(r.DenyASNs) == 0
+}
+
+func (r *Rules) allows() bool {
+	return len(r.AllowCIDRs) > 0 || len(r.AllowCountries) > 0 || len(r.AllowASNs) > 0
+}
+
+// Reports whether the rules need a GeoIP database to be checked.
+func (r *Rules) UsesGeoIP() bool {
+	return len(r.AllowCountries) > 0 || len(r.DenyCountries) > 0 || len(r.AllowASNs) > 0 || len(r.DenyASNs) > 0
+}
+
+// Checks every CIDR and country code, and uppercases the country codes.
+func (r *Rules) Validate() error {
+	for _, cidr := range slices.Concat(r.AllowCIDRs, r.DenyCIDRs) {
+		if _, err := netip.ParsePrefix(cidr); err != nil {
+			return fmt.Errorf("invalid CIDR %q, expected e.g. 10.0.0.0/8", cidr)
+		}
+	}
+	for _, countries := range []*[]string{&r.AllowCountries, &r.DenyCountries} {
+		for i, country := range *countries {
+			country = strings.ToUpper(strings.TrimSpace(country))
+			if len(country) != 2 || strings.Trim(country, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") != "" {
+				return fmt.Errorf("invalid country %q, expected a two letter code like GB", (*countries)[i])
+			}
+			(*countries)[i] = country
+		}
+	}
+	if slices.Contains(r.AllowASNs, 0) || slices.Contains(r.DenyASNs, 0) {
+		return fmt.Errorf("0 isn't an autonomous system number")
+	}
+	return nil
+}
+
+// Returns why a connection from addr isn't allowed, or an empty string if it is. The rules must be valid.
+// Country and ASN rules can't match an address the GeoIP databases don't know, so only deny rules let it through.
+func (r *Rules) Check(addr netip.Addr, location Location) string {
+	addr = addr.Unmap()
+	for _, cidr := range r.DenyCIDRs {
+		if prefix, err := netip.ParsePrefix(cidr); err == nil && prefix.Contains(addr) {
+			return fmt.Sprintf("%s is in the denied network %s", addr, cidr)
+		}
+	}
+	if location.Country != "" && slices.Contains(r.DenyCountries, location.Country) {
+		return fmt.Sprintf("%s is in the denied country %s", addr, location.Country)
+	}
+	if location.ASN != 0 && slices.Contains(r.DenyASNs, location.ASN) {
+		return fmt.Sprintf("%s is in the denied autonomous system AS%d", addr, location.ASN)
+	}
+	if !r.allows() {
+		return ""
+	}
+	for _, cidr := range r.AllowCIDRs {
+		if prefix, err := netip.ParsePrefix(cidr); err == nil && prefix.Contains(addr) {
+			return ""
+		}
+	}
+	if location.Country != "" && slices.Contains(r.AllowCountries, location.Country) {
+		return ""
+	}
+	if location.ASN != 0 && slices.Contains(r.AllowASNs, location.ASN) {
+		return ""
+	}
+	if r.UsesGeoIP() && location == (Location{}) {
+		return fmt.Sprintf("%s isn't in an allowed network, and its country and autonomous system are unknown", addr)
+	}
+	return fmt.Sprintf("%s isn't in an allowed network", addr)
+}
@@ -0,0 +1,51 @@
+package drawbridge
+
+import (
+	"imdawon/drawbridge/cmd/drawbridge/emissary"
+	"imdawon/drawbridge/cmd/drawbridge/network"
+	"imdawon/drawbridge/cmd/drawbridge/persistence"
+	"imdawon/drawbridge/cmd/drawbridge/services"
+	"strings"
+	"testing"
+)
+
+func TestNetworkRules(t *testing.T) {
+	db := persistence.NewMemoryRepository()
+	d := &Drawbridge{DB: db}
+	db.CreateNewEmissaryClient(emissary.EmissaryClient{ID: "device-1", Name: "Brave Otter", DrawbridgeCertificate: "cert-1"})
+
+	if err := d.SaveNetworkRules(network.Rules{AllowCountries: []string{"GB"}}); err == nil {
+		t.Error("expected SaveNetworkRules to refuse country rules without a GeoIP database")
+	}
+	if err := d.SaveNetworkRules(network.Rules{AllowCIDRs: []string{"192.168.1.0/24", "2001:db8::/32"}, DenyCIDRs: []string{"192.168.1.66/32"}}); err != nil {
+		t.Fatalf("SaveNetworkRules failed: %v", err)
+	}
+	for connectionIP, want := range map[string]string{
+		"192.168.1.20:50000":    "",
+		"[2001:db8::1]:50000":   "",
+		"[::ffff:192.168.1.20]": "",
+		"192.168.1.66:50000":    "denied network 192.168.1.66/32",
+		"10.0.0.1:50000":        "isn't in an allowed network",
+	} {
+		if reason := d.CheckNetworkRules(connectionIP); !strings.Contains(reason, want) || (want == "") != (reason == "") {
+			t.Errorf("CheckNetworkRules(%q) = %q, wanted %q", connectionIP, reason, want)
+		}
+	}
+
+	// Protected Service rules are checked on top of the global ones, when the device connects to that service.
+	service, _ := db.CreateNewService(services.ProtectedService{Name: "SSH", NetworkRules: network.Rules{AllowCIDRs: []string{"192.168.1.16/28"}}})
+	if decision := d.AuthorizeProtectedServiceConnection("device-1", "192.168.1.20:50000", service.ID); !decision.Allowed {
+		t.Errorf("expected a connection from the service's network to be allowed, got %+v", decision)
+	}
+	decision := d.AuthorizeProtectedServiceConnection("device-1", "192.168.1.2:50000", service.ID)
+	if decision.Allowed || !strings.Contains(decision.Reason, "the network rules of SSH") {
+		t.Errorf("expected a connection from outside the service's network to be denied, got %+v", decision)
+	}
+
+	// No GeoIP databases leaves events without a location.
+	event := emissary.Event{ConnectionIP: "192.168.1.20:50000"}
+	d.LocateEvent(&event)
+	if event.Country != "" || event.ASN != 0 {
+		t.Errorf("expected no location without a GeoIP database, got %s AS%d", event.Country, event.ASN)
+	}
+}
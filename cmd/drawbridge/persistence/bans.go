@@ -0,0 +1,96 @@
+package persistence
+
+import (
+	"database/sql"
+	"fmt"
+	"imdawon/drawbridge/cmd/drawbridge/network"
+	"time"
+)
+
+func (r *SQLiteRepository) GetIPBan(ip string) (*network.Ban, error) {
+	rows, err := r.db.Query("SELECT ip, reason, offenses, banned_at, expires_at FROM ip_bans WHERE ip = ?", ip)
+	if err != nil {
+		return nil, fmt.Errorf("error getting the ban of %s: %w", ip, err)
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return &network.Ban{}, rows.Err()
+	}
+	return scanIPBan(rows)
+}
+
+func (r *SQLiteRepository) GetActiveIPBans(now time.Time) ([]network.Ban, error) {
+	rows, err := r.db.Query("SELECT ip, reason, offenses, banned_at, expires_at FROM ip_bans WHERE expires_at > ? ORDER BY banned_at DESC, ip", formatOptionalTime(now))
+	if err != nil {
+		return nil, fmt.Errorf("error getting active bans: %w", err)
+	}
+	defer rows.Close()
+
+	var bans []network.Ban
+	for rows.Next() {
+		ban, err := scanIPBan(rows)
+		if err != nil {
+			return nil, err
+		}
+		bans = append(bans, *ban)
+	}
+	return bans, rows.Err()
+}
+
+func scanIPBan(rows *sql.Rows) (*network.Ban, error) {
+	var ban network.Ban
+	var bannedAt, expiresAt string
+	err := rows.Scan(&ban.IP, &ban.Reason, &ban.Offenses, &bannedAt, &expiresAt)
+	if err != nil {
+		return nil, fmt.Errorf("error scanning ban database row into a ban struct: %w", err)
+	}
+	ban.BannedAt, err = parseOptionalTime(bannedAt)
+	if err == nil {
+		ban.ExpiresAt, err = parseOptionalTime(expiresAt)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ban of %s: %w", ban.IP, err)
+	}
+	return &ban, nil
+}
+
+func (r *SQLiteRepository) SaveIPBan(ban network.Ban) error {
+	_, err := r.db.Exec(
+		`INSERT INTO ip_bans(ip, reason, offenses, banned_at, expires_at) values(?,?,?,?,?)
+		ON CONFLICT(ip) DO UPDATE SET reason = excluded.reason, offenses = excluded.offenses, banned_at = excluded.banned_at,
+		expires_at = excluded.expires_at`,
+		ban.IP,
+		ban.Reason,
+		ban.Offenses,
+		formatOptionalTime(ban.BannedAt),
+		formatOptionalTime(ban.ExpiresAt),
+	)
+	if err != nil {
+		return fmt.Errorf("error saving the ban of %s: %w", ban.IP, err)
+	}
+	return nil
+}
+
+func (r *SQLiteRepository) DeleteIPBan(ip string) error {
+	res, err := r.db.Exec("DELETE FROM ip_bans WHERE ip = ?", ip)
+	if err != nil {
+		return fmt.Errorf("error deleting the ban of %s: %w", ip, err)
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return fmt.Errorf("%s isn't banned", ip)
+	}
+	return nil
+}
+
+func (r *SQLiteRepository) PruneIPBans(before time.Time) (int64, error) {
+	res, err := r.db.Exec("DELETE FROM ip_bans WHERE expires_at < ?", formatOptionalTime(before))
+	if err != nil {
+		return 0, fmt.Errorf("error pruning bans: %w", err)
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,70 @@
+package persistence
+
+import (
+	"fmt"
+	"imdawon/drawbridge/cmd/drawbridge/emissary"
+	"time"
+)
+
+// The kinds of rows in the device_baseline table.
+const (
+	baselineConnection = "connection"
+	baselineCountry    = "country"
+	baselineService    = "service"
+)
+
+func (r *SQLiteRepository) RecordDeviceBaseline(deviceID, country, service string, seen time.Time) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	timestamp := seen.UTC().Format(time.RFC3339)
+	for _, row := range [][2]string{{baselineConnection, ""}, {baselineCountry, country}, {baselineService, service}} {
+		if row[0] != baselineConnection && row[1] == "" {
+			continue
+		}
+		_, err = tx.Exec(
+			`INSERT INTO device_baseline(device_id, kind, value, first_seen) values(?,?,?,?)
+			ON CONFLICT(device_id, kind, value) DO UPDATE SET first_seen = excluded.first_seen WHERE excluded.first_seen < first_seen`,
+			deviceID, row[0], row[1], timestamp,
+		)
+		if err != nil {
+			return fmt.Errorf("error recording the baseline of device %s: %w", deviceID, err)
+		}
+	}
+	return tx.Commit()
+}
+
+func (r *SQLiteRepository) GetDeviceHistory(deviceID string, before time.Time) (*emissary.DeviceHistory, error) {
+	rows, err := r.db.Query(
+		"SELECT kind, value, first_seen FROM device_baseline WHERE device_id = ? AND first_seen < ? ORDER BY kind, value",
+		deviceID, before.UTC().Format(time.RFC3339),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error getting the baseline of device %s: %w", deviceID, err)
+	}
+	defer rows.Close()
+
+	var history emissary.DeviceHistory
+	for rows.Next() {
+		var kind, value, firstSeen string
+		err := rows.Scan(&kind, &value, &firstSeen)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning the baseline of device %s: %w", deviceID, err)
+		}
+		switch kind {
+		case baselineConnection:
+			history.FirstSeen, err = time.Parse(time.RFC3339, firstSeen)
+			if err != nil {
+				return nil, fmt.Errorf("the baseline of device %s has an invalid timestamp %q: %w", deviceID, firstSeen, err)
+			}
+		case baselineCountry:
+			history.Countries = append(history.Countries, value)
+		case baselineService:
+			history.Services = append(history.Services, value)
+		}
+	}
+	return &history, rows.Err()
+}
@@ -3,24 +3,17 @@ package persistence
 import (
 	"context"
 	"database/sql"
+	"fmt"
+	"imdawon/drawbridge/cmd/drawbridge/emissary"
+	"time"
 )
 
-func (r *SQLiteRepository) MigrateCertificates() error {
-	query := `
-	CREATE TABLE IF NOT EXISTS certificates(
-		id TEXT NOT NULL UNIQUE,
-		certificate TEXT NOT NULL,
-		certificate_type TEXT NOT NULL,
-		FOREIGN KEY(emissary_client_id) REFERENCES emissary_client(id),
-		FOREIGN KEY(service_id) REFERENCES services(id),
-		revoked INTEGER NOT NULL
-	);
-	CREATE INDEX IF NOT EXISTS idx_certificates_revoked ON certificates (revoked);
-	`
-
-	_, err := r.db.Exec(query)
-	return err
-}
+// Certificate types stored in the certificates table.
+const (
+	// An Emissary device certificate that was replaced during a certificate authority rotation.
+	// It stays valid until the rotation deadline so a device that didn't save its new certificate isn't locked out.
+	CertificateTypeSuperseded = "superseded"
+)
 
 func (r *SQLiteRepository) RevokeEmissaryClientCertificate(clientID string) error {
 	ctx := context.Background()
@@ -33,3 +26,77 @@ func (r *SQLiteRepository) RevokeEmissaryClientCertificate(clientID string) erro
 	return nil
 
 }
+
+// Replaces the certificate an Emissary device uses to connect to Drawbridge.
+// The previous certificate is kept in the certificates table until expiresAt so it keeps working during a
+// certificate authority rotation overlap window.
+func (r *SQLiteRepository) SupersedeEmissaryClientCertificate(deviceID, certificateHash, newCertificate string, expiresAt time.Time) error {
+	ctx := context.Background()
+	tx, err := r.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		`INSERT INTO certificates(id, emissary_client_id, certificate, certificate_type, revoked, expires_at)
+		SELECT ?, id, drawbridge_certificate, ?, revoked, ? FROM emissary_client WHERE id = ?
+		ON CONFLICT(id) DO NOTHING`,
+		certificateHash,
+		CertificateTypeSuperseded,
+		expiresAt.UTC().Format(time.RFC3339),
+		deviceID,
+	)
+	if err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("error saving superseded certificate for emissary client %s: %w", deviceID, err)
+	}
+
+	res, err := tx.Exec("UPDATE emissary_client SET drawbridge_certificate = ? WHERE id = ?", newCertificate, deviceID)
+	if err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("error updating certificate for emissary client %s: %w", deviceID, err)
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil || rowsAffected == 0 {
+		_ = tx.Rollback()
+		return fmt.Errorf("no emissary client with id %s to update certificate for", deviceID)
+	}
+
+	return tx.Commit()
+}
+
+// Returns superseded Emissary device certificates that haven't expired yet, keyed by certificate hash in the same
+// format as GetAllEmissaryClientCertificates.
+func (r *SQLiteRepository) GetActiveSupersededCertificates() (map[string]emissary.DeviceCertificate, error) {
+	rows, err := r.db.Query(
+		`SELECT c.id, c.emissary_client_id, e.revoked FROM certificates c
+		JOIN emissary_client e ON e.id = c.emissary_client_id
+		WHERE c.certificate_type = ? AND c.expires_at > ?`,
+		CertificateTypeSuperseded,
+		time.Now().UTC().Format(time.RFC3339),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error getting superseded certificates: %w", err)
+	}
+	defer rows.Close()
+
+	deviceCerts := make(map[string]emissary.DeviceCertificate, 0)
+	for rows.Next() {
+		var hash string
+		var deviceCert emissary.DeviceCertificate
+		if err := rows.Scan(&hash, &deviceCert.DeviceID, &deviceCert.Revoked); err != nil {
+			return nil, fmt.Errorf("error scanning superseded certificate row: %w", err)
+		}
+		deviceCerts[hash] = deviceCert
+	}
+	return deviceCerts, nil
+}
+
+// Removes every superseded certificate once a certificate authority rotation has finished.
+func (r *SQLiteRepository) DeleteSupersededCertificates() error {
+	_, err := r.db.Exec("DELETE FROM certificates WHERE certificate_type = ?", CertificateTypeSuperseded)
+	if err != nil {
+		return fmt.Errorf("error deleting superseded certificates: %w", err)
+	}
+	return nil
+}
@@ -5,18 +5,6 @@ import (
 	"strings"
 )
 
-func (r *SQLiteRepository) MigrateDrawbridgeConfig() error {
-	query := `
-	CREATE TABLE IF NOT EXISTS drawbridge_config(
-		setting TEXT NOT NULL UNIQUE,
-		value TEXT NOT NULL
-	);
-	`
-
-	_, err := r.db.Exec(query)
-	return err
-}
-
 func (r *SQLiteRepository) CreateNewDrawbridgeConfigSettings(setting, value string) error {
 	_, err := r.db.Exec(
 		"INSERT INTO drawbridge_config(setting, value) values(?,?) ON CONFLICT(setting) DO UPDATE SET value = ?",
@@ -56,7 +44,7 @@ func (r *SQLiteRepository) GetDrawbridgeConfigValueByName(setting string) (*stri
 }
 
 func (r *SQLiteRepository) DeleteDrawbridgeConfigSetting(setting string) error {
-	res, err := r.db.Exec("DELETE FROM drawbridge_config WHERE name = ?", setting)
+	res, err := r.db.Exec("DELETE FROM drawbridge_config WHERE setting = ?", setting)
 	if err != nil {
 		return fmt.Errorf("error deleting drawbridge %s setting: %s", setting, err)
 	}
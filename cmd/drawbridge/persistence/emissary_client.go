@@ -7,29 +7,18 @@ import (
 	"encoding/hex"
 	"fmt"
 	"imdawon/drawbridge/cmd/drawbridge/emissary"
+	"strings"
 )
 
-func (r *SQLiteRepository) MigrateEmissaryClient() error {
-	query := `
-	CREATE TABLE IF NOT EXISTS emissary_client(
-		id TEXT PRIMARY KEY NOT NULL,
-		name TEXT UNIQUE NOT NULL,
-		drawbridge_certificate TEXT UNIQUE NOT NULL,
-		revoked INTEGER NOT NULL
-	);
-	`
-
-	_, err := r.db.Exec(query)
-	return err
-}
-
 func (r *SQLiteRepository) CreateNewEmissaryClient(client emissary.EmissaryClient) (*emissary.EmissaryClient, error) {
 	_, err := r.db.Exec(
-		"INSERT INTO emissary_client(id, name, drawbridge_certificate, revoked) values(?, ?, ?, ?)",
+		"INSERT INTO emissary_client(id, name, drawbridge_certificate, revoked, groups, tags) values(?, ?, ?, ?, ?, ?)",
 		client.ID,
 		client.Name,
 		client.DrawbridgeCertificate,
 		client.Revoked,
+		strings.Join(client.Groups, ","),
+		strings.Join(client.Tags, ","),
 	)
 	if err != nil {
 		return nil, fmt.Errorf("error creating new emissary client: %s", err)
@@ -40,7 +29,7 @@ func (r *SQLiteRepository) CreateNewEmissaryClient(client emissary.EmissaryClien
 }
 
 func (r *SQLiteRepository) GetAllEmissaryClients() ([]*emissary.EmissaryClient, error) {
-	rows, err := r.db.Query("SELECT * FROM emissary_client")
+	rows, err := r.db.Query("SELECT " + emissaryClientColumns + " FROM emissary_client")
 	if err != nil {
 		return nil, fmt.Errorf("error getting all emissary clients: %s", err)
 	}
@@ -48,16 +37,11 @@ func (r *SQLiteRepository) GetAllEmissaryClients() ([]*emissary.EmissaryClient,
 
 	var clients []*emissary.EmissaryClient
 	for rows.Next() {
-		var client emissary.EmissaryClient
-		if err := rows.Scan(
-			&client.ID,
-			&client.Name,
-			&client.DrawbridgeCertificate,
-			&client.Revoked,
-		); err != nil {
-			return nil, fmt.Errorf("error scanning emissary client database row into a emissary client struct: %s", err)
+		client, err := scanEmissaryClient(rows)
+		if err != nil {
+			return nil, err
 		}
-		clients = append(clients, &client)
+		clients = append(clients, client)
 	}
 	return clients, nil
 }
@@ -92,26 +76,49 @@ func (r *SQLiteRepository) GetAllEmissaryClientCertificates() (map[string]emissa
 }
 
 func (r *SQLiteRepository) GetEmissaryClientById(id string) (*emissary.EmissaryClient, error) {
-	rows, err := r.db.Query("SELECT * FROM emissary_client WHERE id = ?", id)
+	rows, err := r.db.Query("SELECT "+emissaryClientColumns+" FROM emissary_client WHERE id = ?", id)
 	if err != nil {
 		return nil, fmt.Errorf("error getting emissary client id %s: %s", id, err)
 	}
 	defer rows.Close()
 
-	var client emissary.EmissaryClient
+	client := &emissary.EmissaryClient{}
 	for rows.Next() {
-		if err := rows.Scan(
-			&client.ID,
-			&client.Name,
-			&client.DrawbridgeCertificate,
-			&client.Revoked,
-		); err != nil {
-			return nil, fmt.Errorf("error scanning emissary client database row into a emissary client struct: %s", err)
+		client, err = scanEmissaryClient(rows)
+		if err != nil {
+			return nil, err
 		}
 	}
+	return client, nil
+}
+
+const emissaryClientColumns = "id, name, drawbridge_certificate, revoked, groups, tags"
+
+func scanEmissaryClient(rows *sql.Rows) (*emissary.EmissaryClient, error) {
+	var client emissary.EmissaryClient
+	var groups, tags string
+	if err := rows.Scan(
+		&client.ID,
+		&client.Name,
+		&client.DrawbridgeCertificate,
+		&client.Revoked,
+		&groups,
+		&tags,
+	); err != nil {
+		return nil, fmt.Errorf("error scanning emissary client database row into a emissary client struct: %s", err)
+	}
+	client.Groups = splitLabels(groups)
+	client.Tags = splitLabels(tags)
 	return &client, nil
 }
 
+func splitLabels(labels string) []string {
+	if labels == "" {
+		return nil
+	}
+	return strings.Split(labels, ",")
+}
+
 func (r *SQLiteRepository) UpdateEmissaryClient(updated *emissary.EmissaryClient, id int64, column string) error {
 	if id == 0 {
 		return fmt.Errorf("the emissary client id supplied is invalid. unable to update emissary client row")
@@ -135,6 +142,38 @@ func (r *SQLiteRepository) UpdateEmissaryClient(updated *emissary.EmissaryClient
 
 }
 
+// Device names are unique, so renaming a device to the name of another fails.
+func (r *SQLiteRepository) RenameEmissaryClient(id, name string) error {
+	res, err := r.db.Exec("UPDATE emissary_client SET name = ? WHERE id = ?", name, id)
+	if err != nil {
+		return fmt.Errorf("error renaming emissary client with id of %s: %s", id, err)
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return fmt.Errorf("no emissary client with id of %s", id)
+	}
+	return nil
+}
+
+// Replaces the groups and tags of a device. They should already be normalized, see emissary.NormalizeLabels.
+func (r *SQLiteRepository) UpdateEmissaryClientGroupsAndTags(id string, groups, tags []string) error {
+	res, err := r.db.Exec("UPDATE emissary_client SET groups = ?, tags = ? WHERE id = ?", strings.Join(groups, ","), strings.Join(tags, ","), id)
+	if err != nil {
+		return fmt.Errorf("error updating the groups and tags of emissary client with id of %s: %s", id, err)
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return fmt.Errorf("no emissary client with id of %s", id)
+	}
+	return nil
+}
+
 // Marks a device as revoked, which keeps it from being able to connect to Drawbridge at all.
 // We do this by adding the Emissary client certificate to Drawbridge's Certificate Revocation List.
 func (r *SQLiteRepository) RevokeEmissaryClient(deviceID string) (*emissary.EmissaryClient, *emissary.Event, error) {
@@ -1,52 +1,43 @@
 package persistence
 
 import (
+	"database/sql"
+	"encoding/json"
 	"fmt"
 	"imdawon/drawbridge/cmd/drawbridge/emissary"
 	"imdawon/drawbridge/cmd/utils"
+	"time"
 )
 
-func (r *SQLiteRepository) MigrateEmissaryClientEvent() error {
-	query := `
-	CREATE TABLE IF NOT EXISTS emissary_client_event(
-		id TEXT PRIMARY KEY,
-		device_id TEXT NOT NULL,
-		device_ip TEXT NOT NULL,
-		type TEXT NOT NULL,
-		target_service TEXT,
-		connection_type TEXT,
-		timestamp TEXT NOT NULL,
-		FOREIGN KEY(device_id) REFERENCES emissary_client(id)
-	);
-	CREATE INDEX IF NOT EXISTS idx_emissary_client_event_device_id ON emissary_client_event (device_id);
-	`
-
-	_, err := r.db.Exec(query)
-	return err
-}
-
+// Reads the most recent event for each device from the event rollups, so the Device Fleet view doesn't scan
+// every raw event. Hourly rollups are pruned before daily ones, so devices last seen long ago come from the daily rollups.
 var queryLatestDeviceEventForEachDevice = `
 SELECT
-	e.id AS event_id,
+	'' AS event_id,
 	e.device_id,
-	e.device_ip,
-	e.type,
+	e.last_ip,
+	e.last_type,
 	e.target_service,
-	e.connection_type,
-	e.timestamp
+	'' AS connection_type,
+	e.last_seen,
+	'' AS reason,
+	'' AS trace,
+	'' AS country,
+	0 AS asn
 FROM
     (
         SELECT
-			id,
             device_id,
-			device_ip,
-            type,
+            last_ip,
+            last_type,
             target_service,
-            connection_type,
-            timestamp,
-            ROW_NUMBER() OVER (PARTITION BY device_id ORDER BY timestamp DESC) AS rn
-        FROM emissary_client_event
-        WHERE device_id IN (%s)
+            last_seen,
+            ROW_NUMBER() OVER (PARTITION BY device_id ORDER BY last_seen DESC) AS rn
+        FROM (
+            SELECT device_id, last_ip, last_type, target_service, last_seen FROM emissary_client_event_hourly WHERE device_id IN (%[1]s)
+            UNION ALL
+            SELECT device_id, last_ip, last_type, target_service, last_seen FROM emissary_client_event_daily WHERE device_id IN (%[1]s)
+        )
     ) e
     JOIN emissary_client c ON e.device_id = c.id
 WHERE
@@ -54,15 +45,27 @@ WHERE
 	`
 
 func (r *SQLiteRepository) InsertEmissaryClientEvent(event emissary.Event) error {
+	trace := ""
+	if len(event.Trace) > 0 {
+		encoded, err := json.Marshal(event.Trace)
+		if err != nil {
+			return fmt.Errorf("error encoding the trace of emissary event %s: %s", event.ID, err)
+		}
+		trace = string(encoded)
+	}
 	_, err := r.db.Exec(
-		"INSERT INTO emissary_client_event(id, device_id, device_ip, type, target_service, connection_type, timestamp) values(?,?,?,?,?,?,?)",
+		"INSERT INTO emissary_client_event(id, device_id, device_ip, type, target_service, connection_type, timestamp, reason, trace, country, asn) values(?,?,?,?,?,?,?,?,?,?,?)",
 		&event.ID,
 		&event.DeviceID,
 		&event.ConnectionIP,
 		&event.Type,
 		&event.TargetService,
 		&event.ConnectionType,
-		&event.Timestamp,
+		event.Timestamp.UTC().Format(time.RFC3339),
+		&event.Reason,
+		trace,
+		&event.Country,
+		&event.ASN,
 	)
 	if err != nil {
 		return fmt.Errorf("error inserting emissary event: %s", err)
@@ -81,30 +84,22 @@ func (r *SQLiteRepository) GetLatestEventForEachDeviceId(deviceIDs []any) (map[s
 
 	queryPlaceholders := utils.GeneratePlaceholders(deviceIDsLen)
 	queryLatestDeviceEventForEachDevice := fmt.Sprintf(queryLatestDeviceEventForEachDevice, queryPlaceholders)
-	rows, err := r.db.Query(queryLatestDeviceEventForEachDevice, deviceIDs...)
+	// The device ids are bound once for the hourly rollups and once for the daily rollups.
+	rows, err := r.db.Query(queryLatestDeviceEventForEachDevice, append(append([]any{}, deviceIDs...), deviceIDs...)...)
 	if err != nil {
 		return nil, fmt.Errorf("error getting latest event for each emissary client: %s", err)
 	}
 	defer rows.Close()
 
-	var event emissary.Event
 	events := make(map[string]emissary.Event, deviceIDsLen)
 	for rows.Next() {
-		if err := rows.Scan(
-			&event.ID,
-			&event.DeviceID,
-			&event.ConnectionIP,
-			&event.Type,
-			&event.TargetService,
-			&event.ConnectionType,
-			&event.Timestamp,
-		); err != nil {
-			return nil, fmt.Errorf("error scanning emissary client database row into a emissary client struct: %s", err)
+		event, err := scanEmissaryClientEvent(rows)
+		if err != nil {
+			return nil, err
 		}
-		event.Timestamp = utils.BeautifulTimeSince(event.Timestamp)
-		events[event.DeviceID] = event
+		events[event.DeviceID] = *event
 	}
-	return events, nil
+	return events, rows.Err()
 }
 
 func (r *SQLiteRepository) GetLatestEventForDeviceId(deviceID string) (*emissary.Event, error) {
@@ -112,24 +107,50 @@ func (r *SQLiteRepository) GetLatestEventForDeviceId(deviceID string) (*emissary
 		return nil, fmt.Errorf("no deviceIDs supplied to get latest event for each device id")
 	}
 	queryLatestDeviceEventForEachDevice := fmt.Sprintf(queryLatestDeviceEventForEachDevice, "?")
-	rows, err := r.db.Query(queryLatestDeviceEventForEachDevice, deviceID)
+	rows, err := r.db.Query(queryLatestDeviceEventForEachDevice, deviceID, deviceID)
 	if err != nil {
 		return nil, fmt.Errorf("error getting latest event for each emissary client: %s", err)
 	}
 	defer rows.Close()
 
-	var event emissary.Event
+	event := &emissary.Event{}
 	for rows.Next() {
-		if err := rows.Scan(
-			&event.ID,
-			&event.DeviceID,
-			&event.ConnectionIP,
-			&event.Type,
-			&event.TargetService,
-			&event.ConnectionType,
-			&event.Timestamp,
-		); err != nil {
-			return nil, fmt.Errorf("error scanning emissary client database row into a emissary client struct: %s", err)
+		event, err = scanEmissaryClientEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return event, rows.Err()
+}
+
+// Scans a row of id, device_id, device_ip, type, target_service, connection_type, timestamp, reason, trace, country and asn into an event.
+func scanEmissaryClientEvent(rows *sql.Rows) (*emissary.Event, error) {
+	var event emissary.Event
+	var timestamp, trace string
+	if err := rows.Scan(
+		&event.ID,
+		&event.DeviceID,
+		&event.ConnectionIP,
+		&event.Type,
+		&event.TargetService,
+		&event.ConnectionType,
+		&timestamp,
+		&event.Reason,
+		&trace,
+		&event.Country,
+		&event.ASN,
+	); err != nil {
+		return nil, fmt.Errorf("error scanning emissary event database row into an event struct: %s", err)
+	}
+	var err error
+	event.Timestamp, err = time.Parse(time.RFC3339, timestamp)
+	if err != nil {
+		return nil, fmt.Errorf("emissary event %s has an invalid timestamp %q: %s", event.ID, timestamp, err)
+	}
+	if trace != "" {
+		err = json.Unmarshal([]byte(trace), &event.Trace)
+		if err != nil {
+			return nil, fmt.Errorf("emissary event %s has an invalid trace: %s", event.ID, err)
 		}
 	}
 	return &event, nil
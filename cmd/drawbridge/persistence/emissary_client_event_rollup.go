@@ -0,0 +1,221 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"imdawon/drawbridge/cmd/drawbridge/emissary"
+	"log/slog"
+	"net"
+	"time"
+)
+
+// The rollup tables, keyed by the size of their buckets.
+var eventRollupTables = map[time.Duration]string{
+	time.Hour:      "emissary_client_event_hourly",
+	24 * time.Hour: "emissary_client_event_daily",
+}
+
+// Adds the bytes proxied for a connection to its event once the connection closes.
+func (r *SQLiteRepository) RecordEmissaryClientEventBytes(eventID string, bytesIn, bytesOut int64) error {
+	_, err := r.db.Exec(
+		"UPDATE emissary_client_event SET bytes_in = bytes_in + ?, bytes_out = bytes_out + ? WHERE id = ?",
+		bytesIn,
+		bytesOut,
+		eventID,
+	)
+	if err != nil {
+		return fmt.Errorf("error recording emissary event bytes: %s", err)
+	}
+	return nil
+}
+
+// Aggregates raw events into the hourly and daily rollup tables. Every bucket from the start of the UTC day
+// that since falls in is recomputed from the raw events, so running it again with the same since is safe.
+func (r *SQLiteRepository) RollupEmissaryClientEvents(since time.Time) error {
+	since = since.UTC().Truncate(24 * time.Hour)
+	rows, err := r.db.Query(
+		"SELECT device_id, device_ip, type, COALESCE(target_service, ''), timestamp, bytes_in, bytes_out FROM emissary_client_event WHERE timestamp >= ? ORDER BY timestamp",
+		since.Format(time.RFC3339),
+	)
+	if err != nil {
+		return fmt.Errorf("error reading emissary events to roll up: %s", err)
+	}
+	defer rows.Close()
+
+	var events []rollupEvent
+	for rows.Next() {
+		var event rollupEvent
+		var timestamp string
+		if err := rows.Scan(
+			&event.DeviceID,
+			&event.ConnectionIP,
+			&event.Type,
+			&event.TargetService,
+			&timestamp,
+			&event.bytesIn,
+			&event.bytesOut,
+		); err != nil {
+			return fmt.Errorf("error scanning emissary event database row: %s", err)
+		}
+		event.Timestamp, err = time.Parse(time.RFC3339, timestamp)
+		if err != nil {
+			slog.Warn("Event Rollup", slog.String("Skipping event with invalid timestamp", timestamp))
+			continue
+		}
+		events = append(events, event)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+	rollups := rollupEvents(events)
+
+	tx, err := r.db.BeginTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return err
+	}
+	for bucketSize, table := range eventRollupTables {
+		for _, rollup := range rollups[bucketSize] {
+			_, err = tx.Exec(
+				fmt.Sprintf(`INSERT INTO %s(device_id, target_service, bucket, connections, bytes_in, bytes_out, unique_ips, last_seen, last_ip, last_type)
+				values(?,?,?,?,?,?,?,?,?,?)
+				ON CONFLICT(device_id, target_service, bucket) DO UPDATE SET
+				connections = excluded.connections, bytes_in = excluded.bytes_in, bytes_out = excluded.bytes_out, unique_ips = excluded.unique_ips,
+				last_seen = excluded.last_seen, last_ip = excluded.last_ip, last_type = excluded.last_type`, table),
+				rollup.DeviceID,
+				rollup.TargetService,
+				rollup.Bucket.Format(time.RFC3339),
+				rollup.Connections,
+				rollup.BytesIn,
+				rollup.BytesOut,
+				rollup.UniqueIPs,
+				rollup.LastSeen.Format(time.RFC3339),
+				rollup.LastIP,
+				rollup.LastType,
+			)
+			if err != nil {
+				_ = tx.Rollback()
+				return fmt.Errorf("error saving %s rollup: %s", table, err)
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// Deletes raw events older than before. Their history stays in the rollup tables.
+func (r *SQLiteRepository) PruneEmissaryClientEvents(before time.Time) (int64, error) {
+	res, err := r.db.Exec("DELETE FROM emissary_client_event WHERE timestamp < ?", before.UTC().Format(time.RFC3339))
+	if err != nil {
+		return 0, fmt.Errorf("error pruning emissary events: %s", err)
+	}
+	return res.RowsAffected()
+}
+
+// Deletes hourly and daily rollups for buckets that start before hourlyBefore and dailyBefore.
+// A zero time keeps every rollup in that table.
+func (r *SQLiteRepository) PruneEmissaryClientEventRollups(hourlyBefore, dailyBefore time.Time) error {
+	for bucketSize, before := range map[time.Duration]time.Time{time.Hour: hourlyBefore, 24 * time.Hour: dailyBefore} {
+		if before.IsZero() {
+			continue
+		}
+		_, err := r.db.Exec(fmt.Sprintf("DELETE FROM %s WHERE bucket < ?", eventRollupTables[bucketSize]), before.UTC().Format(time.RFC3339))
+		if err != nil {
+			return fmt.Errorf("error pruning %s: %s", eventRollupTables[bucketSize], err)
+		}
+	}
+	return nil
+}
+
+// Returns the daily rollups for a device since the start of the UTC day that since falls in, oldest first.
+func (r *SQLiteRepository) GetDailyUsageForDevice(deviceID string, since time.Time) ([]emissary.EventRollup, error) {
+	rows, err := r.db.Query(
+		"SELECT device_id, target_service, bucket, connections, bytes_in, bytes_out, unique_ips, last_seen, last_ip, last_type FROM emissary_client_event_daily WHERE device_id = ? AND bucket >= ? ORDER BY bucket",
+		deviceID,
+		since.UTC().Truncate(24*time.Hour).Format(time.RFC3339),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error getting daily usage for device %s: %s", deviceID, err)
+	}
+	defer rows.Close()
+
+	var usage []emissary.EventRollup
+	for rows.Next() {
+		var rollup emissary.EventRollup
+		var bucket, lastSeen string
+		if err := rows.Scan(
+			&rollup.DeviceID,
+			&rollup.TargetService,
+			&bucket,
+			&rollup.Connections,
+			&rollup.BytesIn,
+			&rollup.BytesOut,
+			&rollup.UniqueIPs,
+			&lastSeen,
+			&rollup.LastIP,
+			&rollup.LastType,
+		); err != nil {
+			return nil, fmt.Errorf("error scanning daily usage database row: %s", err)
+		}
+		rollup.Bucket, err = time.Parse(time.RFC3339, bucket)
+		if err != nil {
+			return nil, err
+		}
+		rollup.LastSeen, err = time.Parse(time.RFC3339, lastSeen)
+		if err != nil {
+			return nil, err
+		}
+		usage = append(usage, rollup)
+	}
+	return usage, rows.Err()
+}
+
+// A raw event and the bytes proxied for it, as read to roll up.
+type rollupEvent struct {
+	emissary.Event
+	bytesIn, bytesOut int64
+}
+
+type rollupKey struct {
+	deviceID, targetService string
+	bucket                  time.Time
+}
+
+// Aggregates events, oldest first, into rollups for each bucket size in eventRollupTables.
+func rollupEvents(events []rollupEvent) map[time.Duration]map[rollupKey]*emissary.EventRollup {
+	rollups := make(map[time.Duration]map[rollupKey]*emissary.EventRollup, len(eventRollupTables))
+	uniqueIPs := make(map[time.Duration]map[rollupKey]map[string]bool, len(eventRollupTables))
+	for bucketSize := range eventRollupTables {
+		rollups[bucketSize] = make(map[rollupKey]*emissary.EventRollup)
+		uniqueIPs[bucketSize] = make(map[rollupKey]map[string]bool)
+	}
+
+	for _, event := range events {
+		timestamp := event.Timestamp.UTC()
+		// Connection IPs include the port, which changes on every connection.
+		ip, _, err := net.SplitHostPort(event.ConnectionIP)
+		if err != nil {
+			ip = event.ConnectionIP
+		}
+
+		for bucketSize := range eventRollupTables {
+			key := rollupKey{event.DeviceID, event.TargetService, timestamp.Truncate(bucketSize)}
+			rollup, exists := rollups[bucketSize][key]
+			if !exists {
+				rollup = &emissary.EventRollup{DeviceID: key.deviceID, TargetService: key.targetService, Bucket: key.bucket}
+				rollups[bucketSize][key] = rollup
+				uniqueIPs[bucketSize][key] = make(map[string]bool)
+			}
+			rollup.Connections++
+			rollup.BytesIn += event.bytesIn
+			rollup.BytesOut += event.bytesOut
+			uniqueIPs[bucketSize][key][ip] = true
+			rollup.UniqueIPs = int64(len(uniqueIPs[bucketSize][key]))
+			// Events are oldest first, so the last event seen is the most recent.
+			rollup.LastSeen = timestamp
+			rollup.LastIP = event.ConnectionIP
+			rollup.LastType = event.Type
+		}
+	}
+	return rollups
+}
@@ -0,0 +1,104 @@
+package persistence
+
+import (
+	"imdawon/drawbridge/cmd/drawbridge/emissary"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRollupEmissaryClientEvents(t *testing.T) {
+	db := NewSQLiteRepository(OpenDatabaseFile(filepath.Join(t.TempDir(), "drawbridge.db")))
+	if _, err := db.Migrate(); err != nil {
+		t.Fatalf("migration failed: %v", err)
+	}
+	if _, err := db.CreateNewEmissaryClient(emissary.EmissaryClient{ID: "device-1", Name: "Laptop"}); err != nil {
+		t.Fatalf("CreateNewEmissaryClient failed: %v", err)
+	}
+
+	day := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	events := []struct {
+		ip        string
+		at        time.Time
+		in, out   int64
+		eventType string
+	}{
+		{"10.0.0.1:50000", day.Add(9*time.Hour + 5*time.Minute), 100, 1000, "PS_CONN"},
+		{"10.0.0.1:50001", day.Add(9*time.Hour + 30*time.Minute), 200, 2000, "PS_CONN"},
+		{"10.0.0.2:50002", day.Add(14 * time.Hour), 300, 3000, "PS_CONN"},
+		{"10.0.0.3:50003", day.AddDate(0, 0, 1).Add(time.Hour), 0, 0, "PS_LIST"},
+	}
+	for i, e := range events {
+		id := string(rune('a' + i))
+		err := db.InsertEmissaryClientEvent(emissary.Event{
+			ID:            id,
+			DeviceID:      "device-1",
+			ConnectionIP:  e.ip,
+			Type:          e.eventType,
+			TargetService: "001",
+			Timestamp:     e.at,
+		})
+		if err != nil {
+			t.Fatalf("InsertEmissaryClientEvent failed: %v", err)
+		}
+		if err := db.RecordEmissaryClientEventBytes(id, e.in, e.out); err != nil {
+			t.Fatalf("RecordEmissaryClientEventBytes failed: %v", err)
+		}
+	}
+
+	if err := db.RollupEmissaryClientEvents(time.Time{}); err != nil {
+		t.Fatalf("RollupEmissaryClientEvents failed: %v", err)
+	}
+	// Rolling up again recomputes the same buckets instead of counting events twice.
+	if err := db.RollupEmissaryClientEvents(day.Add(12 * time.Hour)); err != nil {
+		t.Fatalf("RollupEmissaryClientEvents failed: %v", err)
+	}
+
+	var hourly int64
+	if err := db.db.QueryRow("SELECT connections FROM emissary_client_event_hourly WHERE bucket = ?", day.Add(9*time.Hour).Format(time.RFC3339)).Scan(&hourly); err != nil {
+		t.Fatalf("reading hourly rollup failed: %v", err)
+	}
+	if hourly != 2 {
+		t.Errorf("hourly rollup connections = %d, want 2", hourly)
+	}
+
+	usage, err := db.GetDailyUsageForDevice("device-1", day)
+	if err != nil {
+		t.Fatalf("GetDailyUsageForDevice failed: %v", err)
+	}
+	if len(usage) != 2 {
+		t.Fatalf("expected 2 days of usage, got %d", len(usage))
+	}
+	first := usage[0]
+	if first.Connections != 3 || first.UniqueIPs != 2 || first.BytesIn != 600 || first.BytesOut != 6000 {
+		t.Errorf("unexpected daily rollup %+v", first)
+	}
+	if !first.LastSeen.Equal(day.Add(14*time.Hour)) || first.LastIP != "10.0.0.2:50002" {
+		t.Errorf("daily rollup should keep the latest event, got %v from %s", first.LastSeen, first.LastIP)
+	}
+
+	// Raw events can be pruned once rolled up, and the latest event still comes from the rollups.
+	pruned, err := db.PruneEmissaryClientEvents(day.AddDate(0, 0, 2))
+	if err != nil || pruned != int64(len(events)) {
+		t.Errorf("PruneEmissaryClientEvents pruned %d events, want %d: %v", pruned, len(events), err)
+	}
+	latest, err := db.GetLatestEventForDeviceId("device-1")
+	if err != nil {
+		t.Fatalf("GetLatestEventForDeviceId failed: %v", err)
+	}
+	if latest.Type != "PS_LIST" || latest.ConnectionIP != "10.0.0.3:50003" {
+		t.Errorf("latest event should come from the rollups, got %+v", latest)
+	}
+
+	// Pruning hourly rollups leaves the daily ones.
+	if err := db.PruneEmissaryClientEventRollups(day.AddDate(0, 0, 2), time.Time{}); err != nil {
+		t.Fatalf("PruneEmissaryClientEventRollups failed: %v", err)
+	}
+	latestEvents, err := db.GetLatestEventForEachDeviceId([]any{"device-1"})
+	if err != nil {
+		t.Fatalf("GetLatestEventForEachDeviceId failed: %v", err)
+	}
+	if latestEvents["device-1"].ConnectionIP != "10.0.0.3:50003" {
+		t.Errorf("latest event should come from the daily rollups once hourly rollups are pruned, got %+v", latestEvents["device-1"])
+	}
+}
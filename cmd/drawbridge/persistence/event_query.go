@@ -0,0 +1,216 @@
+package persistence
+
+import (
+	"cmp"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"imdawon/drawbridge/cmd/drawbridge/emissary"
+	"net"
+	"slices"
+	"strings"
+	"time"
+)
+
+var ErrInvalidEventCursor = errors.New("invalid event cursor")
+
+// The emissary_client_event column for each sort, other than timestamp which every sort ends with.
+var eventSortColumns = map[emissary.EventSort]string{
+	emissary.EventSortDevice:        "device_id",
+	emissary.EventSortType:          "type",
+	emissary.EventSortTargetService: "COALESCE(target_service, '')",
+	emissary.EventSortIP:            "device_ip",
+}
+
+// Where a page of events ended. Pages are keyed on the sort column, then timestamp, then id, so inserting events
+// while paging through them doesn't skip or repeat any.
+type eventCursor struct {
+	Sort       emissary.EventSort `json:"s"`
+	Descending bool               `json:"d"`
+	Value      string             `json:"v,omitempty"`
+	Timestamp  time.Time          `json:"t"`
+	ID         string             `json:"i"`
+}
+
+func encodeEventCursor(query emissary.EventQuery, last emissary.Event) string {
+	cursor, _ := json.Marshal(eventCursor{
+		Sort:       query.Sort,
+		Descending: query.Descending,
+		Value:      eventSortValue(last, query.Sort),
+		Timestamp:  last.Timestamp.UTC(),
+		ID:         last.ID,
+	})
+	return base64.RawURLEncoding.EncodeToString(cursor)
+}
+
+// Returns nil for the first page.
+func decodeEventCursor(query emissary.EventQuery) (*eventCursor, error) {
+	if query.Cursor == "" {
+		return nil, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(query.Cursor)
+	if err != nil {
+		return nil, ErrInvalidEventCursor
+	}
+	var cursor eventCursor
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		return nil, ErrInvalidEventCursor
+	}
+	// A cursor only makes sense for the order it was made with.
+	if cursor.Sort != query.Sort || cursor.Descending != query.Descending {
+		return nil, fmt.Errorf("%w: the sort order changed", ErrInvalidEventCursor)
+	}
+	return &cursor, nil
+}
+
+// Fills in the default sort and limit, and rounds the time range to the second like the stored timestamps.
+func normalizeEventQuery(query emissary.EventQuery) (emissary.EventQuery, error) {
+	if query.Sort == "" {
+		query.Sort = emissary.EventSortTimestamp
+	}
+	if !slices.Contains(emissary.EventSorts, query.Sort) {
+		return query, fmt.Errorf("unknown event sort %q", query.Sort)
+	}
+	if query.Limit <= 0 {
+		query.Limit = emissary.DefaultEventQueryLimit
+	}
+	query.Limit = min(query.Limit, emissary.MaxEventQueryLimit)
+	query.Since = query.Since.UTC().Truncate(time.Second)
+	query.Until = query.Until.UTC().Truncate(time.Second)
+	return query, nil
+}
+
+func eventSortValue(event emissary.Event, sort emissary.EventSort) string {
+	switch sort {
+	case emissary.EventSortDevice:
+		return event.DeviceID
+	case emissary.EventSortType:
+		return event.Type
+	case emissary.EventSortTargetService:
+		return event.TargetService
+	case emissary.EventSortIP:
+		return event.ConnectionIP
+	}
+	return ""
+}
+
+// Orders events by the sort column, then timestamp, then id, ascending.
+func compareEvents(a, b emissary.Event, sort emissary.EventSort) int {
+	return cmp.Or(
+		cmp.Compare(eventSortValue(a, sort), eventSortValue(b, sort)),
+		a.Timestamp.Compare(b.Timestamp),
+		cmp.Compare(a.ID, b.ID),
+	)
+}
+
+func matchesEventQuery(event emissary.Event, query emissary.EventQuery) bool {
+	switch {
+	case query.DeviceID != "" && event.DeviceID != query.DeviceID,
+		query.TargetService != "" && event.TargetService != query.TargetService,
+		query.Type != "" && event.Type != query.Type,
+		query.IP != "" && !matchesEventIP(event.ConnectionIP, query.IP),
+		!query.Since.IsZero() && event.Timestamp.Before(query.Since),
+		!query.Until.IsZero() && !event.Timestamp.Before(query.Until):
+		return false
+	}
+	return true
+}
+
+// Connection IPs are stored with their port, e.g. 10.0.0.1:50000 or [::1]:50000.
+func matchesEventIP(connectionIP, ip string) bool {
+	host, _, err := net.SplitHostPort(connectionIP)
+	return connectionIP == ip || (err == nil && host == ip)
+}
+
+// Builds a page from up to query.Limit+1 events, the extra one only telling us there is another page.
+func newEventPage(events []emissary.Event, query emissary.EventQuery) *emissary.EventPage {
+	page := &emissary.EventPage{Events: events}
+	if len(events) > query.Limit {
+		page.Events = events[:query.Limit]
+		page.NextCursor = encodeEventCursor(query, page.Events[query.Limit-1])
+	}
+	return page
+}
+
+// Searches raw events, one page at a time. See emissary.EventQuery.
+func (r *SQLiteRepository) QueryEmissaryClientEvents(query emissary.EventQuery) (*emissary.EventPage, error) {
+	query, err := normalizeEventQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	cursor, err := decodeEventCursor(query)
+	if err != nil {
+		return nil, err
+	}
+
+	var conditions []string
+	var args []any
+	if query.DeviceID != "" {
+		conditions = append(conditions, "device_id = ?")
+		args = append(args, query.DeviceID)
+	}
+	if query.TargetService != "" {
+		conditions = append(conditions, "COALESCE(target_service, '') = ?")
+		args = append(args, query.TargetService)
+	}
+	if query.Type != "" {
+		conditions = append(conditions, "type = ?")
+		args = append(args, query.Type)
+	}
+	if query.IP != "" {
+		ip := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(query.IP)
+		conditions = append(conditions, `(device_ip = ? OR device_ip LIKE ? ESCAPE '\' OR device_ip LIKE ? ESCAPE '\')`)
+		args = append(args, query.IP, ip+":%", "["+ip+"]:%")
+	}
+	if !query.Since.IsZero() {
+		conditions = append(conditions, "timestamp >= ?")
+		args = append(args, query.Since.Format(time.RFC3339))
+	}
+	if !query.Until.IsZero() {
+		conditions = append(conditions, "timestamp < ?")
+		args = append(args, query.Until.Format(time.RFC3339))
+	}
+
+	direction, after := "ASC", ">"
+	if query.Descending {
+		direction, after = "DESC", "<"
+	}
+	order := []string{"timestamp " + direction, "id " + direction}
+	if column, ok := eventSortColumns[query.Sort]; ok {
+		order = append([]string{column + " " + direction}, order...)
+		if cursor != nil {
+			conditions = append(conditions, fmt.Sprintf("(%s, timestamp, id) %s (?, ?, ?)", column, after))
+			args = append(args, cursor.Value, cursor.Timestamp.Format(time.RFC3339), cursor.ID)
+		}
+	} else if cursor != nil {
+		conditions = append(conditions, fmt.Sprintf("(timestamp, id) %s (?, ?)", after))
+		args = append(args, cursor.Timestamp.Format(time.RFC3339), cursor.ID)
+	}
+
+	statement := "SELECT id, device_id, device_ip, type, COALESCE(target_service, ''), COALESCE(connection_type, ''), timestamp, reason, trace, country, asn FROM emissary_client_event"
+	if len(conditions) > 0 {
+		statement += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	statement += " ORDER BY " + strings.Join(order, ", ") + " LIMIT ?"
+	args = append(args, query.Limit+1)
+
+	rows, err := r.db.Query(statement, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error querying emissary events: %s", err)
+	}
+	defer rows.Close()
+
+	var events []emissary.Event
+	for rows.Next() {
+		event, err := scanEmissaryClientEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, *event)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return newEventPage(events, query), nil
+}
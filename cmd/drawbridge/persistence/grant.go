@@ -0,0 +1,69 @@
+package persistence
+
+import (
+	"fmt"
+	"imdawon/drawbridge/cmd/drawbridge/emissary/authorization"
+)
+
+func (r *SQLiteRepository) CreateNewGrant(grant authorization.Grant) (*authorization.Grant, error) {
+	res, err := r.db.Exec(
+		"INSERT INTO service_grants(service_id, group_name, policy_id, schedule_id) values(?,?,?,?)",
+		grant.ServiceID,
+		grant.Group,
+		grant.PolicyID,
+		grant.ScheduleID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error inserting new grant into the db: %w", err)
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, fmt.Errorf("a new grant was inserted into the db, but an error was returned when retrieving the id for it: %w", err)
+	}
+
+	grant.ID = id
+	return &grant, nil
+}
+
+func (r *SQLiteRepository) GetAllGrants() ([]authorization.Grant, error) {
+	return r.queryGrants("SELECT id, service_id, group_name, policy_id, schedule_id FROM service_grants ORDER BY service_id, group_name")
+}
+
+func (r *SQLiteRepository) GetGrantsForService(serviceID int64) ([]authorization.Grant, error) {
+	return r.queryGrants("SELECT id, service_id, group_name, policy_id, schedule_id FROM service_grants WHERE service_id = ? ORDER BY group_name", serviceID)
+}
+
+func (r *SQLiteRepository) queryGrants(query string, args ...any) ([]authorization.Grant, error) {
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error getting grants: %w", err)
+	}
+	defer rows.Close()
+
+	var grants []authorization.Grant
+	for rows.Next() {
+		var grant authorization.Grant
+		err := rows.Scan(&grant.ID, &grant.ServiceID, &grant.Group, &grant.PolicyID, &grant.ScheduleID)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning grant database row into a grant struct: %w", err)
+		}
+		grants = append(grants, grant)
+	}
+	return grants, rows.Err()
+}
+
+func (r *SQLiteRepository) DeleteGrant(id int64) error {
+	res, err := r.db.Exec("DELETE FROM service_grants WHERE id = ?", id)
+	if err != nil {
+		return fmt.Errorf("error deleting grant with id of %d: %w", id, err)
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return fmt.Errorf("no rows were deleted for grant id: %d", id)
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package persistence
+
+import (
+	"database/sql"
+	"fmt"
+	"imdawon/drawbridge/cmd/drawbridge/emissary/authorization"
+	"imdawon/drawbridge/cmd/utils"
+	"time"
+)
+
+const jitRequestColumns = "id, device_id, service_id, reason, status, requested_at, decided_by, decided_at, expires_at"
+
+func (r *SQLiteRepository) CreateNewJITRequest(request authorization.JITRequest) (*authorization.JITRequest, error) {
+	res, err := r.db.Exec(
+		"INSERT INTO jit_requests(device_id, service_id, reason, status, requested_at, decided_by, decided_at, expires_at) values(?,?,?,?,?,?,?,?)",
+		request.DeviceID,
+		request.ServiceID,
+		request.Reason,
+		request.Status,
+		formatOptionalTime(request.RequestedAt),
+		request.DecidedBy,
+		formatOptionalTime(request.DecidedAt),
+		formatOptionalTime(request.ExpiresAt),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error inserting new just-in-time access request into the db: %w", err)
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, fmt.Errorf("a new just-in-time access request was inserted into the db, but an error was returned when retrieving the id for it: %w", err)
+	}
+
+	request.ID = id
+	return &request, nil
+}
+
+func (r *SQLiteRepository) GetJITRequestById(id int64) (*authorization.JITRequest, error) {
+	requests, err := r.queryJITRequests("SELECT "+jitRequestColumns+" FROM jit_requests WHERE id = ?", id)
+	if err != nil {
+		return nil, err
+	}
+	if len(requests) == 0 {
+		return &authorization.JITRequest{}, nil
+	}
+	return &requests[0], nil
+}
+
+func (r *SQLiteRepository) GetJITRequests(statuses []authorization.JITStatus, limit int) ([]authorization.JITRequest, error) {
+	if len(statuses) == 0 {
+		return nil, nil
+	}
+	args := make([]any, 0, len(statuses)+1)
+	for _, status := range statuses {
+		args = append(args, status)
+	}
+	query := fmt.Sprintf("SELECT %s FROM jit_requests WHERE status IN (%s) ORDER BY requested_at DESC, id DESC", jitRequestColumns, utils.GeneratePlaceholders(len(statuses)))
+	if limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, limit)
+	}
+	return r.queryJITRequests(query, args...)
+}
+
+func (r *SQLiteRepository) GetJITRequestsForDevice(deviceID string, serviceID int64, status authorization.JITStatus) ([]authorization.JITRequest, error) {
+	return r.queryJITRequests(
+		"SELECT "+jitRequestColumns+" FROM jit_requests WHERE device_id = ? AND service_id = ? AND status = ? ORDER BY requested_at DESC, id DESC",
+		deviceID,
+		serviceID,
+		status,
+	)
+}
+
+func (r *SQLiteRepository) queryJITRequests(query string, args ...any) ([]authorization.JITRequest, error) {
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error getting just-in-time access requests: %w", err)
+	}
+	defer rows.Close()
+
+	var requests []authorization.JITRequest
+	for rows.Next() {
+		request, err := scanJITRequest(rows)
+		if err != nil {
+			return nil, err
+		}
+		requests = append(requests, *request)
+	}
+	return requests, rows.Err()
+}
+
+func scanJITRequest(rows *sql.Rows) (*authorization.JITRequest, error) {
+	var request authorization.JITRequest
+	var requestedAt, decidedAt, expiresAt string
+	err := rows.Scan(
+		&request.ID,
+		&request.DeviceID,
+		&request.ServiceID,
+		&request.Reason,
+		&request.Status,
+		&requestedAt,
+		&request.DecidedBy,
+		&decidedAt,
+		&expiresAt,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error scanning just-in-time access request database row into a request struct: %w", err)
+	}
+	for _, field := range []struct {
+		value string
+		time  *time.Time
+	}{{requestedAt, &request.RequestedAt}, {decidedAt, &request.DecidedAt}, {expiresAt, &request.ExpiresAt}} {
+		*field.time, err = parseOptionalTime(field.value)
+		if err != nil {
+			return nil, fmt.Errorf("just-in-time access request %d: %w", request.ID, err)
+		}
+	}
+	return &request, nil
+}
+
+func (r *SQLiteRepository) UpdateJITRequest(request *authorization.JITRequest, from authorization.JITStatus) error {
+	res, err := r.db.Exec(
+		"UPDATE jit_requests SET status = ?, decided_by = ?, decided_at = ?, expires_at = ? WHERE id = ? AND status = ?",
+		request.Status,
+		request.DecidedBy,
+		formatOptionalTime(request.DecidedAt),
+		formatOptionalTime(request.ExpiresAt),
+		request.ID,
+		from,
+	)
+	if err != nil {
+		return fmt.Errorf("error updating just-in-time access request id %d: %w", request.ID, err)
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return fmt.Errorf("update failed: no %s just-in-time access request with id %d", from, request.ID)
+	}
+	return nil
+}
+
+// Times are stored as RFC 3339 text in UTC, to the second, and as an empty string when they haven't happened.
+func formatOptionalTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+func parseOptionalTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q: %w", value, err)
+	}
+	return t, nil
+}
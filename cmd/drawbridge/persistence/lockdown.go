@@ -0,0 +1,62 @@
+package persistence
+
+import (
+	"fmt"
+	"imdawon/drawbridge/cmd/drawbridge/lockdown"
+)
+
+func (r *SQLiteRepository) GetLockdown() (*lockdown.Transition, error) {
+	transitions, err := r.GetLockdownTransitions(1)
+	if err != nil {
+		return nil, err
+	}
+	if len(transitions) == 0 {
+		return &lockdown.Transition{}, nil
+	}
+	return &transitions[0], nil
+}
+
+func (r *SQLiteRepository) GetLockdownTransitions(limit int) ([]lockdown.Transition, error) {
+	rows, err := r.db.Query("SELECT id, active, actor, reason, created_at FROM lockdown_transitions ORDER BY id DESC LIMIT ?", limit)
+	if err != nil {
+		return nil, fmt.Errorf("error getting lockdown transitions: %w", err)
+	}
+	defer rows.Close()
+
+	var transitions []lockdown.Transition
+	for rows.Next() {
+		var transition lockdown.Transition
+		var createdAt string
+		err := rows.Scan(&transition.ID, &transition.Active, &transition.Actor, &transition.Reason, &createdAt)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning lockdown database row into a transition struct: %w", err)
+		}
+		transition.CreatedAt, err = parseOptionalTime(createdAt)
+		if err != nil {
+			return nil, fmt.Errorf("lockdown transition %d: %w", transition.ID, err)
+		}
+		transitions = append(transitions, transition)
+	}
+	return transitions, rows.Err()
+}
+
+func (r *SQLiteRepository) CreateLockdownTransition(transition lockdown.Transition) (*lockdown.Transition, error) {
+	res, err := r.db.Exec(
+		"INSERT INTO lockdown_transitions(active, actor, reason, created_at) values(?,?,?,?)",
+		transition.Active,
+		transition.Actor,
+		transition.Reason,
+		formatOptionalTime(transition.CreatedAt),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error inserting new lockdown transition into the db: %w", err)
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, fmt.Errorf("a new lockdown transition was inserted into the db, but an error was returned when retrieving the id for it: %w", err)
+	}
+
+	transition.ID = id
+	return &transition, nil
+}
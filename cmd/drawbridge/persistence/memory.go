@@ -0,0 +1,1105 @@
+package persistence
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"imdawon/drawbridge/cmd/drawbridge/emissary"
+	"imdawon/drawbridge/cmd/drawbridge/emissary/authorization"
+	"imdawon/drawbridge/cmd/drawbridge/lockdown"
+	"imdawon/drawbridge/cmd/drawbridge/network"
+	"imdawon/drawbridge/cmd/drawbridge/persistence/migrations"
+	"imdawon/drawbridge/cmd/drawbridge/services"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Keeps everything Drawbridge stores in memory, for running Drawbridge embedded and for unit tests that
+// shouldn't need a database file. It behaves like SQLiteRepository, which TestRepositoryConformance checks.
+// Nothing is kept once the process exits.
+type MemoryRepository struct {
+	mu sync.RWMutex
+
+	services       []services.ProtectedService
+	nextServiceID  int64
+	policies       []authorization.Policy
+	nextPolicyID   int64
+	schedules      []authorization.Schedule
+	nextScheduleID int64
+	grants         []authorization.Grant
+	nextGrantID    int64
+	jitRequests    []authorization.JITRequest
+	nextJITID      int64
+	// In the order they were created, like the emissary_client table.
+	clients []emissary.EmissaryClient
+	// Keyed by device id, oldest first.
+	posture       map[string][]emissary.PostureReport
+	nextPostureID int64
+	// Keyed by device id.
+	totp map[string]emissary.TOTPEnrollment
+	// Keyed by device id.
+	quarantines map[string]emissary.Quarantine
+	// When each device first connected, and first connected from each country and to each Protected Service.
+	baseline map[baselineKey]time.Time
+	// Keyed by IP.
+	bans map[string]network.Ban
+	// Oldest first.
+	lockdownTransitions []lockdown.Transition
+	events              []rollupEvent
+	// Keyed by the size of their buckets, like eventRollupTables.
+	rollups    map[time.Duration]map[rollupKey]emissary.EventRollup
+	config     map[string]string
+	superseded map[string]supersededCertificate
+}
+
+type supersededCertificate struct {
+	deviceID    string
+	certificate string
+	expiresAt   time.Time
+}
+
+func NewMemoryRepository() *MemoryRepository {
+	rollups := make(map[time.Duration]map[rollupKey]emissary.EventRollup, len(eventRollupTables))
+	for bucketSize := range eventRollupTables {
+		rollups[bucketSize] = make(map[rollupKey]emissary.EventRollup)
+	}
+	return &MemoryRepository{
+		nextServiceID:  1,
+		nextPolicyID:   1,
+		nextScheduleID: 1,
+		nextGrantID:    1,
+		nextJITID:      1,
+		posture:        make(map[string][]emissary.PostureReport),
+		nextPostureID:  1,
+		totp:           make(map[string]emissary.TOTPEnrollment),
+		quarantines:    make(map[string]emissary.Quarantine),
+		baseline:       make(map[baselineKey]time.Time),
+		bans:           make(map[string]network.Ban),
+		rollups:        rollups,
+		config:         make(map[string]string),
+		superseded:     make(map[string]supersededCertificate),
+	}
+}
+
+// There is no schema to migrate in memory.
+func (r *MemoryRepository) Migrate() ([]migrations.Migration, error) {
+	return nil, nil
+}
+
+func (r *MemoryRepository) Close() error {
+	return nil
+}
+
+func (r *MemoryRepository) CreateNewService(service services.ProtectedService) (*services.ProtectedService, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	service.ID = r.nextServiceID
+	r.nextServiceID++
+	r.services = append(r.services, cloneService(service))
+	return &service, nil
+}
+
+func (r *MemoryRepository) GetAllServices() ([]services.ProtectedService, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var all []services.ProtectedService
+	for _, service := range r.services {
+		all = append(all, cloneService(service))
+	}
+	return all, nil
+}
+
+func (r *MemoryRepository) GetServiceById(id int64) (*services.ProtectedService, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var service services.ProtectedService
+	if i := r.serviceIndex(id); i >= 0 {
+		service = cloneService(r.services[i])
+	}
+	return &service, nil
+}
+
+func (r *MemoryRepository) UpdateService(updated *services.ProtectedService, id int64) error {
+	if id == 0 {
+		return fmt.Errorf("invalid updated ID")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i := r.serviceIndex(id)
+	if i < 0 {
+		return fmt.Errorf("update failed: no service with id %d", id)
+	}
+	r.services[i].Name = updated.Name
+	r.services[i].Description = updated.Description
+	r.services[i].Host = updated.Host
+	r.services[i].Port = updated.Port
+	r.services[i].ClientPolicyID = updated.ClientPolicyID
+	r.services[i].ScheduleID = updated.ScheduleID
+	r.services[i].RequireApproval = updated.RequireApproval
+	r.services[i].RequireStepUp = updated.RequireStepUp
+	r.services[i].NetworkRules = cloneService(*updated).NetworkRules
+	return nil
+}
+
+func (r *MemoryRepository) DeleteService(id int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i := r.serviceIndex(int64(id))
+	if i < 0 {
+		return fmt.Errorf("no rows were deleted for service id: %d", id)
+	}
+	r.services = slices.Delete(r.services, i, i+1)
+	r.grants = slices.DeleteFunc(r.grants, func(grant authorization.Grant) bool { return grant.ServiceID == int64(id) })
+	return nil
+}
+
+func (r *MemoryRepository) serviceIndex(id int64) int {
+	return slices.IndexFunc(r.services, func(service services.ProtectedService) bool { return service.ID == id })
+}
+
+// Copies the network rules, so callers can't change a stored service.
+func cloneService(service services.ProtectedService) services.ProtectedService {
+	rules := &service.NetworkRules
+	rules.AllowCIDRs, rules.DenyCIDRs = slices.Clone(rules.AllowCIDRs), slices.Clone(rules.DenyCIDRs)
+	rules.AllowCountries, rules.DenyCountries = slices.Clone(rules.AllowCountries), slices.Clone(rules.DenyCountries)
+	rules.AllowASNs, rules.DenyASNs = slices.Clone(rules.AllowASNs), slices.Clone(rules.DenyASNs)
+	return service
+}
+
+func (r *MemoryRepository) CreateNewPolicy(policy authorization.Policy) (*authorization.Policy, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// The same constraint as the policies table.
+	if slices.ContainsFunc(r.policies, func(existing authorization.Policy) bool { return existing.Name == policy.Name }) {
+		return nil, fmt.Errorf("error inserting new policy into the db: a policy named %s already exists", policy.Name)
+	}
+	policy.ID = r.nextPolicyID
+	r.nextPolicyID++
+	r.policies = append(r.policies, clonePolicy(policy))
+	return &policy, nil
+}
+
+func (r *MemoryRepository) GetAllPolicies() ([]authorization.Policy, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var all []authorization.Policy
+	for _, policy := range r.policies {
+		all = append(all, clonePolicy(policy))
+	}
+	return all, nil
+}
+
+func (r *MemoryRepository) GetPolicyById(id int64) (*authorization.Policy, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var policy authorization.Policy
+	if i := r.policyIndex(id); i >= 0 {
+		policy = clonePolicy(r.policies[i])
+	}
+	return &policy, nil
+}
+
+func (r *MemoryRepository) UpdatePolicy(updated *authorization.Policy, id int64) error {
+	if id == 0 {
+		return fmt.Errorf("invalid updated ID")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i := r.policyIndex(id)
+	if i < 0 {
+		return fmt.Errorf("update failed: no policy with id %d", id)
+	}
+	if slices.ContainsFunc(r.policies, func(existing authorization.Policy) bool { return existing.ID != id && existing.Name == updated.Name }) {
+		return fmt.Errorf("error updating policy id %d: a policy named %s already exists", id, updated.Name)
+	}
+	r.policies[i] = clonePolicy(*updated)
+	r.policies[i].ID = id
+	return nil
+}
+
+func (r *MemoryRepository) DeletePolicy(id int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	attached := 0
+	for _, service := range r.services {
+		if service.ClientPolicyID == id {
+			attached++
+		}
+	}
+	if attached > 0 {
+		return fmt.Errorf("policy id %d is attached to %d Protected Service(s), detach it first", id, attached)
+	}
+	if grants := r.countGrants(func(grant authorization.Grant) bool { return grant.PolicyID == id }); grants > 0 {
+		return fmt.Errorf("policy id %d is used by %d grant(s), remove them first", id, grants)
+	}
+	i := r.policyIndex(id)
+	if i < 0 {
+		return fmt.Errorf("no rows were deleted for policy id: %d", id)
+	}
+	r.policies = slices.Delete(r.policies, i, i+1)
+	return nil
+}
+
+func (r *MemoryRepository) policyIndex(id int64) int {
+	return slices.IndexFunc(r.policies, func(policy authorization.Policy) bool { return policy.ID == id })
+}
+
+// Copies the rules through JSON, like SQLite stores them, so callers can't change a stored policy.
+func clonePolicy(policy authorization.Policy) authorization.Policy {
+	rules, _ := json.Marshal(policy.Rules)
+	policy.Rules = authorization.Group{}
+	json.Unmarshal(rules, &policy.Rules)
+	return policy
+}
+
+func (r *MemoryRepository) CreateNewSchedule(schedule authorization.Schedule) (*authorization.Schedule, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// The same constraint as the schedules table.
+	if slices.ContainsFunc(r.schedules, func(existing authorization.Schedule) bool { return existing.Name == schedule.Name }) {
+		return nil, fmt.Errorf("error inserting new schedule into the db: a schedule named %s already exists", schedule.Name)
+	}
+	schedule.ID = r.nextScheduleID
+	r.nextScheduleID++
+	r.schedules = append(r.schedules, cloneSchedule(schedule))
+	return &schedule, nil
+}
+
+func (r *MemoryRepository) GetAllSchedules() ([]authorization.Schedule, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var all []authorization.Schedule
+	for _, schedule := range r.schedules {
+		all = append(all, cloneSchedule(schedule))
+	}
+	return all, nil
+}
+
+func (r *MemoryRepository) GetScheduleById(id int64) (*authorization.Schedule, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var schedule authorization.Schedule
+	if i := r.scheduleIndex(id); i >= 0 {
+		schedule = cloneSchedule(r.schedules[i])
+	}
+	return &schedule, nil
+}
+
+func (r *MemoryRepository) UpdateSchedule(updated *authorization.Schedule, id int64) error {
+	if id == 0 {
+		return fmt.Errorf("invalid updated ID")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i := r.scheduleIndex(id)
+	if i < 0 {
+		return fmt.Errorf("update failed: no schedule with id %d", id)
+	}
+	if slices.ContainsFunc(r.schedules, func(existing authorization.Schedule) bool { return existing.ID != id && existing.Name == updated.Name }) {
+		return fmt.Errorf("error updating schedule id %d: a schedule named %s already exists", id, updated.Name)
+	}
+	r.schedules[i] = cloneSchedule(*updated)
+	r.schedules[i].ID = id
+	return nil
+}
+
+func (r *MemoryRepository) DeleteSchedule(id int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	services, policies := 0, 0
+	for _, service := range r.services {
+		if service.ScheduleID == id {
+			services++
+		}
+	}
+	for _, policy := range r.policies {
+		if policy.ScheduleID == id {
+			policies++
+		}
+	}
+	if services > 0 || policies > 0 {
+		return fmt.Errorf("schedule id %d is attached to %d Protected Service(s) and %d policies, detach it first", id, services, policies)
+	}
+	if grants := r.countGrants(func(grant authorization.Grant) bool { return grant.ScheduleID == id }); grants > 0 {
+		return fmt.Errorf("schedule id %d is used by %d grant(s), remove them first", id, grants)
+	}
+	i := r.scheduleIndex(id)
+	if i < 0 {
+		return fmt.Errorf("no rows were deleted for schedule id: %d", id)
+	}
+	r.schedules = slices.Delete(r.schedules, i, i+1)
+	return nil
+}
+
+func (r *MemoryRepository) scheduleIndex(id int64) int {
+	return slices.IndexFunc(r.schedules, func(schedule authorization.Schedule) bool { return schedule.ID == id })
+}
+
+// Copies the windows and exceptions, so callers can't change a stored schedule.
+func cloneSchedule(schedule authorization.Schedule) authorization.Schedule {
+	schedule.Windows = slices.Clone(schedule.Windows)
+	for i := range schedule.Windows {
+		schedule.Windows[i].Days = slices.Clone(schedule.Windows[i].Days)
+	}
+	schedule.Exceptions = slices.Clone(schedule.Exceptions)
+	return schedule
+}
+
+func (r *MemoryRepository) CreateNewGrant(grant authorization.Grant) (*authorization.Grant, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// The same constraint as the service_grants table.
+	if r.countGrants(func(existing authorization.Grant) bool {
+		return existing.ServiceID == grant.ServiceID && existing.Group == grant.Group
+	}) > 0 {
+		return nil, fmt.Errorf("error inserting new grant into the db: group %s already has a grant for service id %d", grant.Group, grant.ServiceID)
+	}
+	grant.ID = r.nextGrantID
+	r.nextGrantID++
+	r.grants = append(r.grants, grant)
+	return &grant, nil
+}
+
+// Ordered by service and group, like the SQLite repository.
+func (r *MemoryRepository) GetAllGrants() ([]authorization.Grant, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	grants := slices.Clone(r.grants)
+	slices.SortFunc(grants, func(a, b authorization.Grant) int {
+		if a.ServiceID != b.ServiceID {
+			return cmp.Compare(a.ServiceID, b.ServiceID)
+		}
+		return strings.Compare(a.Group, b.Group)
+	})
+	return grants, nil
+}
+
+func (r *MemoryRepository) GetGrantsForService(serviceID int64) ([]authorization.Grant, error) {
+	all, err := r.GetAllGrants()
+	if err != nil {
+		return nil, err
+	}
+	var grants []authorization.Grant
+	for _, grant := range all {
+		if grant.ServiceID == serviceID {
+			grants = append(grants, grant)
+		}
+	}
+	return grants, nil
+}
+
+func (r *MemoryRepository) DeleteGrant(id int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i := slices.IndexFunc(r.grants, func(grant authorization.Grant) bool { return grant.ID == id })
+	if i < 0 {
+		return fmt.Errorf("no rows were deleted for grant id: %d", id)
+	}
+	r.grants = slices.Delete(r.grants, i, i+1)
+	return nil
+}
+
+func (r *MemoryRepository) countGrants(match func(authorization.Grant) bool) int {
+	count := 0
+	for _, grant := range r.grants {
+		if match(grant) {
+			count++
+		}
+	}
+	return count
+}
+
+// Times are kept to the second in UTC, like the jit_requests table.
+func (r *MemoryRepository) CreateNewJITRequest(request authorization.JITRequest) (*authorization.JITRequest, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	request = truncateJITTimes(request)
+	request.ID = r.nextJITID
+	r.nextJITID++
+	r.jitRequests = append(r.jitRequests, request)
+	return &request, nil
+}
+
+func (r *MemoryRepository) GetJITRequestById(id int64) (*authorization.JITRequest, error) {
+	requests := r.jitRequestsWhere(func(request authorization.JITRequest) bool { return request.ID == id })
+	if len(requests) == 0 {
+		return &authorization.JITRequest{}, nil
+	}
+	return &requests[0], nil
+}
+
+func (r *MemoryRepository) GetJITRequests(statuses []authorization.JITStatus, limit int) ([]authorization.JITRequest, error) {
+	requests := r.jitRequestsWhere(func(request authorization.JITRequest) bool { return slices.Contains(statuses, request.Status) })
+	if limit > 0 && len(requests) > limit {
+		requests = requests[:limit]
+	}
+	return requests, nil
+}
+
+func (r *MemoryRepository) GetJITRequestsForDevice(deviceID string, serviceID int64, status authorization.JITStatus) ([]authorization.JITRequest, error) {
+	return r.jitRequestsWhere(func(request authorization.JITRequest) bool {
+		return request.DeviceID == deviceID && request.ServiceID == serviceID && request.Status == status
+	}), nil
+}
+
+// Newest first, like the SQLite repository.
+func (r *MemoryRepository) jitRequestsWhere(match func(authorization.JITRequest) bool) []authorization.JITRequest {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var requests []authorization.JITRequest
+	for i := len(r.jitRequests) - 1; i >= 0; i-- {
+		if match(r.jitRequests[i]) {
+			requests = append(requests, r.jitRequests[i])
+		}
+	}
+	slices.SortStableFunc(requests, func(a, b authorization.JITRequest) int { return b.RequestedAt.Compare(a.RequestedAt) })
+	return requests
+}
+
+func (r *MemoryRepository) UpdateJITRequest(request *authorization.JITRequest, from authorization.JITStatus) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i := slices.IndexFunc(r.jitRequests, func(existing authorization.JITRequest) bool {
+		return existing.ID == request.ID && existing.Status == from
+	})
+	if i < 0 {
+		return fmt.Errorf("update failed: no %s just-in-time access request with id %d", from, request.ID)
+	}
+	updated := truncateJITTimes(*request)
+	r.jitRequests[i].Status = updated.Status
+	r.jitRequests[i].DecidedBy = updated.DecidedBy
+	r.jitRequests[i].DecidedAt = updated.DecidedAt
+	r.jitRequests[i].ExpiresAt = updated.ExpiresAt
+	return nil
+}
+
+func truncateJITTimes(request authorization.JITRequest) authorization.JITRequest {
+	for _, t := range []*time.Time{&request.RequestedAt, &request.DecidedAt, &request.ExpiresAt} {
+		if !t.IsZero() {
+			*t = t.UTC().Truncate(time.Second)
+		}
+	}
+	return request
+}
+
+func (r *MemoryRepository) CreateNewEmissaryClient(client emissary.EmissaryClient) (*emissary.EmissaryClient, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// The same constraints as the emissary_client table.
+	for _, existing := range r.clients {
+		if existing.ID == client.ID || existing.Name == client.Name || existing.DrawbridgeCertificate == client.DrawbridgeCertificate {
+			return nil, fmt.Errorf("error creating new emissary client: a device with the same id, name or certificate already exists")
+		}
+	}
+	r.clients = append(r.clients, cloneEmissaryClient(client))
+	return &client, nil
+}
+
+func (r *MemoryRepository) GetAllEmissaryClients() ([]*emissary.EmissaryClient, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var clients []*emissary.EmissaryClient
+	for _, client := range r.clients {
+		client = cloneEmissaryClient(client)
+		clients = append(clients, &client)
+	}
+	return clients, nil
+}
+
+func (r *MemoryRepository) GetEmissaryClientById(id string) (*emissary.EmissaryClient, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var client emissary.EmissaryClient
+	if i := r.clientIndex(id); i >= 0 {
+		client = cloneEmissaryClient(r.clients[i])
+	}
+	return &client, nil
+}
+
+func (r *MemoryRepository) RenameEmissaryClient(id, name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i := r.clientIndex(id)
+	if i < 0 {
+		return fmt.Errorf("no emissary client with id of %s", id)
+	}
+	for _, existing := range r.clients {
+		if existing.ID != id && existing.Name == name {
+			return fmt.Errorf("error renaming emissary client with id of %s: a device named %s already exists", id, name)
+		}
+	}
+	r.clients[i].Name = name
+	return nil
+}
+
+func (r *MemoryRepository) UpdateEmissaryClientGroupsAndTags(id string, groups, tags []string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i := r.clientIndex(id)
+	if i < 0 {
+		return fmt.Errorf("no emissary client with id of %s", id)
+	}
+	r.clients[i].Groups, r.clients[i].Tags = slices.Clone(groups), slices.Clone(tags)
+	return nil
+}
+
+// Copies the groups and tags, so callers can't change a stored device.
+func cloneEmissaryClient(client emissary.EmissaryClient) emissary.EmissaryClient {
+	client.Groups, client.Tags = slices.Clone(client.Groups), slices.Clone(client.Tags)
+	return client
+}
+
+func (r *MemoryRepository) RevokeEmissaryClient(deviceID string) (*emissary.EmissaryClient, *emissary.Event, error) {
+	return r.setRevoked(deviceID, 1)
+}
+
+func (r *MemoryRepository) UnRevokeEmissaryClient(id string) (*emissary.EmissaryClient, *emissary.Event, error) {
+	return r.setRevoked(id, 0)
+}
+
+func (r *MemoryRepository) setRevoked(deviceID string, revoked uint8) (*emissary.EmissaryClient, *emissary.Event, error) {
+	r.mu.Lock()
+	if i := r.clientIndex(deviceID); i >= 0 {
+		r.clients[i].Revoked = revoked
+	}
+	r.mu.Unlock()
+
+	client, err := r.GetEmissaryClientById(deviceID)
+	if err != nil {
+		return nil, nil, err
+	}
+	event, err := r.GetLatestEventForDeviceId(deviceID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return client, event, nil
+}
+
+func (r *MemoryRepository) clientIndex(id string) int {
+	return slices.IndexFunc(r.clients, func(client emissary.EmissaryClient) bool { return client.ID == id })
+}
+
+func (r *MemoryRepository) InsertPostureReport(report emissary.PostureReport) (*emissary.PostureReport, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	report.ID = r.nextPostureID
+	r.nextPostureID++
+	report.ReportedAt = report.ReportedAt.UTC().Truncate(time.Second)
+	reports := append(r.posture[report.DeviceID], report)
+	if len(reports) > emissary.MaxPostureHistory {
+		reports = slices.Clone(reports[len(reports)-emissary.MaxPostureHistory:])
+	}
+	r.posture[report.DeviceID] = reports
+	return &report, nil
+}
+
+func (r *MemoryRepository) GetPostureHistory(deviceID string, limit int) ([]emissary.PostureReport, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	reports := slices.Clone(r.posture[deviceID])
+	slices.Reverse(reports)
+	return reports[:min(limit, len(reports))], nil
+}
+
+func (r *MemoryRepository) GetLatestPostureReports(deviceIDs []string) (map[string]emissary.PostureReport, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	latest := make(map[string]emissary.PostureReport, len(deviceIDs))
+	for _, deviceID := range deviceIDs {
+		if reports := r.posture[deviceID]; len(reports) > 0 {
+			latest[deviceID] = reports[len(reports)-1]
+		}
+	}
+	return latest, nil
+}
+
+func (r *MemoryRepository) GetDeviceTOTP(deviceID string) (*emissary.TOTPEnrollment, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	enrollment := r.totp[deviceID]
+	return &enrollment, nil
+}
+
+// Times are kept to the second in UTC, like the device_totp table.
+func (r *MemoryRepository) SaveDeviceTOTP(enrollment emissary.TOTPEnrollment) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, t := range []*time.Time{&enrollment.EnrolledAt, &enrollment.LockedUntil} {
+		if !t.IsZero() {
+			*t = t.UTC().Truncate(time.Second)
+		}
+	}
+	r.totp[enrollment.DeviceID] = enrollment
+	return nil
+}
+
+func (r *MemoryRepository) DeleteDeviceTOTP(deviceID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.totp[deviceID]; !ok {
+		return fmt.Errorf("device %s isn't enrolled in step-up authentication", deviceID)
+	}
+	delete(r.totp, deviceID)
+	return nil
+}
+
+func (r *MemoryRepository) GetDeviceQuarantine(deviceID string) (*emissary.Quarantine, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	quarantine := r.quarantines[deviceID]
+	return &quarantine, nil
+}
+
+func (r *MemoryRepository) GetQuarantinedDevices() ([]emissary.Quarantine, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var quarantines []emissary.Quarantine
+	for _, quarantine := range r.quarantines {
+		quarantines = append(quarantines, quarantine)
+	}
+	slices.SortFunc(quarantines, func(a, b emissary.Quarantine) int {
+		return cmp.Or(b.QuarantinedAt.Compare(a.QuarantinedAt), strings.Compare(a.DeviceID, b.DeviceID))
+	})
+	return quarantines, nil
+}
+
+// Times are kept to the second in UTC, like the device_quarantine table.
+func (r *MemoryRepository) QuarantineDevice(quarantine emissary.Quarantine) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.quarantines[quarantine.DeviceID]; ok {
+		return fmt.Errorf("error quarantining device %s: it is already quarantined", quarantine.DeviceID)
+	}
+	quarantine.QuarantinedAt = quarantine.QuarantinedAt.UTC().Truncate(time.Second)
+	r.quarantines[quarantine.DeviceID] = quarantine
+	return nil
+}
+
+func (r *MemoryRepository) ReleaseDevice(deviceID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.quarantines[deviceID]; !ok {
+		return fmt.Errorf("device %s isn't quarantined", deviceID)
+	}
+	delete(r.quarantines, deviceID)
+	return nil
+}
+
+type baselineKey struct {
+	deviceID string
+	// One of the kinds of rows in the device_baseline table.
+	kind  string
+	value string
+}
+
+// Times are kept to the second in UTC, like the device_baseline table.
+func (r *MemoryRepository) RecordDeviceBaseline(deviceID, country, service string, seen time.Time) error {
+	seen = seen.UTC().Truncate(time.Second)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, key := range []baselineKey{{deviceID, baselineConnection, ""}, {deviceID, baselineCountry, country}, {deviceID, baselineService, service}} {
+		if key.kind != baselineConnection && key.value == "" {
+			continue
+		}
+		if firstSeen, ok := r.baseline[key]; !ok || seen.Before(firstSeen) {
+			r.baseline[key] = seen
+		}
+	}
+	return nil
+}
+
+func (r *MemoryRepository) GetDeviceHistory(deviceID string, before time.Time) (*emissary.DeviceHistory, error) {
+	before = before.UTC().Truncate(time.Second)
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var history emissary.DeviceHistory
+	for key, firstSeen := range r.baseline {
+		if key.deviceID != deviceID || !firstSeen.Before(before) {
+			continue
+		}
+		switch key.kind {
+		case baselineConnection:
+			history.FirstSeen = firstSeen
+		case baselineCountry:
+			history.Countries = append(history.Countries, key.value)
+		case baselineService:
+			history.Services = append(history.Services, key.value)
+		}
+	}
+	slices.Sort(history.Countries)
+	slices.Sort(history.Services)
+	return &history, nil
+}
+
+func (r *MemoryRepository) GetIPBan(ip string) (*network.Ban, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	ban := r.bans[ip]
+	return &ban, nil
+}
+
+// Compares to the second, like the RFC 3339 times in the ip_bans table.
+func (r *MemoryRepository) GetActiveIPBans(now time.Time) ([]network.Ban, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	now = now.UTC().Truncate(time.Second)
+	var bans []network.Ban
+	for _, ban := range r.bans {
+		if ban.ExpiresAt.After(now) {
+			bans = append(bans, ban)
+		}
+	}
+	slices.SortFunc(bans, func(a, b network.Ban) int {
+		return cmp.Or(b.BannedAt.Compare(a.BannedAt), strings.Compare(a.IP, b.IP))
+	})
+	return bans, nil
+}
+
+// Times are kept to the second in UTC, like the ip_bans table.
+func (r *MemoryRepository) SaveIPBan(ban network.Ban) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ban.BannedAt = ban.BannedAt.UTC().Truncate(time.Second)
+	ban.ExpiresAt = ban.ExpiresAt.UTC().Truncate(time.Second)
+	r.bans[ban.IP] = ban
+	return nil
+}
+
+func (r *MemoryRepository) DeleteIPBan(ip string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.bans[ip]; !ok {
+		return fmt.Errorf("%s isn't banned", ip)
+	}
+	delete(r.bans, ip)
+	return nil
+}
+
+func (r *MemoryRepository) PruneIPBans(before time.Time) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	before = before.UTC().Truncate(time.Second)
+	var pruned int64
+	for ip, ban := range r.bans {
+		if ban.ExpiresAt.Before(before) {
+			delete(r.bans, ip)
+			pruned++
+		}
+	}
+	return pruned, nil
+}
+
+func (r *MemoryRepository) GetLockdown() (*lockdown.Transition, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if len(r.lockdownTransitions) == 0 {
+		return &lockdown.Transition{}, nil
+	}
+	transition := r.lockdownTransitions[len(r.lockdownTransitions)-1]
+	return &transition, nil
+}
+
+func (r *MemoryRepository) GetLockdownTransitions(limit int) ([]lockdown.Transition, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var transitions []lockdown.Transition
+	for i := len(r.lockdownTransitions) - 1; i >= 0 && len(transitions) < limit; i-- {
+		transitions = append(transitions, r.lockdownTransitions[i])
+	}
+	return transitions, nil
+}
+
+// Times are kept to the second in UTC, like the lockdown_transitions table.
+func (r *MemoryRepository) CreateLockdownTransition(transition lockdown.Transition) (*lockdown.Transition, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	transition.ID = int64(len(r.lockdownTransitions)) + 1
+	transition.CreatedAt = transition.CreatedAt.UTC().Truncate(time.Second)
+	r.lockdownTransitions = append(r.lockdownTransitions, transition)
+	return &transition, nil
+}
+
+func (r *MemoryRepository) InsertEmissaryClientEvent(event emissary.Event) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.eventIndex(event.ID) >= 0 {
+		return fmt.Errorf("error inserting emissary event: an event with id %s already exists", event.ID)
+	}
+	// SQLite stores timestamps as RFC 3339 text, to the second.
+	event.Timestamp = event.Timestamp.UTC().Truncate(time.Second)
+	r.events = append(r.events, rollupEvent{Event: event})
+	return nil
+}
+
+func (r *MemoryRepository) RecordEmissaryClientEventBytes(eventID string, bytesIn, bytesOut int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if i := r.eventIndex(eventID); i >= 0 {
+		r.events[i].bytesIn += bytesIn
+		r.events[i].bytesOut += bytesOut
+	}
+	return nil
+}
+
+func (r *MemoryRepository) eventIndex(id string) int {
+	return slices.IndexFunc(r.events, func(event rollupEvent) bool { return event.ID == id })
+}
+
+func (r *MemoryRepository) GetLatestEventForEachDeviceId(deviceIDs []any) (map[string]emissary.Event, error) {
+	if len(deviceIDs) == 0 {
+		return nil, fmt.Errorf("no deviceIDs supplied to get latest event for each device id")
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	events := make(map[string]emissary.Event, len(deviceIDs))
+	for _, deviceID := range deviceIDs {
+		id, ok := deviceID.(string)
+		if !ok {
+			continue
+		}
+		event, exists := r.latestEvent(id)
+		if !exists {
+			continue
+		}
+		events[id] = event
+	}
+	return events, nil
+}
+
+func (r *MemoryRepository) GetLatestEventForDeviceId(deviceID string) (*emissary.Event, error) {
+	if len(deviceID) == 0 {
+		return nil, fmt.Errorf("no deviceIDs supplied to get latest event for each device id")
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	event, _ := r.latestEvent(deviceID)
+	return &event, nil
+}
+
+// Finds the most recent event for a device in the rollups, like queryLatestDeviceEventForEachDevice.
+func (r *MemoryRepository) latestEvent(deviceID string) (emissary.Event, bool) {
+	if r.clientIndex(deviceID) < 0 {
+		return emissary.Event{}, false
+	}
+	var latest *emissary.EventRollup
+	for _, rollups := range r.rollups {
+		for key, rollup := range rollups {
+			if key.deviceID == deviceID && (latest == nil || rollup.LastSeen.After(latest.LastSeen)) {
+				latest = &rollup
+			}
+		}
+	}
+	if latest == nil {
+		return emissary.Event{}, false
+	}
+	return emissary.Event{
+		DeviceID:      latest.DeviceID,
+		ConnectionIP:  latest.LastIP,
+		Type:          latest.LastType,
+		TargetService: latest.TargetService,
+		Timestamp:     latest.LastSeen,
+	}, true
+}
+
+func (r *MemoryRepository) QueryEmissaryClientEvents(query emissary.EventQuery) (*emissary.EventPage, error) {
+	query, err := normalizeEventQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	cursor, err := decodeEventCursor(query)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.RLock()
+	var events []emissary.Event
+	for _, event := range r.events {
+		if matchesEventQuery(event.Event, query) {
+			events = append(events, event.Event)
+		}
+	}
+	r.mu.RUnlock()
+
+	compare := func(a, b emissary.Event) int {
+		if query.Descending {
+			return compareEvents(b, a, query.Sort)
+		}
+		return compareEvents(a, b, query.Sort)
+	}
+	slices.SortFunc(events, compare)
+	if cursor != nil {
+		last := emissary.Event{ID: cursor.ID, Timestamp: cursor.Timestamp}
+		switch query.Sort {
+		case emissary.EventSortDevice:
+			last.DeviceID = cursor.Value
+		case emissary.EventSortType:
+			last.Type = cursor.Value
+		case emissary.EventSortTargetService:
+			last.TargetService = cursor.Value
+		case emissary.EventSortIP:
+			last.ConnectionIP = cursor.Value
+		}
+		start, _ := slices.BinarySearchFunc(events, last, compare)
+		if start < len(events) && compare(events[start], last) == 0 {
+			start++
+		}
+		events = events[start:]
+	}
+	return newEventPage(events[:min(len(events), query.Limit+1)], query), nil
+}
+
+func (r *MemoryRepository) RollupEmissaryClientEvents(since time.Time) error {
+	since = since.UTC().Truncate(24 * time.Hour)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var events []rollupEvent
+	for _, event := range r.events {
+		if !event.Timestamp.Before(since) {
+			events = append(events, event)
+		}
+	}
+	slices.SortStableFunc(events, func(a, b rollupEvent) int {
+		return a.Timestamp.Compare(b.Timestamp)
+	})
+	for bucketSize, rollups := range rollupEvents(events) {
+		for key, rollup := range rollups {
+			r.rollups[bucketSize][key] = *rollup
+		}
+	}
+	return nil
+}
+
+func (r *MemoryRepository) PruneEmissaryClientEvents(before time.Time) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	kept := len(r.events)
+	r.events = slices.DeleteFunc(r.events, func(event rollupEvent) bool {
+		return event.Timestamp.Before(before)
+	})
+	return int64(kept - len(r.events)), nil
+}
+
+func (r *MemoryRepository) PruneEmissaryClientEventRollups(hourlyBefore, dailyBefore time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for bucketSize, before := range map[time.Duration]time.Time{time.Hour: hourlyBefore, 24 * time.Hour: dailyBefore} {
+		if before.IsZero() {
+			continue
+		}
+		for key := range r.rollups[bucketSize] {
+			if key.bucket.Before(before) {
+				delete(r.rollups[bucketSize], key)
+			}
+		}
+	}
+	return nil
+}
+
+func (r *MemoryRepository) GetDailyUsageForDevice(deviceID string, since time.Time) ([]emissary.EventRollup, error) {
+	since = since.UTC().Truncate(24 * time.Hour)
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var usage []emissary.EventRollup
+	for key, rollup := range r.rollups[24*time.Hour] {
+		if key.deviceID == deviceID && !key.bucket.Before(since) {
+			usage = append(usage, rollup)
+		}
+	}
+	slices.SortFunc(usage, func(a, b emissary.EventRollup) int {
+		if c := a.Bucket.Compare(b.Bucket); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.TargetService, b.TargetService)
+	})
+	return usage, nil
+}
+
+func (r *MemoryRepository) CreateNewDrawbridgeConfigSettings(setting, value string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.config[setting] = value
+	return nil
+}
+
+func (r *MemoryRepository) GetDrawbridgeConfigValueByName(setting string) (*string, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	value := r.config[setting]
+	return &value, nil
+}
+
+func (r *MemoryRepository) DeleteDrawbridgeConfigSetting(setting string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, exists := r.config[setting]; !exists {
+		return fmt.Errorf("failed to delete drawbridge setting")
+	}
+	delete(r.config, setting)
+	return nil
+}
+
+func (r *MemoryRepository) GetAllEmissaryClientCertificates() (map[string]emissary.DeviceCertificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	deviceCerts := make(map[string]emissary.DeviceCertificate, len(r.clients))
+	for _, client := range r.clients {
+		certificateBytes := sha256.Sum256([]byte(client.DrawbridgeCertificate))
+		deviceCerts[hex.EncodeToString(certificateBytes[:])] = emissary.DeviceCertificate{
+			DeviceID: client.ID,
+			Revoked:  client.Revoked,
+		}
+	}
+	return deviceCerts, nil
+}
+
+func (r *MemoryRepository) SupersedeEmissaryClientCertificate(deviceID, certificateHash, newCertificate string, expiresAt time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i := r.clientIndex(deviceID)
+	if i < 0 {
+		return fmt.Errorf("no emissary client with id %s to update certificate for", deviceID)
+	}
+	for j, client := range r.clients {
+		if j != i && client.DrawbridgeCertificate == newCertificate {
+			return fmt.Errorf("error updating certificate for emissary client %s: the certificate belongs to another device", deviceID)
+		}
+	}
+	if _, exists := r.superseded[certificateHash]; !exists {
+		r.superseded[certificateHash] = supersededCertificate{
+			deviceID:    deviceID,
+			certificate: r.clients[i].DrawbridgeCertificate,
+			expiresAt:   expiresAt,
+		}
+	}
+	r.clients[i].DrawbridgeCertificate = newCertificate
+	return nil
+}
+
+func (r *MemoryRepository) GetActiveSupersededCertificates() (map[string]emissary.DeviceCertificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	now := time.Now()
+	deviceCerts := make(map[string]emissary.DeviceCertificate, 0)
+	for hash, certificate := range r.superseded {
+		i := r.clientIndex(certificate.deviceID)
+		if i < 0 || !certificate.expiresAt.After(now) {
+			continue
+		}
+		deviceCerts[hash] = emissary.DeviceCertificate{
+			DeviceID: certificate.deviceID,
+			Revoked:  r.clients[i].Revoked,
+		}
+	}
+	return deviceCerts, nil
+}
+
+func (r *MemoryRepository) DeleteSupersededCertificates() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	clear(r.superseded)
+	return nil
+}
@@ -0,0 +1,216 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"imdawon/drawbridge/cmd/drawbridge/persistence/migrations"
+	"log/slog"
+	"time"
+)
+
+// The state of a migration in the database, as shown by `drawbridge migrate status`.
+type MigrationStatus struct {
+	migrations.Migration
+	Applied   bool
+	AppliedAt time.Time
+	// Set when the migration applied to the database differs from the one embedded in this binary.
+	ChecksumMismatch bool
+}
+
+// A migration recorded in the schema_version table.
+type appliedMigration struct {
+	version   int
+	name      string
+	checksum  string
+	appliedAt time.Time
+}
+
+// Brings the database schema up to date by applying every pending migration, in order, each in its own transaction.
+// Returns the migrations that were applied.
+func (r *SQLiteRepository) Migrate() ([]migrations.Migration, error) {
+	all, err := migrations.All()
+	if err != nil {
+		return nil, err
+	}
+	return r.migrate(all, false)
+}
+
+// Applies every pending migration and rolls them back instead of committing them, to check that they would succeed.
+// Returns the migrations that would be applied.
+func (r *SQLiteRepository) MigrateDryRun() ([]migrations.Migration, error) {
+	all, err := migrations.All()
+	if err != nil {
+		return nil, err
+	}
+	return r.migrate(all, true)
+}
+
+func (r *SQLiteRepository) migrate(all []migrations.Migration, dryRun bool) ([]migrations.Migration, error) {
+	err := r.createSchemaVersionTable()
+	if err != nil {
+		return nil, err
+	}
+	pending, err := r.pendingMigrations(all)
+	if err != nil {
+		return nil, err
+	}
+
+	if dryRun {
+		// Later migrations build on earlier ones, so a dry run applies them all in one transaction and rolls it back.
+		tx, err := r.db.BeginTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelSerializable})
+		if err != nil {
+			return nil, err
+		}
+		defer tx.Rollback()
+		for _, migration := range pending {
+			err = applyMigration(tx, migration)
+			if err != nil {
+				return nil, fmt.Errorf("migration %d_%s failed: %w", migration.Version, migration.Name, err)
+			}
+		}
+		return pending, nil
+	}
+
+	for _, migration := range pending {
+		tx, err := r.db.BeginTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelSerializable})
+		if err != nil {
+			return nil, err
+		}
+		err = applyMigration(tx, migration)
+		if err == nil {
+			err = tx.Commit()
+		} else {
+			_ = tx.Rollback()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("migration %d_%s failed: %w", migration.Version, migration.Name, err)
+		}
+		slog.Info("Database", slog.String("Applied migration", fmt.Sprintf("%d_%s", migration.Version, migration.Name)))
+	}
+	return pending, nil
+}
+
+// Returns the migrations that haven't been applied yet, after checking the applied ones still match.
+func (r *SQLiteRepository) pendingMigrations(all []migrations.Migration) ([]migrations.Migration, error) {
+	applied, err := r.appliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+	if len(applied) > len(all) {
+		return nil, fmt.Errorf("the database is at schema version %d but this Drawbridge only knows up to version %d, upgrade Drawbridge or restore a backup", len(applied), len(all))
+	}
+	for i, migration := range applied {
+		if migration.version != all[i].Version {
+			return nil, fmt.Errorf("the schema_version table is missing migration %d", all[i].Version)
+		}
+		if migration.checksum != all[i].Checksum {
+			return nil, fmt.Errorf("migration %d_%s was changed after it was applied to the database, checksum %s does not match %s", migration.version, migration.name, all[i].Checksum, migration.checksum)
+		}
+	}
+	return all[len(applied):], nil
+}
+
+func applyMigration(tx *sql.Tx, migration migrations.Migration) error {
+	_, err := tx.Exec(migration.SQL)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(
+		"INSERT INTO schema_version(version, name, checksum, applied_at) values(?,?,?,?)",
+		migration.Version,
+		migration.Name,
+		migration.Checksum,
+		time.Now().UTC().Format(time.RFC3339),
+	)
+	return err
+}
+
+func (r *SQLiteRepository) createSchemaVersionTable() error {
+	query := `
+	CREATE TABLE IF NOT EXISTS schema_version(
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		checksum TEXT NOT NULL,
+		applied_at TEXT NOT NULL
+	);
+	`
+
+	_, err := r.db.Exec(query)
+	return err
+}
+
+func (r *SQLiteRepository) appliedMigrations() ([]appliedMigration, error) {
+	rows, err := r.db.Query("SELECT version, name, checksum, applied_at FROM schema_version ORDER BY version")
+	if err != nil {
+		return nil, fmt.Errorf("error reading schema_version: %s", err)
+	}
+	defer rows.Close()
+
+	var applied []appliedMigration
+	for rows.Next() {
+		var migration appliedMigration
+		var appliedAt string
+		if err := rows.Scan(
+			&migration.version,
+			&migration.name,
+			&migration.checksum,
+			&appliedAt,
+		); err != nil {
+			return nil, fmt.Errorf("error scanning schema_version database row: %s", err)
+		}
+		migration.appliedAt, err = time.Parse(time.RFC3339, appliedAt)
+		if err != nil {
+			return nil, err
+		}
+		applied = append(applied, migration)
+	}
+	return applied, rows.Err()
+}
+
+// Returns the latest migration applied to the database, or 0 for a new database.
+func (r *SQLiteRepository) SchemaVersion() (int, error) {
+	err := r.createSchemaVersionTable()
+	if err != nil {
+		return 0, err
+	}
+	var version sql.NullInt64
+	err = r.db.QueryRow("SELECT MAX(version) FROM schema_version").Scan(&version)
+	if err != nil {
+		return 0, err
+	}
+	return int(version.Int64), nil
+}
+
+// Returns every embedded migration and whether it has been applied to the database.
+// Doesn't modify the schema, apart from creating the empty schema_version table on a new database.
+func (r *SQLiteRepository) MigrationStatus() ([]MigrationStatus, error) {
+	all, err := migrations.All()
+	if err != nil {
+		return nil, err
+	}
+	err = r.createSchemaVersionTable()
+	if err != nil {
+		return nil, err
+	}
+	applied, err := r.appliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+	appliedByVersion := make(map[int]appliedMigration, len(applied))
+	for _, migration := range applied {
+		appliedByVersion[migration.version] = migration
+	}
+
+	statuses := make([]MigrationStatus, 0, len(all))
+	for _, migration := range all {
+		status := MigrationStatus{Migration: migration}
+		if appliedMigration, ok := appliedByVersion[migration.Version]; ok {
+			status.Applied = true
+			status.AppliedAt = appliedMigration.appliedAt
+			status.ChecksumMismatch = appliedMigration.checksum != migration.Checksum
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
@@ -0,0 +1,114 @@
+package persistence
+
+import (
+	"imdawon/drawbridge/cmd/drawbridge/emissary"
+	"imdawon/drawbridge/cmd/drawbridge/persistence/migrations"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestMigrate(t *testing.T) {
+	db := NewSQLiteRepository(OpenDatabaseFile(filepath.Join(t.TempDir(), "drawbridge.db")))
+
+	all, err := migrations.All()
+	if err != nil {
+		t.Fatalf("embedded migrations are invalid: %v", err)
+	}
+	applied, err := db.MigrateDryRun()
+	if err != nil {
+		t.Fatalf("MigrateDryRun failed: %v", err)
+	}
+	if len(applied) != len(all) {
+		t.Errorf("dry run should report %d pending migrations, got %d", len(all), len(applied))
+	}
+	if version, _ := db.SchemaVersion(); version != 0 {
+		t.Errorf("dry run should not apply migrations, schema version is %d", version)
+	}
+
+	if _, err := db.Migrate(); err != nil {
+		t.Fatalf("Migrate failed: %v", err)
+	}
+	if version, _ := db.SchemaVersion(); version != len(all) {
+		t.Errorf("schema version = %d, want %d", version, len(all))
+	}
+	applied, err = db.Migrate()
+	if err != nil || len(applied) != 0 {
+		t.Errorf("migrating an up to date database should do nothing, applied %d: %v", len(applied), err)
+	}
+	statuses, err := db.MigrationStatus()
+	if err != nil {
+		t.Fatalf("MigrationStatus failed: %v", err)
+	}
+	for _, status := range statuses {
+		if !status.Applied || status.ChecksumMismatch {
+			t.Errorf("migration %d should be applied with a matching checksum", status.Version)
+		}
+	}
+
+	// A migration that fails is rolled back along with its schema_version entry.
+	broken := append(all, migrations.Migration{
+		Version:  len(all) + 1,
+		Name:     "broken",
+		SQL:      "CREATE TABLE half_applied(id INTEGER); INSERT INTO no_such_table VALUES (1);",
+		Checksum: "broken",
+	})
+	if _, err := db.migrate(broken, false); err == nil {
+		t.Errorf("a failing migration should return an error")
+	}
+	if version, _ := db.SchemaVersion(); version != len(all) {
+		t.Errorf("a failing migration should not change the schema version, got %d", version)
+	}
+	if _, err := db.db.Exec("SELECT * FROM half_applied"); err == nil {
+		t.Errorf("a failing migration should be rolled back")
+	}
+
+	// An applied migration that changed afterwards is refused.
+	changed := append([]migrations.Migration(nil), all...)
+	changed[0].Checksum = "changed"
+	if _, err := db.migrate(changed, false); err == nil {
+		t.Errorf("a changed migration should be refused")
+	}
+
+	// A database migrated by a newer Drawbridge is refused.
+	if _, err := db.migrate(all[:0], false); err == nil {
+		t.Errorf("a database with unknown migrations should be refused")
+	}
+
+	if err := migrations.Validate([]migrations.Migration{{Version: 1}, {Version: 3}}); err == nil {
+		t.Errorf("migrations with a gap in their versions should be invalid")
+	}
+}
+
+// Devices keep the history their events give them when the device_baseline table is added.
+func TestDeviceBaselineMigration(t *testing.T) {
+	db := NewSQLiteRepository(OpenDatabaseFile(filepath.Join(t.TempDir(), "drawbridge.db")))
+	t.Cleanup(func() { db.Close() })
+	all, err := migrations.All()
+	if err != nil {
+		t.Fatalf("embedded migrations are invalid: %v", err)
+	}
+	before := slices.IndexFunc(all, func(migration migrations.Migration) bool { return migration.Name == "device_baseline" })
+	if _, err := db.migrate(all[:before], false); err != nil {
+		t.Fatalf("migrate failed: %v", err)
+	}
+	day := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	for _, event := range []emissary.Event{
+		{ID: "a", DeviceID: "device-1", Type: "PS_LIST", Country: "GB", Timestamp: day},
+		{ID: "b", DeviceID: "device-1", Type: "PS_CONN", TargetService: "002", Country: "IE", Timestamp: day.Add(time.Hour)},
+		{ID: "c", DeviceID: "device-1", Type: "PS_TERM", TargetService: "003", Country: "FR", Timestamp: day.Add(2 * time.Hour)},
+		{ID: "d", DeviceID: "device-1", Type: "OB_CR8T", TargetService: "004", Timestamp: day.Add(3 * time.Hour)},
+	} {
+		if err := db.InsertEmissaryClientEvent(event); err != nil {
+			t.Fatalf("InsertEmissaryClientEvent failed: %v", err)
+		}
+	}
+	if _, err := db.Migrate(); err != nil {
+		t.Fatalf("Migrate failed: %v", err)
+	}
+	history, err := db.GetDeviceHistory("device-1", day.AddDate(0, 0, 1))
+	if err != nil || !history.FirstSeen.Equal(day) || !slices.Equal(history.Countries, []string{"GB", "IE"}) || !slices.Equal(history.Services, []string{"002"}) {
+		t.Errorf("expected the baseline to start from the events, got %+v: %v", history, err)
+	}
+}
@@ -0,0 +1,44 @@
+-- The schema from before versioned migrations. Existing installs already have these tables,
+-- so every statement is safe to run against them.
+CREATE TABLE IF NOT EXISTS services(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name TEXT NOT NULL,
+	description TEXT,
+	host TEXT NOT NULL,
+	port INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS emissary_client(
+	id TEXT PRIMARY KEY NOT NULL,
+	name TEXT UNIQUE NOT NULL,
+	drawbridge_certificate TEXT UNIQUE NOT NULL,
+	revoked INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS emissary_client_event(
+	id TEXT PRIMARY KEY,
+	device_id TEXT NOT NULL,
+	device_ip TEXT NOT NULL,
+	type TEXT NOT NULL,
+	target_service TEXT,
+	connection_type TEXT,
+	timestamp TEXT NOT NULL,
+	FOREIGN KEY(device_id) REFERENCES emissary_client(id)
+);
+CREATE INDEX IF NOT EXISTS idx_emissary_client_event_device_id ON emissary_client_event (device_id);
+
+CREATE TABLE IF NOT EXISTS drawbridge_config(
+	setting TEXT NOT NULL UNIQUE,
+	value TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS certificates(
+	id TEXT NOT NULL UNIQUE,
+	emissary_client_id TEXT NOT NULL,
+	certificate TEXT NOT NULL,
+	certificate_type TEXT NOT NULL,
+	revoked INTEGER NOT NULL,
+	expires_at TEXT NOT NULL,
+	FOREIGN KEY(emissary_client_id) REFERENCES emissary_client(id)
+);
+CREATE INDEX IF NOT EXISTS idx_certificates_revoked ON certificates (revoked);
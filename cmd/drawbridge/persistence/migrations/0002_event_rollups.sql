@@ -0,0 +1,39 @@
+-- Bytes proxied for each PS_CONN connection. Bytes in come from the Emissary client, bytes out go to it.
+ALTER TABLE emissary_client_event ADD COLUMN bytes_in INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE emissary_client_event ADD COLUMN bytes_out INTEGER NOT NULL DEFAULT 0;
+
+-- Events used to be stored in local time with an offset. Store them in UTC so they sort and compare as text.
+UPDATE emissary_client_event SET timestamp = strftime('%Y-%m-%dT%H:%M:%SZ', timestamp) WHERE strftime('%Y-%m-%dT%H:%M:%SZ', timestamp) IS NOT NULL;
+CREATE INDEX IF NOT EXISTS idx_emissary_client_event_timestamp ON emissary_client_event (timestamp);
+
+-- Events aggregated per device and Protected Service, by hour and by day. Raw events are pruned after the
+-- event retention period, the rollups keep the history.
+CREATE TABLE emissary_client_event_hourly(
+	device_id TEXT NOT NULL,
+	target_service TEXT NOT NULL,
+	bucket TEXT NOT NULL,
+	connections INTEGER NOT NULL,
+	bytes_in INTEGER NOT NULL,
+	bytes_out INTEGER NOT NULL,
+	unique_ips INTEGER NOT NULL,
+	last_seen TEXT NOT NULL,
+	last_ip TEXT NOT NULL,
+	last_type TEXT NOT NULL,
+	PRIMARY KEY(device_id, target_service, bucket)
+);
+CREATE INDEX idx_emissary_client_event_hourly_last_seen ON emissary_client_event_hourly (device_id, last_seen);
+
+CREATE TABLE emissary_client_event_daily(
+	device_id TEXT NOT NULL,
+	target_service TEXT NOT NULL,
+	bucket TEXT NOT NULL,
+	connections INTEGER NOT NULL,
+	bytes_in INTEGER NOT NULL,
+	bytes_out INTEGER NOT NULL,
+	unique_ips INTEGER NOT NULL,
+	last_seen TEXT NOT NULL,
+	last_ip TEXT NOT NULL,
+	last_type TEXT NOT NULL,
+	PRIMARY KEY(device_id, target_service, bucket)
+);
+CREATE INDEX idx_emissary_client_event_daily_bucket ON emissary_client_event_daily (bucket);
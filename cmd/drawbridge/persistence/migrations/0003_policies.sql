@@ -0,0 +1,11 @@
+-- Authorization policies Emissary devices must pass to connect to the Protected Services they are attached to.
+-- The rules are the JSON encoded authorization.Group.
+CREATE TABLE policies(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name TEXT UNIQUE NOT NULL,
+	description TEXT NOT NULL,
+	rules TEXT NOT NULL
+);
+
+-- 0 means the service has no policy, and every device with a valid certificate can connect.
+ALTER TABLE services ADD COLUMN client_policy_id INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,14 @@
+-- The posture reports Emissary clients send with DV_PSTR, newest last. Drawbridge keeps the most recent
+-- emissary.MaxPostureHistory reports for each device.
+CREATE TABLE device_posture_reports(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	device_id TEXT NOT NULL,
+	os TEXT NOT NULL,
+	os_version TEXT NOT NULL,
+	hostname TEXT NOT NULL,
+	disk_encrypted INTEGER NOT NULL,
+	firewall_enabled INTEGER NOT NULL,
+	reported_at TEXT NOT NULL
+);
+
+CREATE INDEX idx_device_posture_reports_device_id ON device_posture_reports (device_id, id);
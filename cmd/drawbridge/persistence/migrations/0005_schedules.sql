@@ -0,0 +1,17 @@
+-- Weekly windows when Emissary devices may connect. Windows and exceptions are the JSON encoded
+-- authorization.Window and authorization.Exception lists.
+CREATE TABLE schedules(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name TEXT UNIQUE NOT NULL,
+	timezone TEXT NOT NULL,
+	windows TEXT NOT NULL,
+	exceptions TEXT NOT NULL,
+	end_sessions INTEGER NOT NULL
+);
+
+-- 0 means the service or policy has no schedule and is open at all times.
+ALTER TABLE services ADD COLUMN schedule_id INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE policies ADD COLUMN schedule_id INTEGER NOT NULL DEFAULT 0;
+
+-- Why Drawbridge denied or ended a connection, e.g. the schedule that was closed.
+ALTER TABLE emissary_client_event ADD COLUMN reason TEXT NOT NULL DEFAULT '';
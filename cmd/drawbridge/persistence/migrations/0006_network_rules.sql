@@ -0,0 +1,6 @@
+-- The JSON encoded network.Rules limiting the source networks that can connect to the service, or empty for none.
+ALTER TABLE services ADD COLUMN network_rules TEXT NOT NULL DEFAULT '';
+
+-- Where the connection IP was, from the GeoIP databases when the event was recorded. Empty or 0 when unknown.
+ALTER TABLE emissary_client_event ADD COLUMN country TEXT NOT NULL DEFAULT '';
+ALTER TABLE emissary_client_event ADD COLUMN asn INTEGER NOT NULL DEFAULT 0;
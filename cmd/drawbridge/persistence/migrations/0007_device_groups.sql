@@ -0,0 +1,14 @@
+-- Comma separated, sorted group names and tags, or empty for none.
+ALTER TABLE emissary_client ADD COLUMN groups TEXT NOT NULL DEFAULT '';
+ALTER TABLE emissary_client ADD COLUMN tags TEXT NOT NULL DEFAULT '';
+
+-- Protected Services granted to groups of devices. 0 means the grant adds no policy or schedule.
+CREATE TABLE service_grants(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	service_id INTEGER NOT NULL,
+	group_name TEXT NOT NULL,
+	policy_id INTEGER NOT NULL DEFAULT 0,
+	schedule_id INTEGER NOT NULL DEFAULT 0,
+	UNIQUE(service_id, group_name)
+);
+CREATE INDEX idx_service_grants_service_id ON service_grants (service_id);
@@ -0,0 +1,3 @@
+-- Every check Drawbridge made before denying a connection, the JSON encoded authorization.TraceStep list.
+-- Empty for events that weren't denied.
+ALTER TABLE emissary_client_event ADD COLUMN trace TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,18 @@
+-- 1 when devices need an approved just-in-time access request to connect to the service.
+ALTER TABLE services ADD COLUMN require_approval INTEGER NOT NULL DEFAULT 0;
+
+-- Requests from devices for temporary access to a Protected Service, kept after they are decided or expire
+-- so every request stays on record. Times are RFC 3339 in UTC, or empty until they happen.
+CREATE TABLE jit_requests(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	device_id TEXT NOT NULL,
+	service_id INTEGER NOT NULL,
+	reason TEXT NOT NULL,
+	status TEXT NOT NULL,
+	requested_at TEXT NOT NULL,
+	decided_by TEXT NOT NULL DEFAULT '',
+	decided_at TEXT NOT NULL DEFAULT '',
+	expires_at TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX idx_jit_requests_device_service ON jit_requests (device_id, service_id, status);
+CREATE INDEX idx_jit_requests_status ON jit_requests (status);
@@ -0,0 +1,13 @@
+-- 1 when devices must step up with a TOTP code to connect to the service.
+ALTER TABLE services ADD COLUMN require_step_up INTEGER NOT NULL DEFAULT 0;
+
+-- The TOTP secret of each device enrolled in step-up authentication. Times are RFC 3339 in UTC, or empty.
+CREATE TABLE device_totp(
+	device_id TEXT PRIMARY KEY,
+	secret TEXT NOT NULL,
+	confirmed INTEGER NOT NULL DEFAULT 0,
+	enrolled_at TEXT NOT NULL,
+	last_counter INTEGER NOT NULL DEFAULT 0,
+	failures INTEGER NOT NULL DEFAULT 0,
+	locked_until TEXT NOT NULL DEFAULT ''
+);
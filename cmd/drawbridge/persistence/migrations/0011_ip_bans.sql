@@ -0,0 +1,10 @@
+-- Source IPs the Emissary listener refuses after too many failed handshakes or malformed requests. A row is kept
+-- after its ban expires so the IP's next ban lasts longer. Times are RFC 3339 in UTC.
+CREATE TABLE ip_bans(
+	ip TEXT PRIMARY KEY,
+	reason TEXT NOT NULL,
+	offenses INTEGER NOT NULL DEFAULT 1,
+	banned_at TEXT NOT NULL,
+	expires_at TEXT NOT NULL
+);
+CREATE INDEX idx_ip_bans_expires_at ON ip_bans(expires_at);
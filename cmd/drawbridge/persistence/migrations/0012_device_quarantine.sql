@@ -0,0 +1,8 @@
+-- Devices the anomaly detector quarantined: they keep their certificate, but can't connect to Protected Services
+-- until the Drawbridge admin releases them. quarantined_at is RFC 3339 in UTC.
+CREATE TABLE device_quarantine(
+	device_id TEXT PRIMARY KEY,
+	reason TEXT NOT NULL,
+	score INTEGER NOT NULL DEFAULT 0,
+	quarantined_at TEXT NOT NULL
+);
@@ -0,0 +1,9 @@
+-- Every time Drawbridge went into or came out of emergency lockdown. The latest row is the current state.
+-- created_at is RFC 3339 in UTC.
+CREATE TABLE lockdown_transitions(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	active INTEGER NOT NULL,
+	actor TEXT NOT NULL,
+	reason TEXT NOT NULL DEFAULT '',
+	created_at TEXT NOT NULL
+);
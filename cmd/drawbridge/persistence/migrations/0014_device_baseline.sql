@@ -0,0 +1,22 @@
+-- What the anomaly detector compares a device's connections to, kept after the raw events are pruned: when the device
+-- first connected, with kind 'connection' and an empty value, and when it first connected from each country, kind
+-- 'country', and asked for each Protected Service, kind 'service'. first_seen is RFC 3339 in UTC.
+CREATE TABLE device_baseline(
+	device_id TEXT NOT NULL,
+	kind TEXT NOT NULL,
+	value TEXT NOT NULL,
+	first_seen TEXT NOT NULL,
+	PRIMARY KEY(device_id, kind, value)
+);
+
+-- Start from the events that haven't been pruned yet. Drawbridge records PS_TERM itself, from the IP of the connection
+-- it ended, and only PS_CONN and PS_DENY ask for a Protected Service.
+INSERT INTO device_baseline(device_id, kind, value, first_seen)
+	SELECT device_id, 'connection', '', MIN(timestamp) FROM emissary_client_event
+	WHERE device_id != '' AND type != 'PS_TERM' GROUP BY device_id;
+INSERT INTO device_baseline(device_id, kind, value, first_seen)
+	SELECT device_id, 'country', country, MIN(timestamp) FROM emissary_client_event
+	WHERE device_id != '' AND type != 'PS_TERM' AND country != '' GROUP BY device_id, country;
+INSERT INTO device_baseline(device_id, kind, value, first_seen)
+	SELECT device_id, 'service', target_service, MIN(timestamp) FROM emissary_client_event
+	WHERE device_id != '' AND type IN ('PS_CONN', 'PS_DENY') AND target_service != '' GROUP BY device_id, target_service;
@@ -0,0 +1,80 @@
+// Package migrations holds the SQLite schema migrations, embedded in the Drawbridge binary.
+//
+// Each migration is a file named <version>_<name>.sql, e.g. 0002_service_health_status.sql. Versions start at 1 and
+// have no gaps. A migration must never change once it has shipped: Drawbridge records the checksum of every migration
+// it applies and refuses to start if an applied migration no longer matches. Add a new migration instead.
+package migrations
+
+import (
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//go:embed *.sql
+var files embed.FS
+
+type Migration struct {
+	Version int
+	Name    string
+	SQL     string
+	// The SHA-256 of the migration file, hex encoded.
+	Checksum string
+}
+
+// Returns every embedded migration, ordered by version.
+func All() ([]Migration, error) {
+	filenames, err := files.ReadDir(".")
+	if err != nil {
+		return nil, err
+	}
+	var migrations []Migration
+	for _, file := range filenames {
+		contents, err := files.ReadFile(file.Name())
+		if err != nil {
+			return nil, err
+		}
+		migration, err := parse(file.Name(), contents)
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, migration)
+	}
+	return migrations, Validate(migrations)
+}
+
+func parse(filename string, contents []byte) (Migration, error) {
+	versionString, name, found := strings.Cut(strings.TrimSuffix(filename, path.Ext(filename)), "_")
+	if !found {
+		return Migration{}, fmt.Errorf("migration %s must be named <version>_<name>.sql", filename)
+	}
+	version, err := strconv.Atoi(versionString)
+	if err != nil {
+		return Migration{}, fmt.Errorf("migration %s must start with its version number", filename)
+	}
+	checksum := sha256.Sum256(contents)
+	return Migration{
+		Version:  version,
+		Name:     name,
+		SQL:      string(contents),
+		Checksum: hex.EncodeToString(checksum[:]),
+	}, nil
+}
+
+// Sorts migrations by version and checks the versions start at 1 without gaps or duplicates.
+func Validate(migrations []Migration) error {
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	for i, migration := range migrations {
+		if migration.Version != i+1 {
+			return fmt.Errorf("expected migration version %d, found %d_%s", i+1, migration.Version, migration.Name)
+		}
+	}
+	return nil
+}
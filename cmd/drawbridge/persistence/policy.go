@@ -0,0 +1,143 @@
+package persistence
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"imdawon/drawbridge/cmd/drawbridge/emissary/authorization"
+)
+
+func (r *SQLiteRepository) CreateNewPolicy(policy authorization.Policy) (*authorization.Policy, error) {
+	rules, err := json.Marshal(policy.Rules)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding the rules of policy %s: %w", policy.Name, err)
+	}
+	res, err := r.db.Exec(
+		"INSERT INTO policies(name, description, rules, schedule_id) values(?,?,?,?)",
+		policy.Name,
+		policy.Description,
+		string(rules),
+		policy.ScheduleID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error inserting new policy into the db: %w", err)
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, fmt.Errorf("a new policy was inserted into the db, but an error was returned when retrieving the id for it: %w", err)
+	}
+
+	policy.ID = id
+	return &policy, nil
+}
+
+func (r *SQLiteRepository) GetAllPolicies() ([]authorization.Policy, error) {
+	rows, err := r.db.Query("SELECT id, name, description, rules, schedule_id FROM policies ORDER BY id")
+	if err != nil {
+		return nil, fmt.Errorf("error getting all policies: %w", err)
+	}
+	defer rows.Close()
+
+	var all []authorization.Policy
+	for rows.Next() {
+		policy, err := scanPolicy(rows)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, *policy)
+	}
+	return all, rows.Err()
+}
+
+func (r *SQLiteRepository) GetPolicyById(id int64) (*authorization.Policy, error) {
+	row := r.db.QueryRow("SELECT id, name, description, rules, schedule_id FROM policies WHERE id = ?", id)
+	policy, err := scanPolicy(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return &authorization.Policy{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error getting policy id %d: %w", id, err)
+	}
+	return policy, nil
+}
+
+func scanPolicy(row interface{ Scan(...any) error }) (*authorization.Policy, error) {
+	var policy authorization.Policy
+	var rules string
+	err := row.Scan(&policy.ID, &policy.Name, &policy.Description, &rules, &policy.ScheduleID)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal([]byte(rules), &policy.Rules)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding the rules of policy %s: %w", policy.Name, err)
+	}
+	return &policy, nil
+}
+
+func (r *SQLiteRepository) UpdatePolicy(updated *authorization.Policy, id int64) error {
+	if id == 0 {
+		return fmt.Errorf("invalid updated ID")
+	}
+	rules, err := json.Marshal(updated.Rules)
+	if err != nil {
+		return fmt.Errorf("error encoding the rules of policy %s: %w", updated.Name, err)
+	}
+	res, err := r.db.Exec(
+		"UPDATE policies SET name = ?, description = ?, rules = ?, schedule_id = ? WHERE id = ?",
+		updated.Name,
+		updated.Description,
+		string(rules),
+		updated.ScheduleID,
+		id,
+	)
+	if err != nil {
+		return fmt.Errorf("error updating policy id %d: %w", id, err)
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return fmt.Errorf("update failed: no policy with id %d", id)
+	}
+	return nil
+}
+
+func (r *SQLiteRepository) DeletePolicy(id int64) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var attached, grants int
+	err = tx.QueryRow("SELECT COUNT(*) FROM services WHERE client_policy_id = ?", id).Scan(&attached)
+	if err != nil {
+		return fmt.Errorf("error checking which services use policy id %d: %w", id, err)
+	}
+	err = tx.QueryRow("SELECT COUNT(*) FROM service_grants WHERE policy_id = ?", id).Scan(&grants)
+	if err != nil {
+		return fmt.Errorf("error checking which grants use policy id %d: %w", id, err)
+	}
+	if attached > 0 {
+		return fmt.Errorf("policy id %d is attached to %d Protected Service(s), detach it first", id, attached)
+	}
+	if grants > 0 {
+		return fmt.Errorf("policy id %d is used by %d grant(s), remove them first", id, grants)
+	}
+	res, err := tx.Exec("DELETE FROM policies WHERE id = ?", id)
+	if err != nil {
+		return fmt.Errorf("error deleting policy with id of %d: %w", id, err)
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return fmt.Errorf("no rows were deleted for policy id: %d", id)
+	}
+	return tx.Commit()
+}
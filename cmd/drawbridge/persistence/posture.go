@@ -0,0 +1,107 @@
+package persistence
+
+import (
+	"fmt"
+	"imdawon/drawbridge/cmd/drawbridge/emissary"
+	"imdawon/drawbridge/cmd/utils"
+	"time"
+)
+
+const postureColumns = "id, device_id, os, os_version, hostname, disk_encrypted, firewall_enabled, reported_at"
+
+func (r *SQLiteRepository) InsertPostureReport(report emissary.PostureReport) (*emissary.PostureReport, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	report.ReportedAt = report.ReportedAt.UTC().Truncate(time.Second)
+	res, err := tx.Exec(
+		"INSERT INTO device_posture_reports(device_id, os, os_version, hostname, disk_encrypted, firewall_enabled, reported_at) values(?,?,?,?,?,?,?)",
+		report.DeviceID,
+		report.OS,
+		report.OSVersion,
+		report.Hostname,
+		report.DiskEncrypted,
+		report.FirewallEnabled,
+		report.ReportedAt.Format(time.RFC3339),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error inserting posture report for device %s: %w", report.DeviceID, err)
+	}
+	report.ID, err = res.LastInsertId()
+	if err != nil {
+		return nil, fmt.Errorf("a posture report was inserted into the db, but an error was returned when retrieving the id for it: %w", err)
+	}
+	_, err = tx.Exec(
+		"DELETE FROM device_posture_reports WHERE device_id = ? AND id NOT IN (SELECT id FROM device_posture_reports WHERE device_id = ? ORDER BY id DESC LIMIT ?)",
+		report.DeviceID,
+		report.DeviceID,
+		emissary.MaxPostureHistory,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error pruning posture reports for device %s: %w", report.DeviceID, err)
+	}
+	return &report, tx.Commit()
+}
+
+func (r *SQLiteRepository) GetPostureHistory(deviceID string, limit int) ([]emissary.PostureReport, error) {
+	rows, err := r.db.Query("SELECT "+postureColumns+" FROM device_posture_reports WHERE device_id = ? ORDER BY id DESC LIMIT ?", deviceID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("error getting posture reports for device %s: %w", deviceID, err)
+	}
+	defer rows.Close()
+
+	var reports []emissary.PostureReport
+	for rows.Next() {
+		report, err := scanPostureReport(rows)
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, *report)
+	}
+	return reports, rows.Err()
+}
+
+func (r *SQLiteRepository) GetLatestPostureReports(deviceIDs []string) (map[string]emissary.PostureReport, error) {
+	reports := make(map[string]emissary.PostureReport, len(deviceIDs))
+	if len(deviceIDs) == 0 {
+		return reports, nil
+	}
+	args := make([]any, len(deviceIDs))
+	for i, id := range deviceIDs {
+		args[i] = id
+	}
+	rows, err := r.db.Query(fmt.Sprintf(
+		"SELECT "+postureColumns+" FROM device_posture_reports WHERE id IN (SELECT MAX(id) FROM device_posture_reports WHERE device_id IN (%s) GROUP BY device_id)",
+		utils.GeneratePlaceholders(len(deviceIDs)),
+	), args...)
+	if err != nil {
+		return nil, fmt.Errorf("error getting the latest posture reports: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		report, err := scanPostureReport(rows)
+		if err != nil {
+			return nil, err
+		}
+		reports[report.DeviceID] = *report
+	}
+	return reports, rows.Err()
+}
+
+func scanPostureReport(row interface{ Scan(...any) error }) (*emissary.PostureReport, error) {
+	var report emissary.PostureReport
+	var reportedAt string
+	err := row.Scan(&report.ID, &report.DeviceID, &report.OS, &report.OSVersion, &report.Hostname, &report.DiskEncrypted, &report.FirewallEnabled, &reportedAt)
+	if err != nil {
+		return nil, fmt.Errorf("error scanning posture report: %w", err)
+	}
+	report.ReportedAt, err = time.Parse(time.RFC3339, reportedAt)
+	if err != nil {
+		return nil, fmt.Errorf("posture report %d has an invalid timestamp %q: %w", report.ID, reportedAt, err)
+	}
+	return &report, nil
+}
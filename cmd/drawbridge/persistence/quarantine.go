@@ -0,0 +1,74 @@
+package persistence
+
+import (
+	"fmt"
+	"imdawon/drawbridge/cmd/drawbridge/emissary"
+)
+
+func (r *SQLiteRepository) GetDeviceQuarantine(deviceID string) (*emissary.Quarantine, error) {
+	quarantines, err := r.queryQuarantines("SELECT device_id, reason, score, quarantined_at FROM device_quarantine WHERE device_id = ?", deviceID)
+	if err != nil {
+		return nil, err
+	}
+	if len(quarantines) == 0 {
+		return &emissary.Quarantine{}, nil
+	}
+	return &quarantines[0], nil
+}
+
+func (r *SQLiteRepository) GetQuarantinedDevices() ([]emissary.Quarantine, error) {
+	return r.queryQuarantines("SELECT device_id, reason, score, quarantined_at FROM device_quarantine ORDER BY quarantined_at DESC, device_id")
+}
+
+func (r *SQLiteRepository) queryQuarantines(query string, args ...any) ([]emissary.Quarantine, error) {
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error getting quarantined devices: %w", err)
+	}
+	defer rows.Close()
+
+	var quarantines []emissary.Quarantine
+	for rows.Next() {
+		var quarantine emissary.Quarantine
+		var quarantinedAt string
+		err := rows.Scan(&quarantine.DeviceID, &quarantine.Reason, &quarantine.Score, &quarantinedAt)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning quarantine database row into a quarantine struct: %w", err)
+		}
+		quarantine.QuarantinedAt, err = parseOptionalTime(quarantinedAt)
+		if err != nil {
+			return nil, fmt.Errorf("quarantine of device %s: %w", quarantine.DeviceID, err)
+		}
+		quarantines = append(quarantines, quarantine)
+	}
+	return quarantines, rows.Err()
+}
+
+func (r *SQLiteRepository) QuarantineDevice(quarantine emissary.Quarantine) error {
+	_, err := r.db.Exec(
+		"INSERT INTO device_quarantine(device_id, reason, score, quarantined_at) values(?,?,?,?)",
+		quarantine.DeviceID,
+		quarantine.Reason,
+		quarantine.Score,
+		formatOptionalTime(quarantine.QuarantinedAt),
+	)
+	if err != nil {
+		return fmt.Errorf("error quarantining device %s: %w", quarantine.DeviceID, err)
+	}
+	return nil
+}
+
+func (r *SQLiteRepository) ReleaseDevice(deviceID string) error {
+	res, err := r.db.Exec("DELETE FROM device_quarantine WHERE device_id = ?", deviceID)
+	if err != nil {
+		return fmt.Errorf("error releasing device %s: %w", deviceID, err)
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return fmt.Errorf("device %s isn't quarantined", deviceID)
+	}
+	return nil
+}
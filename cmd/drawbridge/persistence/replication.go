@@ -0,0 +1,158 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// A table the primary Drawbridge replicates to its standby. Filter, when set, is a WHERE clause selecting the rows
+// that are replicated. The other rows describe the server they are stored on and are left alone.
+type ReplicatedTable struct {
+	Name   string
+	Filter string
+}
+
+// Everything a standby needs to take over from the primary: Protected Services and their policies and schedules, devices,
+// their revocations, posture reports, quarantines and anomaly baselines, lockdown, banned IPs, device certificates and settings. Events stay
+// on the server they happened on, and so do the settings describing the server itself, e.g. its listening address, the
+// paths to its GeoIP databases and its part in replication. The count of an IP's recent failures that haven't led to a
+// ban yet is kept in memory, so it starts over on a promoted standby.
+var ReplicatedTables = []ReplicatedTable{
+	{Name: "services"},
+	{Name: "policies"},
+	{Name: "schedules"},
+	{Name: "service_grants"},
+	{Name: "jit_requests"},
+	{Name: "emissary_client"},
+	{Name: "device_posture_reports"},
+	{Name: "device_totp"},
+	{Name: "device_quarantine"},
+	{Name: "device_baseline"},
+	{Name: "lockdown_transitions"},
+	{Name: "ip_bans"},
+	{Name: "certificates"},
+	{Name: "drawbridge_config", Filter: "setting NOT IN ('listening_address', 'last_ping_timestamp', 'geoip_databases') AND substr(setting, 1, 12) != 'replication_'"},
+}
+
+// The replicated rows of a table, as sent from the primary to the standby.
+type TableDump struct {
+	Table   string   `json:"table"`
+	Columns []string `json:"columns"`
+	Rows    [][]any  `json:"rows"`
+}
+
+func replicatedTable(name string) (ReplicatedTable, error) {
+	for _, table := range ReplicatedTables {
+		if table.Name == name {
+			return table, nil
+		}
+	}
+	return ReplicatedTable{}, fmt.Errorf("%s is not a replicated table", name)
+}
+
+// Reads the replicated rows of a table, in insertion order.
+func (r *SQLiteRepository) DumpTable(table ReplicatedTable) (*TableDump, error) {
+	query := fmt.Sprintf("SELECT * FROM %s", table.Name)
+	if table.Filter != "" {
+		query += " WHERE " + table.Filter
+	}
+	rows, err := r.db.Query(query + " ORDER BY rowid")
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", table.Name, err)
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	dump := &TableDump{Table: table.Name, Columns: columns, Rows: [][]any{}}
+	for rows.Next() {
+		values := make([]any, len(columns))
+		pointers := make([]any, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		err = rows.Scan(pointers...)
+		if err != nil {
+			return nil, err
+		}
+		dump.Rows = append(dump.Rows, values)
+	}
+	return dump, rows.Err()
+}
+
+// Replaces the replicated rows of each dumped table with the dumped rows, in a single transaction so the standby
+// never sees half of an update.
+func (r *SQLiteRepository) ReplaceReplicatedTables(dumps []TableDump) error {
+	tx, err := r.db.BeginTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, dump := range dumps {
+		table, err := replicatedTable(dump.Table)
+		if err != nil {
+			return err
+		}
+		query := fmt.Sprintf("DELETE FROM %s", table.Name)
+		if table.Filter != "" {
+			query += " WHERE " + table.Filter
+		}
+		_, err = tx.Exec(query)
+		if err != nil {
+			return fmt.Errorf("error clearing %s: %w", table.Name, err)
+		}
+		if len(dump.Rows) == 0 {
+			continue
+		}
+
+		quotedColumns := make([]string, len(dump.Columns))
+		for i, column := range dump.Columns {
+			quotedColumns[i] = `"` + strings.ReplaceAll(column, `"`, `""`) + `"`
+		}
+		placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(dump.Columns)), ", ")
+		statement, err := tx.Prepare(fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", table.Name, strings.Join(quotedColumns, ", "), placeholders))
+		if err != nil {
+			return fmt.Errorf("error replicating %s: %w", table.Name, err)
+		}
+		for _, row := range dump.Rows {
+			if len(row) != len(dump.Columns) {
+				statement.Close()
+				return fmt.Errorf("a replicated %s row has %d values for %d columns", table.Name, len(row), len(dump.Columns))
+			}
+			_, err = statement.Exec(jsonValues(row)...)
+			if err != nil {
+				statement.Close()
+				return fmt.Errorf("error replicating %s: %w", table.Name, err)
+			}
+		}
+		statement.Close()
+	}
+	return tx.Commit()
+}
+
+// Dumps travel as JSON, which has no integers. Numbers decoded with json.Decoder.UseNumber are turned back into
+// the integers SQLite stored.
+func jsonValues(row []any) []any {
+	values := make([]any, len(row))
+	for i, value := range row {
+		number, ok := value.(json.Number)
+		if !ok {
+			values[i] = value
+			continue
+		}
+		if integer, err := number.Int64(); err == nil {
+			values[i] = integer
+		} else if float, err := number.Float64(); err == nil {
+			values[i] = float
+		} else {
+			values[i] = number.String()
+		}
+	}
+	return values
+}
@@ -0,0 +1,200 @@
+package persistence
+
+import (
+	"imdawon/drawbridge/cmd/drawbridge/emissary"
+	"imdawon/drawbridge/cmd/drawbridge/emissary/authorization"
+	"imdawon/drawbridge/cmd/drawbridge/lockdown"
+	"imdawon/drawbridge/cmd/drawbridge/network"
+	"imdawon/drawbridge/cmd/drawbridge/persistence/migrations"
+	"imdawon/drawbridge/cmd/drawbridge/services"
+	"time"
+)
+
+// Protected Services the Drawbridge admin has set up.
+type ServiceRepository interface {
+	CreateNewService(service services.ProtectedService) (*services.ProtectedService, error)
+	GetAllServices() ([]services.ProtectedService, error)
+	// Returns an empty service when there is no service with the id.
+	GetServiceById(id int64) (*services.ProtectedService, error)
+	UpdateService(updated *services.ProtectedService, id int64) error
+	// Also deletes the service's grants.
+	DeleteService(id int) error
+}
+
+// Authorization policies Protected Services can require Emissary devices to pass.
+type PolicyRepository interface {
+	// Fails when another policy has the same name.
+	CreateNewPolicy(policy authorization.Policy) (*authorization.Policy, error)
+	GetAllPolicies() ([]authorization.Policy, error)
+	// Returns an empty policy when there is no policy with the id.
+	GetPolicyById(id int64) (*authorization.Policy, error)
+	UpdatePolicy(updated *authorization.Policy, id int64) error
+	// Fails while a Protected Service or grant uses the policy.
+	DeletePolicy(id int64) error
+}
+
+// Schedules Protected Services and policies can limit connections to.
+type ScheduleRepository interface {
+	// Fails when another schedule has the same name.
+	CreateNewSchedule(schedule authorization.Schedule) (*authorization.Schedule, error)
+	GetAllSchedules() ([]authorization.Schedule, error)
+	// Returns an empty schedule when there is no schedule with the id.
+	GetScheduleById(id int64) (*authorization.Schedule, error)
+	UpdateSchedule(updated *authorization.Schedule, id int64) error
+	// Fails while a Protected Service, policy or grant uses the schedule.
+	DeleteSchedule(id int64) error
+}
+
+// Protected Services granted to groups of Emissary devices.
+type GrantRepository interface {
+	// Fails when the group already has a grant for the service.
+	CreateNewGrant(grant authorization.Grant) (*authorization.Grant, error)
+	GetAllGrants() ([]authorization.Grant, error)
+	GetGrantsForService(serviceID int64) ([]authorization.Grant, error)
+	DeleteGrant(id int64) error
+}
+
+// Just-in-time access requests from Emissary devices, kept once they are decided or expire.
+type JITRequestRepository interface {
+	CreateNewJITRequest(request authorization.JITRequest) (*authorization.JITRequest, error)
+	// Returns an empty request when there is no request with the id.
+	GetJITRequestById(id int64) (*authorization.JITRequest, error)
+	// Returns up to limit requests with any of the statuses, newest first. A limit of 0 returns all of them.
+	GetJITRequests(statuses []authorization.JITStatus, limit int) ([]authorization.JITRequest, error)
+	// Returns the device's requests for the service with the status, newest first.
+	GetJITRequestsForDevice(deviceID string, serviceID int64, status authorization.JITStatus) ([]authorization.JITRequest, error)
+	// Stores the request's status, decision and expiry if the stored request still has the status from. Fails if it
+	// doesn't, e.g. because another Drawbridge admin decided the request first.
+	UpdateJITRequest(request *authorization.JITRequest, from authorization.JITStatus) error
+}
+
+// Emissary devices in the Device Fleet.
+type DeviceRepository interface {
+	CreateNewEmissaryClient(client emissary.EmissaryClient) (*emissary.EmissaryClient, error)
+	GetAllEmissaryClients() ([]*emissary.EmissaryClient, error)
+	// Returns an empty client when there is no device with the id.
+	GetEmissaryClientById(id string) (*emissary.EmissaryClient, error)
+	RenameEmissaryClient(id, name string) error
+	UpdateEmissaryClientGroupsAndTags(id string, groups, tags []string) error
+	RevokeEmissaryClient(deviceID string) (*emissary.EmissaryClient, *emissary.Event, error)
+	UnRevokeEmissaryClient(id string) (*emissary.EmissaryClient, *emissary.Event, error)
+}
+
+// The posture reports Emissary clients send about the machines they run on.
+type PostureRepository interface {
+	// Stores the report and drops the device's reports beyond emissary.MaxPostureHistory.
+	InsertPostureReport(report emissary.PostureReport) (*emissary.PostureReport, error)
+	// Returns up to limit of the device's reports, newest first.
+	GetPostureHistory(deviceID string, limit int) ([]emissary.PostureReport, error)
+	// Devices that haven't sent a report are left out.
+	GetLatestPostureReports(deviceIDs []string) (map[string]emissary.PostureReport, error)
+}
+
+// The TOTP secrets Emissary devices step up with to connect to Protected Services that require it.
+type TOTPRepository interface {
+	// Returns an empty enrollment when the device isn't enrolled.
+	GetDeviceTOTP(deviceID string) (*emissary.TOTPEnrollment, error)
+	// Stores the enrollment, replacing the device's previous one.
+	SaveDeviceTOTP(enrollment emissary.TOTPEnrollment) error
+	DeleteDeviceTOTP(deviceID string) error
+}
+
+// Devices the anomaly detector quarantined.
+type QuarantineRepository interface {
+	// Returns an empty quarantine when the device isn't quarantined.
+	GetDeviceQuarantine(deviceID string) (*emissary.Quarantine, error)
+	// Newest first.
+	GetQuarantinedDevices() ([]emissary.Quarantine, error)
+	// Fails when the device is already quarantined.
+	QuarantineDevice(quarantine emissary.Quarantine) error
+	ReleaseDevice(deviceID string) error
+}
+
+// Source IPs banned at the Emissary listener.
+type BanRepository interface {
+	// Returns an empty ban when the IP has never been banned, or its last ban was lifted or pruned.
+	GetIPBan(ip string) (*network.Ban, error)
+	// Returns the bans that haven't expired at now, newest first.
+	GetActiveIPBans(now time.Time) ([]network.Ban, error)
+	// Stores the ban, replacing the IP's previous one.
+	SaveIPBan(ban network.Ban) error
+	DeleteIPBan(ip string) error
+	// Deletes the bans that expired before before. Returns how many were deleted.
+	PruneIPBans(before time.Time) (int64, error)
+}
+
+// Drawbridge's emergency lockdown, kept as the history of its transitions.
+type LockdownRepository interface {
+	// Returns the latest transition, or an empty one, which isn't active, when Drawbridge was never locked down.
+	GetLockdown() (*lockdown.Transition, error)
+	// Newest first, at most limit of them.
+	GetLockdownTransitions(limit int) ([]lockdown.Transition, error)
+	CreateLockdownTransition(transition lockdown.Transition) (*lockdown.Transition, error)
+}
+
+// Emissary connection events and the hourly and daily rollups made from them.
+type EventRepository interface {
+	InsertEmissaryClientEvent(event emissary.Event) error
+	RecordEmissaryClientEventBytes(eventID string, bytesIn, bytesOut int64) error
+	GetLatestEventForEachDeviceId(deviceIDs []any) (map[string]emissary.Event, error)
+	GetLatestEventForDeviceId(deviceID string) (*emissary.Event, error)
+	QueryEmissaryClientEvents(query emissary.EventQuery) (*emissary.EventPage, error)
+	RollupEmissaryClientEvents(since time.Time) error
+	PruneEmissaryClientEvents(before time.Time) (int64, error)
+	PruneEmissaryClientEventRollups(hourlyBefore, dailyBefore time.Time) error
+	GetDailyUsageForDevice(deviceID string, since time.Time) ([]emissary.EventRollup, error)
+}
+
+// What the anomaly detector knows about each device's past connections. Unlike the raw events, it is never pruned.
+type BaselineRepository interface {
+	// Adds a connection at seen to the device's baseline, with the country it came from and the Protected Service it
+	// asked for. Either may be empty.
+	RecordDeviceBaseline(deviceID, country, service string, seen time.Time) error
+	// Summarizes the device's baseline from before before.
+	GetDeviceHistory(deviceID string, before time.Time) (*emissary.DeviceHistory, error)
+}
+
+// Drawbridge settings, stored as key/value pairs.
+type ConfigRepository interface {
+	// Creates the setting or replaces its value.
+	CreateNewDrawbridgeConfigSettings(setting, value string) error
+	// Returns an empty string when the setting hasn't been saved.
+	GetDrawbridgeConfigValueByName(setting string) (*string, error)
+	DeleteDrawbridgeConfigSetting(setting string) error
+}
+
+// Emissary device certificates, including the ones superseded during a certificate authority rotation.
+type CertificateRepository interface {
+	GetAllEmissaryClientCertificates() (map[string]emissary.DeviceCertificate, error)
+	SupersedeEmissaryClientCertificate(deviceID, certificateHash, newCertificate string, expiresAt time.Time) error
+	GetActiveSupersededCertificates() (map[string]emissary.DeviceCertificate, error)
+	DeleteSupersededCertificates() error
+}
+
+// Everything Drawbridge stores. SQLiteRepository keeps it in the drawbridge.db file,
+// MemoryRepository keeps it in memory for running Drawbridge embedded and for tests.
+type Repository interface {
+	ServiceRepository
+	PolicyRepository
+	ScheduleRepository
+	GrantRepository
+	JITRequestRepository
+	DeviceRepository
+	PostureRepository
+	TOTPRepository
+	QuarantineRepository
+	BaselineRepository
+	BanRepository
+	LockdownRepository
+	EventRepository
+	ConfigRepository
+	CertificateRepository
+	// Brings the storage up to date with this version of Drawbridge. Returns the migrations that were applied.
+	Migrate() ([]migrations.Migration, error)
+	Close() error
+}
+
+var (
+	_ Repository = (*SQLiteRepository)(nil)
+	_ Repository = (*MemoryRepository)(nil)
+)
@@ -0,0 +1,909 @@
+package persistence
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"imdawon/drawbridge/cmd/drawbridge/emissary"
+	"imdawon/drawbridge/cmd/drawbridge/emissary/authorization"
+	"imdawon/drawbridge/cmd/drawbridge/lockdown"
+	"imdawon/drawbridge/cmd/drawbridge/network"
+	"imdawon/drawbridge/cmd/drawbridge/services"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// Runs the same checks against every Repository implementation so they stay interchangeable.
+func TestRepositoryConformance(t *testing.T) {
+	implementations := map[string]func(t *testing.T) Repository{
+		"SQLite": func(t *testing.T) Repository {
+			db := NewSQLiteRepository(OpenDatabaseFile(filepath.Join(t.TempDir(), "drawbridge.db")))
+			t.Cleanup(func() { db.Close() })
+			return db
+		},
+		"Memory": func(t *testing.T) Repository {
+			return NewMemoryRepository()
+		},
+	}
+	for name, newRepository := range implementations {
+		t.Run(name, func(t *testing.T) {
+			for check, run := range map[string]func(t *testing.T, r Repository){
+				"Services":     testServiceRepository,
+				"Policies":     testPolicyRepository,
+				"Schedules":    testScheduleRepository,
+				"Grants":       testGrantRepository,
+				"JITRequests":  testJITRequestRepository,
+				"Devices":      testDeviceRepository,
+				"Posture":      testPostureRepository,
+				"TOTP":         testTOTPRepository,
+				"Quarantine":   testQuarantineRepository,
+				"Bans":         testBanRepository,
+				"Lockdown":     testLockdownRepository,
+				"History":      testDeviceHistory,
+				"Events":       testEventRepository,
+				"EventQueries": testEventQueries,
+				"Config":       testConfigRepository,
+				"Certificates": testCertificateRepository,
+			} {
+				t.Run(check, func(t *testing.T) {
+					r := newRepository(t)
+					if _, err := r.Migrate(); err != nil {
+						t.Fatalf("Migrate failed: %v", err)
+					}
+					run(t, r)
+				})
+			}
+		})
+	}
+}
+
+func testServiceRepository(t *testing.T, r Repository) {
+	first, err := r.CreateNewService(services.ProtectedService{Name: "Minecraft", Host: "127.0.0.1", Port: 25565})
+	if err != nil {
+		t.Fatalf("CreateNewService failed: %v", err)
+	}
+	second, err := r.CreateNewService(services.ProtectedService{Name: "SSH", Description: "Home server", Host: "10.0.0.2", Port: 22})
+	if err != nil {
+		t.Fatalf("CreateNewService failed: %v", err)
+	}
+	if first.ID == 0 || second.ID == first.ID {
+		t.Errorf("services should get unique non-zero ids, got %d and %d", first.ID, second.ID)
+	}
+
+	all, err := r.GetAllServices()
+	if err != nil || len(all) != 2 || all[0].Name != "Minecraft" || all[1].Name != "SSH" {
+		t.Errorf("GetAllServices returned %+v: %v", all, err)
+	}
+
+	second.Port = 2222
+	second.RequireApproval = true
+	second.RequireStepUp = true
+	second.NetworkRules = network.Rules{AllowCIDRs: []string{"10.0.0.0/8"}, DenyCountries: []string{"CN"}, AllowASNs: []uint{13335}}
+	if err := r.UpdateService(second, second.ID); err != nil {
+		t.Errorf("UpdateService failed: %v", err)
+	}
+	second.NetworkRules.AllowCIDRs[0] = "0.0.0.0/0"
+	updated, err := r.GetServiceById(second.ID)
+	if err != nil || updated.Port != 2222 || updated.Description != "Home server" || !updated.RequireApproval || !updated.RequireStepUp {
+		t.Errorf("GetServiceById returned %+v: %v", updated, err)
+	}
+	if rules := updated.NetworkRules; len(rules.AllowCIDRs) != 1 || rules.AllowCIDRs[0] != "10.0.0.0/8" || rules.DenyCountries[0] != "CN" || rules.AllowASNs[0] != 13335 {
+		t.Errorf("expected the service to keep its network rules, got %+v", rules)
+	}
+	if err := r.UpdateService(second, 0); err == nil {
+		t.Errorf("updating service id 0 should fail")
+	}
+	if err := r.UpdateService(second, 999); err == nil {
+		t.Errorf("updating a missing service should fail")
+	}
+
+	if err := r.DeleteService(int(first.ID)); err != nil {
+		t.Errorf("DeleteService failed: %v", err)
+	}
+	if err := r.DeleteService(int(first.ID)); err == nil {
+		t.Errorf("deleting a missing service should fail")
+	}
+	missing, err := r.GetServiceById(first.ID)
+	if err != nil || missing.ID != 0 {
+		t.Errorf("GetServiceById should return an empty service once deleted, got %+v: %v", missing, err)
+	}
+}
+
+func testPolicyRepository(t *testing.T, r Repository) {
+	rules := authorization.Group{Match: authorization.MatchAll, Conditions: []authorization.Condition{
+		{Attribute: authorization.AttributeConnectionIP, Operator: authorization.OperatorInCIDR, Values: []string{"10.0.0.0/8"}},
+	}}
+	office, err := r.CreateNewPolicy(authorization.Policy{Name: "Office", Description: "Office network only", Rules: rules})
+	if err != nil {
+		t.Fatalf("CreateNewPolicy failed: %v", err)
+	}
+	if office.ID == 0 {
+		t.Errorf("policies should get a non-zero id")
+	}
+	if _, err := r.CreateNewPolicy(authorization.Policy{Name: "Office", Rules: rules}); err == nil {
+		t.Errorf("creating a second policy with the same name should fail")
+	}
+	stored, err := r.GetPolicyById(office.ID)
+	if err != nil || stored.Name != "Office" || len(stored.Rules.Conditions) != 1 || stored.Rules.Conditions[0].Values[0] != "10.0.0.0/8" {
+		t.Errorf("GetPolicyById returned %+v: %v", stored, err)
+	}
+
+	office.Rules.Match = authorization.MatchAny
+	if err := r.UpdatePolicy(office, office.ID); err != nil {
+		t.Errorf("UpdatePolicy failed: %v", err)
+	}
+	if err := r.UpdatePolicy(office, 999); err == nil {
+		t.Errorf("updating a missing policy should fail")
+	}
+	all, err := r.GetAllPolicies()
+	if err != nil || len(all) != 1 || all[0].Rules.Match != authorization.MatchAny {
+		t.Errorf("GetAllPolicies returned %+v: %v", all, err)
+	}
+
+	service, err := r.CreateNewService(services.ProtectedService{Name: "SSH", Host: "10.0.0.2", Port: 22, ClientPolicyID: office.ID})
+	if err != nil {
+		t.Fatalf("CreateNewService failed: %v", err)
+	}
+	if stored, _ := r.GetServiceById(service.ID); stored.ClientPolicyID != office.ID {
+		t.Errorf("expected the service to keep its policy, got %d", stored.ClientPolicyID)
+	}
+	if err := r.DeletePolicy(office.ID); err == nil {
+		t.Errorf("deleting a policy a service uses should fail")
+	}
+	service.ClientPolicyID = 0
+	if err := r.UpdateService(service, service.ID); err != nil {
+		t.Fatalf("UpdateService failed: %v", err)
+	}
+	if err := r.DeletePolicy(office.ID); err != nil {
+		t.Errorf("DeletePolicy failed: %v", err)
+	}
+	missing, err := r.GetPolicyById(office.ID)
+	if err != nil || missing.ID != 0 {
+		t.Errorf("GetPolicyById should return an empty policy once deleted, got %+v: %v", missing, err)
+	}
+}
+
+func testScheduleRepository(t *testing.T, r Repository) {
+	evenings, err := r.CreateNewSchedule(authorization.Schedule{
+		Name:       "Evenings",
+		Timezone:   "Europe/London",
+		Windows:    []authorization.Window{{Days: []string{"monday", "friday"}, Start: "18:00", End: "01:00"}},
+		Exceptions: []authorization.Exception{{Date: "2024-12-25", Open: false}},
+	})
+	if err != nil {
+		t.Fatalf("CreateNewSchedule failed: %v", err)
+	}
+	if evenings.ID == 0 {
+		t.Errorf("schedules should get a non-zero id")
+	}
+	if _, err := r.CreateNewSchedule(authorization.Schedule{Name: "Evenings", Timezone: "UTC"}); err == nil {
+		t.Errorf("creating a second schedule with the same name should fail")
+	}
+	stored, err := r.GetScheduleById(evenings.ID)
+	if err != nil || stored.Timezone != "Europe/London" || len(stored.Windows) != 1 || stored.Windows[0].Days[1] != "friday" || stored.Exceptions[0].Date != "2024-12-25" {
+		t.Errorf("GetScheduleById returned %+v: %v", stored, err)
+	}
+
+	evenings.EndSessions = true
+	evenings.Exceptions = nil
+	if err := r.UpdateSchedule(evenings, evenings.ID); err != nil {
+		t.Errorf("UpdateSchedule failed: %v", err)
+	}
+	if err := r.UpdateSchedule(evenings, 999); err == nil {
+		t.Errorf("updating a missing schedule should fail")
+	}
+	all, err := r.GetAllSchedules()
+	if err != nil || len(all) != 1 || !all[0].EndSessions || len(all[0].Exceptions) != 0 {
+		t.Errorf("GetAllSchedules returned %+v: %v", all, err)
+	}
+
+	service, err := r.CreateNewService(services.ProtectedService{Name: "SSH", Host: "10.0.0.2", Port: 22, ScheduleID: evenings.ID})
+	if err != nil {
+		t.Fatalf("CreateNewService failed: %v", err)
+	}
+	policy, err := r.CreateNewPolicy(authorization.Policy{Name: "Office", ScheduleID: evenings.ID, Rules: authorization.Group{Match: authorization.MatchAll}})
+	if err != nil {
+		t.Fatalf("CreateNewPolicy failed: %v", err)
+	}
+	if stored, _ := r.GetPolicyById(policy.ID); stored.ScheduleID != evenings.ID {
+		t.Errorf("expected the policy to keep its schedule, got %d", stored.ScheduleID)
+	}
+	if err := r.DeleteSchedule(evenings.ID); err == nil {
+		t.Errorf("deleting a schedule a service and a policy use should fail")
+	}
+	service.ScheduleID = 0
+	if err := r.UpdateService(service, service.ID); err != nil {
+		t.Fatalf("UpdateService failed: %v", err)
+	}
+	if err := r.DeleteSchedule(evenings.ID); err == nil {
+		t.Errorf("deleting a schedule a policy uses should fail")
+	}
+	policy.ScheduleID = 0
+	if err := r.UpdatePolicy(policy, policy.ID); err != nil {
+		t.Fatalf("UpdatePolicy failed: %v", err)
+	}
+	if err := r.DeleteSchedule(evenings.ID); err != nil {
+		t.Errorf("DeleteSchedule failed: %v", err)
+	}
+	missing, err := r.GetScheduleById(evenings.ID)
+	if err != nil || missing.ID != 0 {
+		t.Errorf("GetScheduleById should return an empty schedule once deleted, got %+v: %v", missing, err)
+	}
+}
+
+func testJITRequestRepository(t *testing.T, r Repository) {
+	requestedAt := time.Date(2024, 12, 2, 21, 0, 0, 0, time.UTC)
+	first, err := r.CreateNewJITRequest(authorization.JITRequest{DeviceID: "device-1", ServiceID: 1, Reason: "Fix the backups", Status: authorization.JITPending, RequestedAt: requestedAt})
+	if err != nil {
+		t.Fatalf("CreateNewJITRequest failed: %v", err)
+	}
+	second, err := r.CreateNewJITRequest(authorization.JITRequest{DeviceID: "device-1", ServiceID: 1, Reason: "Restart Plex", Status: authorization.JITPending, RequestedAt: requestedAt.Add(time.Minute)})
+	if err != nil {
+		t.Fatalf("CreateNewJITRequest failed: %v", err)
+	}
+	if first.ID == 0 || second.ID == first.ID {
+		t.Errorf("just-in-time access requests should get unique non-zero ids, got %d and %d", first.ID, second.ID)
+	}
+
+	first.Status = authorization.JITApproved
+	first.DecidedBy = "dashboard 127.0.0.1:51234"
+	first.DecidedAt = requestedAt.Add(2 * time.Minute)
+	first.ExpiresAt = requestedAt.Add(time.Hour)
+	if err := r.UpdateJITRequest(first, authorization.JITPending); err != nil {
+		t.Errorf("UpdateJITRequest failed: %v", err)
+	}
+	if err := r.UpdateJITRequest(&authorization.JITRequest{ID: 999}, authorization.JITPending); err == nil {
+		t.Errorf("updating a missing just-in-time access request should fail")
+	}
+	// Another Drawbridge admin denying the request at the same time doesn't overwrite the approval.
+	denied := *first
+	denied.Status = authorization.JITDenied
+	denied.DecidedBy = "dashboard 127.0.0.1:51235"
+	if err := r.UpdateJITRequest(&denied, authorization.JITPending); err == nil {
+		t.Errorf("updating a just-in-time access request that is no longer pending should fail")
+	}
+	stored, err := r.GetJITRequestById(first.ID)
+	if err != nil || *stored != *first {
+		t.Errorf("GetJITRequestById returned %+v: %v, wanted %+v", stored, err, first)
+	}
+	missing, err := r.GetJITRequestById(999)
+	if err != nil || missing.ID != 0 {
+		t.Errorf("GetJITRequestById should return an empty request when missing, got %+v: %v", missing, err)
+	}
+
+	approved, err := r.GetJITRequestsForDevice("device-1", 1, authorization.JITApproved)
+	if err != nil || len(approved) != 1 || approved[0].ID != first.ID {
+		t.Errorf("GetJITRequestsForDevice should return the approved request, got %+v: %v", approved, err)
+	}
+	if other, err := r.GetJITRequestsForDevice("device-2", 1, authorization.JITApproved); err != nil || len(other) != 0 {
+		t.Errorf("GetJITRequestsForDevice should only return the device's requests, got %+v: %v", other, err)
+	}
+	all, err := r.GetJITRequests([]authorization.JITStatus{authorization.JITPending, authorization.JITApproved}, 0)
+	if err != nil || len(all) != 2 || all[0].ID != second.ID {
+		t.Errorf("GetJITRequests should return every request newest first, got %+v: %v", all, err)
+	}
+	if limited, err := r.GetJITRequests([]authorization.JITStatus{authorization.JITPending, authorization.JITApproved}, 1); err != nil || len(limited) != 1 {
+		t.Errorf("GetJITRequests should return at most the limit, got %+v: %v", limited, err)
+	}
+	if pending, err := r.GetJITRequests([]authorization.JITStatus{authorization.JITPending}, 0); err != nil || len(pending) != 1 || pending[0].Reason != "Restart Plex" {
+		t.Errorf("GetJITRequests should only return pending requests, got %+v: %v", pending, err)
+	}
+}
+
+func testTOTPRepository(t *testing.T, r Repository) {
+	missing, err := r.GetDeviceTOTP("device-1")
+	if err != nil || missing.DeviceID != "" {
+		t.Errorf("GetDeviceTOTP should return an empty enrollment for a device that isn't enrolled, got %+v: %v", missing, err)
+	}
+	enrolledAt := time.Date(2024, 12, 2, 21, 0, 0, 0, time.UTC)
+	enrollment := emissary.TOTPEnrollment{DeviceID: "device-1", Secret: "JBSWY3DPEHPK3PXP", EnrolledAt: enrolledAt}
+	if err := r.SaveDeviceTOTP(enrollment); err != nil {
+		t.Fatalf("SaveDeviceTOTP failed: %v", err)
+	}
+	enrollment.Confirmed = true
+	enrollment.LastCounter = 57773040
+	enrollment.Failures = 2
+	enrollment.LockedUntil = enrolledAt.Add(15 * time.Minute)
+	if err := r.SaveDeviceTOTP(enrollment); err != nil {
+		t.Fatalf("SaveDeviceTOTP failed to replace the enrollment: %v", err)
+	}
+	stored, err := r.GetDeviceTOTP("device-1")
+	if err != nil || *stored != enrollment {
+		t.Errorf("GetDeviceTOTP returned %+v: %v, wanted %+v", stored, err, enrollment)
+	}
+	if err := r.DeleteDeviceTOTP("device-1"); err != nil {
+		t.Errorf("DeleteDeviceTOTP failed: %v", err)
+	}
+	if err := r.DeleteDeviceTOTP("device-1"); err == nil {
+		t.Errorf("deleting an enrollment that doesn't exist should fail")
+	}
+}
+
+func testQuarantineRepository(t *testing.T, r Repository) {
+	missing, err := r.GetDeviceQuarantine("device-1")
+	if err != nil || missing.DeviceID != "" {
+		t.Errorf("GetDeviceQuarantine should return an empty quarantine for a device that isn't quarantined, got %+v: %v", missing, err)
+	}
+	now := time.Date(2024, 12, 2, 21, 0, 0, 0, time.UTC)
+	laptop := emissary.Quarantine{DeviceID: "device-1", Reason: "new country: first connection from FR", Score: 80, QuarantinedAt: now.Add(-time.Hour)}
+	phone := emissary.Quarantine{DeviceID: "device-2", Reason: "several IPs at once: 4 IPs within 10 minutes", Score: 70, QuarantinedAt: now}
+	for _, quarantine := range []emissary.Quarantine{laptop, phone} {
+		if err := r.QuarantineDevice(quarantine); err != nil {
+			t.Fatalf("QuarantineDevice failed: %v", err)
+		}
+	}
+	if err := r.QuarantineDevice(laptop); err == nil {
+		t.Errorf("quarantining a device twice should fail")
+	}
+	stored, err := r.GetDeviceQuarantine("device-1")
+	if err != nil || *stored != laptop {
+		t.Errorf("GetDeviceQuarantine returned %+v: %v, wanted %+v", stored, err, laptop)
+	}
+	all, err := r.GetQuarantinedDevices()
+	if err != nil || len(all) != 2 || all[0] != phone || all[1] != laptop {
+		t.Errorf("GetQuarantinedDevices should return quarantined devices newest first, got %+v: %v", all, err)
+	}
+	if err := r.ReleaseDevice("device-1"); err != nil {
+		t.Errorf("ReleaseDevice failed: %v", err)
+	}
+	if err := r.ReleaseDevice("device-1"); err == nil {
+		t.Errorf("releasing a device that isn't quarantined should fail")
+	}
+}
+
+func testLockdownRepository(t *testing.T, r Repository) {
+	current, err := r.GetLockdown()
+	if err != nil || current.ID != 0 || current.Active {
+		t.Errorf("GetLockdown should return an inactive transition before Drawbridge was ever locked down, got %+v: %v", current, err)
+	}
+	now := time.Date(2024, 12, 2, 21, 0, 0, 0, time.UTC)
+	engaged, err := r.CreateLockdownTransition(lockdown.Transition{Active: true, Actor: "admin", Reason: "leaked Emissary bundle", CreatedAt: now.Add(-time.Hour)})
+	if err != nil || engaged.ID == 0 {
+		t.Fatalf("CreateLockdownTransition returned %+v: %v", engaged, err)
+	}
+	current, err = r.GetLockdown()
+	if err != nil || *current != *engaged {
+		t.Errorf("GetLockdown returned %+v: %v, wanted %+v", current, err, engaged)
+	}
+	lifted, err := r.CreateLockdownTransition(lockdown.Transition{Active: false, Actor: "cli", CreatedAt: now})
+	if err != nil || lifted.ID <= engaged.ID {
+		t.Fatalf("CreateLockdownTransition returned %+v: %v, wanted an id after %d", lifted, err, engaged.ID)
+	}
+	current, err = r.GetLockdown()
+	if err != nil || current.Active || current.Actor != "cli" {
+		t.Errorf("GetLockdown should return the latest transition, got %+v: %v", current, err)
+	}
+	transitions, err := r.GetLockdownTransitions(10)
+	if err != nil || len(transitions) != 2 || transitions[0] != *lifted || transitions[1] != *engaged {
+		t.Errorf("GetLockdownTransitions should return transitions newest first, got %+v: %v", transitions, err)
+	}
+	if transitions, _ := r.GetLockdownTransitions(1); len(transitions) != 1 || transitions[0].ID != lifted.ID {
+		t.Errorf("GetLockdownTransitions should return at most limit transitions, got %+v", transitions)
+	}
+}
+
+func testDeviceHistory(t *testing.T, r Repository) {
+	day := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	for _, seen := range []struct {
+		deviceID, country, service string
+		at                         time.Time
+	}{
+		{"device-1", "GB", "002", day.Add(time.Hour)},
+		{"device-1", "", "", day},
+		{"device-1", "IE", "001", day.Add(2 * time.Hour)},
+		{"device-1", "GB", "002", day.Add(4 * time.Hour)},
+		{"device-1", "FR", "003", day.Add(3 * time.Hour)},
+		{"device-2", "US", "004", day},
+	} {
+		if err := r.RecordDeviceBaseline(seen.deviceID, seen.country, seen.service, seen.at); err != nil {
+			t.Fatalf("RecordDeviceBaseline failed: %v", err)
+		}
+	}
+	history, err := r.GetDeviceHistory("device-1", day.Add(3*time.Hour))
+	want := emissary.DeviceHistory{FirstSeen: day, Countries: []string{"GB", "IE"}, Services: []string{"001", "002"}}
+	if err != nil || !history.FirstSeen.Equal(want.FirstSeen) || !slices.Equal(history.Countries, want.Countries) || !slices.Equal(history.Services, want.Services) {
+		t.Errorf("GetDeviceHistory returned %+v: %v, wanted %+v", history, err, want)
+	}
+	// The baseline outlives the events.
+	if _, err := r.PruneEmissaryClientEvents(day.AddDate(1, 0, 0)); err != nil {
+		t.Fatalf("PruneEmissaryClientEvents failed: %v", err)
+	}
+	history, err = r.GetDeviceHistory("device-1", day.AddDate(0, 0, 1))
+	if err != nil || !history.FirstSeen.Equal(day) || len(history.Countries) != 3 || len(history.Services) != 3 {
+		t.Errorf("GetDeviceHistory should keep every country and Protected Service, got %+v: %v", history, err)
+	}
+	history, err = r.GetDeviceHistory("device-3", day.AddDate(0, 0, 1))
+	if err != nil || !history.FirstSeen.IsZero() || len(history.Countries) != 0 {
+		t.Errorf("GetDeviceHistory should return an empty history for a device without a baseline, got %+v: %v", history, err)
+	}
+}
+
+func testBanRepository(t *testing.T, r Repository) {
+	missing, err := r.GetIPBan("203.0.113.7")
+	if err != nil || missing.IP != "" {
+		t.Errorf("GetIPBan should return an empty ban for an IP that was never banned, got %+v: %v", missing, err)
+	}
+	now := time.Date(2024, 12, 2, 21, 0, 0, 0, time.UTC)
+	scanner := network.Ban{IP: "203.0.113.7", Reason: network.FailureHandshake, Offenses: 1, BannedAt: now.Add(-time.Hour), ExpiresAt: now.Add(-45 * time.Minute)}
+	revoked := network.Ban{IP: "2001:db8::1", Reason: network.FailureRevokedCertificate, Offenses: 1, BannedAt: now.Add(-time.Minute), ExpiresAt: now.Add(14 * time.Minute)}
+	for _, ban := range []network.Ban{scanner, revoked} {
+		if err := r.SaveIPBan(ban); err != nil {
+			t.Fatalf("SaveIPBan failed: %v", err)
+		}
+	}
+	active, err := r.GetActiveIPBans(now)
+	if err != nil || len(active) != 1 || active[0] != revoked {
+		t.Errorf("GetActiveIPBans should leave out expired bans, got %+v: %v", active, err)
+	}
+
+	scanner = network.NextBan(scanner, scanner.IP, network.FailureMalformedRequest, now)
+	if err := r.SaveIPBan(scanner); err != nil {
+		t.Fatalf("SaveIPBan failed to replace the ban: %v", err)
+	}
+	stored, err := r.GetIPBan(scanner.IP)
+	if err != nil || *stored != scanner || stored.Offenses != 2 {
+		t.Errorf("GetIPBan returned %+v: %v, wanted %+v", stored, err, scanner)
+	}
+	active, err = r.GetActiveIPBans(now)
+	if err != nil || len(active) != 2 || active[0] != scanner || active[1] != revoked {
+		t.Errorf("GetActiveIPBans should return active bans newest first, got %+v: %v", active, err)
+	}
+
+	pruned, err := r.PruneIPBans(now.Add(30 * time.Minute))
+	if err != nil || pruned != 1 {
+		t.Errorf("PruneIPBans should delete the ban that expired before, pruned %d: %v", pruned, err)
+	}
+	if err := r.DeleteIPBan(scanner.IP); err != nil {
+		t.Errorf("DeleteIPBan failed: %v", err)
+	}
+	if err := r.DeleteIPBan(scanner.IP); err == nil {
+		t.Errorf("deleting a ban that doesn't exist should fail")
+	}
+}
+
+func testGrantRepository(t *testing.T, r Repository) {
+	ssh, _ := r.CreateNewService(services.ProtectedService{Name: "SSH", Host: "10.0.0.2", Port: 22})
+	minecraft, _ := r.CreateNewService(services.ProtectedService{Name: "Minecraft", Host: "10.0.0.3", Port: 25565})
+	policy, _ := r.CreateNewPolicy(authorization.Policy{Name: "Office", Rules: authorization.Group{Match: authorization.MatchAll}})
+	schedule, _ := r.CreateNewSchedule(authorization.Schedule{Name: "Evenings", Timezone: "UTC"})
+
+	servers, err := r.CreateNewGrant(authorization.Grant{ServiceID: ssh.ID, Group: "servers", PolicyID: policy.ID, ScheduleID: schedule.ID})
+	if err != nil {
+		t.Fatalf("CreateNewGrant failed: %v", err)
+	}
+	if servers.ID == 0 {
+		t.Errorf("grants should get a non-zero id")
+	}
+	if _, err := r.CreateNewGrant(authorization.Grant{ServiceID: ssh.ID, Group: "servers"}); err == nil {
+		t.Errorf("granting a service to the same group twice should fail")
+	}
+	if _, err := r.CreateNewGrant(authorization.Grant{ServiceID: ssh.ID, Group: "family"}); err != nil {
+		t.Fatalf("CreateNewGrant failed: %v", err)
+	}
+	if _, err := r.CreateNewGrant(authorization.Grant{ServiceID: minecraft.ID, Group: "family"}); err != nil {
+		t.Fatalf("CreateNewGrant failed: %v", err)
+	}
+
+	grants, err := r.GetGrantsForService(ssh.ID)
+	if err != nil || len(grants) != 2 || grants[0].Group != "family" || grants[1] != *servers {
+		t.Errorf("GetGrantsForService should return the service's grants by group, got %+v: %v", grants, err)
+	}
+	all, err := r.GetAllGrants()
+	if err != nil || len(all) != 3 || all[0].ServiceID != ssh.ID || all[2].ServiceID != minecraft.ID {
+		t.Errorf("GetAllGrants should return every grant by service, got %+v: %v", all, err)
+	}
+
+	if err := r.DeletePolicy(policy.ID); err == nil {
+		t.Errorf("deleting a policy a grant uses should fail")
+	}
+	if err := r.DeleteSchedule(schedule.ID); err == nil {
+		t.Errorf("deleting a schedule a grant uses should fail")
+	}
+	if err := r.DeleteGrant(servers.ID); err != nil {
+		t.Errorf("DeleteGrant failed: %v", err)
+	}
+	if err := r.DeleteGrant(servers.ID); err == nil {
+		t.Errorf("deleting a missing grant should fail")
+	}
+	if err := r.DeletePolicy(policy.ID); err != nil {
+		t.Errorf("DeletePolicy failed once its grant was deleted: %v", err)
+	}
+
+	if err := r.DeleteService(int(ssh.ID)); err != nil {
+		t.Fatalf("DeleteService failed: %v", err)
+	}
+	if grants, _ := r.GetGrantsForService(ssh.ID); len(grants) != 0 {
+		t.Errorf("deleting a service should delete its grants, got %+v", grants)
+	}
+	if all, _ := r.GetAllGrants(); len(all) != 1 {
+		t.Errorf("deleting a service should leave other services' grants, got %+v", all)
+	}
+}
+
+func testPostureRepository(t *testing.T, r Repository) {
+	start := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+	for i := range emissary.MaxPostureHistory + 5 {
+		_, err := r.InsertPostureReport(emissary.PostureReport{
+			DeviceID:      "device-1",
+			OS:            "linux",
+			OSVersion:     fmt.Sprintf("6.%d", i),
+			Hostname:      "otter",
+			DiskEncrypted: i%2 == 0,
+			ReportedAt:    start.Add(time.Duration(i) * time.Minute),
+		})
+		if err != nil {
+			t.Fatalf("InsertPostureReport failed: %v", err)
+		}
+	}
+	phone, err := r.InsertPostureReport(emissary.PostureReport{DeviceID: "device-2", OS: "android", OSVersion: "14", FirewallEnabled: true, ReportedAt: start.Add(500 * time.Millisecond)})
+	if err != nil || phone.ID == 0 || !phone.ReportedAt.Equal(start) {
+		t.Fatalf("InsertPostureReport returned %+v: %v", phone, err)
+	}
+
+	history, err := r.GetPostureHistory("device-1", 1000)
+	if err != nil || len(history) != emissary.MaxPostureHistory {
+		t.Fatalf("expected the history to be capped at %d reports, got %d: %v", emissary.MaxPostureHistory, len(history), err)
+	}
+	newest := history[0]
+	if newest.OSVersion != fmt.Sprintf("6.%d", emissary.MaxPostureHistory+4) || !newest.ReportedAt.Equal(start.Add(time.Duration(emissary.MaxPostureHistory+4)*time.Minute)) {
+		t.Errorf("expected the newest report first, got %+v", newest)
+	}
+	if oldest := history[len(history)-1]; oldest.OSVersion != "6.5" {
+		t.Errorf("expected the oldest reports to be dropped, the oldest kept is %+v", oldest)
+	}
+	if limited, _ := r.GetPostureHistory("device-1", 3); len(limited) != 3 || limited[0].ID != newest.ID {
+		t.Errorf("expected the 3 newest reports, got %+v", limited)
+	}
+
+	latest, err := r.GetLatestPostureReports([]string{"device-1", "device-2", "device-3"})
+	if err != nil || len(latest) != 2 {
+		t.Fatalf("expected the latest report of the 2 devices that sent one, got %+v: %v", latest, err)
+	}
+	if latest["device-1"] != newest || !latest["device-2"].FirewallEnabled || latest["device-2"].OS != "android" {
+		t.Errorf("GetLatestPostureReports returned %+v", latest)
+	}
+}
+
+func testDeviceRepository(t *testing.T, r Repository) {
+	for _, client := range []emissary.EmissaryClient{
+		{ID: "device-1", Name: "Laptop", DrawbridgeCertificate: "cert-1", Groups: []string{"family"}, Tags: []string{"alice", "work"}},
+		{ID: "device-2", Name: "Phone", DrawbridgeCertificate: "cert-2"},
+	} {
+		if _, err := r.CreateNewEmissaryClient(client); err != nil {
+			t.Fatalf("CreateNewEmissaryClient failed: %v", err)
+		}
+	}
+	if _, err := r.CreateNewEmissaryClient(emissary.EmissaryClient{ID: "device-3", Name: "Laptop", DrawbridgeCertificate: "cert-3"}); err == nil {
+		t.Errorf("device names should be unique")
+	}
+	if _, err := r.CreateNewEmissaryClient(emissary.EmissaryClient{ID: "device-1", Name: "Desktop", DrawbridgeCertificate: "cert-3"}); err == nil {
+		t.Errorf("device ids should be unique")
+	}
+
+	all, err := r.GetAllEmissaryClients()
+	if err != nil || len(all) != 2 || all[0].ID != "device-1" || all[1].ID != "device-2" {
+		t.Errorf("GetAllEmissaryClients should return devices in the order they were created, got %v: %v", all, err)
+	}
+
+	if !slices.Equal(all[0].Groups, []string{"family"}) || !slices.Equal(all[0].Tags, []string{"alice", "work"}) || all[1].Groups != nil {
+		t.Errorf("expected devices to keep their groups and tags, got %+v and %+v", all[0], all[1])
+	}
+	if err := r.UpdateEmissaryClientGroupsAndTags("device-2", []string{"family", "servers"}, nil); err != nil {
+		t.Errorf("UpdateEmissaryClientGroupsAndTags failed: %v", err)
+	}
+	if updated, _ := r.GetEmissaryClientById("device-2"); !slices.Equal(updated.Groups, []string{"family", "servers"}) || updated.Tags != nil {
+		t.Errorf("expected device-2 to be in family and servers with no tags, got %+v", updated)
+	}
+	if err := r.UpdateEmissaryClientGroupsAndTags("no-such-device", nil, nil); err == nil {
+		t.Errorf("updating the groups of a missing device should fail")
+	}
+
+	if err := r.RenameEmissaryClient("device-2", "Tablet"); err != nil {
+		t.Errorf("RenameEmissaryClient failed: %v", err)
+	}
+	if renamed, _ := r.GetEmissaryClientById("device-2"); renamed.Name != "Tablet" {
+		t.Errorf("expected device-2 to be renamed to Tablet, got %q", renamed.Name)
+	}
+	if err := r.RenameEmissaryClient("device-2", "Laptop"); err == nil {
+		t.Errorf("renaming a device to another device's name should fail")
+	}
+	if err := r.RenameEmissaryClient("no-such-device", "Desktop"); err == nil {
+		t.Errorf("renaming a missing device should fail")
+	}
+
+	client, event, err := r.RevokeEmissaryClient("device-2")
+	if err != nil {
+		t.Fatalf("RevokeEmissaryClient failed: %v", err)
+	}
+	if client.Revoked != 1 || event == nil || !event.Timestamp.IsZero() {
+		t.Errorf("RevokeEmissaryClient returned %+v and %+v", client, event)
+	}
+	client, _, err = r.UnRevokeEmissaryClient("device-2")
+	if err != nil || client.Revoked != 0 {
+		t.Errorf("UnRevokeEmissaryClient returned %+v: %v", client, err)
+	}
+
+	missing, err := r.GetEmissaryClientById("no-such-device")
+	if err != nil || missing.ID != "" {
+		t.Errorf("GetEmissaryClientById should return an empty client for a missing device, got %+v: %v", missing, err)
+	}
+}
+
+func testEventRepository(t *testing.T, r Repository) {
+	if _, err := r.CreateNewEmissaryClient(emissary.EmissaryClient{ID: "device-1", Name: "Laptop", DrawbridgeCertificate: "cert-1"}); err != nil {
+		t.Fatalf("CreateNewEmissaryClient failed: %v", err)
+	}
+	if _, err := r.GetLatestEventForEachDeviceId(nil); err == nil {
+		t.Errorf("getting the latest events without device ids should fail")
+	}
+
+	day := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	events := []emissary.Event{
+		{ID: "a", ConnectionIP: "10.0.0.1:50000", Type: "PS_CONN", TargetService: "001", Timestamp: day.Add(9 * time.Hour)},
+		{ID: "b", ConnectionIP: "10.0.0.1:50001", Type: "PS_CONN", TargetService: "002", Timestamp: day.Add(10 * time.Hour)},
+		{ID: "c", ConnectionIP: "10.0.0.2:50002", Type: "PS_CONN", TargetService: "001", Timestamp: day.Add(11 * time.Hour)},
+		{ID: "d", ConnectionIP: "10.0.0.3:50003", Type: "PS_LIST", TargetService: "", Timestamp: day.AddDate(0, 0, 1)},
+	}
+	for _, event := range events {
+		event.DeviceID = "device-1"
+		if err := r.InsertEmissaryClientEvent(event); err != nil {
+			t.Fatalf("InsertEmissaryClientEvent failed: %v", err)
+		}
+		if err := r.RecordEmissaryClientEventBytes(event.ID, 10, 100); err != nil {
+			t.Fatalf("RecordEmissaryClientEventBytes failed: %v", err)
+		}
+	}
+	if err := r.InsertEmissaryClientEvent(emissary.Event{ID: "a", DeviceID: "device-1", Timestamp: day}); err == nil {
+		t.Errorf("event ids should be unique")
+	}
+
+	// Nothing has been rolled up yet.
+	latest, err := r.GetLatestEventForEachDeviceId([]any{"device-1"})
+	if err != nil || len(latest) != 0 {
+		t.Errorf("the latest events should come from the rollups, got %v: %v", latest, err)
+	}
+
+	if err := r.RollupEmissaryClientEvents(time.Time{}); err != nil {
+		t.Fatalf("RollupEmissaryClientEvents failed: %v", err)
+	}
+	if err := r.RollupEmissaryClientEvents(day.Add(12 * time.Hour)); err != nil {
+		t.Fatalf("RollupEmissaryClientEvents failed: %v", err)
+	}
+
+	usage, err := r.GetDailyUsageForDevice("device-1", day)
+	if err != nil {
+		t.Fatalf("GetDailyUsageForDevice failed: %v", err)
+	}
+	if len(usage) != 3 {
+		t.Fatalf("expected daily usage for 2 services on the first day and 1 on the second, got %+v", usage)
+	}
+	if !usage[0].Bucket.Equal(day) || !usage[2].Bucket.Equal(day.AddDate(0, 0, 1)) {
+		t.Errorf("daily usage should be oldest first, got %+v", usage)
+	}
+	for _, rollup := range usage[:2] {
+		switch rollup.TargetService {
+		case "001":
+			if rollup.Connections != 2 || rollup.UniqueIPs != 2 || rollup.BytesIn != 20 || rollup.BytesOut != 200 || rollup.LastIP != "10.0.0.2:50002" {
+				t.Errorf("unexpected daily rollup for service 001: %+v", rollup)
+			}
+		case "002":
+			if rollup.Connections != 1 || rollup.UniqueIPs != 1 {
+				t.Errorf("unexpected daily rollup for service 002: %+v", rollup)
+			}
+		default:
+			t.Errorf("unexpected daily rollup %+v", rollup)
+		}
+	}
+	if usage, _ := r.GetDailyUsageForDevice("device-1", day.AddDate(0, 0, 1)); len(usage) != 1 {
+		t.Errorf("daily usage should start on the day since falls in, got %+v", usage)
+	}
+
+	pruned, err := r.PruneEmissaryClientEvents(day.AddDate(0, 0, 1))
+	if err != nil || pruned != 3 {
+		t.Errorf("PruneEmissaryClientEvents pruned %d events, want 3: %v", pruned, err)
+	}
+	event, err := r.GetLatestEventForDeviceId("device-1")
+	if err != nil || event.Type != "PS_LIST" || event.ConnectionIP != "10.0.0.3:50003" || !event.Timestamp.Equal(events[3].Timestamp) {
+		t.Errorf("GetLatestEventForDeviceId returned %+v: %v", event, err)
+	}
+
+	// Once hourly rollups are pruned the daily rollups still know when the device was last seen.
+	if err := r.PruneEmissaryClientEventRollups(day.AddDate(0, 0, 2), time.Time{}); err != nil {
+		t.Fatalf("PruneEmissaryClientEventRollups failed: %v", err)
+	}
+	latest, err = r.GetLatestEventForEachDeviceId([]any{"device-1", "no-such-device"})
+	if err != nil || len(latest) != 1 || latest["device-1"].ConnectionIP != "10.0.0.3:50003" {
+		t.Errorf("GetLatestEventForEachDeviceId returned %v: %v", latest, err)
+	}
+	if err := r.PruneEmissaryClientEventRollups(day.AddDate(0, 0, 2), day.AddDate(0, 0, 1)); err != nil {
+		t.Fatalf("PruneEmissaryClientEventRollups failed: %v", err)
+	}
+	if usage, _ := r.GetDailyUsageForDevice("device-1", day); len(usage) != 1 {
+		t.Errorf("daily rollups before the cutoff should be pruned, got %+v", usage)
+	}
+}
+
+func testEventQueries(t *testing.T, r Repository) {
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for i := range 25 {
+		event := emissary.Event{
+			ID:            fmt.Sprintf("event-%02d", i),
+			DeviceID:      []string{"device-1", "device-2"}[i%2],
+			ConnectionIP:  []string{"10.0.0.1:5000", "10.0.0.10:5001", "[2001:db8::1]:5002"}[i%3],
+			Type:          "PS_CONN",
+			TargetService: "001",
+			// Pairs of events share a timestamp so paging has to break ties on the id.
+			Timestamp: start.Add(time.Duration(i/2) * time.Minute),
+		}
+		if i%5 == 0 {
+			event.Type, event.TargetService = "PS_LIST", ""
+		}
+		if i == 24 {
+			event.Reason, event.Country, event.ASN = "schedule closed", "GB", 20712
+			event.Trace = []authorization.TraceStep{{Check: `schedule "Evenings"`, Detail: "schedule closed"}}
+		}
+		if err := r.InsertEmissaryClientEvent(event); err != nil {
+			t.Fatalf("InsertEmissaryClientEvent failed: %v", err)
+		}
+	}
+
+	// Page through every event, newest first, and check we see each one once and in order.
+	query := emissary.EventQuery{Descending: true, Limit: 10}
+	var seen []emissary.Event
+	for pages := 0; ; pages++ {
+		page, err := r.QueryEmissaryClientEvents(query)
+		if err != nil {
+			t.Fatalf("QueryEmissaryClientEvents failed: %v", err)
+		}
+		seen = append(seen, page.Events...)
+		if page.NextCursor == "" {
+			if pages != 2 {
+				t.Errorf("25 events 10 at a time should take 3 pages, took %d", pages+1)
+			}
+			break
+		}
+		query.Cursor = page.NextCursor
+	}
+	if len(seen) != 25 || seen[0].ID != "event-24" || seen[24].ID != "event-00" {
+		t.Fatalf("paging should return every event newest first, got %d events", len(seen))
+	}
+	for i := 1; i < len(seen); i++ {
+		if compareEvents(seen[i-1], seen[i], emissary.EventSortTimestamp) <= 0 {
+			t.Errorf("events out of order: %s before %s", seen[i-1].ID, seen[i].ID)
+		}
+	}
+	if !seen[24].Timestamp.Equal(start) {
+		t.Errorf("events should have their timestamp, got %v", seen[24].Timestamp)
+	}
+	if seen[0].Reason != "schedule closed" || seen[0].Country != "GB" || seen[0].ASN != 20712 || seen[1].Reason != "" {
+		t.Errorf("events should keep their reason and location, got %+v and %+v", seen[0], seen[1])
+	}
+	if len(seen[0].Trace) != 1 || seen[0].Trace[0].Check != `schedule "Evenings"` || seen[1].Trace != nil {
+		t.Errorf("events should keep their trace, got %+v and %+v", seen[0].Trace, seen[1].Trace)
+	}
+
+	for name, test := range map[string]struct {
+		query emissary.EventQuery
+		want  int
+	}{
+		"device":          {emissary.EventQuery{DeviceID: "device-1"}, 13},
+		"service":         {emissary.EventQuery{TargetService: "001"}, 20},
+		"type":            {emissary.EventQuery{Type: "PS_LIST"}, 5},
+		"ip without port": {emissary.EventQuery{IP: "10.0.0.1"}, 9},
+		"ip with port":    {emissary.EventQuery{IP: "10.0.0.10:5001"}, 8},
+		"ipv6":            {emissary.EventQuery{IP: "2001:db8::1"}, 8},
+		"time range":      {emissary.EventQuery{Since: start.Add(2 * time.Minute), Until: start.Add(4 * time.Minute)}, 4},
+		"combined":        {emissary.EventQuery{DeviceID: "device-2", Type: "PS_CONN", Since: start.Add(time.Minute)}, 9},
+	} {
+		page, err := r.QueryEmissaryClientEvents(test.query)
+		if err != nil || len(page.Events) != test.want {
+			t.Errorf("filtering by %s returned %d events, want %d: %v", name, len(page.Events), test.want, err)
+		}
+	}
+
+	// Sorting by another column pages the same way.
+	query = emissary.EventQuery{Sort: emissary.EventSortIP, Limit: 4}
+	seen = nil
+	for {
+		page, err := r.QueryEmissaryClientEvents(query)
+		if err != nil {
+			t.Fatalf("QueryEmissaryClientEvents failed: %v", err)
+		}
+		seen = append(seen, page.Events...)
+		if page.NextCursor == "" {
+			break
+		}
+		query.Cursor = page.NextCursor
+	}
+	if len(seen) != 25 {
+		t.Fatalf("paging sorted by ip should return every event, got %d", len(seen))
+	}
+	for i := 1; i < len(seen); i++ {
+		if compareEvents(seen[i-1], seen[i], emissary.EventSortIP) >= 0 {
+			t.Errorf("events out of order: %s before %s", seen[i-1].ID, seen[i].ID)
+		}
+	}
+
+	if _, err := r.QueryEmissaryClientEvents(emissary.EventQuery{Cursor: "not a cursor"}); !errors.Is(err, ErrInvalidEventCursor) {
+		t.Errorf("an invalid cursor should return ErrInvalidEventCursor, got %v", err)
+	}
+	if _, err := r.QueryEmissaryClientEvents(emissary.EventQuery{Sort: emissary.EventSortType, Cursor: query.Cursor}); !errors.Is(err, ErrInvalidEventCursor) {
+		t.Errorf("a cursor for a different sort should return ErrInvalidEventCursor, got %v", err)
+	}
+	if _, err := r.QueryEmissaryClientEvents(emissary.EventQuery{Sort: "name"}); err == nil {
+		t.Errorf("an unknown sort should fail")
+	}
+}
+
+func testConfigRepository(t *testing.T, r Repository) {
+	value, err := r.GetDrawbridgeConfigValueByName("listening_address")
+	if err != nil || value == nil || *value != "" {
+		t.Errorf("a missing setting should be an empty string, got %v: %v", value, err)
+	}
+	if err := r.CreateNewDrawbridgeConfigSettings("listening_address", "127.0.0.1"); err != nil {
+		t.Fatalf("CreateNewDrawbridgeConfigSettings failed: %v", err)
+	}
+	if err := r.CreateNewDrawbridgeConfigSettings("listening_address", "10.0.0.1"); err != nil {
+		t.Fatalf("CreateNewDrawbridgeConfigSettings should replace an existing setting: %v", err)
+	}
+	value, err = r.GetDrawbridgeConfigValueByName("listening_address")
+	if err != nil || *value != "10.0.0.1" {
+		t.Errorf("GetDrawbridgeConfigValueByName returned %v: %v", value, err)
+	}
+	if err := r.DeleteDrawbridgeConfigSetting("listening_address"); err != nil {
+		t.Errorf("DeleteDrawbridgeConfigSetting failed: %v", err)
+	}
+	if err := r.DeleteDrawbridgeConfigSetting("listening_address"); err == nil {
+		t.Errorf("deleting a missing setting should fail")
+	}
+}
+
+func testCertificateRepository(t *testing.T, r Repository) {
+	if _, err := r.CreateNewEmissaryClient(emissary.EmissaryClient{ID: "device-1", Name: "Laptop", DrawbridgeCertificate: "cert-1"}); err != nil {
+		t.Fatalf("CreateNewEmissaryClient failed: %v", err)
+	}
+	if _, err := r.CreateNewEmissaryClient(emissary.EmissaryClient{ID: "device-2", Name: "Phone", DrawbridgeCertificate: "cert-2", Revoked: 1}); err != nil {
+		t.Fatalf("CreateNewEmissaryClient failed: %v", err)
+	}
+	hash := func(certificate string) string {
+		sum := sha256.Sum256([]byte(certificate))
+		return hex.EncodeToString(sum[:])
+	}
+
+	certificates, err := r.GetAllEmissaryClientCertificates()
+	if err != nil || len(certificates) != 2 || certificates[hash("cert-2")] != (emissary.DeviceCertificate{DeviceID: "device-2", Revoked: 1}) {
+		t.Errorf("GetAllEmissaryClientCertificates returned %v: %v", certificates, err)
+	}
+
+	if err := r.SupersedeEmissaryClientCertificate("device-1", hash("cert-1"), "cert-1-rotated", time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("SupersedeEmissaryClientCertificate failed: %v", err)
+	}
+	if err := r.SupersedeEmissaryClientCertificate("device-2", hash("cert-2"), "cert-2-rotated", time.Now().Add(-time.Hour)); err != nil {
+		t.Fatalf("SupersedeEmissaryClientCertificate failed: %v", err)
+	}
+	if err := r.SupersedeEmissaryClientCertificate("no-such-device", "hash", "cert-3", time.Now().Add(time.Hour)); err == nil {
+		t.Errorf("superseding the certificate of a missing device should fail")
+	}
+	if err := r.SupersedeEmissaryClientCertificate("device-1", hash("cert-1-rotated"), "cert-2-rotated", time.Now().Add(time.Hour)); err == nil {
+		t.Errorf("device certificates should be unique")
+	}
+
+	certificates, _ = r.GetAllEmissaryClientCertificates()
+	if _, exists := certificates[hash("cert-1-rotated")]; !exists {
+		t.Errorf("the device should use its new certificate, got %v", certificates)
+	}
+	superseded, err := r.GetActiveSupersededCertificates()
+	if err != nil || len(superseded) != 1 || superseded[hash("cert-1")].DeviceID != "device-1" {
+		t.Errorf("only unexpired superseded certificates should be active, got %v: %v", superseded, err)
+	}
+
+	if err := r.DeleteSupersededCertificates(); err != nil {
+		t.Fatalf("DeleteSupersededCertificates failed: %v", err)
+	}
+	if superseded, _ := r.GetActiveSupersededCertificates(); len(superseded) != 0 {
+		t.Errorf("superseded certificates should be deleted, got %v", superseded)
+	}
+}
@@ -0,0 +1,166 @@
+package persistence
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"imdawon/drawbridge/cmd/drawbridge/emissary/authorization"
+)
+
+func (r *SQLiteRepository) CreateNewSchedule(schedule authorization.Schedule) (*authorization.Schedule, error) {
+	windows, exceptions, err := encodeSchedule(schedule)
+	if err != nil {
+		return nil, err
+	}
+	res, err := r.db.Exec(
+		"INSERT INTO schedules(name, timezone, windows, exceptions, end_sessions) values(?,?,?,?,?)",
+		schedule.Name,
+		schedule.Timezone,
+		windows,
+		exceptions,
+		schedule.EndSessions,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error inserting new schedule into the db: %w", err)
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, fmt.Errorf("a new schedule was inserted into the db, but an error was returned when retrieving the id for it: %w", err)
+	}
+
+	schedule.ID = id
+	return &schedule, nil
+}
+
+func (r *SQLiteRepository) GetAllSchedules() ([]authorization.Schedule, error) {
+	rows, err := r.db.Query("SELECT id, name, timezone, windows, exceptions, end_sessions FROM schedules ORDER BY id")
+	if err != nil {
+		return nil, fmt.Errorf("error getting all schedules: %w", err)
+	}
+	defer rows.Close()
+
+	var all []authorization.Schedule
+	for rows.Next() {
+		schedule, err := scanSchedule(rows)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, *schedule)
+	}
+	return all, rows.Err()
+}
+
+func (r *SQLiteRepository) GetScheduleById(id int64) (*authorization.Schedule, error) {
+	row := r.db.QueryRow("SELECT id, name, timezone, windows, exceptions, end_sessions FROM schedules WHERE id = ?", id)
+	schedule, err := scanSchedule(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return &authorization.Schedule{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error getting schedule id %d: %w", id, err)
+	}
+	return schedule, nil
+}
+
+func encodeSchedule(schedule authorization.Schedule) (string, string, error) {
+	windows, err := json.Marshal(schedule.Windows)
+	if err != nil {
+		return "", "", fmt.Errorf("error encoding the windows of schedule %s: %w", schedule.Name, err)
+	}
+	exceptions, err := json.Marshal(schedule.Exceptions)
+	if err != nil {
+		return "", "", fmt.Errorf("error encoding the exceptions of schedule %s: %w", schedule.Name, err)
+	}
+	return string(windows), string(exceptions), nil
+}
+
+func scanSchedule(row interface{ Scan(...any) error }) (*authorization.Schedule, error) {
+	var schedule authorization.Schedule
+	var windows, exceptions string
+	err := row.Scan(&schedule.ID, &schedule.Name, &schedule.Timezone, &windows, &exceptions, &schedule.EndSessions)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal([]byte(windows), &schedule.Windows)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding the windows of schedule %s: %w", schedule.Name, err)
+	}
+	err = json.Unmarshal([]byte(exceptions), &schedule.Exceptions)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding the exceptions of schedule %s: %w", schedule.Name, err)
+	}
+	return &schedule, nil
+}
+
+func (r *SQLiteRepository) UpdateSchedule(updated *authorization.Schedule, id int64) error {
+	if id == 0 {
+		return fmt.Errorf("invalid updated ID")
+	}
+	windows, exceptions, err := encodeSchedule(*updated)
+	if err != nil {
+		return err
+	}
+	res, err := r.db.Exec(
+		"UPDATE schedules SET name = ?, timezone = ?, windows = ?, exceptions = ?, end_sessions = ? WHERE id = ?",
+		updated.Name,
+		updated.Timezone,
+		windows,
+		exceptions,
+		updated.EndSessions,
+		id,
+	)
+	if err != nil {
+		return fmt.Errorf("error updating schedule id %d: %w", id, err)
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return fmt.Errorf("update failed: no schedule with id %d", id)
+	}
+	return nil
+}
+
+func (r *SQLiteRepository) DeleteSchedule(id int64) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var services, policies int
+	err = tx.QueryRow("SELECT COUNT(*) FROM services WHERE schedule_id = ?", id).Scan(&services)
+	if err != nil {
+		return fmt.Errorf("error checking which services use schedule id %d: %w", id, err)
+	}
+	err = tx.QueryRow("SELECT COUNT(*) FROM policies WHERE schedule_id = ?", id).Scan(&policies)
+	if err != nil {
+		return fmt.Errorf("error checking which policies use schedule id %d: %w", id, err)
+	}
+	if services > 0 || policies > 0 {
+		return fmt.Errorf("schedule id %d is attached to %d Protected Service(s) and %d policies, detach it first", id, services, policies)
+	}
+	var grants int
+	err = tx.QueryRow("SELECT COUNT(*) FROM service_grants WHERE schedule_id = ?", id).Scan(&grants)
+	if err != nil {
+		return fmt.Errorf("error checking which grants use schedule id %d: %w", id, err)
+	}
+	if grants > 0 {
+		return fmt.Errorf("schedule id %d is used by %d grant(s), remove them first", id, grants)
+	}
+	res, err := tx.Exec("DELETE FROM schedules WHERE id = ?", id)
+	if err != nil {
+		return fmt.Errorf("error deleting schedule with id of %d: %w", id, err)
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return fmt.Errorf("no rows were deleted for schedule id: %d", id)
+	}
+	return tx.Commit()
+}
@@ -2,7 +2,9 @@ package persistence
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"imdawon/drawbridge/cmd/drawbridge/network"
 	"imdawon/drawbridge/cmd/drawbridge/services"
 	"log"
 	"log/slog"
@@ -20,28 +22,22 @@ func NewSQLiteRepository(db *sql.DB) *SQLiteRepository {
 	}
 }
 
-func (r *SQLiteRepository) MigrateServices() error {
-	query := `
-	CREATE TABLE IF NOT EXISTS services(
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		name TEXT NOT NULL,
-		description TEXT,
-		host TEXT NOT NULL,
-		port INTEGER NOT NULL
-	);
-	`
-
-	_, err := r.db.Exec(query)
-	return err
-}
-
 func (r *SQLiteRepository) CreateNewService(service services.ProtectedService) (*services.ProtectedService, error) {
+	networkRules, err := encodeNetworkRules(service.NetworkRules)
+	if err != nil {
+		return nil, err
+	}
 	res, err := r.db.Exec(
-		"INSERT INTO services(name, description, host, port) values(?,?,?,?)",
+		"INSERT INTO services(name, description, host, port, client_policy_id, schedule_id, network_rules, require_approval, require_step_up) values(?,?,?,?,?,?,?,?,?)",
 		service.Name,
 		service.Description,
 		service.Host,
 		service.Port,
+		service.ClientPolicyID,
+		service.ScheduleID,
+		networkRules,
+		service.RequireApproval,
+		service.RequireStepUp,
 	)
 	if err != nil {
 		return nil, fmt.Errorf("error inserting new service into the db: %w", err)
@@ -58,7 +54,7 @@ func (r *SQLiteRepository) CreateNewService(service services.ProtectedService) (
 }
 
 func (r *SQLiteRepository) GetAllServices() ([]services.ProtectedService, error) {
-	rows, err := r.db.Query("SELECT * from services")
+	rows, err := r.db.Query("SELECT id, name, description, host, port, client_policy_id, schedule_id, network_rules, require_approval, require_step_up FROM services")
 	if err != nil {
 		return nil, fmt.Errorf("error getting all services: %w", err)
 	}
@@ -66,51 +62,88 @@ func (r *SQLiteRepository) GetAllServices() ([]services.ProtectedService, error)
 
 	var all []services.ProtectedService
 	for rows.Next() {
-		var service services.ProtectedService
-		if err := rows.Scan(
-			&service.ID,
-			&service.Name,
-			&service.Description,
-			&service.Host,
-			&service.Port); err != nil {
+		service, err := scanService(rows)
+		if err != nil {
 			return nil, err
 		}
-		all = append(all, service)
+		all = append(all, *service)
 	}
 	return all, nil
 }
 
 func (r *SQLiteRepository) GetServiceById(id int64) (*services.ProtectedService, error) {
-	rows, err := r.db.Query("SELECT * FROM services WHERE id = ?", id)
+	rows, err := r.db.Query("SELECT id, name, description, host, port, client_policy_id, schedule_id, network_rules, require_approval, require_step_up FROM services WHERE id = ?", id)
 	if err != nil {
 		return nil, fmt.Errorf("error getting service id %d: %s", id, err)
 	}
 	defer rows.Close()
 
-	var service services.ProtectedService
+	service := &services.ProtectedService{}
 	for rows.Next() {
-		if err := rows.Scan(
-			&service.ID,
-			&service.Name,
-			&service.Description,
-			&service.Host,
-			&service.Port); err != nil {
+		service, err = scanService(rows)
+		if err != nil {
 			return nil, err
 		}
 	}
+	return service, nil
+}
+
+func scanService(rows *sql.Rows) (*services.ProtectedService, error) {
+	var service services.ProtectedService
+	var networkRules string
+	if err := rows.Scan(
+		&service.ID,
+		&service.Name,
+		&service.Description,
+		&service.Host,
+		&service.Port,
+		&service.ClientPolicyID,
+		&service.ScheduleID,
+		&networkRules,
+		&service.RequireApproval,
+		&service.RequireStepUp); err != nil {
+		return nil, err
+	}
+	if networkRules != "" {
+		err := json.Unmarshal([]byte(networkRules), &service.NetworkRules)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding the network rules of service %s: %w", service.Name, err)
+		}
+	}
 	return &service, nil
 }
 
+// Services without network rules store an empty string rather than {}.
+func encodeNetworkRules(rules network.Rules) (string, error) {
+	if rules.Empty() {
+		return "", nil
+	}
+	encoded, err := json.Marshal(rules)
+	if err != nil {
+		return "", fmt.Errorf("error encoding network rules: %w", err)
+	}
+	return string(encoded), nil
+}
+
 func (r *SQLiteRepository) UpdateService(updated *services.ProtectedService, id int64) error {
 	if id == 0 {
 		return fmt.Errorf("invalid updated ID")
 	}
+	networkRules, err := encodeNetworkRules(updated.NetworkRules)
+	if err != nil {
+		return err
+	}
 	res, err := r.db.Exec(
-		"UPDATE services SET name = ?, description = ?, host = ?, port = ? WHERE id = ?",
+		"UPDATE services SET name = ?, description = ?, host = ?, port = ?, client_policy_id = ?, schedule_id = ?, network_rules = ?, require_approval = ?, require_step_up = ? WHERE id = ?",
 		updated.Name,
 		updated.Description,
 		updated.Host,
 		updated.Port,
+		updated.ClientPolicyID,
+		updated.ScheduleID,
+		networkRules,
+		updated.RequireApproval,
+		updated.RequireStepUp,
 		id,
 	)
 	if err != nil {
@@ -126,8 +159,15 @@ func (r *SQLiteRepository) UpdateService(updated *services.ProtectedService, id
 
 }
 
+// Deletes the service along with its grants.
 func (r *SQLiteRepository) DeleteService(id int) error {
-	res, err := r.db.Exec("DELETE FROM services WHERE id = ?", id)
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("DELETE FROM services WHERE id = ?", id)
 	if err != nil {
 		return fmt.Errorf("error deleting service with id of %d: %s", id, err)
 	}
@@ -139,7 +179,11 @@ func (r *SQLiteRepository) DeleteService(id int) error {
 	if rowsAffected == 0 {
 		return fmt.Errorf("no rows were deleted for service id: %d", id)
 	}
-	return err
+	_, err = tx.Exec("DELETE FROM service_grants WHERE service_id = ?", id)
+	if err != nil {
+		return fmt.Errorf("error deleting the grants of service id %d: %w", id, err)
+	}
+	return tx.Commit()
 }
 
 func OpenDatabaseFile(filename string) *sql.DB {
@@ -0,0 +1,32 @@
+package persistence
+
+import (
+	"fmt"
+)
+
+// Writes a consistent copy of the database to path with VACUUM INTO. Drawbridge keeps running while the copy is made.
+// The file at path must not exist.
+func (r *SQLiteRepository) SnapshotTo(path string) error {
+	_, err := r.db.Exec("VACUUM INTO ?", path)
+	if err != nil {
+		return fmt.Errorf("error snapshotting database: %s", err)
+	}
+	return nil
+}
+
+// Runs SQLite's integrity check, e.g. on a database restored from a backup.
+func (r *SQLiteRepository) IntegrityCheck() error {
+	var result string
+	err := r.db.QueryRow("PRAGMA integrity_check").Scan(&result)
+	if err != nil {
+		return fmt.Errorf("error checking database integrity: %s", err)
+	}
+	if result != "ok" {
+		return fmt.Errorf("database integrity check failed: %s", result)
+	}
+	return nil
+}
+
+func (r *SQLiteRepository) Close() error {
+	return r.db.Close()
+}
@@ -0,0 +1,74 @@
+package persistence
+
+import (
+	"fmt"
+	"imdawon/drawbridge/cmd/drawbridge/emissary"
+)
+
+func (r *SQLiteRepository) GetDeviceTOTP(deviceID string) (*emissary.TOTPEnrollment, error) {
+	rows, err := r.db.Query("SELECT device_id, secret, confirmed, enrolled_at, last_counter, failures, locked_until FROM device_totp WHERE device_id = ?", deviceID)
+	if err != nil {
+		return nil, fmt.Errorf("error getting the TOTP enrollment of device %s: %w", deviceID, err)
+	}
+	defer rows.Close()
+
+	var enrollment emissary.TOTPEnrollment
+	if !rows.Next() {
+		return &enrollment, rows.Err()
+	}
+	var enrolledAt, lockedUntil string
+	err = rows.Scan(
+		&enrollment.DeviceID,
+		&enrollment.Secret,
+		&enrollment.Confirmed,
+		&enrolledAt,
+		&enrollment.LastCounter,
+		&enrollment.Failures,
+		&lockedUntil,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error scanning TOTP enrollment database row into an enrollment struct: %w", err)
+	}
+	enrollment.EnrolledAt, err = parseOptionalTime(enrolledAt)
+	if err == nil {
+		enrollment.LockedUntil, err = parseOptionalTime(lockedUntil)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("TOTP enrollment of device %s: %w", deviceID, err)
+	}
+	return &enrollment, nil
+}
+
+func (r *SQLiteRepository) SaveDeviceTOTP(enrollment emissary.TOTPEnrollment) error {
+	_, err := r.db.Exec(
+		`INSERT INTO device_totp(device_id, secret, confirmed, enrolled_at, last_counter, failures, locked_until) values(?,?,?,?,?,?,?)
+		ON CONFLICT(device_id) DO UPDATE SET secret = excluded.secret, confirmed = excluded.confirmed, enrolled_at = excluded.enrolled_at,
+		last_counter = excluded.last_counter, failures = excluded.failures, locked_until = excluded.locked_until`,
+		enrollment.DeviceID,
+		enrollment.Secret,
+		enrollment.Confirmed,
+		formatOptionalTime(enrollment.EnrolledAt),
+		enrollment.LastCounter,
+		enrollment.Failures,
+		formatOptionalTime(enrollment.LockedUntil),
+	)
+	if err != nil {
+		return fmt.Errorf("error saving the TOTP enrollment of device %s: %w", enrollment.DeviceID, err)
+	}
+	return nil
+}
+
+func (r *SQLiteRepository) DeleteDeviceTOTP(deviceID string) error {
+	res, err := r.db.Exec("DELETE FROM device_totp WHERE device_id = ?", deviceID)
+	if err != nil {
+		return fmt.Errorf("error deleting the TOTP enrollment of device %s: %w", deviceID, err)
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return fmt.Errorf("device %s isn't enrolled in step-up authentication", deviceID)
+	}
+	return nil
+}
@@ -0,0 +1,261 @@
+package drawbridge
+
+import (
+	"fmt"
+	"imdawon/drawbridge/cmd/drawbridge/emissary"
+	"imdawon/drawbridge/cmd/drawbridge/emissary/authorization"
+	"imdawon/drawbridge/cmd/drawbridge/services"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The event recorded instead of PS_CONN when a Protected Service's policy, schedule, network rules or grants turn an
+// Emissary device away, and instead of PS_CONN or OB_CR8T when lockdown does.
+const EventTypeDenied = "PS_DENY"
+
+// Validates a policy and stores it, replacing the stored policy with the same id if it has one.
+func (d *Drawbridge) SavePolicy(policy authorization.Policy) (*authorization.Policy, error) {
+	err := policy.Validate()
+	if err != nil {
+		return nil, err
+	}
+	if policy.ID == 0 {
+		return d.DB.CreateNewPolicy(policy)
+	}
+	err = d.DB.UpdatePolicy(&policy, policy.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &policy, nil
+}
+
+// A device asking to connect to a Protected Service. The access simulator sets Posture, and picks the connection IP
+// and time, to see what Drawbridge would decide in other circumstances.
+type AccessRequest struct {
+	DeviceID     string
+	ServiceID    int64
+	ConnectionIP string
+	Time         time.Time
+	// Checked instead of the device's latest posture report when set.
+	Posture *emissary.PostureReport
+	// The TOTP code sent with the connection, for services that require step-up. Empty when none was sent.
+	StepUpCode string
+}
+
+// Evaluates the schedules, network rules, just-in-time approval, grants and policy attached to the Protected Service
+// the device asked to connect to. Services without grants or a policy let in every device with a valid certificate,
+// which Drawbridge has already checked, while their schedule is open and from the networks their rules allow.
+// Services with grants only let in devices in a granted group, and services that require approval only let in
+// devices with an approved just-in-time access request on top. Anything that goes wrong looking up the schedules,
+// requests, grants or policies denies the connection. While Drawbridge is in lockdown, only break-glass devices get as
+// far as these checks.
+func (d *Drawbridge) AuthorizeProtectedServiceConnection(deviceID, connectionIP string, serviceID int64) authorization.Decision {
+	return d.AuthorizeConnection(AccessRequest{DeviceID: deviceID, ServiceID: serviceID, ConnectionIP: connectionIP, Time: time.Now()})
+}
+
+// Like AuthorizeProtectedServiceConnection, for a connection that may have sent a TOTP code for step-up. Services
+// that require step-up are checked last, so a code is only used once every other check has let the device in.
+func (d *Drawbridge) AuthorizeConnection(request AccessRequest) authorization.Decision {
+	decision := d.authorize(request)
+	if !decision.Allowed {
+		return decision
+	}
+	return d.checkStepUp(decision, request, true)
+}
+
+// Decides whether a device would be let in to a Protected Service, with every check Drawbridge makes and its
+// outcome. Step-up is checked without a code, so it passes when a fresh one would. Unlike a real connection, it also
+// checks the device's certificate and the Drawbridge source network
+// rules, which a real connection has already passed by the time its Protected Service is known.
+func (d *Drawbridge) SimulateAccess(request AccessRequest) authorization.Decision {
+	var trace []authorization.TraceStep
+	device, err := d.DB.GetEmissaryClientById(request.DeviceID)
+	if err != nil {
+		slog.Error("Access Simulation", slog.Any("Error getting device", err))
+		return denied(trace, "device certificate", "error getting the device")
+	}
+	if device.ID == "" {
+		return denied(trace, "device certificate", fmt.Sprintf("there is no device with id %s", request.DeviceID))
+	}
+	if device.Revoked == 1 {
+		return denied(trace, "device certificate", fmt.Sprintf("%s is revoked", device.Name))
+	}
+	trace = append(trace, authorization.TraceStep{Check: "device certificate", Passed: true, Detail: device.Name})
+	if reason := d.CheckNetworkRules(request.ConnectionIP); reason != "" {
+		return denied(trace, "Drawbridge source network rules", reason)
+	}
+	trace = append(trace, authorization.TraceStep{Check: "Drawbridge source network rules", Passed: true})
+	decision := d.authorize(request)
+	if decision.Allowed {
+		decision = d.checkStepUp(decision, request, false)
+	}
+	decision.Trace = append(trace, decision.Trace...)
+	return decision
+}
+
+// Adds a failed check to the trace and returns a decision denying the connection for its reason.
+func denied(trace []authorization.TraceStep, check, reason string) authorization.Decision {
+	return authorization.Decision{Reason: reason, Trace: append(trace, authorization.TraceStep{Check: check, Detail: reason})}
+}
+
+func (d *Drawbridge) authorize(request AccessRequest) authorization.Decision {
+	var trace []authorization.TraceStep
+	if reason := d.checkLockdown(request.DeviceID); reason != "" {
+		return denied(trace, lockdownCheck, reason)
+	}
+	if reason := d.checkQuarantine(request.DeviceID); reason != "" {
+		return denied(trace, quarantineCheck, reason)
+	}
+	service, err := d.DB.GetServiceById(request.ServiceID)
+	if err != nil {
+		slog.Error("Authorization", slog.Any("Error getting Protected Service", err))
+		return denied(trace, "Protected Service", "error getting the Protected Service")
+	}
+	if service.ScheduleID != 0 {
+		step := d.scheduleStep(service.ScheduleID, request.Time)
+		trace = append(trace, step)
+		if !step.Passed {
+			return authorization.Decision{Reason: step.Detail, Trace: trace}
+		}
+	}
+	if !service.NetworkRules.Empty() {
+		check := fmt.Sprintf("network rules of %s", service.Name)
+		if reason := d.checkNetworkRules(&service.NetworkRules, request.ConnectionIP); reason != "" {
+			return denied(trace, check, fmt.Sprintf("the network rules of %s: %s", service.Name, reason))
+		}
+		trace = append(trace, authorization.TraceStep{Check: check, Passed: true})
+	}
+	if service.RequireApproval {
+		step := d.jitStep(request.DeviceID, service.ID, request.Time)
+		if !step.Passed && step.Detail == "" {
+			step.Detail = fmt.Sprintf("%s needs an approved just-in-time access request", service.Name)
+		}
+		trace = append(trace, step)
+		if !step.Passed {
+			return authorization.Decision{Reason: step.Detail, Trace: trace}
+		}
+	}
+	grants, err := d.DB.GetGrantsForService(service.ID)
+	if err != nil {
+		slog.Error("Authorization", slog.Any("Error getting grants", err))
+		return denied(trace, "grants", "error getting the grants of the Protected Service")
+	}
+	// Emissary Outbound services aren't stored and have no grants or policy.
+	if len(grants) == 0 && service.ClientPolicyID == 0 {
+		return authorization.Decision{Allowed: true, Trace: trace}
+	}
+	device, err := d.DB.GetEmissaryClientById(request.DeviceID)
+	if err != nil {
+		slog.Error("Authorization", slog.Any("Error getting device", err))
+		return denied(trace, "device", "error getting the device")
+	}
+	if len(grants) > 0 {
+		decision := d.authorizeGrants(grants, device, service, request)
+		trace = append(trace, decision.Trace...)
+		if !decision.Allowed {
+			return authorization.Decision{Reason: decision.Reason, Trace: trace}
+		}
+	}
+	if service.ClientPolicyID == 0 {
+		return authorization.Decision{Allowed: true, Trace: trace}
+	}
+	decision := d.evaluatePolicy(service.ClientPolicyID, device, service, request)
+	decision.Trace = append(trace, decision.Trace...)
+	return decision
+}
+
+// Allows the device when it is in a group granted the service, and passes that grant's schedule and policy.
+func (d *Drawbridge) authorizeGrants(grants []authorization.Grant, device *emissary.EmissaryClient, service *services.ProtectedService, request AccessRequest) authorization.Decision {
+	var groups, reasons []string
+	var trace []authorization.TraceStep
+	for _, grant := range grants {
+		groups = append(groups, grant.Group)
+		check := fmt.Sprintf("grant to %s", grant.Group)
+		if !device.InAnyGroup(grant.Group) {
+			trace = append(trace, authorization.TraceStep{Check: check, Detail: fmt.Sprintf("the device isn't in %s", grant.Group)})
+			continue
+		}
+		// The grant's own step goes before its schedule and policy, once it is known whether they passed.
+		step := len(trace)
+		trace = append(trace, authorization.TraceStep{Check: check})
+		if grant.ScheduleID != 0 {
+			scheduleStep := d.scheduleStep(grant.ScheduleID, request.Time)
+			scheduleStep.Depth = 1
+			trace = append(trace, scheduleStep)
+			if !scheduleStep.Passed {
+				trace[step].Detail = scheduleStep.Detail
+				reasons = append(reasons, fmt.Sprintf("%s: %s", check, scheduleStep.Detail))
+				continue
+			}
+		}
+		if grant.PolicyID != 0 {
+			decision := d.evaluatePolicy(grant.PolicyID, device, service, request)
+			trace = append(trace, authorization.Nest(decision.Trace, 1)...)
+			if !decision.Allowed {
+				trace[step].Detail = decision.Reason
+				reasons = append(reasons, fmt.Sprintf("%s: %s", check, decision.Reason))
+				continue
+			}
+		}
+		trace[step].Passed = true
+		return authorization.Decision{Allowed: true, Trace: trace}
+	}
+	if len(reasons) == 0 {
+		return authorization.Decision{Reason: fmt.Sprintf("%s is only granted to the groups %s, and the device is in none of them", service.Name, strings.Join(groups, ", ")), Trace: trace}
+	}
+	return authorization.Decision{Reason: strings.Join(reasons, "; "), Trace: trace}
+}
+
+// Evaluates a policy, and its schedule, for a device connecting to a Protected Service. The trace starts with a step
+// for the policy, with the policy's checks nested under it.
+func (d *Drawbridge) evaluatePolicy(policyID int64, device *emissary.EmissaryClient, service *services.ProtectedService, request AccessRequest) authorization.Decision {
+	check := fmt.Sprintf("policy id %d", policyID)
+	policy, err := d.DB.GetPolicyById(policyID)
+	if err != nil {
+		slog.Error("Authorization", slog.Any("Error getting policy", err))
+		return denied(nil, check, "error getting the policy")
+	}
+	if policy.ID == 0 {
+		return denied(nil, check, fmt.Sprintf("policy id %d no longer exists", policyID))
+	}
+	trace := []authorization.TraceStep{{Check: fmt.Sprintf("policy %q", policy.Name)}}
+	deny := func(reason string) authorization.Decision {
+		reason = fmt.Sprintf("policy %q: %s", policy.Name, reason)
+		trace[0].Detail = reason
+		return authorization.Decision{Reason: reason, Trace: trace}
+	}
+	if policy.ScheduleID != 0 {
+		step := d.scheduleStep(policy.ScheduleID, request.Time)
+		step.Depth = 1
+		trace = append(trace, step)
+		if !step.Passed {
+			return deny(step.Detail)
+		}
+	}
+	now := request.Time
+	attributes := authorization.Attributes{
+		authorization.AttributeDeviceID:     device.ID,
+		authorization.AttributeDeviceName:   device.Name,
+		authorization.AttributeDeviceGroups: strings.Join(device.Groups, ","),
+		authorization.AttributeDeviceTags:   strings.Join(device.Tags, ","),
+		authorization.AttributeConnectionIP: request.ConnectionIP,
+		authorization.AttributeServiceID:    strconv.FormatInt(service.ID, 10),
+		authorization.AttributeServiceName:  service.Name,
+		authorization.AttributeNowHour:      strconv.Itoa(now.Hour()),
+		authorization.AttributeNowMinute:    strconv.Itoa(now.Minute()),
+		authorization.AttributeNowWeekday:   strings.ToLower(now.Weekday().String()),
+	}
+	if policy.UsesPosture() {
+		reason := d.addPostureAttributes(attributes, device.ID, request.Posture, now)
+		trace = append(trace, authorization.TraceStep{Check: "posture report", Passed: reason == "", Detail: reason, Depth: 1})
+		if reason != "" {
+			return deny(reason)
+		}
+	}
+	decision := policy.Evaluate(attributes)
+	trace[0].Passed, trace[0].Detail = decision.Allowed, decision.Reason
+	decision.Trace = append(trace, authorization.Nest(decision.Trace, 1)...)
+	return decision
+}
@@ -0,0 +1,105 @@
+package drawbridge
+
+import (
+	"imdawon/drawbridge/cmd/drawbridge/emissary"
+	"imdawon/drawbridge/cmd/drawbridge/emissary/authorization"
+	"imdawon/drawbridge/cmd/drawbridge/persistence"
+	"imdawon/drawbridge/cmd/drawbridge/services"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuthorizeProtectedServiceConnection(t *testing.T) {
+	db := persistence.NewMemoryRepository()
+	d := &Drawbridge{DB: db}
+	db.CreateNewEmissaryClient(emissary.EmissaryClient{ID: "device-1", Name: "Brave Otter", DrawbridgeCertificate: "cert-1"})
+	policy, err := d.SavePolicy(authorization.Policy{Name: "Home network", Rules: authorization.Group{Match: authorization.MatchAll, Conditions: []authorization.Condition{
+		{Attribute: authorization.AttributeConnectionIP, Operator: authorization.OperatorInCIDR, Values: []string{"192.168.1.0/24"}},
+		{Attribute: authorization.AttributeDeviceName, Operator: authorization.OperatorEquals, Value: "Brave Otter"},
+	}}})
+	if err != nil {
+		t.Fatalf("SavePolicy failed: %v", err)
+	}
+	if _, err := d.SavePolicy(authorization.Policy{Name: "Empty"}); err == nil {
+		t.Error("expected SavePolicy to refuse an invalid policy")
+	}
+	open, _ := db.CreateNewService(services.ProtectedService{Name: "Minecraft", Host: "10.0.0.3", Port: 25565})
+	protected, _ := db.CreateNewService(services.ProtectedService{Name: "SSH", Host: "10.0.0.2", Port: 22, ClientPolicyID: policy.ID})
+	orphaned, _ := db.CreateNewService(services.ProtectedService{Name: "Gitea", Host: "10.0.0.4", Port: 3000, ClientPolicyID: 999})
+
+	tests := []struct {
+		name         string
+		deviceID     string
+		connectionIP string
+		serviceID    int64
+		allowed      bool
+	}{
+		{"no policy", "device-1", "203.0.113.5:50000", open.ID, true},
+		{"passes the policy", "device-1", "192.168.1.20:50000", protected.ID, true},
+		{"outside the network", "device-1", "203.0.113.5:50000", protected.ID, false},
+		{"unknown device", "device-2", "192.168.1.20:50000", protected.ID, false},
+		{"missing policy", "device-1", "192.168.1.20:50000", orphaned.ID, false},
+	}
+	for _, test := range tests {
+		decision := d.AuthorizeProtectedServiceConnection(test.deviceID, test.connectionIP, test.serviceID)
+		if decision.Allowed != test.allowed {
+			t.Errorf("%s: got allowed %t (%s), wanted %t", test.name, decision.Allowed, decision.Reason, test.allowed)
+		}
+		if !decision.Allowed && decision.Reason == "" {
+			t.Errorf("%s: expected a reason for the denial", test.name)
+		}
+	}
+}
+
+func TestSimulateAccess(t *testing.T) {
+	db := persistence.NewMemoryRepository()
+	d := &Drawbridge{DB: db}
+	db.CreateNewEmissaryClient(emissary.EmissaryClient{ID: "device-1", Name: "Brave Otter", DrawbridgeCertificate: "cert-1", Groups: []string{"family"}})
+	db.CreateNewEmissaryClient(emissary.EmissaryClient{ID: "device-2", Name: "Calm Heron", DrawbridgeCertificate: "cert-2", Revoked: 1})
+	weekdays, _ := d.SaveSchedule(authorization.Schedule{Name: "Weekdays", Timezone: "UTC", Windows: []authorization.Window{{Days: []string{"monday", "tuesday", "wednesday", "thursday", "friday"}, Start: "00:00", End: "24:00"}}})
+	policy, _ := d.SavePolicy(authorization.Policy{Name: "Encrypted at home", Rules: authorization.Group{Match: authorization.MatchAll, Conditions: []authorization.Condition{
+		{Attribute: authorization.AttributeConnectionIP, Operator: authorization.OperatorInCIDR, Values: []string{"192.168.0.0/16"}},
+		{Expression: "device.disk_encrypted"},
+	}}})
+	service, _ := db.CreateNewService(services.ProtectedService{Name: "SSH", ScheduleID: weekdays.ID, ClientPolicyID: policy.ID})
+	db.CreateNewGrant(authorization.Grant{ServiceID: service.ID, Group: "family"})
+
+	monday := time.Date(2024, 12, 2, 12, 0, 0, 0, time.UTC)
+	encrypted := &emissary.PostureReport{OS: "linux", DiskEncrypted: true, ReportedAt: monday}
+	tests := []struct {
+		name    string
+		request AccessRequest
+		allowed bool
+		reason  string
+		// The check the trace ends on.
+		last string
+	}{
+		{"allowed", AccessRequest{DeviceID: "device-1", ServiceID: service.ID, ConnectionIP: "192.168.1.20", Time: monday, Posture: encrypted}, true, "", "device.disk_encrypted"},
+		{"other IP", AccessRequest{DeviceID: "device-1", ServiceID: service.ID, ConnectionIP: "203.0.113.7", Time: monday, Posture: encrypted}, false, "connection.ip in_cidr [192.168.0.0/16]: got 203.0.113.7", "device.disk_encrypted"},
+		{"weekend", AccessRequest{DeviceID: "device-1", ServiceID: service.ID, ConnectionIP: "192.168.1.20", Time: monday.AddDate(0, 0, 5), Posture: encrypted}, false, `schedule "Weekdays" is closed`, `schedule "Weekdays"`},
+		{"latest posture", AccessRequest{DeviceID: "device-1", ServiceID: service.ID, ConnectionIP: "192.168.1.20", Time: monday}, false, "hasn't sent a posture report", "posture report"},
+		{"revoked", AccessRequest{DeviceID: "device-2", ServiceID: service.ID, ConnectionIP: "192.168.1.20", Time: monday}, false, "Calm Heron is revoked", "device certificate"},
+	}
+	for _, test := range tests {
+		decision := d.SimulateAccess(test.request)
+		if decision.Allowed != test.allowed || !strings.Contains(decision.Reason, test.reason) {
+			t.Errorf("%s: got %+v, wanted allowed %t with a reason containing %q", test.name, decision, test.allowed, test.reason)
+			continue
+		}
+		if len(decision.Trace) == 0 || decision.Trace[len(decision.Trace)-1].Check != test.last {
+			t.Errorf("%s: expected the trace to end on %q, got %+v", test.name, test.last, decision.Trace)
+		}
+	}
+
+	// Every check is in the trace, with the policy's posture report and conditions nested under it.
+	decision := d.SimulateAccess(tests[1].request)
+	var checks []string
+	for _, step := range decision.Trace {
+		checks = append(checks, strings.Repeat("  ", step.Depth)+step.Check)
+	}
+	want := "device certificate\nDrawbridge source network rules\nschedule \"Weekdays\"\ngrant to family\npolicy \"Encrypted at home\"\n  posture report\n  connection.ip in_cidr [192.168.0.0/16]\n  device.disk_encrypted"
+	if strings.Join(checks, "\n") != want {
+		t.Errorf("got the trace\n%s\nwanted\n%s", strings.Join(checks, "\n"), want)
+	}
+}
@@ -0,0 +1,121 @@
+package drawbridge
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"imdawon/drawbridge/cmd/drawbridge/emissary"
+	"imdawon/drawbridge/cmd/drawbridge/emissary/authorization"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// The setting in the drawbridge_config table for how old a device's latest posture report can be before
+	// policies that use posture deny it.
+	postureMaxAgeSetting = "posture_max_age"
+	DefaultPostureMaxAge = 24 * time.Hour
+	MinPostureMaxAge     = time.Minute
+
+	// Posture reports are JSON objects of a few short fields, so anything longer is a broken or hostile client.
+	maxPostureReportSize = 4096
+	postureReadTimeout   = 10 * time.Second
+)
+
+func (d *Drawbridge) PostureMaxAge() time.Duration {
+	value, err := d.DB.GetDrawbridgeConfigValueByName(postureMaxAgeSetting)
+	if err != nil {
+		slog.Error("Database", slog.Any("Error getting "+postureMaxAgeSetting, err))
+		return DefaultPostureMaxAge
+	}
+	if value == nil || *value == "" {
+		return DefaultPostureMaxAge
+	}
+	maxAge, err := time.ParseDuration(*value)
+	if err != nil || maxAge < MinPostureMaxAge {
+		slog.Error("Device Posture", slog.String("Invalid "+postureMaxAgeSetting, *value))
+		return DefaultPostureMaxAge
+	}
+	return maxAge
+}
+
+func (d *Drawbridge) SavePostureMaxAge(maxAge time.Duration) error {
+	if maxAge < MinPostureMaxAge {
+		return fmt.Errorf("posture reports must be accepted for at least %s", MinPostureMaxAge)
+	}
+	return d.DB.CreateNewDrawbridgeConfigSettings(postureMaxAgeSetting, maxAge.String())
+}
+
+// Stores the posture report an Emissary client sent with DV_PSTR and tells the client whether it was accepted.
+// The report is the JSON after "DV_PSTR: ", up to a newline. The first read may only hold part of it.
+func (d *Drawbridge) handlePostureReport(conn net.Conn, deviceID, payload string) {
+	defer conn.Close()
+	report, err := readPostureReport(conn, payload)
+	if err == nil {
+		report.DeviceID = deviceID
+		report.ReportedAt = time.Now()
+		_, err = d.DB.InsertPostureReport(*report)
+	}
+	if err != nil {
+		slog.Warn("DV_PSTR Handler", slog.String("device", deviceID), slog.Any("Error", err))
+		fmt.Fprintf(conn, "DV_PSTR: ERR %s\n", strings.ReplaceAll(err.Error(), "\n", " "))
+		return
+	}
+	conn.Write([]byte("DV_PSTR: OK\n"))
+}
+
+func readPostureReport(conn net.Conn, payload string) (*emissary.PostureReport, error) {
+	line, _, complete := strings.Cut(payload, "\n")
+	if !complete {
+		conn.SetReadDeadline(time.Now().Add(postureReadTimeout))
+		rest, err := bufio.NewReader(io.LimitReader(conn, int64(maxPostureReportSize-len(payload)))).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, fmt.Errorf("error reading the posture report: %w", err)
+		}
+		if err == io.EOF && len(payload)+len(rest) >= maxPostureReportSize {
+			return nil, fmt.Errorf("posture reports can be at most %d bytes", maxPostureReportSize)
+		}
+		line += strings.TrimSuffix(rest, "\n")
+	}
+	body, found := strings.CutPrefix(line, "DV_PSTR:")
+	if !found {
+		return nil, fmt.Errorf("expected DV_PSTR: followed by the posture report")
+	}
+	var report emissary.PostureReport
+	err := json.Unmarshal([]byte(strings.TrimSpace(body)), &report)
+	if err != nil {
+		return nil, fmt.Errorf("the posture report isn't valid JSON: %w", err)
+	}
+	return &report, report.Normalize()
+}
+
+// Adds the device's latest posture report, or report when it isn't nil, to the attributes a policy is evaluated
+// against. Returns a reason to deny the connection when the device hasn't sent a report in the last PostureMaxAge.
+func (d *Drawbridge) addPostureAttributes(attributes authorization.Attributes, deviceID string, report *emissary.PostureReport, now time.Time) string {
+	if report == nil {
+		reports, err := d.DB.GetLatestPostureReports([]string{deviceID})
+		if err != nil {
+			slog.Error("Authorization", slog.Any("Error getting posture report", err))
+			return "error getting the device's posture report"
+		}
+		latest, found := reports[deviceID]
+		if !found {
+			return "the policy checks device posture and the device hasn't sent a posture report"
+		}
+		report = &latest
+	}
+	maxAge := d.PostureMaxAge()
+	if age := now.Sub(report.ReportedAt); age > maxAge {
+		return fmt.Sprintf("the policy checks device posture and the device's latest posture report is %s old, older than %s", age.Truncate(time.Second), maxAge)
+	}
+	attributes[authorization.AttributeDeviceOS] = report.OS
+	attributes[authorization.AttributeDeviceOSVersion] = report.OSVersion
+	attributes[authorization.AttributeDeviceHostname] = report.Hostname
+	attributes[authorization.AttributeDeviceDiskEncrypted] = strconv.FormatBool(report.DiskEncrypted)
+	attributes[authorization.AttributeDeviceFirewallEnabled] = strconv.FormatBool(report.FirewallEnabled)
+	return ""
+}
@@ -0,0 +1,95 @@
+package drawbridge
+
+import (
+	"bufio"
+	"imdawon/drawbridge/cmd/drawbridge/emissary"
+	"imdawon/drawbridge/cmd/drawbridge/emissary/authorization"
+	"imdawon/drawbridge/cmd/drawbridge/persistence"
+	"imdawon/drawbridge/cmd/drawbridge/services"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPostureGatedAccess(t *testing.T) {
+	db := persistence.NewMemoryRepository()
+	d := &Drawbridge{DB: db}
+	db.CreateNewEmissaryClient(emissary.EmissaryClient{ID: "device-1", Name: "Brave Otter", DrawbridgeCertificate: "cert-1"})
+	policy, err := d.SavePolicy(authorization.Policy{Name: "Encrypted laptops", Rules: authorization.Group{Match: authorization.MatchAll, Conditions: []authorization.Condition{
+		{Expression: `device.disk_encrypted && device.os_version >= version("6.1")`},
+	}}})
+	if err != nil {
+		t.Fatalf("SavePolicy failed: %v", err)
+	}
+	service, _ := db.CreateNewService(services.ProtectedService{Name: "SSH", Host: "10.0.0.2", Port: 22, ClientPolicyID: policy.ID})
+	authorize := func() authorization.Decision {
+		return d.AuthorizeProtectedServiceConnection("device-1", "192.168.1.20:50000", service.ID)
+	}
+
+	if decision := authorize(); decision.Allowed || !strings.Contains(decision.Reason, "hasn't sent a posture report") {
+		t.Errorf("expected a device without a posture report to be denied, got %+v", decision)
+	}
+
+	db.InsertPostureReport(emissary.PostureReport{DeviceID: "device-1", OS: "linux", OSVersion: "6.8.0", DiskEncrypted: true, ReportedAt: time.Now().Add(-25 * time.Hour)})
+	if decision := authorize(); decision.Allowed || !strings.Contains(decision.Reason, "older than 24h0m0s") {
+		t.Errorf("expected a device with a stale posture report to be denied, got %+v", decision)
+	}
+	if err := d.SavePostureMaxAge(48 * time.Hour); err != nil {
+		t.Fatalf("SavePostureMaxAge failed: %v", err)
+	}
+	if decision := authorize(); !decision.Allowed {
+		t.Errorf("expected the report to be recent enough once the max age is raised: %s", decision.Reason)
+	}
+
+	db.InsertPostureReport(emissary.PostureReport{DeviceID: "device-1", OS: "linux", OSVersion: "6.8.0", DiskEncrypted: false, ReportedAt: time.Now()})
+	if decision := authorize(); decision.Allowed {
+		t.Error("expected the latest report to be used, and an unencrypted disk to be denied")
+	}
+	if err := d.SavePostureMaxAge(time.Second); err == nil {
+		t.Error("expected SavePostureMaxAge to refuse a max age under a minute")
+	}
+}
+
+func TestHandlePostureReport(t *testing.T) {
+	tests := []struct {
+		name string
+		// The first read, which handlePostureReport is given, and what the client sends after it.
+		first, rest string
+		response    string
+	}{
+		{"whole report", `DV_PSTR: {"os":"Linux","os_version":"6.8.0","hostname":"otter","disk_encrypted":true,"firewall_enabled":true}` + "\n", "", "DV_PSTR: OK\n"},
+		{"split report", `DV_PSTR: {"os":"macOS","os_ver`, `sion":"14.2","disk_encrypted":true}` + "\n", "DV_PSTR: OK\n"},
+		{"invalid JSON", "DV_PSTR: {\"os\":\n", "", "DV_PSTR: ERR the posture report isn't valid JSON"},
+		{"no os", "DV_PSTR: {\"hostname\":\"otter\"}\n", "", "DV_PSTR: ERR a posture report needs an os\n"},
+		{"too long", "DV_PSTR: {\"os\":\"", strings.Repeat("a", maxPostureReportSize), "DV_PSTR: ERR posture reports can be at most"},
+	}
+	for _, test := range tests {
+		db := persistence.NewMemoryRepository()
+		d := &Drawbridge{DB: db}
+		server, client := net.Pipe()
+		go func() {
+			client.Write([]byte(test.rest))
+		}()
+		go d.handlePostureReport(server, "device-1", test.first)
+		response, err := bufio.NewReader(client).ReadString('\n')
+		client.Close()
+		if err != nil || !strings.HasPrefix(response, test.response) {
+			t.Errorf("%s: got response %q (%v), wanted %q", test.name, response, err, test.response)
+		}
+		history, _ := db.GetPostureHistory("device-1", 10)
+		if accepted := test.response == "DV_PSTR: OK\n"; accepted != (len(history) == 1) {
+			t.Errorf("%s: expected the report to be stored only when it is accepted, stored %d", test.name, len(history))
+		}
+	}
+
+	db := persistence.NewMemoryRepository()
+	d := &Drawbridge{DB: db}
+	server, client := net.Pipe()
+	go d.handlePostureReport(server, "device-1", `DV_PSTR: {"os":"Windows","os_version":"10.0.19045","hostname":"Desk","firewall_enabled":true}`+"\n")
+	bufio.NewReader(client).ReadString('\n')
+	history, _ := db.GetPostureHistory("device-1", 10)
+	if len(history) != 1 || history[0].OS != "windows" || !history[0].FirewallEnabled || history[0].DiskEncrypted || history[0].ReportedAt.IsZero() {
+		t.Errorf("expected the report to be stored with a lowercase os, got %+v", history)
+	}
+}
@@ -2,3 +2,31 @@ package drawbridge
 
 // The Drawbridge protocol communicates over an mTLS-encrypted TCP tunnel for communications between Emissary clients and Drawbridge servers.
 // Read PROTOCOL.md for more info.
+
+import "fmt"
+
+// The shortest request of each type Emissary clients send, e.g. PS_CONN is followed by a space and a 3 digit
+// Protected Service id.
+var requestLengths = map[string]int{
+	"PS_LIST": 7,
+	"CA_ROTN": 7,
+	"DV_PSTR": 7,
+	"PS_CONN": 11,
+	"PS_RQST": 11,
+	"OB_CR8T": 19,
+}
+
+// Checks that a request starts with a known type and is long enough to be handled.
+func checkPreamble(payload string) error {
+	if len(payload) < 7 {
+		return fmt.Errorf("request %q is too short", payload)
+	}
+	minLength, ok := requestLengths[payload[:7]]
+	if !ok {
+		return fmt.Errorf("unknown request type %q", payload[:7])
+	}
+	if len(payload) < minLength {
+		return fmt.Errorf("%s request %q is too short", payload[:7], payload)
+	}
+	return nil
+}
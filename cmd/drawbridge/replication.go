@@ -0,0 +1,97 @@
+package drawbridge
+
+import (
+	"errors"
+	"fmt"
+	"imdawon/drawbridge/cmd/drawbridge/replication"
+	"imdawon/drawbridge/cmd/drawbridge/sinks"
+	certificates "imdawon/drawbridge/cmd/reverse_proxy/ca"
+	"log/slog"
+)
+
+// Returned when something tries to change a standby Drawbridge.
+var ErrStandbyReadOnly = errors.New("this Drawbridge is a standby and is read-only until it is promoted with `drawbridge replication promote`")
+
+// Streams changes to the paired standby, if this Drawbridge is a primary. Runs once the certificate authority is
+// set up, as the replication link is secured by it.
+func (d *Drawbridge) startReplication() {
+	role, err := replication.GetRole(d.DB)
+	if err != nil {
+		slog.Error("Replication", slog.Any("Error reading replication role", err))
+		return
+	}
+	if role != replication.RolePrimary {
+		return
+	}
+	db, ok := d.DB.(replication.Database)
+	if !ok {
+		slog.Error("Replication", slog.String("Error", "only Drawbridge databases stored in SQLite can be replicated"))
+		return
+	}
+	primary, err := replication.NewPrimary(db, d.CA)
+	if err == nil {
+		err = primary.ListenAndServe()
+	}
+	slog.Error("Replication", slog.Any("Error", err))
+}
+
+// Follows the primary until `drawbridge replication promote` is run, then takes over from it:
+// the certificate authority replicated from the primary is loaded and Emissary connections are accepted.
+func (d *Drawbridge) FollowPrimary() error {
+	db, ok := d.DB.(replication.Database)
+	if !ok {
+		return fmt.Errorf("only Drawbridge databases stored in SQLite can be replicated")
+	}
+	standby, err := replication.NewStandby(db)
+	if err != nil {
+		return err
+	}
+	go func() {
+		standby.Run()
+		d.StartEventSinks()
+		d.RecordAdminAction(sinks.TypeStandbyPromoted, "cli", map[string]string{"primary_address": standby.PrimaryAddress})
+		d.StartPrimaryJobs()
+		protectedServices, err := d.DB.GetAllServices()
+		if err != nil {
+			slog.Error("Replication", slog.Any("Error reading replicated services", err))
+		}
+		d.SetUpCAAndDependentServices(protectedServices)
+	}()
+	return nil
+}
+
+// Starts the background jobs that change the database or end sessions: event rollups, schedule and just-in-time
+// access enforcement, and lockdown enforcement. A standby doesn't run them until it is promoted, as it would write
+// over what it replicates from the primary.
+func (d *Drawbridge) StartPrimaryJobs() {
+	d.StartEventRollups()
+	d.StartScheduleEnforcement()
+	d.StartLockdownEnforcement()
+}
+
+// Returns an error if this Drawbridge is a standby, whose database only the primary may change.
+func (d *Drawbridge) CheckWritable() error {
+	role, err := replication.GetRole(d.DB)
+	if err != nil {
+		return fmt.Errorf("error reading replication role: %w", err)
+	}
+	if role == replication.RoleStandby {
+		return ErrStandbyReadOnly
+	}
+	return nil
+}
+
+// The addresses written to Emissary Bundles: this Drawbridge, followed by its standby if one is paired.
+func (d *Drawbridge) emissaryEndpoints(listeningAddress string) string {
+	endpoints := fmt.Sprintf("%s:%d", listeningAddress, d.ListeningPort)
+	standbyAddress, err := d.DB.GetDrawbridgeConfigValueByName(certificates.StandbyListeningAddressSetting)
+	if err != nil {
+		slog.Error("Database", slog.Any("Error reading standby listening address", err))
+		return endpoints
+	}
+	if *standbyAddress != "" {
+		// The standby listens on the same port. Emissary clients that only read the first line keep using the primary.
+		endpoints += fmt.Sprintf("\n%s:%d", *standbyAddress, d.ListeningPort)
+	}
+	return endpoints
+}
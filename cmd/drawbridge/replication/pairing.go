@@ -0,0 +1,217 @@
+package replication
+
+import (
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"imdawon/drawbridge/cmd/drawbridge/persistence"
+	certificates "imdawon/drawbridge/cmd/reverse_proxy/ca"
+	"imdawon/drawbridge/cmd/utils"
+	"net"
+	"os"
+	"time"
+)
+
+// Files the standby connects to the primary with, in the standbyDirectory folder.
+const (
+	standbyCertificateFile          = "standby.crt"
+	standbyKeyFile                  = "standby.key"
+	primaryCertificateAuthorityFile = "primary-ca.crt"
+)
+
+// Written by `drawbridge replication pair` on the primary and read by `drawbridge replication join` on the standby.
+// It holds the standby's private key, so it must be moved to the standby securely.
+type Pairing struct {
+	// The host and port of the primary's replication listener, as reached by the standby.
+	PrimaryAddress string `json:"primary_address"`
+	// The address Emissary clients reach the standby at.
+	ListeningAddress string `json:"listening_address"`
+	// The root certificate authority the primary's server certificate chains to.
+	CertificateAuthority string `json:"certificate_authority"`
+	// The certificate the standby presents, followed by the certificates it chains through.
+	Certificate string `json:"certificate"`
+	Key         string `json:"key"`
+}
+
+// Makes this Drawbridge the primary and issues a certificate for a standby reachable by Emissary clients at
+// standbyListeningAddress. The replication listener binds listenAddress once Drawbridge is restarted.
+// Pairing again replaces the standby, the previous one can no longer connect.
+func Pair(db persistence.ConfigRepository, ca *certificates.CA, listenAddress, standbyListeningAddress string) (*Pairing, error) {
+	role, err := GetRole(db)
+	if err != nil {
+		return nil, err
+	}
+	if role == RoleStandby {
+		return nil, errors.New("this Drawbridge is a standby, pair the standby from the primary")
+	}
+	_, port, err := net.SplitHostPort(listenAddress)
+	if err != nil {
+		return nil, fmt.Errorf("invalid replication listen address %q: %w", listenAddress, err)
+	}
+	if standbyListeningAddress == "" {
+		return nil, errors.New("the standby needs a listening address Emissary clients can reach it at")
+	}
+	listeningAddress, err := db.GetDrawbridgeConfigValueByName("listening_address")
+	if err != nil {
+		return nil, err
+	}
+	if *listeningAddress == standbyListeningAddress {
+		return nil, errors.New("the standby needs a different listening address from the primary")
+	}
+
+	certificatePEM, key, err := ca.IssueEmissaryCertificate("drawbridge-standby", "Drawbridge Standby", ca.KeyAlgorithm(certificates.CertificateTypeServer))
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := certificates.EncodePrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	settings := []struct{ name, value string }{
+		{roleSetting, string(RolePrimary)},
+		{listenAddressSetting, listenAddress},
+		{standbyCertificateSetting, certificates.HashEmissaryCertificate(certificatePEM)},
+		{certificates.StandbyListeningAddressSetting, standbyListeningAddress},
+	}
+	for _, setting := range settings {
+		err = db.CreateNewDrawbridgeConfigSettings(setting.name, setting.value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// The standby presents the primary's server certificate once it's promoted, so it needs to be valid for both.
+	err = ca.ReissueServerCertificate()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Pairing{
+		PrimaryAddress:       net.JoinHostPort(*listeningAddress, port),
+		ListeningAddress:     standbyListeningAddress,
+		CertificateAuthority: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.CertificateAuthority.Raw})),
+		Certificate:          string(append(certificatePEM, ca.CertificateChainPEM()...)),
+		Key:                  string(keyPEM),
+	}, nil
+}
+
+// Makes this Drawbridge the standby of the primary that wrote the pairing. The primary's services, devices, settings
+// and certificate authority replace this Drawbridge's, so joining refuses a Drawbridge that has been set up unless force is set.
+func Join(db persistence.ConfigRepository, pairing *Pairing, force bool) error {
+	if pairing.PrimaryAddress == "" || pairing.ListeningAddress == "" || pairing.Certificate == "" || pairing.Key == "" {
+		return errors.New("the pairing file is incomplete")
+	}
+	listeningAddress, err := db.GetDrawbridgeConfigValueByName("listening_address")
+	if err != nil {
+		return err
+	}
+	if !force && (*listeningAddress != "" || utils.FileExists("ca/ca.crt")) {
+		return errors.New("this Drawbridge has already been set up, and joining replaces its services, devices, settings and certificate authority with the primary's")
+	}
+
+	files := []struct {
+		name     string
+		contents string
+		perm     os.FileMode
+	}{
+		{standbyCertificateFile, pairing.Certificate, 0644},
+		{standbyKeyFile, pairing.Key, 0600},
+		{primaryCertificateAuthorityFile, pairing.CertificateAuthority, 0644},
+	}
+	for _, file := range files {
+		err = utils.ReplaceFile(file.name, []byte(file.contents), standbyDirectory, file.perm)
+		if err != nil {
+			return err
+		}
+	}
+
+	// A former primary forgets its standby.
+	err = deleteSettings(db, listenAddressSetting, standbyCertificateSetting, certificates.StandbyListeningAddressSetting, lastAppliedSetting)
+	if err != nil {
+		return err
+	}
+	settings := []struct{ name, value string }{
+		{roleSetting, string(RoleStandby)},
+		{primaryAddressSetting, pairing.PrimaryAddress},
+		{"listening_address", pairing.ListeningAddress},
+	}
+	for _, setting := range settings {
+		err = db.CreateNewDrawbridgeConfigSettings(setting.name, setting.value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stops this standby following the primary. A running standby notices within a few seconds and starts accepting
+// Emissary connections.
+func Promote(db persistence.ConfigRepository) error {
+	role, err := GetRole(db)
+	if err != nil {
+		return err
+	}
+	if role != RoleStandby {
+		return errors.New("this Drawbridge is not a standby")
+	}
+	return deleteSettings(db, roleSetting, primaryAddressSetting)
+}
+
+// Deletes the settings that have been saved.
+func deleteSettings(db persistence.ConfigRepository, settings ...string) error {
+	for _, setting := range settings {
+		value, err := db.GetDrawbridgeConfigValueByName(setting)
+		if err != nil {
+			return err
+		}
+		if *value == "" {
+			continue
+		}
+		err = db.DeleteDrawbridgeConfigSetting(setting)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// This server's part in replication, as shown by `drawbridge replication status`.
+type Status struct {
+	Role Role
+	// Set on the primary.
+	ListenAddress           string
+	StandbyListeningAddress string
+	// Set on the standby.
+	PrimaryAddress string
+	LastApplied    time.Time
+}
+
+func GetStatus(db persistence.ConfigRepository) (*Status, error) {
+	role, err := GetRole(db)
+	if err != nil {
+		return nil, err
+	}
+	status := &Status{Role: role}
+	for setting, value := range map[string]*string{
+		listenAddressSetting:                        &status.ListenAddress,
+		certificates.StandbyListeningAddressSetting: &status.StandbyListeningAddress,
+		primaryAddressSetting:                       &status.PrimaryAddress,
+	} {
+		stored, err := db.GetDrawbridgeConfigValueByName(setting)
+		if err != nil {
+			return nil, err
+		}
+		*value = *stored
+	}
+	lastApplied, err := db.GetDrawbridgeConfigValueByName(lastAppliedSetting)
+	if err != nil {
+		return nil, err
+	}
+	if *lastApplied != "" {
+		status.LastApplied, err = time.Parse(time.RFC3339, *lastApplied)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return status, nil
+}
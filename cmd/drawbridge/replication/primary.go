@@ -0,0 +1,168 @@
+package replication
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"imdawon/drawbridge/cmd/drawbridge/persistence"
+	certificates "imdawon/drawbridge/cmd/reverse_proxy/ca"
+	"imdawon/drawbridge/cmd/utils"
+	"io"
+	"log/slog"
+	"net"
+	"time"
+)
+
+const (
+	// How often the primary checks for changes to send to the standby.
+	pollInterval = time.Second
+	// How often the primary sends a heartbeat when nothing changed, so the standby notices a dead link.
+	heartbeatInterval = 10 * time.Second
+)
+
+// Streams changes to the paired standby.
+type Primary struct {
+	DB Database
+	CA *certificates.CA
+	// The host and port the replication listener binds, e.g. 0.0.0.0:3200.
+	ListenAddress          string
+	standbyCertificateHash string
+	caPath                 string
+}
+
+// Returns the primary set up by `drawbridge replication pair`.
+func NewPrimary(db Database, ca *certificates.CA) (*Primary, error) {
+	listenAddress, err := db.GetDrawbridgeConfigValueByName(listenAddressSetting)
+	if err != nil {
+		return nil, err
+	}
+	standbyCertificateHash, err := db.GetDrawbridgeConfigValueByName(standbyCertificateSetting)
+	if err != nil {
+		return nil, err
+	}
+	if *listenAddress == "" || *standbyCertificateHash == "" {
+		return nil, fmt.Errorf("no standby has been paired, run `drawbridge replication pair`")
+	}
+	return &Primary{
+		DB:                     db,
+		CA:                     ca,
+		ListenAddress:          *listenAddress,
+		standbyCertificateHash: *standbyCertificateHash,
+		caPath:                 utils.CreateDrawbridgeFilePath("ca"),
+	}, nil
+}
+
+// Accepts connections from the paired standby until the listener fails.
+func (p *Primary) ListenAndServe() error {
+	listener, err := net.Listen("tcp", p.ListenAddress)
+	if err != nil {
+		return fmt.Errorf("error starting replication listener: %w", err)
+	}
+	defer listener.Close()
+	slog.Info("Replication", slog.String("Waiting for the standby Drawbridge on", p.ListenAddress))
+	tlsConfig := p.CA.PeerTLSConfig(p.verifyStandby)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return fmt.Errorf("replication listener stopped: %w", err)
+		}
+		go func(conn net.Conn) {
+			defer conn.Close()
+			slog.Info("Replication", slog.String("Standby connected from", conn.RemoteAddr().String()))
+			err := p.Stream(tls.Server(conn, tlsConfig))
+			slog.Warn("Replication", slog.String("Standby disconnected", conn.RemoteAddr().String()), slog.Any("error", err))
+		}(conn)
+	}
+}
+
+// Only the certificate issued by `drawbridge replication pair` is accepted, not the Emissary device certificates
+// issued by the same certificate authority.
+func (p *Primary) verifyStandby(certificate *x509.Certificate) error {
+	certificatePEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate.Raw})
+	if certificates.HashEmissaryCertificate(certificatePEM) != p.standbyCertificateHash {
+		return errors.New("the certificate doesn't belong to the paired standby")
+	}
+	return nil
+}
+
+// Sends the standby everything it needs, then every change, until the connection fails.
+func (p *Primary) Stream(conn io.ReadWriter) error {
+	schemaVersion, err := p.DB.SchemaVersion()
+	if err != nil {
+		return err
+	}
+
+	acks := make(chan error, 1)
+	go func() {
+		decoder := json.NewDecoder(bufio.NewReader(conn))
+		for {
+			var received ack
+			err := decoder.Decode(&received)
+			if err != nil {
+				acks <- err
+				return
+			}
+			if received.Error != "" {
+				slog.Error("Replication", slog.Uint64("Standby failed to apply update", received.Sequence), slog.String("error", received.Error))
+				continue
+			}
+			slog.Debug("Replication", slog.Uint64("Standby applied update", received.Sequence))
+		}
+	}()
+
+	encoder := json.NewEncoder(conn)
+	tableChecksums := make(map[string]string)
+	caChecksum := ""
+	lastSent := time.Time{}
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for sequence := uint64(1); ; {
+		next := &update{Sequence: sequence, SchemaVersion: schemaVersion}
+		for _, table := range persistence.ReplicatedTables {
+			dump, err := p.DB.DumpTable(table)
+			if err != nil {
+				return err
+			}
+			dumpJSON, err := json.Marshal(dump)
+			if err != nil {
+				return err
+			}
+			if tableChecksums[table.Name] != checksum(dumpJSON) {
+				tableChecksums[table.Name] = checksum(dumpJSON)
+				next.Tables = append(next.Tables, *dump)
+			}
+		}
+		caFiles, err := readCertificateAuthorityFiles(p.caPath)
+		if err != nil {
+			return err
+		}
+		caJSON, err := json.Marshal(caFiles)
+		if err != nil {
+			return err
+		}
+		if caChecksum != checksum(caJSON) {
+			caChecksum = checksum(caJSON)
+			next.CertificateAuthority = caFiles
+		}
+
+		if !next.empty() || time.Since(lastSent) >= heartbeatInterval {
+			err = encoder.Encode(next)
+			if err != nil {
+				return err
+			}
+			lastSent = time.Now()
+			sequence++
+		}
+
+		select {
+		case <-ticker.C:
+		case err := <-acks:
+			return err
+		}
+	}
+}
@@ -0,0 +1,160 @@
+// Package replication keeps a standby Drawbridge in sync with the primary, so the standby can take over when the
+// primary goes down.
+//
+// The primary listens for its paired standby on an mTLS link secured by the Drawbridge certificate authority. Once the
+// standby connects, the primary sends it every replicated table (see persistence.ReplicatedTables) and the files in the
+// ca folder, then polls for changes and sends each table or certificate authority change as it happens. The standby
+// applies every update in a single transaction and acknowledges it. A standby stays passive: it serves the Drawbridge
+// Dashboard but doesn't accept Emissary connections until it is promoted with `drawbridge replication promote`.
+//
+// Pairing is done with `drawbridge replication pair` on the primary, which issues a certificate for the standby and
+// writes it to a pairing file, and `drawbridge replication join` on the standby. Server certificates are issued for
+// both listening addresses, and Emissary Bundles list both, so Emissary clients can fail over to the standby.
+package replication
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"imdawon/drawbridge/cmd/drawbridge/persistence"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// drawbridge_config settings describing this server's part in replication. They are never replicated.
+const (
+	roleSetting = "replication_role"
+	// On the primary, the host and port the replication listener binds.
+	listenAddressSetting = "replication_listen_address"
+	// On the primary, the hash of the certificate issued to the paired standby. No other certificate is accepted.
+	standbyCertificateSetting = "replication_standby_certificate"
+	// On the standby, the host and port of the primary's replication listener.
+	primaryAddressSetting = "replication_primary_address"
+	// On the standby, when it last applied an update from the primary.
+	lastAppliedSetting = "replication_last_applied"
+)
+
+type Role string
+
+const (
+	// A Drawbridge that doesn't replicate.
+	RoleStandalone Role = ""
+	RolePrimary    Role = "primary"
+	RoleStandby    Role = "standby"
+)
+
+// Where the standby keeps the certificate and key it connects to the primary with, relative to the Drawbridge binary.
+const standbyDirectory = "replication"
+
+// The default port of the replication listener.
+const DefaultPort = 3200
+
+// The database replicated from or to. Only SQLiteRepository can be replicated.
+type Database interface {
+	persistence.ConfigRepository
+	SchemaVersion() (int, error)
+	DumpTable(table persistence.ReplicatedTable) (*persistence.TableDump, error)
+	ReplaceReplicatedTables(dumps []persistence.TableDump) error
+}
+
+// Returns this server's part in replication.
+func GetRole(db persistence.ConfigRepository) (Role, error) {
+	role, err := db.GetDrawbridgeConfigValueByName(roleSetting)
+	if err != nil {
+		return RoleStandalone, err
+	}
+	if role == nil {
+		return RoleStandalone, nil
+	}
+	return Role(*role), nil
+}
+
+// Sent by the primary. The first update on a connection holds every replicated table and the certificate authority
+// files, later ones only what changed since. Updates holding neither are heartbeats.
+type update struct {
+	Sequence      uint64                  `json:"sequence"`
+	SchemaVersion int                     `json:"schema_version"`
+	Tables        []persistence.TableDump `json:"tables,omitempty"`
+	// Every file in the ca folder, keyed by its slash-separated path in the folder. Nil when none of them changed.
+	CertificateAuthority map[string][]byte `json:"certificate_authority,omitempty"`
+}
+
+func (u *update) empty() bool {
+	return len(u.Tables) == 0 && u.CertificateAuthority == nil
+}
+
+// Sent by the standby once it has applied an update, or failed to.
+type ack struct {
+	Sequence uint64 `json:"sequence"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Reads every file in the ca folder at caPath. A missing folder has no files.
+func readCertificateAuthorityFiles(caPath string) (map[string][]byte, error) {
+	files := make(map[string][]byte)
+	err := filepath.WalkDir(caPath, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		relativePath, err := filepath.Rel(caPath, filePath)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(relativePath)], err = os.ReadFile(filePath)
+		return err
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("error reading the certificate authority files: %w", err)
+	}
+	return files, nil
+}
+
+// Makes the ca folder at caPath hold exactly files, e.g. removing the previous certificate authority once a rotation
+// has finished on the primary.
+func writeCertificateAuthorityFiles(caPath string, files map[string][]byte) error {
+	for name, contents := range files {
+		if !filepath.IsLocal(filepath.FromSlash(name)) {
+			return fmt.Errorf("the primary sent an unexpected certificate authority file %s", name)
+		}
+		filePath := filepath.Join(caPath, filepath.FromSlash(name))
+		err := os.MkdirAll(filepath.Dir(filePath), 0700)
+		if err != nil {
+			return err
+		}
+		var perm os.FileMode = 0644
+		if filepath.Ext(name) == ".key" {
+			perm = 0600
+		}
+		// Written next to the file and renamed into place, so a crash never leaves a truncated key behind.
+		temporaryPath := filePath + ".replicating"
+		err = os.WriteFile(temporaryPath, contents, perm)
+		if err == nil {
+			err = os.Rename(temporaryPath, filePath)
+		}
+		if err != nil {
+			os.Remove(temporaryPath)
+			return err
+		}
+	}
+
+	existing, err := readCertificateAuthorityFiles(caPath)
+	if err != nil {
+		return err
+	}
+	for name := range existing {
+		if _, ok := files[name]; !ok {
+			err = os.Remove(filepath.Join(caPath, filepath.FromSlash(name)))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func checksum(contents []byte) string {
+	hash := sha256.Sum256(contents)
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,166 @@
+package replication
+
+import (
+	"imdawon/drawbridge/cmd/drawbridge/emissary"
+	"imdawon/drawbridge/cmd/drawbridge/network"
+	"imdawon/drawbridge/cmd/drawbridge/persistence"
+	"imdawon/drawbridge/cmd/drawbridge/services"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestDatabase(t *testing.T) *persistence.SQLiteRepository {
+	db := persistence.NewSQLiteRepository(persistence.OpenDatabaseFile(filepath.Join(t.TempDir(), "drawbridge.db")))
+	t.Cleanup(func() { db.Close() })
+	_, err := db.Migrate()
+	if err != nil {
+		t.Fatalf("Migrate failed: %v", err)
+	}
+	return db
+}
+
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestStandbyFollowsPrimary(t *testing.T) {
+	primaryDB, standbyDB := newTestDatabase(t), newTestDatabase(t)
+	primaryCA, standbyCA := t.TempDir(), t.TempDir()
+
+	primaryDB.CreateNewService(services.ProtectedService{Name: "SSH", Host: "10.0.0.2", Port: 22})
+	primaryDB.CreateNewEmissaryClient(emissary.EmissaryClient{ID: "device-1", Name: "Brave Otter", DrawbridgeCertificate: "cert-1"})
+	bannedAt := time.Now().UTC().Truncate(time.Second)
+	primaryDB.SaveIPBan(network.Ban{IP: "203.0.113.7", Reason: "10 connection failures", Offenses: 2, BannedAt: bannedAt, ExpiresAt: bannedAt.Add(time.Hour)})
+	primaryDB.CreateNewDrawbridgeConfigSettings("listening_address", "10.0.0.1")
+	primaryDB.CreateNewDrawbridgeConfigSettings("dau_ping_enabled", "true")
+	primaryDB.CreateNewDrawbridgeConfigSettings(listenAddressSetting, "0.0.0.0:3200")
+	os.WriteFile(filepath.Join(primaryCA, "ca.crt"), []byte("root certificate"), 0644)
+	os.WriteFile(filepath.Join(primaryCA, "ca.key"), []byte("root key"), 0600)
+	// The standby's own settings and leftovers from before it joined.
+	standbyDB.CreateNewDrawbridgeConfigSettings("listening_address", "10.0.0.9")
+	standbyDB.CreateNewDrawbridgeConfigSettings(roleSetting, string(RoleStandby))
+	standbyDB.CreateNewService(services.ProtectedService{Name: "Stale", Host: "10.0.0.3", Port: 80})
+	os.WriteFile(filepath.Join(standbyCA, "stale.crt"), []byte("stale"), 0644)
+
+	primaryConn, standbyConn := net.Pipe()
+	defer primaryConn.Close()
+	defer standbyConn.Close()
+	primary := &Primary{DB: primaryDB, caPath: primaryCA}
+	standby := &Standby{DB: standbyDB, caPath: standbyCA}
+	go primary.Stream(primaryConn)
+	go standby.Follow(standbyConn)
+
+	waitFor(t, "the initial sync", func() bool {
+		device, _ := standbyDB.GetEmissaryClientById("device-1")
+		return device.Name == "Brave Otter"
+	})
+	all, _ := standbyDB.GetAllServices()
+	if len(all) != 1 || all[0].ID != 1 || all[0].Name != "SSH" || all[0].Port != 22 {
+		t.Errorf("expected the standby to hold the primary's services with their ids, got %+v", all)
+	}
+	for setting, want := range map[string]string{
+		"dau_ping_enabled":   "true",
+		"listening_address":  "10.0.0.9",
+		roleSetting:          string(RoleStandby),
+		listenAddressSetting: "",
+	} {
+		if value, _ := standbyDB.GetDrawbridgeConfigValueByName(setting); *value != want {
+			t.Errorf("expected %s to be %q on the standby, got %q", setting, want, *value)
+		}
+	}
+	// A promoted standby keeps refusing the IPs the primary banned, and bans them for longer when they come back.
+	ban, _ := standbyDB.GetIPBan("203.0.113.7")
+	if !ban.Active(bannedAt) || ban.Offenses != 2 || !ban.ExpiresAt.Equal(bannedAt.Add(time.Hour)) {
+		t.Errorf("expected the standby to hold the primary's IP bans, got %+v", ban)
+	}
+	caFiles, _ := readCertificateAuthorityFiles(standbyCA)
+	if len(caFiles) != 2 || string(caFiles["ca.key"]) != "root key" {
+		t.Errorf("expected the standby to hold exactly the primary's ca files, got %v", caFiles)
+	}
+	if info, err := os.Stat(filepath.Join(standbyCA, "ca.key")); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("expected the replicated key to be private, got %v", info.Mode())
+	}
+
+	// Changes on the primary follow.
+	primaryDB.RevokeEmissaryClient("device-1")
+	primaryDB.DeleteService(1)
+	primaryDB.DeleteIPBan("203.0.113.7")
+	os.Remove(filepath.Join(primaryCA, "ca.key"))
+	waitFor(t, "the revocation", func() bool {
+		device, _ := standbyDB.GetEmissaryClientById("device-1")
+		return device.Revoked == 1
+	})
+	waitFor(t, "the deleted service, ban and key", func() bool {
+		all, _ := standbyDB.GetAllServices()
+		caFiles, _ := readCertificateAuthorityFiles(standbyCA)
+		ban, _ := standbyDB.GetIPBan("203.0.113.7")
+		return len(all) == 0 && len(caFiles) == 1 && ban.IP == ""
+	})
+	status, err := GetStatus(standbyDB)
+	if err != nil || status.LastApplied.IsZero() {
+		t.Errorf("expected the standby to record when it last applied an update, got %+v, %v", status, err)
+	}
+}
+
+func TestStandbyRefusesOtherSchemaVersions(t *testing.T) {
+	standby := &Standby{DB: newTestDatabase(t), caPath: t.TempDir()}
+	primaryConn, standbyConn := net.Pipe()
+	defer primaryConn.Close()
+	errs := make(chan error, 1)
+	go func() { errs <- standby.Follow(standbyConn) }()
+	primaryConn.Write([]byte(`{"sequence": 1, "schema_version": 999, "tables": [{"table": "services", "columns": [], "rows": []}]}` + "\n"))
+	if err := <-errs; err == nil {
+		t.Error("expected a primary at another schema version to be refused")
+	}
+}
+
+func TestReplicatedTablesOnly(t *testing.T) {
+	db := newTestDatabase(t)
+	err := db.ReplaceReplicatedTables([]persistence.TableDump{{Table: "schema_version", Columns: []string{"version"}, Rows: [][]any{{1}}}})
+	if err == nil {
+		t.Error("expected a table that isn't replicated to be refused")
+	}
+}
+
+func TestWriteCertificateAuthorityFilesStaysInFolder(t *testing.T) {
+	err := writeCertificateAuthorityFiles(t.TempDir(), map[string][]byte{"../escaped.crt": []byte("x")})
+	if err == nil {
+		t.Error("expected a file outside the ca folder to be refused")
+	}
+}
+
+func TestPromote(t *testing.T) {
+	db := newTestDatabase(t)
+	if err := Promote(db); err == nil {
+		t.Error("expected promoting a Drawbridge that isn't a standby to fail")
+	}
+	err := Join(db, &Pairing{PrimaryAddress: "10.0.0.1:3200", ListeningAddress: "10.0.0.9", Certificate: "cert", Key: "key"}, false)
+	if err != nil {
+		t.Fatalf("Join failed: %v", err)
+	}
+	if role, _ := GetRole(db); role != RoleStandby {
+		t.Errorf("expected the standby role after joining, got %q", role)
+	}
+	if err := Join(db, &Pairing{PrimaryAddress: "10.0.0.1:3200", ListeningAddress: "10.0.0.9", Certificate: "cert", Key: "key"}, false); err == nil {
+		t.Error("expected joining again without force to fail")
+	}
+	if err := Promote(db); err != nil {
+		t.Fatalf("Promote failed: %v", err)
+	}
+	if role, _ := GetRole(db); role != RoleStandalone {
+		t.Errorf("expected no replication role after promoting, got %q", role)
+	}
+	if address, _ := db.GetDrawbridgeConfigValueByName("listening_address"); *address != "10.0.0.9" {
+		t.Errorf("expected the promoted standby to keep its own listening address, got %q", *address)
+	}
+}
@@ -0,0 +1,195 @@
+package replication
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"imdawon/drawbridge/cmd/utils"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// The standby reconnects when it hasn't heard from the primary for this long.
+	readTimeout = 3 * heartbeatInterval
+	// How often the standby checks whether it has been promoted.
+	promotionCheckInterval = 2 * time.Second
+	maxReconnectDelay      = time.Minute
+)
+
+// Follows the primary, applying its changes, until it is promoted.
+type Standby struct {
+	DB Database
+	// The host and port of the primary's replication listener.
+	PrimaryAddress string
+	caPath         string
+}
+
+// Returns the standby set up by `drawbridge replication join`.
+func NewStandby(db Database) (*Standby, error) {
+	primaryAddress, err := db.GetDrawbridgeConfigValueByName(primaryAddressSetting)
+	if err != nil {
+		return nil, err
+	}
+	if *primaryAddress == "" {
+		return nil, fmt.Errorf("this Drawbridge hasn't joined a primary, run `drawbridge replication join`")
+	}
+	return &Standby{
+		DB:             db,
+		PrimaryAddress: *primaryAddress,
+		caPath:         utils.CreateDrawbridgeFilePath("ca"),
+	}, nil
+}
+
+// Follows the primary, reconnecting whenever the link drops, and returns once `drawbridge replication promote`
+// has been run.
+func (s *Standby) Run() {
+	ctx, promoted := context.WithCancel(context.Background())
+	go func() {
+		ticker := time.NewTicker(promotionCheckInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			role, err := GetRole(s.DB)
+			if err != nil {
+				slog.Error("Replication", slog.Any("Error reading replication role", err))
+				continue
+			}
+			if role != RoleStandby {
+				promoted()
+				return
+			}
+		}
+	}()
+
+	delay := time.Second
+	for ctx.Err() == nil {
+		err := s.follow(ctx)
+		if ctx.Err() != nil {
+			break
+		}
+		slog.Warn("Replication", slog.String("Lost the primary Drawbridge at", s.PrimaryAddress), slog.Any("error", err), slog.Duration("retrying in", delay))
+		select {
+		case <-ctx.Done():
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, maxReconnectDelay)
+	}
+	slog.Info("Replication", slog.String("Promoted", "this Drawbridge is no longer following the primary"))
+}
+
+func (s *Standby) follow(ctx context.Context) error {
+	tlsConfig, err := s.tlsConfig()
+	if err != nil {
+		return err
+	}
+	dialer := &tls.Dialer{Config: tlsConfig}
+	conn, err := dialer.DialContext(ctx, "tcp", s.PrimaryAddress)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	slog.Info("Replication", slog.String("Following the primary Drawbridge at", s.PrimaryAddress))
+	return s.Follow(&deadlineConn{Conn: conn})
+}
+
+// Applies updates from the primary and acknowledges them until the connection fails.
+func (s *Standby) Follow(conn io.ReadWriter) error {
+	schemaVersion, err := s.DB.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bufio.NewReader(conn))
+	decoder.UseNumber()
+	encoder := json.NewEncoder(conn)
+	for {
+		var received update
+		err := decoder.Decode(&received)
+		if err != nil {
+			return err
+		}
+		if received.SchemaVersion != schemaVersion {
+			return fmt.Errorf("the primary is at schema version %d and this Drawbridge at %d, run the same Drawbridge version on both", received.SchemaVersion, schemaVersion)
+		}
+		if received.empty() {
+			continue
+		}
+
+		reply := ack{Sequence: received.Sequence}
+		err = s.apply(&received)
+		if err != nil {
+			slog.Error("Replication", slog.Uint64("Error applying update", received.Sequence), slog.Any("error", err))
+			reply.Error = err.Error()
+		}
+		err = encoder.Encode(reply)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (s *Standby) apply(received *update) error {
+	if received.CertificateAuthority != nil {
+		err := writeCertificateAuthorityFiles(s.caPath, received.CertificateAuthority)
+		if err != nil {
+			return err
+		}
+	}
+	if len(received.Tables) > 0 {
+		err := s.DB.ReplaceReplicatedTables(received.Tables)
+		if err != nil {
+			return err
+		}
+	}
+	slog.Debug("Replication", slog.Uint64("Applied update", received.Sequence), slog.Int("tables", len(received.Tables)))
+	return s.DB.CreateNewDrawbridgeConfigSettings(lastAppliedSetting, time.Now().UTC().Format(time.RFC3339))
+}
+
+// The standby trusts the certificate authority it was paired with, and the one replicated from the primary since,
+// so it keeps following the primary after a certificate authority rotation.
+func (s *Standby) tlsConfig() (*tls.Config, error) {
+	certificate, err := tls.LoadX509KeyPair(utils.CreateDrawbridgeFilePath(filepath.Join(standbyDirectory, standbyCertificateFile)), utils.CreateDrawbridgeFilePath(filepath.Join(standbyDirectory, standbyKeyFile)))
+	if err != nil {
+		return nil, fmt.Errorf("error loading the standby certificate: %w", err)
+	}
+	roots := x509.NewCertPool()
+	for _, path := range []string{utils.CreateDrawbridgeFilePath(filepath.Join(standbyDirectory, primaryCertificateAuthorityFile)), filepath.Join(s.caPath, "ca.crt")} {
+		contents, err := os.ReadFile(path)
+		if err == nil {
+			roots.AppendCertsFromPEM(contents)
+		}
+	}
+	host, _, err := net.SplitHostPort(s.PrimaryAddress)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		RootCAs:      roots,
+		ServerName:   host,
+		MinVersion:   tls.VersionTLS13,
+	}, nil
+}
+
+// Pushes the read deadline back before every read, so a primary that stopped sending heartbeats is noticed.
+type deadlineConn struct {
+	net.Conn
+}
+
+func (c *deadlineConn) Read(b []byte) (int, error) {
+	err := c.Conn.SetReadDeadline(time.Now().Add(readTimeout))
+	if err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
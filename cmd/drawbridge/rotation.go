@@ -0,0 +1,123 @@
+package drawbridge
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	certificates "imdawon/drawbridge/cmd/reverse_proxy/ca"
+	"log/slog"
+	"net"
+	"time"
+)
+
+// Sent to an Emissary client in response to a CA_ROTN request while a certificate authority rotation is in progress.
+// The Emissary client replaces its certificate, key, and pinned certificate authority with these values.
+type CertificateAuthorityRotationBundle struct {
+	CertificateAuthority string    `json:"ca"`
+	Certificate          string    `json:"certificate"`
+	Key                  string    `json:"key"`
+	Deadline             time.Time `json:"deadline"`
+}
+
+// Handles a CA_ROTN request from an Emissary client.
+// If a certificate authority rotation is in progress and the device still uses a certificate from the previous
+// certificate authority, we issue the device a new certificate and send it back along with the new certificate authority.
+// Otherwise we reply with an empty CA_ROTN response so the Emissary client knows there is nothing to do.
+func (d *Drawbridge) handleCertificateAuthorityRotation(emissaryConn net.Conn, deviceID string, presentedCert *x509.Certificate) {
+	response, _ := d.certificateAuthorityRotationResponse(deviceID, presentedCert)
+	emissaryConn.Write([]byte(response))
+}
+
+// Pushes the device its rotation bundle when it connects with a certificate from the previous certificate authority,
+// so it migrates without waiting for its next CA_ROTN. Written after the response to the device's request, which
+// Emissary clients that don't know about rotation read on their own.
+func (d *Drawbridge) pushCertificateAuthorityRotation(emissaryConn net.Conn, deviceID string, presentedCert *x509.Certificate) {
+	response, pending := d.certificateAuthorityRotationResponse(deviceID, presentedCert)
+	if pending {
+		emissaryConn.Write([]byte(response))
+	}
+}
+
+// Returns the CA_ROTN response for the device, and whether it carries a rotation bundle.
+func (d *Drawbridge) certificateAuthorityRotationResponse(deviceID string, presentedCert *x509.Certificate) (string, bool) {
+	rotation := d.CA.CurrentRotation()
+	presentedPEM := pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: presentedCert.Raw,
+	})
+	if rotation == nil || d.CA.IssuedByCurrentCertificateAuthority(string(presentedPEM)) {
+		return "CA_ROTN: \n", false
+	}
+
+	bundle, err := d.reissueEmissaryCertificate(deviceID, presentedPEM, rotation.Deadline)
+	if err != nil {
+		slog.Error("Certificate Authority Rotation", slog.String("device", deviceID), slog.Any("Error reissuing device certificate", err))
+		return "CA_ROTN: \n", false
+	}
+
+	bundleJSON, err := json.Marshal(bundle)
+	if err != nil {
+		slog.Error("Certificate Authority Rotation", slog.Any("Error encoding rotation bundle", err))
+		return "CA_ROTN: \n", false
+	}
+	slog.Info("Certificate Authority Rotation", slog.String("Issued new certificate to device", deviceID))
+	// The newline character is important for other platforms, such as Android,
+	// to properly read the string from the socket without blocking.
+	return fmt.Sprintf("CA_ROTN: %s\n", base64.StdEncoding.EncodeToString(bundleJSON)), true
+}
+
+// Issues a device a certificate from the current certificate authority. The certificate the device presented
+// stays valid until the rotation deadline in case the device fails to save its new certificate.
+func (d *Drawbridge) reissueEmissaryCertificate(deviceID string, presentedPEM []byte, deadline time.Time) (*CertificateAuthorityRotationBundle, error) {
+	listeningAddress, err := d.DB.GetDrawbridgeConfigValueByName("listening_address")
+	if err != nil {
+		return nil, err
+	}
+
+	// Keep the kind of key the device already uses, as its Emissary client is known to support it.
+	keyAlgorithm := certificates.DefaultKeyAlgorithm
+	if block, _ := pem.Decode(presentedPEM); block != nil {
+		presentedCert, err := x509.ParseCertificate(block.Bytes)
+		if err == nil {
+			keyAlgorithm = certificates.KeyAlgorithmOf(presentedCert.PublicKey)
+		}
+	}
+	certPEM, privateKey, err := d.CA.IssueEmissaryCertificate(deviceID, *listeningAddress, keyAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+	// We don't know which platform the device runs on, so use PKCS8 which every Emissary client can read.
+	keyBytes, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{
+		Type:  "PRIVATE KEY",
+		Bytes: keyBytes,
+	})
+
+	presentedHash := certificates.HashEmissaryCertificate(presentedPEM)
+	deviceCert, exists := d.CA.GetCertificateFromCertificateList(presentedHash)
+	if !exists {
+		return nil, fmt.Errorf("device presented a certificate that does not exist in our system")
+	}
+
+	err = d.DB.SupersedeEmissaryClientCertificate(deviceID, presentedHash, string(certPEM), deadline)
+	if err != nil {
+		return nil, err
+	}
+	d.CA.SetEmissaryCertificateToCertificateList(certPEM, deviceCert)
+
+	return &CertificateAuthorityRotationBundle{
+		CertificateAuthority: string(pem.EncodeToMemory(&pem.Block{
+			Type:  "CERTIFICATE",
+			Bytes: d.CA.CurrentCertificateAuthority().Raw,
+		})),
+		// Include the intermediate certificate authority so the Emissary client presents the full chain.
+		Certificate: string(certPEM) + string(d.CA.CertificateChainPEM()),
+		Key:         string(keyPEM),
+		Deadline:    deadline,
+	}, nil
+}
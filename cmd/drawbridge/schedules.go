@@ -0,0 +1,157 @@
+package drawbridge
+
+import (
+	"fmt"
+	"imdawon/drawbridge/cmd/drawbridge/emissary/authorization"
+	"log/slog"
+	"time"
+)
+
+// How often live sessions are checked against their schedules, so how long a session can outlast its window.
+const scheduleEnforcementInterval = 30 * time.Second
+
+// Validates a schedule and stores it, replacing the stored schedule with the same id if it has one.
+func (d *Drawbridge) SaveSchedule(schedule authorization.Schedule) (*authorization.Schedule, error) {
+	err := schedule.Validate()
+	if err != nil {
+		return nil, err
+	}
+	if schedule.ID == 0 {
+		return d.DB.CreateNewSchedule(schedule)
+	}
+	err = d.DB.UpdateSchedule(&schedule, schedule.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &schedule, nil
+}
+
+// Returns why the schedule doesn't allow connections at now, or an empty string if it does.
+// A schedule that can't be looked up denies the connection.
+func (d *Drawbridge) scheduleDenial(scheduleID int64, now time.Time) string {
+	step := d.scheduleStep(scheduleID, now)
+	if step.Passed {
+		return ""
+	}
+	return step.Detail
+}
+
+// Checks whether the schedule allows connections at now, for the trace of an authorization decision.
+func (d *Drawbridge) scheduleStep(scheduleID int64, now time.Time) authorization.TraceStep {
+	schedule, err := d.DB.GetScheduleById(scheduleID)
+	if err != nil {
+		slog.Error("Authorization", slog.Any("Error getting schedule", err))
+		return authorization.TraceStep{Check: fmt.Sprintf("schedule id %d", scheduleID), Detail: "error getting the schedule"}
+	}
+	if schedule.ID == 0 {
+		return authorization.TraceStep{Check: fmt.Sprintf("schedule id %d", scheduleID), Detail: fmt.Sprintf("schedule id %d no longer exists", scheduleID)}
+	}
+	step := authorization.TraceStep{Check: fmt.Sprintf("schedule %q", schedule.Name), Passed: schedule.Open(now)}
+	if !step.Passed {
+		step.Detail = schedule.ClosedReason(now)
+	}
+	return step
+}
+
+// Ends live sessions whose schedule has closed, or whose just-in-time access request has expired, in the background
+// every scheduleEnforcementInterval.
+func (d *Drawbridge) StartScheduleEnforcement() {
+	go func() {
+		for {
+			time.Sleep(scheduleEnforcementInterval)
+			d.EnforceSchedules(time.Now())
+			d.ExpireJITRequests(time.Now())
+		}
+	}()
+}
+
+// Ends the live sessions to Protected Services whose schedule, or whose policy's schedule, is closed at now and
+// set to end sessions. Sessions let in by a grant end when every grant the device is let in by is closed, and one
+// of them is set to end sessions. Returns how many sessions were ended.
+func (d *Drawbridge) EnforceSchedules(now time.Time) int {
+	schedules, err := d.DB.GetAllSchedules()
+	if err != nil {
+		slog.Error("Schedule Enforcement", slog.Any("Error getting schedules", err))
+		return 0
+	}
+	// Why each schedule that ends sessions is closed.
+	closed := make(map[int64]string)
+	for _, schedule := range schedules {
+		if schedule.EndSessions && !schedule.Open(now) {
+			closed[schedule.ID] = schedule.ClosedReason(now)
+		}
+	}
+	if len(closed) == 0 {
+		return 0
+	}
+	allServices, err := d.DB.GetAllServices()
+	if err != nil {
+		slog.Error("Schedule Enforcement", slog.Any("Error getting Protected Services", err))
+		return 0
+	}
+	policies, err := d.DB.GetAllPolicies()
+	if err != nil {
+		slog.Error("Schedule Enforcement", slog.Any("Error getting policies", err))
+		return 0
+	}
+	policySchedules := make(map[int64]int64, len(policies))
+	for _, policy := range policies {
+		policySchedules[policy.ID] = policy.ScheduleID
+	}
+
+	ended := 0
+	for _, service := range allServices {
+		reason, found := closed[service.ScheduleID]
+		if !found {
+			reason, found = closed[policySchedules[service.ClientPolicyID]]
+		}
+		if !found {
+			continue
+		}
+		ended += d.TerminateSessions(func(session Session) bool { return session.ServiceID == service.ID }, reason)
+	}
+	return ended + d.enforceGrantSchedules(now, closed)
+}
+
+// Ends the live sessions whose device is only let in by grants that are closed, where at least one of them is closed
+// by a schedule in closed.
+func (d *Drawbridge) enforceGrantSchedules(now time.Time, closed map[int64]string) int {
+	grants, err := d.DB.GetAllGrants()
+	if err != nil {
+		slog.Error("Schedule Enforcement", slog.Any("Error getting grants", err))
+		return 0
+	}
+	serviceGrants := make(map[int64][]authorization.Grant)
+	for _, grant := range grants {
+		serviceGrants[grant.ServiceID] = append(serviceGrants[grant.ServiceID], grant)
+	}
+	ended := 0
+	for _, session := range d.Sessions() {
+		grants := serviceGrants[session.ServiceID]
+		if len(grants) == 0 {
+			continue
+		}
+		device, err := d.DB.GetEmissaryClientById(session.DeviceID)
+		if err != nil {
+			slog.Error("Schedule Enforcement", slog.Any("Error getting device", err))
+			continue
+		}
+		var reason string
+		open := false
+		for _, grant := range grants {
+			if !device.InAnyGroup(grant.Group) {
+				continue
+			}
+			if closedReason, found := closed[grant.ScheduleID]; found {
+				reason = fmt.Sprintf("grant to %s: %s", grant.Group, closedReason)
+			} else if grant.ScheduleID == 0 || d.scheduleDenial(grant.ScheduleID, now) == "" {
+				open = true
+			}
+		}
+		if open || reason == "" {
+			continue
+		}
+		ended += d.TerminateSessions(func(live Session) bool { return live.ID == session.ID }, reason)
+	}
+	return ended
+}
@@ -0,0 +1,109 @@
+package drawbridge
+
+import (
+	"imdawon/drawbridge/cmd/drawbridge/emissary"
+	"imdawon/drawbridge/cmd/drawbridge/emissary/authorization"
+	"imdawon/drawbridge/cmd/drawbridge/persistence"
+	"imdawon/drawbridge/cmd/drawbridge/services"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	alwaysOpen = []authorization.Window{{Days: []string{"sunday", "monday", "tuesday", "wednesday", "thursday", "friday", "saturday"}, Start: "00:00", End: "24:00"}}
+	// Only open on a date long gone.
+	neverOpen = []authorization.Exception{{Date: "2000-01-01", Open: true}}
+)
+
+func TestScheduledAccess(t *testing.T) {
+	db := persistence.NewMemoryRepository()
+	d := &Drawbridge{DB: db}
+	db.CreateNewEmissaryClient(emissary.EmissaryClient{ID: "device-1", Name: "Brave Otter", DrawbridgeCertificate: "cert-1"})
+	open, err := d.SaveSchedule(authorization.Schedule{Name: "Always", Timezone: "UTC", Windows: alwaysOpen})
+	if err != nil {
+		t.Fatalf("SaveSchedule failed: %v", err)
+	}
+	closed, err := d.SaveSchedule(authorization.Schedule{Name: "Never", Timezone: "UTC", Exceptions: neverOpen})
+	if err != nil {
+		t.Fatalf("SaveSchedule failed: %v", err)
+	}
+	if _, err := d.SaveSchedule(authorization.Schedule{Name: "Nowhere", Timezone: "Mars/Olympus_Mons", Windows: alwaysOpen}); err == nil {
+		t.Error("expected SaveSchedule to refuse an invalid schedule")
+	}
+	everyone, _ := d.SavePolicy(authorization.Policy{Name: "Everyone", ScheduleID: closed.ID, Rules: authorization.Group{Match: authorization.MatchAll, Conditions: []authorization.Condition{
+		{Expression: "true"},
+	}}})
+
+	tests := []struct {
+		name    string
+		service services.ProtectedService
+		allowed bool
+		reason  string
+	}{
+		{"open schedule", services.ProtectedService{Name: "Minecraft", ScheduleID: open.ID}, true, ""},
+		{"closed schedule", services.ProtectedService{Name: "SSH", ScheduleID: closed.ID}, false, `schedule "Never" is closed at`},
+		{"missing schedule", services.ProtectedService{Name: "Gitea", ScheduleID: 999}, false, "schedule id 999 no longer exists"},
+		{"closed policy schedule", services.ProtectedService{Name: "Jellyfin", ScheduleID: open.ID, ClientPolicyID: everyone.ID}, false, `policy "Everyone": schedule "Never"`},
+	}
+	for _, test := range tests {
+		service, _ := db.CreateNewService(test.service)
+		decision := d.AuthorizeProtectedServiceConnection("device-1", "192.168.1.20:50000", service.ID)
+		if decision.Allowed != test.allowed || !strings.Contains(decision.Reason, test.reason) {
+			t.Errorf("%s: got %+v, wanted allowed %t with a reason containing %q", test.name, decision, test.allowed, test.reason)
+		}
+	}
+}
+
+func TestEnforceSchedules(t *testing.T) {
+	db := persistence.NewMemoryRepository()
+	d := &Drawbridge{DB: db}
+	evenings, err := d.SaveSchedule(authorization.Schedule{
+		Name:        "Evenings",
+		Timezone:    "UTC",
+		Windows:     []authorization.Window{{Days: []string{"monday"}, Start: "18:00", End: "22:00"}},
+		EndSessions: true,
+	})
+	if err != nil {
+		t.Fatalf("SaveSchedule failed: %v", err)
+	}
+	// Closes at the same time, but only refuses new connections.
+	lenient, _ := d.SaveSchedule(authorization.Schedule{Name: "Lenient", Timezone: "UTC", Windows: evenings.Windows})
+	policy, _ := d.SavePolicy(authorization.Policy{Name: "Evenings only", ScheduleID: evenings.ID, Rules: authorization.Group{Match: authorization.MatchAll, Conditions: []authorization.Condition{
+		{Expression: "true"},
+	}}})
+	scheduled, _ := db.CreateNewService(services.ProtectedService{Name: "SSH", ScheduleID: evenings.ID})
+	viaPolicy, _ := db.CreateNewService(services.ProtectedService{Name: "Gitea", ScheduleID: lenient.ID, ClientPolicyID: policy.ID})
+	unscheduled, _ := db.CreateNewService(services.ProtectedService{Name: "Minecraft", ScheduleID: lenient.ID})
+
+	conns := make(map[int64]net.Conn)
+	for i, service := range []*services.ProtectedService{scheduled, viaPolicy, unscheduled} {
+		emissaryConn, other := net.Pipe()
+		defer other.Close()
+		conns[service.ID] = other
+		event := emissary.Event{ID: string(rune('a' + i)), DeviceID: "device-1", ConnectionIP: "192.168.1.20:50000", Timestamp: time.Now()}
+		d.startSession(event, service.ID, emissaryConn)
+	}
+
+	monday := time.Date(2024, 12, 2, 21, 0, 0, 0, time.UTC)
+	if ended := d.EnforceSchedules(monday); ended != 0 {
+		t.Errorf("expected no sessions to end while the schedule is open, ended %d", ended)
+	}
+	if ended := d.EnforceSchedules(monday.Add(time.Hour)); ended != 2 {
+		t.Errorf("expected the sessions to the service and the policy with the closed schedule to end, ended %d", ended)
+	}
+	sessions := d.Sessions()
+	if len(sessions) != 1 || sessions[0].ServiceID != unscheduled.ID {
+		t.Fatalf("expected only the session under the lenient schedule to be left, got %+v", sessions)
+	}
+	// The other end of a closed pipe sees the session end.
+	if _, err := conns[scheduled.ID].Read(make([]byte, 1)); err == nil {
+		t.Error("expected the ended session's connection to be closed")
+	}
+
+	events, _ := db.QueryEmissaryClientEvents(emissary.EventQuery{Type: EventTypeTerminated})
+	if len(events.Events) != 2 || !strings.Contains(events.Events[0].Reason, `schedule "Evenings" is closed at Mon 22:00 UTC`) {
+		t.Errorf("expected a PS_TERM event with the reason for each ended session, got %+v", events.Events)
+	}
+}
@@ -1,25 +1,39 @@
 package services
 
-import "net"
+import (
+	"imdawon/drawbridge/cmd/drawbridge/network"
+	"net"
+)
 
 type RunningProtectedService struct {
 	Service ProtectedService
 }
 
 // A service that Drawbridge will protect by only allowing access from authorized machines running the Emissary client.
-// In the future, a Client Policy can be assigned to a Protected Service, allowing for different requirements for different Protected Services.
+// A Client Policy can be assigned to a Protected Service, allowing for different requirements for different Protected Services.
 //
 // Note that an Emissary client can be configured to "host" a Protected Service by creating
 // an outbound connection to Drawbridge, exposing the service it can access locally.
 // This can be useful in situations where you want to expose services in environments where you
 // can't control the settings of the network to host Drawbridge.
 type ProtectedService struct {
-	ID             int64
-	Name           string `schema:"service-name" json:"service-name"`
-	Description    string `schema:"service-description" json:"service-description"`
-	Host           string `schema:"service-host" json:"service-host"`
-	Port           uint16 `schema:"service-port" json:"service-port"`
-	ClientPolicyID int64  `schema:"service-policy-id,omitempty" json:"service-policy-id,omitempty"`
-	Conn           net.Conn
-	// AuthorizationPolicy  authorization.Policy `schema:"authorization-policy,omitempty" json:"authorization-policy,omitempty"`
+	ID          int64
+	Name        string `schema:"service-name" json:"service-name"`
+	Description string `schema:"service-description" json:"service-description"`
+	Host        string `schema:"service-host" json:"service-host"`
+	Port        uint16 `schema:"service-port" json:"service-port"`
+	// The authorization policy devices must pass to connect, or 0 for none.
+	ClientPolicyID int64 `schema:"service-policy-id,omitempty" json:"service-policy-id,omitempty"`
+	// The schedule devices may connect during, or 0 for any time.
+	ScheduleID int64 `schema:"service-schedule-id,omitempty" json:"service-schedule-id,omitempty"`
+	// The source networks devices may connect from, on top of the global network rules.
+	NetworkRules network.Rules `schema:"-" json:"service-network-rules,omitempty"`
+	// Whether devices need an approved just-in-time access request to connect, on top of the grants and policy.
+	RequireApproval bool `schema:"service-require-approval" json:"service-require-approval,omitempty"`
+	// Whether devices must send a TOTP code with PS_CONN, or have stepped up recently, to connect.
+	RequireStepUp bool `schema:"service-require-step-up" json:"service-require-step-up,omitempty"`
+	// For an Emissary Outbound Protected Service, the connection to the Emissary Outbound client hosting it and the
+	// device that registered it.
+	Conn             net.Conn
+	OutboundDeviceID string `schema:"-" json:"-"`
 }
@@ -0,0 +1,108 @@
+package drawbridge
+
+import (
+	"errors"
+	"imdawon/drawbridge/cmd/drawbridge/emissary"
+	"imdawon/drawbridge/cmd/utils"
+	"log/slog"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The event recorded when Drawbridge ends a live Protected Service connection, e.g. because its schedule closed.
+const EventTypeTerminated = "PS_TERM"
+
+// A live connection from an Emissary device to a Protected Service.
+type Session struct {
+	// The id of the PS_CONN event that started the session.
+	ID           string
+	DeviceID     string
+	ServiceID    int64
+	ConnectionIP string
+	Started      time.Time
+	conn         net.Conn
+}
+
+// The live sessions, keyed by the id of the event that started them.
+type sessionRegistry struct {
+	mu       sync.Mutex
+	sessions map[string]*Session
+}
+
+// Tracks a connection that was let through to a Protected Service until endSession is called.
+// Anomaly detection runs after the connection is let through, so the device may have been quarantined since.
+// Then the session isn't started and the caller has to close the connection.
+func (d *Drawbridge) startSession(event emissary.Event, serviceID int64, conn net.Conn) error {
+	d.sessions.mu.Lock()
+	defer d.sessions.mu.Unlock()
+	// Checked while holding the lock so quarantineDevice either sees the session or the session sees the quarantine.
+	if reason := d.checkQuarantine(event.DeviceID); reason != "" {
+		return errors.New(reason)
+	}
+	if d.sessions.sessions == nil {
+		d.sessions.sessions = make(map[string]*Session)
+	}
+	d.sessions.sessions[event.ID] = &Session{
+		ID:           event.ID,
+		DeviceID:     event.DeviceID,
+		ServiceID:    serviceID,
+		ConnectionIP: event.ConnectionIP,
+		Started:      event.Timestamp,
+		conn:         conn,
+	}
+	return nil
+}
+
+func (d *Drawbridge) endSession(id string) {
+	d.sessions.mu.Lock()
+	defer d.sessions.mu.Unlock()
+	delete(d.sessions.sessions, id)
+}
+
+// Returns the live sessions, oldest first.
+func (d *Drawbridge) Sessions() []Session {
+	d.sessions.mu.Lock()
+	defer d.sessions.mu.Unlock()
+	all := make([]Session, 0, len(d.sessions.sessions))
+	for _, session := range d.sessions.sessions {
+		all = append(all, *session)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Started.Before(all[j].Started) })
+	return all
+}
+
+// Closes the live sessions match returns true for and records a PS_TERM event with the reason for each.
+// Returns how many sessions were ended.
+func (d *Drawbridge) TerminateSessions(match func(Session) bool, reason string) int {
+	d.sessions.mu.Lock()
+	var ended []*Session
+	for id, session := range d.sessions.sessions {
+		if match(*session) {
+			ended = append(ended, session)
+			delete(d.sessions.sessions, id)
+		}
+	}
+	d.sessions.mu.Unlock()
+
+	for _, session := range ended {
+		// Closing the Emissary side ends proxyData, which closes the Protected Service side.
+		session.conn.Close()
+		id, err := utils.NewUUID()
+		if err != nil {
+			slog.Error("Emissary Event", slog.Any("Error", err))
+		}
+		slog.Info("Session Ended", slog.String("Device", session.DeviceID), slog.Int64("Service", session.ServiceID), slog.String("Reason", reason))
+		d.RecordEmissaryEvent(emissary.Event{
+			ID:            id,
+			DeviceID:      session.DeviceID,
+			ConnectionIP:  session.ConnectionIP,
+			Type:          EventTypeTerminated,
+			TargetService: utils.PadWithZeros(int(session.ServiceID)),
+			Timestamp:     time.Now().UTC(),
+			Reason:        reason,
+		})
+	}
+	return len(ended)
+}
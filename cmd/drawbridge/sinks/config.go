@@ -0,0 +1,80 @@
+package sinks
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"slices"
+)
+
+// The kinds of sink Drawbridge ships with.
+const (
+	TypeJSONL   = "jsonl"
+	TypeSyslog  = "syslog"
+	TypeWebhook = "webhook"
+)
+
+var Types = []string{TypeJSONL, TypeSyslog, TypeWebhook}
+
+// A sink as saved in the event_sinks setting. Only the settings for its Type are set.
+type Config struct {
+	ID       string `json:"id" yaml:"id" toml:"id"`
+	Name     string `json:"name" yaml:"name" toml:"name"`
+	Type     string `json:"type" yaml:"type" toml:"type"`
+	Disabled bool   `json:"disabled,omitempty" yaml:"disabled,omitempty" toml:"disabled,omitempty"`
+	// Only events of these types are sent to the sink. Empty sends every event.
+	EventTypes Filter         `json:"event_types,omitempty" yaml:"event_types,omitempty" toml:"event_types,omitempty"`
+	JSONL      *JSONLConfig   `json:"jsonl,omitempty" yaml:"jsonl,omitempty" toml:"jsonl,omitempty"`
+	Syslog     *SyslogConfig  `json:"syslog,omitempty" yaml:"syslog,omitempty" toml:"syslog,omitempty"`
+	Webhook    *WebhookConfig `json:"webhook,omitempty" yaml:"webhook,omitempty" toml:"webhook,omitempty"`
+}
+
+func (c Config) Validate() error {
+	if c.Name == "" {
+		return errors.New("event sinks need a name")
+	}
+	err := c.EventTypes.Validate()
+	if err != nil {
+		return err
+	}
+	switch c.Type {
+	case TypeJSONL:
+		if c.JSONL == nil || c.JSONL.Path == "" {
+			return errors.New("JSONL event sinks need a file path")
+		}
+		if c.JSONL.MaxSizeMB < 0 || c.JSONL.MaxBackups < 0 {
+			return errors.New("the JSONL file size and backup count can't be negative")
+		}
+	case TypeSyslog:
+		if c.Syslog == nil {
+			return errors.New("syslog event sinks need an address")
+		}
+		if !slices.Contains([]string{"udp", "tcp", "tls"}, c.Syslog.Network) {
+			return fmt.Errorf("syslog network must be udp, tcp or tls, not %q", c.Syslog.Network)
+		}
+		if _, _, err := net.SplitHostPort(c.Syslog.Address); err != nil {
+			return fmt.Errorf("syslog address must be a host and port: %w", err)
+		}
+		if _, ok := syslogFacilities[c.Syslog.facility()]; !ok {
+			return fmt.Errorf("unknown syslog facility %q", c.Syslog.Facility)
+		}
+	case TypeWebhook:
+		if c.Webhook == nil {
+			return errors.New("webhook event sinks need a URL")
+		}
+		endpoint, err := url.Parse(c.Webhook.URL)
+		if err != nil || (endpoint.Scheme != "https" && endpoint.Scheme != "http") || endpoint.Host == "" {
+			return fmt.Errorf("webhook URL %q must be an http or https URL", c.Webhook.URL)
+		}
+		if c.Webhook.Secret == "" {
+			return errors.New("webhook event sinks need a secret to sign requests with")
+		}
+		if c.Webhook.MaxRetries < 0 || c.Webhook.QueueSize < 0 {
+			return errors.New("the webhook retry count and queue size can't be negative")
+		}
+	default:
+		return fmt.Errorf("unknown event sink type %q", c.Type)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package sinks
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const (
+	defaultJSONLMaxSizeMB  = 100
+	defaultJSONLMaxBackups = 5
+)
+
+type JSONLConfig struct {
+	Path string `json:"path" yaml:"path" toml:"path"`
+	// The file is rotated once it grows past this. 0 uses the default of 100 MB.
+	MaxSizeMB int `json:"max_size_mb,omitempty" yaml:"max_size_mb,omitempty" toml:"max_size_mb,omitempty"`
+	// How many rotated files, e.g. events.jsonl.1, are kept. 0 uses the default of 5.
+	MaxBackups int `json:"max_backups,omitempty" yaml:"max_backups,omitempty" toml:"max_backups,omitempty"`
+}
+
+// Appends one JSON event per line to a file, rotating it to path.1, path.2, ... once it grows too large.
+type JSONLSink struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+func NewJSONLSink(config *JSONLConfig) (*JSONLSink, error) {
+	sink := &JSONLSink{
+		path:       config.Path,
+		maxSize:    int64(defaultJSONLMaxSizeMB) << 20,
+		maxBackups: defaultJSONLMaxBackups,
+	}
+	if config.MaxSizeMB > 0 {
+		sink.maxSize = int64(config.MaxSizeMB) << 20
+	}
+	if config.MaxBackups > 0 {
+		sink.maxBackups = config.MaxBackups
+	}
+	err := os.MkdirAll(filepath.Dir(sink.path), 0700)
+	if err != nil {
+		return nil, fmt.Errorf("error creating directory for %s: %w", sink.path, err)
+	}
+	err = sink.open()
+	if err != nil {
+		return nil, err
+	}
+	return sink, nil
+}
+
+func (s *JSONLSink) open() error {
+	file, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("error opening %s: %w", s.path, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("error reading size of %s: %w", s.path, err)
+	}
+	s.file = file
+	s.size = info.Size()
+	return nil
+}
+
+func (s *JSONLSink) Send(event Event) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if s.size > 0 && s.size+int64(len(line)) > s.maxSize {
+		err := s.rotate()
+		if err != nil {
+			return err
+		}
+	}
+	written, err := s.file.Write(line)
+	s.size += int64(written)
+	return err
+}
+
+// Shifts path.N-1 to path.N and so on, dropping the oldest, then starts a new file at path.
+func (s *JSONLSink) rotate() error {
+	err := s.file.Close()
+	if err != nil {
+		return err
+	}
+	os.Remove(fmt.Sprintf("%s.%d", s.path, s.maxBackups))
+	for i := s.maxBackups - 1; i >= 1; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", s.path, i), fmt.Sprintf("%s.%d", s.path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("error rotating %s: %w", s.path, err)
+		}
+	}
+	err = os.Rename(s.path, s.path+".1")
+	if err != nil {
+		return fmt.Errorf("error rotating %s: %w", s.path, err)
+	}
+	return s.open()
+}
+
+func (s *JSONLSink) Close() error {
+	return s.file.Close()
+}
@@ -0,0 +1,242 @@
+// Package sinks ships Drawbridge events to places outside the SQLite database, e.g. a SIEM.
+//
+// Every Emissary event and Drawbridge admin action is published to a Dispatcher, which hands it to each configured
+// Sink whose event type filter matches. Each sink has its own buffer and goroutine, so a slow or unreachable sink
+// never holds up Emissary connections or the other sinks.
+package sinks
+
+import (
+	"errors"
+	"fmt"
+	"imdawon/drawbridge/cmd/drawbridge/emissary"
+	"log/slog"
+	"path"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Types of the events published for Drawbridge admin actions. Emissary events use their request type, e.g. PS_CONN.
+const (
+	TypeServiceCreated       = "ADMIN_SERVICE_CREATED"
+	TypeServiceUpdated       = "ADMIN_SERVICE_UPDATED"
+	TypeServiceDeleted       = "ADMIN_SERVICE_DELETED"
+	TypePolicyCreated        = "ADMIN_POLICY_CREATED"
+	TypePolicyUpdated        = "ADMIN_POLICY_UPDATED"
+	TypePolicyDeleted        = "ADMIN_POLICY_DELETED"
+	TypeScheduleCreated      = "ADMIN_SCHEDULE_CREATED"
+	TypeScheduleUpdated      = "ADMIN_SCHEDULE_UPDATED"
+	TypeScheduleDeleted      = "ADMIN_SCHEDULE_DELETED"
+	TypeDeviceCreated        = "ADMIN_DEVICE_CREATED"
+	TypeDeviceRevoked        = "ADMIN_DEVICE_REVOKED"
+	TypeDeviceUnrevoked      = "ADMIN_DEVICE_UNREVOKED"
+	TypeDeviceUpdated        = "ADMIN_DEVICE_UPDATED"
+	TypeGrantCreated         = "ADMIN_GRANT_CREATED"
+	TypeGrantDeleted         = "ADMIN_GRANT_DELETED"
+	TypeSettingsUpdated      = "ADMIN_SETTINGS_UPDATED"
+	TypeCertificateAuthority = "ADMIN_CA_UPDATED"
+	TypeBackupCreated        = "ADMIN_BACKUP_CREATED"
+	TypeEventSinksUpdated    = "ADMIN_EVENT_SINKS_UPDATED"
+	TypeConfigDrift          = "ADMIN_CONFIG_DRIFT"
+	TypeStandbyPromoted      = "ADMIN_STANDBY_PROMOTED"
+	TypeJITApproved          = "ADMIN_JIT_APPROVED"
+	TypeJITDenied            = "ADMIN_JIT_DENIED"
+	TypeTOTPEnrolled         = "ADMIN_TOTP_ENROLLED"
+	TypeTOTPRemoved          = "ADMIN_TOTP_REMOVED"
+	TypeTOTPUnlocked         = "ADMIN_TOTP_UNLOCKED"
+	TypeIPUnbanned           = "ADMIN_IP_UNBANNED"
+	TypeDeviceReleased       = "ADMIN_DEVICE_RELEASED"
+	TypeLockdownEngaged      = "ADMIN_LOCKDOWN_ENGAGED"
+	TypeLockdownLifted       = "ADMIN_LOCKDOWN_LIFTED"
+)
+
+// Types of the events published for things no Drawbridge admin did: a device asking for just-in-time access, an
+// approval running out, a device locked out of step-up authentication after too many wrong codes, a source IP
+// banned at the Emissary listener after too many failed handshakes or malformed requests, and the anomaly detector
+// flagging or quarantining a device.
+const (
+	TypeJITRequested      = "JIT_REQUESTED"
+	TypeJITExpired        = "JIT_EXPIRED"
+	TypeStepUpLockout     = "STEP_UP_LOCKOUT"
+	TypeIPBanned          = "IP_BANNED"
+	TypeAnomalyDetected   = "ANOMALY_DETECTED"
+	TypeDeviceQuarantined = "DEVICE_QUARANTINED"
+)
+
+// How many events a sink can fall behind by before new events for it are dropped.
+const sinkBufferSize = 1024
+
+// An event as shipped to sinks.
+type Event struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	Timestamp time.Time `json:"timestamp"`
+	// Set for Emissary events.
+	DeviceID      string `json:"device_id,omitempty"`
+	ConnectionIP  string `json:"connection_ip,omitempty"`
+	TargetService string `json:"target_service,omitempty"`
+	// Why Drawbridge denied or ended the connection, e.g. a closed schedule.
+	Reason string `json:"reason,omitempty"`
+	// Where the connection IP was, from the GeoIP databases.
+	Country string `json:"country,omitempty"`
+	ASN     uint   `json:"asn,omitempty"`
+	// Set for admin actions: who made the change, e.g. "dashboard 127.0.0.1:51234" or "cli".
+	Actor   string            `json:"actor,omitempty"`
+	Details map[string]string `json:"details,omitempty"`
+}
+
+func FromEmissaryEvent(event emissary.Event) Event {
+	return Event{
+		ID:            event.ID,
+		Type:          event.Type,
+		Timestamp:     event.Timestamp.UTC(),
+		DeviceID:      event.DeviceID,
+		ConnectionIP:  event.ConnectionIP,
+		TargetService: event.TargetService,
+		Reason:        event.Reason,
+		Country:       event.Country,
+		ASN:           event.ASN,
+	}
+}
+
+// Somewhere events are shipped to. Send is only called from one goroutine at a time.
+type Sink interface {
+	Send(event Event) error
+	Close() error
+}
+
+// Decides which events a sink gets. Types are glob patterns, e.g. PS_CONN or ADMIN_*.
+// An empty filter matches every event.
+type Filter []string
+
+func (f Filter) Matches(eventType string) bool {
+	if len(f) == 0 {
+		return true
+	}
+	return slices.ContainsFunc(f, func(pattern string) bool {
+		matched, _ := path.Match(pattern, eventType)
+		return matched
+	})
+}
+
+func (f Filter) Validate() error {
+	for _, pattern := range f {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid event type pattern %q", pattern)
+		}
+	}
+	return nil
+}
+
+// Creates the sink described by config.
+func New(config Config) (Sink, error) {
+	err := config.Validate()
+	if err != nil {
+		return nil, err
+	}
+	switch config.Type {
+	case TypeJSONL:
+		return NewJSONLSink(config.JSONL)
+	case TypeSyslog:
+		return NewSyslogSink(config.Syslog)
+	case TypeWebhook:
+		return NewWebhookSink(config.Webhook)
+	}
+	return nil, fmt.Errorf("unknown event sink type %q", config.Type)
+}
+
+// Hands published events to every running sink whose filter matches.
+// A nil Dispatcher drops every event, so callers don't need to check whether sinks are set up.
+type Dispatcher struct {
+	mu    sync.RWMutex
+	sinks []*runningSink
+}
+
+type runningSink struct {
+	name   string
+	filter Filter
+	sink   Sink
+	events chan Event
+	done   chan struct{}
+}
+
+func NewDispatcher() *Dispatcher {
+	return &Dispatcher{}
+}
+
+// Replaces the running sinks with ones made from configs. Sinks that fail to start are skipped and their errors
+// returned, the rest keep running.
+func (d *Dispatcher) Configure(configs []Config) error {
+	var started []*runningSink
+	var errs []error
+	for _, config := range configs {
+		if config.Disabled {
+			continue
+		}
+		sink, err := New(config)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("event sink %s: %w", config.Name, err))
+			continue
+		}
+		running := &runningSink{
+			name:   config.Name,
+			filter: config.EventTypes,
+			sink:   sink,
+			events: make(chan Event, sinkBufferSize),
+			done:   make(chan struct{}),
+		}
+		go running.run()
+		started = append(started, running)
+	}
+
+	d.mu.Lock()
+	previous := d.sinks
+	d.sinks = started
+	d.mu.Unlock()
+	for _, running := range previous {
+		running.stop()
+	}
+	return errors.Join(errs...)
+}
+
+func (d *Dispatcher) Publish(event Event) {
+	if d == nil {
+		return
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	for _, running := range d.sinks {
+		if !running.filter.Matches(event.Type) {
+			continue
+		}
+		select {
+		case running.events <- event:
+		default:
+			slog.Warn("Event Sink", slog.String("Dropping event for sink that is falling behind", running.name), slog.String("event", event.ID))
+		}
+	}
+}
+
+// Stops every sink after it has sent the events it was handed.
+func (d *Dispatcher) Close() {
+	d.Configure(nil)
+}
+
+func (s *runningSink) run() {
+	defer close(s.done)
+	for event := range s.events {
+		err := s.sink.Send(event)
+		if err != nil {
+			slog.Error("Event Sink", slog.String("sink", s.name), slog.Any("Error sending event", err))
+		}
+	}
+}
+
+func (s *runningSink) stop() {
+	close(s.events)
+	<-s.done
+	err := s.sink.Close()
+	if err != nil {
+		slog.Error("Event Sink", slog.String("sink", s.name), slog.Any("Error closing sink", err))
+	}
+}
@@ -0,0 +1,339 @@
+package sinks
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testEvent(id, eventType string) Event {
+	return Event{ID: id, Type: eventType, Timestamp: time.Date(2024, 5, 1, 9, 0, 0, 0, time.UTC), DeviceID: "device-1"}
+}
+
+func TestFilter(t *testing.T) {
+	tests := []struct {
+		filter    Filter
+		eventType string
+		want      bool
+	}{
+		{nil, "PS_CONN", true},
+		{Filter{"PS_CONN"}, "PS_CONN", true},
+		{Filter{"PS_CONN"}, "PS_LIST", false},
+		{Filter{"ADMIN_*"}, TypeDeviceRevoked, true},
+		{Filter{"PS_CONN", "ADMIN_DEVICE_*"}, TypeServiceCreated, false},
+	}
+	for _, test := range tests {
+		if got := test.filter.Matches(test.eventType); got != test.want {
+			t.Errorf("%v.Matches(%q) = %v, want %v", test.filter, test.eventType, got, test.want)
+		}
+	}
+	if err := (Filter{"[PS_CONN"}).Validate(); err == nil {
+		t.Error("expected an invalid pattern to fail validation")
+	}
+}
+
+func TestJSONLSinkRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events", "events.jsonl")
+	sink, err := NewJSONLSink(&JSONLConfig{Path: path, MaxBackups: 2})
+	if err != nil {
+		t.Fatalf("NewJSONLSink failed: %v", err)
+	}
+	// Rotate after every line.
+	sink.maxSize = 1
+	for _, id := range []string{"a", "b", "c", "d"} {
+		if err := sink.Send(testEvent(id, "PS_CONN")); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	for file, wantID := range map[string]string{path: "d", path + ".1": "c", path + ".2": "b"} {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatalf("reading %s failed: %v", file, err)
+		}
+		var event Event
+		if err := json.Unmarshal(data, &event); err != nil {
+			t.Fatalf("%s isn't one JSON event: %v", file, err)
+		}
+		if event.ID != wantID {
+			t.Errorf("%s holds event %q, want %q", file, event.ID, wantID)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("expected only 2 backups to be kept")
+	}
+}
+
+func TestSyslogSinkUDP(t *testing.T) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	defer listener.Close()
+
+	sink, err := NewSyslogSink(&SyslogConfig{Network: "udp", Address: listener.LocalAddr().String(), Facility: "auth"})
+	if err != nil {
+		t.Fatalf("NewSyslogSink failed: %v", err)
+	}
+	defer sink.Close()
+	if err := sink.Send(testEvent("a", TypeDeviceRevoked)); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+
+	buffer := make([]byte, 4096)
+	listener.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := listener.ReadFrom(buffer)
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	message := string(buffer[:n])
+	// auth (4) * 8 + warning (4)
+	wantPrefix := "<36>1 2024-05-01T09:00:00Z "
+	if !strings.HasPrefix(message, wantPrefix) {
+		t.Errorf("message %q doesn't start with %q", message, wantPrefix)
+	}
+	if !strings.Contains(message, ` drawbridge `) || !strings.Contains(message, ` ADMIN_DEVICE_REVOKED [drawbridge@32473 id="a" type="ADMIN_DEVICE_REVOKED"] {`) {
+		t.Errorf("message %q is missing the app name, message id or structured data", message)
+	}
+}
+
+func TestSyslogSinkTCPFraming(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	defer listener.Close()
+	messages := make(chan string, 2)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		for {
+			length, err := reader.ReadString(' ')
+			if err != nil {
+				return
+			}
+			n, _ := strconv.Atoi(strings.TrimSpace(length))
+			message := make([]byte, n)
+			if _, err := io.ReadFull(reader, message); err != nil {
+				return
+			}
+			messages <- string(message)
+		}
+	}()
+
+	sink, err := NewSyslogSink(&SyslogConfig{Network: "tcp", Address: listener.Addr().String()})
+	if err != nil {
+		t.Fatalf("NewSyslogSink failed: %v", err)
+	}
+	defer sink.Close()
+	for _, id := range []string{"a", "b"} {
+		if err := sink.Send(testEvent(id, "PS_CONN")); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+	}
+	for _, id := range []string{"a", "b"} {
+		select {
+		case message := <-messages:
+			// local0 (16) * 8 + informational (6)
+			if !strings.HasPrefix(message, "<134>1 ") || !strings.Contains(message, `"id":"`+id+`"`) {
+				t.Errorf("unexpected message %q", message)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for message %s", id)
+		}
+	}
+}
+
+func TestWebhookSinkSignsAndRetries(t *testing.T) {
+	const secret = "hunter2"
+	var mu sync.Mutex
+	attempts := 0
+	delivered := make(chan Event, 4)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		signature := SignWebhook(secret, r.Header.Get(WebhookTimestampHeader), body)
+		if r.Header.Get(WebhookSignatureHeader) != signature {
+			t.Errorf("signature %q, want %q", r.Header.Get(WebhookSignatureHeader), signature)
+		}
+		mu.Lock()
+		attempts++
+		fail := attempts <= 2
+		mu.Unlock()
+		if fail {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		var event Event
+		json.Unmarshal(body, &event)
+		delivered <- event
+	}))
+	defer server.Close()
+
+	queue := t.TempDir()
+	sink, err := NewWebhookSink(&WebhookConfig{URL: server.URL, Secret: secret, QueueDirectory: queue})
+	if err != nil {
+		t.Fatalf("NewWebhookSink failed: %v", err)
+	}
+	sink.backoff = time.Millisecond
+	if err := sink.Send(testEvent("a", "PS_CONN")); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+
+	select {
+	case event := <-delivered:
+		if event.ID != "a" || event.Type != "PS_CONN" {
+			t.Errorf("delivered %+v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the webhook to be retried")
+	}
+	// The worker removes the event from the queue once the response comes back.
+	deadline := time.Now().Add(5 * time.Second)
+	for len(sink.queued()) != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	sink.Close()
+	if names := sink.queued(); len(names) != 0 {
+		t.Errorf("expected the delivered event to leave the queue, %d files left", len(names))
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if attempts != 3 {
+		t.Errorf("expected 3 attempts, got %d", attempts)
+	}
+}
+
+func TestWebhookSinkQueueIsBounded(t *testing.T) {
+	queue := t.TempDir()
+	// Nothing listens here, so events stay queued.
+	sink, err := NewWebhookSink(&WebhookConfig{URL: "http://127.0.0.1:1", Secret: "s", QueueSize: 3, QueueDirectory: queue})
+	if err != nil {
+		t.Fatalf("NewWebhookSink failed: %v", err)
+	}
+	sink.backoff = time.Hour
+	sink.Close()
+	for _, id := range []string{"a", "b", "c", "d", "e"} {
+		if err := sink.Send(testEvent(id, "PS_CONN")); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+	}
+
+	names := sink.queued()
+	if len(names) != 3 {
+		t.Fatalf("expected 3 queued events, got %d", len(names))
+	}
+	var ids []string
+	for _, name := range names {
+		data, _ := os.ReadFile(filepath.Join(queue, name))
+		var event Event
+		json.Unmarshal(data, &event)
+		ids = append(ids, event.ID)
+	}
+	if strings.Join(ids, "") != "cde" {
+		t.Errorf("expected the oldest events to be dropped, queue holds %v", ids)
+	}
+}
+
+func TestWebhookSinkDeliversQueueAfterRestart(t *testing.T) {
+	queue := t.TempDir()
+	sink, err := NewWebhookSink(&WebhookConfig{URL: "http://127.0.0.1:1", Secret: "s", QueueDirectory: queue})
+	if err != nil {
+		t.Fatalf("NewWebhookSink failed: %v", err)
+	}
+	sink.Close()
+	if err := sink.Send(testEvent("a", "PS_CONN")); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	// A queue file that was cut short, e.g. by a crash.
+	if err := os.WriteFile(filepath.Join(queue, "00000000000000000000-000000.json"), []byte(`{"id":`), 0600); err != nil {
+		t.Fatalf("failed to write queue file: %v", err)
+	}
+
+	delivered := make(chan string, 4)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		delivered <- r.Header.Get(WebhookEventTypeHeader)
+	}))
+	defer server.Close()
+	sink, err = NewWebhookSink(&WebhookConfig{URL: server.URL, Secret: "s", QueueDirectory: queue})
+	if err != nil {
+		t.Fatalf("NewWebhookSink failed: %v", err)
+	}
+	defer sink.Close()
+
+	select {
+	case eventType := <-delivered:
+		if eventType != "PS_CONN" {
+			t.Errorf("%s header = %q, want PS_CONN", WebhookEventTypeHeader, eventType)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the queued event to be delivered")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(sink.queued()) != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if names := sink.queued(); len(names) != 0 {
+		t.Errorf("expected the delivered and unreadable events to leave the queue, %v left", names)
+	}
+	select {
+	case eventType := <-delivered:
+		t.Errorf("the unreadable event shouldn't be delivered, got %q", eventType)
+	default:
+	}
+}
+
+func TestDispatcherFiltersAndConfigures(t *testing.T) {
+	dir := t.TempDir()
+	admin := filepath.Join(dir, "admin.jsonl")
+	all := filepath.Join(dir, "all.jsonl")
+	dispatcher := NewDispatcher()
+	err := dispatcher.Configure([]Config{
+		{Name: "admin", Type: TypeJSONL, EventTypes: Filter{"ADMIN_*"}, JSONL: &JSONLConfig{Path: admin}},
+		{Name: "all", Type: TypeJSONL, JSONL: &JSONLConfig{Path: all}},
+		{Name: "off", Type: TypeJSONL, Disabled: true, JSONL: &JSONLConfig{Path: filepath.Join(dir, "off.jsonl")}},
+		{Name: "broken", Type: TypeSyslog, Syslog: &SyslogConfig{Network: "carrier-pigeon", Address: "x:1"}},
+	})
+	if err == nil || !strings.Contains(err.Error(), "broken") {
+		t.Errorf("expected the broken sink to be reported, got %v", err)
+	}
+	dispatcher.Publish(testEvent("a", "PS_CONN"))
+	dispatcher.Publish(testEvent("b", TypeServiceCreated))
+	dispatcher.Close()
+
+	countLines := func(path string) int {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("reading %s failed: %v", path, err)
+		}
+		return strings.Count(string(data), "\n")
+	}
+	if got := countLines(admin); got != 1 {
+		t.Errorf("admin sink got %d events, want 1", got)
+	}
+	if got := countLines(all); got != 2 {
+		t.Errorf("unfiltered sink got %d events, want 2", got)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "off.jsonl")); !os.IsNotExist(err) {
+		t.Error("disabled sink was started")
+	}
+
+	var nilDispatcher *Dispatcher
+	nilDispatcher.Publish(testEvent("c", "PS_CONN"))
+}
@@ -0,0 +1,171 @@
+package sinks
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// RFC 5424 facility codes by name.
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+	"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19, "local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+const (
+	defaultSyslogFacility = "local0"
+	syslogAppName         = "drawbridge"
+	syslogDialTimeout     = 10 * time.Second
+	// RFC 5424 severities.
+	syslogSeverityWarning       = 4
+	syslogSeverityInformational = 6
+)
+
+type SyslogConfig struct {
+	// udp, tcp or tls.
+	Network string `json:"network" yaml:"network" toml:"network"`
+	Address string `json:"address" yaml:"address" toml:"address"`
+	// e.g. local0, the default, or auth.
+	Facility string `json:"facility,omitempty" yaml:"facility,omitempty" toml:"facility,omitempty"`
+	// PEM file of the certificate authority the syslog server's certificate is checked against.
+	// Empty uses the system's trusted roots.
+	CAFile string `json:"ca_file,omitempty" yaml:"ca_file,omitempty" toml:"ca_file,omitempty"`
+}
+
+func (c SyslogConfig) facility() string {
+	if c.Facility == "" {
+		return defaultSyslogFacility
+	}
+	return c.Facility
+}
+
+// Sends events as RFC 5424 messages, with the event as JSON in the message body.
+// TCP and TLS messages are framed with octet counting (RFC 6587). The connection is redialed when a send fails.
+type SyslogSink struct {
+	config    SyslogConfig
+	facility  int
+	hostname  string
+	tlsConfig *tls.Config
+	conn      net.Conn
+}
+
+func NewSyslogSink(config *SyslogConfig) (*SyslogSink, error) {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+	sink := &SyslogSink{
+		config:   *config,
+		facility: syslogFacilities[config.facility()],
+		hostname: hostname,
+	}
+	if config.Network == "tls" {
+		host, _, _ := net.SplitHostPort(config.Address)
+		sink.tlsConfig = &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}
+		if config.CAFile != "" {
+			caPEM, err := os.ReadFile(config.CAFile)
+			if err != nil {
+				return nil, fmt.Errorf("error reading syslog certificate authority: %w", err)
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(caPEM) {
+				return nil, fmt.Errorf("no certificates found in %s", config.CAFile)
+			}
+			sink.tlsConfig.RootCAs = pool
+		}
+	}
+	return sink, nil
+}
+
+func (s *SyslogSink) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: syslogDialTimeout}
+	if s.tlsConfig != nil {
+		return tls.DialWithDialer(dialer, "tcp", s.config.Address, s.tlsConfig)
+	}
+	return dialer.Dial(s.config.Network, s.config.Address)
+}
+
+func (s *SyslogSink) Send(event Event) error {
+	message, err := s.format(event)
+	if err != nil {
+		return err
+	}
+	if s.config.Network != "udp" {
+		message = append([]byte(fmt.Sprintf("%d ", len(message))), message...)
+	}
+	// Retry once on a fresh connection, in case the server dropped the old one.
+	for attempt := 0; ; attempt++ {
+		if s.conn == nil {
+			s.conn, err = s.dial()
+			if err != nil {
+				return fmt.Errorf("error connecting to syslog server %s: %w", s.config.Address, err)
+			}
+		}
+		_, err = s.conn.Write(message)
+		if err == nil {
+			return nil
+		}
+		s.conn.Close()
+		s.conn = nil
+		if attempt > 0 {
+			return fmt.Errorf("error sending to syslog server %s: %w", s.config.Address, err)
+		}
+	}
+}
+
+// <PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID [STRUCTURED-DATA] MSG
+func (s *SyslogSink) format(event Event) ([]byte, error) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+	severity := syslogSeverityInformational
+	if event.Type == TypeDeviceRevoked {
+		severity = syslogSeverityWarning
+	}
+	structuredData := fmt.Sprintf(`[drawbridge@32473 id="%s" type="%s"]`, escapeSyslogParam(event.ID), escapeSyslogParam(event.Type))
+	message := fmt.Sprintf("<%d>1 %s %s %s %d %s %s %s",
+		s.facility*8+severity,
+		event.Timestamp.UTC().Format(time.RFC3339Nano),
+		s.hostname,
+		syslogAppName,
+		os.Getpid(),
+		syslogMessageID(event.Type),
+		structuredData,
+		body,
+	)
+	return []byte(message), nil
+}
+
+// MSGIDs are at most 32 printable ASCII characters.
+func syslogMessageID(eventType string) string {
+	id := strings.Map(func(r rune) rune {
+		if r < 33 || r > 126 {
+			return '_'
+		}
+		return r
+	}, eventType)
+	if id == "" {
+		return "-"
+	}
+	return id[:min(len(id), 32)]
+}
+
+var syslogParamEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+func escapeSyslogParam(value string) string {
+	return syslogParamEscaper.Replace(value)
+}
+
+func (s *SyslogSink) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.Close()
+}
@@ -0,0 +1,269 @@
+package sinks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultWebhookMaxRetries = 5
+	defaultWebhookQueueSize  = 10000
+	webhookRequestTimeout    = 10 * time.Second
+	webhookInitialBackoff    = time.Second
+	webhookMaxBackoff        = 5 * time.Minute
+
+	WebhookSignatureHeader = "X-Drawbridge-Signature"
+	WebhookTimestampHeader = "X-Drawbridge-Timestamp"
+	WebhookEventTypeHeader = "X-Drawbridge-Event"
+)
+
+type WebhookConfig struct {
+	URL string `json:"url" yaml:"url" toml:"url"`
+	// Requests are signed with HMAC-SHA256 using this secret. See SignWebhook.
+	Secret string `json:"secret" yaml:"secret" toml:"secret"`
+	// How many times a failed delivery is retried before the event is dropped. 0 uses the default of 5.
+	MaxRetries int `json:"max_retries,omitempty" yaml:"max_retries,omitempty" toml:"max_retries,omitempty"`
+	// How many undelivered events are kept on disk. The oldest are dropped past this. 0 uses the default of 10000.
+	QueueSize int `json:"queue_size,omitempty" yaml:"queue_size,omitempty" toml:"queue_size,omitempty"`
+	// Where undelivered events are kept, so they survive a restart.
+	QueueDirectory string `json:"queue_directory,omitempty" yaml:"queue_directory,omitempty" toml:"queue_directory,omitempty"`
+}
+
+// POSTs each event as JSON to a URL. Events are written to an on-disk queue first and delivered in order by a
+// background worker, which retries failed deliveries with exponential backoff.
+type WebhookSink struct {
+	config   WebhookConfig
+	client   *http.Client
+	backoff  time.Duration
+	mu       sync.Mutex
+	sequence int
+	// The names of the queued event files, oldest first, so Send doesn't have to read the queue directory.
+	queue  []string
+	wake   chan struct{}
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func NewWebhookSink(config *WebhookConfig) (*WebhookSink, error) {
+	sink := &WebhookSink{
+		config:  *config,
+		client:  &http.Client{Timeout: webhookRequestTimeout},
+		backoff: webhookInitialBackoff,
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	if sink.config.MaxRetries == 0 {
+		sink.config.MaxRetries = defaultWebhookMaxRetries
+	}
+	if sink.config.QueueSize == 0 {
+		sink.config.QueueSize = defaultWebhookQueueSize
+	}
+	if sink.config.QueueDirectory == "" {
+		return nil, fmt.Errorf("webhook event sinks need a queue directory")
+	}
+	err := os.MkdirAll(sink.config.QueueDirectory, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("error creating webhook queue directory: %w", err)
+	}
+	// Events left over from the last time the sink ran.
+	sink.queue = sink.queued()
+	sink.ctx, sink.cancel = context.WithCancel(context.Background())
+	go sink.deliver()
+	return sink, nil
+}
+
+// Returns the signature sent in the X-Drawbridge-Signature header: "sha256=" followed by the hex HMAC-SHA256 of
+// the X-Drawbridge-Timestamp header, a ".", and the request body. Receivers should check it, and that the
+// timestamp is recent, before trusting an event.
+func SignWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Queues the event for delivery.
+func (s *WebhookSink) Send(event Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.sequence++
+	// Zero padded so the queue sorts in the order events were sent.
+	name := fmt.Sprintf("%020d-%06d.json", time.Now().UnixNano(), s.sequence%1000000)
+	s.mu.Unlock()
+	err = os.WriteFile(filepath.Join(s.config.QueueDirectory, name), body, 0600)
+	if err != nil {
+		return fmt.Errorf("error queueing webhook event: %w", err)
+	}
+	s.enqueue(name)
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Reads the names of the queued event files from the queue directory, oldest first.
+func (s *WebhookSink) queued() []string {
+	entries, err := os.ReadDir(s.config.QueueDirectory)
+	if err != nil {
+		slog.Error("Event Sink", slog.Any("Error reading webhook queue", err))
+		return nil
+	}
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".json") {
+			names = append(names, entry.Name())
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+// Adds a queued event file to the queue, dropping the oldest queued events once there are more than QueueSize.
+func (s *WebhookSink) enqueue(name string) {
+	s.mu.Lock()
+	// Concurrent Sends can finish writing out of order.
+	i, _ := slices.BinarySearch(s.queue, name)
+	s.queue = slices.Insert(s.queue, i, name)
+	overflow := len(s.queue) - s.config.QueueSize
+	if overflow <= 0 {
+		s.mu.Unlock()
+		return
+	}
+	dropped := slices.Clone(s.queue[:overflow])
+	s.queue = slices.Delete(s.queue, 0, overflow)
+	s.mu.Unlock()
+	for _, name := range dropped {
+		os.Remove(filepath.Join(s.config.QueueDirectory, name))
+	}
+	slog.Warn("Event Sink", slog.Int("Webhook queue is full, dropped oldest events", overflow))
+}
+
+// Returns the oldest queued event file, or false if the queue is empty.
+func (s *WebhookSink) oldest() (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.queue) == 0 {
+		return "", false
+	}
+	return s.queue[0], true
+}
+
+// Removes a queued event file from the queue and the queue directory.
+func (s *WebhookSink) dequeue(name string) {
+	s.mu.Lock()
+	// Already gone if enqueue dropped it while it was being delivered.
+	if i, found := slices.BinarySearch(s.queue, name); found {
+		s.queue = slices.Delete(s.queue, i, i+1)
+	}
+	s.mu.Unlock()
+	os.Remove(filepath.Join(s.config.QueueDirectory, name))
+}
+
+// Delivers queued events oldest first until the sink is closed.
+func (s *WebhookSink) deliver() {
+	defer close(s.done)
+	for {
+		for name, ok := s.oldest(); ok; name, ok = s.oldest() {
+			if !s.deliverQueued(name) {
+				return
+			}
+		}
+		select {
+		case <-s.wake:
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// Delivers one queued event, retrying with backoff. Returns false if the sink was closed first.
+func (s *WebhookSink) deliverQueued(name string) bool {
+	path := filepath.Join(s.config.QueueDirectory, name)
+	body, err := os.ReadFile(path)
+	if err != nil {
+		// Dropped by enqueue in the meantime.
+		s.dequeue(name)
+		return true
+	}
+	var event Event
+	err = json.Unmarshal(body, &event)
+	if err != nil {
+		slog.Error("Event Sink", slog.String("Dropping unreadable webhook event", path), slog.Any("error", err))
+		s.dequeue(name)
+		return true
+	}
+	backoff := s.backoff
+	for attempt := 0; attempt <= s.config.MaxRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(backoff):
+			case <-s.ctx.Done():
+				return false
+			}
+			backoff = min(backoff*2, webhookMaxBackoff)
+		}
+		err = s.post(event.Type, body)
+		if err == nil {
+			break
+		}
+		if s.ctx.Err() != nil {
+			return false
+		}
+	}
+	if err != nil {
+		slog.Error("Event Sink", slog.String("Dropping webhook event after retries", s.config.URL), slog.Any("error", err))
+	}
+	s.dequeue(name)
+	return true
+}
+
+func (s *WebhookSink) post(eventType string, body []byte) error {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	request, err := http.NewRequestWithContext(s.ctx, http.MethodPost, s.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "Drawbridge")
+	request.Header.Set(WebhookTimestampHeader, timestamp)
+	request.Header.Set(WebhookSignatureHeader, SignWebhook(s.config.Secret, timestamp, body))
+	request.Header.Set(WebhookEventTypeHeader, eventType)
+	response, err := s.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(response.Body, 1<<16))
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %s", response.Status)
+	}
+	return nil
+}
+
+// Stops delivering. Undelivered events stay queued on disk and are delivered the next time the sink starts.
+func (s *WebhookSink) Close() error {
+	s.cancel()
+	<-s.done
+	return nil
+}
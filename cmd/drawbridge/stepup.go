@@ -0,0 +1,269 @@
+package drawbridge
+
+import (
+	"errors"
+	"fmt"
+	"imdawon/drawbridge/cmd/drawbridge/emissary"
+	"imdawon/drawbridge/cmd/drawbridge/emissary/authorization"
+	"imdawon/drawbridge/cmd/drawbridge/sinks"
+	"imdawon/drawbridge/cmd/drawbridge/totp"
+	"imdawon/drawbridge/cmd/utils"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// The setting in the drawbridge_config table for how long a device can connect to services that require step-up
+	// without another TOTP code.
+	stepUpCacheSetting = "step_up_cache"
+	DefaultStepUpCache = 15 * time.Minute
+	MaxStepUpCache     = 24 * time.Hour
+
+	// Wrong codes in a row before a device is locked out of step-up authentication, and for how long.
+	MaxStepUpFailures = 5
+	StepUpLockout     = 15 * time.Minute
+
+	// The name authenticator apps show next to the device's codes.
+	totpIssuer = "Drawbridge"
+
+	stepUpCheck = "TOTP step-up"
+)
+
+// When each device last stepped up, keyed by device id. Kept in memory only, so devices step up again after
+// Drawbridge restarts. The lock also serializes code checks, so a code can't be used twice by racing connections.
+type stepUpCache struct {
+	mu      sync.Mutex
+	stepped map[string]time.Time
+}
+
+func (d *Drawbridge) StepUpCache() time.Duration {
+	value, err := d.DB.GetDrawbridgeConfigValueByName(stepUpCacheSetting)
+	if err != nil {
+		slog.Error("Database", slog.Any("Error getting "+stepUpCacheSetting, err))
+		return DefaultStepUpCache
+	}
+	if value == nil || *value == "" {
+		return DefaultStepUpCache
+	}
+	cache, err := time.ParseDuration(*value)
+	if err != nil || cache < 0 || cache > MaxStepUpCache {
+		slog.Error("Step-up Authentication", slog.String("Invalid "+stepUpCacheSetting, *value))
+		return DefaultStepUpCache
+	}
+	return cache
+}
+
+// Saves how long a step-up lets a device in for. 0 asks for a code on every connection.
+func (d *Drawbridge) SaveStepUpCache(cache time.Duration) error {
+	if cache < 0 || cache > MaxStepUpCache {
+		return fmt.Errorf("a step-up can be remembered for at most %s", MaxStepUpCache)
+	}
+	return d.DB.CreateNewDrawbridgeConfigSettings(stepUpCacheSetting, cache.String())
+}
+
+// Gives the device a new TOTP secret, replacing any it had, and returns the otpauth URI to show to its authenticator
+// app. The device can't step up until ConfirmTOTP is called with a code from the app.
+func (d *Drawbridge) EnrollTOTP(deviceID string) (*emissary.TOTPEnrollment, string, error) {
+	device, err := d.DB.GetEmissaryClientById(deviceID)
+	if err != nil {
+		return nil, "", err
+	}
+	if device.ID == "" {
+		return nil, "", fmt.Errorf("there is no device with id %s", deviceID)
+	}
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return nil, "", err
+	}
+	enrollment := emissary.TOTPEnrollment{DeviceID: device.ID, Secret: secret, EnrolledAt: time.Now().UTC()}
+	err = d.DB.SaveDeviceTOTP(enrollment)
+	if err != nil {
+		return nil, "", err
+	}
+	d.forgetStepUp(device.ID)
+	return &enrollment, totp.URI(totpIssuer, device.Name, secret), nil
+}
+
+// The otpauth URI of an enrollment, for showing its QR code again until it is confirmed.
+func (d *Drawbridge) TOTPURI(enrollment *emissary.TOTPEnrollment) (string, error) {
+	device, err := d.DB.GetEmissaryClientById(enrollment.DeviceID)
+	if err != nil {
+		return "", err
+	}
+	return totp.URI(totpIssuer, device.Name, enrollment.Secret), nil
+}
+
+// Finishes enrolling the device once the Drawbridge admin enters a code from its authenticator app.
+func (d *Drawbridge) ConfirmTOTP(deviceID, code string) (*emissary.TOTPEnrollment, error) {
+	d.stepUps.mu.Lock()
+	defer d.stepUps.mu.Unlock()
+	enrollment, err := d.DB.GetDeviceTOTP(deviceID)
+	if err != nil {
+		return nil, err
+	}
+	if enrollment.DeviceID == "" {
+		return nil, errors.New("the device isn't enrolled in step-up authentication")
+	}
+	if enrollment.Confirmed {
+		return nil, errors.New("the enrollment was already confirmed")
+	}
+	counter, ok, err := totp.Validate(enrollment.Secret, strings.TrimSpace(code), time.Now(), 0)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errors.New("the code doesn't match, check the authenticator app's clock and try the next code")
+	}
+	enrollment.Confirmed = true
+	enrollment.LastCounter = counter
+	return enrollment, d.DB.SaveDeviceTOTP(*enrollment)
+}
+
+// Lets a device that was locked out after too many wrong codes try again.
+func (d *Drawbridge) UnlockTOTP(deviceID string) error {
+	d.stepUps.mu.Lock()
+	defer d.stepUps.mu.Unlock()
+	enrollment, err := d.DB.GetDeviceTOTP(deviceID)
+	if err != nil {
+		return err
+	}
+	if enrollment.DeviceID == "" {
+		return errors.New("the device isn't enrolled in step-up authentication")
+	}
+	enrollment.Failures = 0
+	enrollment.LockedUntil = time.Time{}
+	return d.DB.SaveDeviceTOTP(*enrollment)
+}
+
+// Removes the device's TOTP secret. It can't connect to services that require step-up until it enrolls again.
+func (d *Drawbridge) RemoveTOTP(deviceID string) error {
+	err := d.DB.DeleteDeviceTOTP(deviceID)
+	if err != nil {
+		return err
+	}
+	d.forgetStepUp(deviceID)
+	return nil
+}
+
+func (d *Drawbridge) forgetStepUp(deviceID string) {
+	d.stepUps.mu.Lock()
+	defer d.stepUps.mu.Unlock()
+	delete(d.stepUps.stepped, deviceID)
+}
+
+// Checks the step-up of a connection the other checks let in, if its Protected Service requires step-up. A device
+// that stepped up within the step-up cache is let in without a code. Otherwise the code sent with the connection must
+// be a fresh one from the device's authenticator app: codes can't be used twice, and too many wrong codes in a row
+// lock the device out. The access simulator passes verify false to check without using or counting a code.
+func (d *Drawbridge) checkStepUp(decision authorization.Decision, request AccessRequest, verify bool) authorization.Decision {
+	service, err := d.DB.GetServiceById(request.ServiceID)
+	if err != nil {
+		slog.Error("Authorization", slog.Any("Error getting Protected Service", err))
+		return denied(decision.Trace, stepUpCheck, "error getting the Protected Service")
+	}
+	if !service.RequireStepUp {
+		return decision
+	}
+	now := request.Time
+	d.stepUps.mu.Lock()
+	defer d.stepUps.mu.Unlock()
+	if stepped, ok := d.stepUps.stepped[request.DeviceID]; ok {
+		if until := stepped.Add(d.StepUpCache()); now.Before(until) {
+			decision.Trace = append(decision.Trace, authorization.TraceStep{Check: stepUpCheck, Passed: true, Detail: fmt.Sprintf("stepped up until %s", until.UTC().Format(time.RFC3339))})
+			return decision
+		}
+	}
+	enrollment, err := d.DB.GetDeviceTOTP(request.DeviceID)
+	if err != nil {
+		slog.Error("Authorization", slog.Any("Error getting TOTP enrollment", err))
+		return denied(decision.Trace, stepUpCheck, "error getting the device's TOTP enrollment")
+	}
+	if !enrollment.Confirmed {
+		return denied(decision.Trace, stepUpCheck, fmt.Sprintf("%s requires step-up and the device isn't enrolled in it", service.Name))
+	}
+	if enrollment.Locked(now) {
+		return denied(decision.Trace, stepUpCheck, fmt.Sprintf("the device is locked out of step-up until %s after too many wrong codes", enrollment.LockedUntil.UTC().Format(time.RFC3339)))
+	}
+	if !verify {
+		decision.Trace = append(decision.Trace, authorization.TraceStep{Check: stepUpCheck, Passed: true, Detail: "needs a fresh code from the device's authenticator app"})
+		return decision
+	}
+	stepUp := func(reason string) authorization.Decision {
+		denial := denied(decision.Trace, stepUpCheck, reason)
+		denial.NeedsStepUp = true
+		return denial
+	}
+	if request.StepUpCode == "" {
+		return stepUp(fmt.Sprintf("%s needs a TOTP code", service.Name))
+	}
+	counter, ok, err := totp.Validate(enrollment.Secret, request.StepUpCode, now, enrollment.LastCounter)
+	if err != nil {
+		slog.Error("Authorization", slog.Any("Error checking TOTP code", err))
+		return denied(decision.Trace, stepUpCheck, "error checking the TOTP code")
+	}
+	if !ok {
+		enrollment.Failures++
+		reason := "wrong or already used TOTP code"
+		locked := enrollment.Failures >= MaxStepUpFailures
+		if locked {
+			enrollment.Failures = 0
+			enrollment.LockedUntil = now.Add(StepUpLockout)
+			reason = fmt.Sprintf("%s, the device is locked out of step-up until %s", reason, enrollment.LockedUntil.UTC().Format(time.RFC3339))
+		}
+		err := d.DB.SaveDeviceTOTP(*enrollment)
+		if err != nil {
+			slog.Error("Authorization", slog.Any("Error saving TOTP enrollment", err))
+		}
+		if locked {
+			slog.Warn("Step-up Authentication", slog.String("Locked out device", request.DeviceID), slog.String("until", enrollment.LockedUntil.String()))
+			d.recordStepUpLockout(request, enrollment)
+			return denied(decision.Trace, stepUpCheck, reason)
+		}
+		return stepUp(reason)
+	}
+	enrollment.LastCounter = counter
+	enrollment.Failures = 0
+	err = d.DB.SaveDeviceTOTP(*enrollment)
+	if err != nil {
+		slog.Error("Authorization", slog.Any("Error saving TOTP enrollment", err))
+		return denied(decision.Trace, stepUpCheck, "error saving the TOTP enrollment")
+	}
+	if d.stepUps.stepped == nil {
+		d.stepUps.stepped = make(map[string]time.Time)
+	}
+	d.stepUps.stepped[request.DeviceID] = now
+	decision.Trace = append(decision.Trace, authorization.TraceStep{Check: stepUpCheck, Passed: true, Detail: "fresh TOTP code"})
+	return decision
+}
+
+func (d *Drawbridge) recordStepUpLockout(request AccessRequest, enrollment *emissary.TOTPEnrollment) {
+	id, err := utils.NewUUID()
+	if err != nil {
+		slog.Error("Step-up Authentication", slog.Any("Error", err))
+	}
+	d.EventSinkDispatcher.Publish(sinks.Event{
+		ID:            id,
+		Type:          sinks.TypeStepUpLockout,
+		Timestamp:     time.Now().UTC(),
+		DeviceID:      request.DeviceID,
+		ConnectionIP:  request.ConnectionIP,
+		TargetService: utils.PadWithZeros(int(request.ServiceID)),
+		Reason:        fmt.Sprintf("%d wrong TOTP codes in a row", MaxStepUpFailures),
+		Details:       map[string]string{"locked_until": enrollment.LockedUntil.UTC().Format(time.RFC3339)},
+	})
+}
+
+// The TOTP code sent after the Protected Service id in PS_CONN <id> <code>, or an empty string.
+func stepUpCode(payload string) string {
+	if len(payload) <= 12 || payload[11] != ' ' {
+		return ""
+	}
+	code, _, _ := strings.Cut(strings.TrimSpace(payload[12:]), " ")
+	if _, err := strconv.Atoi(code); err != nil || len(code) != totp.Digits {
+		return ""
+	}
+	return code
+}
@@ -0,0 +1,117 @@
+package drawbridge
+
+import (
+	"imdawon/drawbridge/cmd/drawbridge/emissary"
+	"imdawon/drawbridge/cmd/drawbridge/persistence"
+	"imdawon/drawbridge/cmd/drawbridge/services"
+	"imdawon/drawbridge/cmd/drawbridge/totp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStepUp(t *testing.T) {
+	db := persistence.NewMemoryRepository()
+	d := &Drawbridge{DB: db}
+	db.CreateNewEmissaryClient(emissary.EmissaryClient{ID: "laptop", Name: "Brave Otter", DrawbridgeCertificate: "cert-1"})
+	nas, _ := db.CreateNewService(services.ProtectedService{Name: "NAS SSH", RequireStepUp: true})
+	plex, _ := db.CreateNewService(services.ProtectedService{Name: "Plex"})
+
+	now := time.Now()
+	connect := func(code string, at time.Time) (allowed, needsStepUp bool, reason string) {
+		decision := d.AuthorizeConnection(AccessRequest{DeviceID: "laptop", ServiceID: nas.ID, ConnectionIP: "192.168.1.20:50000", Time: at, StepUpCode: code})
+		return decision.Allowed, decision.NeedsStepUp, decision.Reason
+	}
+	if allowed, needsStepUp, reason := connect("", now); allowed || needsStepUp || !strings.Contains(reason, "isn't enrolled") {
+		t.Errorf("expected a device that isn't enrolled to be denied, got %t %t %q", allowed, needsStepUp, reason)
+	}
+	if decision := d.AuthorizeProtectedServiceConnection("laptop", "192.168.1.20:50000", plex.ID); !decision.Allowed {
+		t.Errorf("expected services that don't require step-up to let the device in, got %+v", decision)
+	}
+
+	enrollment, uri, err := d.EnrollTOTP("laptop")
+	if err != nil {
+		t.Fatalf("EnrollTOTP failed: %v", err)
+	}
+	if !strings.HasPrefix(uri, "otpauth://totp/Drawbridge:Brave%20Otter?") {
+		t.Errorf("expected an otpauth URI labelled with the device name, got %s", uri)
+	}
+	if allowed, _, _ := connect("", now); allowed {
+		t.Error("expected an enrollment that isn't confirmed to deny the device")
+	}
+	if _, err := d.ConfirmTOTP("laptop", "000000"); err == nil {
+		t.Error("expected ConfirmTOTP to refuse a wrong code")
+	}
+	confirmation, _ := totp.Code(enrollment.Secret, totp.Counter(now)-1)
+	if _, err := d.ConfirmTOTP("laptop", confirmation); err != nil {
+		t.Fatalf("ConfirmTOTP failed: %v", err)
+	}
+
+	if allowed, needsStepUp, reason := connect("", now); allowed || !needsStepUp || reason != "NAS SSH needs a TOTP code" {
+		t.Errorf("expected the device to be asked for a code, got %t %t %q", allowed, needsStepUp, reason)
+	}
+	if allowed, _, _ := connect(confirmation, now); allowed {
+		t.Error("expected the code used to confirm the enrollment to be refused")
+	}
+	code, _ := totp.Code(enrollment.Secret, totp.Counter(now))
+	if allowed, _, reason := connect(code, now); !allowed {
+		t.Fatalf("expected a fresh code to let the device in, got %q", reason)
+	}
+	if allowed, _, _ := connect("", now.Add(10*time.Minute)); !allowed {
+		t.Error("expected the step-up to be remembered for the step-up cache")
+	}
+	if allowed, needsStepUp, _ := connect(code, now.Add(20*time.Minute)); allowed || !needsStepUp {
+		t.Error("expected a used code to be refused once the step-up cache ran out")
+	}
+
+	d.SaveStepUpCache(0)
+	later := now.Add(time.Hour)
+	// The used code above was the first wrong code in a row.
+	for i := 2; i < MaxStepUpFailures; i++ {
+		if allowed, needsStepUp, _ := connect("123456", later); allowed || !needsStepUp {
+			t.Fatalf("expected wrong code %d to ask for another code", i)
+		}
+	}
+	if allowed, needsStepUp, reason := connect("123456", later); allowed || needsStepUp || !strings.Contains(reason, "locked out") {
+		t.Errorf("expected too many wrong codes to lock the device out, got %t %t %q", allowed, needsStepUp, reason)
+	}
+	fresh, _ := totp.Code(enrollment.Secret, totp.Counter(later))
+	if allowed, _, _ := connect(fresh, later); allowed {
+		t.Error("expected a locked out device to be denied even with the right code")
+	}
+	simulation := d.SimulateAccess(AccessRequest{DeviceID: "laptop", ServiceID: nas.ID, ConnectionIP: "192.168.1.20:50000", Time: later})
+	if simulation.Allowed || !strings.Contains(simulation.Reason, "locked out") {
+		t.Errorf("expected the simulator to show the lockout, got %+v", simulation)
+	}
+	if err := d.UnlockTOTP("laptop"); err != nil {
+		t.Fatalf("UnlockTOTP failed: %v", err)
+	}
+	if allowed, _, reason := connect(fresh, later); !allowed {
+		t.Errorf("expected the right code to let the device in once unlocked, got %q", reason)
+	}
+	if allowed, _, _ := connect("", later); allowed {
+		t.Error("expected a step-up cache of 0 to ask for a code on every connection")
+	}
+
+	if err := d.RemoveTOTP("laptop"); err != nil {
+		t.Fatalf("RemoveTOTP failed: %v", err)
+	}
+	if allowed, _, _ := connect(fresh, later); allowed {
+		t.Error("expected the device to be denied once its enrollment was removed")
+	}
+}
+
+func TestStepUpCode(t *testing.T) {
+	payloads := map[string]string{
+		"PS_CONN 004":            "",
+		"PS_CONN 004 123456\n":   "123456",
+		"PS_CONN 004 12345":      "",
+		"PS_CONN 004 abcdef":     "",
+		"PS_CONN 004 654321 xyz": "654321",
+	}
+	for payload, want := range payloads {
+		if got := stepUpCode(payload); got != want {
+			t.Errorf("%q: got %q, wanted %q", payload, got, want)
+		}
+	}
+}
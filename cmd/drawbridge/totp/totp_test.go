@@ -0,0 +1,52 @@
+package totp
+
+import (
+	"encoding/base32"
+	"testing"
+	"time"
+)
+
+// The SHA-1 test vectors from RFC 6238, appendix B, cut to 6 digits.
+func TestCode(t *testing.T) {
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+	vectors := map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1111111111:  "050471",
+		1234567890:  "005924",
+		2000000000:  "279037",
+		20000000000: "353130",
+	}
+	for unix, want := range vectors {
+		got, err := Code(secret, Counter(time.Unix(unix, 0)))
+		if err != nil || got != want {
+			t.Errorf("at %d: got %s (%v), wanted %s", unix, got, err, want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatalf("GenerateSecret failed: %v", err)
+	}
+	now := time.Unix(1733173200, 0)
+	previous, _ := Code(secret, Counter(now)-1)
+	counter, ok, err := Validate(secret, previous, now, 0)
+	if err != nil || !ok || counter != Counter(now)-1 {
+		t.Errorf("expected the previous period's code to be accepted, got %d %t %v", counter, ok, err)
+	}
+	if _, ok, _ := Validate(secret, previous, now, counter); ok {
+		t.Error("expected a code to be refused once it has been used")
+	}
+	stale, _ := Code(secret, Counter(now)-2)
+	if _, ok, _ := Validate(secret, stale, now, 0); ok {
+		t.Error("expected a code from two periods ago to be refused")
+	}
+	if _, ok, _ := Validate(secret, "12345", now, 0); ok {
+		t.Error("expected a short code to be refused")
+	}
+	if uri := URI("Drawbridge", "Brave Otter", "ABC"); uri != "otpauth://totp/Drawbridge:Brave%20Otter?algorithm=SHA1&digits=6&issuer=Drawbridge&period=30&secret=ABC" {
+		t.Errorf("got %s", uri)
+	}
+}
@@ -7,6 +7,8 @@ type CommandLineArgs struct {
 	SqliteFilename         string
 	Env                    string
 	NoGUI                  string
+	KeyFile                string // File containing the passphrase that encrypts the certificate authority and server keys.
+	ConfigFile             string // YAML or TOML file declaring services, devices and settings, see `drawbridge plan`.
 }
 
 var FLAGS *CommandLineArgs
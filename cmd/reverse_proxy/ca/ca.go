@@ -1,17 +1,17 @@
 package certificates
 
 import (
-	"bytes"
 	"crypto"
 	"crypto/ecdsa"
-	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/hex"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"imdawon/drawbridge/cmd/drawbridge/emissary"
 	"imdawon/drawbridge/cmd/drawbridge/persistence"
@@ -21,6 +21,7 @@ import (
 	"math/big"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -31,23 +32,50 @@ import (
 // - On startup we read all certificates from the devices table and load them all into this map.
 type CertificateList map[string]emissary.DeviceCertificate
 
+// The storage the certificate authority reads its settings and Emissary device certificates from.
+type Repository interface {
+	persistence.ConfigRepository
+	persistence.CertificateRepository
+}
+
 type CA struct {
-	CertPool                                 *x509.CertPool
-	ClientTLSConfig                          *tls.Config
-	ServerTLSConfig                          *tls.Config
-	CertificateAuthority                     *x509.Certificate
-	PrivateKey                               crypto.PrivateKey
-	DB                                       *persistence.SQLiteRepository
+	CertPool        *x509.CertPool
+	ClientTLSConfig *tls.Config
+	ServerTLSConfig *tls.Config
+	// The root certificate authority Emissary clients pin.
+	CertificateAuthority *x509.Certificate
+	// The root certificate authority key. Nil once the Drawbridge admin has taken it offline.
+	PrivateKey crypto.Signer
+	// The online certificate authority that issues server and Emissary device certificates.
+	// Nil on installs that still issue every certificate from the root certificate authority.
+	Intermediate           *x509.Certificate
+	IntermediatePrivateKey crypto.Signer
+	// Certificates between an imported intermediate certificate authority and the root, if any.
+	intermediateChain                        []*x509.Certificate
+	DB                                       Repository
 	EmissaryDeviceCertificatesWhitelist      CertificateList
 	EmissaryDeviceCertificatesWhitelistMutex sync.RWMutex
+	// Set while the certificate authority is being rotated. Both the previous and current certificate
+	// authorities are trusted until the rotation deadline.
+	Rotation *Rotation
+	// The TLS config handed out for each new Emissary handshake. See applyTLSConfig.
+	currentServerTLSConfig atomic.Pointer[tls.Config]
+	// Encrypts the private keys on disk when set. See keyencryption.go.
+	keyPassphrase []byte
+	// Set while the private keys on disk are encrypted and we don't have the key passphrase.
+	locked atomic.Bool
+	// Held while Rotation, the certificate authorities and their keys are replaced. Code reading them while Emissary
+	// clients are being served holds the read lock, since a rotation finishes from its deadline timer.
+	rotationMutex sync.RWMutex
+	rotationTimer *time.Timer
 }
 
 // When we create an Emissary device, we save the sha256 hash of the certificate for the device and add it to the certificate whitelist
 func (c *CA) SetEmissaryCertificateToCertificateList(certBytes []byte, emissaryDeviceCertificate emissary.DeviceCertificate) {
 	hexHash := HashEmissaryCertificate(certBytes)
-	c.EmissaryDeviceCertificatesWhitelistMutex.RLock()
+	c.EmissaryDeviceCertificatesWhitelistMutex.Lock()
 	c.EmissaryDeviceCertificatesWhitelist[hexHash] = emissaryDeviceCertificate
-	c.EmissaryDeviceCertificatesWhitelistMutex.RUnlock()
+	c.EmissaryDeviceCertificatesWhitelistMutex.Unlock()
 }
 
 func (c *CA) GetCertificateFromCertificateList(hexHash string) (emissary.DeviceCertificate, bool) {
@@ -60,68 +88,65 @@ func (c *CA) GetCertificateFromCertificateList(hexHash string) (emissary.DeviceC
 
 var CertificateAuthority *CA
 
-func (c *CA) SetupCertificates() error {
-	caCertContents := utils.ReadFile("ca/ca.crt")
-	caPrivKeyContents := utils.ReadFile("ca/ca.key")
-	serverCertExists := utils.FileExists("ca/server-cert.crt")
-	serverKeyExists := utils.FileExists("ca/server-key.key")
+// Files that make up the Drawbridge certificate authority, relative to the Drawbridge binary.
+const (
+	caCertificatePath     = "ca/ca.crt"
+	caKeyPath             = "ca/ca.key"
+	serverCertificatePath = "ca/server-cert.crt"
+	serverKeyPath         = "ca/server-key.key"
+)
 
-	caCertPath := utils.CreateDrawbridgeFilePath("./ca/ca.crt")
-	caKeyPath := utils.CreateDrawbridgeFilePath("./ca/ca.key")
-	serverCertPath := utils.CreateDrawbridgeFilePath("./ca/server-cert.crt")
-	serverKeyPath := utils.CreateDrawbridgeFilePath("./ca/server-key.key")
+func (c *CA) SetupCertificates() error {
+	caCertExists := utils.FileExists(caCertificatePath)
+	caPrivKeyExists := utils.FileExists(caKeyPath)
+	intermediateExists := utils.FileExists(intermediateCertificatePath) && utils.FileExists(intermediateKeyPath)
+	serverCertExists := utils.FileExists(serverCertificatePath)
+	serverKeyExists := utils.FileExists(serverKeyPath)
 
 	// Avoid generating new certificates and keys because we already have. Return TLS configs with the existing files.
-	if caCertContents != nil && serverCertExists && serverKeyExists && caPrivKeyContents != nil {
+	// The root key is missing if the Drawbridge admin took it offline, in which case the intermediate issues every certificate.
+	if caCertExists && (caPrivKeyExists || intermediateExists) && serverCertExists && serverKeyExists {
 		slog.Info("TLS Certs & Keys already exist. Loading them from disk...")
-		certpool := x509.NewCertPool()
-		certpool.AppendCertsFromPEM(*caCertContents)
-
-		// Combine the keypair for the CA certificate
-		caCert, err := tls.LoadX509KeyPair(caCertPath, caKeyPath)
-		if err != nil {
-			log.Fatal("Error loading CA cert and key files: ", err)
-		}
-		c.PrivateKey = caCert.PrivateKey
 
-		// We have to decode the certificate into the ASN.1 DER format before attempting to parse it.
-		// Otherwise, we will error out when parsing.
-		block, _ := pem.Decode(*caCertContents)
-		if block == nil || block.Type != "CERTIFICATE" {
-			log.Fatal("failed to decode PEM block containing CERTIFICATE")
-		}
-		c.CertificateAuthority, err = x509.ParseCertificate(block.Bytes)
+		var err error
+		c.CertificateAuthority, err = readCertificateFile(caCertificatePath)
 		if err != nil {
 			log.Fatal("Error parsing CA cert: ", err)
 		}
-
-		// Read the key pair to create certificate
-		serverCert, err := tls.LoadX509KeyPair(serverCertPath, serverKeyPath)
-		if err != nil {
-			log.Fatal("Error loading server cert and key files: ", err)
+		if intermediateExists {
+			err = c.loadIntermediateCertificate()
+			if err != nil {
+				log.Fatal("Error loading intermediate CA cert: ", err)
+			}
 		}
 
-		c.ServerTLSConfig = &tls.Config{
-			Certificates: []tls.Certificate{serverCert},
-			ClientCAs:    certpool,
-			ClientAuth:   tls.RequireAndVerifyClientCert,
-			MinVersion:   tls.VersionTLS13,
-			// Ensure device cert is valid during handshake
-			VerifyPeerCertificate: c.verifyEmissaryCertificate,
-		}
-		c.ClientTLSConfig = &tls.Config{
-			RootCAs:      certpool,
-			Certificates: []tls.Certificate{serverCert},
-			MinVersion:   tls.VersionTLS13,
+		// Pick up a certificate authority rotation that was in progress when Drawbridge was last stopped.
+		err = c.loadRotation()
+		if err != nil {
+			return err
 		}
 
 		// Populate the certificate authority's list of emissary certificates.
 		// Is used to lookup emissary client certs for revocation status to allow deny access to Drawbridge.
-		emissaryClientCertificates, err := c.DB.GetAllEmissaryClientCertificates()
+		err = c.loadEmissaryCertificates()
 		if err != nil {
 			return err
 		}
-		c.EmissaryDeviceCertificatesWhitelist = emissaryClientCertificates
+
+		// Encrypted private keys stay locked until the Drawbridge admin provides the key passphrase.
+		err = c.loadPrivateKeys()
+		if errors.Is(err, ErrCertificateAuthorityLocked) || errors.Is(err, ErrIncorrectKeyPassphrase) {
+			if errors.Is(err, ErrIncorrectKeyPassphrase) {
+				slog.Error("Certificate Authority", slog.String("Error", "the key passphrase is incorrect"))
+			}
+			c.keyPassphrase = nil
+			c.locked.Store(true)
+			slog.Warn("Certificate Authority", slog.String("Locked", "unlock the certificate authority in the Drawbridge Dashboard to accept Emissary connections"))
+			return ErrCertificateAuthorityLocked
+		}
+		if err != nil {
+			log.Fatal("Error loading private keys: ", err)
+		}
 
 		// Terminate function early as we have all of the cert and key data we need.
 		slog.Info("Loaded TLS Certs & Keys")
@@ -135,18 +160,64 @@ func (c *CA) SetupCertificates() error {
 	if err != nil {
 		slog.Error("Database", slog.Any("Error: %s", err))
 	}
-	isLAN := drawbridgeListeningAddressIsLAN(net.ParseIP(*listeningAddress))
-	slog.Debug("Drawbridge listening address type", slog.Bool("isLAN", isLAN))
 	// CA Cert, Server Cert, and Server key do not exist yet. We will generate them now, and save them to disk for reuse.
 	// 1. Set up our CA certificate
+	ca, caPrivKey, err := newCertificateAuthority(*listeningAddress, "", c.KeyAlgorithm(CertificateTypeCertificateAuthority))
+	if err != nil {
+		return err
+	}
+	err = c.saveCertificateAuthority(nil, ca, caPrivKey)
+	if err != nil {
+		return err
+	}
+	// Store the CA certificate and private key in our CA struct for use later during runtime.
+	c.CertificateAuthority = ca
+	c.PrivateKey = caPrivKey
+
+	// 2. Set up our intermediate certificate authority. It issues every other certificate so the root key can be taken offline.
+	intermediateKey, err := c.KeyAlgorithm(CertificateTypeCertificateAuthority).GenerateKey()
+	if err != nil {
+		return err
+	}
+	intermediate, err := newIntermediateCertificateAuthority(ca, caPrivKey, intermediateKey)
+	if err != nil {
+		return err
+	}
+	err = c.saveIntermediate(nil, intermediate, nil, intermediateKey)
+	if err != nil {
+		return err
+	}
+	c.Intermediate = intermediate
+	c.IntermediatePrivateKey = intermediateKey
+
+	// 3. Set up our server certificate
+	serverCert, err := c.createServerCertificate(nil, *listeningAddress)
+	if err != nil {
+		return err
+	}
+	c.applyTLSConfig(serverCert)
+
+	c.EmissaryDeviceCertificatesWhitelist = make(map[string]emissary.DeviceCertificate, 0)
+
+	return nil
+}
+
+// Returns the certificate template shared by the certificate authority and the server certificate.
+// Listen on all interfaces if the listening address isn't an IANA private IPv4 address e.g if the user
+// uses their WAN IP address.
+// Otherwise we only listen on the LAN address and local loopback network as the user wants.
+func newCertificateTemplate(listeningAddress string) (*x509.Certificate, error) {
+	isLAN := drawbridgeListeningAddressIsLAN(net.ParseIP(listeningAddress))
+	slog.Debug("Drawbridge listening address type", slog.Bool("isLAN", isLAN))
+
 	// Generate a random serial number for the certificate
-	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	serialNumber, err := newSerialNumber()
 	if err != nil {
-		return fmt.Errorf("failed to generate serial number: %w", err)
+		return nil, err
 	}
 
-	ca := x509.Certificate{
-		DNSNames:     []string{*listeningAddress, "localhost"},
+	template := &x509.Certificate{
+		DNSNames:     []string{listeningAddress, "localhost"},
 		SerialNumber: serialNumber,
 		Subject: pkix.Name{
 			Organization:  []string{"Drawbridge"},
@@ -156,90 +227,153 @@ func (c *CA) SetupCertificates() error {
 			StreetAddress: []string{""},
 			PostalCode:    []string{""},
 		},
-		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback, net.ParseIP(*listeningAddress)},
-		NotBefore:             time.Now(),
-		NotAfter:              time.Now().AddDate(10, 0, 0),
-		IsCA:                  true,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
-		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
-		BasicConstraintsValid: true,
-	}
-
-	// Listen on all interfaces if the listening address isn't an IANA private IPv4 address e.g if the user
-	// uses their WAN IP address.
-	// Otherwise we only listen on the LAN address and local loopback network as the user wants.
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback, net.ParseIP(listeningAddress)},
+		NotBefore:   time.Now(),
+		NotAfter:    time.Now().AddDate(10, 0, 0),
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+	}
+
 	if !isLAN {
 		ips, err := utils.GetDeviceIPs()
 		if err != nil {
-			return err
+			return nil, err
 		}
-		ca.IPAddresses = append(ca.IPAddresses, ips...)
-		slog.Debug("Certificates and Keys", slog.String("CA Allowed IP Addresses", fmt.Sprintf("%s", ca.IPAddresses)))
+		template.IPAddresses = append(template.IPAddresses, ips...)
+		slog.Debug("Certificates and Keys", slog.String("Allowed IP Addresses", fmt.Sprintf("%s", template.IPAddresses)))
+	}
+	return template, nil
+}
 
+func newSerialNumber() (*big.Int, error) {
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate serial number: %w", err)
 	}
+	return serialNumber, nil
+}
 
-	c.CertificateAuthority = &ca
+// Creates a new self-signed certificate authority and its private key.
+// A commonName is set when rotating the certificate authority so the old and new authorities can be told apart.
+func newCertificateAuthority(listeningAddress, commonName string, algorithm KeyAlgorithm) (*x509.Certificate, crypto.Signer, error) {
+	template, err := newCertificateTemplate(listeningAddress)
+	if err != nil {
+		return nil, nil, err
+	}
+	template.Subject.CommonName = commonName
+	template.IsCA = true
+	template.KeyUsage = x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign
+	template.BasicConstraintsValid = true
 
 	// Create our private and public key for the Certificate Authority.
-	caPrivKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	caPrivKey, err := algorithm.GenerateKey()
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
 	// Create the CA
-	caBytes, err := x509.CreateCertificate(rand.Reader, &ca, &ca, &caPrivKey.PublicKey, caPrivKey)
+	caBytes, err := x509.CreateCertificate(rand.Reader, template, template, caPrivKey.Public(), caPrivKey)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
+	ca, err := x509.ParseCertificate(caBytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ca, caPrivKey, nil
+}
 
-	// PEM encode
-	caPEM := new(bytes.Buffer)
-	pem.Encode(caPEM, &pem.Block{
-		Type:  "CERTIFICATE",
-		Bytes: caBytes,
-	})
-
-	err = utils.SaveFile("ca.crt", caPEM.String(), "ca")
+// Writes the certificate authority certificate and key to the ca folder, replacing any existing files.
+// A nil key removes the key file, e.g. when the Drawbridge admin imports an intermediate without its root key.
+func (c *CA) saveCertificateAuthority(files *stagedFiles, ca *x509.Certificate, caPrivKey crypto.Signer) error {
+	caPEM := encodeCertificate(ca.Raw)
+	err := files.replaceFile(caCertificatePath, caPEM, 0644)
 	if err != nil {
 		return err
 	}
 	// Save to Emissary certs and key folder so we don't have to do it on-demand when a Drawbridge admin generates a cert and key.
-	err = utils.SaveFile("ca.crt", caPEM.String(), "./emissary_certs_and_key_here")
+	err = files.replaceFile("emissary_certs_and_key_here/ca.crt", caPEM, 0644)
 	if err != nil {
 		return err
 	}
 
-	caPrivKeyPEMBytes, err := x509.MarshalECPrivateKey(caPrivKey)
+	if caPrivKey == nil {
+		return utils.DeleteFile(caKeyPath)
+	}
+	caPrivKeyPEM, err := c.encodePrivateKeyForDisk(caPrivKey)
 	if err != nil {
 		return err
 	}
+	return files.replaceFile(caKeyPath, caPrivKeyPEM, 0600)
+}
 
-	caPrivKeyPEM := new(bytes.Buffer)
-	pem.Encode(caPrivKeyPEM, &pem.Block{
-		Type:  "EC PRIVATE KEY",
-		Bytes: caPrivKeyPEMBytes,
-	})
-	err = utils.SaveFile("ca.key", caPrivKeyPEM.String(), "ca")
+// Creates a server certificate signed by the current certificate authority and saves it to disk,
+// replacing the previous server certificate.
+func (c *CA) createServerCertificate(files *stagedFiles, listeningAddress string) (tls.Certificate, error) {
+	issuer, issuerKey, err := c.issuer()
 	if err != nil {
-		return err
+		return tls.Certificate{}, err
+	}
+	cert, err := newCertificateTemplate(listeningAddress)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	cert.SubjectKeyId = []byte{1, 2, 3, 4, 6}
+	err = c.addStandbyListeningAddress(cert)
+	if err != nil {
+		return tls.Certificate{}, err
 	}
 
-	serverCert, err := tls.X509KeyPair(caPEM.Bytes(), caPrivKeyPEM.Bytes())
+	certPrivKey, err := c.KeyAlgorithm(CertificateTypeServer).GenerateKey()
 	if err != nil {
-		return err
+		return tls.Certificate{}, err
+	}
+	cert.KeyUsage = leafKeyUsage(certPrivKey)
+
+	// Create the server certificate and sign it with our CA.
+	certBytes, err := x509.CreateCertificate(rand.Reader, cert, issuer, certPrivKey.Public(), issuerKey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	certPEM := encodeCertificate(certBytes)
+	err = files.replaceFile(serverCertificatePath, certPEM, 0644)
+	if err != nil {
+		return tls.Certificate{}, err
 	}
 
-	// 2. Set up our server certificate
-	// Generate a different random serial number for the server cert
-	serverSerialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	certPrivKeyPEM, err := EncodePrivateKey(certPrivKey)
 	if err != nil {
-		return fmt.Errorf("failed to generate server serial number: %w", err)
+		return tls.Certificate{}, err
+	}
+	certPrivKeyDiskPEM, err := c.encodePrivateKeyForDisk(certPrivKey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	err = files.replaceFile(serverKeyPath, certPrivKeyDiskPEM, 0600)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.X509KeyPair(certPEM, certPrivKeyPEM)
+}
+
+// Issues a new mTLS certificate for an Emissary device, signed by the current certificate authority.
+// The private key is generated with algorithm, see DeviceKeyAlgorithm.
+// Returns the PEM-encoded certificate and the private key so the caller can encode the key for the device platform.
+// The certificate doesn't include the chain, see CertificateChainPEM.
+func (c *CA) IssueEmissaryCertificate(deviceID, commonName string, algorithm KeyAlgorithm) ([]byte, crypto.Signer, error) {
+	issuer, issuerKey, err := c.issuer()
+	if err != nil {
+		return nil, nil, err
+	}
+	serialNumber, err := newSerialNumber()
+	if err != nil {
+		return nil, nil, err
 	}
 
-	cert := &x509.Certificate{
-		SerialNumber: serverSerialNumber,
+	clientCert := &x509.Certificate{
+		SerialNumber: serialNumber,
 		// TODO: Must be domain name or IP during user dash setup
-		DNSNames: []string{*listeningAddress, "localhost"},
 		Subject: pkix.Name{
 			Organization:  []string{"Drawbridge"},
 			Country:       []string{""},
@@ -247,88 +381,238 @@ func (c *CA) SetupCertificates() error {
 			Locality:      []string{""},
 			StreetAddress: []string{""},
 			PostalCode:    []string{""},
+			CommonName:    commonName,
+			SerialNumber:  deviceID,
 		},
-		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback, net.ParseIP(*listeningAddress)},
 		NotBefore:    time.Now(),
 		NotAfter:     time.Now().AddDate(10, 0, 0),
 		SubjectKeyId: []byte{1, 2, 3, 4, 6},
-		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
-		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
 	}
 
-	// Listen on all interfaces if the listening address isn't an IANA private IPv4 address e.g if the user
-	// uses their WAN IP address.
-	// Otherwise we only listen on the LAN address and local loopback network as the user wants.
-	if !isLAN {
-		ips, err := utils.GetDeviceIPs()
-		if err != nil {
-			return err
-		}
-		cert.IPAddresses = append(ca.IPAddresses, ips...)
-		slog.Debug("Certificates and Keys", slog.String("Server Certificate Allowed IP Addresses", fmt.Sprintf("%s", ca.IPAddresses)))
-	}
-
-	certPrivKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	clientCertPrivKey, err := algorithm.GenerateKey()
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
-
-	// Create the server certificate and sign it with our CA.
-	certBytes, err := x509.CreateCertificate(rand.Reader, cert, &ca, &certPrivKey.PublicKey, caPrivKey)
+	clientCert.KeyUsage = leafKeyUsage(clientCertPrivKey)
+
+	// Create the client certificate and sign it with our CA private key.
+	clientCertBytes, err := x509.CreateCertificate(
+		rand.Reader,
+		clientCert,
+		issuer,
+		clientCertPrivKey.Public(),
+		issuerKey,
+	)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
-	certPEM := new(bytes.Buffer)
-	pem.Encode(certPEM, &pem.Block{
+	return encodeCertificate(clientCertBytes), clientCertPrivKey, nil
+}
+
+func encodeCertificate(der []byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{
 		Type:  "CERTIFICATE",
-		Bytes: certBytes,
+		Bytes: der,
 	})
-	err = utils.SaveFile("server-cert.crt", certPEM.String(), "ca")
+}
+
+// PEM-encodes a private key for Drawbridge keys on disk. ECDSA keys use the EC PRIVATE KEY format,
+// RSA keys use the RSA PRIVATE KEY format, and any other key, e.g. from an imported certificate authority, uses PKCS8.
+func EncodePrivateKey(key crypto.Signer) ([]byte, error) {
+	switch privateKey := key.(type) {
+	case *ecdsa.PrivateKey:
+		keyBytes, err := x509.MarshalECPrivateKey(privateKey)
+		if err != nil {
+			return nil, err
+		}
+		return pem.EncodeToMemory(&pem.Block{
+			Type:  "EC PRIVATE KEY",
+			Bytes: keyBytes,
+		}), nil
+	case *rsa.PrivateKey:
+		return pem.EncodeToMemory(&pem.Block{
+			Type:  "RSA PRIVATE KEY",
+			Bytes: x509.MarshalPKCS1PrivateKey(privateKey),
+		}), nil
+	}
+	keyBytes, err := x509.MarshalPKCS8PrivateKey(key)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "PRIVATE KEY",
+		Bytes: keyBytes,
+	}), nil
+}
+
+// Parses a PEM-encoded private key in any of the formats Drawbridge writes.
+func parsePrivateKey(keyPEM []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, fmt.Errorf("failed to decode PEM block containing private key")
+	}
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("unsupported private key type %T", key)
+		}
+		return signer, nil
 	}
+	return nil, fmt.Errorf("unsupported private key PEM block %s", block.Type)
+}
 
-	certPrivKeyPEMBytes, err := x509.MarshalECPrivateKey(certPrivKey)
+func (c *CA) readPrivateKeyFile(pathWithFilename string) (crypto.Signer, error) {
+	contents := utils.ReadFile(pathWithFilename)
+	if contents == nil {
+		return nil, fmt.Errorf("unable to read %s", pathWithFilename)
+	}
+	keyPEM, err := c.decryptPrivateKeyPEM(*contents)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	key, err := parsePrivateKey(keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", pathWithFilename, err)
 	}
+	return key, nil
+}
 
-	certPrivKeyPEM := new(bytes.Buffer)
-	pem.Encode(certPrivKeyPEM, &pem.Block{
-		Type:  "EC PRIVATE KEY",
-		Bytes: certPrivKeyPEMBytes,
-	})
+// Reads the certificate authority and server private keys from disk and starts serving TLS with them.
+func (c *CA) loadPrivateKeys() error {
+	var rootKey, intermediateKey crypto.Signer
+	var err error
+	if utils.FileExists(caKeyPath) {
+		rootKey, err = c.readPrivateKeyFile(caKeyPath)
+		if err != nil {
+			return err
+		}
+	}
+	if c.Intermediate != nil {
+		intermediateKey, err = c.readPrivateKeyFile(intermediateKeyPath)
+		if err != nil {
+			return err
+		}
+		if !publicKeysEqual(intermediateKey.Public(), c.Intermediate.PublicKey) {
+			return fmt.Errorf("%s does not belong to the intermediate certificate authority", intermediateKeyPath)
+		}
+	}
 
-	err = utils.SaveFile("server-key.key", certPrivKeyPEM.String(), "ca")
+	serverCertPEM := utils.ReadFile(serverCertificatePath)
+	serverKeyPEM := utils.ReadFile(serverKeyPath)
+	if serverCertPEM == nil || serverKeyPEM == nil {
+		return fmt.Errorf("unable to read the server certificate and key")
+	}
+	serverKeyPlainPEM, err := c.decryptPrivateKeyPEM(*serverKeyPEM)
 	if err != nil {
 		return err
 	}
+	serverCert, err := tls.X509KeyPair(*serverCertPEM, serverKeyPlainPEM)
+	if err != nil {
+		return fmt.Errorf("error loading server cert and key files: %w", err)
+	}
 
-	// Store the CA private key in our CA struct for use later during runtime.
-	c.PrivateKey = caPrivKey
+	c.PrivateKey = rootKey
+	c.IntermediatePrivateKey = intermediateKey
+	c.applyTLSConfig(serverCert)
+	if c.Rotation != nil {
+		c.scheduleRotationDeadline()
+	}
+	return nil
+}
 
+// Builds the TLS configs used by the Drawbridge tunnel and stores them on the CA.
+// The listener is handed ServerTLSConfig once, so it looks up the current config on every handshake.
+// This lets us swap the server certificate and trusted certificate authorities at runtime, e.g. during a rotation.
+func (c *CA) applyTLSConfig(serverCert tls.Certificate) {
 	certpool := x509.NewCertPool()
-	certpool.AppendCertsFromPEM(caPEM.Bytes())
+	certpool.AddCert(c.CertificateAuthority)
+	// Build the chain we present from the leaf, so a chain from a previous call is never reused.
+	chain := [][]byte{serverCert.Certificate[0]}
+	if c.Intermediate != nil {
+		// Trust the intermediate directly as well, so Emissary clients that only present their own certificate
+		// still find an acceptable certificate authority during the handshake.
+		certpool.AddCert(c.Intermediate)
+		chain = append(chain, c.Intermediate.Raw)
+		for _, cert := range c.intermediateChain {
+			chain = append(chain, cert.Raw)
+		}
+	}
+	if c.Rotation != nil {
+		// Trust device certificates issued by the previous certificate authority and present the cross-signed
+		// certificate so Emissary clients pinning the previous certificate authority can still verify us.
+		certpool.AddCert(c.Rotation.PreviousCertificateAuthority)
+		if c.Rotation.PreviousIntermediate != nil {
+			certpool.AddCert(c.Rotation.PreviousIntermediate)
+		}
+		chain = append(chain, c.Rotation.CrossCertificate.Raw)
+	}
+	serverCert.Certificate = chain
+	c.CertPool = certpool
 
-	c.ServerTLSConfig = &tls.Config{
+	c.currentServerTLSConfig.Store(&tls.Config{
 		Certificates: []tls.Certificate{serverCert},
 		ClientCAs:    certpool,
 		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS13,
 		// Ensure device cert is valid during handshake
 		VerifyPeerCertificate: c.verifyEmissaryCertificate,
+	})
+	if c.ServerTLSConfig == nil {
+		c.ServerTLSConfig = &tls.Config{
+			MinVersion: tls.VersionTLS13,
+			GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+				return c.currentServerTLSConfig.Load(), nil
+			},
+		}
 	}
-
 	c.ClientTLSConfig = &tls.Config{
 		RootCAs:      certpool,
 		Certificates: []tls.Certificate{serverCert},
+		MinVersion:   tls.VersionTLS13,
 	}
+}
 
-	c.EmissaryDeviceCertificatesWhitelist = make(map[string]emissary.DeviceCertificate, 0)
-
+// Loads every valid Emissary device certificate into the certificate list.
+func (c *CA) loadEmissaryCertificates() error {
+	emissaryClientCertificates, err := c.DB.GetAllEmissaryClientCertificates()
+	if err != nil {
+		return err
+	}
+	// Certificates replaced during a rotation are still accepted until the rotation deadline.
+	supersededCertificates, err := c.DB.GetActiveSupersededCertificates()
+	if err != nil {
+		return err
+	}
+	for hash, deviceCert := range supersededCertificates {
+		emissaryClientCertificates[hash] = deviceCert
+	}
+	c.EmissaryDeviceCertificatesWhitelistMutex.Lock()
+	c.EmissaryDeviceCertificatesWhitelist = emissaryClientCertificates
+	c.EmissaryDeviceCertificatesWhitelistMutex.Unlock()
 	return nil
 }
 
+// Returns the hex-encoded SHA-256 fingerprint of the current certificate authority.
+// Emissary clients pin this certificate authority to verify they're talking to the right Drawbridge.
+func (c *CA) Fingerprint() string {
+	if c.CertificateAuthority == nil {
+		return ""
+	}
+	hash := sha256.Sum256(c.CertificateAuthority.Raw)
+	return hex.EncodeToString(hash[:])
+}
+
 // Parse the peer certificate
 func HashEmissaryCertificate(pemCert []byte) string {
 	// Calculate the SHA-256 hash of the peer certificate
@@ -337,6 +621,13 @@ func HashEmissaryCertificate(pemCert []byte) string {
 	return hexHash
 }
 
+// Returned from the TLS handshake of an Emissary connection whose device certificate isn't in the certificate list,
+// or is revoked, so the listener can tell them apart from other handshake failures.
+var (
+	ErrUnknownCertificate = errors.New("unknown certificate")
+	ErrRevokedCertificate = errors.New("peer certificate is revoked")
+)
+
 // THIS FUNCTION NEEDS TO BE FAST TO NOT DELAY HANDSHAKE
 // Run for every Drawbridge + Emissary handshake to verify the presented cert is not revoked.
 func (c *CA) verifyEmissaryCertificate(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
@@ -360,12 +651,12 @@ func (c *CA) verifyEmissaryCertificate(rawCerts [][]byte, verifiedChains [][]*x5
 	if !exists {
 		slog.Debug("unknown certificate presented", slog.String("hash", hexHash))
 		slog.Debug("hash list: %v", slog.Any("hashes:", c.EmissaryDeviceCertificatesWhitelist))
-		return fmt.Errorf("unknown certificate")
+		return ErrUnknownCertificate
 	}
 
 	if certInfo.Revoked == 1 {
 		slog.Debug("peer cert is REVOKED", slog.String("hash", hexHash))
-		return fmt.Errorf("peer certificate is revoked")
+		return ErrRevokedCertificate
 	}
 
 	// Additional certificate verification checks can be added here
@@ -378,7 +669,7 @@ func (c *CA) RevokeCertInCertificateRevocationList(shaCert string) {
 	c.EmissaryDeviceCertificatesWhitelistMutex.Lock()
 	defer c.EmissaryDeviceCertificatesWhitelistMutex.Unlock()
 
-	cert, ok := c.GetCertificateFromCertificateList(shaCert)
+	cert, ok := c.EmissaryDeviceCertificatesWhitelist[shaCert]
 	if !ok {
 		slog.Error("Unable to revoke certificate as it doesn't exist in the certificate list", slog.String("certHash", shaCert))
 		return
@@ -1,9 +1,21 @@
 package certificates
 
 import (
+	"crypto"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
 	"imdawon/drawbridge/cmd/drawbridge/emissary"
+	"imdawon/drawbridge/cmd/drawbridge/persistence"
+	"imdawon/drawbridge/cmd/utils"
 	"net"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 )
 
 // TestCASetupCertificates tests the certificate generation process
@@ -95,7 +107,7 @@ func TestVerifyEmissaryCertificate(t *testing.T) {
 
 	// Add a valid certificate
 	validCert := []byte{1, 2, 3, 4, 5}
-	validHash := HashEmissaryCertificate(validCert)
+	validHash := HashEmissaryCertificate(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: validCert}))
 	ca.EmissaryDeviceCertificatesWhitelist[validHash] = emissary.DeviceCertificate{
 		DeviceID: "valid-device",
 		Revoked:  0,
@@ -103,7 +115,7 @@ func TestVerifyEmissaryCertificate(t *testing.T) {
 
 	// Add a revoked certificate
 	revokedCert := []byte{6, 7, 8, 9, 10}
-	revokedHash := HashEmissaryCertificate(revokedCert)
+	revokedHash := HashEmissaryCertificate(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: revokedCert}))
 	ca.EmissaryDeviceCertificatesWhitelist[revokedHash] = emissary.DeviceCertificate{
 		DeviceID: "revoked-device",
 		Revoked:  1,
@@ -123,14 +135,577 @@ func TestVerifyEmissaryCertificate(t *testing.T) {
 
 	// Test with revoked certificate
 	err = ca.verifyEmissaryCertificate([][]byte{revokedCert}, nil)
-	if err == nil {
+	if !errors.Is(err, ErrRevokedCertificate) {
 		t.Errorf("revoked certificate verification should fail")
 	}
 
 	// Test with unknown certificate
 	unknownCert := []byte{11, 12, 13, 14, 15}
 	err = ca.verifyEmissaryCertificate([][]byte{unknownCert}, nil)
-	if err == nil {
+	if !errors.Is(err, ErrUnknownCertificate) {
 		t.Errorf("unknown certificate verification should fail")
 	}
 }
+
+// TestRotationTrustsBothCertificateAuthorities tests that device certificates from the previous certificate authority
+// and clients pinning it keep working until the rotation finishes.
+func TestRotationTrustsBothCertificateAuthorities(t *testing.T) {
+	db := persistence.NewSQLiteRepository(persistence.OpenDatabaseFile(filepath.Join(t.TempDir(), "drawbridge.db")))
+	if _, err := db.Migrate(); err != nil {
+		t.Fatalf("migration failed: %v", err)
+	}
+	if err := db.CreateNewDrawbridgeConfigSettings("listening_address", "127.0.0.1"); err != nil {
+		t.Fatalf("failed to save listening address: %v", err)
+	}
+	t.Cleanup(func() { utils.DeleteDirectory("ca") })
+
+	ca := &CA{DB: db}
+	if err := ca.SetupCertificates(); err != nil {
+		t.Fatalf("SetupCertificates failed: %v", err)
+	}
+	previousCA := ca.CertificateAuthority
+	oldDevicePEM, _, err := ca.IssueEmissaryCertificate("old-device", "127.0.0.1", DefaultKeyAlgorithm)
+	if err != nil {
+		t.Fatalf("IssueEmissaryCertificate failed: %v", err)
+	}
+
+	// Emissary clients keep asking about the rotation while it starts and finishes, which it can do from its
+	// deadline timer.
+	stop := make(chan struct{})
+	var readers sync.WaitGroup
+	for _, read := range []func(){
+		func() { ca.CurrentRotation() },
+		func() { ca.CurrentCertificateAuthority() },
+		func() { ca.IssuedByCurrentCertificateAuthority(string(oldDevicePEM)) },
+	} {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					read()
+				}
+			}
+		}()
+	}
+	if err := ca.StartRotation(time.Hour); err != nil {
+		t.Fatalf("StartRotation failed: %v", err)
+	}
+	if ca.CertificateAuthority.Equal(previousCA) {
+		t.Fatalf("certificate authority was not replaced")
+	}
+	if err := ca.StartRotation(time.Hour); err == nil {
+		t.Errorf("starting a second rotation should fail")
+	}
+
+	// Device certificates from the previous certificate authority are still trusted.
+	if !verifiesAgainst(t, oldDevicePEM, ca.CertPool) {
+		t.Errorf("device certificate from previous certificate authority should be trusted during rotation")
+	}
+	if ca.IssuedByCurrentCertificateAuthority(string(oldDevicePEM)) {
+		t.Errorf("device certificate from previous certificate authority reported as current")
+	}
+	newDevicePEM, _, err := ca.IssueEmissaryCertificate("new-device", "127.0.0.1", DefaultKeyAlgorithm)
+	if err != nil {
+		t.Fatalf("IssueEmissaryCertificate failed: %v", err)
+	}
+	pending := ca.DevicesPendingMigration([]*emissary.EmissaryClient{
+		{ID: "old-device", DrawbridgeCertificate: string(oldDevicePEM)},
+		{ID: "new-device", DrawbridgeCertificate: string(newDevicePEM)},
+		{ID: "revoked-device", DrawbridgeCertificate: string(oldDevicePEM), Revoked: 1},
+	})
+	if len(pending) != 1 || pending[0].ID != "old-device" {
+		t.Errorf("expected only the device still on the previous certificate authority to be pending, revoked devices aside, got %+v", pending)
+	}
+
+	// Clients that only pin the previous certificate authority can verify the new server certificate.
+	chain := ca.currentServerTLSConfig.Load().Certificates[0].Certificate
+	if len(chain) != 3 {
+		t.Fatalf("server should present the intermediate and cross-signed certificates during rotation, got chain of %d", len(chain))
+	}
+	server, _ := x509.ParseCertificate(chain[0])
+	roots := x509.NewCertPool()
+	roots.AddCert(previousCA)
+	intermediates := x509.NewCertPool()
+	for _, der := range chain[1:] {
+		cert, _ := x509.ParseCertificate(der)
+		intermediates.AddCert(cert)
+	}
+	_, err = server.Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates, DNSName: "localhost"})
+	if err != nil {
+		t.Errorf("server certificate should verify against the previous certificate authority: %v", err)
+	}
+
+	if err := ca.FinishRotation(); err != nil {
+		t.Fatalf("FinishRotation failed: %v", err)
+	}
+	close(stop)
+	readers.Wait()
+	if verifiesAgainst(t, oldDevicePEM, ca.CertPool) {
+		t.Errorf("device certificate from previous certificate authority should not be trusted after rotation")
+	}
+	if len(ca.currentServerTLSConfig.Load().Certificates[0].Certificate) != 2 {
+		t.Errorf("server should stop presenting the cross-signed certificate after rotation")
+	}
+}
+
+// Fails to save the certificate authority rotation deadline.
+type failingRotationDeadlineRepository struct {
+	Repository
+}
+
+func (r failingRotationDeadlineRepository) CreateNewDrawbridgeConfigSettings(name, value string) error {
+	if name == rotationDeadlineSetting {
+		return errors.New("database is read-only")
+	}
+	return r.Repository.CreateNewDrawbridgeConfigSettings(name, value)
+}
+
+// TestRotationFailureKeepsCertificateAuthority tests that a rotation that fails to save its deadline leaves the
+// current certificate authority in place, in memory and on disk.
+func TestRotationFailureKeepsCertificateAuthority(t *testing.T) {
+	db := persistence.NewSQLiteRepository(persistence.OpenDatabaseFile(filepath.Join(t.TempDir(), "drawbridge.db")))
+	if _, err := db.Migrate(); err != nil {
+		t.Fatalf("migration failed: %v", err)
+	}
+	if err := db.CreateNewDrawbridgeConfigSettings("listening_address", "127.0.0.1"); err != nil {
+		t.Fatalf("failed to save listening address: %v", err)
+	}
+	t.Cleanup(func() { utils.DeleteDirectory("ca") })
+
+	ca := &CA{DB: db}
+	if err := ca.SetupCertificates(); err != nil {
+		t.Fatalf("SetupCertificates failed: %v", err)
+	}
+	previousCA, previousIntermediate := ca.CertificateAuthority, ca.Intermediate
+	previousServerCertificate := utils.ReadFile(serverCertificatePath)
+
+	ca.DB = failingRotationDeadlineRepository{db}
+	if err := ca.StartRotation(time.Hour); err == nil {
+		t.Fatalf("StartRotation should fail when the rotation deadline can't be saved")
+	}
+	if ca.CurrentRotation() != nil {
+		t.Errorf("failed rotation should not be in progress")
+	}
+	if !ca.CertificateAuthority.Equal(previousCA) || !ca.Intermediate.Equal(previousIntermediate) {
+		t.Errorf("failed rotation replaced the certificate authority in memory")
+	}
+	onDisk, err := readCertificatesFile(caCertificatePath)
+	if err != nil {
+		t.Fatalf("failed to read certificate authority: %v", err)
+	}
+	if !onDisk[0].Equal(previousCA) {
+		t.Errorf("failed rotation replaced the certificate authority on disk")
+	}
+	if string(*utils.ReadFile(serverCertificatePath)) != string(*previousServerCertificate) {
+		t.Errorf("failed rotation replaced the server certificate on disk")
+	}
+	for _, pathWithFilename := range []string{previousCACertificatePath, crossSignedCertificatePath} {
+		if utils.FileExists(pathWithFilename) {
+			t.Errorf("failed rotation left %s behind", pathWithFilename)
+		}
+	}
+	staged, _ := filepath.Glob(utils.CreateDrawbridgeFilePath("ca/*" + stagedFileSuffix))
+	if len(staged) != 0 {
+		t.Errorf("failed rotation left staged files behind: %v", staged)
+	}
+
+	ca.DB = db
+	if err := ca.StartRotation(time.Hour); err != nil {
+		t.Fatalf("StartRotation failed after the database recovered: %v", err)
+	}
+	onDisk, err = readCertificatesFile(caCertificatePath)
+	if err != nil {
+		t.Fatalf("failed to read certificate authority: %v", err)
+	}
+	if !onDisk[0].Equal(ca.CurrentCertificateAuthority()) || onDisk[0].Equal(previousCA) {
+		t.Errorf("rotation did not save the new certificate authority to disk")
+	}
+}
+
+func verifiesAgainst(t *testing.T, certPEM []byte, roots *x509.CertPool) bool {
+	t.Helper()
+	block, _ := pem.Decode(certPEM)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+	_, err = cert.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+	return err == nil
+}
+
+// TestIntermediateCertificateAuthority tests that the intermediate certificate authority keeps issuing certificates
+// that chain to the root after the root key is taken offline and the intermediate is re-signed.
+func TestIntermediateCertificateAuthority(t *testing.T) {
+	db := persistence.NewSQLiteRepository(persistence.OpenDatabaseFile(filepath.Join(t.TempDir(), "drawbridge.db")))
+	if _, err := db.Migrate(); err != nil {
+		t.Fatalf("migration failed: %v", err)
+	}
+	if err := db.CreateNewDrawbridgeConfigSettings("listening_address", "127.0.0.1"); err != nil {
+		t.Fatalf("failed to save listening address: %v", err)
+	}
+	t.Cleanup(func() { utils.DeleteDirectory("ca") })
+
+	ca := &CA{DB: db}
+	if err := ca.SetupCertificates(); err != nil {
+		t.Fatalf("SetupCertificates failed: %v", err)
+	}
+	if ca.Intermediate == nil {
+		t.Fatalf("new installs should have an intermediate certificate authority")
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.CertificateAuthority)
+	if !chainVerifies(t, ca.currentServerTLSConfig.Load().Certificates[0].Certificate, roots, x509.ExtKeyUsageServerAuth) {
+		t.Errorf("server certificate chain should verify against the root certificate authority")
+	}
+	devicePEM, _, err := ca.IssueEmissaryCertificate("device", "127.0.0.1", DefaultKeyAlgorithm)
+	if err != nil {
+		t.Fatalf("IssueEmissaryCertificate failed: %v", err)
+	}
+	if !chainVerifies(t, pemChain(t, append(devicePEM, ca.CertificateChainPEM()...)), roots, x509.ExtKeyUsageClientAuth) {
+		t.Errorf("device certificate chain should verify against the root certificate authority")
+	}
+
+	// Take the root key offline.
+	rootKeyPath := filepath.Join(t.TempDir(), "root.key")
+	if err := ca.ExportRootKey(rootKeyPath); err != nil {
+		t.Fatalf("ExportRootKey failed: %v", err)
+	}
+	if utils.FileExists(caKeyPath) {
+		t.Errorf("root key should be removed from the server")
+	}
+	if err := ca.ExportRootKey(filepath.Join(t.TempDir(), "again.key")); err == nil {
+		t.Errorf("exporting an offline root key should fail")
+	}
+
+	// Drawbridge still starts and issues certificates without the root key.
+	ca = &CA{DB: db}
+	if err := ca.SetupCertificates(); err != nil {
+		t.Fatalf("SetupCertificates without root key failed: %v", err)
+	}
+	if ca.RootKeyOnline() {
+		t.Errorf("root key should be offline")
+	}
+	if _, _, err := ca.IssueEmissaryCertificate("device-2", "127.0.0.1", DefaultKeyAlgorithm); err != nil {
+		t.Errorf("intermediate should issue certificates while the root key is offline: %v", err)
+	}
+	if err := ca.StartRotation(time.Hour); err == nil {
+		t.Errorf("rotation should need the root key")
+	}
+
+	// Re-signing keeps the intermediate key, so existing device certificates stay valid.
+	otherKey, _ := DefaultKeyAlgorithm.GenerateKey()
+	otherKeyPEM, _ := EncodePrivateKey(otherKey)
+	if err := ca.ResignIntermediate(otherKeyPEM, false); err == nil {
+		t.Errorf("re-signing with a key that isn't the root key should fail")
+	}
+	rootKeyPEM, err := os.ReadFile(rootKeyPath)
+	if err != nil {
+		t.Fatalf("failed to read exported root key: %v", err)
+	}
+	previousIntermediate := ca.Intermediate
+	if err := ca.ResignIntermediate(rootKeyPEM, false); err != nil {
+		t.Fatalf("ResignIntermediate failed: %v", err)
+	}
+	if ca.Intermediate.Equal(previousIntermediate) {
+		t.Errorf("intermediate certificate authority was not re-signed")
+	}
+	if !chainVerifies(t, pemChain(t, append(devicePEM, ca.CertificateChainPEM()...)), roots, x509.ExtKeyUsageClientAuth) {
+		t.Errorf("device certificate should verify against the re-signed intermediate")
+	}
+
+	// Rekeying the intermediate invalidates existing device certificates.
+	if err := ca.ResignIntermediate(rootKeyPEM, true); err != nil {
+		t.Fatalf("ResignIntermediate with rekey failed: %v", err)
+	}
+	if ca.IssuedByCurrentCertificateAuthority(string(devicePEM)) {
+		t.Errorf("device certificate should not verify against a rekeyed intermediate")
+	}
+}
+
+func pemChain(t *testing.T, chainPEM []byte) [][]byte {
+	t.Helper()
+	var chain [][]byte
+	for block, rest := pem.Decode(chainPEM); block != nil; block, rest = pem.Decode(rest) {
+		chain = append(chain, block.Bytes)
+	}
+	return chain
+}
+
+func chainVerifies(t *testing.T, chain [][]byte, roots *x509.CertPool, usage x509.ExtKeyUsage) bool {
+	t.Helper()
+	leaf, err := x509.ParseCertificate(chain[0])
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+	intermediates := x509.NewCertPool()
+	for _, der := range chain[1:] {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatalf("failed to parse certificate: %v", err)
+		}
+		intermediates.AddCert(cert)
+	}
+	_, err = leaf.Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates, KeyUsages: []x509.ExtKeyUsage{usage}})
+	return err == nil
+}
+
+// TestEncryptedPrivateKeys tests that encrypted private keys lock the certificate authority until the key passphrase is provided.
+func TestEncryptedPrivateKeys(t *testing.T) {
+	db := persistence.NewSQLiteRepository(persistence.OpenDatabaseFile(filepath.Join(t.TempDir(), "drawbridge.db")))
+	if _, err := db.Migrate(); err != nil {
+		t.Fatalf("migration failed: %v", err)
+	}
+	if err := db.CreateNewDrawbridgeConfigSettings("listening_address", "127.0.0.1"); err != nil {
+		t.Fatalf("failed to save listening address: %v", err)
+	}
+	t.Cleanup(func() { utils.DeleteDirectory("ca") })
+
+	passphrase := []byte("correct horse battery staple")
+	ca := &CA{DB: db}
+	ca.UseKeyPassphrase(passphrase)
+	if err := ca.SetupCertificates(); err != nil {
+		t.Fatalf("SetupCertificates failed: %v", err)
+	}
+	for _, keyPath := range []string{caKeyPath, intermediateKeyPath, serverKeyPath} {
+		block, _ := pem.Decode(*utils.ReadFile(keyPath))
+		if block == nil || block.Type != encryptedPrivateKeyBlockType {
+			t.Errorf("%s should be encrypted at rest", keyPath)
+		}
+	}
+	if !PrivateKeysEncrypted() {
+		t.Errorf("PrivateKeysEncrypted should report encrypted keys")
+	}
+
+	// Without the passphrase the certificate authority is locked and refuses to issue certificates.
+	ca = &CA{DB: db}
+	if err := ca.SetupCertificates(); !errors.Is(err, ErrCertificateAuthorityLocked) {
+		t.Fatalf("SetupCertificates without passphrase should return ErrCertificateAuthorityLocked, got %v", err)
+	}
+	if !ca.Locked() {
+		t.Errorf("certificate authority should be locked")
+	}
+	if _, _, err := ca.IssueEmissaryCertificate("device", "127.0.0.1", DefaultKeyAlgorithm); !errors.Is(err, ErrCertificateAuthorityLocked) {
+		t.Errorf("issuing while locked should return ErrCertificateAuthorityLocked, got %v", err)
+	}
+	if err := ca.Unlock([]byte("wrong passphrase")); !errors.Is(err, ErrIncorrectKeyPassphrase) {
+		t.Errorf("unlocking with the wrong passphrase should return ErrIncorrectKeyPassphrase, got %v", err)
+	}
+	if !ca.Locked() {
+		t.Errorf("certificate authority should stay locked after a wrong passphrase")
+	}
+	if err := ca.Unlock(passphrase); err != nil {
+		t.Fatalf("Unlock failed: %v", err)
+	}
+	if _, _, err := ca.IssueEmissaryCertificate("device", "127.0.0.1", DefaultKeyAlgorithm); err != nil {
+		t.Errorf("issuing after unlocking failed: %v", err)
+	}
+
+	// A key file can't make Drawbridge derive its key with scrypt parameters above the maximum.
+	block, _ := pem.Decode(*utils.ReadFile(serverKeyPath))
+	for _, params := range []string{"N=2097152,r=8,p=1", "N=32768,r=32,p=1", "N=32768,r=8,p=8", "N=-1,r=8,p=1"} {
+		block.Headers["KDF-Params"] = params
+		if _, err := OpenWithPassphrase(block, passphrase); err == nil || errors.Is(err, ErrIncorrectKeyPassphrase) {
+			t.Errorf("opening a key with scrypt parameters %s should fail before deriving the key, got %v", params, err)
+		}
+	}
+
+	// Removing the passphrase stores the keys unencrypted.
+	if err := ca.ChangeKeyPassphrase(nil); err != nil {
+		t.Fatalf("ChangeKeyPassphrase failed: %v", err)
+	}
+	if PrivateKeysEncrypted() {
+		t.Errorf("keys should no longer be encrypted")
+	}
+	if staged, _ := filepath.Glob(utils.CreateDrawbridgeFilePath("ca/*" + stagedFileSuffix)); len(staged) != 0 {
+		t.Errorf("changing the key passphrase left staged files behind: %v", staged)
+	}
+	ca = &CA{DB: db}
+	if err := ca.SetupCertificates(); err != nil {
+		t.Errorf("SetupCertificates with unencrypted keys failed: %v", err)
+	}
+}
+
+// TestImportCertificateAuthority tests replacing the certificate authority with one the Drawbridge admin already runs.
+func TestImportCertificateAuthority(t *testing.T) {
+	db := persistence.NewSQLiteRepository(persistence.OpenDatabaseFile(filepath.Join(t.TempDir(), "drawbridge.db")))
+	if _, err := db.Migrate(); err != nil {
+		t.Fatalf("migration failed: %v", err)
+	}
+	if err := db.CreateNewDrawbridgeConfigSettings("listening_address", "127.0.0.1"); err != nil {
+		t.Fatalf("failed to save listening address: %v", err)
+	}
+	t.Cleanup(func() { utils.DeleteDirectory("ca") })
+
+	ca := &CA{DB: db}
+	if err := ca.SetupCertificates(); err != nil {
+		t.Fatalf("SetupCertificates failed: %v", err)
+	}
+
+	// An external root with an intermediate that issues the Drawbridge certificates.
+	externalRoot, externalRootKey, err := newCertificateAuthority("127.0.0.1", "External Root CA", DefaultKeyAlgorithm)
+	if err != nil {
+		t.Fatalf("failed to create external root: %v", err)
+	}
+	externalIntermediateKey, _ := DefaultKeyAlgorithm.GenerateKey()
+	externalIntermediate, err := newIntermediateCertificateAuthority(externalRoot, externalRootKey, externalIntermediateKey)
+	if err != nil {
+		t.Fatalf("failed to create external intermediate: %v", err)
+	}
+	chainPEM := append(encodeCertificate(externalIntermediate.Raw), encodeCertificate(externalRoot.Raw)...)
+	intermediateKeyPEM, _ := EncodePrivateKey(externalIntermediateKey)
+	imported, err := ParseImportedCertificateAuthority(chainPEM, intermediateKeyPEM)
+	if err != nil {
+		t.Fatalf("ParseImportedCertificateAuthority failed: %v", err)
+	}
+	if err := ca.ImportCertificateAuthority(imported); err != nil {
+		t.Fatalf("ImportCertificateAuthority failed: %v", err)
+	}
+	if utils.FileExists(caKeyPath) {
+		t.Errorf("the root key of an imported intermediate should not be on the server")
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(externalRoot)
+	if !chainVerifies(t, ca.currentServerTLSConfig.Load().Certificates[0].Certificate, roots, x509.ExtKeyUsageServerAuth) {
+		t.Errorf("server certificate chain should verify against the imported root")
+	}
+
+	// The imported certificate authority is loaded from disk on restart.
+	ca = &CA{DB: db}
+	if err := ca.SetupCertificates(); err != nil {
+		t.Fatalf("SetupCertificates after import failed: %v", err)
+	}
+	if !ca.CertificateAuthority.Equal(externalRoot) || !ca.Intermediate.Equal(externalIntermediate) {
+		t.Errorf("the imported certificate authority should be loaded on restart")
+	}
+	devicePEM, _, err := ca.IssueEmissaryCertificate("device", "127.0.0.1", DefaultKeyAlgorithm)
+	if err != nil {
+		t.Fatalf("IssueEmissaryCertificate failed: %v", err)
+	}
+	if !chainVerifies(t, pemChain(t, append(devicePEM, ca.CertificateChainPEM()...)), roots, x509.ExtKeyUsageClientAuth) {
+		t.Errorf("device certificate chain should verify against the imported root")
+	}
+
+	// Importing a root with its key creates a Drawbridge intermediate under it.
+	otherRoot, otherRootKey, _ := newCertificateAuthority("127.0.0.1", "Other Root CA", DefaultKeyAlgorithm)
+	otherRootKeyPEM, _ := EncodePrivateKey(otherRootKey)
+	imported, err = ParseImportedCertificateAuthority(encodeCertificate(otherRoot.Raw), otherRootKeyPEM)
+	if err != nil {
+		t.Fatalf("ParseImportedCertificateAuthority for a root failed: %v", err)
+	}
+	if err := ca.ImportCertificateAuthority(imported); err != nil {
+		t.Fatalf("ImportCertificateAuthority for a root failed: %v", err)
+	}
+	if !ca.RootKeyOnline() || ca.Intermediate == nil || ca.Intermediate.Subject.CommonName != intermediateCommonName {
+		t.Errorf("importing a root should keep its key and create a Drawbridge intermediate")
+	}
+	if ca.IssuedByCurrentCertificateAuthority(string(devicePEM)) {
+		t.Errorf("certificates from the previous certificate authority should not verify after an import")
+	}
+
+	// Invalid certificate authorities are rejected before anything is saved.
+	leafTemplate, _ := newCertificateTemplate("127.0.0.1")
+	leafKey, _ := DefaultKeyAlgorithm.GenerateKey()
+	leafDER, _ := x509.CreateCertificate(rand.Reader, leafTemplate, externalRoot, leafKey.Public(), externalRootKey)
+	leafKeyPEM, _ := EncodePrivateKey(leafKey)
+	invalid := map[string][2][]byte{
+		"mismatched key":  {chainPEM, otherRootKeyPEM},
+		"missing root":    {encodeCertificate(externalIntermediate.Raw), intermediateKeyPEM},
+		"not a CA":        {append(encodeCertificate(leafDER), encodeCertificate(externalRoot.Raw)...), leafKeyPEM},
+		"no certificates": {nil, intermediateKeyPEM},
+	}
+	for name, upload := range invalid {
+		if _, err := ParseImportedCertificateAuthority(upload[0], upload[1]); err == nil {
+			t.Errorf("%s: ParseImportedCertificateAuthority should fail", name)
+		}
+	}
+}
+
+// TestKeyAlgorithms tests that each certificate type and Emissary Bundle platform uses its configured key algorithm.
+func TestKeyAlgorithms(t *testing.T) {
+	for _, algorithm := range KeyAlgorithms {
+		t.Run(string(algorithm), func(t *testing.T) {
+			db := persistence.NewSQLiteRepository(persistence.OpenDatabaseFile(filepath.Join(t.TempDir(), "drawbridge.db")))
+			if _, err := db.Migrate(); err != nil {
+				t.Fatalf("migration failed: %v", err)
+			}
+			if err := db.CreateNewDrawbridgeConfigSettings("listening_address", "127.0.0.1"); err != nil {
+				t.Fatalf("failed to save listening address: %v", err)
+			}
+			t.Cleanup(func() { utils.DeleteDirectory("ca") })
+
+			ca := &CA{DB: db}
+			settings := KeyAlgorithmSettings{
+				CertificateAuthority: algorithm,
+				Server:               algorithm,
+				Device:               DefaultKeyAlgorithm,
+				Platforms:            map[string]KeyAlgorithm{"android": algorithm},
+				Encodings:            map[string]KeyEncoding{"ios": KeyEncodingPKCS8},
+			}
+			if err := ca.SaveKeyAlgorithmSettings(settings); err != nil {
+				t.Fatalf("SaveKeyAlgorithmSettings failed: %v", err)
+			}
+			if err := ca.SetupCertificates(); err != nil {
+				t.Fatalf("SetupCertificates failed: %v", err)
+			}
+			serverCert := ca.currentServerTLSConfig.Load().Certificates[0]
+			if got := KeyAlgorithmOf(serverCert.PrivateKey.(crypto.Signer).Public()); got != algorithm {
+				t.Errorf("server key algorithm = %s, want %s", got, algorithm)
+			}
+			for _, cert := range []*x509.Certificate{ca.CertificateAuthority, ca.Intermediate} {
+				if got := KeyAlgorithmOf(cert.PublicKey); got != algorithm {
+					t.Errorf("%s key algorithm = %s, want %s", cert.Subject.CommonName, got, algorithm)
+				}
+			}
+
+			if got := ca.DeviceKeyAlgorithm("android"); got != algorithm {
+				t.Errorf("android device key algorithm = %s, want %s", got, algorithm)
+			}
+			if got := ca.DeviceKeyAlgorithm("linux"); got != DefaultKeyAlgorithm {
+				t.Errorf("platforms without an override should use the device key algorithm, got %s", got)
+			}
+
+			devicePEM, deviceKey, err := ca.IssueEmissaryCertificate("device", "127.0.0.1", ca.DeviceKeyAlgorithm("android"))
+			if err != nil {
+				t.Fatalf("IssueEmissaryCertificate failed: %v", err)
+			}
+			roots := x509.NewCertPool()
+			roots.AddCert(ca.CertificateAuthority)
+			if !chainVerifies(t, pemChain(t, append(devicePEM, ca.CertificateChainPEM()...)), roots, x509.ExtKeyUsageClientAuth) {
+				t.Errorf("device certificate chain should verify against the root certificate authority")
+			}
+			if got := ca.DeviceKeyEncoding("android"); got != KeyEncodingPKCS8 {
+				t.Errorf("android keys should default to PKCS8, got %s", got)
+			}
+			if got := ca.DeviceKeyEncoding("ios"); got != KeyEncodingPKCS8 {
+				t.Errorf("ios key encoding = %s, want the saved %s", got, KeyEncodingPKCS8)
+			}
+			if got := ca.DeviceKeyEncoding("linux"); got != KeyEncodingNative {
+				t.Errorf("linux key encoding = %s, want %s", got, KeyEncodingNative)
+			}
+			for _, encoding := range KeyEncodings {
+				keyPEM, err := EncodePrivateKeyAs(deviceKey, encoding)
+				if err != nil {
+					t.Fatalf("EncodePrivateKeyAs(%s) failed: %v", encoding, err)
+				}
+				block, _ := pem.Decode(keyPEM)
+				if block == nil {
+					t.Fatalf("EncodePrivateKeyAs(%s) didn't return PEM", encoding)
+				}
+				if encoding == KeyEncodingPKCS8 && block.Type != "PRIVATE KEY" {
+					t.Errorf("PKCS8 keys should have PEM type PRIVATE KEY, got %s", block.Type)
+				}
+				if _, err := tls.X509KeyPair(devicePEM, keyPEM); err != nil {
+					t.Errorf("device certificate and %s key should load as a TLS key pair: %v", encoding, err)
+				}
+			}
+		})
+	}
+
+	if _, err := ParseKeyAlgorithm("dsa-1024"); err == nil {
+		t.Errorf("ParseKeyAlgorithm should reject unsupported algorithms")
+	}
+}
@@ -0,0 +1,240 @@
+package certificates
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"imdawon/drawbridge/cmd/utils"
+	"log/slog"
+	"time"
+)
+
+// A certificate authority the Drawbridge admin already runs, e.g. step-ca or an openssl-based setup,
+// that Drawbridge issues server and Emissary device certificates from instead of its own.
+type ImportedCertificateAuthority struct {
+	// The certificate authority the key belongs to. Drawbridge issues certificates with it.
+	Issuer *x509.Certificate
+	Key    crypto.Signer
+	// The certificates between the issuer and the root, in order. Empty if the issuer is the root or directly under it.
+	Chain []*x509.Certificate
+	// The trust anchor Emissary clients pin. Same as the issuer when the Drawbridge admin imports a root.
+	Root *x509.Certificate
+}
+
+// Parses and validates a certificate authority to import.
+// chainPEM holds the issuing certificate authority first, followed by any intermediates, and ends with the root.
+// keyPEM is the unencrypted private key of the issuing certificate authority.
+func ParseImportedCertificateAuthority(chainPEM, keyPEM []byte) (*ImportedCertificateAuthority, error) {
+	certs, err := parseCertificates(chainPEM)
+	if err != nil {
+		return nil, err
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificates found, paste the issuing certificate authority followed by its chain up to the root")
+	}
+
+	keyBlock, _ := pem.Decode(keyPEM)
+	if keyBlock != nil && keyBlock.Type == "ENCRYPTED PRIVATE KEY" {
+		return nil, fmt.Errorf("the private key is encrypted, decrypt it first e.g. with `openssl pkey -in key.pem -out decrypted.pem`")
+	}
+	key, err := parsePrivateKey(keyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	imported := &ImportedCertificateAuthority{
+		Issuer: certs[0],
+		Key:    key,
+		Root:   certs[len(certs)-1],
+	}
+	if len(certs) > 2 {
+		imported.Chain = certs[1 : len(certs)-1]
+	}
+
+	if !publicKeysEqual(key.Public(), imported.Issuer.PublicKey) {
+		return nil, fmt.Errorf("the private key does not match the first certificate in the chain")
+	}
+	if !isSelfSigned(imported.Root) {
+		return nil, fmt.Errorf("the last certificate in the chain must be the self-signed root certificate authority")
+	}
+	for _, cert := range certs {
+		err = validateCertificateAuthority(cert)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", cert.Subject, err)
+		}
+	}
+	if imported.Issuer != imported.Root {
+		err = verifyCertificateAuthorityChain(imported.Issuer, imported.Chain, imported.Root)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return imported, nil
+}
+
+// Checks that a certificate can act as a certificate authority for Drawbridge server and device certificates.
+func validateCertificateAuthority(cert *x509.Certificate) error {
+	if !cert.BasicConstraintsValid || !cert.IsCA {
+		return fmt.Errorf("basic constraints don't mark the certificate as a certificate authority")
+	}
+	if cert.KeyUsage&x509.KeyUsageCertSign == 0 {
+		return fmt.Errorf("key usage doesn't allow signing certificates")
+	}
+	now := time.Now()
+	if now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+		return fmt.Errorf("the certificate is only valid from %s to %s", cert.NotBefore.Format(time.RFC1123), cert.NotAfter.Format(time.RFC1123))
+	}
+	if len(cert.ExtKeyUsage) > 0 && !allowsExtKeyUsage(cert, x509.ExtKeyUsageServerAuth) {
+		return fmt.Errorf("extended key usage doesn't allow server authentication")
+	}
+	if len(cert.ExtKeyUsage) > 0 && !allowsExtKeyUsage(cert, x509.ExtKeyUsageClientAuth) {
+		return fmt.Errorf("extended key usage doesn't allow client authentication")
+	}
+	return nil
+}
+
+func allowsExtKeyUsage(cert *x509.Certificate, usage x509.ExtKeyUsage) bool {
+	for _, allowed := range cert.ExtKeyUsage {
+		if allowed == usage || allowed == x509.ExtKeyUsageAny {
+			return true
+		}
+	}
+	return false
+}
+
+// Verifies that certificates issued by issuer will chain to root for both server and client authentication.
+func verifyCertificateAuthorityChain(issuer *x509.Certificate, chain []*x509.Certificate, root *x509.Certificate) error {
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+	intermediates := x509.NewCertPool()
+	for _, cert := range chain {
+		intermediates.AddCert(cert)
+	}
+	for _, usage := range []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth} {
+		_, err := issuer.Verify(x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{usage},
+		})
+		if err != nil {
+			return fmt.Errorf("the chain does not verify up to the root certificate authority: %w", err)
+		}
+	}
+	return nil
+}
+
+func isSelfSigned(cert *x509.Certificate) bool {
+	return bytes.Equal(cert.RawIssuer, cert.RawSubject) && cert.CheckSignatureFrom(cert) == nil
+}
+
+// Reports whether a certificate authority can sign another certificate authority below it.
+func allowsIntermediate(cert *x509.Certificate) bool {
+	return !(cert.MaxPathLen == 0 && cert.MaxPathLenZero)
+}
+
+// Replaces the certificate authority with an imported one and issues a new server certificate from it.
+// When the Drawbridge admin imports a root with its key, Drawbridge creates its own intermediate under it, like a new install.
+// Emissary devices with certificates from the previous certificate authority will need a new Emissary Bundle.
+func (c *CA) ImportCertificateAuthority(imported *ImportedCertificateAuthority) error {
+	c.rotationMutex.Lock()
+	defer c.rotationMutex.Unlock()
+
+	if c.Rotation != nil {
+		return fmt.Errorf("a certificate authority can't be imported while a certificate authority rotation is in progress")
+	}
+	if c.locked.Load() {
+		return ErrCertificateAuthorityLocked
+	}
+	listeningAddress, err := c.DB.GetDrawbridgeConfigValueByName("listening_address")
+	if err != nil {
+		return err
+	}
+	if listeningAddress == nil || *listeningAddress == "" {
+		return fmt.Errorf("a listening address is needed to issue the server certificate")
+	}
+
+	var rootKey crypto.Signer
+	intermediate, intermediateKey, chain := imported.Issuer, imported.Key, imported.Chain
+	if imported.Issuer == imported.Root {
+		rootKey = imported.Key
+		intermediate, intermediateKey, chain = nil, nil, nil
+		if allowsIntermediate(imported.Root) {
+			intermediateKey, err = c.KeyAlgorithm(CertificateTypeCertificateAuthority).GenerateKey()
+			if err != nil {
+				return err
+			}
+			intermediate, err = newIntermediateCertificateAuthority(imported.Root, rootKey, intermediateKey)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	err = c.saveCertificateAuthority(nil, imported.Root, rootKey)
+	if err != nil {
+		return err
+	}
+	if intermediate != nil {
+		err = c.saveIntermediate(nil, intermediate, chain, intermediateKey)
+	} else {
+		err = deleteIntermediateFiles()
+	}
+	if err != nil {
+		return err
+	}
+
+	c.CertificateAuthority = imported.Root
+	c.PrivateKey = rootKey
+	c.Intermediate = intermediate
+	c.IntermediatePrivateKey = intermediateKey
+	c.intermediateChain = chain
+
+	serverCert, err := c.createServerCertificate(nil, *listeningAddress)
+	if err != nil {
+		return err
+	}
+	c.applyTLSConfig(serverCert)
+
+	slog.Info("Certificate Authority", slog.String("Imported certificate authority", imported.Issuer.Subject.String()))
+	return nil
+}
+
+func deleteIntermediateFiles() error {
+	err := utils.DeleteFile(intermediateCertificatePath)
+	if err != nil {
+		return err
+	}
+	return utils.DeleteFile(intermediateKeyPath)
+}
+
+func parseCertificates(certificatesPEM []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for block, rest := pem.Decode(certificatesPEM); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+func readCertificatesFile(pathWithFilename string) ([]*x509.Certificate, error) {
+	contents := utils.ReadFile(pathWithFilename)
+	if contents == nil {
+		return nil, fmt.Errorf("unable to read %s", pathWithFilename)
+	}
+	certs, err := parseCertificates(*contents)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", pathWithFilename, err)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("failed to decode PEM block containing CERTIFICATE in %s", pathWithFilename)
+	}
+	return certs, nil
+}
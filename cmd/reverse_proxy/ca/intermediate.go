@@ -0,0 +1,228 @@
+package certificates
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"imdawon/drawbridge/cmd/utils"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// Drawbridge uses a two-tier certificate authority. The root certificate authority in ca/ca.crt is the trust anchor
+// shipped in every Emissary Bundle. It only signs the intermediate certificate authority, so the Drawbridge admin can
+// export its key and keep it offline. The intermediate certificate authority stays online and issues the server and
+// Emissary device certificates.
+//
+// Installs created before the intermediate certificate authority existed keep issuing from the root until the
+// Drawbridge admin runs `drawbridge ca resign-intermediate`.
+const (
+	intermediateCertificatePath         = "ca/intermediate.crt"
+	intermediateKeyPath                 = "ca/intermediate.key"
+	previousIntermediateCertificatePath = "ca/previous-intermediate.crt"
+	intermediateCommonName              = "Drawbridge Intermediate CA"
+)
+
+// Creates an intermediate certificate authority for intermediateKey, signed by the root certificate authority.
+// The intermediate can't outlive the root, and can only sign end-entity certificates.
+func newIntermediateCertificateAuthority(root *x509.Certificate, rootKey crypto.Signer, intermediateKey crypto.Signer) (*x509.Certificate, error) {
+	serialNumber, err := newSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			Organization: []string{"Drawbridge"},
+			CommonName:   intermediateCommonName,
+		},
+		NotBefore:             time.Now(),
+		NotAfter:              root.NotAfter,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		MaxPathLenZero:        true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+	}
+	intermediateBytes, err := x509.CreateCertificate(rand.Reader, template, root, intermediateKey.Public(), rootKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign intermediate certificate authority: %w", err)
+	}
+	return x509.ParseCertificate(intermediateBytes)
+}
+
+// Writes the intermediate certificate authority certificate and key to the ca folder, replacing any existing files.
+// The certificates between the intermediate and the root, if any, are saved after the intermediate certificate.
+func (c *CA) saveIntermediate(files *stagedFiles, intermediate *x509.Certificate, chain []*x509.Certificate, intermediateKey crypto.Signer) error {
+	intermediatePEM := encodeCertificate(intermediate.Raw)
+	for _, cert := range chain {
+		intermediatePEM = append(intermediatePEM, encodeCertificate(cert.Raw)...)
+	}
+	err := files.replaceFile(intermediateCertificatePath, intermediatePEM, 0644)
+	if err != nil {
+		return err
+	}
+	intermediateKeyPEM, err := c.encodePrivateKeyForDisk(intermediateKey)
+	if err != nil {
+		return err
+	}
+	return files.replaceFile(intermediateKeyPath, intermediateKeyPEM, 0600)
+}
+
+func (c *CA) loadIntermediateCertificate() error {
+	certs, err := readCertificatesFile(intermediateCertificatePath)
+	if err != nil {
+		return err
+	}
+	err = verifyCertificateAuthorityChain(certs[0], certs[1:], c.CertificateAuthority)
+	if err != nil {
+		return fmt.Errorf("the intermediate certificate authority does not chain to the root certificate authority: %w", err)
+	}
+	c.Intermediate = certs[0]
+	c.intermediateChain = certs[1:]
+	return nil
+}
+
+// Returns the certificate authority that signs server and Emissary device certificates.
+func (c *CA) issuer() (*x509.Certificate, crypto.Signer, error) {
+	if c.locked.Load() {
+		return nil, nil, ErrCertificateAuthorityLocked
+	}
+	if c.Intermediate != nil {
+		return c.Intermediate, c.IntermediatePrivateKey, nil
+	}
+	if c.PrivateKey == nil {
+		return nil, nil, fmt.Errorf("the root certificate authority key is offline and there is no intermediate certificate authority to issue certificates")
+	}
+	return c.CertificateAuthority, c.PrivateKey, nil
+}
+
+// Returns the PEM-encoded certificates between an issued certificate and the root certificate authority.
+// Emissary device certificate files include these so Emissary clients present the full chain.
+func (c *CA) CertificateChainPEM() []byte {
+	if c.Intermediate == nil {
+		return nil
+	}
+	chainPEM := encodeCertificate(c.Intermediate.Raw)
+	for _, cert := range c.intermediateChain {
+		chainPEM = append(chainPEM, encodeCertificate(cert.Raw)...)
+	}
+	return chainPEM
+}
+
+// Reports whether the root certificate authority key is on this server.
+func (c *CA) RootKeyOnline() bool {
+	return c.PrivateKey != nil
+}
+
+// Writes the root certificate authority key to destination and removes it from the server.
+// From then on only the intermediate certificate authority can issue certificates. The exported key is needed again
+// to re-sign the intermediate certificate authority or to rotate the certificate authority.
+func (c *CA) ExportRootKey(destination string) error {
+	if c.locked.Load() {
+		return ErrCertificateAuthorityLocked
+	}
+	if c.PrivateKey == nil {
+		return fmt.Errorf("the root certificate authority key is already offline")
+	}
+	if c.Intermediate == nil {
+		return fmt.Errorf("create an intermediate certificate authority with `drawbridge ca resign-intermediate` before taking the root key offline")
+	}
+	rootKeyPEM, err := EncodePrivateKey(c.PrivateKey)
+	if err != nil {
+		return err
+	}
+
+	// Never overwrite an existing file, it might be another root key.
+	exportFile, err := os.OpenFile(destination, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("unable to create %s: %w", destination, err)
+	}
+	_, err = exportFile.Write(rootKeyPEM)
+	if err == nil {
+		err = exportFile.Sync()
+	}
+	if closeErr := exportFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return errors.Join(fmt.Errorf("unable to write the root key to %s", destination), err, os.Remove(destination))
+	}
+
+	err = utils.DeleteFile(caKeyPath)
+	if err != nil {
+		return err
+	}
+	c.PrivateKey = nil
+	slog.Info("Certificate Authority", slog.String("Root key exported and removed from server", destination))
+	return nil
+}
+
+// Signs a new intermediate certificate authority with the root key, e.g. when the intermediate expires or when
+// upgrading a Drawbridge install that issues every certificate from the root.
+// The current intermediate key is reused so existing Emissary device certificates stay valid, unless rekey is set.
+// Rekeying should only be needed if the intermediate key was compromised, and every Emissary device will need a new Emissary Bundle.
+func (c *CA) ResignIntermediate(rootKeyPEM []byte, rekey bool) error {
+	c.rotationMutex.Lock()
+	defer c.rotationMutex.Unlock()
+
+	if c.Rotation != nil {
+		return fmt.Errorf("the intermediate certificate authority can't be re-signed while a certificate authority rotation is in progress")
+	}
+	if c.locked.Load() {
+		return ErrCertificateAuthorityLocked
+	}
+	// Accept the root key as stored on disk, which may be encrypted with the key passphrase.
+	rootKeyPEM, err := c.decryptPrivateKeyPEM(rootKeyPEM)
+	if err != nil {
+		return err
+	}
+	rootKey, err := parsePrivateKey(rootKeyPEM)
+	if err != nil {
+		return err
+	}
+	if !publicKeysEqual(rootKey.Public(), c.CertificateAuthority.PublicKey) {
+		return fmt.Errorf("the key does not belong to the root certificate authority in %s", caCertificatePath)
+	}
+
+	intermediateKey := c.IntermediatePrivateKey
+	if intermediateKey == nil || rekey {
+		intermediateKey, err = c.KeyAlgorithm(CertificateTypeCertificateAuthority).GenerateKey()
+		if err != nil {
+			return err
+		}
+	}
+	intermediate, err := newIntermediateCertificateAuthority(c.CertificateAuthority, rootKey, intermediateKey)
+	if err != nil {
+		return err
+	}
+	err = c.saveIntermediate(nil, intermediate, nil, intermediateKey)
+	if err != nil {
+		return err
+	}
+	c.Intermediate = intermediate
+	c.IntermediatePrivateKey = intermediateKey
+	c.intermediateChain = nil
+
+	listeningAddress, err := c.DB.GetDrawbridgeConfigValueByName("listening_address")
+	if err != nil {
+		return err
+	}
+	serverCert, err := c.createServerCertificate(nil, *listeningAddress)
+	if err != nil {
+		return err
+	}
+	c.applyTLSConfig(serverCert)
+
+	slog.Info("Certificate Authority", slog.String("Signed intermediate certificate authority valid until", intermediate.NotAfter.Format(time.RFC1123)))
+	return nil
+}
+
+func publicKeysEqual(a, b crypto.PublicKey) bool {
+	key, ok := a.(interface{ Equal(crypto.PublicKey) bool })
+	return ok && key.Equal(b)
+}
@@ -0,0 +1,345 @@
+package certificates
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"log/slog"
+)
+
+// The algorithm and key size or curve Drawbridge generates private keys with.
+// Every Emissary client supports ECDSA P-384, which is why it's the default. Some embedded clients and older Java
+// stacks need RSA or P-256, and modern clients may prefer Ed25519.
+type KeyAlgorithm string
+
+const (
+	KeyAlgorithmECDSAP256 KeyAlgorithm = "ecdsa-p256"
+	KeyAlgorithmECDSAP384 KeyAlgorithm = "ecdsa-p384"
+	KeyAlgorithmRSA2048   KeyAlgorithm = "rsa-2048"
+	KeyAlgorithmRSA3072   KeyAlgorithm = "rsa-3072"
+	KeyAlgorithmEd25519   KeyAlgorithm = "ed25519"
+
+	DefaultKeyAlgorithm = KeyAlgorithmECDSAP384
+)
+
+// Every key algorithm the Drawbridge admin can pick from, in the order the Drawbridge Dashboard lists them.
+var KeyAlgorithms = []KeyAlgorithm{
+	KeyAlgorithmECDSAP384,
+	KeyAlgorithmECDSAP256,
+	KeyAlgorithmRSA2048,
+	KeyAlgorithmRSA3072,
+	KeyAlgorithmEd25519,
+}
+
+// Platforms Emissary Bundles are built for. Each can override the key algorithm and key encoding of its device certificates.
+var EmissaryPlatforms = []string{"linux", "macos", "windows", "android", "ios"}
+
+// How the private key in an Emissary Bundle is PEM-encoded, so it matches what the platform's Emissary client reads.
+type KeyEncoding string
+
+const (
+	// SEC 1 for ECDSA keys and PKCS1 for RSA keys, like Drawbridge keys on disk. Ed25519 keys are always PKCS8.
+	KeyEncodingNative KeyEncoding = "native"
+	KeyEncodingPKCS8  KeyEncoding = "pkcs8"
+)
+
+// Every key encoding the Drawbridge admin can pick from, in the order the Drawbridge Dashboard lists them.
+var KeyEncodings = []KeyEncoding{KeyEncodingNative, KeyEncodingPKCS8}
+
+// The key encoding of platforms the Drawbridge admin hasn't picked one for. Platforms not listed use KeyEncodingNative.
+// Android is a special little platform. The Kotlin/Java stdlib seems to only have support for the
+// PKCS8 format, so Android keys are PKCS8 to avoid complicated conversion code on the Android client.
+var DefaultPlatformKeyEncodings = map[string]KeyEncoding{"android": KeyEncodingPKCS8}
+
+// Returns the key encoding Emissary Bundles for the platform use unless the Drawbridge admin picked another.
+func DefaultKeyEncoding(platform string) KeyEncoding {
+	if encoding, ok := DefaultPlatformKeyEncodings[platform]; ok {
+		return encoding
+	}
+	return KeyEncodingNative
+}
+
+func ParseKeyEncoding(encoding string) (KeyEncoding, error) {
+	for _, known := range KeyEncodings {
+		if KeyEncoding(encoding) == known {
+			return known, nil
+		}
+	}
+	return "", fmt.Errorf("unsupported key encoding %q", encoding)
+}
+
+// Returns the name the Drawbridge Dashboard shows for the key encoding.
+func (e KeyEncoding) Label() string {
+	switch e {
+	case KeyEncodingNative:
+		return "SEC 1 / PKCS1"
+	case KeyEncodingPKCS8:
+		return "PKCS8"
+	}
+	return string(e)
+}
+
+// Parses a key algorithm as stored in the drawbridge_config table, e.g. "ecdsa-p256".
+func ParseKeyAlgorithm(algorithm string) (KeyAlgorithm, error) {
+	for _, known := range KeyAlgorithms {
+		if KeyAlgorithm(algorithm) == known {
+			return known, nil
+		}
+	}
+	return "", fmt.Errorf("unsupported key algorithm %q", algorithm)
+}
+
+// Returns the name the Drawbridge Dashboard shows for the key algorithm.
+func (a KeyAlgorithm) Label() string {
+	switch a {
+	case KeyAlgorithmECDSAP256:
+		return "ECDSA P-256"
+	case KeyAlgorithmECDSAP384:
+		return "ECDSA P-384"
+	case KeyAlgorithmRSA2048:
+		return "RSA 2048"
+	case KeyAlgorithmRSA3072:
+		return "RSA 3072"
+	case KeyAlgorithmEd25519:
+		return "Ed25519"
+	}
+	return string(a)
+}
+
+func (a KeyAlgorithm) GenerateKey() (crypto.Signer, error) {
+	switch a {
+	case KeyAlgorithmECDSAP256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KeyAlgorithmECDSAP384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case KeyAlgorithmRSA2048:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case KeyAlgorithmRSA3072:
+		return rsa.GenerateKey(rand.Reader, 3072)
+	case KeyAlgorithmEd25519:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	}
+	return nil, fmt.Errorf("unsupported key algorithm %q", a)
+}
+
+// Returns the key algorithm of a public key, e.g. so a device gets a new certificate with the same kind of key it already uses.
+// Keys Drawbridge can't generate, such as RSA 4096 from an imported certificate authority, return the default.
+func KeyAlgorithmOf(publicKey crypto.PublicKey) KeyAlgorithm {
+	switch key := publicKey.(type) {
+	case *ecdsa.PublicKey:
+		if key.Curve == elliptic.P256() {
+			return KeyAlgorithmECDSAP256
+		}
+	case *rsa.PublicKey:
+		switch key.N.BitLen() {
+		case 2048:
+			return KeyAlgorithmRSA2048
+		case 3072:
+			return KeyAlgorithmRSA3072
+		}
+	case ed25519.PublicKey:
+		return KeyAlgorithmEd25519
+	}
+	return DefaultKeyAlgorithm
+}
+
+// The kinds of certificates Drawbridge issues. Each has its own key algorithm setting.
+type CertificateType string
+
+const (
+	CertificateTypeCertificateAuthority CertificateType = "ca"
+	CertificateTypeServer               CertificateType = "server"
+	CertificateTypeDevice               CertificateType = "device"
+)
+
+// The key algorithm for each certificate type, and the per-platform overrides for Emissary device certificates.
+// The certificate authority algorithm applies to the root and intermediate certificate authorities Drawbridge creates,
+// so changing it takes effect at the next rotation. The server algorithm takes effect the next time the server
+// certificate is issued, and device algorithms with the next Emissary Bundle.
+type KeyAlgorithmSettings struct {
+	CertificateAuthority KeyAlgorithm
+	Server               KeyAlgorithm
+	Device               KeyAlgorithm
+	// Overrides Device for Emissary Bundles built for the platform. Platforms without an entry use Device.
+	Platforms map[string]KeyAlgorithm
+	// The key encoding for Emissary Bundles built for the platform. Platforms without an entry use
+	// DefaultPlatformKeyEncodings.
+	Encodings map[string]KeyEncoding
+}
+
+func keyAlgorithmSettingName(certificateType CertificateType) string {
+	return fmt.Sprintf("key_algorithm_%s", certificateType)
+}
+
+func platformKeyAlgorithmSettingName(platform string) string {
+	return fmt.Sprintf("key_algorithm_device_%s", platform)
+}
+
+func platformKeyEncodingSettingName(platform string) string {
+	return fmt.Sprintf("key_encoding_device_%s", platform)
+}
+
+// Reads a key algorithm from the drawbridge_config table. Returns an empty KeyAlgorithm if it isn't set.
+func (c *CA) readKeyAlgorithmSetting(setting string) KeyAlgorithm {
+	if c.DB == nil {
+		return ""
+	}
+	value, err := c.DB.GetDrawbridgeConfigValueByName(setting)
+	if err != nil {
+		slog.Error("Database", slog.Any("Error reading key algorithm", err))
+		return ""
+	}
+	if value == nil || *value == "" {
+		return ""
+	}
+	algorithm, err := ParseKeyAlgorithm(*value)
+	if err != nil {
+		slog.Error("Certificate Authority", slog.String(setting, err.Error()))
+		return ""
+	}
+	return algorithm
+}
+
+// Returns the key algorithm new keys for the certificate type are generated with.
+func (c *CA) KeyAlgorithm(certificateType CertificateType) KeyAlgorithm {
+	algorithm := c.readKeyAlgorithmSetting(keyAlgorithmSettingName(certificateType))
+	if algorithm == "" {
+		return DefaultKeyAlgorithm
+	}
+	return algorithm
+}
+
+// Returns the key algorithm for Emissary device certificates in bundles built for the platform.
+func (c *CA) DeviceKeyAlgorithm(platform string) KeyAlgorithm {
+	algorithm := c.readKeyAlgorithmSetting(platformKeyAlgorithmSettingName(platform))
+	if algorithm == "" {
+		return c.KeyAlgorithm(CertificateTypeDevice)
+	}
+	return algorithm
+}
+
+// Reads the key encoding the Drawbridge admin picked for the platform. Returns an empty KeyEncoding if it isn't set.
+func (c *CA) readKeyEncodingSetting(platform string) KeyEncoding {
+	if c.DB == nil {
+		return ""
+	}
+	setting := platformKeyEncodingSettingName(platform)
+	value, err := c.DB.GetDrawbridgeConfigValueByName(setting)
+	if err != nil {
+		slog.Error("Database", slog.Any("Error reading key encoding", err))
+		return ""
+	}
+	if value == nil || *value == "" {
+		return ""
+	}
+	encoding, err := ParseKeyEncoding(*value)
+	if err != nil {
+		slog.Error("Certificate Authority", slog.String(setting, err.Error()))
+		return ""
+	}
+	return encoding
+}
+
+// Returns the key encoding of the private key in Emissary Bundles built for the platform.
+func (c *CA) DeviceKeyEncoding(platform string) KeyEncoding {
+	if encoding := c.readKeyEncodingSetting(platform); encoding != "" {
+		return encoding
+	}
+	return DefaultKeyEncoding(platform)
+}
+
+func (c *CA) KeyAlgorithmSettings() KeyAlgorithmSettings {
+	settings := KeyAlgorithmSettings{
+		CertificateAuthority: c.KeyAlgorithm(CertificateTypeCertificateAuthority),
+		Server:               c.KeyAlgorithm(CertificateTypeServer),
+		Device:               c.KeyAlgorithm(CertificateTypeDevice),
+		Platforms:            make(map[string]KeyAlgorithm),
+		Encodings:            make(map[string]KeyEncoding),
+	}
+	for _, platform := range EmissaryPlatforms {
+		algorithm := c.readKeyAlgorithmSetting(platformKeyAlgorithmSettingName(platform))
+		if algorithm != "" {
+			settings.Platforms[platform] = algorithm
+		}
+		encoding := c.readKeyEncodingSetting(platform)
+		if encoding != "" {
+			settings.Encodings[platform] = encoding
+		}
+	}
+	return settings
+}
+
+// Saves the key algorithm settings. Existing keys and certificates are left alone.
+func (c *CA) SaveKeyAlgorithmSettings(settings KeyAlgorithmSettings) error {
+	certificateTypes := map[CertificateType]KeyAlgorithm{
+		CertificateTypeCertificateAuthority: settings.CertificateAuthority,
+		CertificateTypeServer:               settings.Server,
+		CertificateTypeDevice:               settings.Device,
+	}
+	for certificateType, algorithm := range certificateTypes {
+		if _, err := ParseKeyAlgorithm(string(algorithm)); err != nil {
+			return fmt.Errorf("%s certificates: %w", certificateType, err)
+		}
+	}
+	for platform, algorithm := range settings.Platforms {
+		if _, err := ParseKeyAlgorithm(string(algorithm)); err != nil {
+			return fmt.Errorf("%s Emissary Bundles: %w", platform, err)
+		}
+	}
+	for platform, encoding := range settings.Encodings {
+		if _, err := ParseKeyEncoding(string(encoding)); err != nil {
+			return fmt.Errorf("%s Emissary Bundles: %w", platform, err)
+		}
+	}
+
+	for certificateType, algorithm := range certificateTypes {
+		err := c.DB.CreateNewDrawbridgeConfigSettings(keyAlgorithmSettingName(certificateType), string(algorithm))
+		if err != nil {
+			return err
+		}
+	}
+	for _, platform := range EmissaryPlatforms {
+		// An empty value falls back to the device key algorithm.
+		err := c.DB.CreateNewDrawbridgeConfigSettings(platformKeyAlgorithmSettingName(platform), string(settings.Platforms[platform]))
+		if err != nil {
+			return err
+		}
+		// An empty value falls back to the platform's default key encoding.
+		err = c.DB.CreateNewDrawbridgeConfigSettings(platformKeyEncodingSettingName(platform), string(settings.Encodings[platform]))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the key usage for a certificate with the key. RSA keys can also be used for RSA key exchange,
+// which some older TLS clients still negotiate.
+func leafKeyUsage(key crypto.Signer) x509.KeyUsage {
+	if _, ok := key.(*rsa.PrivateKey); ok {
+		return x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment
+	}
+	return x509.KeyUsageDigitalSignature
+}
+
+// PEM-encodes a private key with the key encoding.
+func EncodePrivateKeyAs(key crypto.Signer, encoding KeyEncoding) ([]byte, error) {
+	if encoding != KeyEncodingPKCS8 {
+		return EncodePrivateKey(key)
+	}
+	keyBytes, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "PRIVATE KEY",
+		Bytes: keyBytes,
+	}), nil
+}
@@ -0,0 +1,309 @@
+package certificates
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"imdawon/drawbridge/cmd/utils"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// Drawbridge can encrypt the certificate authority and server private keys at rest.
+// Each key file holds the original PEM-encoded key, sealed with AES-256-GCM under a key-encryption key
+// derived from a passphrase with scrypt. The passphrase comes from one of, in order:
+//   - the file passed with the -keyfile flag
+//   - the drawbridge-key-passphrase systemd credential (LoadCredential= or SetCredentialEncrypted=)
+//   - the DRAWBRIDGE_KEY_PASSPHRASE environment variable
+//   - a prompt at startup, when Drawbridge runs in a terminal
+//
+// Until the passphrase is provided, the certificate authority is locked: Drawbridge can't accept Emissary
+// connections or issue certificates. The Drawbridge admin can unlock it from the Drawbridge Dashboard.
+const (
+	encryptedPrivateKeyBlockType     = "DRAWBRIDGE ENCRYPTED PRIVATE KEY"
+	KeyPassphraseEnvironmentVariable = "DRAWBRIDGE_KEY_PASSPHRASE"
+	KeyPassphraseCredentialName      = "drawbridge-key-passphrase"
+
+	// scrypt parameters recommended for interactive logins. They are stored with each key so they can be raised later.
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+
+	// The highest scrypt parameters a key file can ask for. Anything above them would let a tampered key file make
+	// Drawbridge spend gigabytes of memory or minutes of CPU deriving the key-encryption key.
+	maxScryptN = 1 << 20
+	maxScryptR = 16
+	maxScryptP = 4
+)
+
+// Returned while the certificate authority keys are encrypted and no passphrase has been provided.
+var ErrCertificateAuthorityLocked = errors.New("the certificate authority is locked, unlock it in the Drawbridge Dashboard")
+
+// Returned when a passphrase fails to decrypt a key.
+var ErrIncorrectKeyPassphrase = errors.New("incorrect key passphrase")
+
+// Reads the key-encryption passphrase from the non-interactive sources, in order of precedence.
+// Returns nil if none of them are set. The environment variable is cleared once read so child processes don't inherit it.
+func ReadKeyPassphrase(keyFile string) ([]byte, error) {
+	if keyFile != "" {
+		return readPassphraseFile(keyFile)
+	}
+	if credentialsDirectory := os.Getenv("CREDENTIALS_DIRECTORY"); credentialsDirectory != "" {
+		credentialPath := filepath.Join(credentialsDirectory, KeyPassphraseCredentialName)
+		if _, err := os.Stat(credentialPath); err == nil {
+			return readPassphraseFile(credentialPath)
+		}
+	}
+	if passphrase, ok := os.LookupEnv(KeyPassphraseEnvironmentVariable); ok {
+		os.Unsetenv(KeyPassphraseEnvironmentVariable)
+		if passphrase == "" {
+			return nil, fmt.Errorf("%s is set but empty", KeyPassphraseEnvironmentVariable)
+		}
+		return []byte(passphrase), nil
+	}
+	return nil, nil
+}
+
+func readPassphraseFile(path string) ([]byte, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read key passphrase file: %w", err)
+	}
+	// Editors and `echo` add a trailing newline that isn't part of the passphrase.
+	contents = bytes.TrimRight(contents, "\r\n")
+	if len(contents) == 0 {
+		return nil, fmt.Errorf("key passphrase file %s is empty", path)
+	}
+	return contents, nil
+}
+
+// Reports whether any of the certificate authority and server keys on disk are encrypted.
+func PrivateKeysEncrypted() bool {
+	for _, keyPath := range []string{caKeyPath, intermediateKeyPath, serverKeyPath} {
+		contents := utils.ReadFile(keyPath)
+		if contents == nil {
+			continue
+		}
+		block, _ := pem.Decode(*contents)
+		if block != nil && block.Type == encryptedPrivateKeyBlockType {
+			return true
+		}
+	}
+	return false
+}
+
+// Seals a PEM-encoded private key with a key derived from passphrase.
+func encryptPrivateKeyPEM(keyPEM, passphrase []byte) ([]byte, error) {
+	return SealWithPassphrase(encryptedPrivateKeyBlockType, keyPEM, passphrase)
+}
+
+// Opens a key sealed by encryptPrivateKeyPEM and returns the original PEM-encoded private key.
+func decryptPrivateKeyBlock(block *pem.Block, passphrase []byte) ([]byte, error) {
+	return OpenWithPassphrase(block, passphrase)
+}
+
+// Seals plaintext in a PEM block of blockType with a key derived from passphrase, the same way Drawbridge
+// encrypts private keys at rest. Also used for encrypted backups.
+func SealWithPassphrase(blockType string, plaintext, passphrase []byte) ([]byte, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := newKeyEncryptionCipher(passphrase, salt, scryptN, scryptR, scryptP)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{
+		Type: blockType,
+		Headers: map[string]string{
+			"KDF":        "scrypt",
+			"KDF-Params": fmt.Sprintf("N=%d,r=%d,p=%d", scryptN, scryptR, scryptP),
+			"Salt":       base64.StdEncoding.EncodeToString(salt),
+			"Cipher":     "AES-256-GCM",
+			"Nonce":      base64.StdEncoding.EncodeToString(nonce),
+		},
+		Bytes: aead.Seal(nil, nonce, plaintext, []byte(blockType)),
+	}), nil
+}
+
+// Opens a PEM block sealed by SealWithPassphrase and returns the plaintext.
+// Returns ErrIncorrectKeyPassphrase if the passphrase is wrong or the block was tampered with.
+func OpenWithPassphrase(block *pem.Block, passphrase []byte) ([]byte, error) {
+	if block.Headers["KDF"] != "scrypt" || block.Headers["Cipher"] != "AES-256-GCM" {
+		return nil, fmt.Errorf("unsupported encryption %s/%s", block.Headers["KDF"], block.Headers["Cipher"])
+	}
+	n, r, p, err := parseScryptParams(block.Headers["KDF-Params"])
+	if err != nil {
+		return nil, err
+	}
+	salt, err := base64.StdEncoding.DecodeString(block.Headers["Salt"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid salt: %w", err)
+	}
+	nonce, err := base64.StdEncoding.DecodeString(block.Headers["Nonce"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid nonce: %w", err)
+	}
+	aead, err := newKeyEncryptionCipher(passphrase, salt, n, r, p)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("invalid nonce length %d", len(nonce))
+	}
+	plaintext, err := aead.Open(nil, nonce, block.Bytes, []byte(block.Type))
+	if err != nil {
+		return nil, ErrIncorrectKeyPassphrase
+	}
+	return plaintext, nil
+}
+
+func newKeyEncryptionCipher(passphrase, salt []byte, n, r, p int) (cipher.AEAD, error) {
+	keyEncryptionKey, err := scrypt.Key(passphrase, salt, n, r, p, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(keyEncryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func parseScryptParams(params string) (n, r, p int, err error) {
+	values := map[string]*int{"N": &n, "r": &r, "p": &p}
+	for _, param := range strings.Split(params, ",") {
+		name, value, found := strings.Cut(param, "=")
+		target, known := values[name]
+		if !found || !known {
+			return 0, 0, 0, fmt.Errorf("invalid scrypt parameters %q", params)
+		}
+		*target, err = strconv.Atoi(value)
+		if err != nil {
+			return 0, 0, 0, fmt.Errorf("invalid scrypt parameters %q", params)
+		}
+	}
+	if n <= 0 || r <= 0 || p <= 0 {
+		return 0, 0, 0, fmt.Errorf("invalid scrypt parameters %q", params)
+	}
+	if n > maxScryptN || r > maxScryptR || p > maxScryptP {
+		return 0, 0, 0, fmt.Errorf("scrypt parameters %q are above the maximum of N=%d,r=%d,p=%d", params, maxScryptN, maxScryptR, maxScryptP)
+	}
+	return n, r, p, nil
+}
+
+// Sets the passphrase used to decrypt the private keys on disk, and to encrypt keys Drawbridge writes from now on.
+// Must be called before SetupCertificates.
+func (c *CA) UseKeyPassphrase(passphrase []byte) {
+	c.keyPassphrase = passphrase
+}
+
+// Reports whether the certificate authority is waiting for the key passphrase.
+func (c *CA) Locked() bool {
+	return c.locked.Load()
+}
+
+// Decrypts the private keys on disk with passphrase and starts serving TLS with them.
+func (c *CA) Unlock(passphrase []byte) error {
+	c.rotationMutex.Lock()
+	defer c.rotationMutex.Unlock()
+
+	if !c.locked.Load() {
+		return fmt.Errorf("the certificate authority is not locked")
+	}
+	c.keyPassphrase = passphrase
+	err := c.loadPrivateKeys()
+	if err != nil {
+		c.keyPassphrase = nil
+		return err
+	}
+	c.locked.Store(false)
+	slog.Info("Certificate Authority", slog.String("Unlocked", "private keys decrypted"))
+	return nil
+}
+
+// Re-encrypts every private key on disk with a new passphrase. A nil passphrase stores the keys unencrypted.
+func (c *CA) ChangeKeyPassphrase(passphrase []byte) error {
+	c.rotationMutex.Lock()
+	defer c.rotationMutex.Unlock()
+
+	if c.locked.Load() {
+		return ErrCertificateAuthorityLocked
+	}
+	serverConfig := c.currentServerTLSConfig.Load()
+	if serverConfig == nil {
+		return fmt.Errorf("the server certificate is not loaded")
+	}
+	serverKey, ok := serverConfig.Certificates[0].PrivateKey.(crypto.Signer)
+	if !ok {
+		return fmt.Errorf("unsupported server private key type %T", serverConfig.Certificates[0].PrivateKey)
+	}
+	keys := map[string]crypto.Signer{serverKeyPath: serverKey}
+	if c.PrivateKey != nil {
+		keys[caKeyPath] = c.PrivateKey
+	}
+	if c.IntermediatePrivateKey != nil {
+		keys[intermediateKeyPath] = c.IntermediatePrivateKey
+	}
+
+	// Stage every key before replacing any file so a failure can't leave keys under different passphrases.
+	previousPassphrase := c.keyPassphrase
+	c.keyPassphrase = passphrase
+	files := &stagedFiles{}
+	defer files.discard()
+	for keyPath, key := range keys {
+		keyPEM, err := c.encodePrivateKeyForDisk(key)
+		if err == nil {
+			err = files.replaceFile(keyPath, keyPEM, 0600)
+		}
+		if err != nil {
+			c.keyPassphrase = previousPassphrase
+			return err
+		}
+	}
+	err := files.commit()
+	if err != nil {
+		c.keyPassphrase = previousPassphrase
+		return err
+	}
+	return nil
+}
+
+// Returns the plaintext PEM-encoded private key, decrypting it with the key passphrase if it is encrypted.
+func (c *CA) decryptPrivateKeyPEM(keyPEM []byte) ([]byte, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil || block.Type != encryptedPrivateKeyBlockType {
+		return keyPEM, nil
+	}
+	if c.keyPassphrase == nil {
+		return nil, ErrCertificateAuthorityLocked
+	}
+	return decryptPrivateKeyBlock(block, c.keyPassphrase)
+}
+
+// PEM-encodes a private key for disk, encrypted if a key passphrase is set.
+func (c *CA) encodePrivateKeyForDisk(key crypto.Signer) ([]byte, error) {
+	keyPEM, err := EncodePrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if c.keyPassphrase == nil {
+		return keyPEM, nil
+	}
+	return encryptPrivateKeyPEM(keyPEM, c.keyPassphrase)
+}
@@ -0,0 +1,345 @@
+package certificates
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"imdawon/drawbridge/cmd/drawbridge/emissary"
+	"imdawon/drawbridge/cmd/utils"
+	"log/slog"
+	"time"
+)
+
+// A certificate authority rotation lets a Drawbridge admin replace a compromised or expiring certificate authority
+// without hand-delivering new Emissary Bundles to every device.
+//
+// When a rotation starts, Drawbridge generates a new certificate authority and cross-signs it with the previous one.
+// Until the deadline, Drawbridge trusts device certificates issued by either certificate authority and presents the
+// cross-signed certificate so Emissary clients that still pin the previous certificate authority can verify it.
+// Connected Emissary clients pick up a new device certificate and certificate authority pin with the CA_ROTN command.
+// Once the deadline passes the previous certificate authority is distrusted.
+type Rotation struct {
+	// The certificate authority being retired.
+	PreviousCertificateAuthority *x509.Certificate
+	// The intermediate certificate authority being retired, if the previous certificate authority had one.
+	PreviousIntermediate *x509.Certificate
+	// The current certificate authority, signed by the previous certificate authority.
+	CrossCertificate *x509.Certificate
+	Deadline         time.Time
+}
+
+const (
+	rotationDeadlineSetting        = "ca_rotation_deadline"
+	previousCACertificatePath      = "ca/previous-ca.crt"
+	crossSignedCertificatePath     = "ca/ca-cross.crt"
+	retiredCertificateAuthorityDir = "ca/retired"
+)
+
+// Generates a new certificate authority and starts trusting both it and the current certificate authority
+// for the overlap duration.
+func (c *CA) StartRotation(overlap time.Duration) error {
+	c.rotationMutex.Lock()
+	defer c.rotationMutex.Unlock()
+
+	if c.Rotation != nil {
+		return fmt.Errorf("a certificate authority rotation is already in progress until %s", c.Rotation.Deadline.Format(time.RFC1123))
+	}
+	if overlap <= 0 {
+		return fmt.Errorf("the rotation overlap window must be longer than zero")
+	}
+	if c.locked.Load() {
+		return ErrCertificateAuthorityLocked
+	}
+	// The previous root key cross-signs the new certificate authority.
+	if c.PrivateKey == nil {
+		return fmt.Errorf("rotating the certificate authority needs the root key, copy it back to %s and restart Drawbridge", caKeyPath)
+	}
+
+	listeningAddress, err := c.DB.GetDrawbridgeConfigValueByName("listening_address")
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(overlap)
+	newCA, newCAPrivKey, err := newCertificateAuthority(*listeningAddress, fmt.Sprintf("Drawbridge CA %s", time.Now().Format(time.DateOnly)), c.KeyAlgorithm(CertificateTypeCertificateAuthority))
+	if err != nil {
+		return err
+	}
+
+	// Cross-sign the new certificate authority with the previous one. It only needs to be valid for the overlap window.
+	crossTemplate := *newCA
+	crossTemplate.SerialNumber, err = newSerialNumber()
+	if err != nil {
+		return err
+	}
+	crossTemplate.NotAfter = deadline
+	crossBytes, err := x509.CreateCertificate(rand.Reader, &crossTemplate, c.CertificateAuthority, newCAPrivKey.Public(), c.PrivateKey)
+	if err != nil {
+		return fmt.Errorf("failed to cross-sign new certificate authority: %w", err)
+	}
+	crossCert, err := x509.ParseCertificate(crossBytes)
+	if err != nil {
+		return err
+	}
+
+	// Every file is staged and only renamed into place once the rotation deadline is saved,
+	// so a failure part way through leaves the current certificate authority usable, even after a restart.
+	files := &stagedFiles{}
+	defer files.discard()
+	err = files.replaceFile(previousCACertificatePath, encodeCertificate(c.CertificateAuthority.Raw), 0644)
+	if err != nil {
+		return err
+	}
+	err = files.replaceFile(crossSignedCertificatePath, encodeCertificate(crossBytes), 0644)
+	if err != nil {
+		return err
+	}
+	rotation := &Rotation{
+		PreviousCertificateAuthority: c.CertificateAuthority,
+		PreviousIntermediate:         c.Intermediate,
+		CrossCertificate:             crossCert,
+		Deadline:                     deadline,
+	}
+	// Installs with an intermediate certificate authority get a new one signed by the new root.
+	var newIntermediate *x509.Certificate
+	var newIntermediateKey crypto.Signer
+	if c.Intermediate != nil {
+		err = files.replaceFile(previousIntermediateCertificatePath, encodeCertificate(c.Intermediate.Raw), 0644)
+		if err != nil {
+			return err
+		}
+		newIntermediateKey, err = c.KeyAlgorithm(CertificateTypeCertificateAuthority).GenerateKey()
+		if err != nil {
+			return err
+		}
+		newIntermediate, err = newIntermediateCertificateAuthority(newCA, newCAPrivKey, newIntermediateKey)
+		if err != nil {
+			return err
+		}
+		err = c.saveIntermediate(files, newIntermediate, nil, newIntermediateKey)
+		if err != nil {
+			return err
+		}
+	}
+	err = c.saveCertificateAuthority(files, newCA, newCAPrivKey)
+	if err != nil {
+		return err
+	}
+
+	// The server certificate is signed by the new certificate authority, so swap it in while issuing it.
+	previousCA, previousCAPrivKey := c.CertificateAuthority, c.PrivateKey
+	previousIntermediate, previousIntermediateKey, previousIntermediateChain := c.Intermediate, c.IntermediatePrivateKey, c.intermediateChain
+	c.CertificateAuthority, c.PrivateKey = newCA, newCAPrivKey
+	if newIntermediate != nil {
+		c.Intermediate, c.IntermediatePrivateKey, c.intermediateChain = newIntermediate, newIntermediateKey, nil
+	}
+	serverCert, err := c.createServerCertificate(files, *listeningAddress)
+	if err == nil {
+		err = c.DB.CreateNewDrawbridgeConfigSettings(rotationDeadlineSetting, deadline.UTC().Format(time.RFC3339))
+	}
+	if err == nil {
+		err = files.commit()
+		if err != nil {
+			c.DB.DeleteDrawbridgeConfigSetting(rotationDeadlineSetting)
+		}
+	}
+	if err != nil {
+		c.CertificateAuthority, c.PrivateKey = previousCA, previousCAPrivKey
+		c.Intermediate, c.IntermediatePrivateKey, c.intermediateChain = previousIntermediate, previousIntermediateKey, previousIntermediateChain
+		return err
+	}
+	c.Rotation = rotation
+	c.applyTLSConfig(serverCert)
+	c.scheduleRotationDeadline()
+
+	slog.Info("Certificate Authority Rotation", slog.String("Started, previous certificate authority is trusted until", deadline.Format(time.RFC1123)))
+	return nil
+}
+
+// Distrusts the previous certificate authority. Emissary devices that never picked up a new certificate
+// can no longer connect and have to be issued a new Emissary Bundle.
+func (c *CA) FinishRotation() error {
+	c.rotationMutex.Lock()
+	defer c.rotationMutex.Unlock()
+
+	if c.Rotation == nil {
+		return nil
+	}
+
+	// Keep a copy of the retired certificate authority for reference. Its private key is already gone.
+	retiredName := fmt.Sprintf("ca-%s.crt", c.Rotation.PreviousCertificateAuthority.SerialNumber.Text(16))
+	err := utils.ReplaceFile(retiredName, encodeCertificate(c.Rotation.PreviousCertificateAuthority.Raw), retiredCertificateAuthorityDir, 0644)
+	if err != nil {
+		return err
+	}
+	if c.Rotation.PreviousIntermediate != nil {
+		retiredName = fmt.Sprintf("intermediate-%s.crt", c.Rotation.PreviousIntermediate.SerialNumber.Text(16))
+		err = utils.ReplaceFile(retiredName, encodeCertificate(c.Rotation.PreviousIntermediate.Raw), retiredCertificateAuthorityDir, 0644)
+		if err != nil {
+			return err
+		}
+		err = utils.DeleteFile(previousIntermediateCertificatePath)
+		if err != nil {
+			return err
+		}
+	}
+	err = utils.DeleteFile(previousCACertificatePath)
+	if err != nil {
+		return err
+	}
+	err = utils.DeleteFile(crossSignedCertificatePath)
+	if err != nil {
+		return err
+	}
+	err = c.DB.DeleteSupersededCertificates()
+	if err != nil {
+		return err
+	}
+	err = c.DB.DeleteDrawbridgeConfigSetting(rotationDeadlineSetting)
+	if err != nil {
+		return err
+	}
+
+	c.Rotation = nil
+	if c.rotationTimer != nil {
+		c.rotationTimer.Stop()
+		c.rotationTimer = nil
+	}
+
+	// Drop the cross-signed certificate from the chain we present and the previous certificate authority
+	// from the pool of trusted certificate authorities.
+	c.applyTLSConfig(c.currentServerTLSConfig.Load().Certificates[0])
+
+	err = c.loadEmissaryCertificates()
+	if err != nil {
+		return err
+	}
+
+	slog.Info("Certificate Authority Rotation", slog.String("Finished", "previous certificate authority is no longer trusted"))
+	return nil
+}
+
+// Reads the state of a certificate authority rotation from disk, if one is in progress.
+func (c *CA) loadRotation() error {
+	deadlineValue, err := c.DB.GetDrawbridgeConfigValueByName(rotationDeadlineSetting)
+	if err != nil {
+		return err
+	}
+	if deadlineValue == nil || *deadlineValue == "" {
+		return nil
+	}
+	deadline, err := time.Parse(time.RFC3339, *deadlineValue)
+	if err != nil {
+		return fmt.Errorf("error parsing certificate authority rotation deadline: %w", err)
+	}
+
+	previousCA, err := readCertificateFile(previousCACertificatePath)
+	if err != nil {
+		return err
+	}
+	crossCert, err := readCertificateFile(crossSignedCertificatePath)
+	if err != nil {
+		return err
+	}
+	var previousIntermediate *x509.Certificate
+	if utils.FileExists(previousIntermediateCertificatePath) {
+		previousIntermediate, err = readCertificateFile(previousIntermediateCertificatePath)
+		if err != nil {
+			return err
+		}
+	}
+	c.Rotation = &Rotation{
+		PreviousCertificateAuthority: previousCA,
+		PreviousIntermediate:         previousIntermediate,
+		CrossCertificate:             crossCert,
+		Deadline:                     deadline,
+	}
+	return nil
+}
+
+// Finishes the rotation when the deadline passes. If the deadline passed while Drawbridge was stopped,
+// the rotation finishes right away.
+func (c *CA) scheduleRotationDeadline() {
+	if c.rotationTimer != nil {
+		c.rotationTimer.Stop()
+	}
+	c.rotationTimer = time.AfterFunc(time.Until(c.Rotation.Deadline), func() {
+		err := c.FinishRotation()
+		if err != nil {
+			slog.Error("Certificate Authority Rotation", slog.Any("Error finishing rotation", err))
+		}
+	})
+}
+
+// Returns the rotation in progress, or nil. A Rotation doesn't change once it has started.
+func (c *CA) CurrentRotation() *Rotation {
+	c.rotationMutex.RLock()
+	defer c.rotationMutex.RUnlock()
+	return c.Rotation
+}
+
+// Returns the current root certificate authority, which a rotation replaces.
+func (c *CA) CurrentCertificateAuthority() *x509.Certificate {
+	c.rotationMutex.RLock()
+	defer c.rotationMutex.RUnlock()
+	return c.CertificateAuthority
+}
+
+// Reports whether an Emissary device certificate was issued by the current certificate authority.
+// Devices that return false during a rotation haven't picked up their new certificate yet.
+func (c *CA) IssuedByCurrentCertificateAuthority(certificatePEM string) bool {
+	block, _ := pem.Decode([]byte(certificatePEM))
+	if block == nil {
+		return false
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return false
+	}
+	c.rotationMutex.RLock()
+	defer c.rotationMutex.RUnlock()
+	roots := x509.NewCertPool()
+	roots.AddCert(c.CertificateAuthority)
+	intermediates := x509.NewCertPool()
+	if c.Intermediate != nil {
+		intermediates.AddCert(c.Intermediate)
+	}
+	for _, intermediate := range c.intermediateChain {
+		intermediates.AddCert(intermediate)
+	}
+	_, err = cert.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	return err == nil
+}
+
+// Returns the Emissary devices still using a certificate issued by a previous certificate authority. Revoked devices
+// are never reissued a certificate, so they aren't waited for.
+func (c *CA) DevicesPendingMigration(clients []*emissary.EmissaryClient) []*emissary.EmissaryClient {
+	var pending []*emissary.EmissaryClient
+	for _, client := range clients {
+		if client.Revoked == 1 {
+			continue
+		}
+		if !c.IssuedByCurrentCertificateAuthority(client.DrawbridgeCertificate) {
+			pending = append(pending, client)
+		}
+	}
+	return pending
+}
+
+func readCertificateFile(pathWithFilename string) (*x509.Certificate, error) {
+	contents := utils.ReadFile(pathWithFilename)
+	if contents == nil {
+		return nil, fmt.Errorf("unable to read %s", pathWithFilename)
+	}
+	block, _ := pem.Decode(*contents)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("failed to decode PEM block containing CERTIFICATE in %s", pathWithFilename)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
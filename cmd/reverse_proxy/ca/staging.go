@@ -0,0 +1,53 @@
+package certificates
+
+import (
+	"imdawon/drawbridge/cmd/utils"
+	"os"
+	"path/filepath"
+)
+
+// Files that have to be replaced together, like a new certificate authority and the server certificate it signs.
+// Each file is first written next to the file it replaces and only renamed into place by commit, so a failure
+// part way through leaves every file Drawbridge loads on startup untouched.
+//
+// A nil *stagedFiles replaces files immediately.
+type stagedFiles struct {
+	// Drawbridge file paths, like ca/ca.crt, that have a staged file waiting to be renamed into place.
+	paths []string
+}
+
+const stagedFileSuffix = ".staged"
+
+func (s *stagedFiles) replaceFile(pathWithFilename string, contents []byte, perm os.FileMode) error {
+	if s == nil {
+		return utils.ReplaceFile(filepath.Base(pathWithFilename), contents, filepath.Dir(pathWithFilename), perm)
+	}
+	err := utils.ReplaceFile(filepath.Base(pathWithFilename)+stagedFileSuffix, contents, filepath.Dir(pathWithFilename), perm)
+	if err != nil {
+		return err
+	}
+	s.paths = append(s.paths, pathWithFilename)
+	return nil
+}
+
+// Renames every staged file into place.
+func (s *stagedFiles) commit() error {
+	for i, pathWithFilename := range s.paths {
+		fullFilePath := utils.CreateDrawbridgeFilePath(pathWithFilename)
+		err := os.Rename(fullFilePath+stagedFileSuffix, fullFilePath)
+		if err != nil {
+			s.paths = s.paths[i:]
+			return err
+		}
+	}
+	s.paths = nil
+	return nil
+}
+
+// Deletes staged files that were never renamed into place.
+func (s *stagedFiles) discard() {
+	for _, pathWithFilename := range s.paths {
+		utils.DeleteFile(pathWithFilename + stagedFileSuffix)
+	}
+	s.paths = nil
+}
@@ -0,0 +1,68 @@
+package certificates
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+)
+
+// The drawbridge_config setting holding the listening address of the standby Drawbridge, see the replication package.
+// Server certificates are valid for the standby's address as well, so the standby presents the same certificate as
+// the primary and Emissary clients can connect to either.
+const StandbyListeningAddressSetting = "replication_standby_listening_address"
+
+func (c *CA) addStandbyListeningAddress(template *x509.Certificate) error {
+	if c.DB == nil {
+		return nil
+	}
+	standbyAddress, err := c.DB.GetDrawbridgeConfigValueByName(StandbyListeningAddressSetting)
+	if err != nil {
+		return err
+	}
+	if standbyAddress == nil || *standbyAddress == "" {
+		return nil
+	}
+	template.DNSNames = append(template.DNSNames, *standbyAddress)
+	if ip := net.ParseIP(*standbyAddress); ip != nil {
+		template.IPAddresses = append(template.IPAddresses, ip)
+	}
+	return nil
+}
+
+// Issues a new server certificate for the current listening addresses, e.g. after pairing a standby Drawbridge.
+func (c *CA) ReissueServerCertificate() error {
+	listeningAddress, err := c.DB.GetDrawbridgeConfigValueByName("listening_address")
+	if err != nil {
+		return err
+	}
+	serverCert, err := c.createServerCertificate(nil, *listeningAddress)
+	if err != nil {
+		return err
+	}
+	c.applyTLSConfig(serverCert)
+	return nil
+}
+
+// Returns a TLS config for mTLS listeners other than the Emissary tunnel, e.g. replication to a standby Drawbridge.
+// Like the tunnel it presents the current server certificate and requires a client certificate issued by the
+// certificate authority, but the client certificate is checked with verify instead of the Emissary certificate list.
+func (c *CA) PeerTLSConfig(verify func(certificate *x509.Certificate) error) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS13,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			config := c.currentServerTLSConfig.Load()
+			if config == nil {
+				return nil, errors.New("the certificate authority has not been set up yet")
+			}
+			config = config.Clone()
+			config.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+				if len(verifiedChains) == 0 || len(verifiedChains[0]) == 0 {
+					return errors.New("no verified client certificate")
+				}
+				return verify(verifiedChains[0][0])
+			}
+			return config, nil
+		},
+	}
+}
@@ -82,7 +82,7 @@ func SaveFileByte(fileName string, fileContents []byte, relativePath string) err
 
 		err := os.Mkdir(relativePath, os.ModePerm)
 		if err != nil {
-			slog.Error("Error creating file on path %s/%s: %s", relativePath, fileName, err)
+			slog.Error("File Operation", slog.String("Fail - Creating Folder Path", fullFilePath), slog.Any("error", err))
 		}
 	}
 
@@ -100,6 +100,57 @@ func SaveFileByte(fileName string, fileContents []byte, relativePath string) err
 	return nil
 }
 
+// Save file, replacing it if it already exists.
+// The contents are written to a temporary file first and renamed into place, so a crash midway through
+// never leaves a truncated certificate or key behind.
+func ReplaceFile(fileName string, fileContents []byte, relativePath string, perm os.FileMode) error {
+	// Ensure we are only reading files from our executable and not where the terminal is executing from.
+	execPath, err := os.Executable()
+	if err != nil {
+		slog.Error(err.Error())
+	}
+	execDirPath := path.Dir(execPath)
+	relativePath = filepath.Join(execDirPath, relativePath)
+	fullFilePath := filepath.Join(relativePath, fileName)
+
+	if err := os.MkdirAll(relativePath, os.ModePerm); err != nil {
+		return fmt.Errorf("error creating folder path %s: %w", relativePath, err)
+	}
+
+	f, err := os.CreateTemp(relativePath, fileName+".tmp*")
+	if err != nil {
+		return fmt.Errorf("error creating temporary file for %s: %w", fullFilePath, err)
+	}
+	tmpPath := f.Name()
+	defer os.Remove(tmpPath)
+
+	if _, err := f.Write(fileContents); err != nil {
+		f.Close()
+		return fmt.Errorf("error writing file contents: %w", err)
+	}
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		return fmt.Errorf("error setting file permissions: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	slog.Debug("File Operation", slog.String("Replace Drawbridge File", fullFilePath))
+	return os.Rename(tmpPath, fullFilePath)
+}
+
+// Delete a single Drawbridge file. Deleting a file that doesn't exist is not an error.
+func DeleteFile(pathWithFilename string) error {
+	fullFilePath := CreateDrawbridgeFilePath(pathWithFilename)
+	err := os.Remove(fullFilePath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		slog.Error("File Operation", slog.Any("Fail - Deleting Drawbridge File", fullFilePath))
+		return err
+	}
+	return nil
+}
+
 func DeleteDirectory(relativePath string) error {
 	execPath, err := os.Executable()
 	if err != nil {
@@ -374,7 +425,11 @@ func BeautifulTimeSince(timestamp string) string {
 	if err != nil {
 		return "Invalid timestamp"
 	}
+	return BeautifulTime(t)
+}
 
+// Describes how long ago t was, e.g. "Around 3 hours ago".
+func BeautifulTime(t time.Time) string {
 	// Calculate the duration between the timestamp and the current time
 	duration := time.Since(t)
 
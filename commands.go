@@ -0,0 +1,581 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"imdawon/drawbridge/cmd/drawbridge"
+	"imdawon/drawbridge/cmd/drawbridge/backup"
+	"imdawon/drawbridge/cmd/drawbridge/declarative"
+	"imdawon/drawbridge/cmd/drawbridge/persistence"
+	"imdawon/drawbridge/cmd/drawbridge/replication"
+	flagger "imdawon/drawbridge/cmd/flags"
+	certificates "imdawon/drawbridge/cmd/reverse_proxy/ca"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// Drawbridge admin commands run instead of the Drawbridge servers, e.g. `drawbridge ca export-root root.key`.
+// They work against the same database and files as a running Drawbridge, which needs to be restarted to pick up any changes.
+func runCommand(db *persistence.SQLiteRepository, keyPassphrase []byte, args []string) error {
+	switch args[0] {
+	case "ca":
+		return runCertificateAuthorityCommand(db, keyPassphrase, args[1:])
+	case "backup":
+		return runBackupCommand(db, args[1:])
+	case "plan":
+		return runPlanCommand(db, args[1:], false)
+	case "apply":
+		return runPlanCommand(db, args[1:], true)
+	case "replication":
+		return runReplicationCommand(db, keyPassphrase, args[1:])
+	case "lockdown":
+		return runLockdownCommand(db, args[1:])
+	default:
+		return fmt.Errorf("unknown command %q, available commands: apply, backup, ca, lockdown, migrate, plan, replication, restore", args[0])
+	}
+}
+
+func runCertificateAuthorityCommand(db *persistence.SQLiteRepository, keyPassphrase []byte, args []string) error {
+	usage := `usage:
+  drawbridge ca export-root <destination>
+      write the root certificate authority key to destination and remove it from this server
+  drawbridge ca resign-intermediate [-rekey] <root key file>
+      sign a new intermediate certificate authority with the root key
+  drawbridge ca set-key-passphrase [-from-file <file>] [-remove]
+      encrypt the certificate authority and server keys at rest with a new passphrase
+  drawbridge ca import <certificate chain file> <key file>
+      replace the certificate authority with an existing one, e.g. from step-ca or openssl`
+	if len(args) == 0 {
+		return fmt.Errorf("%s", usage)
+	}
+
+	ca, err := loadCertificateAuthority(db, keyPassphrase)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "export-root":
+		if len(args) != 2 {
+			return fmt.Errorf("%s", usage)
+		}
+		err = ca.ExportRootKey(args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Exported the root key to %s. Keep it somewhere safe and offline, you need it to re-sign the intermediate certificate authority.\n", args[1])
+	case "resign-intermediate":
+		commandFlags := flag.NewFlagSet("resign-intermediate", flag.ContinueOnError)
+		rekey := commandFlags.Bool("rekey", false, "generate a new intermediate key. Every Emissary device will need a new Emissary Bundle.")
+		err = commandFlags.Parse(args[1:])
+		if err != nil {
+			return err
+		}
+		if commandFlags.NArg() != 1 {
+			return fmt.Errorf("%s", usage)
+		}
+		rootKeyPEM, err := os.ReadFile(commandFlags.Arg(0))
+		if err != nil {
+			return err
+		}
+		err = ca.ResignIntermediate(rootKeyPEM, *rekey)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Signed a new intermediate certificate authority valid until %s. Restart Drawbridge to start using it.\n", ca.Intermediate.NotAfter.Format("2006-01-02"))
+	case "import":
+		if len(args) != 3 {
+			return fmt.Errorf("%s", usage)
+		}
+		chainPEM, err := os.ReadFile(args[1])
+		if err != nil {
+			return err
+		}
+		keyPEM, err := os.ReadFile(args[2])
+		if err != nil {
+			return err
+		}
+		imported, err := certificates.ParseImportedCertificateAuthority(chainPEM, keyPEM)
+		if err != nil {
+			return err
+		}
+		err = ca.ImportCertificateAuthority(imported)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Imported %s. Restart Drawbridge to start using it, then create a new Emissary Bundle for every Emissary device.\n", imported.Issuer.Subject)
+	case "set-key-passphrase":
+		commandFlags := flag.NewFlagSet("set-key-passphrase", flag.ContinueOnError)
+		fromFile := commandFlags.String("from-file", "", "read the new passphrase from a file, e.g. the file you pass to -keyfile")
+		remove := commandFlags.Bool("remove", false, "store the keys unencrypted")
+		err = commandFlags.Parse(args[1:])
+		if err != nil {
+			return err
+		}
+		var newPassphrase []byte
+		switch {
+		case *remove:
+		case *fromFile != "":
+			newPassphrase, err = certificates.ReadKeyPassphrase(*fromFile)
+		default:
+			newPassphrase, err = promptNewPassphrase()
+		}
+		if err != nil {
+			return err
+		}
+		err = ca.ChangeKeyPassphrase(newPassphrase)
+		if err != nil {
+			return err
+		}
+		if newPassphrase == nil {
+			fmt.Println("The certificate authority and server keys are no longer encrypted.")
+		} else {
+			fmt.Printf("Encrypted the certificate authority and server keys. Drawbridge reads the passphrase from -keyfile, the %s systemd credential, or %s, and otherwise asks for it.\n", certificates.KeyPassphraseCredentialName, certificates.KeyPassphraseEnvironmentVariable)
+		}
+	default:
+		return fmt.Errorf("%s", usage)
+	}
+	return nil
+}
+
+// Loads the certificate authority from disk. Drawbridge creates the certificate authority during onboarding,
+// so there is nothing to load before the Drawbridge admin has set a listening address.
+func loadCertificateAuthority(db *persistence.SQLiteRepository, keyPassphrase []byte) (*certificates.CA, error) {
+	listeningAddress, err := db.GetDrawbridgeConfigValueByName("listening_address")
+	if err != nil {
+		return nil, err
+	}
+	if listeningAddress == nil || *listeningAddress == "" {
+		return nil, fmt.Errorf("finish setting up Drawbridge in the Drawbridge Dashboard before managing the certificate authority")
+	}
+	ca := &certificates.CA{DB: db}
+	ca.UseKeyPassphrase(keyPassphrase)
+	err = ca.SetupCertificates()
+	if errors.Is(err, certificates.ErrCertificateAuthorityLocked) {
+		return nil, fmt.Errorf("the certificate authority keys are encrypted, provide the key passphrase with -keyfile, the %s systemd credential, %s, or run this command in a terminal", certificates.KeyPassphraseCredentialName, certificates.KeyPassphraseEnvironmentVariable)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ca, nil
+}
+
+// Runs before Drawbridge migrates the database on startup, so status and dry runs see the schema as it is.
+func runMigrateCommand(db *persistence.SQLiteRepository, args []string) error {
+	usage := `usage:
+  drawbridge migrate status
+      list every migration and whether it has been applied
+  drawbridge migrate up [-dry-run]
+      apply pending migrations. -dry-run applies them in a transaction that is rolled back`
+	if len(args) == 0 {
+		return fmt.Errorf("%s", usage)
+	}
+
+	switch args[0] {
+	case "status":
+		statuses, err := db.MigrationStatus()
+		if err != nil {
+			return err
+		}
+		for _, status := range statuses {
+			state := "pending"
+			if status.Applied {
+				state = fmt.Sprintf("applied %s", status.AppliedAt.Local().Format(time.RFC1123))
+			}
+			if status.ChecksumMismatch {
+				state += ", CHECKSUM MISMATCH"
+			}
+			fmt.Printf("%04d_%s\t%s\n", status.Version, status.Name, state)
+		}
+	case "up":
+		commandFlags := flag.NewFlagSet("up", flag.ContinueOnError)
+		dryRun := commandFlags.Bool("dry-run", false, "check that pending migrations apply without committing them")
+		err := commandFlags.Parse(args[1:])
+		if err != nil {
+			return err
+		}
+		migrate := db.Migrate
+		if *dryRun {
+			migrate = db.MigrateDryRun
+		}
+		applied, err := migrate()
+		if err != nil {
+			return err
+		}
+		if len(applied) == 0 {
+			fmt.Println("The database schema is up to date.")
+			return nil
+		}
+		for _, migration := range applied {
+			fmt.Printf("%04d_%s\n", migration.Version, migration.Name)
+		}
+		if *dryRun {
+			fmt.Printf("%d migrations would be applied. Nothing was changed.\n", len(applied))
+		} else {
+			fmt.Printf("Applied %d migrations.\n", len(applied))
+		}
+	default:
+		return fmt.Errorf("%s", usage)
+	}
+	return nil
+}
+
+func runBackupCommand(db *persistence.SQLiteRepository, args []string) error {
+	usage := `usage:
+  drawbridge backup [-encrypt] [-passphrase-file <file>] <destination>
+      write the database and certificate authority to a backup archive.
+      The backup holds the certificate authority keys, encrypt it unless it's stored somewhere safe`
+	commandFlags := flag.NewFlagSet("backup", flag.ContinueOnError)
+	encrypt := commandFlags.Bool("encrypt", false, "encrypt the backup with a passphrase you are asked for")
+	passphraseFile := commandFlags.String("passphrase-file", "", "encrypt the backup with the passphrase in this file")
+	err := commandFlags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if commandFlags.NArg() != 1 {
+		return fmt.Errorf("%s", usage)
+	}
+
+	var passphrase []byte
+	switch {
+	case *passphraseFile != "":
+		passphrase, err = certificates.ReadKeyPassphrase(*passphraseFile)
+	case *encrypt:
+		passphrase, err = promptNewPassphrase()
+	}
+	if err != nil {
+		return err
+	}
+
+	// Never overwrite an existing file, it might be another backup.
+	backupFile, err := os.OpenFile(commandFlags.Arg(0), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	manifest, err := backup.Create(db, backupFile, passphrase)
+	if closeErr := backupFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return errors.Join(err, os.Remove(commandFlags.Arg(0)))
+	}
+	fmt.Printf("Backed up %d files at schema version %d to %s.\n", len(manifest.Files), manifest.SchemaVersion, commandFlags.Arg(0))
+	return nil
+}
+
+// Runs before Drawbridge opens the database, as the restore replaces the database file.
+func runRestoreCommand(databasePath string, args []string) error {
+	usage := `usage:
+  drawbridge restore [-check] [-passphrase-file <file>] <backup>
+      restore a backup onto a fresh install. -check only validates the backup`
+	commandFlags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	check := commandFlags.Bool("check", false, "validate the backup without restoring it")
+	passphraseFile := commandFlags.String("passphrase-file", "", "decrypt the backup with the passphrase in this file")
+	err := commandFlags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if commandFlags.NArg() != 1 {
+		return fmt.Errorf("%s", usage)
+	}
+
+	contents, err := os.ReadFile(commandFlags.Arg(0))
+	if err != nil {
+		return err
+	}
+	var passphrase []byte
+	if backup.Encrypted(contents) {
+		if *passphraseFile != "" {
+			passphrase, err = certificates.ReadKeyPassphrase(*passphraseFile)
+		} else {
+			passphrase, err = promptPassphrase("Backup passphrase: ")
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	var manifest *backup.Manifest
+	if *check {
+		manifest, err = backup.Validate(contents, passphrase)
+	} else {
+		manifest, err = backup.Restore(contents, passphrase, databasePath)
+	}
+	if errors.Is(err, certificates.ErrIncorrectKeyPassphrase) {
+		return fmt.Errorf("incorrect backup passphrase")
+	}
+	if err != nil {
+		return err
+	}
+	if *check {
+		fmt.Printf("The backup created %s is valid and holds %d files.\n", manifest.CreatedAt.Local().Format(time.RFC1123), len(manifest.Files))
+	} else {
+		fmt.Printf("Restored the backup created %s. Start Drawbridge to pick it up.\n", manifest.CreatedAt.Local().Format(time.RFC1123))
+	}
+	return nil
+}
+
+// Diffs a configuration file against the database, and with apply, reconciles the database with it.
+func runPlanCommand(db *persistence.SQLiteRepository, args []string, apply bool) error {
+	usage := `usage:
+  drawbridge [-config <file>] plan [<file>]
+      list the changes that would make Drawbridge match the configuration file
+  drawbridge [-config <file>] apply [-yes] [<file>]
+      make those changes, after asking for confirmation unless -yes is passed`
+	commandFlags := flag.NewFlagSet("plan", flag.ContinueOnError)
+	yes := commandFlags.Bool("yes", false, "apply the changes without asking for confirmation")
+	err := commandFlags.Parse(args)
+	if err != nil {
+		return err
+	}
+	path := flagger.FLAGS.ConfigFile
+	if commandFlags.NArg() == 1 {
+		path = commandFlags.Arg(0)
+	}
+	if path == "" || commandFlags.NArg() > 1 || (*yes && !apply) {
+		return fmt.Errorf("%s", usage)
+	}
+
+	file, err := declarative.Load(path)
+	if err != nil {
+		return err
+	}
+	d := &drawbridge.Drawbridge{DB: db}
+	plan, err := declarative.NewPlan(d, file)
+	if err != nil {
+		return err
+	}
+	fmt.Print(plan.String())
+	if !apply || plan.Empty() {
+		return nil
+	}
+
+	if !*yes {
+		if !term.IsTerminal(int(os.Stdin.Fd())) {
+			return fmt.Errorf("run this command in a terminal or pass -yes")
+		}
+		fmt.Print("Apply these changes? Only 'yes' will be accepted: ")
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if strings.TrimSpace(answer) != "yes" {
+			return fmt.Errorf("apply cancelled")
+		}
+	}
+	err = plan.Apply(d, "cli")
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Applied %d changes. Restart Drawbridge to pick them up.\n", len(plan.Changes))
+	return nil
+}
+
+func runReplicationCommand(db *persistence.SQLiteRepository, keyPassphrase []byte, args []string) error {
+	usage := fmt.Sprintf(`usage:
+  drawbridge replication pair [-listen <host:port>] -standby-address <address> <pairing file>
+      make this Drawbridge the primary and write a pairing file for a standby Emissary clients reach at address.
+      The standby listens on the same -api port. Replication listens on port %d unless -listen is passed
+  drawbridge replication join [-force] <pairing file>
+      make this Drawbridge the standby of the primary that wrote the pairing file
+  drawbridge replication promote
+      stop following the primary and start accepting Emissary connections
+  drawbridge replication status
+      show this Drawbridge's part in replication`, replication.DefaultPort)
+	if len(args) == 0 {
+		return fmt.Errorf("%s", usage)
+	}
+
+	switch args[0] {
+	case "pair":
+		commandFlags := flag.NewFlagSet("pair", flag.ContinueOnError)
+		listen := commandFlags.String("listen", fmt.Sprintf("0.0.0.0:%d", replication.DefaultPort), "host and port the replication listener binds")
+		standbyAddress := commandFlags.String("standby-address", "", "the IP address or domain name Emissary clients reach the standby at")
+		err := commandFlags.Parse(args[1:])
+		if err != nil {
+			return err
+		}
+		if commandFlags.NArg() != 1 || *standbyAddress == "" {
+			return fmt.Errorf("%s", usage)
+		}
+		ca, err := loadCertificateAuthority(db, keyPassphrase)
+		if err != nil {
+			return err
+		}
+		pairing, err := replication.Pair(db, ca, *listen, *standbyAddress)
+		if err != nil {
+			return err
+		}
+		pairingJSON, err := json.MarshalIndent(pairing, "", "  ")
+		if err != nil {
+			return err
+		}
+		// The pairing file holds the standby's private key, and never overwrites another file.
+		pairingFile, err := os.OpenFile(commandFlags.Arg(0), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		_, err = pairingFile.Write(pairingJSON)
+		if closeErr := pairingFile.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Wrote the pairing file to %s. It holds the standby's private key: copy it to the standby securely, run `drawbridge replication join %s` there, then delete it.\n", commandFlags.Arg(0), commandFlags.Arg(0))
+		fmt.Printf("Restart Drawbridge to start replicating. New Emissary Bundles list both %s and %s.\n", pairing.PrimaryAddress, *standbyAddress)
+	case "join":
+		commandFlags := flag.NewFlagSet("join", flag.ContinueOnError)
+		force := commandFlags.Bool("force", false, "join even though this Drawbridge has been set up. Its services, devices, settings and certificate authority are replaced")
+		err := commandFlags.Parse(args[1:])
+		if err != nil {
+			return err
+		}
+		if commandFlags.NArg() != 1 {
+			return fmt.Errorf("%s", usage)
+		}
+		pairingJSON, err := os.ReadFile(commandFlags.Arg(0))
+		if err != nil {
+			return err
+		}
+		pairing := &replication.Pairing{}
+		err = json.Unmarshal(pairingJSON, pairing)
+		if err != nil {
+			return fmt.Errorf("not a Drawbridge pairing file: %w", err)
+		}
+		err = replication.Join(db, pairing, *force)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Joined the primary Drawbridge at %s. Start Drawbridge to follow it, and delete %s.\n", pairing.PrimaryAddress, commandFlags.Arg(0))
+	case "promote":
+		if len(args) != 1 {
+			return fmt.Errorf("%s", usage)
+		}
+		err := replication.Promote(db)
+		if err != nil {
+			return err
+		}
+		fmt.Println("Promoted this Drawbridge. If it is running, it starts accepting Emissary connections within a few seconds.")
+		fmt.Println("Don't start the previous primary again as it is. To make it the standby, run `drawbridge replication pair` here and `drawbridge replication join -force` there.")
+	case "status":
+		if len(args) != 1 {
+			return fmt.Errorf("%s", usage)
+		}
+		status, err := replication.GetStatus(db)
+		if err != nil {
+			return err
+		}
+		switch status.Role {
+		case replication.RolePrimary:
+			fmt.Printf("Primary, replicating on %s to the standby at %s.\n", status.ListenAddress, status.StandbyListeningAddress)
+		case replication.RoleStandby:
+			lastApplied := "never"
+			if !status.LastApplied.IsZero() {
+				lastApplied = status.LastApplied.Local().Format(time.RFC1123)
+			}
+			fmt.Printf("Standby of the primary at %s. Last applied an update from it: %s.\n", status.PrimaryAddress, lastApplied)
+		default:
+			fmt.Println("This Drawbridge doesn't replicate.")
+		}
+	default:
+		return fmt.Errorf("%s", usage)
+	}
+	return nil
+}
+
+// Changes the lockdown stored in the database. A running Drawbridge turns devices away as soon as lockdown is stored,
+// and ends their sessions and publishes the change to its event sinks within a few seconds.
+func runLockdownCommand(db *persistence.SQLiteRepository, args []string) error {
+	usage := `usage:
+  drawbridge lockdown engage [-reason <reason>]
+      turn away every Emissary device except the break-glass devices and end their sessions, until lockdown is lifted
+  drawbridge lockdown lift
+      let Emissary devices connect again
+  drawbridge lockdown status
+      show whether Drawbridge is in lockdown, its recent transitions and the break-glass devices
+  drawbridge lockdown break-glass [-clear] [<device id>...]
+      replace the break-glass devices, which lockdown still lets in`
+	if len(args) == 0 {
+		return fmt.Errorf("%s", usage)
+	}
+
+	d := &drawbridge.Drawbridge{DB: db}
+	switch args[0] {
+	case "engage":
+		commandFlags := flag.NewFlagSet("engage", flag.ContinueOnError)
+		reason := commandFlags.String("reason", "", "why Drawbridge is locked down, recorded with the lockdown and sent to devices that are turned away")
+		err := commandFlags.Parse(args[1:])
+		if err != nil {
+			return err
+		}
+		if commandFlags.NArg() != 0 {
+			return fmt.Errorf("%s", usage)
+		}
+		err = d.EngageLockdown("cli", *reason)
+		if err != nil {
+			return err
+		}
+		fmt.Println("Drawbridge is in lockdown. If it is running, it ends the sessions of every device but the break-glass devices within a few seconds.")
+	case "lift":
+		if len(args) != 1 {
+			return fmt.Errorf("%s", usage)
+		}
+		err := d.LiftLockdown("cli")
+		if err != nil {
+			return err
+		}
+		fmt.Println("Lifted the lockdown. Emissary devices can connect again.")
+	case "status":
+		if len(args) != 1 {
+			return fmt.Errorf("%s", usage)
+		}
+		transitions, err := db.GetLockdownTransitions(drawbridge.RecentLockdownTransitions)
+		if err != nil {
+			return err
+		}
+		if len(transitions) == 0 || !transitions[0].Active {
+			fmt.Println("Drawbridge isn't in lockdown.")
+		} else {
+			fmt.Println("Drawbridge is in lockdown.")
+		}
+		for _, transition := range transitions {
+			action := "lifted"
+			if transition.Active {
+				action = "engaged"
+			}
+			fmt.Printf("%s\t%s by %s\t%s\n", transition.CreatedAt.Local().Format(time.RFC1123), action, transition.Actor, transition.Reason)
+		}
+		breakGlass := d.BreakGlassDevices()
+		if len(breakGlass) == 0 {
+			fmt.Println("There are no break-glass devices.")
+		} else {
+			fmt.Printf("Break-glass devices: %s\n", strings.Join(breakGlass, ", "))
+		}
+	case "break-glass":
+		commandFlags := flag.NewFlagSet("break-glass", flag.ContinueOnError)
+		clearAll := commandFlags.Bool("clear", false, "remove every break-glass device")
+		err := commandFlags.Parse(args[1:])
+		if err != nil {
+			return err
+		}
+		if (commandFlags.NArg() == 0) != *clearAll {
+			return fmt.Errorf("%s", usage)
+		}
+		err = d.SaveBreakGlassDevices(commandFlags.Args())
+		if err != nil {
+			return err
+		}
+		if *clearAll {
+			fmt.Println("Removed every break-glass device. Lockdown lets no device in.")
+		} else {
+			fmt.Printf("Lockdown lets in %s.\n", strings.Join(d.BreakGlassDevices(), ", "))
+		}
+	default:
+		return fmt.Errorf("%s", usage)
+	}
+	return nil
+}
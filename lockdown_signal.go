@@ -0,0 +1,26 @@
+//go:build !windows
+
+package main
+
+import (
+	"imdawon/drawbridge/cmd/drawbridge"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// Engages lockdown when Drawbridge receives SIGUSR1, e.g. `pkill -USR1 drawbridge`, for when the Drawbridge Dashboard
+// can't be reached. Lift it from the Drawbridge Dashboard or with `drawbridge lockdown lift`.
+func notifyLockdownSignal(d *drawbridge.Drawbridge) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	go func() {
+		for range signals {
+			err := d.EngageLockdown("signal", "SIGUSR1")
+			if err != nil {
+				slog.Error("Lockdown", slog.Any("Error engaging lockdown on SIGUSR1", err))
+			}
+		}
+	}()
+}
@@ -0,0 +1,6 @@
+package main
+
+import "imdawon/drawbridge/cmd/drawbridge"
+
+// Windows has no SIGUSR1. Engage lockdown from the Drawbridge Dashboard or with `drawbridge lockdown engage`.
+func notifyLockdownSignal(d *drawbridge.Drawbridge) {}
@@ -5,8 +5,11 @@ import (
 	"imdawon/drawbridge/cmd/analytics"
 	"imdawon/drawbridge/cmd/dashboard/ui"
 	"imdawon/drawbridge/cmd/drawbridge"
+	"imdawon/drawbridge/cmd/drawbridge/declarative"
 	"imdawon/drawbridge/cmd/drawbridge/persistence"
+	"imdawon/drawbridge/cmd/drawbridge/replication"
 	"imdawon/drawbridge/cmd/drawbridge/services"
+	"imdawon/drawbridge/cmd/drawbridge/sinks"
 	flagger "imdawon/drawbridge/cmd/flags"
 	"imdawon/drawbridge/cmd/utils"
 	"log"
@@ -55,6 +58,18 @@ func main() {
 		"",
 		"if passed, the Drawbridge Dashboard will not automatically open in the default browser",
 	)
+	flag.StringVar(
+		&flagger.FLAGS.KeyFile,
+		"keyfile",
+		"",
+		"file containing the passphrase that encrypts the certificate authority and server keys at rest",
+	)
+	flag.StringVar(
+		&flagger.FLAGS.ConfigFile,
+		"config",
+		"",
+		"YAML or TOML file declaring Protected Services, devices and settings. 'drawbridge plan' and 'drawbridge apply' reconcile Drawbridge with it, and an authoritative file is applied on startup",
+	)
 	flag.Parse()
 
 	// Show debugger messages in development mode.
@@ -74,30 +89,87 @@ func main() {
 	execDirPath := path.Dir(execPath)
 	flagger.FLAGS.SqliteFilename = filepath.Join(execDirPath, flagger.FLAGS.SqliteFilename)
 
+	// `drawbridge restore` replaces the database file, so it runs before we open it.
+	if flag.Arg(0) == "restore" {
+		err = runRestoreCommand(flagger.FLAGS.SqliteFilename, flag.Args()[1:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	// Migrate sqlite tables
 	db := persistence.NewSQLiteRepository(persistence.OpenDatabaseFile(flagger.FLAGS.SqliteFilename))
-	err = db.MigrateServices()
-	if err != nil {
-		log.Fatalf("Error running services db migration: %s", err)
+	// `drawbridge migrate` inspects and applies migrations itself, so it runs before we migrate the database.
+	if flag.Arg(0) == "migrate" {
+		err = runMigrateCommand(db, flag.Args()[1:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
-	err = db.MigrateEmissaryClient()
+	_, err = db.Migrate()
 	if err != nil {
-		log.Fatalf("Error running emissary_client db migration: %s", err)
+		log.Fatalf("Error running db migrations: %s", err)
 	}
-	err = db.MigrateEmissaryClientEvent()
+
+	// Read the passphrase protecting the certificate authority and server keys, if they are encrypted.
+	keyPassphrase, err := readKeyPassphrase(flagger.FLAGS.KeyFile)
 	if err != nil {
-		log.Fatalf("Error running emissary_client_event db migration: %s", err)
+		log.Fatalf("Error reading key passphrase: %s", err)
 	}
-	err = db.MigrateDrawbridgeConfig()
-	if err != nil {
-		log.Fatalf("Error running drawbridge_config db migration: %s", err)
+
+	// Run a Drawbridge admin command, e.g. `drawbridge ca export-root root.key`, instead of starting the servers.
+	if flag.NArg() > 0 {
+		err = runCommand(db, keyPassphrase, flag.Args())
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
 
 	drawbridgeAPI := &drawbridge.Drawbridge{
-		ProtectedServices: make(map[int64]services.RunningProtectedService, 0),
-		DB:                db,
-		ListeningPort:     flagger.FLAGS.DrawbridgePort,
-		OutboundServices:  make(map[int64]*services.ProtectedService, 0),
+		ProtectedServices:   make(map[int64]services.RunningProtectedService, 0),
+		DB:                  db,
+		ListeningPort:       flagger.FLAGS.DrawbridgePort,
+		OutboundServices:    make(map[int64]*services.ProtectedService, 0),
+		KeyPassphrase:       keyPassphrase,
+		EventSinkDispatcher: sinks.NewDispatcher(),
+	}
+	drawbridgeAPI.LoadGeoIP()
+
+	// A standby gets its services, devices and settings from the primary, see the replication package.
+	role, err := replication.GetRole(db)
+	if err != nil {
+		log.Fatalf("Error reading replication role: %s", err)
+	}
+	// The primary publishes events to the event sinks, including the ones a standby replicates from it.
+	// A standby starts them when it is promoted.
+	if role != replication.RoleStandby {
+		drawbridgeAPI.StartEventSinks()
+	}
+
+	// An authoritative configuration file is the source of truth, so Drawbridge starts out matching it.
+	// The Drawbridge Dashboard flags edits that drift from it.
+	var configDrift *declarative.DriftDetector
+	if flagger.FLAGS.ConfigFile != "" && role != replication.RoleStandby {
+		configFile, err := declarative.Load(flagger.FLAGS.ConfigFile)
+		if err != nil {
+			log.Fatalf("Error loading configuration file: %s", err)
+		}
+		if configFile.Authoritative {
+			plan, err := declarative.NewPlan(drawbridgeAPI, configFile)
+			if err == nil {
+				err = plan.Apply(drawbridgeAPI, "config file "+flagger.FLAGS.ConfigFile)
+			}
+			if err != nil {
+				log.Fatalf("Error applying configuration file: %s", err)
+			}
+			if !plan.Empty() {
+				slog.Info("Config File", slog.String("Applied configuration file", flagger.FLAGS.ConfigFile), slog.String("changes", plan.String()))
+			}
+			configDrift = declarative.NewDriftDetector(drawbridgeAPI, flagger.FLAGS.ConfigFile, configFile)
+		}
 	}
 
 	// Onboarding configuration has been complete and we can load all existing config files and start servers.
@@ -114,7 +186,13 @@ func main() {
 	if err != nil {
 		slog.Error("Database", slog.Any("Error: %s", err))
 	}
-	if *listeningAddress == "" {
+	if role == replication.RoleStandby {
+		// The standby doesn't accept Emissary connections until it is promoted.
+		err = drawbridgeAPI.FollowPrimary()
+		if err != nil {
+			log.Fatalf("Error following the primary Drawbridge: %s", err)
+		}
+	} else if *listeningAddress == "" {
 		if utils.FileExists("config/listening_address.txt") {
 			addressBytes := utils.ReadFile("config/listening_address.txt")
 			// If someone has a historical Drawbridge install, we will insert their listening address
@@ -137,6 +215,10 @@ func main() {
 	}
 
 	drawbridgeAPI.ListeningAddress = *listeningAddress
+	if role != replication.RoleStandby {
+		drawbridgeAPI.StartPrimaryJobs()
+	}
+	notifyLockdownSignal(drawbridgeAPI)
 
 	// Initalize DAU ping only if enabled by the Drawbridge admin.
 	dauPingEnabled, err := db.GetDrawbridgeConfigValueByName("dau_ping_enabled")
@@ -173,7 +255,8 @@ func main() {
 	frontendController := ui.Controller{
 		DrawbridgeAPI:     drawbridgeAPI,
 		ProtectedServices: services,
-		DB:                db}
+		DB:                db,
+		ConfigDrift:       configDrift}
 
 	// Set up templ controller used to return hypermedia to our htmx frontend.
 	frontendController.SetUp(flagger.FLAGS.FrontendAPIHostAndPort)
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	certificates "imdawon/drawbridge/cmd/reverse_proxy/ca"
+	"os"
+
+	"golang.org/x/term"
+)
+
+// Returns the key passphrase from the -keyfile flag, the systemd credential, or the environment.
+// If none are set and the keys on disk are encrypted, we prompt for it when Drawbridge runs in a terminal.
+// Otherwise Drawbridge starts with the certificate authority locked.
+func readKeyPassphrase(keyFile string) ([]byte, error) {
+	passphrase, err := certificates.ReadKeyPassphrase(keyFile)
+	if err != nil || passphrase != nil {
+		return passphrase, err
+	}
+	if !certificates.PrivateKeysEncrypted() || !term.IsTerminal(int(os.Stdin.Fd())) {
+		return nil, nil
+	}
+	return promptPassphrase("Drawbridge key passphrase: ")
+}
+
+func promptPassphrase(prompt string) ([]byte, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	passphrase, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	if len(passphrase) == 0 {
+		return nil, fmt.Errorf("the passphrase can't be empty")
+	}
+	return passphrase, nil
+}
+
+// Prompts for a new passphrase twice to catch typos.
+func promptNewPassphrase() ([]byte, error) {
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return nil, fmt.Errorf("run this command in a terminal or pass -from-file")
+	}
+	passphrase, err := promptPassphrase("New key passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+	confirmation, err := promptPassphrase("Confirm new key passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(passphrase, confirmation) {
+		return nil, fmt.Errorf("the passphrases don't match")
+	}
+	return passphrase, nil
+}